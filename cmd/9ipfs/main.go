@@ -103,7 +103,7 @@ func newFileServer(ipfsNode *ipfs.IPFS) *fileServer {
 }
 
 // Rversion initiates the session
-func (fs *fileServer) Rversion(msize protocol.MaxSize, version string) (protocol.MaxSize, string, error) {
+func (fs *fileServer) Rversion(ctx context.Context, msize protocol.MaxSize, version string) (protocol.MaxSize, string, error) {
 	if version != "9P2000" {
 		return 0, "unknown", nil
 	}
@@ -111,7 +111,7 @@ func (fs *fileServer) Rversion(msize protocol.MaxSize, version string) (protocol
 }
 
 // Rattach attaches a fid to the root for the given user.  aname and afid are not used.
-func (fs *fileServer) Rattach(fid protocol.FID, afid protocol.FID, uname string, aname string) (protocol.QID, error) {
+func (fs *fileServer) Rattach(ctx context.Context, fid protocol.FID, afid protocol.FID, uname string, aname string) (protocol.QID, error) {
 	if afid != protocol.NOFID {
 		return protocol.QID{}, ErrUnknownFID
 	}
@@ -121,13 +121,12 @@ func (fs *fileServer) Rattach(fid protocol.FID, afid protocol.FID, uname string,
 }
 
 // Rflush does nothing.
-func (fs *fileServer) Rflush(o protocol.Tag) error {
+func (fs *fileServer) Rflush(ctx context.Context, o protocol.Tag) error {
 	return nil
 }
 
 // Rwalk walks the hierarchy from fid, with the walk path determined by paths
-func (fs *fileServer) Rwalk(fid protocol.FID, newfid protocol.FID, names []string) ([]protocol.QID, error) {
-	ctx := context.Background()
+func (fs *fileServer) Rwalk(ctx context.Context, fid protocol.FID, newfid protocol.FID, names []string) ([]protocol.QID, error) {
 
 	// Lookup the parent fid
 	parent, err := fs.getFile(fid)
@@ -170,7 +169,7 @@ func (fs *fileServer) Rwalk(fid protocol.FID, newfid protocol.FID, names []strin
 }
 
 // Ropen opens the file associated with fid
-func (fs *fileServer) Ropen(fid protocol.FID, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+func (fs *fileServer) Ropen(ctx context.Context, fid protocol.FID, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
 	if mode&(protocol.OTRUNC|protocol.ORCLOSE|protocol.OAPPEND) != 0 {
 		return protocol.QID{}, 0, ErrPermission
 	}
@@ -191,18 +190,18 @@ func (fs *fileServer) Ropen(fid protocol.FID, mode protocol.Mode) (protocol.QID,
 }
 
 // Rcreate not supported since it's a read-only filesystem
-func (fs *fileServer) Rcreate(fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+func (fs *fileServer) Rcreate(ctx context.Context, fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
 	return protocol.QID{}, 0, ErrPermission
 }
 
 // Rclunk drops the fid association in the file system
-func (fs *fileServer) Rclunk(fid protocol.FID) error {
+func (fs *fileServer) Rclunk(ctx context.Context, fid protocol.FID) error {
 	_, err := fs.clunk(fid)
 	return err
 }
 
 // Rstat returns stat message for the file associated with fid
-func (fs *fileServer) Rstat(fid protocol.FID) ([]byte, error) {
+func (fs *fileServer) Rstat(ctx context.Context, fid protocol.FID) ([]byte, error) {
 	f, err := fs.getFile(fid)
 	if err != nil {
 		return []byte{}, err
@@ -216,24 +215,22 @@ func (fs *fileServer) Rstat(fid protocol.FID) ([]byte, error) {
 }
 
 // Rwstat not supported since it's a read-only filesystem
-func (fs *fileServer) Rwstat(fid protocol.FID, b []byte) error {
+func (fs *fileServer) Rwstat(ctx context.Context, fid protocol.FID, b []byte) error {
 	return ErrPermission
 }
 
 // Rremove not supported since it's a read-only filesystem
-func (fs *fileServer) Rremove(fid protocol.FID) error {
+func (fs *fileServer) Rremove(ctx context.Context, fid protocol.FID) error {
 	return ErrPermission
 }
 
 // Rread returns up to c bytes from file fid starting at offset o
-func (fs *fileServer) Rread(fid protocol.FID, offset protocol.Offset, count protocol.Count) ([]byte, error) {
+func (fs *fileServer) Rread(ctx context.Context, fid protocol.FID, offset protocol.Offset, count protocol.Count) ([]byte, error) {
 	f, err := fs.getFile(fid)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx := context.Background()
-
 	switch f.Type {
 	case icore.TDirectory:
 		entries, err := fs.ipfs.ReadDir(ctx, f)
@@ -289,7 +286,7 @@ func (fs *fileServer) Rread(fid protocol.FID, offset protocol.Offset, count prot
 }
 
 // Rwrite not supported since it's a read-only filesystem
-func (fs *fileServer) Rwrite(fid protocol.FID, o protocol.Offset, b []byte) (protocol.Count, error) {
+func (fs *fileServer) Rwrite(ctx context.Context, fid protocol.FID, o protocol.Offset, b []byte) (protocol.Count, error) {
 	return 0, ErrPermission
 }
 
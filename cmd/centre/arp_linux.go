@@ -0,0 +1,106 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	ethPArp      = 0x0806
+	ethPIP       = 0x0800
+	arpRequest   = 1
+	arpReply     = 2
+	arpHdrEther  = 1
+	ethHeaderLen = 14
+	arpLen       = 28
+)
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// arpProbe sends an RFC 5227 ARP probe for ip on the named interface and
+// waits up to timeout for an answer. It returns the hardware address of
+// whoever answers, or nil if nobody does.
+func arpProbe(inf string, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	ip = ip.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("arp probe: %v is not an IPv4 address", ip)
+	}
+	ifi, err := net.InterfaceByName(inf)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPArp)))
+	if err != nil {
+		return nil, fmt.Errorf("arp probe: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	sa := &syscall.SockaddrLinklayer{Protocol: htons(ethPArp), Ifindex: ifi.Index}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, fmt.Errorf("arp probe: bind %v: %v", inf, err)
+	}
+
+	// A probe has a sender IP of 0.0.0.0 so that it doesn't pollute
+	// anyone's ARP cache should the address turn out to be taken.
+	var b bytes.Buffer
+	b.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	b.Write(ifi.HardwareAddr)
+	binary.Write(&b, binary.BigEndian, []uint16{ethPArp, arpHdrEther, ethPIP})
+	b.Write([]byte{6, 4})
+	binary.Write(&b, binary.BigEndian, uint16(arpRequest))
+	b.Write(ifi.HardwareAddr)
+	b.Write(net.IPv4zero.To4())
+	b.Write(make([]byte, 6))
+	b.Write(ip)
+
+	dst := &syscall.SockaddrLinklayer{
+		Protocol: htons(ethPArp),
+		Ifindex:  ifi.Index,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	if err := syscall.Sendto(fd, b.Bytes(), 0, dst); err != nil {
+		return nil, fmt.Errorf("arp probe: send: %v", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, nil
+		}
+		tv := syscall.NsecToTimeval(left.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return nil, fmt.Errorf("arp probe: %v", err)
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("arp probe: receive: %v", err)
+		}
+		if n < ethHeaderLen+arpLen {
+			continue
+		}
+		arp := buf[ethHeaderLen : ethHeaderLen+arpLen]
+		if binary.BigEndian.Uint16(arp[6:8]) != arpReply {
+			continue
+		}
+		if !net.IP(arp[14:18]).Equal(ip) {
+			continue
+		}
+		return net.HardwareAddr(append([]byte{}, arp[8:14]...)), nil
+	}
+}
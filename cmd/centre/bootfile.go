@@ -0,0 +1,78 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// classBootFile is the boot file for clients whose vendor class, which
+// they send in DHCP option 60, starts with prefix.
+type classBootFile struct {
+	prefix string
+	file   string
+}
+
+// classBootFiles is a set of classBootFile, longest prefix first.
+type classBootFiles []classBootFile
+
+// parseClassBootFiles parses a comma-separated list of class=file
+// pairs, e.g. PXEClient:Arch:00007=ipxe.efi,Acme=acme.0. A class may
+// hold colons, as PXE's do, but not commas or equals signs.
+func parseClassBootFiles(s string) (classBootFiles, error) {
+	var c classBootFiles
+	if s == "" {
+		return c, nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		i := strings.Index(p, "=")
+		if i <= 0 || i == len(p)-1 {
+			return nil, fmt.Errorf("%q: want class=file", p)
+		}
+		c = append(c, classBootFile{prefix: p[:i], file: p[i+1:]})
+	}
+	sort.SliceStable(c, func(i, j int) bool { return len(c[i].prefix) > len(c[j].prefix) })
+	return c, nil
+}
+
+// lookup returns the boot file for vendor class class: that of the
+// longest prefix of it there is one for.
+func (c classBootFiles) lookup(class string) (string, bool) {
+	for _, f := range c {
+		if strings.HasPrefix(class, f.prefix) {
+			return f.file, true
+		}
+	}
+	return "", false
+}
+
+// httpsURL returns file, if it is an http:// URL for the HTTP server
+// at self and httpPort, as the https:// URL for the same path on the
+// HTTPS server at httpsPort. Any other file is returned as it is.
+func httpsURL(file string, self net.IP, httpPort, httpsPort int) string {
+	u, err := url.Parse(file)
+	if err != nil || u.Scheme != "http" || !net.ParseIP(u.Hostname()).Equal(self) {
+		return file
+	}
+	port := 80
+	if p := u.Port(); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return file
+		}
+	}
+	if port != httpPort {
+		return file
+	}
+	u.Scheme, u.Host = "https", self.String()
+	if httpsPort != 443 {
+		u.Host = net.JoinHostPort(u.Host, strconv.Itoa(httpsPort))
+	}
+	return u.String()
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClassBootFiles(t *testing.T) {
+	c, err := parseClassBootFiles("PXEClient=pxelinux.0,PXEClient:Arch:00007=ipxe.efi,Acme Appliance=acme.0")
+	if err != nil {
+		t.Fatalf("parseClassBootFiles: want nil, got %v", err)
+	}
+	for _, tt := range []struct {
+		class string
+		file  string
+		ok    bool
+	}{
+		{"PXEClient:Arch:00000:UNDI:002001", "pxelinux.0", true},
+		// The longest prefix wins, wherever it was in the list.
+		{"PXEClient:Arch:00007:UNDI:003016", "ipxe.efi", true},
+		{"Acme Appliance v2", "acme.0", true},
+		{"Acme", "", false},
+		{"", "", false},
+	} {
+		if f, ok := c.lookup(tt.class); f != tt.file || ok != tt.ok {
+			t.Errorf("lookup(%q): want (%q, %v), got (%q, %v)", tt.class, tt.file, tt.ok, f, ok)
+		}
+	}
+
+	for _, s := range []string{"PXEClient", "=x.0", "PXEClient=", "a=b,,c=d"} {
+		if _, err := parseClassBootFiles(s); err == nil {
+			t.Errorf("parseClassBootFiles(%q): want an error, got nil", s)
+		}
+	}
+}
+
+func TestHTTPSURL(t *testing.T) {
+	self := net.ParseIP("192.168.0.1")
+	for _, tt := range []struct {
+		file                string
+		httpPort, httpsPort int
+		want                string
+	}{
+		{"http://192.168.0.1/ipxe.efi", 80, 443, "https://192.168.0.1/ipxe.efi"},
+		{"http://192.168.0.1:80/boot/vmlinuz?x=1", 80, 8443, "https://192.168.0.1:8443/boot/vmlinuz?x=1"},
+		{"http://192.168.0.1:8080/ipxe.efi", 8080, 443, "https://192.168.0.1/ipxe.efi"},
+		// Not our HTTP server, or not HTTP at all: left alone.
+		{"http://192.168.0.1:8080/ipxe.efi", 80, 443, "http://192.168.0.1:8080/ipxe.efi"},
+		{"http://10.0.0.1/ipxe.efi", 80, 443, "http://10.0.0.1/ipxe.efi"},
+		{"https://192.168.0.1/ipxe.efi", 80, 443, "https://192.168.0.1/ipxe.efi"},
+		{"pxelinux.0", 80, 443, "pxelinux.0"},
+	} {
+		if got := httpsURL(tt.file, self, tt.httpPort, tt.httpsPort); got != tt.want {
+			t.Errorf("httpsURL(%q, %d, %d): got %q, want %q", tt.file, tt.httpPort, tt.httpsPort, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// hostEntry is a line of a host file, as lookupIP reads it.
+type hostEntry struct {
+	line  int
+	ip    net.IP
+	names []string
+	// mac is the MAC address among the names, if there is one, and
+	// oldStyle is set if it was written with colons.
+	mac      net.HardwareAddr
+	oldStyle bool
+}
+
+func (e hostEntry) String() string {
+	s := fmt.Sprintf("%v %s", e.ip, strings.Join(e.names, " "))
+	if e.mac != nil {
+		s += fmt.Sprintf(" (MAC %v)", e.mac)
+	}
+	return s
+}
+
+// hostMAC returns the MAC address in a host name of the form lookupIP
+// is asked for: a "u" and the address in hex, without colons, or with
+// them in the old style.
+func hostMAC(name string) (mac net.HardwareAddr, oldStyle bool) {
+	if len(name) < 2 || (name[0] != 'u' && name[0] != 'U') {
+		return nil, false
+	}
+	if b, err := hex.DecodeString(name[1:]); err == nil && len(b) == 6 {
+		return net.HardwareAddr(b), false
+	}
+	if m, err := net.ParseMAC(name[1:]); err == nil && strings.Contains(name, ":") {
+		return m, true
+	}
+	return nil, false
+}
+
+// checkHosts reads the host file r, named name, and writes to w each
+// entry and route in it, each line lookupIP skips or misreads and why, and each
+// IP or MAC address given more than once, of which lookupIP only ever
+// finds the first. It returns the number of problems.
+func checkHosts(w io.Writer, r io.Reader, name string) (int, error) {
+	var problems int
+	warn := func(line int, format string, args ...interface{}) {
+		problems++
+		fmt.Fprintf(w, "%s:%d: %s\n", name, line, fmt.Sprintf(format, args...))
+	}
+	ips := make(map[string]int)
+	macs := make(map[string]int)
+	scan := bufio.NewScanner(r)
+	for n := 1; scan.Scan(); n++ {
+		fields := strings.Fields(scan.Text())
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(fields[0], "#"):
+			continue
+		case fields[0] == routeKeyword:
+			if r, mac, err := parseRouteLine(fields); err != nil {
+				warn(n, "skipped: %v", err)
+			} else {
+				fmt.Fprintf(w, "%s:%d: %v for %v\n", name, n, r, mac)
+			}
+			continue
+		case len(fields) < 2:
+			warn(n, "skipped: no host names after %q", fields[0])
+			continue
+		}
+		e := hostEntry{line: n, ip: net.ParseIP(fields[0]), names: fields[1:]}
+		if e.ip == nil {
+			warn(n, "skipped: %q is not an IP address", fields[0])
+			continue
+		}
+		for i, f := range e.names {
+			if strings.HasPrefix(f, "#") {
+				warn(n, "%q is taken as a host name: only a # at the start of a line is a comment", f)
+			}
+			mac, old := hostMAC(f)
+			switch {
+			case mac == nil:
+				continue
+			case e.mac != nil:
+				warn(n, "more than one MAC address: %v and %v", e.mac, mac)
+				continue
+			case i != len(e.names)-1:
+				warn(n, "MAC address %v is not at the end of the line", mac)
+			}
+			e.mac, e.oldStyle = mac, old
+		}
+		if e.oldStyle {
+			warn(n, "old style MAC address: write u%s", strings.Replace(e.mac.String(), ":", "", -1))
+		}
+		fmt.Fprintf(w, "%s:%d: %v\n", name, n, e)
+		if l, ok := ips[e.ip.String()]; ok {
+			warn(n, "IP address %v is also given to line %d; two machines would get the same address", e.ip, l)
+		} else {
+			ips[e.ip.String()] = n
+		}
+		if e.mac == nil {
+			continue
+		}
+		if l, ok := macs[e.mac.String()]; ok {
+			warn(n, "MAC address %v is also on line %d; that line is used, and this one ignored", e.mac, l)
+		} else {
+			macs[e.mac.String()] = n
+		}
+	}
+	return problems, scan.Err()
+}
+
+// checkHostsCmd is centre check-hosts: it checks the host files named
+// in args, and returns the exit status.
+func checkHostsCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: centre check-hosts file...")
+		return 2
+	}
+	status := 0
+	for _, a := range args {
+		f, err := os.Open(a)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		n, err := checkHosts(os.Stdout, f, a)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", a, err)
+		}
+		if n > 0 || err != nil {
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheckHosts(t *testing.T) {
+	hosts := `# The usual.
+192.168.0.1 centre
+192.168.0.5 harvey u020000000005
+
+192.168.0.6
+192.168.0.7.8 broken u020000000007
+192.168.0.9 old u02:00:00:00:00:09
+192.168.0.10 u02000000000a late # the tenth
+192.168.0.5 again u02000000000b
+192.168.0.12 twin u020000000005
+fe80::1 six
+route 10.1.0.0/16 192.168.0.254 u020000000005
+route 10.1.0.0/16 192.168.0.254
+`
+	var b bytes.Buffer
+	n, err := checkHosts(&b, strings.NewReader(hosts), "hosts")
+	if err != nil {
+		t.Fatalf("checkHosts: want nil, got %v", err)
+	}
+	want := `hosts:2: 192.168.0.1 centre
+hosts:3: 192.168.0.5 harvey u020000000005 (MAC 02:00:00:00:00:05)
+hosts:5: skipped: no host names after "192.168.0.6"
+hosts:6: skipped: "192.168.0.7.8" is not an IP address
+hosts:7: old style MAC address: write u020000000009
+hosts:7: 192.168.0.9 old u02:00:00:00:00:09 (MAC 02:00:00:00:00:09)
+hosts:8: MAC address 02:00:00:00:00:0a is not at the end of the line
+hosts:8: "#" is taken as a host name: only a # at the start of a line is a comment
+hosts:8: 192.168.0.10 u02000000000a late # the tenth (MAC 02:00:00:00:00:0a)
+hosts:9: 192.168.0.5 again u02000000000b (MAC 02:00:00:00:00:0b)
+hosts:9: IP address 192.168.0.5 is also given to line 3; two machines would get the same address
+hosts:10: 192.168.0.12 twin u020000000005 (MAC 02:00:00:00:00:05)
+hosts:10: MAC address 02:00:00:00:00:05 is also on line 3; that line is used, and this one ignored
+hosts:11: fe80::1 six
+hosts:12: route to 10.1.0.0/16 via 192.168.0.254 for 02:00:00:00:00:05
+hosts:13: skipped: want route <dest>/<bits> <router> u<mac>
+`
+	if got := b.String(); got != want {
+		t.Errorf("checkHosts: want\n%s\ngot\n%s", want, got)
+	}
+	if n != 8 {
+		t.Errorf("checkHosts: want 8 problems, got %d", n)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"harvey-os.org/ninep/tmpfs"
+)
+
+// openImage indexes the tar file n, for -image. The file stays open,
+// since the archive's files are read from it. The archive is an fs.FS,
+// served over HTTP with http.FS.
+func openImage(n string) (*tmpfs.Archive, error) {
+	f, err := os.Open(n)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a, err := tmpfs.IndexImageTar(f, st.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", n, err)
+	}
+	return a, nil
+}
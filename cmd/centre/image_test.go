@@ -0,0 +1,77 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImageHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := filepath.Join(dir, "root.tar")
+	f, err := os.Create(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	for _, e := range []struct{ name, body string }{
+		{"boot/kernel", "ELF and so on"},
+		{"lib/ndb/local", "sys=centre"},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	img, err := openImage(n)
+	if err != nil {
+		t.Fatalf("openImage: want nil, got %v", err)
+	}
+	h := http.FileServer(http.FS(img))
+	for _, tc := range []struct {
+		path, rng string
+		code      int
+		want      string
+	}{
+		{path: "/boot/kernel", code: http.StatusOK, want: "ELF and so on"},
+		{path: "/boot/kernel", rng: "bytes=4-6", code: http.StatusPartialContent, want: "and"},
+		{path: "/lib/ndb/local", code: http.StatusOK, want: "sys=centre"},
+		{path: "/lib/", code: http.StatusOK, want: `<a href="ndb/">ndb/</a>`},
+		{path: "/boot/initrd", code: http.StatusNotFound},
+		{path: "/boot/kernel/x", code: http.StatusNotFound},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.rng != "" {
+			r.Header.Set("Range", tc.rng)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.code || !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("GET %s %s: want %d and %q, got %d and %q", tc.path, tc.rng, tc.code, tc.want, w.Code, w.Body.String())
+		}
+	}
+
+	if _, err := openImage(filepath.Join(dir, "nothing.tar")); err == nil {
+		t.Errorf("openImage of a missing file: want err, got nil")
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A lease is an address handed to a client.
+type lease struct {
+	MAC      string    `json:"mac"`
+	IP       net.IP    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expires  time.Time `json:"expires"` // zero if never
+}
+
+// A leaseHook is told what centre does with leases, e.g. to keep an
+// IPAM or CMDB up to date. Its methods are called one at a time, in
+// order, but not on the DHCP reply path: see asyncHook.
+type leaseHook interface {
+	// OnOffer is called for each address offered.
+	OnOffer(l lease)
+	// OnAck is called for each lease granted, or renewed.
+	OnAck(l lease)
+	// OnExpire is called when a lease runs out without being renewed.
+	OnExpire(l lease)
+	// OnRelease is called when a client gives its lease back.
+	OnRelease(l lease)
+	// OnDecline is called when a client declines an address because
+	// another machine has it: somebody may want to find out which.
+	OnDecline(l lease)
+}
+
+// leaseHooks tells each of its hooks in turn.
+type leaseHooks []leaseHook
+
+func (hs leaseHooks) OnOffer(l lease) {
+	for _, h := range hs {
+		h.OnOffer(l)
+	}
+}
+
+func (hs leaseHooks) OnAck(l lease) {
+	for _, h := range hs {
+		h.OnAck(l)
+	}
+}
+
+func (hs leaseHooks) OnExpire(l lease) {
+	for _, h := range hs {
+		h.OnExpire(l)
+	}
+}
+
+func (hs leaseHooks) OnRelease(l lease) {
+	for _, h := range hs {
+		h.OnRelease(l)
+	}
+}
+
+func (hs leaseHooks) OnDecline(l lease) {
+	for _, h := range hs {
+		h.OnDecline(l)
+	}
+}
+
+// fileHook appends a line for each lease event to a file:
+//
+//	<time> <event> <mac> <ip> <expiry or -> [hostname]
+//
+// The file is opened for each line, so that it can be rotated.
+type fileHook struct {
+	name string
+}
+
+func (f fileHook) OnOffer(l lease)   { f.write("offer", l) }
+func (f fileHook) OnAck(l lease)     { f.write("ack", l) }
+func (f fileHook) OnExpire(l lease)  { f.write("expire", l) }
+func (f fileHook) OnRelease(l lease) { f.write("release", l) }
+func (f fileHook) OnDecline(l lease) { f.write("decline", l) }
+
+func (f fileHook) write(event string, l lease) {
+	expires := "-"
+	if !l.Expires.IsZero() {
+		expires = l.Expires.UTC().Format(time.RFC3339)
+	}
+	line := fmt.Sprintf("%s %s %s %s %s %s\n", time.Now().UTC().Format(time.RFC3339), event, l.MAC, l.IP, expires, l.Hostname)
+	o, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("lease file: %v", err)
+		return
+	}
+	defer o.Close()
+	if _, err := o.WriteString(line); err != nil {
+		log.Printf("lease file: %v", err)
+	}
+}
+
+// httpHook POSTs each lease event to a URL, as JSON: the lease, with
+// "event" set to offer, ack, expire, release or decline.
+type httpHook struct {
+	url    string
+	client *http.Client
+}
+
+func (h httpHook) OnOffer(l lease)   { h.post("offer", l) }
+func (h httpHook) OnAck(l lease)     { h.post("ack", l) }
+func (h httpHook) OnExpire(l lease)  { h.post("expire", l) }
+func (h httpHook) OnRelease(l lease) { h.post("release", l) }
+func (h httpHook) OnDecline(l lease) { h.post("decline", l) }
+
+func (h httpHook) post(event string, l lease) {
+	b, err := json.Marshal(struct {
+		Event string `json:"event"`
+		lease
+	}{event, l})
+	if err != nil {
+		log.Printf("lease URL: %v", err)
+		return
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Printf("lease URL: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("lease URL: %s %s for %s: %s", event, l.MAC, h.url, resp.Status)
+	}
+}
+
+// asyncHook runs a leaseHook's calls on a goroutine of its own, so that
+// a slow one, e.g. an HTTP endpoint that's down, never holds up a DHCP
+// reply. At most n calls wait; any more are dropped, and counted.
+type asyncHook struct {
+	h       leaseHook
+	calls   chan func()
+	done    chan struct{}
+	dropped int64
+}
+
+func newAsyncHook(h leaseHook, n int) *asyncHook {
+	a := &asyncHook{h: h, calls: make(chan func(), n), done: make(chan struct{})}
+	go func() {
+		defer close(a.done)
+		for f := range a.calls {
+			f()
+		}
+	}()
+	return a
+}
+
+func (a *asyncHook) OnOffer(l lease)   { a.call("offer", l, a.h.OnOffer) }
+func (a *asyncHook) OnAck(l lease)     { a.call("ack", l, a.h.OnAck) }
+func (a *asyncHook) OnExpire(l lease)  { a.call("expire", l, a.h.OnExpire) }
+func (a *asyncHook) OnRelease(l lease) { a.call("release", l, a.h.OnRelease) }
+func (a *asyncHook) OnDecline(l lease) { a.call("decline", l, a.h.OnDecline) }
+
+func (a *asyncHook) call(event string, l lease, f func(lease)) {
+	select {
+	case a.calls <- func() { f(l) }:
+	default:
+		n := atomic.AddInt64(&a.dropped, 1)
+		log.Printf("lease hook: %d events waiting already, dropping %s for %s (%d dropped so far)", cap(a.calls), event, l.MAC, n)
+	}
+}
+
+// close waits for the calls already made to be run.
+func (a *asyncHook) close() {
+	close(a.calls)
+	<-a.done
+}
+
+// leases keeps the leases granted, so as to tell the hook when they
+// run out, and the addresses clients have declined, so as not to offer
+// them again for a while.
+type leases struct {
+	hook leaseHook
+
+	mu sync.Mutex
+	m  map[string]lease
+	// declined holds, for each address declined, when it may be
+	// offered again.
+	declined map[string]time.Time
+}
+
+func newLeases(h leaseHook) *leases {
+	return &leases{hook: h, m: make(map[string]lease), declined: make(map[string]time.Time)}
+}
+
+// offer tells the hook l was offered.
+func (ls *leases) offer(l lease) {
+	ls.hook.OnOffer(l)
+}
+
+// ack records l, in place of any lease its client had, and tells the
+// hook.
+func (ls *leases) ack(l lease) {
+	ls.mu.Lock()
+	ls.m[l.MAC] = l
+	ls.mu.Unlock()
+	ls.hook.OnAck(l)
+}
+
+// release forgets the lease of the client mac, if it is for ip, and
+// tells the hook. The hook is told even if there is no such lease, as
+// there won't be for one granted before centre last started.
+func (ls *leases) release(mac string, ip net.IP) {
+	ls.mu.Lock()
+	l, ok := ls.m[mac]
+	if ok && l.IP.Equal(ip) {
+		delete(ls.m, mac)
+	} else {
+		l = lease{MAC: mac, IP: ip}
+	}
+	ls.mu.Unlock()
+	ls.hook.OnRelease(l)
+}
+
+// decline forgets the lease of the client mac, if it is for ip, as the
+// client won't be using it, and has ip not offered again until until.
+// It tells the hook.
+func (ls *leases) decline(mac string, ip net.IP, until time.Time) {
+	ls.mu.Lock()
+	if l, ok := ls.m[mac]; ok && l.IP.Equal(ip) {
+		delete(ls.m, mac)
+	}
+	ls.declined[ip.String()] = until
+	ls.mu.Unlock()
+	ls.hook.OnDecline(lease{MAC: mac, IP: ip, Expires: until})
+}
+
+// isDeclined says whether ip was declined, and is not to be offered
+// yet, at now.
+func (ls *leases) isDeclined(ip net.IP, now time.Time) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	until, ok := ls.declined[ip.String()]
+	if ok && !now.Before(until) {
+		delete(ls.declined, ip.String())
+		ok = false
+	}
+	return ok
+}
+
+// expire forgets the leases which have run out by now, and tells the
+// hook about each, and the declines which have run out.
+func (ls *leases) expire(now time.Time) {
+	var gone []lease
+	ls.mu.Lock()
+	for mac, l := range ls.m {
+		if !l.Expires.IsZero() && !now.Before(l.Expires) {
+			gone = append(gone, l)
+			delete(ls.m, mac)
+		}
+	}
+	for ip, until := range ls.declined {
+		if !now.Before(until) {
+			delete(ls.declined, ip)
+		}
+	}
+	ls.mu.Unlock()
+	for _, l := range gone {
+		ls.hook.OnExpire(l)
+	}
+}
+
+// sweep expires leases every interval. It does not return.
+func (ls *leases) sweep(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		ls.expire(now)
+	}
+}
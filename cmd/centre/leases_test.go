@@ -0,0 +1,202 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordHook remembers the lease events it is told of, as "event mac".
+type recordHook struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordHook) OnOffer(l lease)   { r.record("offer", l) }
+func (r *recordHook) OnAck(l lease)     { r.record("ack", l) }
+func (r *recordHook) OnExpire(l lease)  { r.record("expire", l) }
+func (r *recordHook) OnRelease(l lease) { r.record("release", l) }
+func (r *recordHook) OnDecline(l lease) { r.record("decline", l) }
+
+func (r *recordHook) record(event string, l lease) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event+" "+l.MAC)
+}
+
+func (r *recordHook) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+// stuckHook is a hook which doesn't return until it is let go.
+type stuckHook struct {
+	recordHook
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *stuckHook) OnAck(l lease) {
+	s.entered <- struct{}{}
+	<-s.release
+	s.recordHook.OnAck(l)
+}
+
+func TestAsyncHookFull(t *testing.T) {
+	s := &stuckHook{entered: make(chan struct{}, 5), release: make(chan struct{})}
+	a := newAsyncHook(s, 2)
+	a.OnAck(lease{MAC: "0"})
+	<-s.entered
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// One in the hook, two waiting, and two to drop.
+		for i := 1; i < 5; i++ {
+			a.OnAck(lease{MAC: fmt.Sprint(i)})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnAck blocked on a stuck hook")
+	}
+	close(s.release)
+	a.close()
+	got := s.get()
+	if want := []string{"ack 0", "ack 1", "ack 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if n := atomic.LoadInt64(&a.dropped); n != 2 {
+		t.Errorf("dropped %d, want 2", n)
+	}
+}
+
+func TestLeaseExpire(t *testing.T) {
+	var r recordHook
+	ls := newLeases(&r)
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	ls.offer(lease{MAC: "a"})
+	ls.ack(lease{MAC: "a", Expires: now.Add(time.Hour)})
+	ls.ack(lease{MAC: "b", Expires: now.Add(time.Minute)})
+	ls.ack(lease{MAC: "forever"})
+	ls.expire(now)
+	ls.expire(now.Add(time.Minute))
+	// A renewal pushes the expiry back.
+	ls.ack(lease{MAC: "a", Expires: now.Add(3 * time.Hour)})
+	ls.expire(now.Add(2 * time.Hour))
+	ls.expire(now.Add(100 * time.Hour))
+	want := []string{"offer a", "ack a", "ack b", "ack forever", "expire b", "ack a", "expire a"}
+	if got := r.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLeaseDecline(t *testing.T) {
+	var r recordHook
+	ls := newLeases(&r)
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	ip := net.IPv4(192, 168, 0, 5)
+	ls.ack(lease{MAC: "a", IP: ip, Expires: now.Add(time.Hour)})
+	ls.decline("a", ip, now.Add(time.Minute))
+	if !ls.isDeclined(ip, now) {
+		t.Errorf("%v not declined straight after DECLINE", ip)
+	}
+	if ls.isDeclined(net.IPv4(192, 168, 0, 6), now) {
+		t.Errorf("192.168.0.6 declined, but only %v was", ip)
+	}
+	if ls.isDeclined(ip, now.Add(time.Minute)) {
+		t.Errorf("%v still declined after the decline time", ip)
+	}
+	// The declined lease is gone, and doesn't run out later.
+	ls.expire(now.Add(2 * time.Hour))
+	want := []string{"ack a", "decline a"}
+	if got := r.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLeaseRelease(t *testing.T) {
+	var r recordHook
+	ls := newLeases(&r)
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	ip := net.IPv4(192, 168, 0, 5)
+	ls.ack(lease{MAC: "a", IP: ip, Expires: now.Add(time.Hour)})
+	ls.ack(lease{MAC: "b", IP: net.IPv4(192, 168, 0, 6), Expires: now.Add(time.Hour)})
+	ls.release("a", ip)
+	// Releasing an address b hasn't got leaves its lease be.
+	ls.release("b", ip)
+	ls.expire(now.Add(2 * time.Hour))
+	want := []string{"ack a", "ack b", "release a", "release b", "expire b"}
+	if got := r.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFileHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := fileHook{name: filepath.Join(dir, "leases")}
+	ip := net.IPv4(192, 168, 0, 5)
+	f.OnOffer(lease{MAC: "02:00:00:00:00:05", IP: ip, Hostname: "harvey"})
+	f.OnExpire(lease{MAC: "02:00:00:00:00:05", IP: ip, Expires: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)})
+	b, err := ioutil.ReadFile(f.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	want := []string{
+		"offer 02:00:00:00:00:05 192.168.0.5 - harvey",
+		"expire 02:00:00:00:00:05 192.168.0.5 2021-03-01T12:00:00Z ",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %q, want %d lines", lines, len(want))
+	}
+	for i, l := range lines {
+		// Drop the time it was written.
+		if j := strings.Index(l, " "); j < 0 || l[j+1:] != want[i] {
+			t.Errorf("line %d: got %q, want <time> %q", i, l, want[i])
+		}
+	}
+}
+
+func TestHTTPHook(t *testing.T) {
+	got := make(chan map[string]string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			t.Errorf("decoding %s: %v", r.Method, err)
+		}
+		got <- m
+	}))
+	defer ts.Close()
+	h := httpHook{url: ts.URL, client: ts.Client()}
+	h.OnAck(lease{MAC: "02:00:00:00:00:05", IP: net.IPv4(192, 168, 0, 5), Expires: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)})
+	want := map[string]string{
+		"event":   "ack",
+		"mac":     "02:00:00:00:00:05",
+		"ip":      "192.168.0.5",
+		"expires": "2021-03-01T12:00:00Z",
+	}
+	if m := <-got; !reflect.DeepEqual(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+}
@@ -4,6 +4,9 @@
 
 // centre is used to support one or more of DHCP, TFTP, and HTTP services
 // on harvey networks.
+//
+// centre check-hosts file... checks host files, as given to -hostfile,
+// and reports what it makes of each line.
 package main
 
 import (
@@ -15,10 +18,13 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"harvey-os.org/ninep/protocol"
+	"harvey-os.org/ninep/tmpfs"
 	"harvey-os.org/ninep/ufs"
 	"pack.ag/tftp"
 )
@@ -33,9 +39,22 @@ var (
 	tftpPort   = flag.Int("tftp-port", 69, "Port to serve TFTP on")
 	httpDir    = flag.String("http-dir", "", "Directory to serve over HTTP")
 	httpPort   = flag.Int("http-port", 80, "Port to serve HTTP on")
+	httpsCert  = flag.String("https-cert", "", "Serve HTTPS too, alongside HTTP, with the PEM certificate in this file; http:// boot files on this server are then sent as https://")
+	httpsKey   = flag.String("https-key", "", "PEM key for -https-cert")
+	httpsPort  = flag.Int("https-port", 443, "Port to serve HTTPS on")
 	ninepDir   = flag.String("ninep-dir", "", "Directory to serve over 9p")
-	ninepAddr  = flag.String("ninep-addr", ":5640", "addr to serve 9p on")
+	ninepNet   = flag.String("ninep-net", "tcp4", "Network to serve 9p on: tcp4, unix, or vsock")
+	ninepAddr  = flag.String("ninep-addr", ":5640", "addr to serve 9p on: host:port, a path for unix, or cid:port for vsock")
 	ninepDebug = flag.Int("ninep-debug", 0, "Debug level for ninep -- for now, only non-zero matters")
+	image      = flag.String("image", "", "Uncompressed tar file to serve, read-only, over HTTP and 9p, in place of -http-dir and -ninep-dir")
+	watch      = flag.Bool("watch", false, "Watch -http-dir and -ninep-dir for changes, so that 9p QID versions and HTTP ETags, which are the same for a file served both ways, change with every change, however quick; Linux only")
+
+	ninepTLSCert     = flag.String("ninep-tls-cert", "", "Serve 9p over TLS, with the PEM certificate in this file")
+	ninepTLSKey      = flag.String("ninep-tls-key", "", "PEM key for -ninep-tls-cert")
+	ninepTLSClientCA = flag.String("ninep-tls-client-ca", "", "Require 9p clients to give certificates signed by a CA in this PEM file, and to attach as their certificate's common name")
+
+	maxTransfers   = flag.Int("max-transfers", 0, "Maximum number of TFTP and HTTP transfers at once; 0 means no limit")
+	transferReport = flag.Duration("transfer-report", time.Minute, "How often to log the number of TFTP and HTTP transfers")
 )
 
 // lookupIP looks up an IP address corresponding to the given name.
@@ -58,7 +77,7 @@ func lookupIP(hostFile string, addr string) (net.IP, []string, error) {
 		scan := bufio.NewScanner(f)
 		for scan.Scan() {
 			fields := strings.Fields(scan.Text())
-			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || fields[0] == routeKeyword {
 				continue
 			}
 			var hostnames []string
@@ -85,8 +104,49 @@ func lookupIP(hostFile string, addr string) (net.IP, []string, error) {
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "check-hosts" {
+		os.Exit(checkHostsCmd(flag.Args()[1:]))
+	}
+
+	if (*httpsCert == "") != (*httpsKey == "") {
+		log.Fatal("-https-cert and -https-key go together")
+	}
+
+	var img *tmpfs.Archive
+	if len(*image) != 0 {
+		if len(*httpDir) != 0 || len(*ninepDir) != 0 {
+			log.Fatal("-image can't be used with -http-dir or -ninep-dir")
+		}
+		if *watch {
+			log.Fatal("-watch can't be used with -image, which doesn't change")
+		}
+		var err error
+		if img, err = openImage(*image); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// One watcher for each tree, shared if -http-dir and -ninep-dir
+	// are the same one.
+	watchers := make(map[string]*watcher)
+	watchDir := func(dir string) *watcher {
+		dir = filepath.Clean(dir)
+		if w, ok := watchers[dir]; ok {
+			return w
+		}
+		w, err := newWatcher(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		watchers[dir] = w
+		return w
+	}
 
 	var wg sync.WaitGroup
+	xfers := newTransfers(*maxTransfers)
+	if len(*tftpDir) != 0 || len(*httpDir) != 0 || img != nil {
+		go xfers.report(*transferReport)
+	}
 	if len(*tftpDir) != 0 {
 		wg.Add(1)
 		go func() {
@@ -97,17 +157,32 @@ func main() {
 			}
 
 			log.Println("starting file server")
-			server.ReadHandler(tftp.FileServer(*tftpDir))
+			server.ReadHandler(xfers.tftpHandler(tftp.FileServer(*tftpDir)))
 			log.Fatal(server.ListenAndServe())
 		}()
 	}
-	if len(*httpDir) != 0 {
+	if len(*httpDir) != 0 || img != nil {
+		var fs http.FileSystem = http.Dir(*httpDir)
+		if img != nil {
+			fs = http.FS(img)
+		}
+		h := http.FileServer(fs)
+		if *watch {
+			h = watchHTTP(h, *httpDir, watchDir(*httpDir))
+		}
+		http.Handle("/", xfers.httpHandler(h))
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			http.Handle("/", http.FileServer(http.Dir(*httpDir)))
 			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *httpPort), nil))
 		}()
+		if *httpsCert != "" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%d", *httpsPort), *httpsCert, *httpsKey, nil))
+			}()
+		}
 	}
 
 	var dns []net.IP
@@ -125,19 +200,41 @@ func main() {
 		}
 	}
 	// TODO: serve on ip6
-	if len(*ninepDir) != 0 {
-		ln, err := net.Listen("tcp4", *ninepAddr)
+	if len(*ninepDir) != 0 || img != nil {
+		ln, err := protocol.ListenNet(*ninepNet, *ninepAddr)
 		if err != nil {
 			log.Fatalf("Listen failed: %v", err)
 		}
 
-		ufslistener, err := ufs.NewUFS(*ninepDir, *ninepDebug, func(l *protocol.NetListener) error {
+		trace := func(l *protocol.NetListener) error {
 			l.Trace = nil
 			if *ninepDebug > 1 {
 				l.Trace = log.Printf
 			}
 			return nil
-		})
+		}
+		opts := []protocol.NetListenerOpt{trace}
+		if *ninepTLSCert != "" {
+			config, err := protocol.LoadTLSConfig(*ninepTLSCert, *ninepTLSKey, *ninepTLSClientCA)
+			if err != nil {
+				log.Fatalf("9p TLS: %v", err)
+			}
+			opts = append(opts, protocol.WithTLS(config))
+		} else if *ninepTLSClientCA != "" {
+			log.Fatal("-ninep-tls-client-ca needs -ninep-tls-cert")
+		}
+		var ufslistener *protocol.NetListener
+		if img != nil {
+			ufslistener, err = protocol.NewNetListener(func() protocol.NineServer {
+				return tmpfs.NewFileServer(img, 1*1024*1024)
+			}, opts...)
+		} else {
+			var fsOpts []ufs.Opt
+			if *watch {
+				fsOpts = append(fsOpts, ufs.WithQIDFunc(watchQID(watchDir(*ninepDir))))
+			}
+			ufslistener, err = ufs.NewUFSWithOpts(*ninepDir, *ninepDebug, fsOpts, opts...)
+		}
 
 		if err != nil {
 			log.Fatal(err)
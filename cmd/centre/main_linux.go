@@ -11,13 +11,13 @@ import (
 	"log"
 	"math"
 	"net"
+	"net/http"
 	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
-	"github.com/insomniacslk/dhcp/dhcpv4/bsdp"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/insomniacslk/dhcp/dhcpv6/server6"
@@ -25,13 +25,30 @@ import (
 
 var (
 	// DHCPv4-specific
-	ipv4         = flag.Bool("4", true, "IPv4 DHCP server")
-	selfIP       = flag.String("ip", "192.168.0.1", "DHCPv4 IP of self")
-	rootpath     = flag.String("rootpath", "", "RootPath option to serve via DHCPv4")
-	bootfilename = flag.String("bootfilename", "pxelinux.0", "Boot file to serve via DHCPv4")
-	raspi        = flag.Bool("raspi", false, "Configure to boot Raspberry Pi")
-	gateway      = flag.String("gw", "", "Optional gateway IP for DHCPv4")
-	hostFile     = flag.String("hostfile", "", "Optional additional hosts file for DHCPv4")
+	ipv4          = flag.Bool("4", true, "IPv4 DHCP server")
+	selfIP        = flag.String("ip", "192.168.0.1", "DHCPv4 IP of self")
+	rootpath      = flag.String("rootpath", "", "RootPath option to serve via DHCPv4")
+	bootfilename  = flag.String("bootfilename", "pxelinux.0", "Boot file to serve via DHCPv4")
+	classBoot     = flag.String("class-bootfile", "", "Comma-separated class=file pairs: a DHCPv4 client whose vendor class (option 60) starts with class is sent file, not -bootfilename; the longest class wins")
+	raspi         = flag.Bool("raspi", false, "Configure to boot Raspberry Pi; the same as -pxe raspi")
+	pxe           = flag.String("pxe", "", "PXE profile to answer PXE clients with: pxe for standard PXE ROMs, raspi for Raspberry Pi, or empty for none")
+	pxeMenu       = flag.String("pxe-menu", "Harvey", "PXE boot menu item, for -pxe pxe")
+	pxePrompt     = flag.String("pxe-prompt", "", "Optional PXE menu prompt, for -pxe pxe")
+	pxeTimeout    = flag.Uint("pxe-timeout", 0, "Seconds to show the PXE menu prompt for, before booting the first menu item; 0 boots it at once, and 255 waits for a key")
+	pxeLocal      = flag.String("pxe-local", "", "Optional PXE menu item which boots from the local disk, for -pxe pxe; it needs -pxe-prompt, and a -pxe-timeout of less than 255")
+	pxeLocalFirst = flag.Bool("pxe-local-first", false, "Make the -pxe-local menu item the first, which is booted when the -pxe-timeout is up")
+	gateway       = flag.String("gw", "", "Optional gateway IP for DHCPv4")
+	routes        = flag.String("routes", "", "Comma-separated dest=router pairs, e.g. 10.1.0.0/16=192.168.0.254: classless static routes (option 121) for every DHCPv4 client, along with any the hosts file gives it in lines of the form 'route dest router u<mac>'")
+	hostFile      = flag.String("hostfile", "", "Optional additional hosts file for DHCPv4")
+	nextServer    = flag.String("next-server", "", "Optional TFTP server IP for DHCPv4 clients, if not this one")
+	probe         = flag.Bool("probe", false, "ARP-probe addresses before offering them, and don't offer any that are in use")
+	probeTimeout  = flag.Duration("probe-timeout", 500*time.Millisecond, "How long to wait for an answer to an ARP probe")
+	leaseTime     = flag.Duration("lease-time", 0, "DHCPv4 lease time; 0 for leases which never run out")
+	leaseFile     = flag.String("lease-file", "", "Optional file to append a line to for each DHCPv4 lease offered, granted, run out, released or declined")
+	leaseURL      = flag.String("lease-url", "", "Optional URL to POST each DHCPv4 lease offered, granted, run out, released or declined to, as JSON")
+	declineTime   = flag.Duration("decline-time", 10*time.Minute, "How long not to offer a DHCPv4 address a client has declined, as in use by another machine")
+	bindTimeout   = flag.Duration("bind-timeout", time.Minute, "How long to keep trying to bind DHCPv4 to -i, at boot, when the interface may not be up yet; 0 to try once")
+	dhcpRate      = flag.Int("dhcp-rate", 0, "Most DHCPv4 requests a second to answer from any one MAC, e.g. 5; the rest are dropped, with a log line now and then; 0, the default, for no limit")
 
 	// DHCPv6-specific
 	ipv6           = flag.Bool("6", false, "DHCPv6 server")
@@ -39,6 +56,7 @@ var (
 )
 
 type dserver4 struct {
+	inf          string
 	mac          net.HardwareAddr
 	yourIP       net.IP
 	submask      net.IPMask
@@ -47,17 +65,94 @@ type dserver4 struct {
 	rootpath     string
 	dns          []net.IP
 	hostFile     string
+
+	// nextServer is the TFTP server, if it isn't self.
+	nextServer net.IP
+
+	// classBootFiles are the boot files for particular vendor
+	// classes, in place of bootfilename.
+	classBootFiles classBootFiles
+
+	// pxe is the contents of option 43 for PXE clients, if we're to
+	// answer them specially. If pxeAll is set, everybody gets it,
+	// whether they said they were a PXE client or not.
+	pxe    []byte
+	pxeAll bool
+
+	// routes are the classless static routes for every client, to
+	// which the host file may add some for each.
+	routes dhcpv4.Routes
+
+	// httpsPort, if not 0, is the port HTTPS is served on, and
+	// http:// boot files for our HTTP server are sent as https://.
+	httpPort, httpsPort int
+
+	// leaseTime is how long leases last; 0 is forever. leases, if
+	// set, is told about each one.
+	leaseTime time.Duration
+	leases    *leases
+
+	// declineTime is how long an address a client declines is not
+	// offered for.
+	declineTime time.Duration
+
+	// limiter, if set, drops requests from clients which send too
+	// many.
+	limiter *macLimiter
+}
+
+// mustOptions are sent whether they were asked for or not: RFC 2131,
+// Section 4.3.1 says so of the message type, server identifier and
+// lease time, and RFC 6842 of the client identifier. A PXE ROM gives
+// up on a reply without the class identifier and vendor options, asked
+// for or not.
+var mustOptions = []dhcpv4.OptionCode{
+	dhcpv4.OptionDHCPMessageType,
+	dhcpv4.OptionServerIdentifier,
+	dhcpv4.OptionIPAddressLeaseTime,
+	dhcpv4.OptionClientIdentifier,
+	dhcpv4.OptionClassIdentifier,
+	dhcpv4.OptionVendorSpecificInformation,
+}
+
+// requestedOptions takes out of reply the options the request m didn't
+// ask for in its Parameter Request List, option 55, other than
+// mustOptions, so that replies stay small enough for the clients that
+// need them to be. A request without a list gets every option.
+func requestedOptions(reply, m *dhcpv4.DHCPv4) {
+	prl := m.ParameterRequestList()
+	if len(prl) == 0 {
+		return
+	}
+	keep := make(map[uint8]bool)
+	for _, c := range append(prl, mustOptions...) {
+		keep[c.Code()] = true
+	}
+	for c := range reply.Options {
+		if !keep[c] {
+			delete(reply.Options, c)
+		}
+	}
 }
 
 func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+	// Before anything is logged: a client in a loop would flood the
+	// log, too.
+	if s.limiter != nil && !s.limiter.allow(m.ClientHWAddr.String(), time.Now()) {
+		return
+	}
 	log.Printf("Handling request %v for peer %v", m, peer)
 
 	var replyType dhcpv4.MessageType
-	switch mt := m.MessageType(); mt {
+	mt := m.MessageType()
+	switch mt {
 	case dhcpv4.MessageTypeDiscover:
 		replyType = dhcpv4.MessageTypeOffer
-	case dhcpv4.MessageTypeRequest:
+	case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform:
 		replyType = dhcpv4.MessageTypeAck
+	case dhcpv4.MessageTypeDecline, dhcpv4.MessageTypeRelease:
+		s.giveBack(m)
+		return
 	default:
 		log.Printf("Can't handle type %v", mt)
 		return
@@ -71,7 +166,12 @@ func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHC
 		log.Printf("WARNING: support for old style names will end Sep 1, 2022")
 	} else {
 		ip, hostnames, err = lookupIP(s.hostFile, macHost)
-		if err != nil || ip.IsUnspecified() {
+		if (err != nil || ip.IsUnspecified()) && mt == dhcpv4.MessageTypeInform {
+			// RFC 2131, Section 4.3.5: a machine which sends an
+			// INFORM has its address already, and just wants the
+			// rest of its configuration. It needn't be one of ours.
+			hostnames = nil
+		} else if err != nil || ip.IsUnspecified() {
 			log.Printf("Not responding to DHCP request for mac %s", m.ClientHWAddr)
 			log.Printf("You can create a host entry of the form 'a.b.c.d [names] %s' 'ip6addr [names] u%s'if you wish", macHost, macHost)
 			return
@@ -81,47 +181,85 @@ func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHC
 	// Since this is dserver4, we force it to be an ip4 address.
 	ip = ip.To4()
 
+	// Make sure nobody else is squatting on the address, e.g. a machine
+	// somebody configured by hand. Only bother for an offer: by the time
+	// a client requests an address it may well be using it already.
+	if s.leases != nil && replyType == dhcpv4.MessageTypeOffer && s.leases.isDeclined(ip, time.Now()) {
+		log.Printf("Not offering %v to %s: it was declined, as in use", ip, m.ClientHWAddr)
+		return
+	}
+	if *probe && replyType == dhcpv4.MessageTypeOffer {
+		hw, err := arpProbe(s.inf, ip, *probeTimeout)
+		if err != nil {
+			log.Printf("ARP probe for %v failed, offering it anyway: %v", ip, err)
+		} else if hw != nil && !bytes.Equal(hw, m.ClientHWAddr) {
+			log.Printf("Not offering %v to %s: already in use by %s", ip, m.ClientHWAddr, hw)
+			return
+		}
+	}
+
 	// We're just going to use the first hostname for now
 	var hostname string
 	if len(hostnames) > 0 {
 		hostname = hostnames[0]
 	}
 
+	// Some clients find the TFTP server and boot file in siaddr and
+	// file, and some in options 66 and 67, so we set both.
+	next := s.self
+	if s.nextServer != nil {
+		next = s.nextServer
+	}
 	modifiers := []dhcpv4.Modifier{
 		dhcpv4.WithMessageType(replyType),
-		dhcpv4.WithServerIP(s.self),
+		dhcpv4.WithServerIP(next),
+		dhcpv4.WithOption(dhcpv4.OptTFTPServerName(next.String())),
 		dhcpv4.WithRouter(s.self),
 		dhcpv4.WithNetmask(s.submask),
-		dhcpv4.WithYourIP(ip),
 		// RFC 2131, Section 4.3.1. Server Identifier: MUST
 		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.self)),
-		// RFC 2131, Section 4.3.1. IP lease time: MUST
-		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(dhcpv4.MaxLeaseTime)),
+	}
+	// RFC 2131, Section 4.3.5: the ACK to an INFORM has no address
+	// and no lease time, just the client's own address back.
+	if mt == dhcpv4.MessageTypeInform {
+		modifiers = append(modifiers, dhcpv4.WithClientIP(m.ClientIPAddr))
+	} else {
+		modifiers = append(modifiers,
+			dhcpv4.WithYourIP(ip),
+			// RFC 2131, Section 4.3.1. IP lease time: MUST
+			dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(s.leaseDuration())),
+		)
 	}
 	if hostname != `` {
 		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptHostName(hostname)))
 	}
-	if *raspi {
+	bootfile := s.bootFile(m)
+	if len(bootfile) > 0 {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptBootFileName(bootfile)))
+	}
+	// A PXE ROM says it is one in option 60, and only carries on if we
+	// say the same thing back, along with some PXE options in 43.
+	if s.pxe != nil && (s.pxeAll || strings.HasPrefix(m.ClassIdentifier(), "PXEClient")) {
 		modifiers = append(modifiers,
 			dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient")),
-			// Add option 43, suboption 9 (PXE native boot menu) to allow Raspberry Pi to recognise the offer
-			dhcpv4.WithOption(dhcpv4.Option{
-				Code: dhcpv4.OptionVendorSpecificInformation,
-				Value: bsdp.VendorOptions{Options: dhcpv4.OptionsFromList(
-					// The dhcp package only seems to support Apple BSDP boot menu items,
-					// so we have to craft the option by hand.
-					// \x11 is the length of the 'Raspberry Pi Boot' string...
-					dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(9), []byte("\000\000\x11Raspberry Pi Boot")),
-				)},
-			}),
+			dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, s.pxe)),
 		)
 	}
 	if len(s.dns) != 0 {
 		modifiers = append(modifiers, dhcpv4.WithDNS(s.dns...))
 	}
+	router := s.self
 	if *gateway != `` {
-		modifiers = append(modifiers, dhcpv4.WithGatewayIP(net.ParseIP(*gateway)))
-		modifiers = append(modifiers, dhcpv4.WithRouter(net.ParseIP(*gateway)))
+		router = net.ParseIP(*gateway)
+		modifiers = append(modifiers, dhcpv4.WithGatewayIP(router))
+		modifiers = append(modifiers, dhcpv4.WithRouter(router))
+	}
+	own, err := hostRoutes(s.hostFile, m.ClientHWAddr)
+	if err != nil {
+		log.Printf("Routes for %s: %v", m.ClientHWAddr, err)
+	}
+	if rs := clientRoutes(s.routes, own, router); len(rs) > 0 {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptClasslessStaticRoute(rs...)))
 	}
 	reply, err := dhcpv4.NewReplyFromRequest(m, modifiers...)
 
@@ -129,8 +267,8 @@ func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHC
 	if val := m.Options.Get(dhcpv4.OptionClientIdentifier); len(val) > 0 {
 		reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionClientIdentifier, val))
 	}
-	if len(s.bootfilename) > 0 {
-		reply.BootFileName = s.bootfilename
+	if len(bootfile) > 0 {
+		reply.BootFileName = bootfile
 	}
 	if len(s.rootpath) > 0 {
 		reply.UpdateOption(dhcpv4.OptRootPath(s.rootpath))
@@ -139,6 +277,7 @@ func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHC
 		log.Printf("Could not create reply for %v: %v", m, err)
 		return
 	}
+	requestedOptions(reply, m)
 
 	// Experimentally determined. You can't just blindly send a broadcast packet
 	// with the broadcast address. You can, however, send a broadcast packet
@@ -153,13 +292,158 @@ func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHC
 		log.Printf("Changing %v to %v", peer, p)
 		peer = p
 	}
+	// RFC 2131, Section 4.3.5: the ACK to an INFORM goes straight to
+	// the address the client says it has.
+	if mt == dhcpv4.MessageTypeInform && !m.ClientIPAddr.IsUnspecified() {
+		peer = &net.UDPAddr{IP: m.ClientIPAddr, Port: dhcpv4.ClientPort}
+	}
 
 	log.Printf("Sending %v to %v", reply.Summary(), peer)
 	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
 		log.Printf("Could not write %v: %v", reply, err)
+		return
+	}
+
+	if s.leases == nil || mt == dhcpv4.MessageTypeInform {
+		return
+	}
+	l := lease{MAC: m.ClientHWAddr.String(), IP: ip, Hostname: hostname}
+	if s.leaseTime > 0 {
+		l.Expires = time.Now().Add(s.leaseTime)
+	}
+	if replyType == dhcpv4.MessageTypeOffer {
+		s.leases.offer(l)
+	} else {
+		s.leases.ack(l)
 	}
 }
 
+// giveBack handles a DECLINE or RELEASE, neither of which is answered.
+// RFC 2131, Section 4.3.3: a DECLINE says which address in the
+// requested IP address option, and means another machine has it, so
+// it isn't offered again for declineTime; Section 4.3.4: a RELEASE
+// says which in ciaddr. Either for another server is none of ours.
+func (s *dserver4) giveBack(m *dhcpv4.DHCPv4) {
+	mt := m.MessageType()
+	if id := m.ServerIdentifier(); id != nil && !id.Equal(s.self) {
+		log.Printf("Ignoring %v from %s for server %v", mt, m.ClientHWAddr, id)
+		return
+	}
+	ip := m.ClientIPAddr
+	if mt == dhcpv4.MessageTypeDecline {
+		ip = m.RequestedIPAddress()
+	}
+	if ip == nil || ip.IsUnspecified() {
+		log.Printf("Ignoring %v from %s: no address", mt, m.ClientHWAddr)
+		return
+	}
+	ip = ip.To4()
+	mac := m.ClientHWAddr.String()
+	if mt == dhcpv4.MessageTypeDecline {
+		log.Printf("WARNING: %s declined %v: another machine is using it", mac, ip)
+	} else {
+		log.Printf("%s released %v", mac, ip)
+	}
+	if s.leases == nil {
+		return
+	}
+	if mt == dhcpv4.MessageTypeDecline {
+		s.leases.decline(mac, ip, time.Now().Add(s.declineTime))
+	} else {
+		s.leases.release(mac, ip)
+	}
+}
+
+// bootServerHandler answers PXE ROMs which have been shown a menu, and
+// ask, on pxeBootServerPort, for the boot file of the item chosen from
+// it. Only ours, pxeBootType, is answered: the local boot item is never
+// asked for, and other types are other servers'.
+func (s *dserver4) bootServerHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+	if m.MessageType() != dhcpv4.MessageTypeRequest || !strings.HasPrefix(m.ClassIdentifier(), "PXEClient") {
+		log.Printf("Boot server: ignoring %v from %s: not a PXE request", m.MessageType(), m.ClientHWAddr)
+		return
+	}
+	typ, layer, ok := pxeItem(m.Options.Get(dhcpv4.OptionVendorSpecificInformation))
+	if !ok || typ != pxeBootType {
+		log.Printf("Boot server: ignoring request from %s for boot item type %#x (%v)", m.ClientHWAddr, typ, ok)
+		return
+	}
+	next := s.self
+	if s.nextServer != nil {
+		next = s.nextServer
+	}
+	bootfile := s.bootFile(m)
+	modifiers := []dhcpv4.Modifier{
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithServerIP(next),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.self)),
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient")),
+		dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, pxeItemReply(typ, layer))),
+	}
+	if len(bootfile) > 0 {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptBootFileName(bootfile)))
+	}
+	reply, err := dhcpv4.NewReplyFromRequest(m, modifiers...)
+	if err != nil {
+		log.Printf("Boot server: could not create reply for %v: %v", m, err)
+		return
+	}
+	reply.BootFileName = bootfile
+	log.Printf("Boot server: sending %v to %v", reply.Summary(), peer)
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		log.Printf("Boot server: could not write %v: %v", reply, err)
+	}
+}
+
+// serve serves DHCPv4 requests to port on s.inf with handler, and gives
+// up if it can't.
+func (s *dserver4) serve(port int, what string, handler server4.Handler) {
+	laddr := &net.UDPAddr{Port: port}
+	var conn *net.UDPConn
+	if err := retry("Binding "+what+" to "+s.inf, *bindTimeout, func() (err error) {
+		conn, err = server4.NewIPv4UDPConn(s.inf, laddr)
+		return err
+	}); err != nil {
+		log.Fatalf("Binding %v to %v: giving up after %v: %v", what, s.inf, *bindTimeout, err)
+	}
+	// Send replies from the address in their server identifier, if
+	// it's ours to send from.
+	var pc net.PacketConn = conn
+	if ok, err := hasAddr(s.inf, s.self); err != nil || !ok {
+		log.Printf("%v is not an address of %v (%v): replies go out from whichever address the kernel picks", s.self, s.inf, err)
+	} else {
+		pc = newSrcConn(conn, s.self)
+	}
+	server, err := server4.NewServer(s.inf, laddr, handler, server4.WithConn(pc))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// leaseDuration returns the lease time to send clients.
+func (s *dserver4) leaseDuration() time.Duration {
+	if s.leaseTime > 0 {
+		return s.leaseTime
+	}
+	return dhcpv4.MaxLeaseTime
+}
+
+// bootFile returns the boot file for the client which sent m: the one
+// for its vendor class, if there is one, or else bootfilename.
+func (s *dserver4) bootFile(m *dhcpv4.DHCPv4) string {
+	f, ok := s.classBootFiles.lookup(m.ClassIdentifier())
+	if !ok {
+		f = s.bootfilename
+	}
+	if s.httpsPort != 0 {
+		f = httpsURL(f, s.self, s.httpPort, s.httpsPort)
+	}
+	return f
+}
+
 type dserver6 struct {
 	mac         net.HardwareAddr
 	yourIP      net.IP
@@ -233,28 +517,98 @@ func dhcpServe(inf string, dns []net.IP, wg *sync.WaitGroup) error {
 		} else {
 			ip = net.ParseIP(*selfIP)
 		}
-		wg.Add(1)
-		log.Printf("Using IP address %v on %v", ip, inf)
-		go func() {
-			defer wg.Done()
-			s := &dserver4{
-				self:         ip,
-				bootfilename: *bootfilename,
-				rootpath:     *rootpath,
-				submask:      ip.DefaultMask(),
-				dns:          dns,
-				hostFile:     *hostFile,
+		s := &dserver4{
+			inf:          inf,
+			self:         ip,
+			bootfilename: *bootfilename,
+			rootpath:     *rootpath,
+			submask:      ip.DefaultMask(),
+			dns:          dns,
+			hostFile:     *hostFile,
+			leaseTime:    *leaseTime,
+			declineTime:  *declineTime,
+		}
+		profile := *pxe
+		if *raspi {
+			profile = "raspi"
+		}
+		if *nextServer != "" {
+			if s.nextServer = net.ParseIP(*nextServer).To4(); s.nextServer == nil {
+				return fmt.Errorf("-next-server %q is not an IPv4 address", *nextServer)
 			}
-
-			laddr := &net.UDPAddr{Port: dhcpv4.ServerPort}
-			server, err := server4.NewServer(inf, laddr, s.dhcpHandler)
+		}
+		cb, err := parseClassBootFiles(*classBoot)
+		if err != nil {
+			return fmt.Errorf("-class-bootfile: %v", err)
+		}
+		s.classBootFiles = cb
+		if s.routes, err = parseRoutes(*routes); err != nil {
+			return fmt.Errorf("-routes: %v", err)
+		}
+		if *httpsCert != "" && (*httpDir != "" || *image != "") {
+			s.httpPort, s.httpsPort = *httpPort, *httpsPort
+		}
+		if *pxeTimeout > 255 {
+			return fmt.Errorf("-pxe-timeout %d is more than 255 seconds", *pxeTimeout)
+		}
+		if profile != "" {
+			c, err := pxeProfile(profile, ip, pxeOpts{
+				Menu:       *pxeMenu,
+				Local:      *pxeLocal,
+				LocalFirst: *pxeLocalFirst,
+				Prompt:     *pxePrompt,
+				Timeout:    uint8(*pxeTimeout),
+			})
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
-			if err := server.Serve(); err != nil {
-				log.Fatal(err)
+			if s.pxe, err = c.marshal(); err != nil {
+				return err
 			}
+			// The Raspberry Pi has always been sent its PXE options
+			// whatever it asked for.
+			s.pxeAll = profile == "raspi"
+		}
+		var hooks leaseHooks
+		if *leaseFile != "" {
+			hooks = append(hooks, fileHook{name: *leaseFile})
+		}
+		if *leaseURL != "" {
+			hooks = append(hooks, httpHook{url: *leaseURL, client: &http.Client{Timeout: 10 * time.Second}})
+		}
+		// There are leases to keep, and declined addresses to
+		// keep track of, whether or not anything is told of them.
+		var hook leaseHook = hooks
+		if len(hooks) > 0 {
+			hook = newAsyncHook(hooks, 256)
+		}
+		s.leases = newLeases(hook)
+		if s.leaseTime > 0 {
+			go s.leases.sweep(time.Minute)
+		}
+		if *dhcpRate < 0 {
+			return fmt.Errorf("-dhcp-rate %d is less than 0", *dhcpRate)
+		}
+		if *dhcpRate > 0 {
+			s.limiter = newMACLimiter(*dhcpRate, time.Minute)
+			go s.limiter.sweep(time.Minute)
+		}
+
+		log.Printf("Using IP address %v on %v", ip, inf)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(dhcpv4.ServerPort, "DHCPv4", s.dhcpHandler)
 		}()
+		// A standard PXE ROM with a menu asks us for its boot file
+		// once an item is chosen.
+		if profile == "pxe" && *pxeLocal != "" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serve(pxeBootServerPort, "PXE boot server", s.bootServerHandler)
+			}()
+		}
 	}
 
 	// not yet.
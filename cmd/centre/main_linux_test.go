@@ -0,0 +1,569 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// sentConn is a net.PacketConn which remembers what was written to it.
+type sentConn struct {
+	net.PacketConn
+	b  []byte
+	to net.Addr
+}
+
+func (c *sentConn) WriteTo(b []byte, to net.Addr) (int, error) {
+	c.b, c.to = append([]byte(nil), b...), to
+	return len(b), nil
+}
+
+func TestInform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("192.168.0.5 harvey u020000000005\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	self := net.IPv4(192, 168, 0, 1).To4()
+	s := &dserver4{
+		self:         self,
+		submask:      self.DefaultMask(),
+		bootfilename: "pxelinux.0",
+		dns:          []net.IP{self},
+		hostFile:     hosts,
+	}
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 5}
+	have := net.IPv4(192, 168, 0, 99).To4()
+
+	for _, tt := range []struct {
+		mt     dhcpv4.MessageType
+		yiaddr net.IP
+		to     net.IP
+	}{
+		// An INFORM keeps the address it has, however it got it.
+		{dhcpv4.MessageTypeInform, net.IPv4zero, have},
+		{dhcpv4.MessageTypeDiscover, net.IPv4(192, 168, 0, 5), nil},
+	} {
+		m, err := dhcpv4.New(dhcpv4.WithMessageType(tt.mt), dhcpv4.WithHwAddr(mac), dhcpv4.WithClientIP(have))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+		var c sentConn
+		s.dhcpHandler(&c, peer, m)
+		if c.b == nil {
+			t.Fatalf("%v: no reply", tt.mt)
+		}
+		r, err := dhcpv4.FromBytes(c.b)
+		if err != nil {
+			t.Fatalf("%v: reply: %v", tt.mt, err)
+		}
+		lease := r.Options.Has(dhcpv4.OptionIPAddressLeaseTime)
+		if !r.YourIPAddr.Equal(tt.yiaddr) || lease != (tt.mt != dhcpv4.MessageTypeInform) {
+			t.Errorf("%v: want yiaddr %v and a lease time only for an address, got yiaddr %v, lease time %v", tt.mt, tt.yiaddr, r.YourIPAddr, lease)
+		}
+		if r.BootFileName != "pxelinux.0" || r.HostName() != "harvey" || len(r.DNS()) != 1 {
+			t.Errorf("%v: want boot file, host name and DNS, got %v", tt.mt, r.Summary())
+		}
+		if tt.to != nil {
+			if u, ok := c.to.(*net.UDPAddr); !ok || !u.IP.Equal(tt.to) || u.Port != dhcpv4.ClientPort {
+				t.Errorf("%v: sent to %v, want %v:%d", tt.mt, c.to, tt.to, dhcpv4.ClientPort)
+			}
+			if r.MessageType() != dhcpv4.MessageTypeAck || !r.ClientIPAddr.Equal(tt.to) {
+				t.Errorf("%v: want an ACK for ciaddr %v, got %v", tt.mt, tt.to, r.Summary())
+			}
+		}
+	}
+}
+
+func TestNextServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("192.168.0.5 harvey u020000000005\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	self := net.IPv4(192, 168, 0, 1).To4()
+	tftp := net.IPv4(192, 168, 0, 2).To4()
+	for _, next := range []net.IP{nil, tftp} {
+		s := &dserver4{
+			self:         self,
+			submask:      self.DefaultMask(),
+			bootfilename: "pxelinux.0",
+			hostFile:     hosts,
+			nextServer:   next,
+		}
+		m, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover), dhcpv4.WithHwAddr(net.HardwareAddr{2, 0, 0, 0, 0, 5}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c sentConn
+		s.dhcpHandler(&c, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, m)
+		r, err := dhcpv4.FromBytes(c.b)
+		if err != nil {
+			t.Fatalf("reply: %v", err)
+		}
+		want := self
+		if next != nil {
+			want = next
+		}
+		if !r.ServerIPAddr.Equal(want) || r.TFTPServerName() != want.String() {
+			t.Errorf("next server %v: want siaddr and option 66 %v, got %v and %q", next, want, r.ServerIPAddr, r.TFTPServerName())
+		}
+		if r.BootFileName != "pxelinux.0" || r.BootFileNameOption() != "pxelinux.0" {
+			t.Errorf("next server %v: want file and option 67 pxelinux.0, got %q and %q", next, r.BootFileName, r.BootFileNameOption())
+		}
+		if id := r.ServerIdentifier(); !id.Equal(self) {
+			t.Errorf("next server %v: want server identifier %v, got %v", next, self, id)
+		}
+	}
+}
+
+func TestClassBootFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("192.168.0.5 harvey u020000000005\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	self := net.IPv4(192, 168, 0, 1).To4()
+	cb, err := parseClassBootFiles("PXEClient:Arch:00007=ipxe.efi,HTTPClient=http://192.168.0.1/boot.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dserver4{
+		self:           self,
+		submask:        self.DefaultMask(),
+		bootfilename:   "pxelinux.0",
+		hostFile:       hosts,
+		classBootFiles: cb,
+		httpPort:       80,
+	}
+	for _, tt := range []struct {
+		class     string
+		httpsPort int
+		want      string
+	}{
+		{"PXEClient:Arch:00007:UNDI:003016", 0, "ipxe.efi"},
+		{"PXEClient:Arch:00000:UNDI:002001", 0, "pxelinux.0"},
+		{"", 0, "pxelinux.0"},
+		{"HTTPClient:Arch:00016", 0, "http://192.168.0.1/boot.efi"},
+		// With HTTPS served, our boot URLs are sent as https://.
+		{"HTTPClient:Arch:00016", 443, "https://192.168.0.1/boot.efi"},
+		{"PXEClient:Arch:00007:UNDI:003016", 443, "ipxe.efi"},
+	} {
+		s.httpsPort = tt.httpsPort
+		mods := []dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover), dhcpv4.WithHwAddr(net.HardwareAddr{2, 0, 0, 0, 0, 5})}
+		if tt.class != "" {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClassIdentifier(tt.class)))
+		}
+		m, err := dhcpv4.New(mods...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c sentConn
+		s.dhcpHandler(&c, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, m)
+		r, err := dhcpv4.FromBytes(c.b)
+		if err != nil {
+			t.Fatalf("reply: %v", err)
+		}
+		if r.BootFileName != tt.want || r.BootFileNameOption() != tt.want {
+			t.Errorf("class %q: want file and option 67 %s, got %q and %q", tt.class, tt.want, r.BootFileName, r.BootFileNameOption())
+		}
+	}
+}
+
+func TestBootServer(t *testing.T) {
+	self := net.IPv4(192, 168, 0, 1).To4()
+	cb, err := parseClassBootFiles("PXEClient:Arch:00007=ipxe.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dserver4{
+		self:           self,
+		submask:        self.DefaultMask(),
+		bootfilename:   "pxelinux.0",
+		classBootFiles: cb,
+	}
+	have := net.IPv4(192, 168, 0, 5).To4()
+	peer := &net.UDPAddr{IP: have, Port: dhcpv4.ClientPort}
+	for _, tt := range []struct {
+		mt    dhcpv4.MessageType
+		class string
+		item  []byte
+		want  string // boot file, or "" for no answer
+	}{
+		{dhcpv4.MessageTypeRequest, "PXEClient:Arch:00000:UNDI:002001", pxeItemReply(pxeBootType, 0), "pxelinux.0"},
+		{dhcpv4.MessageTypeRequest, "PXEClient:Arch:00007:UNDI:003016", pxeItemReply(pxeBootType, 0), "ipxe.efi"},
+		// Another server's, and the local disk, are not ours.
+		{dhcpv4.MessageTypeRequest, "PXEClient:Arch:00000:UNDI:002001", pxeItemReply(0x8001, 0), ""},
+		{dhcpv4.MessageTypeRequest, "PXEClient:Arch:00000:UNDI:002001", pxeItemReply(pxeLocalBoot, 0), ""},
+		{dhcpv4.MessageTypeRequest, "PXEClient:Arch:00000:UNDI:002001", nil, ""},
+		{dhcpv4.MessageTypeRequest, "", pxeItemReply(pxeBootType, 0), ""},
+		{dhcpv4.MessageTypeDiscover, "PXEClient:Arch:00000:UNDI:002001", pxeItemReply(pxeBootType, 0), ""},
+	} {
+		mods := []dhcpv4.Modifier{
+			dhcpv4.WithMessageType(tt.mt),
+			dhcpv4.WithHwAddr(net.HardwareAddr{2, 0, 0, 0, 0, 5}),
+			dhcpv4.WithClientIP(have),
+		}
+		if tt.class != "" {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClassIdentifier(tt.class)))
+		}
+		if tt.item != nil {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, tt.item)))
+		}
+		m, err := dhcpv4.New(mods...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c sentConn
+		s.bootServerHandler(&c, peer, m)
+		if tt.want == "" {
+			if c.b != nil {
+				t.Errorf("%v from %q for %v: want no answer, got one", tt.mt, tt.class, tt.item)
+			}
+			continue
+		}
+		r, err := dhcpv4.FromBytes(c.b)
+		if err != nil {
+			t.Fatalf("reply: %v", err)
+		}
+		if r.MessageType() != dhcpv4.MessageTypeAck || c.to != peer {
+			t.Errorf("%q: want an ACK to %v, got %v to %v", tt.class, peer, r.MessageType(), c.to)
+		}
+		if r.BootFileName != tt.want || r.BootFileNameOption() != tt.want || !r.ServerIPAddr.Equal(self) {
+			t.Errorf("%q: want file and option 67 %s from %v, got %q and %q from %v", tt.class, tt.want, self, r.BootFileName, r.BootFileNameOption(), r.ServerIPAddr)
+		}
+		if typ, _, ok := pxeItem(r.Options.Get(dhcpv4.OptionVendorSpecificInformation)); !ok || typ != pxeBootType || r.ClassIdentifier() != "PXEClient" {
+			t.Errorf("%q: want boot item %#x and class PXEClient, got %#x (%v) and %q", tt.class, pxeBootType, typ, ok, r.ClassIdentifier())
+		}
+	}
+}
+
+func TestLeaseHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("192.168.0.5 harvey u020000000005\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	self := net.IPv4(192, 168, 0, 1).To4()
+	var h recordHook
+	s := &dserver4{
+		self:      self,
+		submask:   self.DefaultMask(),
+		hostFile:  hosts,
+		leaseTime: time.Hour,
+		leases:    newLeases(&h),
+	}
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 5}
+	for _, mt := range []dhcpv4.MessageType{dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform} {
+		m, err := dhcpv4.New(dhcpv4.WithMessageType(mt), dhcpv4.WithHwAddr(mac))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c sentConn
+		s.dhcpHandler(&c, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, m)
+		r, err := dhcpv4.FromBytes(c.b)
+		if err != nil {
+			t.Fatalf("%v: reply: %v", mt, err)
+		}
+		if d := r.IPAddressLeaseTime(0); mt != dhcpv4.MessageTypeInform && d != time.Hour {
+			t.Errorf("%v: lease time %v, want %v", mt, d, time.Hour)
+		}
+	}
+	// An INFORM doesn't get a lease.
+	want := []string{"offer " + mac.String(), "ack " + mac.String()}
+	if got := h.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDeclineRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("192.168.0.5 harvey u020000000005\n192.168.0.6 harvey2 u020000000006\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	self := net.IPv4(192, 168, 0, 1).To4()
+	var h recordHook
+	s := &dserver4{
+		self:        self,
+		submask:     self.DefaultMask(),
+		hostFile:    hosts,
+		leaseTime:   time.Hour,
+		declineTime: time.Hour,
+		leases:      newLeases(&h),
+	}
+	mac5 := net.HardwareAddr{2, 0, 0, 0, 0, 5}
+	mac6 := net.HardwareAddr{2, 0, 0, 0, 0, 6}
+	ip5, ip6 := net.IPv4(192, 168, 0, 5).To4(), net.IPv4(192, 168, 0, 6).To4()
+	send := func(mt dhcpv4.MessageType, mac net.HardwareAddr, mods ...dhcpv4.Modifier) []byte {
+		t.Helper()
+		m, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithMessageType(mt), dhcpv4.WithHwAddr(mac)}, mods...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c sentConn
+		s.dhcpHandler(&c, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, m)
+		return c.b
+	}
+	for _, mac := range []net.HardwareAddr{mac5, mac6} {
+		send(dhcpv4.MessageTypeRequest, mac)
+	}
+	ours := dhcpv4.WithOption(dhcpv4.OptServerIdentifier(self))
+
+	// Neither is answered.
+	if b := send(dhcpv4.MessageTypeDecline, mac5, ours, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip5))); b != nil {
+		t.Errorf("DECLINE: got a reply")
+	}
+	if b := send(dhcpv4.MessageTypeRelease, mac6, ours, dhcpv4.WithClientIP(ip6)); b != nil {
+		t.Errorf("RELEASE: got a reply")
+	}
+	// One for another server is none of ours.
+	other := dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 168, 0, 2)))
+	send(dhcpv4.MessageTypeRelease, mac5, other, dhcpv4.WithClientIP(ip5))
+
+	want := []string{"ack " + mac5.String(), "ack " + mac6.String(), "decline " + mac5.String(), "release " + mac6.String()}
+	if got := h.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events: got %q, want %q", got, want)
+	}
+	s.leases.mu.Lock()
+	if n := len(s.leases.m); n != 0 {
+		t.Errorf("%d leases left, want none: %v", n, s.leases.m)
+	}
+	s.leases.mu.Unlock()
+
+	// The declined address isn't offered again; the released one is.
+	if b := send(dhcpv4.MessageTypeDiscover, mac5); b != nil {
+		t.Errorf("DISCOVER after DECLINE of %v: got an offer", ip5)
+	}
+	b := send(dhcpv4.MessageTypeDiscover, mac6)
+	if b == nil {
+		t.Fatalf("DISCOVER after RELEASE of %v: no offer", ip6)
+	}
+	r, err := dhcpv4.FromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.YourIPAddr.Equal(ip6) {
+		t.Errorf("DISCOVER after RELEASE: offered %v, want %v", r.YourIPAddr, ip6)
+	}
+}
+
+func TestSrcConn(t *testing.T) {
+	// All of 127/8 is ours on Linux, so we can send from 127.0.0.2
+	// to 127.0.0.1 without configuring anything.
+	r, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("no loopback: %v", err)
+	}
+	defer r.Close()
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	src := net.IPv4(127, 0, 0, 2).To4()
+	sc := newSrcConn(c, src)
+	if _, err := sc.WriteTo([]byte("offer"), r.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 16)
+	n, from, err := r.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if u := from.(*net.UDPAddr); string(b[:n]) != "offer" || !u.IP.Equal(src) {
+		t.Errorf("got %q from %v, want %q from %v", b[:n], from, "offer", src)
+	}
+
+	if ok, err := hasAddr("lo", net.IPv4(127, 0, 0, 1)); err != nil || !ok {
+		t.Errorf("hasAddr(lo, 127.0.0.1): want true, got %v, %v", ok, err)
+	}
+	if ok, err := hasAddr("lo", net.IPv4(192, 0, 2, 1)); err != nil || ok {
+		t.Errorf("hasAddr(lo, 192.0.2.1): want false, got %v, %v", ok, err)
+	}
+}
+
+func TestRequestedOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("192.168.0.5 harvey u020000000005\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	self := net.IPv4(192, 168, 0, 1).To4()
+	s := &dserver4{
+		self:         self,
+		submask:      self.DefaultMask(),
+		bootfilename: "pxelinux.0",
+		dns:          []net.IP{self},
+		hostFile:     hosts,
+	}
+	for _, tt := range []struct {
+		prl  []dhcpv4.OptionCode
+		want bool // whether the unrequested options are there
+	}{
+		{nil, true},
+		{[]dhcpv4.OptionCode{dhcpv4.OptionSubnetMask, dhcpv4.OptionRouter}, false},
+	} {
+		mods := []dhcpv4.Modifier{
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+			dhcpv4.WithHwAddr(net.HardwareAddr{2, 0, 0, 0, 0, 5}),
+			dhcpv4.WithOption(dhcpv4.OptClientIdentifier([]byte{1, 2, 0, 0, 0, 0, 5})),
+		}
+		if tt.prl != nil {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptParameterRequestList(tt.prl...)))
+		}
+		m, err := dhcpv4.New(mods...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c sentConn
+		s.dhcpHandler(&c, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, m)
+		r, err := dhcpv4.FromBytes(c.b)
+		if err != nil {
+			t.Fatalf("PRL %v: reply: %v", tt.prl, err)
+		}
+		for _, o := range []dhcpv4.OptionCode{dhcpv4.OptionDHCPMessageType, dhcpv4.OptionServerIdentifier, dhcpv4.OptionIPAddressLeaseTime, dhcpv4.OptionClientIdentifier, dhcpv4.OptionSubnetMask, dhcpv4.OptionRouter} {
+			if !r.Options.Has(o) {
+				t.Errorf("PRL %v: no %v in %v", tt.prl, o, r.Summary())
+			}
+		}
+		for _, o := range []dhcpv4.OptionCode{dhcpv4.OptionHostName, dhcpv4.OptionDomainNameServer, dhcpv4.OptionTFTPServerName, dhcpv4.OptionBootfileName} {
+			if r.Options.Has(o) != tt.want {
+				t.Errorf("PRL %v: want %v there: %v, got %v", tt.prl, o, tt.want, r.Summary())
+			}
+		}
+		// The boot file is in the header as well, which isn't an option.
+		if r.BootFileName != "pxelinux.0" {
+			t.Errorf("PRL %v: want file pxelinux.0, got %q", tt.prl, r.BootFileName)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	hostFile := `192.168.0.5 harvey u020000000005
+192.168.0.6 plan9 u020000000006
+route 10.3.0.0/16 192.168.0.253 u020000000005
+`
+	if err := ioutil.WriteFile(hosts, []byte(hostFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	self := net.IPv4(192, 168, 0, 1).To4()
+	rs, err := parseRoutes("10.1.0.0/16=192.168.0.254")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dserver4{
+		self:     self,
+		submask:  self.DefaultMask(),
+		hostFile: hosts,
+		routes:   rs,
+	}
+	for _, tt := range []struct {
+		mac  net.HardwareAddr
+		want string
+	}{
+		{net.HardwareAddr{2, 0, 0, 0, 0, 5}, "route to 10.3.0.0/16 via 192.168.0.253; route to 10.1.0.0/16 via 192.168.0.254; route to 0.0.0.0/0 via 192.168.0.1"},
+		{net.HardwareAddr{2, 0, 0, 0, 0, 6}, "route to 10.1.0.0/16 via 192.168.0.254; route to 0.0.0.0/0 via 192.168.0.1"},
+	} {
+		m, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover), dhcpv4.WithHwAddr(tt.mac))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c sentConn
+		s.dhcpHandler(&c, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, m)
+		if c.b == nil {
+			t.Fatalf("%v: no reply", tt.mac)
+		}
+		r, err := dhcpv4.FromBytes(c.b)
+		if err != nil {
+			t.Fatalf("%v: reply: %v", tt.mac, err)
+		}
+		if got := dhcpv4.Routes(r.ClasslessStaticRoute()).String(); got != tt.want {
+			t.Errorf("%v: want option 121 %q, got %q", tt.mac, tt.want, got)
+		}
+	}
+}
+
+// TestDHCPRate checks that dhcpHandler drops requests from a client
+// which sends too many, and only from that one.
+func TestDHCPRate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("192.168.0.5 a u020000000005\n192.168.0.6 b u020000000006\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	self := net.IPv4(192, 168, 0, 1).To4()
+	s := &dserver4{
+		self:     self,
+		submask:  self.DefaultMask(),
+		hostFile: hosts,
+		limiter:  newMACLimiter(1, time.Minute),
+	}
+	s.limiter.logf = t.Logf
+	discover := func(mac net.HardwareAddr) bool {
+		t.Helper()
+		m, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover), dhcpv4.WithHwAddr(mac))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c sentConn
+		s.dhcpHandler(&c, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, m)
+		return c.b != nil
+	}
+	a, b := net.HardwareAddr{2, 0, 0, 0, 0, 5}, net.HardwareAddr{2, 0, 0, 0, 0, 6}
+	if !discover(a) {
+		t.Fatalf("first DISCOVER from a: no reply")
+	}
+	if discover(a) {
+		t.Errorf("second DISCOVER from a at once: want it dropped, got a reply")
+	}
+	if !discover(b) {
+		t.Errorf("DISCOVER from b: want a reply, whatever a does")
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// PXE vendor suboptions, which go in option 43, from the PXE 2.1 spec.
+const (
+	pxeDiscoveryControl = 6
+	pxeBootServers      = 8
+	pxeBootMenu         = 9
+	pxeMenuPrompt       = 10
+	pxeBootItem         = 71
+	pxeEnd              = 255
+)
+
+// pxeBootServerPort is where a PXE ROM asks a boot server, one of
+// pxeBootServers, for the boot file of the menu item chosen.
+const pxeBootServerPort = 4011
+
+// PXE discovery control bits.
+const (
+	pxeNoBroadcast = 1 << iota // don't discover boot servers by broadcast
+	pxeNoMulticast             // don't discover boot servers by multicast
+	pxeServerList              // only use boot servers from pxeBootServers
+	pxeBootFile                // just download the boot file, if there is one
+)
+
+// pxeBootType is the boot server type of our network boot menu item.
+// Types from 0x8000 up are vendor types, which nobody else will claim.
+// Type 0 is no server at all, but the local disk: the ROM hands back to
+// the BIOS, which boots the next device.
+const (
+	pxeBootType  = 0x8000
+	pxeLocalBoot = 0
+)
+
+type pxeMenuItem struct {
+	Type uint16
+	Desc string
+}
+
+type pxeBootServer struct {
+	Type uint16
+	IPs  []net.IP
+}
+
+// pxeConfig is what we tell a PXE ROM in option 43.
+type pxeConfig struct {
+	Control uint8
+	Servers []pxeBootServer
+	Menu    []pxeMenuItem
+	// Prompt is shown for Timeout seconds, or until a key is
+	// pressed, which shows the menu; when the time is up, the
+	// first menu item is booted. A Timeout of 0 boots it at once,
+	// and 255 waits for a key for ever.
+	Prompt  string
+	Timeout uint8
+
+	// NoEnd leaves off the end suboption. The Raspberry Pi has never
+	// been sent one, and we'd rather not find out whether it minds.
+	NoEnd bool
+}
+
+// pxeOpts are the settings of the "pxe" profile's menu.
+type pxeOpts struct {
+	// Menu is the description of the network boot item.
+	Menu string
+	// Local, if set, is the description of an item which boots
+	// from the local disk, after the network boot item, or before
+	// it if LocalFirst is set.
+	Local      string
+	LocalFirst bool
+	Prompt     string
+	Timeout    uint8
+}
+
+// pxeProfile returns the PXE configuration for the named profile:
+// "pxe" for standard PXE ROMs, which will be told to boot from us, or
+// "raspi" for the Raspberry Pi bootloader, which only wants a menu.
+//
+// Without a local item, a standard ROM just downloads the boot file,
+// and shows neither prompt nor menu. With one, it shows both, and then
+// asks us, as its boot server, for the boot file if the network boot
+// item is chosen. So that a machine whose network boot has failed, or
+// has no boot file, can get on with booting from its disk unattended,
+// the menu must have a prompt, which times out.
+func pxeProfile(name string, self net.IP, o pxeOpts) (*pxeConfig, error) {
+	switch name {
+	case "pxe":
+		c := &pxeConfig{
+			Control: pxeNoBroadcast | pxeNoMulticast | pxeServerList | pxeBootFile,
+			Servers: []pxeBootServer{{Type: pxeBootType, IPs: []net.IP{self}}},
+			Menu:    []pxeMenuItem{{Type: pxeBootType, Desc: o.Menu}},
+			Prompt:  o.Prompt,
+			Timeout: o.Timeout,
+		}
+		if o.Local == "" {
+			return c, nil
+		}
+		if o.Prompt == "" || o.Timeout == 255 {
+			return nil, fmt.Errorf("a PXE menu with a local boot item needs a prompt with a timeout of less than 255 seconds, or it waits for ever")
+		}
+		c.Control &^= pxeBootFile
+		local := pxeMenuItem{Type: pxeLocalBoot, Desc: o.Local}
+		if o.LocalFirst {
+			c.Menu = append([]pxeMenuItem{local}, c.Menu...)
+		} else {
+			c.Menu = append(c.Menu, local)
+		}
+		return c, nil
+	case "raspi":
+		return &pxeConfig{
+			Menu:  []pxeMenuItem{{Type: 0, Desc: "Raspberry Pi Boot"}},
+			NoEnd: true,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown PXE profile %q: want pxe or raspi", name)
+}
+
+// pxeItem returns the boot item, its type and layer, asked for in the
+// option 43 of a request to a boot server.
+func pxeItem(opt []byte) (typ, layer uint16, ok bool) {
+	for len(opt) > 0 {
+		code := opt[0]
+		if code == pxeEnd {
+			break
+		}
+		// Pad is just the code.
+		if code == 0 {
+			opt = opt[1:]
+			continue
+		}
+		if len(opt) < 2 || len(opt) < 2+int(opt[1]) {
+			break
+		}
+		v := opt[2 : 2+opt[1]]
+		if code == pxeBootItem && len(v) == 4 {
+			return binary.BigEndian.Uint16(v), binary.BigEndian.Uint16(v[2:]), true
+		}
+		opt = opt[2+len(v):]
+	}
+	return 0, 0, false
+}
+
+// pxeItemReply returns the option 43 of a boot server's answer for the
+// boot item typ and layer.
+func pxeItemReply(typ, layer uint16) []byte {
+	b := []byte{pxeBootItem, 4, 0, 0, 0, 0, pxeEnd}
+	binary.BigEndian.PutUint16(b[2:], typ)
+	binary.BigEndian.PutUint16(b[4:], layer)
+	return b
+}
+
+// marshal returns the contents of option 43 for c.
+func (c *pxeConfig) marshal() ([]byte, error) {
+	var b bytes.Buffer
+	sub := func(code uint8, v []byte) error {
+		if len(v) > 255 {
+			return fmt.Errorf("PXE suboption %d is %d bytes, more than 255", code, len(v))
+		}
+		b.Write([]byte{code, uint8(len(v))})
+		b.Write(v)
+		return nil
+	}
+
+	if c.Control != 0 {
+		sub(pxeDiscoveryControl, []byte{c.Control})
+	}
+	if len(c.Servers) > 0 {
+		var v bytes.Buffer
+		for _, s := range c.Servers {
+			binary.Write(&v, binary.BigEndian, s.Type)
+			v.WriteByte(uint8(len(s.IPs)))
+			for _, ip := range s.IPs {
+				ip4 := ip.To4()
+				if ip4 == nil {
+					return nil, fmt.Errorf("PXE boot server %v is not an IPv4 address", ip)
+				}
+				v.Write(ip4)
+			}
+		}
+		if err := sub(pxeBootServers, v.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Menu) > 0 {
+		var v bytes.Buffer
+		for _, m := range c.Menu {
+			if len(m.Desc) > 255 {
+				return nil, fmt.Errorf("PXE menu item %q is too long", m.Desc)
+			}
+			binary.Write(&v, binary.BigEndian, m.Type)
+			v.WriteByte(uint8(len(m.Desc)))
+			v.WriteString(m.Desc)
+		}
+		if err := sub(pxeBootMenu, v.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if c.Prompt != "" {
+		if err := sub(pxeMenuPrompt, append([]byte{c.Timeout}, c.Prompt...)); err != nil {
+			return nil, err
+		}
+	}
+	if !c.NoEnd {
+		b.WriteByte(pxeEnd)
+	}
+	return b.Bytes(), nil
+}
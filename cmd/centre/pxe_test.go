@@ -0,0 +1,136 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPXERaspi(t *testing.T) {
+	c, err := pxeProfile("raspi", net.IPv4(192, 168, 0, 1), pxeOpts{Menu: "Harvey"})
+	if err != nil {
+		t.Fatalf("pxeProfile: want nil, got %v", err)
+	}
+	b, err := c.marshal()
+	if err != nil {
+		t.Fatalf("marshal: want nil, got %v", err)
+	}
+	// What we sent before there were profiles.
+	want := []byte("\x09\x14\x00\x00\x11Raspberry Pi Boot")
+	if !bytes.Equal(b, want) {
+		t.Errorf("raspi option 43: want %q, got %q", want, b)
+	}
+}
+
+func TestPXE(t *testing.T) {
+	c, err := pxeProfile("pxe", net.IPv4(192, 168, 0, 1), pxeOpts{Menu: "Harvey", Prompt: "Boot?", Timeout: 5})
+	if err != nil {
+		t.Fatalf("pxeProfile: want nil, got %v", err)
+	}
+	b, err := c.marshal()
+	if err != nil {
+		t.Fatalf("marshal: want nil, got %v", err)
+	}
+	want := []byte{
+		6, 1, 0x0f,
+		8, 7, 0x80, 0x00, 1, 192, 168, 0, 1,
+		9, 9, 0x80, 0x00, 6, 'H', 'a', 'r', 'v', 'e', 'y',
+		10, 6, 5, 'B', 'o', 'o', 't', '?',
+		255,
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("pxe option 43: want %v, got %v", want, b)
+	}
+}
+
+func TestPXELocal(t *testing.T) {
+	for _, tt := range []struct {
+		first bool
+		menu  []byte
+	}{
+		{false, []byte{
+			9, 16,
+			0x80, 0x00, 6, 'H', 'a', 'r', 'v', 'e', 'y',
+			0x00, 0x00, 4, 'D', 'i', 's', 'k',
+		}},
+		{true, []byte{
+			9, 16,
+			0x00, 0x00, 4, 'D', 'i', 's', 'k',
+			0x80, 0x00, 6, 'H', 'a', 'r', 'v', 'e', 'y',
+		}},
+	} {
+		c, err := pxeProfile("pxe", net.IPv4(192, 168, 0, 1), pxeOpts{Menu: "Harvey", Local: "Disk", LocalFirst: tt.first, Prompt: "Boot?", Timeout: 5})
+		if err != nil {
+			t.Fatalf("pxeProfile: want nil, got %v", err)
+		}
+		b, err := c.marshal()
+		if err != nil {
+			t.Fatalf("marshal: want nil, got %v", err)
+		}
+		// Without pxeBootFile, so that the ROM shows the menu.
+		want := []byte{6, 1, 0x07, 8, 7, 0x80, 0x00, 1, 192, 168, 0, 1}
+		want = append(want, tt.menu...)
+		want = append(want, 10, 6, 5, 'B', 'o', 'o', 't', '?', 255)
+		if !bytes.Equal(b, want) {
+			t.Errorf("pxe option 43 with local boot first %v: want %v, got %v", tt.first, want, b)
+		}
+	}
+
+	// A menu which waits for ever is no fallback.
+	for _, o := range []pxeOpts{
+		{Menu: "Harvey", Local: "Disk"},
+		{Menu: "Harvey", Local: "Disk", Prompt: "Boot?", Timeout: 255},
+	} {
+		if _, err := pxeProfile("pxe", net.IPv4(192, 168, 0, 1), o); err == nil {
+			t.Errorf("pxeProfile(%+v): want error, got nil", o)
+		}
+	}
+}
+
+func TestPXEItem(t *testing.T) {
+	b := pxeItemReply(pxeBootType, 0)
+	if want := []byte{71, 4, 0x80, 0x00, 0, 0, 255}; !bytes.Equal(b, want) {
+		t.Errorf("pxeItemReply: want %v, got %v", want, b)
+	}
+	for _, tt := range []struct {
+		opt        []byte
+		typ, layer uint16
+		ok         bool
+	}{
+		{b, pxeBootType, 0, true},
+		{[]byte{0, 6, 1, 0x0f, 71, 4, 0x80, 0x01, 0x00, 0x02, 255}, 0x8001, 2, true},
+		{[]byte{6, 1, 0x0f, 255, 71, 4, 0x80, 0x00, 0, 0}, 0, 0, false},
+		{[]byte{71, 4, 0x80}, 0, 0, false},
+		{nil, 0, 0, false},
+	} {
+		typ, layer, ok := pxeItem(tt.opt)
+		if typ != tt.typ || layer != tt.layer || ok != tt.ok {
+			t.Errorf("pxeItem(%v): want (%#x, %d, %v), got (%#x, %d, %v)", tt.opt, tt.typ, tt.layer, tt.ok, typ, layer, ok)
+		}
+	}
+}
+
+func TestPXEBad(t *testing.T) {
+	if _, err := pxeProfile("bios", nil, pxeOpts{}); err == nil {
+		t.Errorf("pxeProfile(bios): want error, got nil")
+	}
+	c, err := pxeProfile("pxe", net.ParseIP("fe80::1"), pxeOpts{Menu: "Harvey"})
+	if err != nil {
+		t.Fatalf("pxeProfile: want nil, got %v", err)
+	}
+	if _, err := c.marshal(); err == nil {
+		t.Errorf("marshal with IPv6 boot server: want error, got nil")
+	}
+	c, err = pxeProfile("pxe", net.IPv4(192, 168, 0, 1), pxeOpts{Menu: strings.Repeat("x", 300)})
+	if err != nil {
+		t.Fatalf("pxeProfile: want nil, got %v", err)
+	}
+	if _, err := c.marshal(); err == nil {
+		t.Errorf("marshal with 300 byte menu item: want error, got nil")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// limiterLogEvery is how often a macLimiter logs, at most, that it is
+// dropping one client's requests, however many it drops.
+var limiterLogEvery = 10 * time.Second
+
+// maxLimitedMACs is how many clients a macLimiter keeps track of at
+// most. Past that, until some have been idle long enough to forget,
+// new ones aren't limited: a flood of made-up MACs mustn't cost us
+// all our memory.
+const maxLimitedMACs = 1 << 16
+
+// A macLimiter limits how many DHCP requests a second are answered from
+// each client, by MAC, so that one which has gone wrong, and sends
+// DISCOVERs in a tight loop, can't flood the logs and the wire, and
+// drown out the rest. Each MAC has a bucket of rate tokens, topped up
+// at rate a second; each request takes one, and one which finds none
+// is dropped.
+type macLimiter struct {
+	rate float64
+	// idle is how long a MAC has to be quiet for to be forgotten.
+	idle time.Duration
+	logf func(string, ...interface{})
+
+	mu sync.Mutex
+	m  map[string]*macBucket
+}
+
+// A macBucket is what a macLimiter knows of one MAC.
+type macBucket struct {
+	tokens float64
+	// last is when tokens was last topped up, which is when the
+	// last request came.
+	last time.Time
+	// dropped counts the requests dropped since the last log line,
+	// which was at logged.
+	dropped int
+	logged  time.Time
+}
+
+// newMACLimiter returns a macLimiter which answers rate requests a
+// second from each MAC, and forgets MACs idle for idle.
+func newMACLimiter(rate int, idle time.Duration) *macLimiter {
+	return &macLimiter{rate: float64(rate), idle: idle, logf: log.Printf, m: make(map[string]*macBucket)}
+}
+
+// allow reports whether a request from mac, which came at now, is to be
+// answered. A request which isn't gets a log line, unless one has been
+// logged for mac in the last limiterLogEvery, in which case the next
+// counts it.
+func (l *macLimiter) allow(mac string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.m[mac]
+	if !ok {
+		if len(l.m) >= maxLimitedMACs {
+			l.expireLocked(now)
+			if len(l.m) >= maxLimitedMACs {
+				return true
+			}
+		}
+		b = &macBucket{tokens: l.rate, last: now}
+		l.m[mac] = b
+	}
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens += d.Seconds() * l.rate
+		if b.tokens > l.rate {
+			b.tokens = l.rate
+		}
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+	b.dropped++
+	if now.Sub(b.logged) >= limiterLogEvery {
+		l.logf("DHCPv4: dropped %d requests from %s, which sends more than %v a second; no more said of it for %v", b.dropped, mac, l.rate, limiterLogEvery)
+		b.dropped, b.logged = 0, now
+	}
+	return false
+}
+
+// expireLocked forgets the MACs which have been quiet for l.idle, by
+// now. l.mu must be held.
+func (l *macLimiter) expireLocked(now time.Time) {
+	for mac, b := range l.m {
+		if now.Sub(b.last) >= l.idle {
+			delete(l.m, mac)
+		}
+	}
+}
+
+// sweep forgets idle MACs every interval. It does not return.
+func (l *macLimiter) sweep(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		l.mu.Lock()
+		l.expireLocked(now)
+		l.mu.Unlock()
+	}
+}
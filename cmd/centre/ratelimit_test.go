@@ -0,0 +1,59 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMACLimiter(t *testing.T) {
+	l := newMACLimiter(2, time.Minute)
+	var logged []string
+	l.logf = func(f string, args ...interface{}) { logged = append(logged, fmt.Sprintf(f, args...)) }
+	const a, b = "02:00:00:00:00:0a", "02:00:00:00:00:0b"
+	now := time.Unix(1e9, 0)
+
+	// Two a second, with no more saved up than that.
+	for i, want := range []bool{true, true, false, false} {
+		if got := l.allow(a, now); got != want {
+			t.Errorf("request %d from a at once: want %v, got %v", i, want, got)
+		}
+	}
+	if !l.allow(b, now) {
+		t.Errorf("first request from b: want it allowed, whatever a does")
+	}
+	if len(logged) != 1 {
+		t.Errorf("log lines for two dropped requests: want 1, got %q", logged)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow(a, now) || l.allow(a, now) {
+		t.Errorf("requests from a after half a second: want one allowed, and no more")
+	}
+
+	// The next log line, at the first drop once limiterLogEvery is
+	// up, counts what was dropped meanwhile: two, and itself.
+	now = now.Add(limiterLogEvery)
+	for i := 0; i < 5; i++ {
+		l.allow(a, now)
+	}
+	if len(logged) != 2 || !strings.HasPrefix(logged[1], "DHCPv4: dropped 3 ") {
+		t.Errorf("log lines after %v: want a second, counting 3 dropped, got %q", limiterLogEvery, logged)
+	}
+
+	// Idle MACs are forgotten.
+	now = now.Add(time.Minute)
+	l.allow(b, now)
+	l.mu.Lock()
+	l.expireLocked(now)
+	_, aKept := l.m[a]
+	_, bKept := l.m[b]
+	l.mu.Unlock()
+	if aKept || !bKept {
+		t.Errorf("after a minute of a being quiet: want a forgotten and b kept, got a %v and b %v", aKept, bKept)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// firstBackoff is how long retry waits after the first failure. It
+// doubles after each, up to maxBackoff.
+var (
+	firstBackoff = 250 * time.Millisecond
+	maxBackoff   = 5 * time.Second
+)
+
+// retry calls f until it succeeds, or until timeout has passed, logging
+// each failure, and returns f's last error. With a timeout of 0, f is
+// called once. It is for what may fail at boot only because it comes
+// before what it needs, such as a network interface.
+func retry(what string, timeout time.Duration, f func() error) error {
+	deadline := time.Now().Add(timeout)
+	wait := firstBackoff
+	for try := 1; ; try++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return err
+		}
+		if wait > left {
+			wait = left
+		}
+		log.Printf("%s: try %d: %v; trying again in %v", what, try, err, wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	defer func(f, m time.Duration) { firstBackoff, maxBackoff = f, m }(firstBackoff, maxBackoff)
+	firstBackoff, maxBackoff = time.Millisecond, 4*time.Millisecond
+	errDown := errors.New("interface is down")
+
+	tries := 0
+	err := retry("bind", time.Minute, func() error {
+		if tries++; tries < 4 {
+			return errDown
+		}
+		return nil
+	})
+	if err != nil || tries != 4 {
+		t.Errorf("retry, failing three times: want (nil, 4 tries), got (%v, %d tries)", err, tries)
+	}
+
+	tries = 0
+	err = retry("bind", 0, func() error { tries++; return errDown })
+	if err != errDown || tries != 1 {
+		t.Errorf("retry, with no timeout: want (%v, 1 try), got (%v, %d tries)", errDown, err, tries)
+	}
+
+	tries = 0
+	start := time.Now()
+	err = retry("bind", 50*time.Millisecond, func() error { tries++; return errDown })
+	if d := time.Since(start); err != errDown || d < 50*time.Millisecond || d > 10*time.Second {
+		t.Errorf("retry, always failing: want %v after 50ms, got %v after %v", errDown, err, d)
+	}
+	if tries < 3 {
+		t.Errorf("retry, always failing for 50ms: want several tries, got %d", tries)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// routeKeyword starts a line of a host file which gives a route for
+// one machine, rather than an address:
+//
+//	route <dest>/<bits> <router> u<mac>
+//
+// e.g. "route 10.1.0.0/16 192.168.0.254 u020000000005". The machine
+// is sent the route, along with any -routes, in option 121.
+const routeKeyword = "route"
+
+// parseRoute returns the route to dest, a network such as
+// 10.1.0.0/16, through router. Both must be IPv4.
+func parseRoute(dest, router string) (*dhcpv4.Route, error) {
+	ip, n, err := net.ParseCIDR(dest)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("%q is not an IPv4 network", dest)
+	}
+	if !ip.Equal(n.IP) {
+		return nil, fmt.Errorf("%q has bits set past its prefix: did you mean %v?", dest, n)
+	}
+	r := net.ParseIP(router).To4()
+	if r == nil {
+		return nil, fmt.Errorf("%q is not an IPv4 address", router)
+	}
+	n.IP = n.IP.To4()
+	return &dhcpv4.Route{Dest: n, Router: r}, nil
+}
+
+// parseRoutes parses a comma-separated list of dest=router pairs, e.g.
+// 10.1.0.0/16=192.168.0.254,10.2.0.0/16=192.168.0.253.
+func parseRoutes(s string) (dhcpv4.Routes, error) {
+	var rs dhcpv4.Routes
+	if s == "" {
+		return rs, nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		i := strings.Index(p, "=")
+		if i <= 0 || i == len(p)-1 {
+			return nil, fmt.Errorf("%q: want dest=router", p)
+		}
+		r, err := parseRoute(p[:i], p[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// parseRouteLine parses the fields of a route line of a host file.
+func parseRouteLine(fields []string) (*dhcpv4.Route, net.HardwareAddr, error) {
+	if len(fields) != 4 {
+		return nil, nil, fmt.Errorf("want %s <dest>/<bits> <router> u<mac>", routeKeyword)
+	}
+	r, err := parseRoute(fields[1], fields[2])
+	if err != nil {
+		return nil, nil, err
+	}
+	mac, _ := hostMAC(fields[3])
+	if mac == nil {
+		return nil, nil, fmt.Errorf("%q is not a MAC address", fields[3])
+	}
+	return r, mac, nil
+}
+
+// hostRoutes returns the routes hostFile gives for the machine with
+// MAC address mac. Like lookupIP, it reads the file each time, so that
+// it can be changed without restarting the server. Lines it can't make
+// sense of are skipped: centre check-hosts says what is wrong with them.
+func hostRoutes(hostFile string, mac net.HardwareAddr) (dhcpv4.Routes, error) {
+	if hostFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(hostFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rs dhcpv4.Routes
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) == 0 || fields[0] != routeKeyword {
+			continue
+		}
+		r, m, err := parseRouteLine(fields)
+		if err == nil && bytes.Equal(m, mac) {
+			rs = append(rs, r)
+		}
+	}
+	return rs, scan.Err()
+}
+
+// clientRoutes returns the routes to send a client in option 121: those
+// of its own, from the host file, and then those for everybody which
+// it has none of its own for. A client which is sent option 121 ignores
+// option 3, its routers, so unless there is a route for 0.0.0.0/0
+// already, one through router goes last.
+func clientRoutes(all, own dhcpv4.Routes, router net.IP) dhcpv4.Routes {
+	if len(all) == 0 && len(own) == 0 {
+		return nil
+	}
+	var rs dhcpv4.Routes
+	seen := make(map[string]bool)
+	for _, r := range append(append(dhcpv4.Routes{}, own...), all...) {
+		if d := r.Dest.String(); !seen[d] {
+			seen[d] = true
+			rs = append(rs, r)
+		}
+	}
+	if !seen["0.0.0.0/0"] && router != nil {
+		rs = append(rs, &dhcpv4.Route{
+			Dest:   &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			Router: router.To4(),
+		})
+	}
+	return rs
+}
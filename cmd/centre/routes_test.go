@@ -0,0 +1,68 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	rs, err := parseRoutes("10.1.0.0/16=192.168.0.254,10.2.3.0/24=192.168.0.253")
+	if err != nil {
+		t.Fatalf("parseRoutes: want nil, got %v", err)
+	}
+	if got, want := rs.String(), "route to 10.1.0.0/16 via 192.168.0.254; route to 10.2.3.0/24 via 192.168.0.253"; got != want {
+		t.Errorf("parseRoutes: want %q, got %q", want, got)
+	}
+
+	for _, s := range []string{"10.1.0.0/16", "10.1.0.0/16=", "=192.168.0.254", "10.1.0.1/16=192.168.0.254", "fe80::/64=192.168.0.254", "10.1.0.0/16=fe80::1", "10.1.0.0=192.168.0.254"} {
+		if _, err := parseRoutes(s); err == nil {
+			t.Errorf("parseRoutes(%q): want an error, got nil", s)
+		}
+	}
+}
+
+func TestClientRoutes(t *testing.T) {
+	all, err := parseRoutes("10.1.0.0/16=192.168.0.254,10.2.0.0/16=192.168.0.254")
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, err := parseRoutes("10.2.0.0/16=192.168.0.253")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := net.IPv4(192, 168, 0, 1)
+	for _, tt := range []struct {
+		all, own []string
+		want     string
+	}{
+		{nil, nil, ""},
+		// The client's own route wins, and there is a default route
+		// through router, since option 121 hides option 3.
+		{[]string{"all"}, []string{"own"}, "route to 10.2.0.0/16 via 192.168.0.253; route to 10.1.0.0/16 via 192.168.0.254; route to 0.0.0.0/0 via 192.168.0.1"},
+		{nil, []string{"own"}, "route to 10.2.0.0/16 via 192.168.0.253; route to 0.0.0.0/0 via 192.168.0.1"},
+	} {
+		a, o := all[:0], own[:0]
+		if tt.all != nil {
+			a = all
+		}
+		if tt.own != nil {
+			o = own
+		}
+		if got := clientRoutes(a, o, router).String(); got != tt.want {
+			t.Errorf("clientRoutes(%v, %v): want %q, got %q", tt.all, tt.own, tt.want, got)
+		}
+	}
+
+	// A default route of our own is left alone.
+	def, err := parseRoutes("0.0.0.0/0=192.168.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clientRoutes(def, nil, router).String(), "route to 0.0.0.0/0 via 192.168.0.2"; got != want {
+		t.Errorf("clientRoutes with a default route: want %q, got %q", want, got)
+	}
+}
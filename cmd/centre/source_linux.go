@@ -0,0 +1,51 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+
+	// Not ipv4: that is the -4 flag.
+	xipv4 "golang.org/x/net/ipv4"
+)
+
+// srcConn is a net.PacketConn whose writes go out from src, rather than
+// from whichever of the interface's addresses the kernel picks, so that
+// a reply's source is the server identifier in it. Some clients drop
+// replies where the two differ. Its reads are those of the conn it
+// wraps, which, bound to no address, still gets broadcasts.
+type srcConn struct {
+	net.PacketConn
+	p   *xipv4.PacketConn
+	src net.IP
+}
+
+func newSrcConn(c net.PacketConn, src net.IP) *srcConn {
+	return &srcConn{PacketConn: c, p: xipv4.NewPacketConn(c), src: src}
+}
+
+// WriteTo writes b to to, from src, by way of IP_PKTINFO.
+func (c *srcConn) WriteTo(b []byte, to net.Addr) (int, error) {
+	return c.p.WriteTo(b, &xipv4.ControlMessage{Src: c.src}, to)
+}
+
+// hasAddr reports whether ip is one of the addresses of the named
+// interface.
+func hasAddr(inf string, ip net.IP) (bool, error) {
+	i, err := net.InterfaceByName(inf)
+	if err != nil {
+		return false, err
+	}
+	addrs, err := i.Addrs()
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
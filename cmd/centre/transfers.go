@@ -0,0 +1,112 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"pack.ag/tftp"
+)
+
+// retryAfter is what we tell HTTP clients we turn away.
+const retryAfter = "5"
+
+// transfers limits how many TFTP and HTTP transfers run at once. When a
+// whole rack PXE-boots together, they all want the same big image at the
+// same time; past some point, serving more of them at once only makes
+// every one of them slower.
+type transfers struct {
+	// sem holds a token for each transfer in progress. If it is nil
+	// there is no limit.
+	sem chan struct{}
+
+	active   int64
+	total    int64
+	rejected int64
+}
+
+// newTransfers returns a transfers that allows max at once. If max is
+// zero or less, there is no limit, but we still count.
+func newTransfers(max int) *transfers {
+	t := &transfers{}
+	if max > 0 {
+		t.sem = make(chan struct{}, max)
+	}
+	return t
+}
+
+// start reserves a slot for a transfer. It returns false if all the
+// slots are in use, in which case the transfer should be turned away.
+// If it returns true, done must be called when the transfer is over.
+func (t *transfers) start() bool {
+	if t.sem != nil {
+		select {
+		case t.sem <- struct{}{}:
+		default:
+			atomic.AddInt64(&t.rejected, 1)
+			return false
+		}
+	}
+	atomic.AddInt64(&t.active, 1)
+	atomic.AddInt64(&t.total, 1)
+	return true
+}
+
+// done releases a slot reserved by start.
+func (t *transfers) done() {
+	atomic.AddInt64(&t.active, -1)
+	if t.sem != nil {
+		<-t.sem
+	}
+}
+
+// report logs the number of transfers every interval, for as long as
+// there is anything to say. A limit of 0 means there is none. It does
+// not return.
+func (t *transfers) report(interval time.Duration) {
+	var total, rejected int64
+	for range time.Tick(interval) {
+		a := atomic.LoadInt64(&t.active)
+		nt, nr := atomic.LoadInt64(&t.total), atomic.LoadInt64(&t.rejected)
+		if a == 0 && nt == total && nr == rejected {
+			continue
+		}
+		log.Printf("transfers: %d active (limit %d), %d started and %d rejected in the last %v", a, cap(t.sem), nt-total, nr-rejected, interval)
+		total, rejected = nt, nr
+	}
+}
+
+// tftpHandler wraps h so that it counts against the limit. TFTP has no way
+// to say "try later", so a client that is turned away gets an error,
+// and has to start over.
+func (t *transfers) tftpHandler(h tftp.ReadHandler) tftp.ReadHandler {
+	return tftp.ReadHandlerFunc(func(r tftp.ReadRequest) {
+		if !t.start() {
+			log.Printf("TFTP: too many transfers, rejecting %q for %v", r.Name(), r.Addr())
+			r.WriteError(tftp.ErrCodeNotDefined, "server busy, try again later")
+			return
+		}
+		defer t.done()
+		h.ServeTFTP(r)
+	})
+}
+
+// httpHandler wraps h so that it counts against the limit. Clients turned away
+// get a 503 and are told when to come back.
+func (t *transfers) httpHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.start() {
+			log.Printf("HTTP: too many transfers, rejecting %q for %v", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "server busy, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer t.done()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransfersHTTP(t *testing.T) {
+	xfers := newTransfers(1)
+	inside, release := make(chan struct{}), make(chan struct{})
+	h := xfers.httpHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(inside)
+		<-release
+	}))
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(first, httptest.NewRequest("GET", "/image", nil))
+		close(done)
+	}()
+	<-inside
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/image", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("second request: want %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("second request: want a Retry-After header, got none")
+	}
+
+	close(release)
+	<-done
+	if first.Code != http.StatusOK {
+		t.Errorf("first request: want %d, got %d", http.StatusOK, first.Code)
+	}
+
+	// The slot is free again.
+	if !xfers.start() {
+		t.Fatalf("start after done: want true, got false")
+	}
+	xfers.done()
+}
+
+func TestTransfersUnlimited(t *testing.T) {
+	xfers := newTransfers(0)
+	for i := 0; i < 100; i++ {
+		if !xfers.start() {
+			t.Fatalf("start %d: want true, got false", i)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"harvey-os.org/ninep/protocol"
+	"harvey-os.org/ninep/ufs"
+)
+
+// watchQID returns a QIDFunc which adds the changes w has seen to a
+// file to its QID's version, which is otherwise taken from its
+// modification time, and so may not change if two changes come close
+// together.
+func watchQID(w *watcher) ufs.QIDFunc {
+	return func(name string, fi os.FileInfo) protocol.QID {
+		q := ufs.DefaultQID(fi)
+		q.Version += w.version(name)
+		return q
+	}
+}
+
+// watchHTTP serves files from dir with h, with an ETag made from the
+// QID the file has over 9P with watchQID, so that a file served both
+// ways is the same version both ways, and a client which checks its
+// ETag sees every change. Directories are left to h as they are.
+func watchHTTP(h http.Handler, dir string, w *watcher) http.Handler {
+	qid := watchQID(w)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err == nil && fi.Mode().IsRegular() {
+			q := qid(name, fi)
+			rw.Header().Set("Etag", fmt.Sprintf(`"%x-%x"`, q.Path, q.Version))
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask is what a watcher hears of in each directory: anything
+// which changes a file's contents or metadata, or the directory's.
+const watchMask = unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_CLOSE_WRITE |
+	unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_ONLYDIR
+
+// A watcher counts the changes to each file in a tree, as inotify tells
+// of them, so that a file's version can change however soon after the
+// last one the next change comes: its modification time may not, if
+// the clock is coarse or the changes quick.
+type watcher struct {
+	root string
+	// f is the inotify descriptor fd, as a File so that Close stops
+	// a Read. fd is kept apart because f.Fd() would make f block.
+	f  *os.File
+	fd int
+
+	mu sync.Mutex
+	// changes counts the changes to each file, by its name rooted at
+	// "/". A change to a file is a change to its directory, too.
+	changes map[string]uint32
+	// epoch counts the times inotify's queue overflowed, and so
+	// changes may have been missed: it is in every file's version.
+	epoch uint32
+	// dirs are the names of the directories watched, by watch
+	// descriptor.
+	dirs map[int]string
+}
+
+func newWatcher(root string) (*watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("watching %s: %v", root, err)
+	}
+	w := &watcher{
+		root:    root,
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		changes: make(map[string]uint32),
+		dirs:    make(map[int]string),
+	}
+	if err := w.add("/"); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// add watches the directory name, and those below it.
+func (w *watcher) add(name string) error {
+	return filepath.Walk(filepath.Join(w.root, filepath.FromSlash(name)), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Gone already: whatever took it will be heard of.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(w.root, p)
+		if err != nil {
+			return err
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, p, watchMask)
+		if err != nil {
+			return fmt.Errorf("watching %s: %v", p, err)
+		}
+		w.mu.Lock()
+		w.dirs[wd] = path.Join("/", filepath.ToSlash(rel))
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// version returns how many times the file name, rooted at "/", has
+// changed since w began watching it.
+func (w *watcher) version(name string) uint32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.changes[path.Join("/", name)] + w.epoch
+}
+
+func (w *watcher) run() {
+	b := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(b)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("Watching %s: %v; changes made in the same instant may not be seen", w.root, err)
+			}
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&b[off]))
+			name := b[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			w.event(int(ev.Wd), ev.Mask, string(name))
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+		}
+	}
+}
+
+// event counts a change to name in the directory watched as wd.
+func (w *watcher) event(wd int, mask uint32, name string) {
+	w.mu.Lock()
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		w.epoch++
+		w.mu.Unlock()
+		return
+	}
+	dir, ok := w.dirs[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+	w.changes[dir]++
+	p := dir
+	if name != "" {
+		p = path.Join(dir, name)
+		w.changes[p]++
+	}
+	w.mu.Unlock()
+
+	if mask&unix.IN_ISDIR != 0 && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+		if err := w.add(p); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func (w *watcher) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor waits for ok, for up to five seconds.
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	for end := time.Now().Add(5 * time.Second); !ok(); time.Sleep(time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatalf("gave up waiting for %s", what)
+		}
+	}
+}
+
+func newTestWatcher(t *testing.T) (*watcher, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, "f"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newWatcher(dir)
+	if err != nil {
+		t.Fatalf("newWatcher: want nil, got %v", err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w, dir
+}
+
+func TestWatcher(t *testing.T) {
+	w, dir := newTestWatcher(t)
+	if v := w.version("/f"); v != 0 {
+		t.Errorf("version(/f) before a change: want 0, got %d", v)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "f"), []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a change to /f", func() bool { return w.version("/f") > 0 })
+	if w.version("/") == 0 {
+		t.Errorf("version(/): want a change to f to change its directory, got 0")
+	}
+	if v := w.version("/d"); v != 0 {
+		t.Errorf("version(/d): want 0, got %d", v)
+	}
+
+	// A new directory is watched too.
+	if err := os.Mkdir(filepath.Join(dir, "d", "e"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "d/e to be watched", func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for _, d := range w.dirs {
+			if d == "/d/e" {
+				return true
+			}
+		}
+		return false
+	})
+	if err := ioutil.WriteFile(filepath.Join(dir, "d", "e", "g"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a change to /d/e/g", func() bool { return w.version("d/e/g") > 0 })
+}
+
+func TestWatchQID(t *testing.T) {
+	w, dir := newTestWatcher(t)
+	qid := watchQID(w)
+	name := filepath.Join(dir, "f")
+	fi, err := os.Lstat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := qid("/f", fi)
+
+	// A change which leaves the modification time as it was.
+	if err := ioutil.WriteFile(name, []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a change to /f", func() bool { return w.version("/f") > 0 })
+	if fi, err = os.Lstat(name); err != nil {
+		t.Fatal(err)
+	}
+	after := qid("/f", fi)
+	if after.Path != before.Path || after.Version == before.Version {
+		t.Errorf("QID after a change: want path %d and a version other than %d, got %v", before.Path, before.Version, after)
+	}
+}
+
+func TestWatchHTTP(t *testing.T) {
+	w, dir := newTestWatcher(t)
+	s := httptest.NewServer(watchHTTP(http.FileServer(http.Dir(dir)), dir, w))
+	defer s.Close()
+	get := func(etag string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", s.URL+"/f", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	resp, body := get("")
+	etag := resp.Header.Get("Etag")
+	if resp.StatusCode != http.StatusOK || body != "one" || etag == "" {
+		t.Fatalf("GET /f: want 200, one and an ETag, got %v, %q and %q", resp.Status, body, etag)
+	}
+	// The ETag is the QID 9P has for the file.
+	fi, err := os.Lstat(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := watchQID(w)("/f", fi); etag != fmt.Sprintf(`"%x-%x"`, q.Path, q.Version) {
+		t.Errorf("GET /f: want the ETag to be the QID %v, got %s", q, etag)
+	}
+	if resp, _ := get(etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET /f with If-None-Match: want 304, got %v", resp.Status)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "f"), []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "f"), fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a change to /f", func() bool { return w.version("/f") > 0 })
+	if resp, body := get(etag); resp.StatusCode != http.StatusOK || body != "two" || resp.Header.Get("Etag") == etag {
+		t.Errorf("GET /f with If-None-Match after a change: want 200, two and a new ETag, got %v, %q and %q", resp.Status, body, resp.Header.Get("Etag"))
+	}
+
+	// Directories are as they were.
+	resp, err = http.Get(s.URL + "/d/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Etag") != "" {
+		t.Errorf("GET /d/: want 200 and no ETag, got %v and %q", resp.Status, resp.Header.Get("Etag"))
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// A watcher would count the changes to each file in a tree, but there
+// is no inotify here.
+type watcher struct{}
+
+func newWatcher(root string) (*watcher, error) {
+	return nil, fmt.Errorf("can't watch %s for changes on %s", root, runtime.GOOS)
+}
+
+func (w *watcher) version(name string) uint32 {
+	return 0
+}
+
+func (w *watcher) Close() error {
+	return nil
+}
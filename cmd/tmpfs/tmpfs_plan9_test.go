@@ -23,7 +23,7 @@ func TestNwTmpfs(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	fs := &fileServer{archive: arch, files: make(map[protocol.FID]*FidEntry), ioUnit: 1 * 1024 * 1024}
+	fs := tmpfs.NewFileServer(arch, 1*1024*1024)
 
 	// TODO: get the tracing back in.
 	// The ninep package was from a long time ago and it's
@@ -42,7 +42,7 @@ func TestMount(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	fs := &fileServer{archive: arch, files: make(map[protocol.FID]*FidEntry), ioUnit: 1 * 1024 * 1024}
+	fs := tmpfs.NewFileServer(arch, 1*1024*1024)
 
 	// TODO: get the tracing back in.
 	// The ninep package was from a long time ago and it's
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// level is a protocol.Logger whose level can be changed while ufs runs,
+// by SIGUSR1 and SIGUSR2 where there are signals. Its level is as for
+// -debug: 0 logs nothing, 1 logs connections, 2 each request as well,
+// and 3 each message in hex as well.
+type level struct {
+	trace protocol.Tracer
+	debug int32
+}
+
+func (l *level) Enabled(lv protocol.Level) bool {
+	return int32(lv) < atomic.LoadInt32(&l.debug)
+}
+
+func (l *level) Logf(lv protocol.Level, format string, args ...interface{}) {
+	if l.Enabled(lv) {
+		l.trace(format, args...)
+	}
+}
+
+// add changes the level by n, keeping it between 0 and 3, and logs the
+// new level if it changed.
+func (l *level) add(n int32) {
+	for {
+		old := atomic.LoadInt32(&l.debug)
+		d := old + n
+		if d < 0 {
+			d = 0
+		}
+		if d > int32(protocol.LevelWire)+1 {
+			d = int32(protocol.LevelWire) + 1
+		}
+		if d == old {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&l.debug, old, d) {
+			log.Printf("debug level is now %d", d)
+			return
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+func TestLevel(t *testing.T) {
+	var got []string
+	l := &level{trace: func(format string, args ...interface{}) { got = append(got, format) }}
+	l.Logf(protocol.LevelInfo, "off")
+	for i, want := range []int32{1, 2, 3, 3} {
+		l.add(1)
+		if l.debug != want {
+			t.Errorf("after %d ups: want level %d, got %d", i+1, want, l.debug)
+		}
+	}
+	l.Logf(protocol.LevelWire, "wire")
+	for i := 0; i < 5; i++ {
+		l.add(-1)
+	}
+	if l.debug != 0 || l.Enabled(protocol.LevelInfo) {
+		t.Errorf("after turning down: want level 0, nothing enabled, got %d", l.debug)
+	}
+	l.add(1)
+	l.Logf(protocol.LevelInfo, "info")
+	l.Logf(protocol.LevelDebug, "debug")
+	if len(got) != 2 || got[0] != "wire" || got[1] != "info" {
+		t.Errorf("traces: want [wire info], got %v", got)
+	}
+}
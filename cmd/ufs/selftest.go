@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+	"harvey-os.org/ninep/ufs"
+)
+
+// selftestTimeout bounds each step of selftest, so that a server that
+// never answers fails the test rather than hanging it.
+const selftestTimeout = 10 * time.Second
+
+// selftest serves root on a loopback address, through the same code as
+// ufs serves it otherwise, and has a client do a version, an attach, a
+// walk to name, within root, an open, a read, a stat and clunks. It
+// writes a line to w for each step, and returns the error from the
+// first that fails.
+func selftest(w io.Writer, root, name string, fsOpts []ufs.Opt) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintf(w, "selftest: listen: FAIL: %v\n", err)
+		return err
+	}
+	l, err := ufs.NewUFSWithOpts(root, 0, fsOpts)
+	if err != nil {
+		ln.Close()
+		fmt.Fprintf(w, "selftest: serve: FAIL: %v\n", err)
+		return err
+	}
+	go l.Serve(ln)
+	defer l.Close()
+	return checkServer(w, ln.Addr().String(), name)
+}
+
+// checkServer has a client do what selftest says with the server at the dial
+// string addr, e.g. tcp!host!5640 or unix!/run/ufs.sock: see
+// protocol.ParseDialString.
+func checkServer(w io.Writer, addr, name string) error {
+	var c *protocol.Client
+	const msize = 8192 + protocol.IOHDRSZ
+	var elems []string
+	if p := path.Clean("/" + name); p != "/" {
+		elems = strings.Split(p[1:], "/")
+	}
+	steps := []struct {
+		name string
+		f    func() (string, error)
+	}{
+		{"dial " + addr, func() (string, error) {
+			conn, err := protocol.DialAddr(addr)
+			if err != nil {
+				return "", err
+			}
+			c, err = protocol.NewClient(func(c *protocol.Client) error {
+				c.FromNet, c.ToNet = conn, conn
+				c.Msize = msize
+				return nil
+			})
+			return "", err
+		}},
+		{"version", func() (string, error) {
+			m, v, err := c.CallTversion(msize, protocol.Version)
+			if err == nil && v != protocol.Version {
+				err = fmt.Errorf("got version %q", v)
+			}
+			return fmt.Sprintf("%s, msize %d", v, m), err
+		}},
+		{"attach", func() (string, error) {
+			q, err := c.CallTattach(0, protocol.NOFID, "", "")
+			return fmt.Sprint(q), err
+		}},
+		{"walk " + path.Join("/", name), func() (string, error) {
+			q, err := c.CallTwalk(0, 1, elems)
+			if err == nil && len(q) != len(elems) {
+				err = fmt.Errorf("walked only %d of %d names", len(q), len(elems))
+			}
+			return fmt.Sprint(q), err
+		}},
+		{"open", func() (string, error) {
+			q, _, err := c.CallTopen(1, protocol.OREAD)
+			return fmt.Sprint(q), err
+		}},
+		{"read", func() (string, error) {
+			d, err := c.CallTread(1, 0, 8192)
+			return fmt.Sprintf("%d bytes", len(d)), err
+		}},
+		{"stat", func() (string, error) {
+			b, err := c.CallTstat(1)
+			return fmt.Sprintf("%d bytes", len(b)), err
+		}},
+		{"clunk", func() (string, error) {
+			if err := c.CallTclunk(1); err != nil {
+				return "", err
+			}
+			return "", c.CallTclunk(0)
+		}},
+	}
+	for _, s := range steps {
+		type result struct {
+			what string
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			what, err := s.f()
+			done <- result{what, err}
+		}()
+		var r result
+		select {
+		case r = <-done:
+		case <-time.After(selftestTimeout):
+			r.err = fmt.Errorf("no answer after %v", selftestTimeout)
+		}
+		if r.err != nil {
+			fmt.Fprintf(w, "selftest: %s: FAIL: %v\n", s.name, r.err)
+			return fmt.Errorf("%s: %w", s.name, r.err)
+		}
+		if r.what != "" {
+			fmt.Fprintf(w, "selftest: %s: ok: %s\n", s.name, r.what)
+		} else {
+			fmt.Fprintf(w, "selftest: %s: ok\n", s.name)
+		}
+	}
+	fmt.Fprintf(w, "selftest: PASS\n")
+	return nil
+}
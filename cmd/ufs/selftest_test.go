@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"harvey-os.org/ninep/protocol"
+	"harvey-os.org/ninep/ufs"
+)
+
+func TestSelftest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc", "motd"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/", "etc/motd", "/etc/../etc/motd"} {
+		var b bytes.Buffer
+		if err := selftest(&b, dir, name, nil); err != nil || !strings.HasSuffix(b.String(), "selftest: PASS\n") {
+			t.Errorf("selftest of %q: want PASS, got %v and\n%s", name, err, b.String())
+		}
+		if name != "/" && !strings.Contains(b.String(), "read: ok: 5 bytes") {
+			t.Errorf("selftest of %q: want 5 bytes read, got\n%s", name, b.String())
+		}
+	}
+
+	var b bytes.Buffer
+	err = selftest(&b, dir, "etc/nonesuch", nil)
+	if err == nil || !strings.Contains(b.String(), "selftest: walk /etc/nonesuch: FAIL") || strings.Contains(b.String(), "PASS") {
+		t.Errorf("selftest of a missing file: want the walk to fail, got %v and\n%s", err, b.String())
+	}
+}
+
+func TestCheckServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "motd"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := "unix!" + filepath.Join(dir, "ufs.sock")
+	ln, err := protocol.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ufs.NewUFS(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.Serve(ln)
+	defer l.Close()
+
+	var b bytes.Buffer
+	if err := checkServer(&b, addr, "motd"); err != nil || !strings.Contains(b.String(), "read: ok: 5 bytes") {
+		t.Errorf("checkServer(%q): want 5 bytes read, got %v and\n%s", addr, err, b.String())
+	}
+	b.Reset()
+	if err := checkServer(&b, "udp!localhost!564", "motd"); err == nil || !strings.Contains(b.String(), "dial udp!localhost!564: FAIL") {
+		t.Errorf("checkServer of a bad dial string: want the dial to fail, got %v and\n%s", err, b.String())
+	}
+}
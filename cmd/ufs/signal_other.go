@@ -0,0 +1,7 @@
+//go:build plan9 || windows
+// +build plan9 windows
+
+package main
+
+// levelSignals does nothing: there are no SIGUSR1 and SIGUSR2 here.
+func levelSignals(l *level) {}
@@ -0,0 +1,25 @@
+//go:build !plan9 && !windows
+// +build !plan9,!windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// levelSignals makes SIGUSR1 turn l up, and SIGUSR2 turn it down.
+func levelSignals(l *level) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for s := range c {
+			if s == syscall.SIGUSR1 {
+				l.add(1)
+			} else {
+				l.add(-1)
+			}
+		}
+	}()
+}
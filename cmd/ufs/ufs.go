@@ -1,42 +1,136 @@
 // UFS is a userspace server which exports a filesystem over 9p2000.
 //
 // By default, it will export / over a TCP on port 5640 under the username
-// of "harvey".
+// of "harvey". -net unix -addr /run/ufs.sock serves on a unix socket
+// instead, and -net vsock -addr :5640 on a VM socket, for guests. With -tls-cert and -tls-key, it serves over TLS, and with
+// -tls-client-ca as well, only to clients with certificates.
+//
+// -read-only serves the paths given, and what is beneath them,
+// read-only, and -writable makes exceptions of paths beneath those:
+// -read-only / -writable /scratch serves everything read-only but
+// /scratch.
+//
+// -record keeps a record of each connection, for protocol.Replay to play
+// back, e.g. when a client hangs.
+//
+// ufs -selftest checks that the root can be served, by having a client
+// read it over a loopback connection, and exits 1 if it can't. With
+// -selftest-addr tcp!host!5640, or any other dial string, the client
+// checks the server there instead.
 package main
 
 import (
 	"flag"
 	"log"
-	"net"
+	"os"
+	"strings"
 
 	"harvey-os.org/ninep/protocol"
 	"harvey-os.org/ninep/ufs"
 )
 
 var (
-	ntype = flag.String("net", "tcp4", "Default network type")
-	naddr = flag.String("addr", ":5640", "Network address")
-	debug = flag.Int("debug", 0, "print debug messages")
+	ntype = flag.String("net", "tcp4", "Network type: tcp, tcp4, tcp6, unix, or vsock")
+	naddr = flag.String("addr", ":5640", "Network address: host:port, a path for unix, or cid:port for vsock")
+	debug = flag.Int("debug", 0, "print debug messages: 1 for file server calls and connections, 2 for each request as well, 3 for each message in hex as well; SIGUSR1 and SIGUSR2 turn it up and down")
 	root  = flag.String("root", "/", "Set the root for all attaches")
+	trace = flag.String("trace", "", "append protocol traces to this file, rather than the log, at least those of -debug 2")
+	onefs = flag.Bool("one-filesystem", false, "don't walk into file systems mounted beneath the root")
+
+	recordDir      = flag.String("record", "", "record each connection, byte for byte, in a file in this directory, for protocol.Replay")
+	recordMaxBytes = flag.Int64("record-max-bytes", 64<<20, "start a new record file once one has this many bytes; 0 for no limit")
+	recordMaxFiles = flag.Int("record-max-files", 100, "keep only this many record files, removing the oldest; 0 for no limit")
+
+	readOnly = flag.String("read-only", "", "comma-separated paths within the root to serve read-only, e.g. / or /images")
+	writable = flag.String("writable", "", "comma-separated paths beneath -read-only ones to serve writable all the same, e.g. /scratch")
+
+	selftestFlag = flag.Bool("selftest", false, "serve the root on a loopback address, check that a client can version, attach, walk to -selftest-path, open, read, stat and clunk, print how each step went, and exit, 0 if they all passed")
+	selftestPath = flag.String("selftest-path", "/", "path within the root for -selftest to walk to and read")
+	selftestAddr = flag.String("selftest-addr", "", "with -selftest, check the server at this dial string, e.g. tcp!host!5640 or unix!/run/ufs.sock, rather than serving the root")
+
+	tlsCert     = flag.String("tls-cert", "", "serve over TLS, with the PEM certificate in this file")
+	tlsKey      = flag.String("tls-key", "", "PEM key for -tls-cert")
+	tlsClientCA = flag.String("tls-client-ca", "", "require clients to give certificates signed by a CA in this PEM file; the user they attach as must be their certificate's common name")
 )
 
 func main() {
 	flag.Parse()
 
-	ln, err := net.Listen(*ntype, *naddr)
+	var fsOpts []ufs.Opt
+	if *onefs {
+		fsOpts = append(fsOpts, ufs.WithOneFilesystem())
+	}
+	if rules := pathRules(*readOnly, *writable); len(rules) > 0 {
+		fsOpts = append(fsOpts, ufs.WithPathRules(rules...))
+	}
+
+	if *selftestFlag {
+		check := func() error { return selftest(os.Stdout, *root, *selftestPath, fsOpts) }
+		if *selftestAddr != "" {
+			check = func() error { return checkServer(os.Stdout, *selftestAddr, *selftestPath) }
+		}
+		if err := check(); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	ln, err := protocol.ListenNet(*ntype, *naddr)
 	if err != nil {
 		log.Fatalf("Listen failed: %v", err)
 	}
 
-	ufslistener, err := ufs.NewUFS(*root, *debug, func(l *protocol.NetListener) error {
-		l.Trace = nil
-		if *debug > 1 {
-			l.Trace = log.Printf
+	// -debug 1 logs the file server calls, with DebugFileServer, and
+	// the protocol's connection traces. SIGUSR1 and SIGUSR2 turn the
+	// protocol's traces up and down; the file server calls are logged
+	// only if -debug was set to begin with.
+	lv := &level{trace: log.Printf, debug: int32(*debug)}
+	if *trace != "" {
+		f, err := os.OpenFile(*trace, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("Trace file: %v", err)
+		}
+		lv.trace = log.New(f, "", log.LstdFlags|log.Lmicroseconds).Printf
+		if lv.debug < 2 {
+			lv.debug = 2
+		}
+	}
+	levelSignals(lv)
+	opts := []protocol.NetListenerOpt{protocol.WithLogger(lv)}
+	if *tlsCert != "" {
+		config, err := protocol.LoadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatalf("TLS: %v", err)
 		}
-		return nil
-	})
+		opts = append(opts, protocol.WithTLS(config))
+	} else if *tlsClientCA != "" {
+		log.Fatal("-tls-client-ca needs -tls-cert")
+	}
+	if *recordDir != "" {
+		opts = append(opts, protocol.WithRecording(&protocol.Recording{Dir: *recordDir, MaxBytes: *recordMaxBytes, MaxFiles: *recordMaxFiles}))
+	}
 
-	if err := ufslistener.Serve(ln); err != nil {
+	ufslistener, err := ufs.NewUFSWithOpts(*root, *debug, fsOpts, opts...)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if err :=ufslistener.Serve(ln); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// pathRules makes the PathRules for -read-only and -writable.
+func pathRules(ro, rw string) []ufs.PathRule {
+	var rules []ufs.PathRule
+	for _, l := range []struct {
+		paths    string
+		readOnly bool
+	}{{ro, true}, {rw, false}} {
+		for _, p := range strings.Split(l.paths, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				rules = append(rules, ufs.PathRule{Path: p, ReadOnly: l.readOnly})
+			}
+		}
+	}
+	return rules
 }
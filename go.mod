@@ -1,19 +1,26 @@
 module harvey-os.org
 
-go 1.14
+go 1.18
+
+require (
+	github.com/insomniacslk/dhcp v0.0.0-20200814125043-2e1bf785d039
+	github.com/u-root/u-root v6.0.1-0.20200728234108-3441aaa6cf0c+incompatible
+	github.com/ulikunitz/xz v0.5.8
+	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
+	golang.org/x/sys v0.0.0-20200728102440-3e129f6d46b1
+	pack.ag/tftp v1.0.0
+)
 
 require (
 	github.com/dustin/go-humanize v1.0.0 // indirect
+	github.com/golang/protobuf v1.3.3 // indirect
 	github.com/google/goexpect v0.0.0-20200816234442-b5b77125c2c5 // indirect
+	github.com/google/goterm v0.0.0-20190703233501-fc88cf888a3f // indirect
 	github.com/hugelgupf/socketpair v0.0.0-20190730060125-05d35a94e714 // indirect
-	github.com/insomniacslk/dhcp v0.0.0-20200814125043-2e1bf785d039
 	github.com/mdlayher/ethernet v0.0.0-20190606142754-0394541c37b7 // indirect
 	github.com/mdlayher/raw v0.0.0-20191009151244-50f2db8cc065 // indirect
 	github.com/stretchr/testify v1.6.1 // indirect
-	github.com/u-root/u-root v6.0.1-0.20200728234108-3441aaa6cf0c+incompatible
-	github.com/ulikunitz/xz v0.5.8
-	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
-	golang.org/x/net v0.0.0-20200625001655-4c5254603344 // indirect
-	golang.org/x/sys v0.0.0-20200728102440-3e129f6d46b1 // indirect
-	pack.ag/tftp v1.0.0
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55 // indirect
+	google.golang.org/grpc v1.31.0 // indirect
 )
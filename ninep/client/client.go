@@ -0,0 +1,532 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package client is a 9P2000 client. A Conn is a connection to a
+// server, on which Attach gives a Fid for the root of a tree; Fids walk
+// from there to the files in it, and open, read, write, stat and remove
+// them. A Conn and its Fids may be used from many goroutines at once:
+// each request has a tag of its own, and replies go back to whichever
+// goroutine is waiting for them, in whatever order they come. A Fid's
+// WithContext gives a Fid whose requests are given up on, and flushed,
+// once a context is done, and its WithRetry one whose idempotent
+// requests are tried again when they fail in a way which may pass.
+// WithMiddleware wraps every request a Conn sends, e.g. in Trace or
+// Stats, to log or count them.
+//
+// An error from the server comes back as a *RemoteError, which errors.Is
+// matches with the protocol package's Err values, e.g.
+// protocol.ErrNotExist, and with package os's, e.g. os.ErrNotExist,
+// whichever words the server has for them. A failure of the connection
+// itself comes back as a *TransportError, and once there has been one,
+// everything done on the Conn fails with it. A reply which breaks the
+// protocol's rules is one of those, for ErrProtocol.
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// DefaultMsize is the msize Dial and Probe offer. The server may settle
+// on less.
+const DefaultMsize = 64*1024 + protocol.IOHDRSZ
+
+// A RemoteError is an Rerror: the server understood the request, and
+// says why it failed.
+type RemoteError struct {
+	Op  string
+	Msg string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Op + ": " + e.Msg
+}
+
+// Unwrap returns the protocol package's Err value for the message, if
+// it is one of theirs, or says the same in other words, so that
+// errors.Is(err, protocol.ErrNotExist) works, as does os.ErrNotExist.
+func (e *RemoteError) Unwrap() error {
+	var pe *protocol.Error
+	if errors.As(protocol.ErrorFor(e.Msg), &pe) {
+		return pe
+	}
+	return nil
+}
+
+// A TransportError is a failure of the connection: a read or write on
+// it failed, or the server sent something which made no sense. The
+// Conn is closed, and whatever it was doing may or may not have been
+// done.
+type TransportError struct {
+	Op  string
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// ErrClosed is the TransportError's Err once Close has been called.
+var ErrClosed = errors.New("connection closed")
+
+// ErrProtocol is in the TransportError's Err when the server broke the
+// protocol's rules: it replied with a tag not in use, or with the wrong
+// type of reply, or with one which holds what it can't, e.g. more
+// data than was asked for, or more QIDs than names walked. The Conn is
+// failed, since what it knows of the server's state can't be trusted.
+var ErrProtocol = errors.New("protocol violation")
+
+// ErrNotNineP is in the TransportError's Err when what answers a
+// Tversion isn't 9P, e.g. a web server, so that errors.Is can tell it
+// from a server which is down.
+var ErrNotNineP = errors.New("not a 9P server")
+
+// A Conn is a 9P2000 connection to a server.
+type Conn struct {
+	rwc   io.ReadWriteCloser
+	msize uint32
+
+	// tags holds the tags not in use.
+	tags chan protocol.Tag
+	// fid is the last FID handed out.
+	fid uint32
+
+	// middleware is what WithMiddleware gave; rt is the RoundTripper
+	// it makes, if it gave any.
+	middleware []Middleware
+	rt         RoundTripper
+
+	// wmu makes each message go out whole.
+	wmu sync.Mutex
+
+	// mu guards below.
+	mu sync.Mutex
+	// pending has, for each tag in use, where its reply goes.
+	pending map[protocol.Tag]chan []byte
+	// err is why the Conn is done with, if it is; done is closed then.
+	err  error
+	done chan struct{}
+}
+
+// Dial connects to the 9P server at addr on network, as net.Dial does,
+// and settles the version and msize with it. ctx bounds the dial and
+// the Tversion; once Dial returns, it has no more effect.
+func Dial(ctx context.Context, network, addr string, opts ...ConnOpt) (*Conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewConn(ctx, nc, DefaultMsize, opts...)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialAddr connects to the 9P server at the dial string addr, as
+// Connect does, and settles the version and msize with it, as Dial
+// does.
+func DialAddr(ctx context.Context, addr string, opts ...ConnOpt) (*Conn, error) {
+	rwc, err := Connect(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewConn(ctx, rwc, DefaultMsize, opts...)
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Connect connects to the dial string addr, Plan 9's tcp!host!port or
+// Go's host:port, or any other protocol.ParseDialString takes, and
+// returns the connection, for NewConn, or for a Session's dial func.
+// A path, or unix!path, which is not a socket is a file to open and
+// speak 9P on, e.g. one in /srv on Plan 9 and Harvey.
+func Connect(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+	network, address, err := protocol.ParseDialString(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "unix", "unixpacket":
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket == 0 {
+			return os.OpenFile(address, os.O_RDWR, 0)
+		}
+	case "vsock":
+		return protocol.DialNet(network, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// NewConn returns a Conn which speaks 9P2000 on rwc, offering the
+// server msize. ctx bounds the Tversion; if it is done first, rwc is
+// closed.
+func NewConn(ctx context.Context, rwc io.ReadWriteCloser, msize uint32, opts ...ConnOpt) (*Conn, error) {
+	c := &Conn{
+		rwc:     rwc,
+		msize:   msize,
+		tags:    make(chan protocol.Tag, protocol.NumTags),
+		pending: make(map[protocol.Tag]chan []byte),
+		done:    make(chan struct{}),
+	}
+	for t := 1; t < int(protocol.NOTAG); t++ {
+		c.tags <- protocol.Tag(t)
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if len(c.middleware) > 0 {
+		c.rt = c.roundTrip
+		for i := len(c.middleware) - 1; i >= 0; i-- {
+			c.rt = c.middleware[i](c.rt)
+		}
+	}
+
+	// If ctx is done first, rwc is closed, and the Tversion fails.
+	versioned, watched := make(chan struct{}), make(chan struct{})
+	var cancelled bool
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			cancelled = true
+			rwc.Close()
+		case <-versioned:
+		}
+	}()
+	err := c.version()
+	close(versioned)
+	<-watched
+	if cancelled {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	go c.readReplies()
+	return c, nil
+}
+
+// version does the Tversion, before there is anything else going on.
+func (c *Conn) version() error {
+	v, err := c.tversion(protocol.Version)
+	if err != nil {
+		return err
+	}
+	if v != protocol.Version {
+		return &RemoteError{"version", fmt.Sprintf("server speaks %q, not %q", v, protocol.Version)}
+	}
+	return nil
+}
+
+// tversion sends a Tversion offering version and c.msize, sets c.msize
+// to the msize the server settles on, and returns the version it
+// settles on. A reply which isn't 9P at all is ErrNotNineP.
+func (c *Conn) tversion(version string) (string, error) {
+	var b bytes.Buffer
+	protocol.MarshalTversionPkt(&b, protocol.NOTAG, protocol.MaxSize(c.msize), version)
+	if _, err := c.rwc.Write(b.Bytes()); err != nil {
+		return "", &TransportError{"version", err}
+	}
+	m, err := c.readMessage()
+	if err != nil {
+		var se *sizeError
+		if errors.As(err, &se) {
+			err = fmt.Errorf("%w: %v", ErrNotNineP, err)
+		}
+		return "", &TransportError{"version", err}
+	}
+	switch protocol.MType(m[4]) {
+	case protocol.Rversion:
+	case protocol.Rerror:
+		s, _, err := protocol.UnmarshalRerrorPkt(bytes.NewBuffer(m[5:]))
+		if err != nil {
+			return "", &TransportError{"version", fmt.Errorf("%w: %v", ErrNotNineP, err)}
+		}
+		return "", &RemoteError{"version", s}
+	default:
+		return "", &TransportError{"version", fmt.Errorf("%w: reply is %v, not Rversion", ErrNotNineP, protocol.RPCNames[protocol.MType(m[4])])}
+	}
+	msize, v, _, err := protocol.UnmarshalRversionPkt(bytes.NewBuffer(m[5:]))
+	if err != nil {
+		return "", &TransportError{"version", fmt.Errorf("%w: %v", ErrNotNineP, err)}
+	}
+	if uint32(msize) > c.msize || msize <= protocol.IOHDRSZ {
+		return "", &TransportError{"version", fmt.Errorf("server's msize %d is no good: offered %d", msize, c.msize)}
+	}
+	c.msize = uint32(msize)
+	return v, nil
+}
+
+// A sizeError is a message whose size can't be right.
+type sizeError struct {
+	size, msize uint32
+}
+
+func (e *sizeError) Error() string {
+	return fmt.Sprintf("bad message size %d: must be between 7 and msize %d", e.size, e.msize)
+}
+
+// readMessage reads one message, whole, from the server.
+func (c *Conn) readMessage() ([]byte, error) {
+	var l [7]byte
+	if _, err := io.ReadFull(c.rwc, l[:]); err != nil {
+		return nil, err
+	}
+	sz := uint32(l[0]) | uint32(l[1])<<8 | uint32(l[2])<<16 | uint32(l[3])<<24
+	if sz < 7 || sz > c.msize {
+		return nil, &sizeError{sz, c.msize}
+	}
+	m := make([]byte, sz)
+	copy(m, l[:])
+	if _, err := io.ReadFull(c.rwc, m[7:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// readReplies hands each reply to whoever is waiting for it, until the
+// connection fails.
+func (c *Conn) readReplies() {
+	for {
+		m, err := c.readMessage()
+		if err != nil {
+			var se *sizeError
+			if errors.As(err, &se) {
+				err = fmt.Errorf("%w: %v", ErrProtocol, err)
+			}
+			c.fail(err)
+			return
+		}
+		tag := protocol.Tag(m[5]) | protocol.Tag(m[6])<<8
+		c.mu.Lock()
+		r, ok := c.pending[tag]
+		delete(c.pending, tag)
+		c.mu.Unlock()
+		if !ok {
+			c.fail(fmt.Errorf("%w: reply with tag %d, which is not in use", ErrProtocol, tag))
+			return
+		}
+		r <- m
+	}
+}
+
+// fail closes c, because of err, unless it is closed already.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.rwc.Close()
+}
+
+// Close closes the connection. Anything still waiting for a reply gets
+// a TransportError.
+func (c *Conn) Close() error {
+	c.fail(ErrClosed)
+	return nil
+}
+
+// Msize returns the msize the server settled on.
+func (c *Conn) Msize() uint32 {
+	return c.msize
+}
+
+// maxData returns the most data a Tread may ask for, or a Twrite carry.
+func (c *Conn) maxData() uint32 {
+	return c.msize - protocol.IOHDRSZ
+}
+
+// newFID returns a FID not used before on c.
+func (c *Conn) newFID() protocol.FID {
+	return protocol.FID(atomic.AddUint32(&c.fid, 1))
+}
+
+// rpc sends the request marshal makes, with a tag of its own, and waits
+// for the reply, which it returns from the tag on, for the protocol
+// package's Unmarshal functions. It is an error if the reply is
+// neither want nor an Rerror.
+//
+// If ctx is done first, rpc returns its error, and flushes the request.
+// The request may or may not have been done. It goes through the
+// Conn's Middleware, if it has any.
+func (c *Conn) rpc(ctx context.Context, op string, want protocol.MType, marshal func(b *bytes.Buffer, t protocol.Tag)) (*bytes.Buffer, error) {
+	if c.rt != nil {
+		return c.rt(ctx, newRequest(op, want, marshal))
+	}
+	return c.roundTrip(ctx, &Request{Op: op, want: want, marshal: marshal})
+}
+
+// roundTrip is the RoundTripper at the bottom of the Middleware: it
+// sends r, and waits for its reply.
+func (c *Conn) roundTrip(ctx context.Context, r *Request) (*bytes.Buffer, error) {
+	op, want := r.Op, r.want
+	t, err := c.tag(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := c.send(op, t, r.marshal)
+	if err != nil {
+		c.tags <- t
+		return nil, err
+	}
+
+	var m []byte
+	select {
+	case m = <-rc:
+	case <-c.done:
+		c.tags <- t
+		return nil, c.transportError(op)
+	case <-ctx.Done():
+		go c.flush(t, rc)
+		return nil, fmt.Errorf("%s: %w", op, ctx.Err())
+	}
+	c.tags <- t
+	switch typ := protocol.MType(m[4]); typ {
+	case want:
+		return bytes.NewBuffer(m[5:]), nil
+	case protocol.Rerror:
+		s, _, err := protocol.UnmarshalRerrorPkt(bytes.NewBuffer(m[5:]))
+		if err != nil {
+			return nil, c.violation(op, err)
+		}
+		return nil, &RemoteError{op, s}
+	default:
+		return nil, c.violation(op, fmt.Errorf("reply to %s is %v, not %v", op, protocol.RPCNames[typ], protocol.RPCNames[want]))
+	}
+}
+
+// tag returns a tag not in use, once there is one.
+func (c *Conn) tag(ctx context.Context, op string) (protocol.Tag, error) {
+	select {
+	case t := <-c.tags:
+		return t, nil
+	case <-c.done:
+		return 0, c.transportError(op)
+	case <-ctx.Done():
+		return 0, fmt.Errorf("%s: %w", op, ctx.Err())
+	}
+}
+
+// send sends the request marshal makes with tag t, and returns where
+// its reply will go.
+func (c *Conn) send(op string, t protocol.Tag, marshal func(b *bytes.Buffer, t protocol.Tag)) (chan []byte, error) {
+	var b bytes.Buffer
+	marshal(&b, t)
+	if uint32(b.Len()) > c.msize {
+		return nil, fmt.Errorf("%s: request of %d bytes is more than msize %d", op, b.Len(), c.msize)
+	}
+	r := make(chan []byte, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.transportError(op)
+	}
+	c.pending[t] = r
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	_, err := c.rwc.Write(b.Bytes())
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, c.transportError(op)
+	}
+	return r, nil
+}
+
+// flush flushes the request with tag old, whose caller has given up on
+// it. old stays in use until the Rflush comes: until then the server
+// may yet reply to the request, and the reply mustn't be taken for one
+// to the next request with old. The reply, if it comes, goes to r, and
+// nobody reads it.
+func (c *Conn) flush(old protocol.Tag, r chan []byte) {
+	defer func() { c.tags <- old }()
+	t, err := c.tag(context.Background(), "flush")
+	if err != nil {
+		return
+	}
+	defer func() { c.tags <- t }()
+	fr, err := c.send("flush", t, func(b *bytes.Buffer, t protocol.Tag) {
+		protocol.MarshalTflushPkt(b, t, old)
+	})
+	if err != nil {
+		return
+	}
+	select {
+	case m := <-fr:
+		// An Rflush can't fail.
+		if typ := protocol.MType(m[4]); typ != protocol.Rflush {
+			c.violation("flush", fmt.Errorf("reply to flush is %v, not Rflush", protocol.RPCNames[typ]))
+			return
+		}
+	case <-c.done:
+		return
+	}
+	// Once the Rflush is in, there will be no reply to old, if there
+	// hasn't been one already.
+	c.mu.Lock()
+	delete(c.pending, old)
+	c.mu.Unlock()
+}
+
+// transportError returns why c failed, as a TransportError from op.
+func (c *Conn) transportError(op string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &TransportError{op, c.err}
+}
+
+// violation returns err, which says how the reply to op broke the
+// protocol's rules, as a TransportError for ErrProtocol. c is failed:
+// a server which sends nonsense can't be trusted with what comes next.
+func (c *Conn) violation(op string, err error) error {
+	c.fail(fmt.Errorf("%w: %v", ErrProtocol, err))
+	return c.transportError(op)
+}
+
+// Attach attaches to the tree aname, as uname, and returns a Fid for
+// its root. ctx bounds the Tattach; the Fid's RPCs are bound by none,
+// unless WithContext makes one which is.
+func (c *Conn) Attach(ctx context.Context, uname, aname string) (*Fid, error) {
+	fid := c.newFID()
+	b, err := c.rpc(ctx, "attach", protocol.Rattach, func(b *bytes.Buffer, t protocol.Tag) {
+		protocol.MarshalTattachPkt(b, t, fid, protocol.NOFID, uname, aname)
+	})
+	if err != nil {
+		return nil, err
+	}
+	q, _, err := protocol.UnmarshalRattachPkt(b)
+	if err != nil {
+		return nil, c.violation("attach", err)
+	}
+	if q.Type&protocol.QTAUTH != 0 {
+		return nil, c.violation("attach", fmt.Errorf("root QID %v is an auth file's", q))
+	}
+	return &Fid{c: c, fid: fid, ctx: context.Background(), s: &fidState{qid: q}}, nil
+}
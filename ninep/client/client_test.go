@@ -0,0 +1,1041 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"harvey-os.org/ninep/ninetest"
+	"harvey-os.org/ninep/protocol"
+	"harvey-os.org/ninep/ufs"
+)
+
+// newUFS returns a Conn to a ufs serving a new directory, which it
+// also returns, over a pipe.
+func newUFS(t *testing.T) (*Conn, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := ufs.NewUFS(dir, 0)
+	if err != nil {
+		t.Fatalf("NewUFS: want nil, got %v", err)
+	}
+	p, err := ninetest.Pipe(l)
+	if err != nil {
+		t.Fatalf("Pipe: want nil, got %v", err)
+	}
+	c, err := NewConn(context.Background(), p, DefaultMsize)
+	if err != nil {
+		t.Fatalf("NewConn: want nil, got %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, dir
+}
+
+func attach(t *testing.T, c *Conn) *Fid {
+	t.Helper()
+	root, err := c.Attach(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Attach: want nil, got %v", err)
+	}
+	if root.QID().Type&protocol.QTDIR == 0 {
+		t.Fatalf("Attach: root QID %v is not a directory", root.QID())
+	}
+	return root
+}
+
+func TestDial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := ufs.NewUFS(dir, 0)
+	if err != nil {
+		t.Fatalf("NewUFS: want nil, got %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.Serve(ln)
+	defer l.Shutdown(context.Background())
+
+	c, err := Dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: want nil, got %v", err)
+	}
+	defer c.Close()
+	if c.Msize() != DefaultMsize {
+		t.Errorf("Msize: want %d, got %d", DefaultMsize, c.Msize())
+	}
+	if _, err := c.Attach(context.Background(), "", ""); err != nil {
+		t.Errorf("Attach: want nil, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Dial(ctx, "tcp", ln.Addr().String()); err == nil {
+		t.Errorf("Dial with a done context: want an error, got nil")
+	}
+}
+
+func TestDialAddr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := ufs.NewUFS(dir, 0)
+	if err != nil {
+		t.Fatalf("NewUFS: want nil, got %v", err)
+	}
+	defer l.Shutdown(context.Background())
+	sock := filepath.Join(dir, "ufs.sock")
+	var addrs []string
+	for _, a := range []string{"tcp!127.0.0.1!0", "unix!" + sock} {
+		ln, err := protocol.Listen(a)
+		if err != nil {
+			t.Fatalf("Listen(%q): want nil, got %v", a, err)
+		}
+		go l.Serve(ln)
+		if ln.Addr().Network() == "tcp" {
+			_, port, _ := net.SplitHostPort(ln.Addr().String())
+			addrs = append(addrs, "tcp!127.0.0.1!"+port, "net!localhost!"+port, "127.0.0.1:"+port)
+		}
+	}
+	addrs = append(addrs, "unix!"+sock, sock)
+
+	for _, a := range addrs {
+		c, err := DialAddr(context.Background(), a)
+		if err != nil {
+			t.Errorf("DialAddr(%q): want nil, got %v", a, err)
+			continue
+		}
+		if _, err := c.Attach(context.Background(), "", ""); err != nil {
+			t.Errorf("DialAddr(%q): Attach: want nil, got %v", a, err)
+		}
+		c.Close()
+	}
+	if _, err := DialAddr(context.Background(), "udp!127.0.0.1!564"); err == nil {
+		t.Errorf("DialAddr(udp!127.0.0.1!564): want an error, got nil")
+	}
+
+	// A file which isn't a socket is opened, as a /srv file would be.
+	srv := filepath.Join(dir, "srv")
+	if err := ioutil.WriteFile(srv, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	rwc, err := Connect(context.Background(), srv)
+	if err != nil {
+		t.Fatalf("Connect(%q): want nil, got %v", srv, err)
+	}
+	defer rwc.Close()
+	if _, ok := rwc.(*os.File); !ok {
+		t.Errorf("Connect(%q): want an *os.File, got %T", srv, rwc)
+	}
+}
+
+func TestFileRPCs(t *testing.T) {
+	c, dir := newUFS(t)
+	root := attach(t, c)
+
+	// Create, Write, Seek, Read.
+	d, err := root.Walk("")
+	if err != nil {
+		t.Fatalf("Walk(\"\"): want nil, got %v", err)
+	}
+	if err := d.Create("f", 0644, protocol.ORDWR); err != nil {
+		t.Fatalf("Create: want nil, got %v", err)
+	}
+	if d.QID().Type&protocol.QTDIR != 0 {
+		t.Errorf("Create: QID %v is of a directory", d.QID())
+	}
+	if n, err := d.Write([]byte("hello, ")); n != 7 || err != nil {
+		t.Fatalf("Write: want (7, nil), got (%d, %v)", n, err)
+	}
+	if n, err := d.Write([]byte("world")); n != 5 || err != nil {
+		t.Fatalf("Write: want (5, nil), got (%d, %v)", n, err)
+	}
+	if o, err := d.Seek(0, io.SeekStart); o != 0 || err != nil {
+		t.Fatalf("Seek: want (0, nil), got (%d, %v)", o, err)
+	}
+	b, err := ioutil.ReadAll(d)
+	if err != nil || string(b) != "hello, world" {
+		t.Errorf("ReadAll: want (%q, nil), got (%q, %v)", "hello, world", b, err)
+	}
+	if o, err := d.Seek(-5, io.SeekEnd); o != 7 || err != nil {
+		t.Errorf("Seek from the end: want (7, nil), got (%d, %v)", o, err)
+	}
+	if err := d.Clunk(); err != nil {
+		t.Errorf("Clunk: want nil, got %v", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "f")); string(b) != "hello, world" {
+		t.Errorf("file: want %q, got (%q, %v)", "hello, world", b, err)
+	}
+
+	// Walk, Open, ReadAt and WriteAt, across more than one Tread and
+	// Twrite.
+	f, err := root.Walk("f")
+	if err != nil {
+		t.Fatalf("Walk(f): want nil, got %v", err)
+	}
+	if err := f.Open(protocol.ORDWR); err != nil {
+		t.Fatalf("Open: want nil, got %v", err)
+	}
+	big := bytes.Repeat([]byte("0123456789abcdef"), 3*int(c.Msize())/16+1)
+	if n, err := f.WriteAt(big, 100); n != len(big) || err != nil {
+		t.Fatalf("WriteAt: want (%d, nil), got (%d, %v)", len(big), n, err)
+	}
+	got := make([]byte, len(big))
+	if n, err := f.ReadAt(got, 100); n != len(big) || err != nil || !bytes.Equal(got, big) {
+		t.Errorf("ReadAt: want (%d, nil) and what was written, got (%d, %v)", len(big), n, err)
+	}
+	if n, err := f.ReadAt(got, 100+int64(len(big))-10); n != 10 || err != io.EOF {
+		t.Errorf("ReadAt past the end: want (10, io.EOF), got (%d, %v)", n, err)
+	}
+
+	// Stat and Wstat.
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat: want nil, got %v", err)
+	}
+	if st.Name != "f" || st.Length != uint64(100+len(big)) || st.QID.Path != f.QID().Path {
+		t.Errorf("Stat: want f, length %d, QID %v; got %v", 100+len(big), f.QID(), st)
+	}
+	w := protocol.NullDir
+	w.Mode = 0600
+	if err := f.Wstat(w); err != nil {
+		t.Fatalf("Wstat(mode): want nil, got %v", err)
+	}
+	w = protocol.NullDir
+	w.Name = "g"
+	if err := f.Wstat(w); err != nil {
+		t.Fatalf("Wstat(name): want nil, got %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "g")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("after Wstat: want g, mode 0600, got (%v, %v)", fi, err)
+	}
+	if err := f.Clunk(); err != nil {
+		t.Errorf("Clunk: want nil, got %v", err)
+	}
+
+	// Remove.
+	g, err := root.Walk("g")
+	if err != nil {
+		t.Fatalf("Walk(g): want nil, got %v", err)
+	}
+	if err := g.Remove(); err != nil {
+		t.Errorf("Remove: want nil, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "g")); !os.IsNotExist(err) {
+		t.Errorf("after Remove: want g gone, got %v", err)
+	}
+}
+
+func TestChmodRenameChtimes(t *testing.T) {
+	c, dir := newUFS(t)
+	root := attach(t, c)
+	defer root.Clunk()
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "d", "f"), []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := root.Walk("d")
+	if err != nil {
+		t.Fatalf("Walk(d): want nil, got %v", err)
+	}
+	defer d.Clunk()
+	f, err := root.Walk("d/f")
+	if err != nil {
+		t.Fatalf("Walk(d/f): want nil, got %v", err)
+	}
+	defer f.Clunk()
+
+	if err := f.Chmod(0600); err != nil {
+		t.Errorf("Chmod(0600): want nil, got %v", err)
+	}
+	// A directory stays one.
+	if err := d.Chmod(0700); err != nil {
+		t.Errorf("Chmod(0700) of a directory: want nil, got %v", err)
+	}
+	mtime := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := f.Chtimes(time.Time{}, mtime); err != nil {
+		t.Errorf("Chtimes: want nil, got %v", err)
+	}
+	if err := f.Rename("g"); err != nil {
+		t.Errorf("Rename(g): want nil, got %v", err)
+	}
+	for _, name := range []string{"", "..", "../g", "e/g"} {
+		if err := f.Rename(name); !errors.Is(err, protocol.ErrBadWalkName) {
+			t.Errorf("Rename(%q): want %v, got %v", name, protocol.ErrBadWalkName, err)
+		}
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "d", "g"))
+	if err != nil || fi.Mode() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("d/g: want mode 0600, modified %v, got %v", mtime, err)
+	} else if b, err := ioutil.ReadFile(filepath.Join(dir, "d", "g")); string(b) != "f" || err != nil {
+		t.Errorf("d/g: want (f, nil), got (%q, %v)", b, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "d")); err != nil || fi.Mode() != os.ModeDir|0700 {
+		t.Errorf("d: want mode %v, got (%v, %v)", os.ModeDir|0700, fi, err)
+	}
+}
+
+// TestWstatNull checks that Chmod, Rename and Chtimes send a Twstat
+// which changes only what they are to change.
+func TestWstatNull(t *testing.T) {
+	_, f, s := newFake(t, 10)
+	mtime := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name string
+		call func() error
+		stat protocol.Dir // the Rstat, if Tstat comes first
+		want func(d *protocol.Dir)
+	}{
+		{"Rename", func() error { return f.Rename("g") }, protocol.Dir{}, func(d *protocol.Dir) { d.Name = "g" }},
+		{"Chtimes", func() error { return f.Chtimes(time.Time{}, mtime) }, protocol.Dir{}, func(d *protocol.Dir) { d.Mtime = uint32(mtime.Unix()) }},
+		{"Chtimes both", func() error { return f.Chtimes(mtime, mtime) }, protocol.Dir{}, func(d *protocol.Dir) { d.Atime, d.Mtime = uint32(mtime.Unix()), uint32(mtime.Unix()) }},
+		{"Chmod", func() error { return f.Chmod(0640) }, protocol.Dir{Name: "d", Mode: protocol.DMDIR | protocol.DMAPPEND | 0755}, func(d *protocol.Dir) { d.Mode = protocol.DMDIR | protocol.DMAPPEND | 0640 }},
+	} {
+		done := make(chan error, 1)
+		go func() { done <- tt.call() }()
+		if tt.stat.Name != "" {
+			tag := s.expect(protocol.Tstat)
+			var b bytes.Buffer
+			protocol.MarshalRstatPkt(&b, tag, tt.stat.Marshal())
+			s.conn.Write(b.Bytes())
+		}
+		typ, tag, m := s.read()
+		if typ != protocol.Twstat {
+			t.Fatalf("%s: want Twstat, got %v", tt.name, protocol.RPCNames[typ])
+		}
+		_, st, _, err := protocol.UnmarshalTwstatPkt(m)
+		if err != nil {
+			t.Fatalf("%s: Twstat: %v", tt.name, err)
+		}
+		var got protocol.Dir
+		if err := got.Unmarshal(st); err != nil {
+			t.Fatalf("%s: Twstat: %v", tt.name, err)
+		}
+		want := protocol.NullDir
+		tt.want(&want)
+		if got != want {
+			t.Errorf("%s: want Twstat of %v, got %v", tt.name, want, got)
+		}
+		var b bytes.Buffer
+		protocol.MarshalRwstatPkt(&b, tag)
+		s.conn.Write(b.Bytes())
+		if err := <-done; err != nil {
+			t.Errorf("%s: want nil, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	c, dir := newUFS(t)
+	path := dir
+	var want []string
+	for i := 0; i < 2*protocol.MaxWElem; i++ {
+		path = filepath.Join(path, fmt.Sprint("d", i))
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Enough entries that they take more than one Tread.
+	for i := 0; i < 1000; i++ {
+		n := fmt.Sprintf("a-file-with-a-longish-name-%03d", i)
+		if err := ioutil.WriteFile(filepath.Join(path, n), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, n)
+	}
+
+	root := attach(t, c)
+	rel, _ := filepath.Rel(dir, path)
+	d, err := root.Walk(filepath.ToSlash(rel))
+	if err != nil {
+		t.Fatalf("Walk(%q): want nil, got %v", rel, err)
+	}
+	defer d.Clunk()
+	if d.QID().Type&protocol.QTDIR == 0 {
+		t.Errorf("Walk(%q): QID %v is not a directory", rel, d.QID())
+	}
+	if err := d.Open(protocol.OREAD); err != nil {
+		t.Fatalf("Open: want nil, got %v", err)
+	}
+	ds, err := d.ReadDir()
+	if err != nil {
+		t.Fatalf("ReadDir: want nil, got %v", err)
+	}
+	var got []string
+	for _, e := range ds {
+		got = append(got, e.Name)
+	}
+	sort.Strings(got)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("ReadDir: want %v, got %v", want, got)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c, _ := newUFS(t)
+	root := attach(t, c)
+
+	_, err := root.Walk("a/b/c")
+	if !errors.Is(err, protocol.ErrNotExist) {
+		t.Errorf("Walk(a/b/c): want %v, got %v", protocol.ErrNotExist, err)
+	}
+	var re *RemoteError
+	if !errors.As(err, &re) {
+		t.Errorf("Walk(a/b/c): want a *RemoteError, got %T", err)
+	}
+	if err := root.Create("x", protocol.DMDIR|0755, protocol.OREAD); err != nil {
+		t.Fatalf("Create(x): want nil, got %v", err)
+	}
+	if err := root.Clunk(); err != nil {
+		t.Fatalf("Clunk: want nil, got %v", err)
+	}
+	root = attach(t, c)
+	x, err := root.Walk("x")
+	if err != nil {
+		t.Fatalf("Walk(x): want nil, got %v", err)
+	}
+	if err := x.Open(protocol.OWRITE); !errors.As(err, &re) {
+		t.Errorf("Open(directory, OWRITE): want a *RemoteError, got %v", err)
+	}
+	if err := x.Clunk(); err != nil {
+		t.Errorf("Clunk: want nil, got %v", err)
+	}
+	if err := x.Clunk(); !errors.As(err, &re) {
+		t.Errorf("Clunk again: want a *RemoteError, got %v", err)
+	}
+
+	// Other servers say the same in other words, and keep them.
+	err = &RemoteError{"walk", "No such file or directory"}
+	if !errors.Is(err, protocol.ErrNotExist) || !errors.Is(err, os.ErrNotExist) || err.Error() != "walk: No such file or directory" {
+		t.Errorf("%v: want it to be %v and os.ErrNotExist", err, protocol.ErrNotExist)
+	}
+	if err := (&RemoteError{"walk", "disk on fire"}); errors.Unwrap(err) != nil {
+		t.Errorf("%v: want no Err value, got %v", err, errors.Unwrap(err))
+	}
+
+	c.Close()
+	var te *TransportError
+	_, err = root.Stat()
+	if !errors.As(err, &te) || !errors.Is(err, ErrClosed) {
+		t.Errorf("Stat after Close: want a *TransportError for ErrClosed, got %v", err)
+	}
+}
+
+func TestHangup(t *testing.T) {
+	p, p2 := net.Pipe()
+	go func() {
+		// Answer the Tversion, then hang up on the Tattach.
+		var b [512]byte
+		n, _ := p2.Read(b[:])
+		var r bytes.Buffer
+		protocol.MarshalRversionPkt(&r, protocol.NOTAG, 8192, protocol.Version)
+		p2.Write(r.Bytes())
+		if n > 0 {
+			p2.Read(b[:])
+		}
+		p2.Close()
+	}()
+	c, err := NewConn(context.Background(), p, DefaultMsize)
+	if err != nil {
+		t.Fatalf("NewConn: want nil, got %v", err)
+	}
+	if c.Msize() != 8192 {
+		t.Errorf("Msize: want 8192, got %d", c.Msize())
+	}
+	var te *TransportError
+	if _, err := c.Attach(context.Background(), "", ""); !errors.As(err, &te) || !errors.Is(err, io.EOF) {
+		t.Errorf("Attach: want a *TransportError for io.EOF, got %v", err)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	c, dir := newUFS(t)
+	root := attach(t, c)
+	const n = 20
+	for i := 0; i < n; i++ {
+		b := bytes.Repeat([]byte{byte('a' + i)}, 10000+i)
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := root.Walk(fmt.Sprint(i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer f.Clunk()
+			if err := f.Open(protocol.OREAD); err != nil {
+				errs <- err
+				return
+			}
+			b, err := ioutil.ReadAll(f)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if want := bytes.Repeat([]byte{byte('a' + i)}, 10000+i); !bytes.Equal(b, want) {
+				errs <- fmt.Errorf("file %d: got %d bytes, not the %d written", i, len(b), len(want))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestIOunit checks that a big write is split into Twrites of the
+// iounit ufs gives, which is as much as fits in msize.
+func TestIOunit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var rec ninetest.Recorder
+	l, err := ufs.NewUFS(dir, 0, protocol.WithMiddleware(rec.Middleware))
+	if err != nil {
+		t.Fatalf("NewUFS: want nil, got %v", err)
+	}
+	p, err := ninetest.Pipe(l)
+	if err != nil {
+		t.Fatalf("Pipe: want nil, got %v", err)
+	}
+	c, err := NewConn(context.Background(), p, 8192)
+	if err != nil {
+		t.Fatalf("NewConn: want nil, got %v", err)
+	}
+	defer c.Close()
+	root := attach(t, c)
+	if err := root.Create("big", 0644, protocol.OWRITE); err != nil {
+		t.Fatalf("Create: want nil, got %v", err)
+	}
+	b := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	if n, err := root.Write(b); n != len(b) || err != nil {
+		t.Fatalf("Write: want (%d, nil), got (%d, %v)", len(b), n, err)
+	}
+	// 8192 less the Twrite header is 8168, which 1MB needs 129 of.
+	if n, want := rec.Count(protocol.Twrite), (len(b)+8167)/8168; n != want {
+		t.Errorf("1MB write with msize 8192: want %d Twrites, got %d", want, n)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "big")); err != nil || !bytes.Equal(got, b) {
+		t.Errorf("file: want the %d bytes written, got (%d bytes, %v)", len(b), len(got), err)
+	}
+}
+
+// TestIOunitFallback checks that the client keeps to a server's
+// iounit, and to what msize allows when the iounit is 0.
+func TestIOunitFallback(t *testing.T) {
+	for _, tt := range []struct {
+		iounit protocol.MaxSize
+		want   int
+	}{
+		{0, (1<<20 + 8167) / 8168},
+		{4096, 1 << 20 / 4096},
+		// More than msize allows is no more than it allows.
+		{1 << 20, (1<<20 + 8167) / 8168},
+	} {
+		_, f, s := newFake(t, 10)
+		done := make(chan error, 1)
+		go func() {
+			if err := f.Open(protocol.OWRITE); err != nil {
+				done <- err
+				return
+			}
+			_, err := f.Write(make([]byte, 1<<20))
+			done <- err
+		}()
+		tag := s.expect(protocol.Topen)
+		var b bytes.Buffer
+		protocol.MarshalRopenPkt(&b, tag, protocol.QID{}, tt.iounit)
+		s.conn.Write(b.Bytes())
+
+		var n, tot int
+		for tot < 1<<20 {
+			typ, tag, m := s.read()
+			if typ != protocol.Twrite {
+				t.Fatalf("iounit %d: want Twrite, got %v", tt.iounit, protocol.RPCNames[typ])
+			}
+			_, _, data, _, err := protocol.UnmarshalTwritePkt(m)
+			if err != nil {
+				t.Fatalf("iounit %d: Twrite: %v", tt.iounit, err)
+			}
+			if max := 8192 - protocol.IOHDRSZ; len(data) > max || (tt.iounit != 0 && len(data) > int(tt.iounit)) {
+				t.Errorf("iounit %d: Twrite of %d bytes", tt.iounit, len(data))
+			}
+			b.Reset()
+			protocol.MarshalRwritePkt(&b, tag, protocol.Count(len(data)))
+			s.conn.Write(b.Bytes())
+			n++
+			tot += len(data)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("iounit %d: Write: want nil, got %v", tt.iounit, err)
+		}
+		if n != tt.want {
+			t.Errorf("iounit %d: 1MB write with msize 8192: want %d Twrites, got %d", tt.iounit, tt.want, n)
+		}
+	}
+}
+
+// A fakeServer is the far end of a Conn, for tests of servers which
+// misbehave: it replies only as, and when, the test says.
+type fakeServer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// newFake returns a Conn to a fakeServer, which has answered the
+// Tversion, and a Fid on it, as though attached. The Conn has only
+// ntags tags, so that tests can run out of them.
+func newFake(t *testing.T, ntags int) (*Conn, *Fid, *fakeServer) {
+	t.Helper()
+	p, p2 := net.Pipe()
+	s := &fakeServer{t: t, conn: p2}
+	go func() {
+		var l [4]byte
+		if _, err := io.ReadFull(p2, l[:]); err != nil {
+			return
+		}
+		m := make([]byte, int(l[0])|int(l[1])<<8-4)
+		io.ReadFull(p2, m)
+		var b bytes.Buffer
+		protocol.MarshalRversionPkt(&b, protocol.NOTAG, 8192, protocol.Version)
+		p2.Write(b.Bytes())
+	}()
+	c, err := NewConn(context.Background(), p, DefaultMsize)
+	if err != nil {
+		t.Fatalf("NewConn: want nil, got %v", err)
+	}
+	t.Cleanup(func() { c.Close(); p2.Close() })
+	for len(c.tags) > ntags {
+		<-c.tags
+	}
+	return c, &Fid{c: c, fid: 1, ctx: context.Background(), s: &fidState{}}, s
+}
+
+// read reads a request, and returns its type and tag, and the request
+// from the tag on, for the protocol package's Unmarshal functions.
+func (s *fakeServer) read() (protocol.MType, protocol.Tag, *bytes.Buffer) {
+	s.t.Helper()
+	var l [4]byte
+	if _, err := io.ReadFull(s.conn, l[:]); err != nil {
+		s.t.Fatalf("fake server: reading a request: %v", err)
+	}
+	m := make([]byte, int(l[0])|int(l[1])<<8|int(l[2])<<16|int(l[3])<<24-4)
+	if _, err := io.ReadFull(s.conn, m); err != nil {
+		s.t.Fatalf("fake server: reading a request: %v", err)
+	}
+	return protocol.MType(m[0]), protocol.Tag(m[1]) | protocol.Tag(m[2])<<8, bytes.NewBuffer(m[1:])
+}
+
+// expect reads a request, which must be of type typ, and returns its tag.
+func (s *fakeServer) expect(typ protocol.MType) protocol.Tag {
+	s.t.Helper()
+	got, t, _ := s.read()
+	if got != typ {
+		s.t.Fatalf("fake server: want %v, got %v", protocol.RPCNames[typ], protocol.RPCNames[got])
+	}
+	return t
+}
+
+// quiet reports whether no request comes for a while.
+func (s *fakeServer) quiet() bool {
+	s.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	defer s.conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := s.conn.Read(b[:])
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// rstat replies to the Tstat with tag t, with a Dir named name.
+func (s *fakeServer) rstat(t protocol.Tag, name string) {
+	var b bytes.Buffer
+	protocol.MarshalRstatPkt(&b, t, protocol.Dir{Name: name}.Marshal())
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		s.t.Fatalf("fake server: %v", err)
+	}
+}
+
+func (s *fakeServer) rflush(t protocol.Tag) {
+	var b bytes.Buffer
+	protocol.MarshalRflushPkt(&b, t)
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		s.t.Fatalf("fake server: %v", err)
+	}
+}
+
+type statResult struct {
+	d   protocol.Dir
+	err error
+}
+
+func stat(f *Fid) chan statResult {
+	r := make(chan statResult, 1)
+	go func() {
+		d, err := f.Stat()
+		r <- statResult{d, err}
+	}()
+	return r
+}
+
+func TestOutOfOrder(t *testing.T) {
+	_, f, s := newFake(t, 10)
+	var rs []chan statResult
+	tags := map[protocol.Tag]int{}
+	for i := 0; i < 3; i++ {
+		rs = append(rs, stat(f))
+		tags[s.expect(protocol.Tstat)] = i
+	}
+	if len(tags) != 3 {
+		t.Fatalf("three Tstats at once: want three tags, got %v", tags)
+	}
+	// Whichever came last gets its reply first.
+	for i := 2; i >= 0; i-- {
+		for tag, j := range tags {
+			if j == i {
+				s.rstat(tag, fmt.Sprint(i))
+			}
+		}
+	}
+	// Each Stat gets the reply to its own Tstat, whatever order the
+	// Tstats went in.
+	names := map[string]bool{}
+	for _, r := range rs {
+		r := <-r
+		if r.err != nil {
+			t.Fatalf("Stat: want nil, got %v", r.err)
+		}
+		names[r.d.Name] = true
+	}
+	if len(names) != 3 {
+		t.Errorf("Stats: want three different replies, got %v", names)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	_, f, s := newFake(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	r := stat(f.WithContext(ctx))
+	tag := s.expect(protocol.Tstat)
+	cancel()
+	if r := <-r; !errors.Is(r.err, context.Canceled) {
+		t.Errorf("Stat, cancelled: want %v, got %v", context.Canceled, r.err)
+	}
+	typ, ftag, b := s.read()
+	if typ != protocol.Tflush {
+		t.Fatalf("after cancel: want Tflush, got %v", protocol.RPCNames[typ])
+	}
+	if old, _, err := protocol.UnmarshalTflushPkt(b); old != tag || err != nil {
+		t.Errorf("Tflush: want oldtag %d, got (%d, %v)", tag, old, err)
+	}
+
+	// Both tags are in use, the Tstat's until the Rflush: another Stat
+	// must wait.
+	r = stat(f)
+	if !s.quiet() {
+		t.Fatalf("Stat with both tags in use: sent a request")
+	}
+	// The reply to the flushed Tstat may come before the Rflush, and is
+	// no reply to anything else.
+	s.rstat(tag, "late")
+	s.rflush(ftag)
+	next := s.expect(protocol.Tstat)
+	if next != tag && next != ftag {
+		t.Errorf("Tstat after Rflush: want tag %d or %d, got %d", tag, ftag, next)
+	}
+	s.rstat(next, "next")
+	if r := <-r; r.err != nil || r.d.Name != "next" {
+		t.Errorf("Stat after Rflush: want (next, nil), got (%q, %v)", r.d.Name, r.err)
+	}
+}
+
+func TestDeadConn(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		die  func(s *fakeServer, tags []protocol.Tag)
+	}{
+		{"hangup", func(s *fakeServer, tags []protocol.Tag) { s.conn.Close() }},
+		// newFake took tag 1 out of use.
+		{"unknown tag", func(s *fakeServer, tags []protocol.Tag) { s.rstat(1, "") }},
+		{"wrong reply", func(s *fakeServer, tags []protocol.Tag) { s.rflush(tags[1]) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			const ntags, n = 4, 10
+			_, f, s := newFake(t, ntags)
+			// Some waiting for replies, some for tags, and one for
+			// a Tflush's Rflush.
+			ctx, cancel := context.WithCancel(context.Background())
+			var rs []chan statResult
+			rs = append(rs, stat(f.WithContext(ctx)))
+			tags := []protocol.Tag{s.expect(protocol.Tstat)}
+			cancel()
+			<-rs[0]
+			s.expect(protocol.Tflush)
+			for i := 0; i < n; i++ {
+				rs = append(rs, stat(f))
+			}
+			for i := 2; i < ntags; i++ {
+				tags = append(tags, s.expect(protocol.Tstat))
+			}
+			tt.die(s, tags)
+
+			for _, r := range rs[1:] {
+				select {
+				case r := <-r:
+					var te *TransportError
+					if !errors.As(r.err, &te) {
+						t.Errorf("Stat: want a *TransportError, got %v", r.err)
+					}
+				case <-time.After(10 * time.Second):
+					t.Fatalf("Stat: still waiting, 10s after the connection died")
+				}
+			}
+			if _, err := f.Stat(); err == nil {
+				t.Errorf("Stat on a dead connection: want an error, got nil")
+			}
+		})
+	}
+}
+
+// send sends the reply marshal makes.
+func (s *fakeServer) send(marshal func(b *bytes.Buffer)) {
+	var b bytes.Buffer
+	marshal(&b)
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		s.t.Fatalf("fake server: %v", err)
+	}
+}
+
+// TestProtocolViolation checks that each kind of reply a server can't
+// send is ErrProtocol, and fails the connection.
+func TestProtocolViolation(t *testing.T) {
+	dir := protocol.QID{Type: protocol.QTDIR, Path: 1}
+	file := protocol.QID{Path: 2}
+	walk := func(path string) func(c *Conn, f *Fid) error {
+		return func(c *Conn, f *Fid) error {
+			_, err := f.Walk(path)
+			return err
+		}
+	}
+	// badWalk answers a Twalk with qids, which break the rules, and
+	// checks that the newfid the server may have made is clunked.
+	badWalk := func(qids ...protocol.QID) func(s *fakeServer) {
+		return func(s *fakeServer) {
+			s.t.Helper()
+			typ, _, b := s.read()
+			_, newfid, _, tag, err := protocol.UnmarshalTwalkPkt(b)
+			if typ != protocol.Twalk || err != nil {
+				s.t.Fatalf("fake server: want a Twalk, got %v, %v", protocol.RPCNames[typ], err)
+			}
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRwalkPkt(b, tag, qids) })
+			typ, _, b = s.read()
+			if fid, _, err := protocol.UnmarshalTclunkPkt(b); typ != protocol.Tclunk || fid != newfid || err != nil {
+				s.t.Errorf("after a bad Rwalk: want a Tclunk of newfid %d, got %v of %d, %v", newfid, protocol.RPCNames[typ], fid, err)
+			}
+		}
+	}
+	for _, tt := range []struct {
+		name  string
+		do    func(c *Conn, f *Fid) error
+		reply func(s *fakeServer)
+	}{
+		{"unknown tag", walk(""), func(s *fakeServer) {
+			tag := s.expect(protocol.Twalk)
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRwalkPkt(b, tag+1, nil) })
+		}},
+		{"wrong reply", walk(""), func(s *fakeServer) {
+			tag := s.expect(protocol.Twalk)
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRclunkPkt(b, tag) })
+		}},
+		{"short message", walk(""), func(s *fakeServer) {
+			s.expect(protocol.Twalk)
+			s.conn.Write([]byte{5, 0, 0, 0, byte(protocol.Rwalk), 1, 0})
+		}},
+		{"more qids than names", walk("a"), badWalk(dir, dir)},
+		{"no qids and no error", walk("a"), badWalk()},
+		{"walk through a file", walk("a/b"), badWalk(file, file)},
+		{"read more than asked", func(c *Conn, f *Fid) error {
+			_, err := f.ReadAt(make([]byte, 4), 0)
+			return err
+		}, func(s *fakeServer) {
+			tag := s.expect(protocol.Tread)
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRreadPkt(b, tag, make([]byte, 8)) })
+		}},
+		{"wrote more than sent", func(c *Conn, f *Fid) error {
+			_, err := f.WriteAt(make([]byte, 4), 0)
+			return err
+		}, func(s *fakeServer) {
+			tag := s.expect(protocol.Twrite)
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRwritePkt(b, tag, 8) })
+		}},
+		{"attach to an auth file", func(c *Conn, f *Fid) error {
+			_, err := c.Attach(context.Background(), "glenda", "")
+			return err
+		}, func(s *fakeServer) {
+			tag := s.expect(protocol.Tattach)
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRattachPkt(b, tag, protocol.QID{Type: protocol.QTAUTH}) })
+		}},
+		{"create a directory, get a file", func(c *Conn, f *Fid) error {
+			return f.Create("d", protocol.DMDIR|0755, protocol.OREAD)
+		}, func(s *fakeServer) {
+			tag := s.expect(protocol.Tcreate)
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRcreatePkt(b, tag, file, 0) })
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, f, s := newFake(t, 10)
+			done := make(chan error, 1)
+			go func() { done <- tt.do(c, f) }()
+			tt.reply(s)
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("still waiting, 10s after a bad reply")
+			}
+			var te *TransportError
+			if !errors.Is(err, ErrProtocol) || !errors.As(err, &te) {
+				t.Errorf("want a *TransportError for %v, got %v", ErrProtocol, err)
+			}
+			// The connection is done with.
+			if _, err := f.Stat(); !errors.Is(err, ErrProtocol) {
+				t.Errorf("Stat after a bad reply: want %v, got %v", ErrProtocol, err)
+			}
+		})
+	}
+}
+
+// TestFlushViolation checks that an Rerror to a Tflush, which can't
+// fail, fails the connection.
+func TestFlushViolation(t *testing.T) {
+	c, f, s := newFake(t, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	r := stat(f.WithContext(ctx))
+	s.expect(protocol.Tstat)
+	cancel()
+	<-r
+	tag := s.expect(protocol.Tflush)
+	s.send(func(b *bytes.Buffer) { protocol.MarshalRerrorPkt(b, tag, "no") })
+	select {
+	case <-c.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("still connected, 10s after an Rerror to a Tflush")
+	}
+	if _, err := f.Stat(); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Stat after an Rerror to a Tflush: want %v, got %v", ErrProtocol, err)
+	}
+}
+
+func TestZip(t *testing.T) {
+	c, _ := newUFS(t)
+	root := attach(t, c)
+	files := map[string][]byte{
+		"small": []byte("a little"),
+		"big":   bytes.Repeat([]byte("more than one Tread's worth "), 3*int(c.Msize())/28),
+	}
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprint("f", i)] = bytes.Repeat([]byte{byte(i)}, 1000*i)
+	}
+
+	// Write a zip archive to the server with Write, ...
+	f, err := root.Walk("")
+	if err != nil {
+		t.Fatalf("Walk: want nil, got %v", err)
+	}
+	if err := f.Create("a.zip", 0644, protocol.ORDWR); err != nil {
+		t.Fatalf("Create: want nil, got %v", err)
+	}
+	zw := zip.NewWriter(f)
+	for n, b := range files {
+		w, err := zw.Create(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(b); err != nil {
+			t.Fatalf("writing %s: want nil, got %v", n, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing the zip.Writer: want nil, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: want nil, got %v", err)
+	}
+
+	// ... and read it with ReadAt, for all the files at once.
+	f, err = root.Walk("a.zip")
+	if err != nil {
+		t.Fatalf("Walk: want nil, got %v", err)
+	}
+	defer f.Close()
+	if err := f.Open(protocol.OREAD); err != nil {
+		t.Fatalf("Open: want nil, got %v", err)
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("Seek: want nil, got %v", err)
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		t.Fatalf("zip.NewReader: want nil, got %v", err)
+	}
+	if len(zr.File) != len(files) {
+		t.Errorf("zip: want %d files, got %d", len(files), len(zr.File))
+	}
+	var wg sync.WaitGroup
+	for _, zf := range zr.File {
+		wg.Add(1)
+		go func(zf *zip.File) {
+			defer wg.Done()
+			r, err := zf.Open()
+			if err != nil {
+				t.Errorf("opening %s: want nil, got %v", zf.Name, err)
+				return
+			}
+			defer r.Close()
+			if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, files[zf.Name]) {
+				t.Errorf("reading %s: want %d bytes as written, got (%d bytes, %v)", zf.Name, len(files[zf.Name]), len(b), err)
+			}
+		}(zf)
+	}
+	wg.Wait()
+}
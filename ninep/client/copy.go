@@ -0,0 +1,405 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// SymlinkPolicy says what CopyIn and CopyOut do with a symbolic link.
+// A copy follows none: a link is either an error or left out.
+type SymlinkPolicy int
+
+const (
+	// SymlinkError makes a link an error, which stops the copy.
+	// It is the zero SymlinkPolicy, so that links are only left out
+	// if that is asked for.
+	SymlinkError SymlinkPolicy = iota
+	// SymlinkSkip leaves links out of the copy, and tells Progress.
+	SymlinkSkip
+)
+
+// CopyOpts are options for CopyIn and CopyOut. The zero CopyOpts, like
+// a nil one, copies everything, one file at a time, and stops at a
+// symbolic link.
+type CopyOpts struct {
+	// Symlinks says what to do with symbolic links.
+	Symlinks SymlinkPolicy
+
+	// Sync leaves out files which are there already, with the
+	// same size and modification time, as rsync does by default.
+	Sync bool
+
+	// Parallel is how many files are copied at once; 0 is 1.
+	Parallel int
+
+	// Progress, if set, is called as each file is copied, from as
+	// many goroutines as Parallel says.
+	Progress func(Progress)
+}
+
+// Progress is how far a copy of one file has got.
+type Progress struct {
+	// Name is the file's path from where the copy started, with
+	// slashes, as in a 9P walk.
+	Name string
+	// Copied is how many of the Size bytes have been copied.
+	Copied, Size int64
+	// Skipped is set if the file is left out: by Sync, when Copied
+	// is Size, or as a symbolic link, when it is 0.
+	Skipped bool
+}
+
+// CopyIn copies src, a local file or a tree, to name in the directory
+// dir, keeping permissions and modification times. A directory which
+// is there already is copied into; a file which is there already is
+// written over, unless opts.Sync leaves it be.
+func CopyIn(dir *Fid, name, src string, opts *CopyOpts) error {
+	c := newCopier(opts)
+	var walk func(local, rel string) error
+	walk = func(local, rel string) error {
+		fi, err := os.Lstat(local)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			return c.symlink(rel, local)
+		case fi.IsDir():
+			if err := mkdirIn(dir, rel); err != nil {
+				return err
+			}
+			fis, err := ioutil.ReadDir(local)
+			if err != nil {
+				return err
+			}
+			for _, fi := range fis {
+				if err := walk(filepath.Join(local, fi.Name()), path.Join(rel, fi.Name())); err != nil {
+					return err
+				}
+			}
+			c.dirs = append(c.dirs, func() error { return setIn(dir, rel, fi) })
+		case fi.Mode().IsRegular():
+			c.file(func() error { return c.copyIn(dir, rel, local, fi) })
+		default:
+			return fmt.Errorf("%s: not a file, directory or symbolic link", local)
+		}
+		return nil
+	}
+	return c.wait(walk(src, name))
+}
+
+// CopyOut copies name in the directory dir, a file or a tree, to dst,
+// keeping permissions and modification times, as CopyIn does the
+// other way.
+func CopyOut(dst string, dir *Fid, name string, opts *CopyOpts) error {
+	c := newCopier(opts)
+	var walk func(local, rel string) error
+	walk = func(local, rel string) error {
+		f, err := dir.Walk(rel)
+		if err != nil {
+			return err
+		}
+		d, err := f.Stat()
+		if err != nil {
+			f.Clunk()
+			return err
+		}
+		switch {
+		case d.Mode&protocol.DMSYMLINK != 0 || d.QID.Type&protocol.QTSYMLINK != 0:
+			f.Clunk()
+			return c.symlink(rel, local)
+		case d.Mode&protocol.DMDIR != 0:
+			err := f.Open(protocol.OREAD)
+			var ds []protocol.Dir
+			if err == nil {
+				ds, err = f.ReadDir()
+			}
+			f.Clunk()
+			if err != nil {
+				return err
+			}
+			for _, e := range ds {
+				if !localName(e.Name) {
+					return dir.c.violation("readdir "+rel, fmt.Errorf("directory entry named %q", e.Name))
+				}
+			}
+			if err := mkdirOut(local); err != nil {
+				return err
+			}
+			sort.Slice(ds, func(i, j int) bool { return ds[i].Name < ds[j].Name })
+			for _, e := range ds {
+				if err := walk(filepath.Join(local, e.Name), path.Join(rel, e.Name)); err != nil {
+					return err
+				}
+			}
+			c.dirs = append(c.dirs, func() error { return setOut(local, d) })
+		default:
+			f.Clunk()
+			c.file(func() error { return c.copyOut(local, dir, rel, d) })
+		}
+		return nil
+	}
+	return c.wait(walk(dst, name))
+}
+
+// localName reports whether n, the name of a directory entry, is one
+// which may be joined to a local path: one that names a file in the
+// directory, not the directory itself, its parent, or one further down.
+func localName(n string) bool {
+	return n != "" && n != "." && n != ".." && !strings.Contains(n, "/") && !strings.ContainsRune(n, filepath.Separator)
+}
+
+// A copier runs the copies of files, as many at a time as Parallel
+// says, and then sets the directories' metadata, once what is copied
+// into them won't change it again.
+type copier struct {
+	o   CopyOpts
+	sem chan struct{}
+	wg  sync.WaitGroup
+	// dirs set the metadata of each directory, in the order the
+	// directories were finished, so the deepest first.
+	dirs []func() error
+
+	// mu guards err, the first error a file's copy has.
+	mu  sync.Mutex
+	err error
+}
+
+func newCopier(opts *CopyOpts) *copier {
+	c := &copier{}
+	if opts != nil {
+		c.o = *opts
+	}
+	if c.o.Parallel < 1 {
+		c.o.Parallel = 1
+	}
+	c.sem = make(chan struct{}, c.o.Parallel)
+	return c
+}
+
+// file runs copy once there is room for it, unless a copy has failed.
+func (c *copier) file(copy func() error) {
+	c.sem <- struct{}{}
+	if c.failed() != nil {
+		<-c.sem
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() { <-c.sem }()
+		if err := copy(); err != nil {
+			c.mu.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.mu.Unlock()
+		}
+	}()
+}
+
+func (c *copier) failed() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// wait waits for the files' copies, and then sets the directories'
+// metadata. err is the walk's; it, or the first copy's, is returned.
+func (c *copier) wait(err error) error {
+	c.wg.Wait()
+	if err == nil {
+		err = c.failed()
+	}
+	if err != nil {
+		return err
+	}
+	for _, set := range c.dirs {
+		if err := set(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *copier) symlink(rel, name string) error {
+	if c.o.Symlinks != SymlinkSkip {
+		return fmt.Errorf("%s: is a symbolic link", name)
+	}
+	c.progress(Progress{Name: rel, Skipped: true})
+	return nil
+}
+
+func (c *copier) progress(p Progress) {
+	if c.o.Progress != nil {
+		c.o.Progress(p)
+	}
+}
+
+// same reports whether Sync can leave a file out: it has the size and
+// modification time of the one being copied.
+func (c *copier) same(size, dsize int64, mtime, dmtime time.Time) bool {
+	return c.o.Sync && size == dsize && mtime.Unix() == dmtime.Unix()
+}
+
+// counter tells Progress of the bytes written through it.
+type counter struct {
+	io.Writer
+	c *copier
+	p Progress
+}
+
+func (w *counter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.p.Copied += int64(n)
+	w.c.progress(w.p)
+	return n, err
+}
+
+// parent returns the path of rel's directory, for Walk.
+func parent(rel string) string {
+	if p := path.Dir(rel); p != "." {
+		return p
+	}
+	return ""
+}
+
+// mkdirIn makes the directory rel below dir, unless it is there.
+func mkdirIn(dir *Fid, rel string) error {
+	if f, err := dir.Walk(rel); err == nil {
+		isDir := f.QID().Type&protocol.QTDIR != 0
+		f.Clunk()
+		if !isDir {
+			return fmt.Errorf("%s: %w", rel, protocol.ErrNotDir)
+		}
+		return nil
+	}
+	p, err := dir.Walk(parent(rel))
+	if err != nil {
+		return err
+	}
+	defer p.Clunk()
+	// Writable by us until setIn gives it its own permissions.
+	return p.Create(path.Base(rel), protocol.DMDIR|0700, protocol.OREAD)
+}
+
+// setIn gives rel below dir the permissions and modification time of
+// fi, which keeps the mode bits 9P has.
+func setIn(dir *Fid, rel string, fi os.FileInfo) error {
+	f, err := dir.Walk(rel)
+	if err != nil {
+		return err
+	}
+	defer f.Clunk()
+	d := protocol.NullDir
+	d.Mode = uint32(fi.Mode().Perm())
+	if fi.IsDir() {
+		d.Mode |= protocol.DMDIR
+	}
+	d.Mtime = uint32(fi.ModTime().Unix())
+	return f.Wstat(d)
+}
+
+func (c *copier) copyIn(dir *Fid, rel, local string, fi os.FileInfo) error {
+	p := Progress{Name: rel, Size: fi.Size()}
+	f, err := dir.Walk(rel)
+	if err == nil {
+		d, err := f.Stat()
+		if err == nil && c.same(fi.Size(), int64(d.Length), fi.ModTime(), time.Unix(int64(d.Mtime), 0)) {
+			f.Clunk()
+			p.Copied, p.Skipped = p.Size, true
+			c.progress(p)
+			return nil
+		}
+		if err == nil {
+			err = f.Open(protocol.OWRITE | protocol.OTRUNC)
+		}
+		if err != nil {
+			f.Clunk()
+			return err
+		}
+	} else {
+		if f, err = dir.Walk(parent(rel)); err != nil {
+			return err
+		}
+		if err := f.Create(path.Base(rel), protocol.Perm(fi.Mode().Perm()), protocol.OWRITE); err != nil {
+			f.Clunk()
+			return err
+		}
+	}
+	defer f.Clunk()
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	c.progress(p)
+	if _, err := io.Copy(&counter{Writer: f, c: c, p: p}, in); err != nil {
+		return err
+	}
+	return setIn(dir, rel, fi)
+}
+
+// mkdirOut makes the directory local, unless it is there.
+func mkdirOut(local string) error {
+	if fi, err := os.Stat(local); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%s: not a directory", local)
+		}
+		return nil
+	}
+	// Writable by us until setOut gives it its own permissions.
+	return os.Mkdir(local, 0700)
+}
+
+// setOut gives local the permissions and modification time of d.
+func setOut(local string, d protocol.Dir) error {
+	if err := os.Chmod(local, os.FileMode(d.Mode&0777)); err != nil {
+		return err
+	}
+	return os.Chtimes(local, time.Unix(int64(d.Atime), 0), time.Unix(int64(d.Mtime), 0))
+}
+
+func (c *copier) copyOut(local string, dir *Fid, rel string, d protocol.Dir) error {
+	p := Progress{Name: rel, Size: int64(d.Length)}
+	if fi, err := os.Stat(local); err == nil && c.same(fi.Size(), int64(d.Length), fi.ModTime(), time.Unix(int64(d.Mtime), 0)) {
+		p.Copied, p.Skipped = p.Size, true
+		c.progress(p)
+		return nil
+	}
+	f, err := dir.Walk(rel)
+	if err != nil {
+		return err
+	}
+	defer f.Clunk()
+	if err := f.Open(protocol.OREAD); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(d.Mode&0777)|0200)
+	if err != nil {
+		return err
+	}
+	c.progress(p)
+	if _, err := io.Copy(&counter{Writer: out, c: c, p: p}, f); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return setOut(local, d)
+}
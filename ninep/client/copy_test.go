@@ -0,0 +1,283 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// fixture is a tree to copy: each file's contents, or "/" for a
+// directory, and its permissions.
+var fixture = []struct {
+	name string
+	data string
+	perm os.FileMode
+}{
+	{"a", "a file", 0644},
+	{"x", "#!/bin/rc\necho hi\n", 0755},
+	{"ro", "read only", 0444},
+	{"d", "/", 0750},
+	{"d/b", "in a directory", 0600},
+	{"d/big", string(make([]byte, 100000)), 0644},
+	{"d/e", "/", 0755},
+	{"d/e/empty", "", 0640},
+	{"d/none", "/", 0700},
+}
+
+// fixtureTime is the modification time of the nth file of fixture.
+func fixtureTime(n int) time.Time {
+	return time.Date(2021, 3, 1, 12, n, 0, 0, time.UTC)
+}
+
+func makeFixture(t *testing.T, dir string) {
+	t.Helper()
+	for _, f := range fixture {
+		n := filepath.Join(dir, filepath.FromSlash(f.name))
+		var err error
+		if f.data == "/" {
+			err = os.Mkdir(n, 0755)
+		} else {
+			err = ioutil.WriteFile(n, []byte(f.data), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deepest first, so that making a file doesn't change its
+	// directory's time once set.
+	for i := len(fixture) - 1; i >= 0; i-- {
+		f := fixture[i]
+		n := filepath.Join(dir, filepath.FromSlash(f.name))
+		if err := os.Chmod(n, f.perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(n, fixtureTime(i), fixtureTime(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkFixture checks that dir has the fixture, metadata and all.
+func checkFixture(t *testing.T, dir string) {
+	t.Helper()
+	for i, f := range fixture {
+		n := filepath.Join(dir, filepath.FromSlash(f.name))
+		fi, err := os.Stat(n)
+		if err != nil {
+			t.Errorf("%s: %v", f.name, err)
+			continue
+		}
+		if fi.Mode().Perm() != f.perm || fi.IsDir() != (f.data == "/") {
+			t.Errorf("%s: mode %v, want %v (directory: %v)", f.name, fi.Mode(), f.perm, f.data == "/")
+		}
+		if !fi.ModTime().Equal(fixtureTime(i)) {
+			t.Errorf("%s: modified %v, want %v", f.name, fi.ModTime().UTC(), fixtureTime(i))
+		}
+		if fi.IsDir() {
+			continue
+		}
+		if b, err := ioutil.ReadFile(n); string(b) != f.data || err != nil {
+			t.Errorf("%s: got (%d bytes, %v), want (%d bytes, nil)", f.name, len(b), err, len(f.data))
+		}
+	}
+}
+
+// progressLog keeps the names Progress is told of, once copied or
+// skipped.
+type progressLog struct {
+	mu      sync.Mutex
+	copied  []string
+	skipped []string
+}
+
+func (l *progressLog) progress(p Progress) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case p.Skipped:
+		l.skipped = append(l.skipped, p.Name)
+	case p.Copied == p.Size:
+		l.copied = append(l.copied, p.Name)
+	}
+}
+
+// names returns the copied and skipped names, each sorted, and
+// empties l.
+func (l *progressLog) names() ([]string, []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, s := l.copied, l.skipped
+	l.copied, l.skipped = nil, nil
+	sort.Strings(c)
+	sort.Strings(s)
+	return c, s
+}
+
+func TestCopy(t *testing.T) {
+	c, served := newUFS(t)
+	root := attach(t, c)
+	defer root.Clunk()
+	local, err := ioutil.TempDir("", "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	src, back := filepath.Join(local, "src"), filepath.Join(local, "back")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	makeFixture(t, src)
+
+	var l progressLog
+	opts := &CopyOpts{Parallel: 4, Progress: l.progress}
+	if err := CopyIn(root, "tree", src, opts); err != nil {
+		t.Fatalf("CopyIn: want nil, got %v", err)
+	}
+	checkFixture(t, filepath.Join(served, "tree"))
+	if err := CopyOut(back, root, "tree", opts); err != nil {
+		t.Fatalf("CopyOut: want nil, got %v", err)
+	}
+	checkFixture(t, back)
+
+	// A file by itself.
+	if err := CopyOut(filepath.Join(local, "b"), root, "tree/d/b", nil); err != nil {
+		t.Fatalf("CopyOut(tree/d/b): want nil, got %v", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(local, "b")); string(b) != "in a directory" || err != nil {
+		t.Errorf("CopyOut(tree/d/b): got (%q, %v), want (%q, nil)", b, err, "in a directory")
+	}
+
+	// Sync copies only what has changed.
+	l.names()
+	if err := ioutil.WriteFile(filepath.Join(src, "d", "b"), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts.Sync = true
+	if err := CopyIn(root, "tree", src, opts); err != nil {
+		t.Fatalf("CopyIn with Sync: want nil, got %v", err)
+	}
+	copied, skipped := l.names()
+	if want := []string{"tree/d/b"}; !reflect.DeepEqual(copied, want) {
+		t.Errorf("CopyIn with Sync: copied %q, want %q", copied, want)
+	}
+	if want := []string{"tree/a", "tree/d/big", "tree/d/e/empty", "tree/ro", "tree/x"}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("CopyIn with Sync: skipped %q, want %q", skipped, want)
+	}
+	if err := CopyOut(back, root, "tree", opts); err != nil {
+		t.Fatalf("CopyOut with Sync: want nil, got %v", err)
+	}
+	if copied, _ := l.names(); !reflect.DeepEqual(copied, []string{"tree/d/b"}) {
+		t.Errorf("CopyOut with Sync: copied %q, want [tree/d/b]", copied)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(back, "d", "b")); string(b) != "changed" || err != nil {
+		t.Errorf("CopyOut with Sync: d/b is (%q, %v), want (changed, nil)", b, err)
+	}
+}
+
+func TestCopySymlinks(t *testing.T) {
+	c, served := newUFS(t)
+	root := attach(t, c)
+	defer root.Clunk()
+	local, err := ioutil.TempDir("", "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	if err := ioutil.WriteFile(filepath.Join(local, "f"), []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("f", filepath.Join(local, "l")); err != nil {
+		t.Skipf("no symbolic links: %v", err)
+	}
+
+	if err := CopyIn(root, "in", local, nil); err == nil {
+		t.Errorf("CopyIn of a symbolic link with SymlinkError: want an error, got nil")
+	}
+	var l progressLog
+	opts := &CopyOpts{Symlinks: SymlinkSkip, Progress: l.progress}
+	if err := CopyIn(root, "in", local, opts); err != nil {
+		t.Fatalf("CopyIn with SymlinkSkip: want nil, got %v", err)
+	}
+	if _, skipped := l.names(); !reflect.DeepEqual(skipped, []string{"in/l"}) {
+		t.Errorf("CopyIn with SymlinkSkip: skipped %q, want [in/l]", skipped)
+	}
+	if _, err := os.Lstat(filepath.Join(served, "in", "l")); !os.IsNotExist(err) {
+		t.Errorf("CopyIn with SymlinkSkip: in/l: want not to exist, got %v", err)
+	}
+
+	// One served is a symbolic link too.
+	if err := os.Symlink("f", filepath.Join(served, "in", "l")); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(local, "out")
+	if err := CopyOut(out, root, "in", nil); err == nil {
+		t.Errorf("CopyOut of a symbolic link with SymlinkError: want an error, got nil")
+	}
+	if err := CopyOut(out, root, "in", opts); err != nil {
+		t.Fatalf("CopyOut with SymlinkSkip: want nil, got %v", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(out, "f")); string(b) != "f" || err != nil {
+		t.Errorf("CopyOut with SymlinkSkip: f is (%q, %v), want (f, nil)", b, err)
+	}
+	if _, err := os.Lstat(filepath.Join(out, "l")); !os.IsNotExist(err) {
+		t.Errorf("CopyOut with SymlinkSkip: l: want not to exist, got %v", err)
+	}
+}
+
+// TestCopyOutBadName checks that CopyOut won't copy a directory entry
+// whose name would take it out of the directory, but takes it for the
+// protocol violation it is.
+func TestCopyOutBadName(t *testing.T) {
+	for _, name := range []string{"..", ".", "", "a/b"} {
+		t.Run(name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "copy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			_, root, s := newFake(t, 10)
+			r := make(chan error, 1)
+			go func() {
+				r <- CopyOut(filepath.Join(tmp, "out"), root, "d", nil)
+			}()
+
+			dir := protocol.QID{Type: protocol.QTDIR, Path: 1}
+			tag := s.expect(protocol.Twalk)
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRwalkPkt(b, tag, []protocol.QID{dir}) })
+			tag = s.expect(protocol.Tstat)
+			s.send(func(b *bytes.Buffer) {
+				protocol.MarshalRstatPkt(b, tag, protocol.Dir{QID: dir, Mode: protocol.DMDIR | 0755, Name: "d"}.Marshal())
+			})
+			tag = s.expect(protocol.Topen)
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRopenPkt(b, tag, dir, 0) })
+			tag = s.expect(protocol.Tread)
+			s.send(func(b *bytes.Buffer) {
+				protocol.MarshalRreadPkt(b, tag, protocol.Dir{QID: dir, Mode: protocol.DMDIR | 0755, Name: name}.Marshal())
+			})
+			tag = s.expect(protocol.Tread)
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRreadPkt(b, tag, nil) })
+			tag = s.expect(protocol.Tclunk)
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRclunkPkt(b, tag) })
+
+			if err := <-r; !errors.Is(err, ErrProtocol) {
+				t.Errorf("CopyOut of an entry named %q: want ErrProtocol, got %v", name, err)
+			}
+			if fis, err := ioutil.ReadDir(tmp); err != nil || len(fis) != 0 {
+				t.Errorf("CopyOut of an entry named %q: want nothing copied, got %d files, %v", name, len(fis), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,490 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// A Fid is a file on the server, as a FID names it: walked to, and,
+// once Open or Create has been called, open. It is the caller's, to
+// Clunk or Remove once done with.
+//
+// Read and Write go on from where the last one left off, as an
+// os.File's do; ReadAt and WriteAt say where, and take as many Treads
+// and Twrites as the iounit and msize need. A Fid may be used from
+// many goroutines at once: ReadAt and WriteAt are then as they would
+// be one at a time, but Reads and Writes at the offset, like an
+// os.File's, go in whatever order they come.
+type Fid struct {
+	c   *Conn
+	fid protocol.FID
+	// ctx bounds each RPC on the Fid.
+	ctx context.Context
+	// retry, if set, says which RPCs are tried again. See WithRetry.
+	retry *RetryPolicy
+	// s is shared by the Fids WithContext makes of this one.
+	s *fidState
+}
+
+// A Fid is an io.ReadWriteSeeker, io.ReaderAt, io.WriterAt and
+// io.Closer, for whatever takes those.
+var (
+	_ io.ReadWriteSeeker = (*Fid)(nil)
+	_ io.ReaderAt        = (*Fid)(nil)
+	_ io.WriterAt        = (*Fid)(nil)
+	_ io.Closer          = (*Fid)(nil)
+)
+
+type fidState struct {
+	// mu guards below.
+	mu     sync.Mutex
+	qid    protocol.QID
+	iounit uint32
+	offset int64
+}
+
+// WithContext returns f with its RPCs bound by ctx: once ctx is done,
+// they return its error, and are flushed. The Fid returned is the same
+// file as f, at the same offset, and Clunking either clunks both. Fids
+// walked to from it are bound by ctx too.
+func (f *Fid) WithContext(ctx context.Context) *Fid {
+	return &Fid{c: f.c, fid: f.fid, ctx: ctx, retry: f.retry, s: f.s}
+}
+
+// QID returns the QID of the file, as the server last gave it.
+func (f *Fid) QID() protocol.QID {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	return f.s.qid
+}
+
+// Walk returns a new Fid for the file at path, a slash-separated list
+// of names from f, which may be a file or a directory. An empty path
+// clones f. Paths of more than protocol.MaxWElem names take several
+// Twalks. If the walk doesn't get all the way, the error is a
+// RemoteError for protocol.ErrNotExist, or for what the server said.
+func (f *Fid) Walk(path string) (*Fid, error) {
+	var names []string
+	for _, n := range strings.Split(path, "/") {
+		if n != "" {
+			names = append(names, n)
+		}
+	}
+	op := "walk " + path
+	from, q := f.fid, f.QID()
+	for first := true; first || len(names) > 0; first = false {
+		n := len(names)
+		if n > protocol.MaxWElem {
+			n = protocol.MaxWElem
+		}
+		// Each try has a newfid of its own: one which timed out may
+		// have made its newfid all the same, so it is clunked.
+		var newfid protocol.FID
+		var r *bytes.Buffer
+		var failed error
+		clunkFailed := func() {
+			if errors.Is(failed, protocol.ErrTimedOut) {
+				f.c.clunk(f.ctx, newfid)
+			}
+		}
+		err := f.retrying(OpWalk, func() error {
+			clunkFailed()
+			newfid = f.c.newFID()
+			r, failed = f.c.rpc(f.ctx, op, protocol.Rwalk, func(b *bytes.Buffer, t protocol.Tag) {
+				protocol.MarshalTwalkPkt(b, t, from, newfid, names[:n])
+			})
+			return failed
+		})
+		if from != f.fid {
+			f.c.clunk(f.ctx, from)
+		}
+		if err != nil {
+			clunkFailed()
+			return nil, err
+		}
+		qids, _, err := protocol.UnmarshalRwalkPkt(r)
+		if err == nil {
+			err = checkWalk(qids, n)
+		}
+		if err != nil {
+			// Whatever the server meant, it may have made newfid.
+			f.c.clunkLost(newfid)
+			return nil, f.c.violation(op, err)
+		}
+		if len(qids) < n {
+			// A walk which gets part of the way makes no FID.
+			return nil, &RemoteError{op, protocol.ErrNotExist.Err}
+		}
+		if n > 0 {
+			q = qids[n-1]
+		}
+		from, names = newfid, names[n:]
+	}
+	return &Fid{c: f.c, fid: from, ctx: f.ctx, retry: f.retry, s: &fidState{qid: q}}, nil
+}
+
+// checkWalk returns what is wrong with qids, the Rwalk of n names: a
+// walk gets no further than it was asked to, gets somewhere unless it
+// was asked to go nowhere, and gets there through directories.
+func checkWalk(qids []protocol.QID, n int) error {
+	switch {
+	case len(qids) > n:
+		return fmt.Errorf("walked %d names of %d", len(qids), n)
+	case n > 0 && len(qids) == 0:
+		return fmt.Errorf("walk of %d names got nowhere, but is not an Rerror", n)
+	}
+	for i := 0; i+1 < len(qids); i++ {
+		if qids[i].Type&protocol.QTDIR == 0 {
+			return fmt.Errorf("walked on from %v, which is not a directory", qids[i])
+		}
+	}
+	return nil
+}
+
+// Open opens the file with mode, e.g. protocol.OREAD.
+func (f *Fid) Open(mode protocol.Mode) error {
+	b, err := f.rpc(OpOpen, "open", protocol.Ropen, func(b *bytes.Buffer, t protocol.Tag) {
+		protocol.MarshalTopenPkt(b, t, f.fid, mode)
+	})
+	if err != nil {
+		return err
+	}
+	q, iounit, _, err := protocol.UnmarshalRopenPkt(b)
+	if err != nil {
+		return f.c.violation("open", err)
+	}
+	f.opened(q, iounit)
+	return nil
+}
+
+// Create creates name, in the directory f, with perm, and opens it with
+// mode. f is the new file from then on.
+func (f *Fid) Create(name string, perm protocol.Perm, mode protocol.Mode) error {
+	op := "create " + name
+	b, err := f.rpc(OpCreate, op, protocol.Rcreate, func(b *bytes.Buffer, t protocol.Tag) {
+		protocol.MarshalTcreatePkt(b, t, f.fid, name, perm, mode)
+	})
+	if err != nil {
+		return err
+	}
+	q, iounit, _, err := protocol.UnmarshalRcreatePkt(b)
+	if err != nil {
+		return f.c.violation(op, err)
+	}
+	if (q.Type&protocol.QTDIR != 0) != (perm&protocol.DMDIR != 0) {
+		return f.c.violation(op, fmt.Errorf("QID %v is not what perm %#o makes", q, perm))
+	}
+	f.opened(q, iounit)
+	return nil
+}
+
+func (f *Fid) opened(q protocol.QID, iounit protocol.MaxSize) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	f.s.qid, f.s.iounit, f.s.offset = q, uint32(iounit), 0
+}
+
+// chunk returns the most one Tread or Twrite on f may move: the iounit
+// the server gave, if it gave one, within what msize allows.
+func (f *Fid) chunk() int {
+	f.s.mu.Lock()
+	n := f.s.iounit
+	f.s.mu.Unlock()
+	if max := f.c.maxData(); n == 0 || n > max {
+		n = max
+	}
+	return int(n)
+}
+
+// ReadAt reads len(b) bytes from f at off, as io.ReaderAt does: if it
+// reads less, the error says why, and is io.EOF at the end of the file.
+func (f *Fid) ReadAt(b []byte, off int64) (int, error) {
+	var tot int
+	for tot < len(b) {
+		n, err := f.read(b[tot:], off+int64(tot))
+		tot += n
+		if err != nil {
+			return tot, err
+		}
+		if n == 0 {
+			return tot, io.EOF
+		}
+	}
+	return tot, nil
+}
+
+// read does one Tread, of as much of b as fits.
+func (f *Fid) read(b []byte, off int64) (int, error) {
+	if max := f.chunk(); len(b) > max {
+		b = b[:max]
+	}
+	r, err := f.rpc(OpRead, "read", protocol.Rread, func(m *bytes.Buffer, t protocol.Tag) {
+		protocol.MarshalTreadPkt(m, t, f.fid, protocol.Offset(off), protocol.Count(len(b)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	d, _, err := protocol.UnmarshalRreadPkt(r)
+	if err != nil {
+		return 0, f.c.violation("read", err)
+	}
+	if len(d) > len(b) {
+		return 0, f.c.violation("read", fmt.Errorf("got %d bytes, asked for %d", len(d), len(b)))
+	}
+	return copy(b, d), nil
+}
+
+// Read reads up to len(b) bytes from where the last Read or Write left
+// off, in one Tread. At the end of the file it returns 0, io.EOF.
+func (f *Fid) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	f.s.mu.Lock()
+	off := f.s.offset
+	f.s.mu.Unlock()
+	n, err := f.read(b, off)
+	f.s.mu.Lock()
+	f.s.offset = off + int64(n)
+	f.s.mu.Unlock()
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WriteAt writes b to f at off, in as many Twrites as it takes, as
+// io.WriterAt does.
+func (f *Fid) WriteAt(b []byte, off int64) (int, error) {
+	var tot int
+	for tot < len(b) {
+		d := b[tot:]
+		if max := f.chunk(); len(d) > max {
+			d = d[:max]
+		}
+		o := off + int64(tot)
+		r, err := f.rpc(OpWrite, "write", protocol.Rwrite, func(m *bytes.Buffer, t protocol.Tag) {
+			protocol.MarshalTwritePkt(m, t, f.fid, protocol.Offset(o), d)
+		})
+		if err != nil {
+			return tot, err
+		}
+		n, _, err := protocol.UnmarshalRwritePkt(r)
+		if err != nil {
+			return tot, f.c.violation("write", err)
+		}
+		if n < 0 || int(n) > len(d) {
+			return tot, f.c.violation("write", fmt.Errorf("wrote %d bytes of %d", n, len(d)))
+		}
+		tot += int(n)
+		if n == 0 {
+			return tot, io.ErrShortWrite
+		}
+	}
+	return tot, nil
+}
+
+// Write writes b where the last Read or Write left off.
+func (f *Fid) Write(b []byte) (int, error) {
+	f.s.mu.Lock()
+	off := f.s.offset
+	f.s.mu.Unlock()
+	n, err := f.WriteAt(b, off)
+	f.s.mu.Lock()
+	f.s.offset = off + int64(n)
+	f.s.mu.Unlock()
+	return n, err
+}
+
+// Seek sets where the next Read or Write starts, as io.Seeker does.
+// Seeking from the end stats the file for its length.
+func (f *Fid) Seek(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		f.s.mu.Lock()
+		base = f.s.offset
+		f.s.mu.Unlock()
+	case io.SeekEnd:
+		d, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		base = int64(d.Length)
+	default:
+		return 0, fmt.Errorf("seek: bad whence %d", whence)
+	}
+	if base+offset < 0 {
+		return 0, errors.New("seek: negative offset")
+	}
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	f.s.offset = base + offset
+	return f.s.offset, nil
+}
+
+// ReadDir reads the directory f, which must be open, from the start,
+// and returns its entries.
+func (f *Fid) ReadDir() ([]protocol.Dir, error) {
+	var ds []protocol.Dir
+	b := make([]byte, f.chunk())
+	for off := int64(0); ; {
+		n, err := f.read(b, off)
+		if err != nil {
+			return ds, err
+		}
+		if n == 0 {
+			return ds, nil
+		}
+		off += int64(n)
+		for e := b[:n]; len(e) > 0; {
+			if len(e) < 2 {
+				return ds, f.c.violation("readdir", fmt.Errorf("%d bytes left over after the last entry", len(e)))
+			}
+			sz := int(e[0]) | int(e[1])<<8 + 2
+			if sz > len(e) {
+				return ds, f.c.violation("readdir", fmt.Errorf("entry of %d bytes, but only %d left", sz, len(e)))
+			}
+			var d protocol.Dir
+			if err := d.Unmarshal(e[:sz]); err != nil {
+				return ds, f.c.violation("readdir", err)
+			}
+			ds = append(ds, d)
+			e = e[sz:]
+		}
+	}
+}
+
+// Stat returns what the server says of the file.
+func (f *Fid) Stat() (protocol.Dir, error) {
+	r, err := f.rpc(OpStat, "stat", protocol.Rstat, func(b *bytes.Buffer, t protocol.Tag) {
+		protocol.MarshalTstatPkt(b, t, f.fid)
+	})
+	if err != nil {
+		return protocol.Dir{}, err
+	}
+	b, _, err := protocol.UnmarshalRstatPkt(r)
+	if err != nil {
+		return protocol.Dir{}, f.c.violation("stat", err)
+	}
+	var d protocol.Dir
+	if err := d.Unmarshal(b); err != nil {
+		return protocol.Dir{}, f.c.violation("stat", err)
+	}
+	return d, nil
+}
+
+// Wstat changes the file as d says: start from protocol.NullDir, which
+// changes nothing, and set what is to change.
+func (f *Fid) Wstat(d protocol.Dir) error {
+	_, err := f.rpc(OpWstat, "wstat", protocol.Rwstat, func(b *bytes.Buffer, t protocol.Tag) {
+		protocol.MarshalTwstatPkt(b, t, f.fid, d.Marshal())
+	})
+	return err
+}
+
+// Chmod changes the file's permissions, the 0777 bits of its mode, to
+// perm's. A Twstat may not change whether a file is a directory, so the
+// rest of the mode is kept as Stat says it is.
+func (f *Fid) Chmod(perm protocol.Perm) error {
+	d, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return f.Wstat(chmodDir(d, perm))
+}
+
+func chmodDir(d protocol.Dir, perm protocol.Perm) protocol.Dir {
+	w := protocol.NullDir
+	w.Mode = d.Mode&^0777 | uint32(perm)&0777
+	return w
+}
+
+// Rename renames the file to name, in the same directory: 9P moves no
+// file from one directory to another.
+func (f *Fid) Rename(name string) error {
+	w, err := renameDir(name)
+	if err != nil {
+		return err
+	}
+	return f.Wstat(w)
+}
+
+func renameDir(name string) (protocol.Dir, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return protocol.Dir{}, fmt.Errorf("rename to %q: %w", name, protocol.ErrBadWalkName)
+	}
+	w := protocol.NullDir
+	w.Name = name
+	return w, nil
+}
+
+// Chtimes changes the file's access and modification times, as
+// os.Chtimes does. A zero time.Time leaves that time as it is.
+func (f *Fid) Chtimes(atime, mtime time.Time) error {
+	return f.Wstat(chtimesDir(atime, mtime))
+}
+
+func chtimesDir(atime, mtime time.Time) protocol.Dir {
+	w := protocol.NullDir
+	if !atime.IsZero() {
+		w.Atime = uint32(atime.Unix())
+	}
+	if !mtime.IsZero() {
+		w.Mtime = uint32(mtime.Unix())
+	}
+	return w
+}
+
+// Remove removes the file, and clunks f, whether or not the file could
+// be removed. Since f is gone either way, a Remove is never done again,
+// whatever f's RetryPolicy says.
+func (f *Fid) Remove() error {
+	_, err := f.c.rpc(f.ctx, "remove", protocol.Rremove, func(b *bytes.Buffer, t protocol.Tag) {
+		protocol.MarshalTremovePkt(b, t, f.fid)
+	})
+	return err
+}
+
+// Clunk tells the server f is done with. f must not be used after.
+func (f *Fid) Clunk() error {
+	return f.c.clunk(f.ctx, f.fid)
+}
+
+// Close is Clunk, for io.Closer.
+func (f *Fid) Close() error {
+	return f.Clunk()
+}
+
+// clunkLost clunks fid without waiting for the reply, which may never
+// come: it is for a Conn about to be failed, which mustn't leave behind
+// a fid the server may have made. The tag it takes is never given back.
+func (c *Conn) clunkLost(fid protocol.FID) {
+	select {
+	case t := <-c.tags:
+		c.send("clunk", t, func(b *bytes.Buffer, t protocol.Tag) {
+			protocol.MarshalTclunkPkt(b, t, fid)
+		})
+	default:
+	}
+}
+
+func (c *Conn) clunk(ctx context.Context, fid protocol.FID) error {
+	_, err := c.rpc(ctx, "clunk", protocol.Rclunk, func(b *bytes.Buffer, t protocol.Tag) {
+		protocol.MarshalTclunkPkt(b, t, fid)
+	})
+	return err
+}
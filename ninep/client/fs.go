@@ -0,0 +1,266 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// An FS is the tree below a Fid, read-only, as an fs.FS, so that
+// fs.WalkDir, http.FS, template.ParseFS and the like can use a 9P
+// server. It is also an fs.StatFS, an fs.ReadDirFS and an
+// fs.ReadFileFS, and the files it opens are io.Seekers and
+// io.ReaderAts. Errors which are protocol.ErrNotExist,
+// protocol.ErrPermission or protocol.ErrExist are fs's.
+//
+// An FS uses its root, but does not own it: the caller clunks it once
+// done with the FS.
+type FS struct {
+	root *Fid
+}
+
+// NewFS returns an FS of the tree below root, usually the Fid Attach
+// returns.
+func NewFS(root *Fid) *FS {
+	return &FS{root: root}
+}
+
+// fsErrors are the fs errors for the Err values of the same meaning,
+// so that errors.Is(err, fs.ErrNotExist) works on what an FS returns.
+var fsErrors = []struct {
+	e   *protocol.Error
+	err error
+}{
+	{protocol.ErrNotExist, fs.ErrNotExist},
+	{protocol.ErrPermission, fs.ErrPermission},
+	{protocol.ErrExist, fs.ErrExist},
+}
+
+// pathError returns err, from op on name, as an *fs.PathError.
+func pathError(op, name string, err error) error {
+	for _, f := range fsErrors {
+		if errors.Is(err, f.e) {
+			err = f.err
+			break
+		}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// walk returns a new Fid for name, which must be a valid fs path.
+func (fsys *FS) walk(op, name string) (*Fid, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		name = ""
+	}
+	f, err := fsys.root.Walk(name)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	return f, nil
+}
+
+// Open opens name for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	f, err := fsys.walk("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Open(protocol.OREAD); err != nil {
+		f.Clunk()
+		return nil, pathError("open", name, err)
+	}
+	return &file{f: f, name: name}, nil
+}
+
+// Stat returns what the server says of name.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	f, err := fsys.walk("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Clunk()
+	d, err := f.Stat()
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return &fileInfo{name: path.Base(name), d: d}, nil
+}
+
+// ReadDir returns the entries of the directory name, sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.(*file).ReadDir(-1)
+}
+
+// ReadFile returns what is in the file name.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.walk("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Clunk()
+	if f.QID().Type&protocol.QTDIR != 0 {
+		return nil, pathError("readfile", name, protocol.ErrIsDir)
+	}
+	if err := f.Open(protocol.OREAD); err != nil {
+		return nil, pathError("readfile", name, err)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, pathError("readfile", name, err)
+	}
+	return b, nil
+}
+
+// A file is an open file of an FS.
+type file struct {
+	f    *Fid
+	name string
+
+	// mu guards below.
+	mu     sync.Mutex
+	closed bool
+	// ents holds the entries ReadDir has yet to return, once it has
+	// read them; read says whether it has.
+	ents []fs.DirEntry
+	read bool
+}
+
+func (f *file) isDir() bool {
+	return f.f.QID().Type&protocol.QTDIR != 0
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	d, err := f.f.Stat()
+	if err != nil {
+		return nil, pathError("stat", f.name, err)
+	}
+	return &fileInfo{name: path.Base(f.name), d: d}, nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if f.isDir() {
+		return 0, pathError("read", f.name, protocol.ErrIsDir)
+	}
+	n, err := f.f.Read(b)
+	if err != nil && err != io.EOF {
+		err = pathError("read", f.name, err)
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	if f.isDir() {
+		return 0, pathError("read", f.name, protocol.ErrIsDir)
+	}
+	n, err := f.f.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		err = pathError("read", f.name, err)
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	o, err := f.f.Seek(offset, whence)
+	if err != nil {
+		return 0, pathError("seek", f.name, err)
+	}
+	return o, nil
+}
+
+// ReadDir returns the next n entries of the directory, as
+// fs.ReadDirFile does. It reads them all the first time, and returns
+// them sorted by name.
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.read {
+		if !f.isDir() {
+			return nil, pathError("readdir", f.name, protocol.ErrNotDir)
+		}
+		ds, err := f.f.ReadDir()
+		if err != nil {
+			return nil, pathError("readdir", f.name, err)
+		}
+		for _, d := range ds {
+			f.ents = append(f.ents, &fileInfo{name: d.Name, d: d})
+		}
+		sort.Slice(f.ents, func(i, j int) bool { return f.ents[i].Name() < f.ents[j].Name() })
+		f.read = true
+	}
+	if n > 0 && len(f.ents) == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > len(f.ents) {
+		n = len(f.ents)
+	}
+	ents := f.ents[:n]
+	f.ents = f.ents[n:]
+	return ents, nil
+}
+
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	if err := f.f.Clunk(); err != nil {
+		return pathError("close", f.name, err)
+	}
+	return nil
+}
+
+// A fileInfo is a Dir as an fs.FileInfo, and an fs.DirEntry.
+type fileInfo struct {
+	name string
+	d    protocol.Dir
+}
+
+func (fi *fileInfo) Name() string               { return fi.name }
+func (fi *fileInfo) Size() int64                { return int64(fi.d.Length) }
+func (fi *fileInfo) ModTime() time.Time         { return time.Unix(int64(fi.d.Mtime), 0) }
+func (fi *fileInfo) IsDir() bool                { return fi.d.Mode&protocol.DMDIR != 0 }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// Sys returns the protocol.Dir.
+func (fi *fileInfo) Sys() interface{} { return fi.d }
+
+// Mode returns the Dir's mode as an fs.FileMode.
+func (fi *fileInfo) Mode() fs.FileMode {
+	m := fs.FileMode(fi.d.Mode & 0777)
+	for _, b := range []struct {
+		dm uint32
+		fm fs.FileMode
+	}{
+		{protocol.DMDIR, fs.ModeDir},
+		{protocol.DMAPPEND, fs.ModeAppend},
+		{protocol.DMEXCL, fs.ModeExclusive},
+		{protocol.DMTMP, fs.ModeTemporary},
+	} {
+		if fi.d.Mode&b.dm != 0 {
+			m |= b.fm
+		}
+	}
+	return m
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+func TestFS(t *testing.T) {
+	c, dir := newUFS(t)
+	files := map[string]string{
+		"a":         "a file",
+		"b/c":       "in a directory",
+		"b/d/e":     "further down",
+		"b/d/empty": "",
+	}
+	for n, s := range files {
+		n = filepath.Join(dir, filepath.FromSlash(n))
+		if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(n, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := attach(t, c)
+	defer root.Clunk()
+	fsys := NewFS(root)
+
+	if err := fstest.TestFS(fsys, "a", "b/c", "b/d/e", "b/d/empty"); err != nil {
+		t.Fatal(err)
+	}
+	for n, s := range files {
+		if b, err := fsys.ReadFile(n); string(b) != s || err != nil {
+			t.Errorf("ReadFile(%q): want (%q, nil), got (%q, %v)", n, s, b, err)
+		}
+	}
+	if _, err := fsys.ReadFile("b"); !errors.Is(err, protocol.ErrIsDir) {
+		t.Errorf("ReadFile(b): want %v, got %v", protocol.ErrIsDir, err)
+	}
+	if _, err := fsys.Open("nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(nope): want %v, got %v", fs.ErrNotExist, err)
+	}
+	if _, err := fsys.Stat("../a"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Stat(../a): want %v, got %v", fs.ErrInvalid, err)
+	}
+
+	srv := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/b/d/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, err := ioutil.ReadAll(resp.Body); string(b) != files["b/d/e"] || err != nil {
+		t.Errorf("GET /b/d/e: want (%q, nil), got (%q, %v)", files["b/d/e"], b, err)
+	}
+}
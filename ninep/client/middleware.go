@@ -0,0 +1,158 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/bits"
+	"sync"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// A Request is an RPC on its way to the server, as Middleware sees it.
+type Request struct {
+	// Op is what the request is for, as errors say: e.g. "walk a/b".
+	Op string
+	// Type is the T-message's type.
+	Type protocol.MType
+	// FID is the fid the request is on.
+	FID protocol.FID
+	// Offset and Count are a Tread's or Twrite's: where, and how many
+	// bytes are asked for, or sent.
+	Offset int64
+	Count  uint32
+	// Size is the T-message's size, in bytes.
+	Size int
+
+	want    protocol.MType
+	marshal func(b *bytes.Buffer, t protocol.Tag)
+}
+
+// newRequest returns the Request for op, decoded from what marshal
+// makes. Every request which goes through rpc has a fid first.
+func newRequest(op string, want protocol.MType, marshal func(b *bytes.Buffer, t protocol.Tag)) *Request {
+	var b bytes.Buffer
+	marshal(&b, protocol.NOTAG)
+	m := b.Bytes()
+	r := &Request{Op: op, Type: protocol.MType(m[4]), FID: protocol.NOFID, Size: len(m), want: want, marshal: marshal}
+	if len(m) >= 11 {
+		r.FID = protocol.FID(binary.LittleEndian.Uint32(m[7:]))
+	}
+	if (r.Type == protocol.Tread || r.Type == protocol.Twrite) && len(m) >= 23 {
+		r.Offset = int64(binary.LittleEndian.Uint64(m[11:]))
+		r.Count = binary.LittleEndian.Uint32(m[19:])
+	}
+	return r
+}
+
+// A RoundTripper sends a Request, and returns its reply, from the tag
+// on, as the protocol package's Unmarshal functions take it. An Rerror
+// is a RemoteError.
+type RoundTripper func(ctx context.Context, r *Request) (*bytes.Buffer, error)
+
+// Middleware wraps a RoundTripper in another, which may look at, change
+// or stand in for what the first does, e.g. to log requests, or to
+// start a span for each in some tracing system, with the Request's FID,
+// Offset and Count for attributes. The Tversion and Tflushes a Conn
+// sends itself don't go through it.
+type Middleware func(RoundTripper) RoundTripper
+
+// A ConnOpt is an option for NewConn, Dial and DialAddr.
+type ConnOpt func(*Conn)
+
+// WithMiddleware wraps each of the Conn's RPCs in m. The first
+// Middleware given, to the first WithMiddleware, is the outermost.
+func WithMiddleware(m ...Middleware) ConnOpt {
+	return func(c *Conn) {
+		c.middleware = append(c.middleware, m...)
+	}
+}
+
+// Trace returns Middleware which logs each request with logf: what it
+// was, on which fid, how long it took, and how it ended.
+func Trace(logf func(string, ...interface{})) Middleware {
+	return func(next RoundTripper) RoundTripper {
+		return func(ctx context.Context, r *Request) (*bytes.Buffer, error) {
+			start := time.Now()
+			b, err := next(ctx, r)
+			took := time.Since(start)
+			switch {
+			case r.Type == protocol.Tread || r.Type == protocol.Twrite:
+				logf("%v fid %d offset %d count %d: took %v, error %v", protocol.RPCNames[r.Type], r.FID, r.Offset, r.Count, took, err)
+			default:
+				logf("%v fid %d: took %v, error %v", protocol.RPCNames[r.Type], r.FID, took, err)
+			}
+			return b, err
+		}
+	}
+}
+
+// Stats is Middleware which counts a Conn's requests of each type, and
+// the errors, times them, and counts the bytes they move, as a
+// NetListener's Metrics does for a server. Its zero value is ready to
+// use, and one Stats may be shared by any number of Conns.
+type Stats struct {
+	mu       sync.Mutex
+	m        map[protocol.MType]*protocol.RequestMetrics
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// Middleware wraps next to keep s.
+func (s *Stats) Middleware(next RoundTripper) RoundTripper {
+	return func(ctx context.Context, r *Request) (*bytes.Buffer, error) {
+		start := time.Now()
+		b, err := next(ctx, r)
+		took := time.Since(start)
+		bucket := bits.Len64(uint64(took / time.Microsecond))
+		if bucket >= protocol.LatencyBuckets {
+			bucket = protocol.LatencyBuckets - 1
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.m == nil {
+			s.m = make(map[protocol.MType]*protocol.RequestMetrics)
+		}
+		rm, ok := s.m[r.Type]
+		if !ok {
+			rm = &protocol.RequestMetrics{}
+			s.m[r.Type] = rm
+		}
+		rm.Count++
+		if err != nil {
+			rm.Errors++
+		}
+		rm.Total += took
+		rm.Latency[bucket]++
+		s.bytesOut += uint64(r.Size)
+		if b != nil {
+			// The size, and the type, are gone.
+			s.bytesIn += uint64(b.Len() + 5)
+		}
+		return b, err
+	}
+}
+
+// Snapshot returns what s has counted. Errors are all those an RPC can
+// give, not only Rerrors, and BytesIn counts replies but for those.
+// Rejected, Conns and Accepted are a server's, and 0.
+func (s *Stats) Snapshot() protocol.MetricsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := protocol.MetricsSnapshot{
+		Requests: make(map[protocol.MType]protocol.RequestMetrics, len(s.m)),
+		BytesIn:  s.bytesIn,
+		BytesOut: s.bytesOut,
+	}
+	for t, rm := range s.m {
+		ms.Requests[t] = *rm
+	}
+	return ms
+}
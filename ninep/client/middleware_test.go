@@ -0,0 +1,161 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"harvey-os.org/ninep/ninetest"
+	"harvey-os.org/ninep/protocol"
+)
+
+// TestMiddleware runs a script of calls against a MemFS, through
+// Trace, Stats, and Middleware of the test's own, and checks what each
+// saw.
+func TestMiddleware(t *testing.T) {
+	fs := ninetest.NewMemFS()
+	if err := fs.WriteFile("f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ninetest.PipeServer(fs)
+	if err != nil {
+		t.Fatalf("PipeServer: want nil, got %v", err)
+	}
+
+	var (
+		mu    sync.Mutex
+		lines []string
+		reqs  []Request
+		order []string
+	)
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	// outer and inner check that the first Middleware is outermost.
+	outer := func(next RoundTripper) RoundTripper {
+		return func(ctx context.Context, r *Request) (*bytes.Buffer, error) {
+			mu.Lock()
+			reqs = append(reqs, *r)
+			order = append(order, "outer")
+			mu.Unlock()
+			return next(ctx, r)
+		}
+	}
+	inner := func(next RoundTripper) RoundTripper {
+		return func(ctx context.Context, r *Request) (*bytes.Buffer, error) {
+			mu.Lock()
+			order = append(order, "inner")
+			mu.Unlock()
+			return next(ctx, r)
+		}
+	}
+	var stats Stats
+	c, err := NewConn(context.Background(), p, 8192, WithMiddleware(outer, stats.Middleware), WithMiddleware(Trace(logf), inner))
+	if err != nil {
+		t.Fatalf("NewConn: want nil, got %v", err)
+	}
+	defer c.Close()
+
+	root, err := c.Attach(context.Background(), "glenda", "")
+	if err != nil {
+		t.Fatalf("Attach: want nil, got %v", err)
+	}
+	f, err := root.Walk("f")
+	if err != nil {
+		t.Fatalf("Walk: want nil, got %v", err)
+	}
+	if err := f.Open(protocol.ORDWR); err != nil {
+		t.Fatalf("Open: want nil, got %v", err)
+	}
+	b := make([]byte, 4)
+	if _, err := f.ReadAt(b, 1); err != nil {
+		t.Fatalf("ReadAt: want nil, got %v", err)
+	}
+	if _, err := f.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatalf("WriteAt: want nil, got %v", err)
+	}
+	if _, err := f.Stat(); err != nil {
+		t.Fatalf("Stat: want nil, got %v", err)
+	}
+	if _, err := root.Walk("nope"); err == nil {
+		t.Fatalf("Walk nope: want an error, got nil")
+	}
+	if err := f.Clunk(); err != nil {
+		t.Fatalf("Clunk: want nil, got %v", err)
+	}
+
+	want := []protocol.MType{protocol.Tattach, protocol.Twalk, protocol.Topen, protocol.Tread, protocol.Twrite, protocol.Tstat, protocol.Twalk, protocol.Tclunk}
+	if len(reqs) != len(want) {
+		t.Fatalf("requests: want %d, got %d: %v", len(want), len(reqs), reqs)
+	}
+	var size uint64
+	for i, r := range reqs {
+		if r.Type != want[i] {
+			t.Errorf("request %d: want %v, got %v", i, protocol.RPCNames[want[i]], protocol.RPCNames[r.Type])
+		}
+		size += uint64(r.Size)
+	}
+	rootFID, fFID := reqs[0].FID, reqs[2].FID
+	if r := reqs[1]; r.FID != rootFID || r.Op != "walk f" {
+		t.Errorf("Twalk: want fid %d, op %q, got %+v", rootFID, "walk f", r)
+	}
+	if r := reqs[3]; r.FID != fFID || r.Offset != 1 || r.Count != 4 {
+		t.Errorf("Tread: want fid %d, offset 1, count 4, got %+v", fFID, r)
+	}
+	if r := reqs[4]; r.FID != fFID || r.Offset != 0 || r.Count != 1 {
+		t.Errorf("Twrite: want fid %d, offset 0, count 1, got %+v", fFID, r)
+	}
+	if got := strings.Join(order[:4], " "); got != "outer inner outer inner" {
+		t.Errorf("order: want outer before inner, got %v", order)
+	}
+
+	s := stats.Snapshot()
+	for typ, n := range map[protocol.MType]uint64{
+		protocol.Tattach: 1, protocol.Twalk: 2, protocol.Topen: 1, protocol.Tread: 1,
+		protocol.Twrite: 1, protocol.Tstat: 1, protocol.Tclunk: 1,
+	} {
+		rm := s.Requests[typ]
+		if rm.Count != n {
+			t.Errorf("Stats for %v: want %d, got %d", protocol.RPCNames[typ], n, rm.Count)
+		}
+		var hist uint64
+		for _, c := range rm.Latency {
+			hist += c
+		}
+		if hist != n || rm.Total <= 0 {
+			t.Errorf("Stats for %v: want %d timed, got %d, total %v", protocol.RPCNames[typ], n, hist, rm.Total)
+		}
+	}
+	if len(s.Requests) != 7 {
+		t.Errorf("Stats: want 7 types of request, got %d", len(s.Requests))
+	}
+	if n := s.Errors(); n != 1 || s.Requests[protocol.Twalk].Errors != 1 {
+		t.Errorf("Stats: want 1 error, for a Twalk, got %d", n)
+	}
+	// What came back: an Rattach, Rwalk and Ropen of 20, 22 and 24
+	// bytes, an Rread of 4 bytes of data, 15, an Rwrite of 11 and
+	// Rclunk of 7, and an Rstat, which is more; the Rerror isn't
+	// counted.
+	if s.BytesOut != size || s.BytesIn <= 99 {
+		t.Errorf("Stats: want %d bytes out, and more than 99 in, got %d and %d", size, s.BytesOut, s.BytesIn)
+	}
+
+	if len(lines) != len(want) {
+		t.Fatalf("Trace: want %d lines, got %d: %q", len(want), len(lines), lines)
+	}
+	if l := fmt.Sprintf("Tread fid %d offset 1 count 4: took", fFID); !strings.HasPrefix(lines[3], l) || !strings.HasSuffix(lines[3], "error <nil>") {
+		t.Errorf("Trace of the Tread: want %q..., got %q", l, lines[3])
+	}
+	if !strings.Contains(lines[6], "not exist") && !strings.Contains(lines[6], "not found") {
+		t.Errorf("Trace of the failed Twalk: want its error, got %q", lines[6])
+	}
+}
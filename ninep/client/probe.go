@@ -0,0 +1,67 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// A ProbeResult is what Probe learns of a server.
+type ProbeResult struct {
+	// Version is the version the server settled on: the one offered,
+	// another it would rather speak, or "unknown" if it speaks
+	// nothing like it.
+	Version string
+	// Msize is the msize the server settled on, which is no more
+	// than DefaultMsize.
+	Msize uint32
+	// RTT is how long the server took to answer the Tversion.
+	RTT time.Duration
+}
+
+// Probe checks that the 9P server at the dial string addr, as Connect
+// takes, is up, and learns what it speaks, without attaching: it
+// connects, sends a Tversion offering version, e.g. protocol.Version,
+// and DefaultMsize, and hangs up once it has the Rversion. It is cheap
+// enough to do every few seconds, e.g. as a load balancer's health
+// check. ctx bounds it all, the dial included, so a deadline on ctx is
+// the probe's timeout. If what answers isn't 9P, the error is a
+// *TransportError which errors.Is matches with ErrNotNineP; something
+// which doesn't answer at all, e.g. a web server waiting for the rest
+// of its request, is caught by that deadline.
+func Probe(ctx context.Context, addr, version string) (*ProbeResult, error) {
+	rwc, err := Connect(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+	return probe(ctx, rwc, version)
+}
+
+// probe does Probe's Tversion on rwc, which it closes if ctx is done
+// first.
+func probe(ctx context.Context, rwc io.ReadWriteCloser, version string) (*ProbeResult, error) {
+	c := &Conn{rwc: rwc, msize: DefaultMsize}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rwc.Close()
+		case <-done:
+		}
+	}()
+	start := time.Now()
+	v, err := c.tversion(version)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return &ProbeResult{Version: v, Msize: c.msize, RTT: time.Since(start)}, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"harvey-os.org/ninep/ninetest"
+	"harvey-os.org/ninep/protocol"
+	"harvey-os.org/ninep/ufs"
+)
+
+// listen returns the address of a ufs listening on the loopback.
+func listen(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := ufs.NewUFS(dir, 0)
+	if err != nil {
+		t.Fatalf("NewUFS: want nil, got %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.Serve(ln)
+	t.Cleanup(func() { l.Close() })
+	return ln.Addr().String()
+}
+
+func TestProbe(t *testing.T) {
+	addr := listen(t)
+	for _, tt := range []struct {
+		offer, want string
+	}{
+		{protocol.Version, protocol.Version},
+		{protocol.VersionU, protocol.VersionU},
+		{"9P2000.x", protocol.Version},
+		{"10P", "unknown"},
+	} {
+		r, err := Probe(context.Background(), addr, tt.offer)
+		if err != nil || r.Version != tt.want || r.Msize != DefaultMsize || r.RTT <= 0 {
+			t.Errorf("Probe offering %q: want version %q and msize %d, got (%+v, %v)", tt.offer, tt.want, DefaultMsize, r, err)
+		}
+	}
+}
+
+// TestProbeVersionOnly checks that a probe sends a Tversion and
+// nothing else.
+func TestProbeVersionOnly(t *testing.T) {
+	var rec ninetest.Recorder
+	p, err := ninetest.PipeServer(ninetest.NewMemFS(), protocol.WithMiddleware(rec.Middleware))
+	if err != nil {
+		t.Fatalf("PipeServer: want nil, got %v", err)
+	}
+	defer p.Close()
+	if r, err := probe(context.Background(), p, protocol.Version); err != nil || r.Version != protocol.Version {
+		t.Fatalf("probe: want version %q, got (%+v, %v)", protocol.Version, r, err)
+	}
+	rec.Expect(t, protocol.Tversion)
+}
+
+func TestProbeErrors(t *testing.T) {
+	// Something which isn't 9P, and says so first.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("SSH-2.0-OpenSSH_8.4\r\n"))
+			c.Close()
+		}
+	}()
+	_, err = Probe(context.Background(), ln.Addr().String(), protocol.Version)
+	var te *TransportError
+	if !errors.Is(err, ErrNotNineP) || !errors.As(err, &te) {
+		t.Errorf("Probe of an ssh server: want a TransportError with %v, got %v", ErrNotNineP, err)
+	}
+
+	// Nothing at all.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := closed.Addr().String()
+	closed.Close()
+	if _, err := Probe(context.Background(), addr, protocol.Version); err == nil || errors.Is(err, ErrNotNineP) {
+		t.Errorf("Probe of nothing: want an error other than %v, got %v", ErrNotNineP, err)
+	}
+
+	// A server which never answers.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Probe(ctx, silent.Addr().String(), protocol.Version); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Probe of a server which never answers: want %v, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// An Op is a kind of operation on a file, for a RetryPolicy to say
+// which may be tried again. Ops are bits, to be or-ed together.
+type Op uint
+
+const (
+	OpWalk Op = 1 << iota
+	OpStat
+	OpRead
+	OpOpen
+	OpCreate
+	OpWrite
+	OpWstat
+	OpRemove
+)
+
+// Idempotent is the Ops which come to the same thing done twice as
+// done once: walks, stats, and reads at an offset. A RetryPolicy tries
+// these again, and the rest only if its Safe says to.
+const Idempotent = OpWalk | OpStat | OpRead
+
+// A RetryPolicy says when an operation which failed is tried again,
+// and how often. Nothing is tried again unless asked to: a Fid's
+// WithRetry, or a Session's WithRetry option, asks.
+//
+// On a Fid, a TransportError is never tried again, as its Conn is done
+// with; the errors worth trying again there are those a server gives
+// when it is too busy, such as protocol.ErrTimedOut. A Session tries
+// again on a new connection, with the Fids walked to and opened again.
+type RetryPolicy struct {
+	// Attempts is the most times an operation is done, the first
+	// included. Less than 2 is once: no retrying.
+	Attempts int
+	// Backoff is how long to wait before the second try; each wait
+	// after that is twice the last, up to MaxBackoff, if it is set.
+	// A Session waits for a new connection as WithBackoff says,
+	// instead.
+	Backoff, MaxBackoff time.Duration
+	// Retryable reports whether an operation which failed with err
+	// is worth doing again. If nil, it is IsTransient.
+	Retryable func(err error) bool
+	// Safe is the Ops, beyond the Idempotent ones, which the caller
+	// knows are safe to do again: e.g. OpWrite, for a file where
+	// writing the same bytes at the same offset twice is the same as
+	// once. Only the caller can know that. OpRemove is only done
+	// again by a Session, on a new Fid: a Fid's Remove is never
+	// done again, as a Tremove clunks its fid, whatever comes of it.
+	Safe Op
+}
+
+// IsTransient reports whether err is one which may go away by itself:
+// a failed connection, or a server which timed out.
+func IsTransient(err error) bool {
+	var te *TransportError
+	switch {
+	case errors.Is(err, ErrClosed), errors.Is(err, ErrProtocol):
+		return false
+	case errors.As(err, &te):
+		return true
+	}
+	return errors.Is(err, protocol.ErrTimedOut)
+}
+
+// allows reports whether p may try op again. p may be nil, which
+// allows nothing.
+func (p *RetryPolicy) allows(op Op) bool {
+	return p != nil && op&(Idempotent|p.Safe) != 0
+}
+
+// again reports whether, after try tries which ended with err, p
+// tries once more.
+func (p *RetryPolicy) again(try int, err error) bool {
+	if try >= p.Attempts {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsTransient(err)
+}
+
+// wait waits out the backoff after try tries, or until ctx is done.
+func (p *RetryPolicy) wait(ctx context.Context, try int) error {
+	d := p.Backoff
+	for i := 1; i < try && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WithRetry returns f with its operations tried again as p says. It is
+// the same file as f, as WithContext's is, and Fids walked to from it
+// are tried again as p says too.
+func (f *Fid) WithRetry(p RetryPolicy) *Fid {
+	return &Fid{c: f.c, fid: f.fid, ctx: f.ctx, retry: &p, s: f.s}
+}
+
+// retrying does fn, an operation of kind op, and does it again as f's
+// RetryPolicy says, until it works or the Conn has failed.
+func (f *Fid) retrying(kind Op, fn func() error) error {
+	p := f.retry
+	for try := 1; ; try++ {
+		err := fn()
+		if err == nil || !p.allows(kind) || !p.again(try, err) {
+			return err
+		}
+		select {
+		case <-f.c.done:
+			return err
+		default:
+		}
+		if p.wait(f.ctx, try) != nil {
+			return err
+		}
+	}
+}
+
+// rpc is the Conn's rpc, for an operation of kind op, done again as
+// retrying says.
+func (f *Fid) rpc(kind Op, op string, want protocol.MType, marshal func(b *bytes.Buffer, t protocol.Tag)) (*bytes.Buffer, error) {
+	var b *bytes.Buffer
+	err := f.retrying(kind, func() error {
+		var err error
+		b, err = f.c.rpc(f.ctx, op, want, marshal)
+		return err
+	})
+	return b, err
+}
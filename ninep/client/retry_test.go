@@ -0,0 +1,367 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"harvey-os.org/ninep/ninetest"
+	"harvey-os.org/ninep/protocol"
+)
+
+// TestFidRetry has a server time out every request, and checks how
+// many times each operation is sent, as the policy says.
+func TestFidRetry(t *testing.T) {
+	ops := []struct {
+		name string
+		typ  protocol.MType
+		kind Op
+		do   func(f *Fid) error
+	}{
+		{"walk", protocol.Twalk, OpWalk, func(f *Fid) error { _, err := f.Walk("a"); return err }},
+		{"stat", protocol.Tstat, OpStat, func(f *Fid) error { _, err := f.Stat(); return err }},
+		{"readat", protocol.Tread, OpRead, func(f *Fid) error { _, err := f.ReadAt(make([]byte, 5), 10); return err }},
+		{"read", protocol.Tread, OpRead, func(f *Fid) error { _, err := f.Read(make([]byte, 5)); return err }},
+		{"open", protocol.Topen, OpOpen, func(f *Fid) error { return f.Open(protocol.OREAD) }},
+		{"create", protocol.Tcreate, OpCreate, func(f *Fid) error { return f.Create("a", 0644, protocol.OWRITE) }},
+		{"write", protocol.Twrite, OpWrite, func(f *Fid) error { _, err := f.WriteAt([]byte("hello"), 0); return err }},
+		{"wstat", protocol.Twstat, OpWstat, func(f *Fid) error { return f.Rename("a") }},
+		{"remove", protocol.Tremove, OpRemove, func(f *Fid) error { return f.Remove() }},
+	}
+	const all = OpWalk | OpStat | OpRead | OpOpen | OpCreate | OpWrite | OpWstat | OpRemove
+	for _, tt := range []struct {
+		name  string
+		retry *RetryPolicy
+		// msg is what the server says to every request.
+		msg string
+		// tries says how many requests each kind of Op makes.
+		tries func(kind Op) int
+	}{
+		{"no policy", nil, "timed out", func(Op) int { return 1 }},
+		{"idempotent", &RetryPolicy{Attempts: 3, Backoff: time.Millisecond}, "timed out", func(k Op) int {
+			if k&Idempotent != 0 {
+				return 3
+			}
+			return 1
+		}},
+		{"safe", &RetryPolicy{Attempts: 3, Backoff: time.Millisecond, Safe: all}, "timed out", func(k Op) int {
+			if k == OpRemove {
+				return 1
+			}
+			return 3
+		}},
+		{"not transient", &RetryPolicy{Attempts: 3, Safe: all}, "file not found", func(Op) int { return 1 }},
+		{"classifier", &RetryPolicy{Attempts: 2, Retryable: func(err error) bool { return errors.Is(err, os.ErrNotExist) }}, "file not found", func(k Op) int {
+			if k&Idempotent != 0 {
+				return 2
+			}
+			return 1
+		}},
+	} {
+		for _, op := range ops {
+			t.Run(tt.name+"/"+op.name, func(t *testing.T) {
+				_, f, s := newFake(t, 10)
+				if tt.retry != nil {
+					f = f.WithRetry(*tt.retry)
+				}
+				errc := make(chan error, 1)
+				go func() { errc <- op.do(f) }()
+				want := tt.tries(op.kind)
+				for i := 0; i < want; i++ {
+					tag := s.expect(op.typ)
+					s.send(func(b *bytes.Buffer) { protocol.MarshalRerrorPkt(b, tag, tt.msg) })
+					if op.typ == protocol.Twalk && tt.msg == "timed out" {
+						// The newfid is clunked, in case the
+						// server made it all the same.
+						tag := s.expect(protocol.Tclunk)
+						s.send(func(b *bytes.Buffer) { protocol.MarshalRclunkPkt(b, tag) })
+					}
+				}
+				if !s.quiet() {
+					t.Errorf("%s: want %d requests, got more", op.name, want)
+				}
+				var re *RemoteError
+				if err := <-errc; !errors.As(err, &re) || re.Msg != tt.msg {
+					t.Errorf("%s: want a RemoteError %q, got %v", op.name, tt.msg, err)
+				}
+			})
+		}
+	}
+}
+
+// TestFidRetryWalk checks that each try of a walk has a newfid of its
+// own, as one which timed out may have made its newfid all the same.
+func TestFidRetryWalk(t *testing.T) {
+	for _, timedOut := range [][]bool{{true, false}, {true, true}} {
+		_, f, s := newFake(t, 10)
+		f = f.WithRetry(RetryPolicy{Attempts: 2})
+		type result struct {
+			f   *Fid
+			err error
+		}
+		r := make(chan result, 1)
+		go func() {
+			nf, err := f.Walk("a")
+			r <- result{nf, err}
+		}()
+		var newfids []protocol.FID
+		for _, to := range timedOut {
+			typ, _, b := s.read()
+			_, newfid, _, tag, err := protocol.UnmarshalTwalkPkt(b)
+			if typ != protocol.Twalk || err != nil {
+				t.Fatalf("fake server: want a Twalk, got %v, %v", protocol.RPCNames[typ], err)
+			}
+			newfids = append(newfids, newfid)
+			if !to {
+				s.send(func(b *bytes.Buffer) { protocol.MarshalRwalkPkt(b, tag, []protocol.QID{{Path: 1}}) })
+				continue
+			}
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRerrorPkt(b, tag, "timed out") })
+			// The newfid of a try which timed out is clunked, in
+			// case the server made it all the same.
+			typ, _, b = s.read()
+			fid, tag, err := protocol.UnmarshalTclunkPkt(b)
+			if typ != protocol.Tclunk || err != nil || fid != newfid {
+				t.Fatalf("fake server: want a Tclunk of %d, got %v of %d, %v", newfid, protocol.RPCNames[typ], fid, err)
+			}
+			s.send(func(b *bytes.Buffer) { protocol.MarshalRclunkPkt(b, tag) })
+		}
+		res := <-r
+		if newfids[0] == newfids[1] {
+			t.Errorf("Walk, timed out %v: want two newfids, got %v", timedOut, newfids)
+		}
+		if timedOut[1] {
+			if !errors.Is(res.err, protocol.ErrTimedOut) {
+				t.Errorf("Walk, timed out twice: want %v, got %v", protocol.ErrTimedOut, res.err)
+			}
+			continue
+		}
+		if res.err != nil {
+			t.Fatalf("Walk, timed out once: want nil, got %v", res.err)
+		}
+		if res.f.fid != newfids[1] {
+			t.Errorf("Walk, timed out once: want the second newfid, %d, got %d", newfids[1], res.f.fid)
+		}
+	}
+}
+
+// TestFidRetryGivesUp checks that a Fid tries nothing again once its
+// Conn has failed, nor once its context is done.
+func TestFidRetryGivesUp(t *testing.T) {
+	_, f, s := newFake(t, 10)
+	f = f.WithRetry(RetryPolicy{Attempts: 5, Backoff: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	r := stat(f.WithContext(ctx))
+	tag := s.expect(protocol.Tstat)
+	s.send(func(b *bytes.Buffer) { protocol.MarshalRerrorPkt(b, tag, "timed out") })
+	// Give the Rerror time to come in, and the wait to start.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if res := <-r; !errors.Is(res.err, protocol.ErrTimedOut) {
+		t.Errorf("Stat, cancelled while waiting to try again: want %v, got %v", protocol.ErrTimedOut, res.err)
+	}
+
+	r = stat(f)
+	s.expect(protocol.Tstat)
+	s.conn.Close()
+	var te *TransportError
+	if res := <-r; !errors.As(res.err, &te) {
+		t.Errorf("Stat, with the connection gone: want a TransportError, got %v", res.err)
+	}
+}
+
+// flakyDial dials as dial does, but the first time the client sends a
+// request of type typ, on any connection, the connection fails instead:
+// the request is lost, and is never done.
+func flakyDial(dial func(context.Context) (io.ReadWriteCloser, error), typ protocol.MType) func(context.Context) (io.ReadWriteCloser, error) {
+	var once sync.Once
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		rwc, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &flakyConn{ReadWriteCloser: rwc, typ: typ, once: &once}, nil
+	}
+}
+
+type flakyConn struct {
+	io.ReadWriteCloser
+	typ  protocol.MType
+	once *sync.Once
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if len(b) > 4 && protocol.MType(b[4]) == c.typ {
+		dropped := false
+		c.once.Do(func() { dropped = true })
+		if dropped {
+			c.Close()
+			return 0, errors.New("connection reset by peer")
+		}
+	}
+	return c.ReadWriteCloser.Write(b)
+}
+
+// TestSessionRetry drops the connection under each kind of operation,
+// and checks which are done again, on Fids walked to and opened again
+// on the new connection, and which give ErrUncertain.
+func TestSessionRetry(t *testing.T) {
+	const safe = OpCreate | OpWrite | OpWstat | OpRemove
+	for _, tt := range []struct {
+		name string
+		typ  protocol.MType
+		// dir has the operation done on the root, rather than on
+		// the file f, opened for reading and writing.
+		dir  bool
+		do   func(f *File) error
+		safe Op
+		// again says whether the operation is done again, on a
+		// new connection.
+		again bool
+		// check checks the directory after.
+		check func(dir string) error
+	}{
+		{name: "stat", typ: protocol.Tstat, do: func(f *File) error { _, err := f.Stat(); return err }, again: true},
+		{name: "read", typ: protocol.Tread, do: func(f *File) error {
+			b := make([]byte, 5)
+			if _, err := f.ReadAt(b, 0); err != nil {
+				return err
+			}
+			if string(b) != "hello" {
+				return errors.New("read " + string(b))
+			}
+			return nil
+		}, again: true},
+		{name: "write", typ: protocol.Twrite, do: func(f *File) error { _, err := f.WriteAt([]byte("J"), 0); return err }},
+		{name: "safe write", typ: protocol.Twrite, do: func(f *File) error { _, err := f.WriteAt([]byte("J"), 0); return err }, safe: safe, again: true,
+			check: func(dir string) error {
+				if b, err := ioutil.ReadFile(filepath.Join(dir, "f")); err != nil || string(b) != "Jello" {
+					return errors.New("f is " + string(b))
+				}
+				return nil
+			}},
+		{name: "wstat", typ: protocol.Twstat, do: func(f *File) error { return f.Rename("g") }},
+		{name: "safe wstat", typ: protocol.Twstat, do: func(f *File) error { return f.Rename("g") }, safe: safe, again: true,
+			check: func(dir string) error {
+				_, err := os.Stat(filepath.Join(dir, "g"))
+				return err
+			}},
+		{name: "remove", typ: protocol.Tremove, do: func(f *File) error { return f.Remove() }},
+		{name: "safe remove", typ: protocol.Tremove, do: func(f *File) error { return f.Remove() }, safe: safe, again: true,
+			check: func(dir string) error {
+				if _, err := os.Stat(filepath.Join(dir, "f")); !os.IsNotExist(err) {
+					return errors.New("f is still there")
+				}
+				return nil
+			}},
+		{name: "create", typ: protocol.Tcreate, dir: true, do: func(f *File) error { return f.Create("g", 0644, protocol.OWRITE) }},
+		{name: "safe create", typ: protocol.Tcreate, dir: true, do: func(f *File) error { return f.Create("g", 0644, protocol.OWRITE) }, safe: safe, again: true,
+			check: func(dir string) error {
+				_, err := os.Stat(filepath.Join(dir, "g"))
+				return err
+			}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var rec ninetest.Recorder
+			r := newRestartable(t, protocol.WithMiddleware(rec.Middleware))
+			if err := ioutil.WriteFile(filepath.Join(r.dir, "f"), []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := NewSession(context.Background(), flakyDial(r.dial, tt.typ), "", "",
+				WithBackoff(protocol.Backoff{Max: 20 * time.Millisecond}, 5*time.Second),
+				WithRetry(RetryPolicy{Attempts: 3, Safe: tt.safe}))
+			if err != nil {
+				t.Fatalf("NewSession: want nil, got %v", err)
+			}
+			defer s.Close()
+			f := s.Root()
+			if tt.dir {
+				if _, err := f.Stat(); err != nil {
+					t.Fatalf("Stat: want nil, got %v", err)
+				}
+			} else {
+				if f, err = f.Walk("f"); err != nil {
+					t.Fatalf("Walk: want nil, got %v", err)
+				}
+				if err := f.Open(protocol.ORDWR); err != nil {
+					t.Fatalf("Open: want nil, got %v", err)
+				}
+			}
+			rec.Reset()
+
+			err = tt.do(f)
+			if !tt.again {
+				if !errors.Is(err, ErrUncertain) {
+					t.Errorf("%s with the connection dropped: want %v, got %v", tt.name, ErrUncertain, err)
+				}
+				// The request was lost, and isn't sent again.
+				if n := rec.Count(tt.typ); n != 0 {
+					t.Errorf("%v: want none done, got %d", protocol.RPCNames[tt.typ], n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s with the connection dropped: want nil, got %v", tt.name, err)
+			}
+			// The new connection has its own Fids, walked to,
+			// and opened, again.
+			want := []protocol.MType{protocol.Tversion, protocol.Tattach, protocol.Twalk, protocol.Topen, tt.typ}
+			if tt.dir {
+				want = []protocol.MType{protocol.Tversion, protocol.Tattach, protocol.Twalk, tt.typ}
+			}
+			rec.Expect(t, want...)
+			if tt.check != nil {
+				if err := tt.check(r.dir); err != nil {
+					t.Errorf("after %s: %v", tt.name, err)
+				}
+			}
+		})
+	}
+}
+
+// TestSessionRetryAttempts checks that a Session gives up after the
+// policy's Attempts, and that without one, it doesn't try again.
+func TestSessionRetryAttempts(t *testing.T) {
+	r := newRestartable(t)
+	dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		rwc, err := r.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Every Tstat is lost.
+		return &flakyConn{ReadWriteCloser: rwc, typ: protocol.Tstat, once: new(sync.Once)}, nil
+	}
+	for _, attempts := range []int{1, 3} {
+		s, err := NewSession(context.Background(), dial, "", "",
+			WithBackoff(protocol.Backoff{Max: 20 * time.Millisecond}, 5*time.Second),
+			WithRetry(RetryPolicy{Attempts: attempts}))
+		if err != nil {
+			t.Fatalf("NewSession: want nil, got %v", err)
+		}
+		r.mu.Lock()
+		before := r.dials
+		r.mu.Unlock()
+		var te *TransportError
+		if _, err := s.Root().Stat(); !errors.As(err, &te) {
+			t.Errorf("Stat, %d attempts, every one dropped: want a TransportError, got %v", attempts, err)
+		}
+		r.mu.Lock()
+		n := r.dials - before
+		r.mu.Unlock()
+		if n != attempts-1 {
+			t.Errorf("Stat, %d attempts: want %d redials, got %d", attempts, attempts-1, n)
+		}
+		s.Close()
+	}
+}
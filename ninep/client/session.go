@@ -0,0 +1,633 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// ErrUncertain is what an operation which changes something on the
+// server, e.g. a write, gives if the connection fails while it is in
+// flight: it may or may not have been done, and so isn't done again.
+// The error wraps it, and the TransportError.
+var ErrUncertain = errors.New("connection failed: the operation may or may not have been done")
+
+// ErrStale is what a File gives if, on a new connection, its path
+// leads to another file than it did, e.g. because the file was
+// removed and made again in the meantime.
+var ErrStale = errors.New("file has been replaced")
+
+// A Session is a connection to a server which outlives connections:
+// when one fails, the Session dials another, with backoff, and attaches
+// again, and its Files are walked to, and opened, again, from the path
+// and mode each has. What is safe to do again, such as a read, is done
+// again on the new connection, as though the old one never failed;
+// what isn't, such as a write, gives ErrUncertain. WithRetry says how
+// often, and what else may be done again.
+//
+// Only what a Session has is put back: a file the server held open
+// with ORCLOSE, or an exclusive-use file, is as the server left it.
+type Session struct {
+	dial         func(ctx context.Context) (io.ReadWriteCloser, error)
+	uname, aname string
+
+	// backoff says how long to wait after each failed dial, and
+	// timeout how long to go on trying. See WithBackoff.
+	backoff protocol.Backoff
+	timeout time.Duration
+	// connOpts are for each new Conn. See WithConnOpts.
+	connOpts []ConnOpt
+	// retry, if set, says what is tried again, and how often, in
+	// place of timeout. See WithRetry.
+	retry *RetryPolicy
+
+	// dialing holds a token while a new connection is dialed, so
+	// that only one is, and done is closed by Close.
+	dialing chan struct{}
+	done    chan struct{}
+
+	// mu guards below.
+	mu   sync.Mutex
+	conn *Conn
+	root *Fid
+	// gen counts the connections, so that Files know when theirs
+	// has gone.
+	gen    uint64
+	closed bool
+}
+
+// A SessionOpt is an option for NewSession and DialSession.
+type SessionOpt func(*Session)
+
+// WithBackoff sets how long a Session waits to dial again after a dial
+// fails, as b says, b.Attempts and b.Notify included. After timeout,
+// the Session gives up, until the next operation. The default is a
+// Backoff with a Max of 5s, and a minute.
+func WithBackoff(b protocol.Backoff, timeout time.Duration) SessionOpt {
+	return func(s *Session) {
+		s.backoff, s.timeout = b, timeout
+	}
+}
+
+// WithConnOpts has a Session make each connection's Conn with opts,
+// e.g. WithMiddleware, to trace or count the requests of them all.
+func WithConnOpts(opts ...ConnOpt) SessionOpt {
+	return func(s *Session) {
+		s.connOpts = append(s.connOpts, opts...)
+	}
+}
+
+// WithRetry has a Session try operations again as p says: the
+// Idempotent ones, and p.Safe's, up to p.Attempts times, when they fail
+// with what p.Retryable says is worth trying again. After a failed
+// connection, they are tried again on a new one; since that is done
+// with new Fids, OpOpen is safe there too. Those which p doesn't try
+// again give ErrUncertain, if the connection fails under them, as
+// they do without WithRetry.
+func WithRetry(p RetryPolicy) SessionOpt {
+	return func(s *Session) {
+		s.retry = &p
+	}
+}
+
+// NewSession returns a Session on the connections dial makes, attached
+// as uname to aname. ctx bounds the first connection, which must work.
+func NewSession(ctx context.Context, dial func(ctx context.Context) (io.ReadWriteCloser, error), uname, aname string, opts ...SessionOpt) (*Session, error) {
+	s := &Session{
+		dial:    dial,
+		uname:   uname,
+		aname:   aname,
+		backoff: protocol.Backoff{Max: 5 * time.Second},
+		timeout: time.Minute,
+		dialing: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	c, root, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.conn, s.root = c, root
+	s.gen++
+	return s, nil
+}
+
+// DialSession is NewSession, dialing addr on network as Dial does.
+func DialSession(ctx context.Context, network, addr, uname, aname string, opts ...SessionOpt) (*Session, error) {
+	return NewSession(ctx, func(ctx context.Context) (io.ReadWriteCloser, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}, uname, aname, opts...)
+}
+
+// connect makes a new connection, and attaches on it.
+func (s *Session) connect(ctx context.Context) (*Conn, *Fid, error) {
+	rwc, err := s.dial(ctx)
+	if err != nil {
+		return nil, nil, &TransportError{"dial", err}
+	}
+	c, err := NewConn(ctx, rwc, DefaultMsize, s.connOpts...)
+	if err != nil {
+		rwc.Close()
+		return nil, nil, err
+	}
+	root, err := c.Attach(ctx, s.uname, s.aname)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, root, nil
+}
+
+// reconnect replaces connection gen, which has failed, unless that has
+// been done already, trying until it works, or s.timeout has passed,
+// or ctx is done, or the server turns the Tattach down, or s is
+// closed. s.mu isn't held while dialing, or waiting to dial again, so
+// that Close needn't wait for it.
+func (s *Session) reconnect(ctx context.Context, gen uint64) error {
+	closed := &TransportError{"redial", ErrClosed}
+	select {
+	case s.dialing <- struct{}{}:
+	case <-s.done:
+		return closed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.dialing }()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return closed
+	}
+	if s.gen != gen {
+		s.mu.Unlock()
+		return nil
+	}
+	s.conn.Close()
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(s.timeout)
+	for try := 1; ; try++ {
+		c, root, err := s.connect(ctx)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			if err == nil {
+				c.Close()
+			}
+			return closed
+		}
+		if err == nil {
+			s.conn, s.root = c, root
+			s.gen++
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+		if s.backoff.Notify != nil {
+			s.backoff.Notify(try, err)
+		}
+		var re *RemoteError
+		switch {
+		case errors.As(err, &re), ctx.Err() != nil:
+			return err
+		case !time.Now().Before(deadline), s.backoff.Attempts > 0 && try >= s.backoff.Attempts:
+			return fmt.Errorf("redial: giving up after %d tries: %w", try, err)
+		}
+		wait := s.backoff.Delay(try)
+		if left := time.Until(deadline); wait > left {
+			wait = left
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-s.done:
+			t.Stop()
+			return closed
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// current returns the connection's root Fid, and its generation.
+func (s *Session) current() (*Fid, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, 0, &TransportError{"session", ErrClosed}
+	}
+	return s.root, s.gen, nil
+}
+
+// Close closes the Session's connection, and the Session with it.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	return s.conn.Close()
+}
+
+// Root returns a File for the root of the tree. Like any File, it is
+// only walked to, on the server, when first used.
+func (s *Session) Root() *File {
+	return &File{s: s, ctx: context.Background(), st: &fileState{}}
+}
+
+// A File is a file on a Session's server, as its path from the root
+// names it. It is a Fid which is walked to, and opened, again on each
+// new connection. Its methods are Fid's; the Fid's doc comments apply.
+type File struct {
+	s *Session
+	// ctx bounds each operation on the File, redials included.
+	ctx context.Context
+	// st is shared by the Files WithContext makes of this one.
+	st *fileState
+}
+
+type fileState struct {
+	// mu guards below.
+	mu sync.Mutex
+	// names is the path from the root.
+	names []string
+	// mode is what the File was opened with, if open is set.
+	mode protocol.Mode
+	open bool
+	// qid is the file's, once the File has been walked to.
+	qid    protocol.QID
+	walked bool
+	offset int64
+	// fid is the File's Fid on connection gen.
+	fid *Fid
+	gen uint64
+	// clunked is set once the File is done with.
+	clunked bool
+}
+
+// WithContext returns f with its operations bound by ctx, as a Fid's
+// WithContext does.
+func (f *File) WithContext(ctx context.Context) *File {
+	return &File{s: f.s, ctx: ctx, st: f.st}
+}
+
+// fid returns f's Fid on the current connection, walking to, and
+// opening, the file again if the connection is new.
+func (f *File) fid() (*Fid, uint64, error) {
+	root, gen, err := f.s.current()
+	if err != nil {
+		return nil, 0, err
+	}
+	st := f.st
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.clunked {
+		return nil, 0, errors.New("file already clunked")
+	}
+	if st.fid != nil && st.gen == gen {
+		return st.fid, gen, nil
+	}
+	fid, err := root.WithContext(f.ctx).Walk(strings.Join(st.names, "/"))
+	if err != nil {
+		return nil, gen, err
+	}
+	q := fid.QID()
+	if st.walked && (q.Path != st.qid.Path || q.Type != st.qid.Type) {
+		fid.Clunk()
+		return nil, gen, fmt.Errorf("/%s: %w", strings.Join(st.names, "/"), ErrStale)
+	}
+	if st.open {
+		// Truncating again would undo what has been written since.
+		if err := fid.Open(st.mode &^ protocol.OTRUNC); err != nil {
+			fid.Clunk()
+			return nil, gen, err
+		}
+	}
+	st.fid, st.gen = fid.WithContext(context.Background()), gen
+	st.qid, st.walked = q, true
+	return st.fid, gen, nil
+}
+
+// do does fn, an operation of kind op, on f's Fid. If the connection
+// fails, do dials another, and, if op is safe to do again, does it
+// again; if it isn't, and may have been sent, do returns ErrUncertain.
+// With a RetryPolicy, do also does again what fails otherwise, as the
+// policy says.
+func (f *File) do(op Op, fn func(fid *Fid) error) error {
+	p := f.s.retry
+	// On a new connection, op is done on a new Fid: opening it again
+	// is as safe as walking to it again.
+	again := op&(Idempotent|OpOpen) != 0 || p.allows(op)
+	start := time.Now()
+	for try := 1; ; try++ {
+		fid, gen, err := f.fid()
+		if err == nil {
+			if !again {
+				// If the connection is known to have failed,
+				// op hasn't been sent on it.
+				select {
+				case <-fid.c.done:
+					err = fid.c.transportError("session")
+				default:
+					err = fn(fid.WithContext(f.ctx))
+					var te *TransportError
+					if errors.As(err, &te) {
+						return fmt.Errorf("%w: %v", ErrUncertain, err)
+					}
+					return err
+				}
+			} else {
+				err = fn(fid.WithContext(f.ctx))
+			}
+		}
+		var te *TransportError
+		transport := errors.As(err, &te)
+		switch {
+		case err == nil, errors.Is(err, ErrClosed):
+			return err
+		case p == nil:
+			if !transport || time.Since(start) > f.s.timeout {
+				return err
+			}
+		case !transport && !p.allows(op), !p.again(try, err):
+			return err
+		}
+		if !transport {
+			if p.wait(f.ctx, try) != nil {
+				return err
+			}
+		} else if err := f.s.reconnect(f.ctx, gen); err != nil {
+			return err
+		}
+	}
+}
+
+// Name returns f's path from the root.
+func (f *File) Name() string {
+	f.st.mu.Lock()
+	defer f.st.mu.Unlock()
+	return "/" + strings.Join(f.st.names, "/")
+}
+
+// QID returns the file's QID, as the server last gave it.
+func (f *File) QID() protocol.QID {
+	f.st.mu.Lock()
+	defer f.st.mu.Unlock()
+	return f.st.qid
+}
+
+// Walk returns a File for the file at p, from f.
+func (f *File) Walk(p string) (*File, error) {
+	names := append([]string{}, f.st.names...)
+	for _, n := range strings.Split(p, "/") {
+		if n != "" {
+			names = append(names, n)
+		}
+	}
+	nf := &File{s: f.s, ctx: f.ctx, st: &fileState{names: names}}
+	if err := nf.do(OpWalk, func(*Fid) error { return nil }); err != nil {
+		return nil, err
+	}
+	return nf, nil
+}
+
+// Open opens the file with mode. It is opened with it again on each
+// new connection, but for OTRUNC.
+func (f *File) Open(mode protocol.Mode) error {
+	return f.do(OpOpen, func(fid *Fid) error {
+		if err := fid.Open(mode); err != nil {
+			return err
+		}
+		f.opened(fid, mode)
+		return nil
+	})
+}
+
+// Create creates name in the directory f, and opens it with mode, as a
+// Fid's Create does. f is the new file from then on.
+func (f *File) Create(name string, perm protocol.Perm, mode protocol.Mode) error {
+	return f.do(OpCreate, func(fid *Fid) error {
+		if err := fid.Create(name, perm, mode); err != nil {
+			return err
+		}
+		f.st.mu.Lock()
+		f.st.names = append(f.st.names, name)
+		f.st.mu.Unlock()
+		f.opened(fid, mode)
+		return nil
+	})
+}
+
+func (f *File) opened(fid *Fid, mode protocol.Mode) {
+	f.st.mu.Lock()
+	defer f.st.mu.Unlock()
+	f.st.mode, f.st.open, f.st.offset = mode, true, 0
+	f.st.qid = fid.QID()
+}
+
+// ReadAt reads len(b) bytes at off, as a Fid's ReadAt does.
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	var n int
+	err := f.do(OpRead, func(fid *Fid) error {
+		m, err := fid.ReadAt(b[n:], off+int64(n))
+		n += m
+		return err
+	})
+	return n, err
+}
+
+// Read reads from where the last Read or Write left off.
+func (f *File) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var n int
+	err := f.do(OpRead, func(fid *Fid) error {
+		var err error
+		n, err = fid.read(b, f.offset())
+		return err
+	})
+	f.advance(n)
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WriteAt writes b at off, as a Fid's WriteAt does. If the connection
+// fails on the way, the error is ErrUncertain, and n is what is known
+// to have been written.
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	var n int
+	err := f.do(OpWrite, func(fid *Fid) error {
+		var err error
+		n, err = fid.WriteAt(b, off)
+		return err
+	})
+	return n, err
+}
+
+// Write writes b where the last Read or Write left off.
+func (f *File) Write(b []byte) (int, error) {
+	n, err := f.WriteAt(b, f.offset())
+	f.advance(n)
+	return n, err
+}
+
+func (f *File) offset() int64 {
+	f.st.mu.Lock()
+	defer f.st.mu.Unlock()
+	return f.st.offset
+}
+
+func (f *File) advance(n int) {
+	f.st.mu.Lock()
+	defer f.st.mu.Unlock()
+	f.st.offset += int64(n)
+}
+
+// Seek sets where the next Read or Write starts, as io.Seeker does.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = f.offset()
+	case io.SeekEnd:
+		d, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		base = int64(d.Length)
+	default:
+		return 0, fmt.Errorf("seek: bad whence %d", whence)
+	}
+	if base+offset < 0 {
+		return 0, errors.New("seek: negative offset")
+	}
+	f.st.mu.Lock()
+	defer f.st.mu.Unlock()
+	f.st.offset = base + offset
+	return f.st.offset, nil
+}
+
+// ReadDir reads the directory f, which must be open, from the start.
+func (f *File) ReadDir() ([]protocol.Dir, error) {
+	var ds []protocol.Dir
+	err := f.do(OpRead, func(fid *Fid) error {
+		var err error
+		ds, err = fid.ReadDir()
+		return err
+	})
+	return ds, err
+}
+
+// Stat returns what the server says of the file.
+func (f *File) Stat() (protocol.Dir, error) {
+	var d protocol.Dir
+	err := f.do(OpStat, func(fid *Fid) error {
+		var err error
+		d, err = fid.Stat()
+		return err
+	})
+	return d, err
+}
+
+// Wstat changes the file as d says. If d renames it, f's path follows.
+func (f *File) Wstat(d protocol.Dir) error {
+	return f.do(OpWstat, func(fid *Fid) error {
+		if err := fid.Wstat(d); err != nil {
+			return err
+		}
+		if d.Name != "" {
+			f.st.mu.Lock()
+			if n := len(f.st.names); n > 0 {
+				f.st.names[n-1] = path.Base(d.Name)
+			}
+			f.st.mu.Unlock()
+		}
+		return nil
+	})
+}
+
+// Chmod changes the file's permissions, as Fid's Chmod does.
+func (f *File) Chmod(perm protocol.Perm) error {
+	d, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return f.Wstat(chmodDir(d, perm))
+}
+
+// Rename renames the file to name, in the same directory, and f's path
+// follows.
+func (f *File) Rename(name string) error {
+	w, err := renameDir(name)
+	if err != nil {
+		return err
+	}
+	return f.Wstat(w)
+}
+
+// Chtimes changes the file's access and modification times, as Fid's
+// Chtimes does.
+func (f *File) Chtimes(atime, mtime time.Time) error {
+	return f.Wstat(chtimesDir(atime, mtime))
+}
+
+// Remove removes the file, and is done with f.
+func (f *File) Remove() error {
+	err := f.do(OpRemove, func(fid *Fid) error { return fid.Remove() })
+	f.forget()
+	return err
+}
+
+// Clunk is done with f. If f's connection has failed, there is
+// nothing to tell the server.
+func (f *File) Clunk() error {
+	st := f.st
+	st.mu.Lock()
+	fid, gen := st.fid, st.gen
+	st.mu.Unlock()
+	f.forget()
+	if fid == nil {
+		return nil
+	}
+	if _, cur, err := f.s.current(); err != nil || cur != gen {
+		return nil
+	}
+	err := fid.WithContext(f.ctx).Clunk()
+	var te *TransportError
+	if errors.As(err, &te) {
+		return nil
+	}
+	return err
+}
+
+// Close is Clunk, for io.Closer.
+func (f *File) Close() error {
+	return f.Clunk()
+}
+
+func (f *File) forget() {
+	f.st.mu.Lock()
+	defer f.st.mu.Unlock()
+	f.st.fid, f.st.clunked = nil, true
+}
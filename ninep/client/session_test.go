@@ -0,0 +1,291 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+	"harvey-os.org/ninep/ufs"
+)
+
+// restartable is a ufs server which can be killed, dropping its
+// connections, and started again, on the same directory.
+type restartable struct {
+	t    *testing.T
+	dir  string
+	opts []protocol.NetListenerOpt
+
+	// mu guards below.
+	mu    sync.Mutex
+	l     *protocol.NetListener
+	conns []net.Conn
+	dials int
+}
+
+func newRestartable(t *testing.T, opts ...protocol.NetListenerOpt) *restartable {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	r := &restartable{t: t, dir: dir, opts: opts}
+	r.start()
+	t.Cleanup(r.kill)
+	return r
+}
+
+func (r *restartable) start() {
+	l, err := ufs.NewUFS(r.dir, 0, r.opts...)
+	if err != nil {
+		r.t.Errorf("NewUFS: want nil, got %v", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.l = l
+}
+
+func (r *restartable) kill() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.conns {
+		c.Close()
+	}
+	r.l, r.conns = nil, nil
+}
+
+func (r *restartable) dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dials++
+	if r.l == nil {
+		return nil, errors.New("connection refused")
+	}
+	p, p2 := net.Pipe()
+	if err := r.l.Accept(p2); err != nil {
+		return nil, err
+	}
+	r.conns = append(r.conns, p, p2)
+	return p, nil
+}
+
+func (r *restartable) session(t *testing.T) *Session {
+	t.Helper()
+	s, err := NewSession(context.Background(), r.dial, "", "", WithBackoff(protocol.Backoff{Max: 20 * time.Millisecond}, 5*time.Second))
+	if err != nil {
+		t.Fatalf("NewSession: want nil, got %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// restart kills r, and starts it again after a while, as a server
+// which crashes and is restarted would be.
+func (r *restartable) restart() {
+	r.kill()
+	time.AfterFunc(50*time.Millisecond, r.start)
+}
+
+func TestSessionReconnect(t *testing.T) {
+	r := newRestartable(t)
+	want := bytes.Repeat([]byte("0123456789"), 100)
+	if err := ioutil.WriteFile(filepath.Join(r.dir, "f"), want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(r.dir, n), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := r.session(t)
+	root := s.Root()
+	f, err := root.Walk("f")
+	if err != nil {
+		t.Fatalf("Walk: want nil, got %v", err)
+	}
+	defer f.Close()
+	if err := f.Open(protocol.OREAD); err != nil {
+		t.Fatalf("Open: want nil, got %v", err)
+	}
+	got := make([]byte, len(want))
+	if n, err := io.ReadFull(f, got[:300]); n != 300 || err != nil {
+		t.Fatalf("Read: want (300, nil), got (%d, %v)", n, err)
+	}
+
+	r.restart()
+	if n, err := io.ReadFull(f, got[300:]); n != len(want)-300 || err != nil {
+		t.Fatalf("Read after restart: want (%d, nil), got (%d, %v)", len(want)-300, n, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Read across restart: got %q, want %q", got, want)
+	}
+	r.mu.Lock()
+	dials := r.dials
+	r.mu.Unlock()
+	if dials < 3 {
+		t.Errorf("dials: want at least 3, one refused, got %d", dials)
+	}
+
+	r.restart()
+	if err := root.Open(protocol.OREAD); err != nil {
+		t.Fatalf("Open(/): want nil, got %v", err)
+	}
+	r.restart()
+	ds, err := root.ReadDir()
+	if err != nil {
+		t.Fatalf("ReadDir after restart: want nil, got %v", err)
+	}
+	var names []string
+	for _, d := range ds {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	if got, want := strings.Join(names, " "), "a b c f"; got != want {
+		t.Errorf("ReadDir after restart: want %q, got %q", want, got)
+	}
+
+	// A file removed while the server was down is gone, and one made
+	// again is another file.
+	b, err := root.Walk("b")
+	if err != nil {
+		t.Fatalf("Walk(b): want nil, got %v", err)
+	}
+	defer b.Close()
+	r.restart()
+	if err := os.Remove(filepath.Join(r.dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(r.dir, "c"), filepath.Join(r.dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := root.Walk("a"); !errors.Is(err, protocol.ErrNotExist) {
+		if err == nil {
+			a.Close()
+		}
+		t.Errorf("Walk(a) after remove: want %v, got %v", protocol.ErrNotExist, err)
+	}
+	if _, err := b.Stat(); !errors.Is(err, ErrStale) {
+		t.Errorf("Stat(b) after replacing it: want %v, got %v", ErrStale, err)
+	}
+}
+
+// TestSessionRename checks that a File renamed by Rename is walked to
+// by its new name once the server restarts.
+func TestSessionRename(t *testing.T) {
+	r := newRestartable(t)
+	if err := ioutil.WriteFile(filepath.Join(r.dir, "f"), []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := r.session(t)
+	f, err := s.Root().Walk("f")
+	if err != nil {
+		t.Fatalf("Walk: want nil, got %v", err)
+	}
+	defer f.Close()
+	if err := f.Rename("g"); err != nil {
+		t.Fatalf("Rename: want nil, got %v", err)
+	}
+	r.restart()
+	if err := f.Chmod(0600); err != nil {
+		t.Fatalf("Chmod after restart: want nil, got %v", err)
+	}
+	if d, err := f.Stat(); err != nil || d.Name != "g" || d.Mode != 0600 {
+		t.Errorf("Stat after restart: want g, mode 0600, got (%v, %v)", d, err)
+	}
+	if f.Name() != "/g" {
+		t.Errorf("Name: want /g, got %q", f.Name())
+	}
+}
+
+func TestSessionUncertain(t *testing.T) {
+	var r *restartable
+	var drop sync.Once
+	r = newRestartable(t, protocol.WithMiddleware(func(next protocol.Dispatcher) protocol.Dispatcher {
+		return func(ctx context.Context, s *protocol.Server, b *bytes.Buffer, m protocol.MType) error {
+			if m == protocol.Twrite {
+				dropped := false
+				drop.Do(func() { dropped = true })
+				if dropped {
+					// The write is done, but the reply
+					// is lost.
+					err := next(ctx, s, b, m)
+					r.restart()
+					return err
+				}
+			}
+			return next(ctx, s, b, m)
+		}
+	}))
+	s := r.session(t)
+	f := s.Root()
+	if err := f.Create("f", 0644, protocol.ORDWR); err != nil {
+		t.Fatalf("Create: want nil, got %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("hello")); !errors.Is(err, ErrUncertain) {
+		t.Fatalf("Write with the connection dropped: want %v, got %v", ErrUncertain, err)
+	}
+	// Whether it was or not, reads go on, on the new connection.
+	b := make([]byte, 10)
+	if n, err := f.ReadAt(b, 0); string(b[:n]) != "hello" || err != io.EOF {
+		t.Errorf("ReadAt: want (hello, EOF), got (%q, %v)", b[:n], err)
+	}
+	if n, err := f.WriteAt([]byte("J"), 0); n != 1 || err != nil {
+		t.Errorf("WriteAt: want (1, nil), got (%d, %v)", n, err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(r.dir, "f")); string(b) != "Jello" || err != nil {
+		t.Errorf("file: want (Jello, nil), got (%q, %v)", b, err)
+	}
+}
+
+// TestSessionCloseWhileRedialing checks that Close doesn't wait for a
+// Session trying to reach a server which is down, and that the
+// operation waiting on it gives ErrClosed.
+func TestSessionCloseWhileRedialing(t *testing.T) {
+	r := newRestartable(t)
+	s := r.session(t)
+	f := s.Root()
+	defer f.Close()
+	if _, err := f.Stat(); err != nil {
+		t.Fatalf("Stat: want nil, got %v", err)
+	}
+	r.kill()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := f.Stat()
+		errc <- err
+	}()
+	// Let it fail a few dials.
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close: still waiting after a second")
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Stat with the Session closed: want %v, got %v", ErrClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Stat: still redialing a second after Close")
+	}
+}
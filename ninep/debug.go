@@ -6,6 +6,8 @@ package ninep
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"log"
 
 	"harvey-os.org/ninep/protocol"
@@ -15,9 +17,14 @@ type DebugFileServer struct {
 	FileServer protocol.NineServer
 }
 
-func (dfs *DebugFileServer) Rversion(msize protocol.MaxSize, version string) (protocol.MaxSize, string, error) {
+func (dfs *DebugFileServer) Rversion(ctx context.Context, msize protocol.MaxSize, version string) (protocol.MaxSize, string, error) {
 	log.Printf(">>> Tversion %v %v\n", msize, version)
-	msize, version, err := dfs.FileServer.Rversion(msize, version)
+	// We look like a UNineServer whether or not we wrap one, so the
+	// protocol can't negotiate down for us.
+	if _, ok := dfs.FileServer.(protocol.UNineServer); !ok && version == protocol.VersionU {
+		version = protocol.Version
+	}
+	msize, version, err := dfs.FileServer.Rversion(ctx, msize, version)
 	if err == nil {
 		log.Printf("<<< Rversion %v %v\n", msize, version)
 	} else {
@@ -26,10 +33,10 @@ func (dfs *DebugFileServer) Rversion(msize protocol.MaxSize, version string) (pr
 	return msize, version, err
 }
 
-func (dfs *DebugFileServer) Rattach(fid protocol.FID, afid protocol.FID, uname string, aname string) (protocol.QID, error) {
+func (dfs *DebugFileServer) Rattach(ctx context.Context, fid protocol.FID, afid protocol.FID, uname string, aname string) (protocol.QID, error) {
 	log.Printf(">>> Tattach fid %v,  afid %v, uname %v, aname %v\n", fid, afid,
 		uname, aname)
-	qid, err := dfs.FileServer.Rattach(fid, afid, uname, aname)
+	qid, err := dfs.FileServer.Rattach(ctx, fid, afid, uname, aname)
 	if err == nil {
 		log.Printf("<<< Rattach %v\n", qid)
 	} else {
@@ -38,9 +45,9 @@ func (dfs *DebugFileServer) Rattach(fid protocol.FID, afid protocol.FID, uname s
 	return qid, err
 }
 
-func (dfs *DebugFileServer) Rflush(o protocol.Tag) error {
+func (dfs *DebugFileServer) Rflush(ctx context.Context, o protocol.Tag) error {
 	log.Printf(">>> Tflush tag %v\n", o)
-	err := dfs.FileServer.Rflush(o)
+	err := dfs.FileServer.Rflush(ctx, o)
 	if err == nil {
 		log.Printf("<<< Rflush\n")
 	} else {
@@ -49,9 +56,9 @@ func (dfs *DebugFileServer) Rflush(o protocol.Tag) error {
 	return err
 }
 
-func (dfs *DebugFileServer) Rwalk(fid protocol.FID, newfid protocol.FID, paths []string) ([]protocol.QID, error) {
+func (dfs *DebugFileServer) Rwalk(ctx context.Context, fid protocol.FID, newfid protocol.FID, paths []string) ([]protocol.QID, error) {
 	log.Printf(">>> Twalk fid %v, newfid %v, paths %v\n", fid, newfid, paths)
-	qid, err := dfs.FileServer.Rwalk(fid, newfid, paths)
+	qid, err := dfs.FileServer.Rwalk(ctx, fid, newfid, paths)
 	if err == nil {
 		log.Printf("<<< Rwalk %v\n", qid)
 	} else {
@@ -60,9 +67,9 @@ func (dfs *DebugFileServer) Rwalk(fid protocol.FID, newfid protocol.FID, paths [
 	return qid, err
 }
 
-func (dfs *DebugFileServer) Ropen(fid protocol.FID, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+func (dfs *DebugFileServer) Ropen(ctx context.Context, fid protocol.FID, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
 	log.Printf(">>> Topen fid %v, mode %v\n", fid, mode)
-	qid, iounit, err := dfs.FileServer.Ropen(fid, mode)
+	qid, iounit, err := dfs.FileServer.Ropen(ctx, fid, mode)
 	if err == nil {
 		log.Printf("<<< Ropen %v %v\n", qid, iounit)
 	} else {
@@ -71,10 +78,34 @@ func (dfs *DebugFileServer) Ropen(fid protocol.FID, mode protocol.Mode) (protoco
 	return qid, iounit, err
 }
 
-func (dfs *DebugFileServer) Rcreate(fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+func (dfs *DebugFileServer) Rcreate(ctx context.Context, fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
 	log.Printf(">>> Tcreate fid %v, name %v, perm %v, mode %v\n", fid, name,
 		perm, mode)
-	qid, iounit, err := dfs.FileServer.Rcreate(fid, name, perm, mode)
+	qid, iounit, err := dfs.FileServer.Rcreate(ctx, fid, name, perm, mode)
+	if err == nil {
+		log.Printf("<<< Rcreate %v %v\n", qid, iounit)
+	} else {
+		log.Printf("<<< Error %v\n", err)
+	}
+	return qid, iounit, err
+}
+
+func (dfs *DebugFileServer) RattachU(ctx context.Context, fid protocol.FID, afid protocol.FID, uname string, aname string, nuname uint32) (protocol.QID, error) {
+	log.Printf(">>> Tattach fid %v,  afid %v, uname %v, aname %v, nuname %v\n", fid, afid,
+		uname, aname, nuname)
+	qid, err := dfs.FileServer.(protocol.UNineServer).RattachU(ctx, fid, afid, uname, aname, nuname)
+	if err == nil {
+		log.Printf("<<< Rattach %v\n", qid)
+	} else {
+		log.Printf("<<< Error %v\n", err)
+	}
+	return qid, err
+}
+
+func (dfs *DebugFileServer) RcreateU(ctx context.Context, fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode, extension string) (protocol.QID, protocol.MaxSize, error) {
+	log.Printf(">>> Tcreate fid %v, name %v, perm %v, mode %v, extension %q\n", fid, name,
+		perm, mode, extension)
+	qid, iounit, err := dfs.FileServer.(protocol.UNineServer).RcreateU(ctx, fid, name, perm, mode, extension)
 	if err == nil {
 		log.Printf("<<< Rcreate %v %v\n", qid, iounit)
 	} else {
@@ -83,9 +114,9 @@ func (dfs *DebugFileServer) Rcreate(fid protocol.FID, name string, perm protocol
 	return qid, iounit, err
 }
 
-func (dfs *DebugFileServer) Rclunk(fid protocol.FID) error {
+func (dfs *DebugFileServer) Rclunk(ctx context.Context, fid protocol.FID) error {
 	log.Printf(">>> Tclunk fid %v\n", fid)
-	err := dfs.FileServer.Rclunk(fid)
+	err := dfs.FileServer.Rclunk(ctx, fid)
 	if err == nil {
 		log.Printf("<<< Rclunk\n")
 	} else {
@@ -94,9 +125,9 @@ func (dfs *DebugFileServer) Rclunk(fid protocol.FID) error {
 	return err
 }
 
-func (dfs *DebugFileServer) Rstat(fid protocol.FID) ([]byte, error) {
+func (dfs *DebugFileServer) Rstat(ctx context.Context, fid protocol.FID) ([]byte, error) {
 	log.Printf(">>> Tstat fid %v\n", fid)
-	b, err := dfs.FileServer.Rstat(fid)
+	b, err := dfs.FileServer.Rstat(ctx, fid)
 	if err == nil {
 		dir, _ := protocol.Unmarshaldir(bytes.NewBuffer(b))
 		log.Printf("<<< Rstat %v\n", dir)
@@ -106,10 +137,10 @@ func (dfs *DebugFileServer) Rstat(fid protocol.FID) ([]byte, error) {
 	return b, err
 }
 
-func (dfs *DebugFileServer) Rwstat(fid protocol.FID, b []byte) error {
+func (dfs *DebugFileServer) Rwstat(ctx context.Context, fid protocol.FID, b []byte) error {
 	dir, _ := protocol.Unmarshaldir(bytes.NewBuffer(b))
 	log.Printf(">>> Twstat fid %v, %v\n", fid, dir)
-	err := dfs.FileServer.Rwstat(fid, b)
+	err := dfs.FileServer.Rwstat(ctx, fid, b)
 	if err == nil {
 		log.Printf("<<< Rwstat\n")
 	} else {
@@ -118,9 +149,9 @@ func (dfs *DebugFileServer) Rwstat(fid protocol.FID, b []byte) error {
 	return err
 }
 
-func (dfs *DebugFileServer) Rremove(fid protocol.FID) error {
+func (dfs *DebugFileServer) Rremove(ctx context.Context, fid protocol.FID) error {
 	log.Printf(">>> Tremove fid %v\n", fid)
-	err := dfs.FileServer.Rremove(fid)
+	err := dfs.FileServer.Rremove(ctx, fid)
 	if err == nil {
 		log.Printf("<<< Rremove\n")
 	} else {
@@ -129,9 +160,9 @@ func (dfs *DebugFileServer) Rremove(fid protocol.FID) error {
 	return err
 }
 
-func (dfs *DebugFileServer) Rread(fid protocol.FID, o protocol.Offset, c protocol.Count) ([]byte, error) {
+func (dfs *DebugFileServer) Rread(ctx context.Context, fid protocol.FID, o protocol.Offset, c protocol.Count) ([]byte, error) {
 	log.Printf(">>> Tread fid %v, off %v, count %v\n", fid, o, c)
-	b, err := dfs.FileServer.Rread(fid, o, c)
+	b, err := dfs.FileServer.Rread(ctx, fid, o, c)
 	if err == nil {
 		log.Printf("<<< Rread %v\n", len(b))
 	} else {
@@ -140,9 +171,9 @@ func (dfs *DebugFileServer) Rread(fid protocol.FID, o protocol.Offset, c protoco
 	return b, err
 }
 
-func (dfs *DebugFileServer) Rwrite(fid protocol.FID, o protocol.Offset, b []byte) (protocol.Count, error) {
+func (dfs *DebugFileServer) Rwrite(ctx context.Context, fid protocol.FID, o protocol.Offset, b []byte) (protocol.Count, error) {
 	log.Printf(">>> Twrite fid %v, off %v, count %v\n", fid, o, len(b))
-	c, err := dfs.FileServer.Rwrite(fid, o, b)
+	c, err := dfs.FileServer.Rwrite(ctx, fid, o, b)
 	if err == nil {
 		log.Printf("<<< Rwrite %v\n", c)
 	} else {
@@ -150,3 +181,42 @@ func (dfs *DebugFileServer) Rwrite(fid protocol.FID, o protocol.Offset, b []byte
 	}
 	return c, err
 }
+
+func (dfs *DebugFileServer) Rauth(ctx context.Context, afid protocol.FID, uname, aname string) (protocol.QID, error) {
+	log.Printf(">>> Tauth afid %v uname %v aname %v\n", afid, uname, aname)
+	a, ok := dfs.FileServer.(protocol.AuthNineServer)
+	if !ok {
+		log.Printf("<<< Error authentication not required\n")
+		return protocol.QID{}, fmt.Errorf("authentication not required")
+	}
+	qid, err := a.Rauth(ctx, afid, uname, aname)
+	if err == nil {
+		log.Printf("<<< Rauth %v\n", qid)
+	} else {
+		log.Printf("<<< Error %v\n", err)
+	}
+	return qid, err
+}
+
+func (dfs *DebugFileServer) Rstatfs(ctx context.Context, fid protocol.FID) (protocol.Statfs, error) {
+	log.Printf(">>> Tstatfs fid %v\n", fid)
+	s, ok := dfs.FileServer.(protocol.StatfsNineServer)
+	if !ok {
+		log.Printf("<<< Error statfs not supported\n")
+		return protocol.Statfs{}, fmt.Errorf("statfs not supported")
+	}
+	st, err := s.Rstatfs(ctx, fid)
+	if err == nil {
+		log.Printf("<<< Rstatfs %+v\n", st)
+	} else {
+		log.Printf("<<< Error %v\n", err)
+	}
+	return st, err
+}
+
+func (dfs *DebugFileServer) ConnClosed() {
+	log.Printf(">>> connection closed\n")
+	if cn, ok := dfs.FileServer.(protocol.ClosingNineServer); ok {
+		cn.ConnClosed()
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninep
+
+import (
+	"context"
+	"strings"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// A Mux serves several trees from one connection, each from a
+// NineServer of its own, chosen by the aname of each Tattach. The first
+// element of the aname names the tree, and the rest of it is the aname
+// its NineServer is given, so that
+//
+//	m := NewMux(def)
+//	m.Handle("logs", logs)
+//
+// attaches "logs" and "logs/today" to logs, with anames "" and "today",
+// and anything else to def, with the aname unchanged. Every FID the
+// attach leads to, by walks from it, belongs to the same NineServer,
+// and its requests go there.
+//
+// Like the NineServers it serves from, a Mux is for one connection: a
+// NsCreator makes a new one, and new NineServers for it, for each. It
+// speaks 9P2000 only; of the optional interfaces, it passes on
+// ConnClosed.
+type Mux struct {
+	def   protocol.NineServer
+	trees map[string]protocol.NineServer
+
+	// fids holds the NineServer which owns each FID.
+	fids protocol.FIDMap
+}
+
+// NewMux returns a Mux which attaches anames which name no tree to
+// def. If def is nil, such attaches fail.
+func NewMux(def protocol.NineServer) *Mux {
+	return &Mux{def: def, trees: make(map[string]protocol.NineServer)}
+}
+
+// Handle serves the tree called name from ns. It must be called before
+// the Mux is served.
+func (m *Mux) Handle(name string, ns protocol.NineServer) {
+	m.trees[name] = ns
+}
+
+// servers returns every NineServer m serves from.
+func (m *Mux) servers() []protocol.NineServer {
+	var s []protocol.NineServer
+	if m.def != nil {
+		s = append(s, m.def)
+	}
+	for _, ns := range m.trees {
+		s = append(s, ns)
+	}
+	return s
+}
+
+// route returns the NineServer which serves aname, and the aname to
+// give it.
+func (m *Mux) route(aname string) (protocol.NineServer, string, error) {
+	name, rest := strings.TrimLeft(aname, "/"), ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, rest = name[:i], name[i+1:]
+	}
+	if ns, ok := m.trees[name]; ok {
+		return ns, rest, nil
+	}
+	if m.def == nil {
+		return nil, "", protocol.ErrNotExist
+	}
+	return m.def, aname, nil
+}
+
+// owner returns the NineServer which owns fid.
+func (m *Mux) owner(fid protocol.FID) (protocol.NineServer, error) {
+	v, err := m.fids.Lookup(fid)
+	if err != nil {
+		return nil, err
+	}
+	return v.(protocol.NineServer), nil
+}
+
+// Rversion gives every NineServer the version, and returns the
+// smallest msize of theirs. All their FIDs are gone after it.
+func (m *Mux) Rversion(ctx context.Context, msize protocol.MaxSize, version string) (protocol.MaxSize, string, error) {
+	m.fids.ClunkAll()
+	for _, ns := range m.servers() {
+		ms, v, err := ns.Rversion(ctx, msize, version)
+		if err != nil {
+			return 0, "", err
+		}
+		if v != version {
+			return msize, "unknown", nil
+		}
+		if ms < msize {
+			msize = ms
+		}
+	}
+	return msize, version, nil
+}
+
+func (m *Mux) Rattach(ctx context.Context, fid protocol.FID, afid protocol.FID, uname string, aname string) (protocol.QID, error) {
+	ns, aname, err := m.route(aname)
+	if err != nil {
+		return protocol.QID{}, err
+	}
+	if _, err := m.fids.Lookup(fid); err == nil {
+		return protocol.QID{}, protocol.ErrFIDInUse
+	}
+	q, err := ns.Rattach(ctx, fid, afid, uname, aname)
+	if err != nil {
+		return protocol.QID{}, err
+	}
+	if err := m.fids.Add(fid, ns); err != nil {
+		// Another attach took fid while this one was going on.
+		ns.Rclunk(ctx, fid)
+		return protocol.QID{}, err
+	}
+	return q, nil
+}
+
+func (m *Mux) Rwalk(ctx context.Context, fid protocol.FID, newfid protocol.FID, paths []string) ([]protocol.QID, error) {
+	var qids []protocol.QID
+	err := m.fids.Walk(fid, newfid, func(v interface{}) (interface{}, error) {
+		var err error
+		qids, err = v.(protocol.NineServer).Rwalk(ctx, fid, newfid, paths)
+		if err != nil || len(qids) < len(paths) {
+			return nil, err
+		}
+		return v, nil
+	})
+	return qids, err
+}
+
+func (m *Mux) Ropen(ctx context.Context, fid protocol.FID, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	ns, err := m.owner(fid)
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	return ns.Ropen(ctx, fid, mode)
+}
+
+func (m *Mux) Rcreate(ctx context.Context, fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	ns, err := m.owner(fid)
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	return ns.Rcreate(ctx, fid, name, perm, mode)
+}
+
+func (m *Mux) Rstat(ctx context.Context, fid protocol.FID) ([]byte, error) {
+	ns, err := m.owner(fid)
+	if err != nil {
+		return nil, err
+	}
+	return ns.Rstat(ctx, fid)
+}
+
+func (m *Mux) Rwstat(ctx context.Context, fid protocol.FID, b []byte) error {
+	ns, err := m.owner(fid)
+	if err != nil {
+		return err
+	}
+	return ns.Rwstat(ctx, fid, b)
+}
+
+// Rclunk forgets fid, whatever its NineServer makes of the clunk.
+func (m *Mux) Rclunk(ctx context.Context, fid protocol.FID) error {
+	v, err := m.fids.Clunk(fid)
+	if err != nil {
+		return err
+	}
+	return v.(protocol.NineServer).Rclunk(ctx, fid)
+}
+
+// Rremove forgets fid, whether or not the file is removed.
+func (m *Mux) Rremove(ctx context.Context, fid protocol.FID) error {
+	v, err := m.fids.Clunk(fid)
+	if err != nil {
+		return err
+	}
+	return v.(protocol.NineServer).Rremove(ctx, fid)
+}
+
+func (m *Mux) Rread(ctx context.Context, fid protocol.FID, o protocol.Offset, c protocol.Count) ([]byte, error) {
+	ns, err := m.owner(fid)
+	if err != nil {
+		return nil, err
+	}
+	return ns.Rread(ctx, fid, o, c)
+}
+
+func (m *Mux) Rwrite(ctx context.Context, fid protocol.FID, o protocol.Offset, b []byte) (protocol.Count, error) {
+	ns, err := m.owner(fid)
+	if err != nil {
+		return 0, err
+	}
+	return ns.Rwrite(ctx, fid, o, b)
+}
+
+// Rflush passes the flush to every NineServer, since a tag says nothing
+// of which one it is for.
+func (m *Mux) Rflush(ctx context.Context, o protocol.Tag) error {
+	var err error
+	for _, ns := range m.servers() {
+		if e := ns.Rflush(ctx, o); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ConnClosed forgets every FID, and tells the NineServers which want
+// to know.
+func (m *Mux) ConnClosed() {
+	m.fids.ClunkAll()
+	for _, ns := range m.servers() {
+		if c, ok := ns.(protocol.ClosingNineServer); ok {
+			c.ConnClosed()
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninep
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// tree is a NineServer which knows only the names its FIDs are at, and
+// which has one name, "missing", that isn't there. Reads return the
+// tree's name and the FID's name.
+type tree struct {
+	name   string
+	fids   map[protocol.FID]string
+	closed bool
+}
+
+func newTree(name string) *tree {
+	return &tree{name: name, fids: make(map[protocol.FID]string)}
+}
+
+func (t *tree) Rversion(ctx context.Context, msize protocol.MaxSize, version string) (protocol.MaxSize, string, error) {
+	t.fids = make(map[protocol.FID]string)
+	return msize, version, nil
+}
+
+func (t *tree) Rattach(ctx context.Context, fid, afid protocol.FID, uname, aname string) (protocol.QID, error) {
+	t.fids[fid] = path.Join("/", aname)
+	return protocol.QID{Type: protocol.QTDIR}, nil
+}
+
+func (t *tree) Rwalk(ctx context.Context, fid, newfid protocol.FID, paths []string) ([]protocol.QID, error) {
+	n, ok := t.fids[fid]
+	if !ok {
+		return nil, protocol.ErrUnknownFID
+	}
+	var qids []protocol.QID
+	for _, p := range paths {
+		if p == "missing" {
+			if len(qids) == 0 {
+				return nil, protocol.ErrNotExist
+			}
+			return qids, nil
+		}
+		n = path.Join(n, p)
+		qids = append(qids, protocol.QID{})
+	}
+	t.fids[newfid] = n
+	return qids, nil
+}
+
+func (t *tree) Rread(ctx context.Context, fid protocol.FID, o protocol.Offset, c protocol.Count) ([]byte, error) {
+	n, ok := t.fids[fid]
+	if !ok {
+		return nil, protocol.ErrUnknownFID
+	}
+	return []byte(t.name + ":" + n), nil
+}
+
+func (t *tree) Rclunk(ctx context.Context, fid protocol.FID) error {
+	if _, ok := t.fids[fid]; !ok {
+		return protocol.ErrUnknownFID
+	}
+	delete(t.fids, fid)
+	return nil
+}
+
+func (t *tree) Rremove(ctx context.Context, fid protocol.FID) error {
+	delete(t.fids, fid)
+	return protocol.ErrPermission
+}
+
+func (t *tree) Ropen(context.Context, protocol.FID, protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	return protocol.QID{}, 0, nil
+}
+
+func (t *tree) Rcreate(context.Context, protocol.FID, string, protocol.Perm, protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	return protocol.QID{}, 0, protocol.ErrPermission
+}
+
+func (t *tree) Rstat(context.Context, protocol.FID) ([]byte, error) {
+	return protocol.NullDir.Marshal(), nil
+}
+
+func (t *tree) Rwstat(context.Context, protocol.FID, []byte) error {
+	return protocol.ErrPermission
+}
+
+func (t *tree) Rwrite(context.Context, protocol.FID, protocol.Offset, []byte) (protocol.Count, error) {
+	return 0, protocol.ErrPermission
+}
+
+func (t *tree) Rflush(context.Context, protocol.Tag) error {
+	return nil
+}
+
+func (t *tree) ConnClosed() {
+	t.closed = true
+}
+
+func TestMux(t *testing.T) {
+	ctx := context.Background()
+	def, logs, http := newTree("def"), newTree("logs"), newTree("http")
+	m := NewMux(def)
+	m.Handle("logs", logs)
+	m.Handle("http", http)
+
+	if _, _, err := m.Rversion(ctx, 8192, protocol.Version); err != nil {
+		t.Fatalf("Rversion: %v", err)
+	}
+	read := func(fid protocol.FID) string {
+		b, err := m.Rread(ctx, fid, 0, 100)
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	}
+
+	for _, a := range []struct {
+		fid   protocol.FID
+		aname string
+		want  string
+	}{
+		{1, "logs", "logs:/"},
+		{2, "http/static", "http:/static"},
+		{3, "", "def:/"},
+		{4, "other/tree", "def:/other/tree"},
+	} {
+		if _, err := m.Rattach(ctx, a.fid, protocol.NOFID, "glenda", a.aname); err != nil {
+			t.Fatalf("Rattach %q: %v", a.aname, err)
+		}
+		if got := read(a.fid); got != a.want {
+			t.Errorf("Rattach %q: read got %q, want %q", a.aname, got, a.want)
+		}
+	}
+	if _, err := m.Rattach(ctx, 1, protocol.NOFID, "glenda", "http"); err != protocol.ErrFIDInUse {
+		t.Errorf("Rattach of a FID in use: got %v, want %v", err, protocol.ErrFIDInUse)
+	}
+
+	// Walks stay within the tree they start in.
+	if _, err := m.Rwalk(ctx, 1, 10, []string{"today"}); err != nil {
+		t.Fatalf("Rwalk: %v", err)
+	}
+	if got, want := read(10), "logs:/today"; got != want {
+		t.Errorf("after Rwalk: read got %q, want %q", got, want)
+	}
+	if _, err := m.Rwalk(ctx, 2, 11, nil); err != nil {
+		t.Fatalf("Rwalk: %v", err)
+	}
+	if got, want := read(11), "http:/static"; got != want {
+		t.Errorf("after clone: read got %q, want %q", got, want)
+	}
+	if _, err := m.Rwalk(ctx, 11, 11, []string{"css"}); err != nil {
+		t.Fatalf("Rwalk: %v", err)
+	}
+	if got, want := read(11), "http:/static/css"; got != want {
+		t.Errorf("after Rwalk in place: read got %q, want %q", got, want)
+	}
+	if _, err := m.Rwalk(ctx, 1, 11, nil); err != protocol.ErrFIDInUse {
+		t.Errorf("Rwalk to a FID in use: got %v, want %v", err, protocol.ErrFIDInUse)
+	}
+
+	// A walk that gets only part of the way, or nowhere, makes no FID.
+	if qids, err := m.Rwalk(ctx, 1, 12, []string{"today", "missing"}); err != nil || len(qids) != 1 {
+		t.Errorf("partial Rwalk: got (%v, %v), want 1 QID", qids, err)
+	}
+	if _, err := m.Rwalk(ctx, 1, 12, []string{"missing"}); err != protocol.ErrNotExist {
+		t.Errorf("failed Rwalk: got %v, want %v", err, protocol.ErrNotExist)
+	}
+	if _, err := m.Rread(ctx, 12, 0, 100); err != protocol.ErrUnknownFID {
+		t.Errorf("Rread of FID a partial walk gave: got %v, want %v", err, protocol.ErrUnknownFID)
+	}
+
+	// Clunks and removes free the FID in the Mux and in its tree.
+	if err := m.Rclunk(ctx, 10); err != nil {
+		t.Errorf("Rclunk: %v", err)
+	}
+	if err := m.Rremove(ctx, 11); err != protocol.ErrPermission {
+		t.Errorf("Rremove: got %v, want %v", err, protocol.ErrPermission)
+	}
+	for _, fid := range []protocol.FID{10, 11} {
+		if err := m.Rclunk(ctx, fid); err != protocol.ErrUnknownFID {
+			t.Errorf("Rclunk of FID %d again: got %v, want %v", fid, err, protocol.ErrUnknownFID)
+		}
+	}
+	if len(logs.fids) != 1 || len(http.fids) != 1 || len(def.fids) != 2 {
+		t.Errorf("FIDs left: logs %v, http %v, def %v; want 1, 1, 2", logs.fids, http.fids, def.fids)
+	}
+	// The FID can be used again, in another tree.
+	if _, err := m.Rwalk(ctx, 3, 10, nil); err != nil {
+		t.Fatalf("Rwalk to a clunked FID: %v", err)
+	}
+	if got, want := read(10), "def:/"; got != want {
+		t.Errorf("reused FID: read got %q, want %q", got, want)
+	}
+
+	m.ConnClosed()
+	if m.fids.Len() != 0 {
+		t.Errorf("after ConnClosed: %d FIDs left, want 0", m.fids.Len())
+	}
+	for _, tr := range []*tree{def, logs, http} {
+		if !tr.closed {
+			t.Errorf("%s: not told of ConnClosed", tr.name)
+		}
+	}
+}
+
+func TestMuxNoDefault(t *testing.T) {
+	ctx := context.Background()
+	m := NewMux(nil)
+	m.Handle("logs", newTree("logs"))
+	if _, err := m.Rattach(ctx, 1, protocol.NOFID, "glenda", "other"); err != protocol.ErrNotExist {
+		t.Errorf("Rattach of no tree: got %v, want %v", err, protocol.ErrNotExist)
+	}
+	if _, err := m.Rattach(ctx, 1, protocol.NOFID, "glenda", "/logs"); err != nil {
+		t.Errorf("Rattach of /logs: %v", err)
+	}
+	if _, _, err := m.Rversion(ctx, 8192, protocol.Version); err != nil || m.fids.Len() != 0 {
+		t.Errorf("Rversion: got (%d FIDs, %v), want (0, nil)", m.fids.Len(), err)
+	}
+}
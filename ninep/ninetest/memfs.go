@@ -0,0 +1,600 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninetest
+
+import (
+	"context"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// Owner owns the files a MemFS is given by Mkdir and WriteFile. Those
+// made over 9P belong to the uname they were attached as.
+const Owner = "ninetest"
+
+// Errors a MemFS gives which the protocol package has none for.
+var (
+	ErrNotOpen  = &protocol.Error{Err: "fid not open for I/O", Errno: protocol.EBADF}
+	ErrBadUse   = &protocol.Error{Err: "inappropriate use of fid", Errno: protocol.EBADF}
+	ErrBadName  = &protocol.Error{Err: "illegal name", Errno: protocol.EINVAL}
+	ErrNotEmpty = &protocol.Error{Err: "directory not empty", Errno: protocol.ENOTEMPTY}
+)
+
+// A MemFS is a NineServer which keeps a tree of files in memory, for
+// tests which need a server to talk to but not the files of a real one.
+// It keeps to what the protocol says of each request: a walk which
+// gets part of the way returns the QIDs it got and leaves newfid
+// alone; a FID can't be walked from, or opened again, once open; a
+// remove clunks the FID whether or not it removes the file; and a
+// directory is read a whole entry at a time. It checks no permissions,
+// and has no authentication.
+//
+// A MemFS serves one connection at a time, since the FIDs it keeps
+// are that connection's; they are clunked when it ends.
+type MemFS struct {
+	fids protocol.FIDMap
+
+	// mu guards the tree below and everything in it.
+	mu   sync.Mutex
+	root *memNode
+	path uint64 // the last QID path given out
+}
+
+// A memNode is a file or a directory.
+type memNode struct {
+	d      protocol.Dir // Length is kept in data
+	data   []byte
+	parent *memNode // the root is its own
+	// children is nil for files, and never for directories.
+	children map[string]*memNode
+	removed  bool
+}
+
+func (n *memNode) isDir() bool {
+	return n.children != nil
+}
+
+// stat returns n's Dir.
+func (n *memNode) stat() protocol.Dir {
+	d := n.d
+	d.Length = uint64(len(n.data))
+	return d
+}
+
+// changed notes a change to n's contents by user.
+func (n *memNode) changed(user string) {
+	n.d.QID.Version++
+	n.d.Mtime = uint32(time.Now().Unix())
+	n.d.ModUser = user
+}
+
+// A memFID is what a MemFS keeps for each FID.
+type memFID struct {
+	n     *memNode
+	uname string
+	open  bool
+	mode  protocol.Mode
+	dir   *protocol.DirReader
+}
+
+func (f *memFID) IsOpen() bool {
+	return f.open
+}
+
+// NewMemFS returns a MemFS holding nothing but an empty root directory.
+func NewMemFS() *MemFS {
+	fs := &MemFS{}
+	fs.root = fs.newNode(nil, "/", protocol.DMDIR|0777, Owner, Owner)
+	return fs
+}
+
+// newNode returns a new file or directory called name in parent,
+// which is nil for the root, owned by user and group, and adds it to
+// parent. fs.mu must be held, but for the root.
+func (fs *MemFS) newNode(parent *memNode, name string, perm protocol.Perm, user, group string) *memNode {
+	fs.path++
+	now := uint32(time.Now().Unix())
+	n := &memNode{
+		d: protocol.Dir{
+			QID:     protocol.QID{Type: uint8(perm >> 24), Path: fs.path},
+			Mode:    uint32(perm),
+			Atime:   now,
+			Mtime:   now,
+			Name:    name,
+			User:    user,
+			Group:   group,
+			ModUser: user,
+		},
+		parent: parent,
+	}
+	if perm&protocol.DMDIR != 0 {
+		n.children = make(map[string]*memNode)
+	}
+	if parent == nil {
+		n.parent = n
+	} else {
+		parent.children[name] = n
+		parent.changed(user)
+	}
+	return n
+}
+
+// lookup returns the node for name, a slash-separated path from the
+// root. fs.mu must be held.
+func (fs *MemFS) lookup(name string) (*memNode, error) {
+	n := fs.root
+	for _, e := range strings.Split(path.Clean("/" + name)[1:], "/") {
+		if e == "" {
+			continue
+		}
+		if !n.isDir() {
+			return nil, protocol.ErrNotDir
+		}
+		c, ok := n.children[e]
+		if !ok {
+			return nil, protocol.ErrNotExist
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// parentOf returns the directory name, a slash-separated path from the
+// root, is to be made in, and its last element. fs.mu must be held.
+func (fs *MemFS) parentOf(name string) (*memNode, string, error) {
+	dir, elem := path.Split(path.Clean("/" + name))
+	if elem == "" {
+		return nil, "", ErrBadName
+	}
+	p, err := fs.lookup(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if !p.isDir() {
+		return nil, "", protocol.ErrNotDir
+	}
+	return p, elem, nil
+}
+
+// Mkdir makes the directory name, a slash-separated path from the
+// root, whose parent must exist, with permissions perm.
+func (fs *MemFS) Mkdir(name string, perm protocol.Perm) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, elem, err := fs.parentOf(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := p.children[elem]; ok {
+		return protocol.ErrExist
+	}
+	fs.newNode(p, elem, protocol.DMDIR|perm&0777, Owner, Owner)
+	return nil
+}
+
+// WriteFile sets the file name, a slash-separated path from the root,
+// whose parent must exist, to hold data, making it with permissions
+// perm if it doesn't exist.
+func (fs *MemFS) WriteFile(name string, data []byte, perm protocol.Perm) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, elem, err := fs.parentOf(name)
+	if err != nil {
+		return err
+	}
+	n, ok := p.children[elem]
+	switch {
+	case !ok:
+		n = fs.newNode(p, elem, perm&^protocol.DMDIR, Owner, Owner)
+	case n.isDir():
+		return protocol.ErrIsDir
+	}
+	n.data = append([]byte(nil), data...)
+	n.changed(Owner)
+	return nil
+}
+
+// ReadFile returns what the file name, a slash-separated path from the
+// root, holds.
+func (fs *MemFS) ReadFile(name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if n.isDir() {
+		return nil, protocol.ErrIsDir
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+// Stat returns the Dir of name, a slash-separated path from the root.
+func (fs *MemFS) Stat(name string) (protocol.Dir, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := fs.lookup(name)
+	if err != nil {
+		return protocol.Dir{}, err
+	}
+	return n.stat(), nil
+}
+
+// fid returns what fs keeps for fid.
+func (fs *MemFS) fid(fid protocol.FID) (*memFID, error) {
+	v, err := fs.fids.Lookup(fid)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*memFID), nil
+}
+
+// validName reports whether name can be a file's.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+func (fs *MemFS) Rversion(ctx context.Context, msize protocol.MaxSize, version string) (protocol.MaxSize, string, error) {
+	// The Server has settled on plain 9P2000 and an msize by now.
+	return msize, protocol.Version, nil
+}
+
+func (fs *MemFS) Rattach(ctx context.Context, fid, afid protocol.FID, uname, aname string) (protocol.QID, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fids.Add(fid, &memFID{n: fs.root, uname: uname}); err != nil {
+		return protocol.QID{}, err
+	}
+	return fs.root.d.QID, nil
+}
+
+func (fs *MemFS) Rwalk(ctx context.Context, fid, newfid protocol.FID, names []string) ([]protocol.QID, error) {
+	var qids []protocol.QID
+	err := fs.fids.Walk(fid, newfid, func(v interface{}) (interface{}, error) {
+		f := v.(*memFID)
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		n := f.n
+		for i, name := range names {
+			var err error
+			switch {
+			case !n.isDir():
+				err = protocol.ErrNotDir
+			case name == "..":
+				n = n.parent
+			default:
+				c, ok := n.children[name]
+				if !ok {
+					err = protocol.ErrNotExist
+				}
+				n = c
+			}
+			if err != nil {
+				if i == 0 {
+					return nil, err
+				}
+				// Part of the way: newfid is left as it was.
+				return nil, nil
+			}
+			qids = append(qids, n.d.QID)
+		}
+		return &memFID{n: n, uname: f.uname}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return qids, nil
+}
+
+// openable returns the error opening a file, or a directory if dir,
+// with mode gives.
+func openable(dir bool, mode protocol.Mode) error {
+	if dir && (mode&3 == protocol.OWRITE || mode&3 == protocol.ORDWR || mode&protocol.OTRUNC != 0) {
+		return protocol.ErrIsDir
+	}
+	return nil
+}
+
+// open makes f open with mode.
+func (fs *MemFS) open(f *memFID, mode protocol.Mode) {
+	f.open, f.mode = true, mode
+	if !f.n.isDir() {
+		return
+	}
+	f.dir = &protocol.DirReader{Open: func() (func() ([]byte, error), error) {
+		// The entries as they are now, by name.
+		fs.mu.Lock()
+		c := sortedChildren(f.n)
+		es := make([][]byte, len(c))
+		for i, n := range c {
+			es[i] = n.stat().Marshal()
+		}
+		fs.mu.Unlock()
+		return func() ([]byte, error) {
+			if len(es) == 0 {
+				return nil, io.EOF
+			}
+			e := es[0]
+			es = es[1:]
+			return e, nil
+		}, nil
+	}}
+}
+
+func (fs *MemFS) Ropen(ctx context.Context, fid protocol.FID, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	f, err := fs.fid(fid)
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	if f.open {
+		return protocol.QID{}, 0, protocol.ErrFIDOpen
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := openable(f.n.isDir(), mode); err != nil {
+		return protocol.QID{}, 0, err
+	}
+	if mode&protocol.OTRUNC != 0 && len(f.n.data) > 0 {
+		f.n.data = nil
+		f.n.changed(f.uname)
+	}
+	fs.open(f, mode)
+	return f.n.d.QID, 0, nil
+}
+
+func (fs *MemFS) Rcreate(ctx context.Context, fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	f, err := fs.fid(fid)
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	if f.open {
+		return protocol.QID{}, 0, protocol.ErrFIDOpen
+	}
+	if !validName(name) {
+		return protocol.QID{}, 0, ErrBadName
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p := f.n
+	switch {
+	case !p.isDir():
+		return protocol.QID{}, 0, protocol.ErrNotDir
+	case p.removed:
+		return protocol.QID{}, 0, protocol.ErrNotExist
+	}
+	if _, ok := p.children[name]; ok {
+		return protocol.QID{}, 0, protocol.ErrExist
+	}
+	// The new file has no permission its directory lacks.
+	if perm&protocol.DMDIR != 0 {
+		perm &= ^protocol.Perm(0777) | protocol.Perm(p.d.Mode)&0777
+	} else {
+		perm &= ^protocol.Perm(0666) | protocol.Perm(p.d.Mode)&0666
+	}
+	if err := openable(perm&protocol.DMDIR != 0, mode); err != nil {
+		return protocol.QID{}, 0, err
+	}
+	f.n = fs.newNode(p, name, perm, f.uname, p.d.Group)
+	fs.open(f, mode)
+	return f.n.d.QID, 0, nil
+}
+
+func (fs *MemFS) Rstat(ctx context.Context, fid protocol.FID) ([]byte, error) {
+	f, err := fs.fid(fid)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return f.n.stat().Marshal(), nil
+}
+
+func (fs *MemFS) Rwstat(ctx context.Context, fid protocol.FID, b []byte) error {
+	f, err := fs.fid(fid)
+	if err != nil {
+		return err
+	}
+	var w protocol.Dir
+	if err := w.Unmarshal(b); err != nil {
+		return err
+	}
+	if w.IsNull() {
+		// A request to sync, and we're as synced as we'll get.
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n := f.n
+	d := n.stat()
+	null := protocol.NullDir
+
+	// Check it all before changing any of it: a Twstat is all or
+	// nothing.
+	switch {
+	case w.Type != null.Type && w.Type != d.Type,
+		w.Dev != null.Dev && w.Dev != d.Dev,
+		w.QID != null.QID && w.QID != d.QID,
+		w.User != "" && w.User != d.User,
+		w.ModUser != "" && w.ModUser != d.ModUser:
+		return protocol.ErrPermission
+	case w.Mode != null.Mode && w.Mode&protocol.DMDIR != d.Mode&protocol.DMDIR:
+		return protocol.ErrPermission
+	case w.Length != null.Length && n.isDir() && w.Length != 0:
+		return protocol.ErrIsDir
+	}
+	rename := w.Name != "" && w.Name != d.Name
+	if rename {
+		switch {
+		case n == fs.root:
+			return protocol.ErrPermission
+		case !validName(w.Name):
+			return ErrBadName
+		}
+		if _, ok := n.parent.children[w.Name]; ok && !n.removed {
+			return protocol.ErrExist
+		}
+	}
+
+	if rename {
+		if !n.removed {
+			delete(n.parent.children, d.Name)
+			n.parent.children[w.Name] = n
+			n.parent.changed(f.uname)
+		}
+		n.d.Name = w.Name
+	}
+	if w.Mode != null.Mode {
+		n.d.Mode = w.Mode
+		n.d.QID.Type = uint8(w.Mode >> 24)
+	}
+	if w.Atime != null.Atime {
+		n.d.Atime = w.Atime
+	}
+	if w.Length != null.Length && !n.isDir() && w.Length != uint64(len(n.data)) {
+		data := make([]byte, w.Length)
+		copy(data, n.data)
+		n.data = data
+		n.changed(f.uname)
+	}
+	if w.Mtime != null.Mtime {
+		n.d.Mtime = w.Mtime
+	}
+	if w.Group != "" {
+		n.d.Group = w.Group
+	}
+	return nil
+}
+
+// remove takes n out of its directory. fs.mu must be held.
+func (fs *MemFS) remove(n *memNode, user string) error {
+	switch {
+	case n == fs.root:
+		return protocol.ErrPermission
+	case n.removed:
+		return protocol.ErrNotExist
+	case len(n.children) > 0:
+		return ErrNotEmpty
+	}
+	delete(n.parent.children, n.d.Name)
+	n.parent.changed(user)
+	n.removed = true
+	return nil
+}
+
+// clunk lets go of f, removing its file if it was opened with ORCLOSE.
+func (fs *MemFS) clunk(f *memFID) {
+	if !f.open || f.mode&protocol.ORCLOSE == 0 {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	// As for Tremove, but a clunk succeeds regardless.
+	fs.remove(f.n, f.uname)
+}
+
+func (fs *MemFS) Rclunk(ctx context.Context, fid protocol.FID) error {
+	v, err := fs.fids.Clunk(fid)
+	if err != nil {
+		return err
+	}
+	fs.clunk(v.(*memFID))
+	return nil
+}
+
+func (fs *MemFS) Rremove(ctx context.Context, fid protocol.FID) error {
+	// The FID is clunked even if the file can't be removed.
+	v, err := fs.fids.Clunk(fid)
+	if err != nil {
+		return err
+	}
+	f := v.(*memFID)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.remove(f.n, f.uname)
+}
+
+func (fs *MemFS) Rread(ctx context.Context, fid protocol.FID, o protocol.Offset, c protocol.Count) ([]byte, error) {
+	f, err := fs.fid(fid)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !f.open:
+		return nil, ErrNotOpen
+	case f.mode&3 == protocol.OWRITE:
+		return nil, ErrBadUse
+	case f.dir != nil:
+		return f.dir.Read(o, c)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n := f.n
+	n.d.Atime = uint32(time.Now().Unix())
+	if o >= protocol.Offset(len(n.data)) {
+		return nil, nil
+	}
+	b := n.data[o:]
+	if len(b) > int(c) {
+		b = b[:c]
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (fs *MemFS) Rwrite(ctx context.Context, fid protocol.FID, o protocol.Offset, b []byte) (protocol.Count, error) {
+	f, err := fs.fid(fid)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case !f.open:
+		return 0, ErrNotOpen
+	case f.mode&3 != protocol.OWRITE && f.mode&3 != protocol.ORDWR:
+		return 0, ErrBadUse
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n := f.n
+	if n.d.Mode&protocol.DMAPPEND != 0 {
+		o = protocol.Offset(len(n.data))
+	}
+	if end := int(o) + len(b); end > len(n.data) {
+		data := make([]byte, end)
+		copy(data, n.data)
+		n.data = data
+	}
+	copy(n.data[o:], b)
+	n.changed(f.uname)
+	return protocol.Count(len(b)), nil
+}
+
+func (fs *MemFS) Rflush(ctx context.Context, o protocol.Tag) error {
+	return nil
+}
+
+// ConnClosed clunks the connection's FIDs, for the next one.
+func (fs *MemFS) ConnClosed() {
+	for _, v := range fs.fids.ClunkAll() {
+		fs.clunk(v.(*memFID))
+	}
+}
+
+var _ protocol.ClosingNineServer = &MemFS{}
+
+// sortedChildren returns the children of n by name. fs.mu must be
+// held.
+func sortedChildren(n *memNode) []*memNode {
+	c := make([]*memNode, 0, len(n.children))
+	for _, k := range n.children {
+		c = append(c, k)
+	}
+	sort.Slice(c, func(i, j int) bool { return c[i].d.Name < c[j].d.Name })
+	return c
+}
@@ -0,0 +1,348 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// newMemFS returns a MemFS holding d/f, which says "hello", attached
+// as fid 1.
+func newMemFS(t *testing.T) *MemFS {
+	t.Helper()
+	fs := NewMemFS()
+	if err := fs.Mkdir("d", 0755); err != nil {
+		t.Fatalf("Mkdir: want nil, got %v", err)
+	}
+	if err := fs.WriteFile("d/f", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: want nil, got %v", err)
+	}
+	if _, err := fs.Rattach(context.Background(), 1, protocol.NOFID, "glenda", ""); err != nil {
+		t.Fatalf("Rattach: want nil, got %v", err)
+	}
+	return fs
+}
+
+func TestMemFSWalk(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(t)
+	d, _ := fs.Stat("d")
+	f, _ := fs.Stat("d/f")
+
+	qids, err := fs.Rwalk(ctx, 1, 2, []string{"d", "f"})
+	if err != nil || len(qids) != 2 || qids[0] != d.QID || qids[1] != f.QID {
+		t.Fatalf("Rwalk d/f: want ([%v %v], nil), got (%v, %v)", d.QID, f.QID, qids, err)
+	}
+
+	// A walk which gets part of the way returns the QIDs it got, and
+	// leaves newfid alone.
+	qids, err = fs.Rwalk(ctx, 1, 3, []string{"d", "g"})
+	if err != nil || len(qids) != 1 {
+		t.Errorf("Rwalk d/g: want 1 QID and nil, got (%v, %v)", qids, err)
+	}
+	if _, err := fs.Rstat(ctx, 3); !errors.Is(err, protocol.ErrUnknownFID) {
+		t.Errorf("Rstat of the newfid of a partial walk: want %v, got %v", protocol.ErrUnknownFID, err)
+	}
+	// One which gets nowhere is an error.
+	if qids, err := fs.Rwalk(ctx, 1, 3, []string{"g"}); !errors.Is(err, protocol.ErrNotExist) {
+		t.Errorf("Rwalk g: want %v, got (%v, %v)", protocol.ErrNotExist, qids, err)
+	}
+	if _, err := fs.Rwalk(ctx, 2, 3, []string{"x"}); !errors.Is(err, protocol.ErrNotDir) {
+		t.Errorf("Rwalk from a file: want %v, got %v", protocol.ErrNotDir, err)
+	}
+
+	// newfid must be new, unless it is fid.
+	if _, err := fs.Rwalk(ctx, 1, 2, nil); !errors.Is(err, protocol.ErrFIDInUse) {
+		t.Errorf("Rwalk to a FID in use: want %v, got %v", protocol.ErrFIDInUse, err)
+	}
+	if _, err := fs.Rwalk(ctx, 9, 3, nil); !errors.Is(err, protocol.ErrUnknownFID) {
+		t.Errorf("Rwalk from an unknown FID: want %v, got %v", protocol.ErrUnknownFID, err)
+	}
+	if qids, err := fs.Rwalk(ctx, 1, 3, []string{"d", "..", "d"}); err != nil || len(qids) != 3 || qids[2] != d.QID {
+		t.Errorf("Rwalk d/../d: want 3 QIDs, the last %v, got (%v, %v)", d.QID, qids, err)
+	}
+	if qids, err := fs.Rwalk(ctx, 3, 3, []string{".."}); err != nil || len(qids) != 1 {
+		t.Errorf("Rwalk of a FID to itself: want 1 QID and nil, got (%v, %v)", qids, err)
+	}
+	root, _ := fs.Stat("/")
+	if qids, err := fs.Rwalk(ctx, 3, 3, []string{".."}); err != nil || len(qids) != 1 || qids[0] != root.QID {
+		t.Errorf("Rwalk .. from the root: want [%v], got (%v, %v)", root.QID, qids, err)
+	}
+
+	// An open FID can't be walked from, or opened again.
+	if _, _, err := fs.Ropen(ctx, 2, protocol.OREAD); err != nil {
+		t.Fatalf("Ropen: want nil, got %v", err)
+	}
+	if _, err := fs.Rwalk(ctx, 2, 4, nil); !errors.Is(err, protocol.ErrFIDOpen) {
+		t.Errorf("Rwalk from an open FID: want %v, got %v", protocol.ErrFIDOpen, err)
+	}
+	if _, _, err := fs.Ropen(ctx, 2, protocol.OREAD); !errors.Is(err, protocol.ErrFIDOpen) {
+		t.Errorf("Ropen of an open FID: want %v, got %v", protocol.ErrFIDOpen, err)
+	}
+}
+
+func TestMemFSOpenReadWrite(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(t)
+	if _, err := fs.Rwalk(ctx, 1, 2, []string{"d", "f"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Rread(ctx, 2, 0, 10); !errors.Is(err, ErrNotOpen) {
+		t.Errorf("Rread before Ropen: want %v, got %v", ErrNotOpen, err)
+	}
+	before, _ := fs.Stat("d/f")
+	if _, _, err := fs.Ropen(ctx, 2, protocol.ORDWR|protocol.OTRUNC); err != nil {
+		t.Fatalf("Ropen: want nil, got %v", err)
+	}
+	if n, err := fs.Rwrite(ctx, 2, 2, []byte("xy")); n != 2 || err != nil {
+		t.Errorf("Rwrite: want (2, nil), got (%d, %v)", n, err)
+	}
+	if b, err := fs.Rread(ctx, 2, 0, 10); !bytes.Equal(b, []byte("\x00\x00xy")) || err != nil {
+		t.Errorf("Rread: want (\"\\x00\\x00xy\", nil), got (%q, %v)", b, err)
+	}
+	if b, err := fs.Rread(ctx, 2, 10, 10); len(b) != 0 || err != nil {
+		t.Errorf("Rread past the end: want nothing, got (%q, %v)", b, err)
+	}
+	after, _ := fs.Stat("d/f")
+	if after.QID.Version == before.QID.Version || after.Length != 4 || after.ModUser != "glenda" {
+		t.Errorf("Stat after a write: want a new version, length 4 and muid glenda, got %v", after)
+	}
+
+	if _, err := fs.Rwalk(ctx, 1, 3, []string{"d", "f"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.Ropen(ctx, 3, protocol.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Rwrite(ctx, 3, 0, []byte("x")); !errors.Is(err, ErrBadUse) {
+		t.Errorf("Rwrite to a FID open for reading: want %v, got %v", ErrBadUse, err)
+	}
+
+	if _, err := fs.Rwalk(ctx, 1, 4, []string{"d"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.Ropen(ctx, 4, protocol.OWRITE); !errors.Is(err, protocol.ErrIsDir) {
+		t.Errorf("Ropen of a directory for writing: want %v, got %v", protocol.ErrIsDir, err)
+	}
+}
+
+func TestMemFSCreate(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(t)
+	if err := fs.WriteFile("d/g", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Rwalk(ctx, 1, 2, []string{"d"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		if _, _, err := fs.Rcreate(ctx, 2, name, 0644, protocol.OREAD); !errors.Is(err, ErrBadName) {
+			t.Errorf("Rcreate %q: want %v, got %v", name, ErrBadName, err)
+		}
+	}
+	if _, _, err := fs.Rcreate(ctx, 2, "f", 0644, protocol.OREAD); !errors.Is(err, protocol.ErrExist) {
+		t.Errorf("Rcreate of a file which exists: want %v, got %v", protocol.ErrExist, err)
+	}
+	if _, _, err := fs.Rcreate(ctx, 2, "e", protocol.DMDIR|0777, protocol.OWRITE); !errors.Is(err, protocol.ErrIsDir) {
+		t.Errorf("Rcreate of a directory for writing: want %v, got %v", protocol.ErrIsDir, err)
+	}
+
+	// The new file has no permission its directory lacks, and fid
+	// is now the new file, open.
+	q, _, err := fs.Rcreate(ctx, 2, "new", 0666, protocol.OWRITE)
+	if err != nil {
+		t.Fatalf("Rcreate: want nil, got %v", err)
+	}
+	d, err := fs.Stat("d/new")
+	if err != nil || d.QID != q || d.Mode != 0644 || d.User != "glenda" || d.Group != Owner {
+		t.Errorf("Stat of a new file: want QID %v, mode 0644, owner glenda and group %s, got (%v, %v)", q, Owner, d, err)
+	}
+	if _, err := fs.Rwrite(ctx, 2, 0, []byte("new")); err != nil {
+		t.Errorf("Rwrite to a created FID: want nil, got %v", err)
+	}
+	if _, _, err := fs.Rcreate(ctx, 2, "again", 0666, protocol.OREAD); !errors.Is(err, protocol.ErrFIDOpen) {
+		t.Errorf("Rcreate from an open FID: want %v, got %v", protocol.ErrFIDOpen, err)
+	}
+	if _, err := fs.Rwalk(ctx, 1, 3, []string{"d", "f"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.Rcreate(ctx, 3, "x", 0666, protocol.OREAD); !errors.Is(err, protocol.ErrNotDir) {
+		t.Errorf("Rcreate in a file: want %v, got %v", protocol.ErrNotDir, err)
+	}
+}
+
+func TestMemFSClunkRemove(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(t)
+	if _, err := fs.Rwalk(ctx, 1, 2, []string{"d"}); err != nil {
+		t.Fatal(err)
+	}
+	// A remove which fails still clunks the FID.
+	if err := fs.Rremove(ctx, 2); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("Rremove of a directory with a file in it: want %v, got %v", ErrNotEmpty, err)
+	}
+	if err := fs.Rclunk(ctx, 2); !errors.Is(err, protocol.ErrUnknownFID) {
+		t.Errorf("Rclunk after a failed Rremove: want %v, got %v", protocol.ErrUnknownFID, err)
+	}
+	if err := fs.Rremove(ctx, 2); !errors.Is(err, protocol.ErrUnknownFID) {
+		t.Errorf("Rremove of an unknown FID: want %v, got %v", protocol.ErrUnknownFID, err)
+	}
+
+	// A FID on a file another has removed still stats, but can't be
+	// removed again.
+	if _, err := fs.Rwalk(ctx, 1, 2, []string{"d", "f"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Rwalk(ctx, 1, 3, []string{"d", "f"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rremove(ctx, 2); err != nil {
+		t.Fatalf("Rremove: want nil, got %v", err)
+	}
+	if _, err := fs.Stat("d/f"); !errors.Is(err, protocol.ErrNotExist) {
+		t.Errorf("Stat of a removed file: want %v, got %v", protocol.ErrNotExist, err)
+	}
+	if _, err := fs.Rstat(ctx, 3); err != nil {
+		t.Errorf("Rstat of a FID on a removed file: want nil, got %v", err)
+	}
+	if err := fs.Rremove(ctx, 3); !errors.Is(err, protocol.ErrNotExist) {
+		t.Errorf("Rremove of a removed file: want %v, got %v", protocol.ErrNotExist, err)
+	}
+	if err := fs.Rremove(ctx, 1); !errors.Is(err, protocol.ErrPermission) {
+		t.Errorf("Rremove of the root: want %v, got %v", protocol.ErrPermission, err)
+	}
+
+	// ORCLOSE removes the file on clunk, and when the connection ends.
+	if _, err := fs.Rattach(ctx, 1, protocol.NOFID, "glenda", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := fs.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.Rwalk(ctx, 1, 2, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.Ropen(ctx, 2, protocol.OREAD|protocol.ORCLOSE); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rclunk(ctx, 2); err != nil {
+		t.Errorf("Rclunk: want nil, got %v", err)
+	}
+	if _, err := fs.Stat("a"); !errors.Is(err, protocol.ErrNotExist) {
+		t.Errorf("Stat of an ORCLOSE file after Rclunk: want %v, got %v", protocol.ErrNotExist, err)
+	}
+	if _, err := fs.Rwalk(ctx, 1, 2, []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.Ropen(ctx, 2, protocol.OREAD|protocol.ORCLOSE); err != nil {
+		t.Fatal(err)
+	}
+	fs.ConnClosed()
+	if _, err := fs.Stat("b"); !errors.Is(err, protocol.ErrNotExist) {
+		t.Errorf("Stat of an ORCLOSE file after ConnClosed: want %v, got %v", protocol.ErrNotExist, err)
+	}
+	if _, err := fs.Rstat(ctx, 1); !errors.Is(err, protocol.ErrUnknownFID) {
+		t.Errorf("Rstat after ConnClosed: want %v, got %v", protocol.ErrUnknownFID, err)
+	}
+}
+
+func TestMemFSWstat(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(t)
+	if err := fs.WriteFile("d/g", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Rwalk(ctx, 1, 2, []string{"d", "f"}); err != nil {
+		t.Fatal(err)
+	}
+	wstat := func(fid protocol.FID, change func(d *protocol.Dir)) error {
+		d := protocol.NullDir
+		change(&d)
+		return fs.Rwstat(ctx, fid, d.Marshal())
+	}
+
+	// All or nothing: the name is not changed if the length can't be.
+	if err := wstat(2, func(d *protocol.Dir) { d.Name = "g" }); !errors.Is(err, protocol.ErrExist) {
+		t.Errorf("Rwstat to the name of another file: want %v, got %v", protocol.ErrExist, err)
+	}
+	if err := wstat(2, func(d *protocol.Dir) { d.Name, d.Mode = "h", protocol.DMDIR|0755 }); !errors.Is(err, protocol.ErrPermission) {
+		t.Errorf("Rwstat making a file a directory: want %v, got %v", protocol.ErrPermission, err)
+	}
+	if _, err := fs.Stat("d/f"); err != nil {
+		t.Errorf("Stat after a failed Rwstat: want nil, got %v", err)
+	}
+
+	if err := wstat(2, func(d *protocol.Dir) { d.Name, d.Mode, d.Length, d.Mtime = "h", 0600, 2, 1 }); err != nil {
+		t.Fatalf("Rwstat: want nil, got %v", err)
+	}
+	d, err := fs.Stat("d/h")
+	if err != nil || d.Mode != 0600 || d.Length != 2 || d.Mtime != 1 {
+		t.Errorf("Stat after Rwstat: want mode 0600, length 2 and mtime 1, got (%v, %v)", d, err)
+	}
+	if b, _ := fs.ReadFile("d/h"); string(b) != "he" {
+		t.Errorf("ReadFile after truncating: want he, got %q", b)
+	}
+	if _, err := fs.Stat("d/f"); !errors.Is(err, protocol.ErrNotExist) {
+		t.Errorf("Stat of the old name: want %v, got %v", protocol.ErrNotExist, err)
+	}
+	if err := fs.Rwstat(ctx, 2, protocol.NullDir.Marshal()); err != nil {
+		t.Errorf("Rwstat of NullDir: want nil, got %v", err)
+	}
+	if err := wstat(1, func(d *protocol.Dir) { d.Name = "root" }); !errors.Is(err, protocol.ErrPermission) {
+		t.Errorf("Rwstat renaming the root: want %v, got %v", protocol.ErrPermission, err)
+	}
+}
+
+func TestMemFSReadDir(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(t)
+	for _, name := range []string{"d/c", "d/b", "d/a"} {
+		if err := fs.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.Rwalk(ctx, 1, 2, []string{"d"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.Ropen(ctx, 2, protocol.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	// Room for two entries a read: a, b and c, f.
+	one := len(protocol.Dir{Name: "a", User: Owner, Group: Owner, ModUser: Owner}.Marshal())
+	var names []string
+	var o protocol.Offset
+	for {
+		b, err := fs.Rread(ctx, 2, o, protocol.Count(2*one+1))
+		if err != nil {
+			t.Fatalf("Rread at %d: want nil, got %v", o, err)
+		}
+		if len(b) == 0 {
+			break
+		}
+		o += protocol.Offset(len(b))
+		for len(b) > 0 {
+			n := int(b[0]) | int(b[1])<<8 + 2
+			var d protocol.Dir
+			if err := d.Unmarshal(b[:n]); err != nil {
+				t.Fatalf("Unmarshal: want nil, got %v", err)
+			}
+			names = append(names, d.Name)
+			b = b[n:]
+		}
+	}
+	if got := len(names); got != 4 || names[0] != "a" || names[1] != "b" || names[2] != "c" || names[3] != "f" {
+		t.Errorf("directory entries: want [a b c f], got %v", names)
+	}
+	if _, err := fs.Rread(ctx, 2, 1, 100); err == nil {
+		t.Errorf("Rread of a directory at a bad offset: want an error, got nil")
+	}
+}
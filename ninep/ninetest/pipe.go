@@ -0,0 +1,37 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ninetest has what tests of 9P clients and servers need:
+// PipeServer, to serve a NineServer to a client in the same process;
+// MemFS, a NineServer which keeps its files in memory, as a fixture;
+// and Recorder, to check which requests a server was sent.
+package ninetest
+
+import (
+	"net"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// PipeServer serves ns, with a NetListener made with opts, over one end
+// of a net.Pipe, and returns the other, for a client, e.g. one made by
+// client.NewConn. Closing it ends the connection.
+func PipeServer(ns protocol.NineServer, opts ...protocol.NetListenerOpt) (net.Conn, error) {
+	l, err := protocol.NewNetListener(func() protocol.NineServer { return ns }, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return Pipe(l)
+}
+
+// Pipe is PipeServer for a NetListener made already, e.g. by
+// ufs.NewUFS, or one a test wants to look at, e.g. with Conns.
+func Pipe(l *protocol.NetListener) (net.Conn, error) {
+	p, p2 := net.Pipe()
+	if err := l.Accept(p2); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// A Call is a request a Recorder saw, and how it was answered.
+type Call struct {
+	Type protocol.MType
+	Tag  protocol.Tag
+	// FID is the first FID the request names, or NOFID if it names
+	// none, as Tversion and Tflush don't.
+	FID protocol.FID
+	// Msg is the request from its tag on, as the protocol package's
+	// Unmarshal functions take it.
+	Msg []byte
+	// Err is the text of the Rerror, or of the errno of the Rlerror,
+	// it was answered with, or "" if it succeeded.
+	Err string
+}
+
+func (c Call) String() string {
+	s := fmt.Sprintf("%v tag %d", protocol.RPCNames[c.Type], c.Tag)
+	if c.FID != protocol.NOFID {
+		s += fmt.Sprintf(" fid %d", c.FID)
+	}
+	if c.Err != "" {
+		s += ": " + c.Err
+	}
+	return s
+}
+
+// A Recorder is Middleware which keeps each request it sees, for a test
+// to check, e.g. that a client sent what it should have, or no more. Add
+// it to a NetListener with protocol.WithMiddleware(r.Middleware). Its
+// zero value is ready to use, and one Recorder may be shared by any
+// number of connections.
+//
+// Requests are kept in the order they started. The Server runs those
+// on different FIDs at once, so a client which doesn't wait for one
+// before sending the next can't count on their order.
+type Recorder struct {
+	mu    sync.Mutex
+	calls []*Call
+}
+
+// Middleware wraps next to keep the requests it is given.
+func (r *Recorder) Middleware(next protocol.Dispatcher) protocol.Dispatcher {
+	return func(ctx context.Context, s *protocol.Server, b *bytes.Buffer, t protocol.MType) error {
+		c := Call{Type: t, FID: protocol.NOFID, Msg: append([]byte(nil), b.Bytes()...)}
+		if len(c.Msg) >= 2 {
+			c.Tag = protocol.Tag(c.Msg[0]) | protocol.Tag(c.Msg[1])<<8
+		}
+		if len(c.Msg) >= 6 && t != protocol.Tversion && t != protocol.Tflush {
+			d := c.Msg[2:]
+			c.FID = protocol.FID(d[0]) | protocol.FID(d[1])<<8 | protocol.FID(d[2])<<16 | protocol.FID(d[3])<<24
+		}
+		r.mu.Lock()
+		r.calls = append(r.calls, &c)
+		r.mu.Unlock()
+
+		err := next(ctx, s, b, t)
+		if e := replyError(b.Bytes()); e != "" {
+			r.mu.Lock()
+			c.Err = e
+			r.mu.Unlock()
+		}
+		return err
+	}
+}
+
+// replyError returns the error in reply d, a whole message, or "" if
+// it isn't an Rerror or an Rlerror.
+func replyError(d []byte) string {
+	if len(d) < 7 {
+		return ""
+	}
+	switch protocol.MType(d[4]) {
+	case protocol.Rerror:
+		if len(d) < 9 {
+			return ""
+		}
+		n := int(d[7]) | int(d[8])<<8
+		if len(d) < 9+n {
+			return ""
+		}
+		return string(d[9 : 9+n])
+	case protocol.Rlerror:
+		if len(d) < 11 {
+			return ""
+		}
+		return fmt.Sprintf("errno %d", uint32(d[7])|uint32(d[8])<<8|uint32(d[9])<<16|uint32(d[10])<<24)
+	}
+	return ""
+}
+
+// Calls returns the requests seen since the last Reset or Expect.
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := make([]Call, len(r.calls))
+	for i, c := range r.calls {
+		calls[i] = *c
+	}
+	return calls
+}
+
+// Types returns the types of the requests seen since the last Reset
+// or Expect.
+func (r *Recorder) Types() []protocol.MType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := make([]protocol.MType, len(r.calls))
+	for i, c := range r.calls {
+		t[i] = c.Type
+	}
+	return t
+}
+
+// Count returns how many requests of type t have been seen since the
+// last Reset or Expect.
+func (r *Recorder) Count(t protocol.MType) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, c := range r.calls {
+		if c.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+// Reset forgets the requests seen so far.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+}
+
+// Expect fails t unless the requests seen since the last Reset or
+// Expect were of the types want, in that order, and then forgets them,
+// so that a test can check a client's requests a step at a time.
+func (r *Recorder) Expect(t testing.TB, want ...protocol.MType) {
+	t.Helper()
+	r.mu.Lock()
+	calls := make([]Call, len(r.calls))
+	for i, c := range r.calls {
+		calls[i] = *c
+	}
+	r.calls = nil
+	r.mu.Unlock()
+
+	ok := len(calls) == len(want)
+	for i := 0; ok && i < len(want); i++ {
+		ok = calls[i].Type == want[i]
+	}
+	if ok {
+		return
+	}
+	w := make([]string, len(want))
+	for i, typ := range want {
+		w[i] = protocol.RPCNames[typ]
+	}
+	g := make([]string, len(calls))
+	for i, c := range calls {
+		g[i] = c.String()
+	}
+	t.Errorf("requests: want [%s], got [%s]", strings.Join(w, ", "), strings.Join(g, ", "))
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninetest
+
+import (
+	"context"
+	"testing"
+
+	"harvey-os.org/ninep/client"
+	"harvey-os.org/ninep/protocol"
+)
+
+// TestPipeServer serves a MemFS to a client, and checks the requests
+// it sends for each step.
+func TestPipeServer(t *testing.T) {
+	fs := NewMemFS()
+	if err := fs.WriteFile("f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var rec Recorder
+	p, err := PipeServer(fs, protocol.WithMiddleware(rec.Middleware))
+	if err != nil {
+		t.Fatalf("PipeServer: want nil, got %v", err)
+	}
+	c, err := client.NewConn(context.Background(), p, 8192)
+	if err != nil {
+		t.Fatalf("NewConn: want nil, got %v", err)
+	}
+	defer c.Close()
+	rec.Expect(t, protocol.Tversion)
+
+	root, err := c.Attach(context.Background(), "glenda", "")
+	if err != nil {
+		t.Fatalf("Attach: want nil, got %v", err)
+	}
+	rootFID := protocol.NOFID
+	if calls := rec.Calls(); len(calls) > 0 {
+		rootFID = calls[0].FID
+	}
+	rec.Expect(t, protocol.Tattach)
+
+	f, err := root.Walk("f")
+	if err != nil {
+		t.Fatalf("Walk: want nil, got %v", err)
+	}
+	if err := f.Open(protocol.OREAD); err != nil {
+		t.Fatalf("Open: want nil, got %v", err)
+	}
+	b := make([]byte, 10)
+	if n, err := f.Read(b); n != 5 || string(b[:n]) != "hello" {
+		t.Errorf("Read: want (5, hello), got (%d, %q, %v)", n, b[:n], err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: want nil, got %v", err)
+	}
+	rec.Expect(t, protocol.Twalk, protocol.Topen, protocol.Tread, protocol.Tclunk)
+
+	if _, err := root.Walk("g"); err == nil {
+		t.Errorf("Walk g: want an error, got nil")
+	}
+	calls := rec.Calls()
+	if len(calls) != 1 || calls[0].Type != protocol.Twalk || calls[0].FID != rootFID || calls[0].Err == "" {
+		t.Errorf("calls for a failed walk: want one Twalk of fid %d, with an error, got %v", rootFID, calls)
+	}
+	if n := rec.Count(protocol.Twalk); n != 1 {
+		t.Errorf("Count(Twalk): want 1, got %d", n)
+	}
+	rec.Reset()
+	if n := len(rec.Types()); n != 0 {
+		t.Errorf("Types after Reset: want none, got %d", n)
+	}
+}
+
+// TestRecorderExpect checks that Expect fails a test whose requests
+// weren't what it wanted.
+func TestRecorderExpect(t *testing.T) {
+	var rec Recorder
+	rec.calls = []*Call{{Type: protocol.Tversion, FID: protocol.NOFID}, {Type: protocol.Tattach, FID: 1, Err: "no"}}
+	ft := &fakeT{TB: t}
+	rec.Expect(ft, protocol.Tversion, protocol.Twalk)
+	if ft.errors != 1 {
+		t.Errorf("Expect of the wrong requests: want 1 error, got %d", ft.errors)
+	}
+	if len(rec.Calls()) != 0 {
+		t.Errorf("Calls after Expect: want none, got %v", rec.Calls())
+	}
+}
+
+// fakeT counts a test's errors, rather than failing it.
+type fakeT struct {
+	testing.TB
+	errors int
+}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors++
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// captureMagic starts every capture.
+const captureMagic = "9P capture 1\n"
+
+// WithCapture returns a NetListenerOpt which writes each message each
+// connection reads or writes to w, whole, with the time and which
+// connection it was. Where WithRecording keeps the bytes as each read
+// and write had them, a file to a connection, a capture has one stream
+// of messages, those of all the connections mixed, for ReadCapture to
+// read and the replay package to play back. Over TLS, the messages are
+// the 9p, not the TLS.
+//
+// What is captured is a copy: the messages the client and server see
+// are as they would be without it. The first error writing to w stops
+// the capture, and is logged; the connections go on.
+func WithCapture(w io.Writer) NetListenerOpt {
+	return func(l *NetListener) error {
+		if _, err := io.WriteString(w, captureMagic); err != nil {
+			return err
+		}
+		l.capturer = &capturer{w: w}
+		return nil
+	}
+}
+
+// A CaptureEntry is a message, read or written whole, and the
+// connection it was read from, or written to. Connections are numbered
+// from 1, in the order they started.
+type CaptureEntry struct {
+	Conn uint32
+	RecordEntry
+}
+
+// capturer writes the capture of all of a NetListener's connections.
+type capturer struct {
+	// mu guards below.
+	mu    sync.Mutex
+	w     io.Writer
+	conns uint32
+	err   error
+}
+
+// newConn returns the number of a new connection.
+func (cp *capturer) newConn() uint32 {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.conns++
+	return cp.conns
+}
+
+// write writes an entry for m. The first error stops the capture, and
+// is returned.
+func (cp *capturer) write(conn uint32, out bool, m []byte) error {
+	var h [13]byte
+	h[0] = '<'
+	if out {
+		h[0] = '>'
+	}
+	binary.LittleEndian.PutUint32(h[1:], conn)
+	binary.LittleEndian.PutUint64(h[5:], uint64(time.Now().UnixNano()))
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.err != nil {
+		return nil
+	}
+	// One write per entry, so that entries from different
+	// connections don't get mixed up.
+	_, cp.err = cp.w.Write(append(h[:], m...))
+	return cp.err
+}
+
+// capture has the messages which pass through c captured by cp.
+func (c *conn) capture(cp *capturer) {
+	cc := &captureConn{
+		ReadWriteCloser: struct {
+			io.Reader
+			io.Writer
+			io.Closer
+		}{c.Reader, c.Writer, c.Closer},
+		cp:   cp,
+		conn: cp.newConn(),
+		logf: c.logf,
+	}
+	cc.in.out, cc.out.out = false, true
+	c.Reader, c.Writer = cc, cc
+}
+
+// captureConn is a connection's Reader and Writer, putting together
+// the messages which pass through them, and capturing them.
+type captureConn struct {
+	io.ReadWriteCloser
+	cp   *capturer
+	conn uint32
+	logf func(string, ...interface{})
+
+	in, out framer
+}
+
+func (cc *captureConn) Read(b []byte) (int, error) {
+	n, err := cc.ReadWriteCloser.Read(b)
+	if n > 0 {
+		cc.in.add(cc, b[:n])
+	}
+	return n, err
+}
+
+func (cc *captureConn) Write(b []byte) (int, error) {
+	n, err := cc.ReadWriteCloser.Write(b)
+	if n > 0 {
+		cc.out.add(cc, b[:n])
+	}
+	return n, err
+}
+
+// A framer puts the bytes going one way through a connection back
+// together into messages.
+type framer struct {
+	out bool
+
+	// mu guards below.
+	mu sync.Mutex
+	b  []byte
+	// done is set once the capture of this way has stopped.
+	done bool
+}
+
+// add adds b to what has gone f's way, and captures the messages it
+// completes.
+func (f *framer) add(cc *captureConn, b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return
+	}
+	f.b = append(f.b, b...)
+	var used int
+	for m := f.b; len(m) >= 4; {
+		sz := binary.LittleEndian.Uint32(m)
+		if sz < 7 || sz > MSIZE {
+			// The server will have none of it either.
+			cc.logf("capture stopped: bad message size %d", sz)
+			f.done, f.b = true, nil
+			return
+		}
+		if uint32(len(m)) < sz {
+			break
+		}
+		if err := cc.cp.write(cc.conn, f.out, m[:sz]); err != nil {
+			cc.logf("capture stopped: %v", err)
+			f.done, f.b = true, nil
+			return
+		}
+		m = m[sz:]
+		used += int(sz)
+	}
+	f.b = append(f.b[:0], f.b[used:]...)
+}
+
+// ReadCapture reads a capture written for WithCapture. A capture cut
+// short gives the entries which are whole, and io.ErrUnexpectedEOF.
+func ReadCapture(r io.Reader) ([]CaptureEntry, error) {
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != captureMagic {
+		return nil, errors.New("not a 9p capture")
+	}
+	var es []CaptureEntry
+	for {
+		var h [17]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return es, err
+		}
+		if h[0] != '<' && h[0] != '>' {
+			return es, fmt.Errorf("capture entry %d: bad direction %q", len(es), h[0])
+		}
+		sz := binary.LittleEndian.Uint32(h[13:])
+		if sz < 7 || sz > MSIZE {
+			return es, fmt.Errorf("capture entry %d: bad message size %d", len(es), sz)
+		}
+		e := CaptureEntry{
+			Conn: binary.LittleEndian.Uint32(h[1:]),
+			RecordEntry: RecordEntry{
+				Time: time.Unix(0, int64(binary.LittleEndian.Uint64(h[5:]))),
+				Out:  h[0] == '>',
+				Data: make([]byte, sz),
+			},
+		}
+		copy(e.Data, h[13:])
+		if _, err := io.ReadFull(r, e.Data[4:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return es, err
+		}
+		es = append(es, e)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readRaw reads one message from c, whole, as it came.
+func readRaw(t *testing.T, c net.Conn) []byte {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	var l [4]byte
+	if _, err := io.ReadFull(c, l[:]); err != nil {
+		t.Fatalf("reading a reply: %v", err)
+	}
+	m := make([]byte, binary.LittleEndian.Uint32(l[:]))
+	copy(m, l[:])
+	if _, err := io.ReadFull(c, m[4:]); err != nil {
+		t.Fatalf("reading a reply: %v", err)
+	}
+	return m
+}
+
+func TestCapture(t *testing.T) {
+	var capture bytes.Buffer
+	l, err := NewNetListener(func() NineServer { return recorded{newEcho()} }, WithCapture(&capture))
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+
+	// Two connections, one of which sends its messages a byte at a
+	// time, and what each sent and got.
+	var sent, got [2]bytes.Buffer
+	var cs [2]net.Conn
+	for i := range cs {
+		p, p2 := net.Pipe()
+		if err := l.Accept(p2); err != nil {
+			t.Fatalf("Accept: want nil, got %v", err)
+		}
+		cs[i] = p
+	}
+	rpc := func(i int, b *bytes.Buffer) {
+		t.Helper()
+		m := b.Bytes()
+		sent[i].Write(m)
+		if i == 0 {
+			for j := range m {
+				if _, err := cs[i].Write(m[j : j+1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		} else if _, err := cs[i].Write(m); err != nil {
+			t.Fatal(err)
+		}
+		got[i].Write(readRaw(t, cs[i]))
+		b.Reset()
+	}
+	var b bytes.Buffer
+	for i := range cs {
+		MarshalTversionPkt(&b, NOTAG, 8192, Version)
+		rpc(i, &b)
+	}
+	MarshalTattachPkt(&b, 1, 2, NOFID, "glenda", "")
+	rpc(0, &b)
+	MarshalTattachPkt(&b, 1, 2, NOFID, "glenda", "")
+	rpc(1, &b)
+	MarshalTreadPkt(&b, 2, 2, 0, 100)
+	rpc(0, &b)
+	MarshalTclunkPkt(&b, 3, 2)
+	rpc(0, &b)
+	for _, c := range cs {
+		c.Close()
+	}
+	for start := time.Now(); len(l.Conns()) > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("connections not done with after the clients went away")
+		}
+	}
+
+	es, err := ReadCapture(bytes.NewReader(capture.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadCapture: want nil, got %v", err)
+	}
+	// The capture has each message, whole, and what each connection
+	// read and wrote is what its client sent and got.
+	var in, out [2]bytes.Buffer
+	var recs [2][]RecordEntry
+	for i, e := range es {
+		if e.Conn < 1 || e.Conn > 2 {
+			t.Fatalf("entry %d: connection %d, want 1 or 2", i, e.Conn)
+		}
+		if int(binary.LittleEndian.Uint32(e.Data)) != len(e.Data) {
+			t.Errorf("entry %d: %d bytes, not a whole message: %v", i, len(e.Data), e.Data)
+		}
+		c := e.Conn - 1
+		if e.Out {
+			out[c].Write(e.Data)
+		} else {
+			in[c].Write(e.Data)
+		}
+		recs[c] = append(recs[c], e.RecordEntry)
+	}
+	for i := range cs {
+		if !bytes.Equal(in[i].Bytes(), sent[i].Bytes()) {
+			t.Errorf("connection %d: captured requests\n%v\nwant what was sent\n%v", i+1, in[i].Bytes(), sent[i].Bytes())
+		}
+		if !bytes.Equal(out[i].Bytes(), got[i].Bytes()) {
+			t.Errorf("connection %d: captured replies\n%v\nwant what was got\n%v", i+1, out[i].Bytes(), got[i].Bytes())
+		}
+	}
+
+	// A connection's entries are a record, for Replay.
+	if err := Replay(recs[0], recorded{newEcho()}); err != nil {
+		t.Errorf("Replay of connection 1: %v", err)
+	}
+
+	cut, err := ReadCapture(bytes.NewReader(capture.Bytes()[:capture.Len()-1]))
+	if err != io.ErrUnexpectedEOF || len(cut) != len(es)-1 {
+		t.Errorf("ReadCapture of a cut capture: got (%d entries, %v), want (%d, %v)", len(cut), err, len(es)-1, io.ErrUnexpectedEOF)
+	}
+	if _, err := ReadCapture(strings.NewReader("not a capture at all")); err == nil {
+		t.Error("ReadCapture of something else: want an error, got nil")
+	}
+}
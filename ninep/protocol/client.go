@@ -8,13 +8,26 @@ package protocol
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
+	"net"
 	"runtime"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// MaxWElem is the most path elements one Twalk may hold.
+const MaxWElem = 16
+
+// ErrWouldBlock is what TryRead returns when the server doesn't answer
+// before its context's deadline.
+var ErrWouldBlock = &Error{"operation would block", EAGAIN}
+
 // Client implements a 9p client. It has a chan containing all tags,
 // a scalar FID which is incremented to provide new FIDS (all FIDS for a given
 // client are unique), an array of MaxTag-2 RPC structs, a ReadWriteCloser
@@ -22,6 +35,10 @@ import (
 // pushed and another from which RPCReplys return.
 // Once a client is marked Dead all further requests to it will fail.
 // The ToNet/FromNet are separate so we can use io.Pipe for testing.
+//
+// Msize is what the last Tversion settled on, or, until there has been
+// one, what the ClientOpts set; 0 means no limit. No Tread or Twrite
+// bigger than it is sent: see fit.
 type Client struct {
 	Tags       chan Tag
 	FID        uint64
@@ -33,6 +50,25 @@ type Client struct {
 	Msize      uint32
 	Dead       bool
 	Trace      Tracer
+
+	// dial, if set, is how the Client was connected by Dial, for Redial.
+	dial *dialer
+
+	// mu guards below.
+	mu sync.Mutex
+
+	// root is the FID Attach attached, which Walk walks from, or NOFID.
+	root FID
+
+	// attached is how Attach made root, for Redial to do again.
+	attached *attachment
+}
+
+// attachment is how a Client's root was made.
+type attachment struct {
+	msize        MaxSize
+	version      string
+	uname, aname string
 }
 
 func NewClient(opts ...ClientOpt) (*Client, error) {
@@ -43,6 +79,7 @@ func NewClient(opts ...ClientOpt) (*Client, error) {
 		c.Tags <- Tag(i)
 	}
 	c.FID = 1
+	c.root = NOFID
 	c.RPC = make([]*RPCCall, NumTags)
 	for _, o := range opts {
 		if err := o(c); err != nil {
@@ -74,6 +111,148 @@ func (c *Client) GetFID() FID {
 	return FID(atomic.AddUint64(&c.FID, 1))
 }
 
+// WalkTo walks from fid to path, a slash-separated list of names
+// relative to fid, and returns a new fid for where it ends up, with
+// the QIDs of the elements walked. Paths with more than MaxWElem
+// elements take several Twalks, each from the fid the last one made;
+// those fids are clunked on the way. If the walk fails part way, no
+// fid is returned, and the QIDs are those of the elements that were
+// walked. An empty path clones fid.
+func (c *Client) WalkTo(fid FID, path string) (FID, []QID, error) {
+	var names []string
+	for _, n := range strings.Split(path, "/") {
+		if n != "" {
+			names = append(names, n)
+		}
+	}
+
+	var qids []QID
+	from := fid
+	for first := true; first || len(names) > 0; first = false {
+		n := len(names)
+		if n > MaxWElem {
+			n = MaxWElem
+		}
+		newfid := c.GetFID()
+		q, err := c.CallTwalk(from, newfid, names[:n])
+		if from != fid {
+			c.CallTclunk(from)
+		}
+		if err != nil {
+			return NOFID, qids, err
+		}
+		qids = append(qids, q...)
+		if len(q) < n {
+			return NOFID, qids, fmt.Errorf("walk %q: can't walk to %q", path, names[len(q)])
+		}
+		from, names = newfid, names[n:]
+	}
+	return from, qids, nil
+}
+
+// Attach starts a session on c, and gives it a root: it does Tversion,
+// offering msize and version, and then attaches a new FID to aname, as
+// uname, which is returned by Root and walked from by Walk from then on.
+// The root belongs to c, and must not be clunked, walked with a Twalk
+// that moves it, or opened; clone it with Walk first.
+//
+// Tversion ends everything the session had, so the root from an
+// earlier Attach, and every FID walked from it, are gone; so are they
+// when the connection is. Redial attaches again, as Attach did, so the
+// new Client has a root of its own before it is returned.
+func (c *Client) Attach(msize MaxSize, version, uname, aname string) (QID, error) {
+	c.mu.Lock()
+	c.root, c.attached = NOFID, nil
+	c.mu.Unlock()
+	m, v, err := c.CallTversion(msize, version)
+	if err != nil {
+		return QID{}, err
+	}
+	if v == "unknown" {
+		return QID{}, fmt.Errorf("Attach: server doesn't speak %v", version)
+	}
+	root := c.GetFID()
+	q, err := c.CallTattach(root, NOFID, uname, aname)
+	if err != nil {
+		return QID{}, err
+	}
+	c.mu.Lock()
+	c.root, c.attached = root, &attachment{msize: m, version: v, uname: uname, aname: aname}
+	c.mu.Unlock()
+	return q, nil
+}
+
+// Root returns the FID Attach attached, or NOFID if it hasn't.
+func (c *Client) Root() FID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.root
+}
+
+// Walk is WalkTo from Root: it clones the root, rather than attaching
+// again, and walks to path. A path is taken from the root whether it
+// starts with a slash or not, so "/a/b" and "a/b" are the same file.
+// An empty path, or "/", clones the root. The FID returned is the
+// caller's, to clunk when done with.
+func (c *Client) Walk(path string) (FID, []QID, error) {
+	root := c.Root()
+	if root == NOFID {
+		return NOFID, nil, fmt.Errorf("walk %q: not attached", path)
+	}
+	return c.WalkTo(root, path)
+}
+
+// TryRead is CallTread, but gives up waiting for the Rread when ctx is
+// done, so that a caller polling a file, e.g. from an event loop, can
+// back off and try again: it returns ErrWouldBlock if ctx's deadline
+// passed, and ctx.Err() if it was cancelled. It is still a round trip
+// to the server, only a bounded one. The Tread is flushed when ctx is
+// done, and TryRead waits for the Rflush, so that the tag is free to
+// use again when it returns; if the Rread beats the Rflush, its data is
+// returned all the same.
+func (c *Client) TryRead(ctx context.Context, fid FID, o Offset, n Count) ([]byte, error) {
+	var b bytes.Buffer
+	if c.Trace != nil {
+		c.Trace("%v, until %v", Tread, ctx)
+	}
+	MarshalTreadPkt(&b, 0, fid, o, n)
+	// IO mustn't block handing over a reply nobody waits for.
+	r := make(chan []byte, 1)
+	sent := make(chan Tag, 1)
+	c.FromClient <- &RPCCall{b: b.Bytes(), Reply: r, sent: sent}
+	var bb []byte
+	select {
+	case bb = <-r:
+	case <-ctx.Done():
+		// The spec has a server answer a Tread before the Tflush,
+		// if it does at all, so once the Rflush is in, the Rread is
+		// in r, and its tag back in c.Tags, or there won't be one,
+		// and the tag is ours to give back.
+		t := <-sent
+		if err := c.CallTflush(t); err != nil {
+			return nil, err
+		}
+		select {
+		case bb = <-r:
+		default:
+			c.Tags <- t
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, ErrWouldBlock
+			}
+			return nil, ctx.Err()
+		}
+	}
+	if MType(bb[4]) == Rerror {
+		s, _, err := UnmarshalRerrorPkt(bytes.NewBuffer(bb[5:]))
+		if err != nil {
+			return nil, err
+		}
+		return nil, clientError(s)
+	}
+	data, _, err := UnmarshalRreadPkt(bytes.NewBuffer(bb[5:]))
+	return data, err
+}
+
 func (c *Client) readNetPackets() {
 	if c.FromNet == nil {
 		if c.Trace != nil {
@@ -130,10 +309,14 @@ func (c *Client) IO() {
 			}
 			r.b[5] = uint8(t)
 			r.b[6] = uint8(t >> 8)
+			r.b = c.fit(r.b)
 			if c.Trace != nil {
 				c.Trace(fmt.Sprintf("Tag for request is %v", t))
 			}
 			c.RPC[int(t)-1] = r
+			if r.sent != nil {
+				r.sent <- t
+			}
 			if c.Trace != nil {
 				c.Trace("Write %v to ToNet", r.b)
 			}
@@ -146,7 +329,11 @@ func (c *Client) IO() {
 	}()
 
 	for {
-		r := <-c.FromServer
+		r, ok := <-c.FromServer
+		if !ok {
+			// readNetPackets has given up on the connection.
+			return
+		}
 		if c.Trace != nil {
 			c.Trace("Read %v FromServer", r.b)
 		}
@@ -160,16 +347,210 @@ func (c *Client) IO() {
 		if int(t-1) >= len(c.RPC) {
 			panic(fmt.Sprintf("tag %d >= len(c.RPC) %d", t, len(c.RPC)))
 		}
-		c.Trace("RPC %v ", c.RPC[t-1])
 		rrr := c.RPC[t-1]
-		c.Trace("rrr %v ", rrr)
+		if c.Trace != nil {
+			c.Trace("rrr %v ", rrr)
+		}
+		if MType(r.b[4]) == Rversion && len(r.b) >= 11 {
+			// Set it before the caller hears of it, so that what it
+			// sends next fits.
+			atomic.StoreUint32(&c.Msize, uint32(r.b[7])|uint32(r.b[8])<<8|uint32(r.b[9])<<16|uint32(r.b[10])<<24)
+		}
 		rrr.Reply <- r.b
 		c.Tags <- t
 	}
 }
 
+// maxData returns the most data a Tread may ask for, or a Twrite
+// carry, with c's msize, or 0 if there is no limit.
+func (c *Client) maxData() Count {
+	m := atomic.LoadUint32(&c.Msize)
+	if m <= IOHDRSZ {
+		return 0
+	}
+	return Count(m - IOHDRSZ)
+}
+
+// fit returns the message b cut down, if it is a Tread or Twrite with
+// more data than maxData allows, to one which has no more: the count
+// of a Tread is lowered, and the data of a Twrite cut short, so that
+// the reply says it was. Since it is done as each message is sent,
+// with the msize of the moment, an operation which spans a Tversion
+// that lowers it is sized for the new msize from then on.
+func (c *Client) fit(b []byte) []byte {
+	max := c.maxData()
+	if max == 0 || len(b) < 23 {
+		return b
+	}
+	switch MType(b[4]) {
+	case Tread:
+		if n := uint32(b[19]) | uint32(b[20])<<8 | uint32(b[21])<<16 | uint32(b[22])<<24; n > uint32(max) {
+			putCount(b[19:], max)
+		}
+	case Twrite:
+		if len(b)-23 > int(max) {
+			b = b[:23+int(max)]
+			putCount(b, Count(len(b)))
+			putCount(b[19:], max)
+		}
+	}
+	return b
+}
+
+// putCount puts n into b, little-endian, as 9P has it.
+func putCount(b []byte, n Count) {
+	b[0], b[1], b[2], b[3] = byte(n), byte(n>>8), byte(n>>16), byte(n>>24)
+}
+
+// Read reads n bytes of fid at o, in as many Treads as msize needs,
+// and returns what it read: less than n if a read comes up short, as
+// at the end of the file, other than because a Tversion lowered
+// msize while it was going on.
+func (c *Client) Read(fid FID, o Offset, n Count) ([]byte, error) {
+	var b []byte
+	for Count(len(b)) < n {
+		asked := n - Count(len(b))
+		if max := c.maxData(); max > 0 && asked > max {
+			asked = max
+		}
+		d, err := c.CallTread(fid, o+Offset(len(b)), asked)
+		b = append(b, d...)
+		if err != nil {
+			return b, err
+		}
+		if got := Count(len(d)); got < asked && (c.maxData() == 0 || got < c.maxData()) {
+			break
+		}
+	}
+	return b, nil
+}
+
+// Write writes all of b to fid at o, in as many Twrites as msize
+// needs, and returns how much was written. A Twrite which writes
+// nothing ends it, with io.ErrShortWrite.
+func (c *Client) Write(fid FID, o Offset, b []byte) (Count, error) {
+	var tot Count
+	for int(tot) < len(b) {
+		d := b[tot:]
+		if max := c.maxData(); max > 0 && Count(len(d)) > max {
+			d = d[:max]
+		}
+		n, err := c.CallTwrite(fid, o+Offset(tot), d)
+		if n > 0 {
+			tot += n
+		}
+		if err != nil {
+			return tot, err
+		}
+		if n <= 0 {
+			return tot, io.ErrShortWrite
+		}
+	}
+	return tot, nil
+}
+
 func (c *Client) String() string {
 	z := map[bool]string{false: "Alive", true: "Dead"}
-	return fmt.Sprintf("%v tags available, Msize %v, %v FromNet %v ToNet %v", len(c.Tags), c.Msize, z[c.Dead],
+	return fmt.Sprintf("%v tags available, Msize %v, %v FromNet %v ToNet %v", len(c.Tags), atomic.LoadUint32(&c.Msize), z[c.Dead],
 		c.FromNet, c.ToNet)
 }
+
+// Backoff says how Dial and Redial retry a failed dial. They wait
+// between attempts, starting at 5ms and doubling each time up to Max,
+// with some jitter so that clients dropped together don't all come
+// back together.
+type Backoff struct {
+	// Max is the longest to wait between attempts; 0 means a second.
+	Max time.Duration
+	// Attempts is how many dials to try before giving up and returning
+	// the last error; 0 means keep trying.
+	Attempts int
+	// Notify, if set, is called after each failed attempt, with its
+	// number, starting at 1, and its error.
+	Notify func(attempt int, err error)
+}
+
+type dialer struct {
+	dial func() (net.Conn, error)
+	b    Backoff
+	opts []ClientOpt
+}
+
+// Dial connects to a server with dial, retrying as b says, and returns
+// a Client for the connection, set up by opts. The Client can Redial.
+func Dial(dial func() (net.Conn, error), b Backoff, opts ...ClientOpt) (*Client, error) {
+	d := &dialer{dial: dial, b: b, opts: opts}
+	return d.connect()
+}
+
+// Redial closes c's connection, if it's still open, and connects again
+// the way Dial did, returning a new Client to use in place of c, which
+// must not be used again. If c was given a root by Attach, the new
+// Client attaches again in the same way, with the msize and version
+// c's server settled on, and has a root of its own; if not, it must
+// do its own Tversion and Tattach. No other FID survives from c.
+func (c *Client) Redial() (*Client, error) {
+	if c.dial == nil {
+		return nil, fmt.Errorf("Redial: client was not made by Dial")
+	}
+	if c.ToNet != nil {
+		c.ToNet.Close()
+	}
+	nc, err := c.dial.connect()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	a := c.attached
+	c.mu.Unlock()
+	if a == nil {
+		return nc, nil
+	}
+	if _, err := nc.Attach(a.msize, a.version, a.uname, a.aname); err != nil {
+		nc.ToNet.Close()
+		return nil, fmt.Errorf("Redial: %w", err)
+	}
+	return nc, nil
+}
+
+func (d *dialer) connect() (*Client, error) {
+	for attempt := 1; ; attempt++ {
+		conn, err := d.dial()
+		if err == nil {
+			opts := append([]ClientOpt{func(c *Client) error {
+				c.FromNet, c.ToNet, c.dial = conn, conn, d
+				return nil
+			}}, d.opts...)
+			c, err := NewClient(opts...)
+			if err != nil {
+				conn.Close()
+			}
+			return c, err
+		}
+		if d.b.Notify != nil {
+			d.b.Notify(attempt, err)
+		}
+		if d.b.Attempts > 0 && attempt >= d.b.Attempts {
+			return nil, err
+		}
+		time.Sleep(d.b.Delay(attempt))
+	}
+}
+
+// Delay returns how long to wait after failed attempt n, counting from
+// 1, before trying again: somewhere between half of, and all of, 5ms
+// doubled n-1 times, up to Max.
+func (b Backoff) Delay(n int) time.Duration {
+	max := b.Max
+	if max == 0 {
+		max = 1 * time.Second
+	}
+	delay := 5 * time.Millisecond
+	for i := 1; i < n && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// NullDir is the Dir a Twstat sends to change nothing: every integer is
+// all ones and every string is empty. A Twstat changes only the fields
+// which differ from NullDir's, and one which is NullDir itself asks for
+// the file to be committed to stable storage.
+var NullDir = Dir{
+	Type:   ^uint16(0),
+	Dev:    ^uint32(0),
+	QID:    QID{Type: ^uint8(0), Version: ^uint32(0), Path: ^uint64(0)},
+	Mode:   ^uint32(0),
+	Atime:  ^uint32(0),
+	Mtime:  ^uint32(0),
+	Length: ^uint64(0),
+}
+
+// NullDirU is NullDir with the 9P2000.u extensions, which are left
+// alone too.
+var NullDirU = DirU{Dir: NullDir, NUid: NOUID, NGid: NOUID, NMuid: NOUID}
+
+// Marshal returns d as a stat, as Rstat returns it.
+func (d Dir) Marshal() []byte {
+	var b bytes.Buffer
+	Marshaldir(&b, d)
+	return b.Bytes()
+}
+
+// Unmarshal sets d from the stat in b. What follows the fields of a
+// Dir, e.g. the rest of a 9P2000.u stat, is ignored.
+func (d *Dir) Unmarshal(b []byte) error {
+	if err := statSize(b); err != nil {
+		return err
+	}
+	nd, err := Unmarshaldir(bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	*d = nd
+	return nil
+}
+
+// IsNull reports whether d is NullDir, i.e. a Twstat of d changes
+// nothing.
+func (d Dir) IsNull() bool {
+	return d == NullDir
+}
+
+// Apply returns d with the changes a Twstat of w asks for made: each
+// field of w which isn't NullDir's replaces d's.
+func (d Dir) Apply(w Dir) Dir {
+	if w.Type != NullDir.Type {
+		d.Type = w.Type
+	}
+	if w.Dev != NullDir.Dev {
+		d.Dev = w.Dev
+	}
+	if w.QID != NullDir.QID {
+		d.QID = w.QID
+	}
+	if w.Mode != NullDir.Mode {
+		d.Mode = w.Mode
+	}
+	if w.Atime != NullDir.Atime {
+		d.Atime = w.Atime
+	}
+	if w.Mtime != NullDir.Mtime {
+		d.Mtime = w.Mtime
+	}
+	if w.Length != NullDir.Length {
+		d.Length = w.Length
+	}
+	if w.Name != "" {
+		d.Name = w.Name
+	}
+	if w.User != "" {
+		d.User = w.User
+	}
+	if w.Group != "" {
+		d.Group = w.Group
+	}
+	if w.ModUser != "" {
+		d.ModUser = w.ModUser
+	}
+	return d
+}
+
+// Marshal returns d as a 9P2000.u stat.
+func (d DirU) Marshal() []byte {
+	var b bytes.Buffer
+	MarshalDirU(&b, d)
+	return b.Bytes()
+}
+
+// Unmarshal sets d from the 9P2000.u stat in b.
+func (d *DirU) Unmarshal(b []byte) error {
+	if err := statSize(b); err != nil {
+		return err
+	}
+	nd, err := UnmarshalDirU(bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	*d = nd
+	return nil
+}
+
+// IsNull reports whether d is NullDirU, i.e. a Twstat of d changes
+// nothing.
+func (d DirU) IsNull() bool {
+	return d == NullDirU
+}
+
+// Apply is Dir.Apply, for the 9P2000.u fields too.
+func (d DirU) Apply(w DirU) DirU {
+	d.Dir = d.Dir.Apply(w.Dir)
+	if w.Extension != "" {
+		d.Extension = w.Extension
+	}
+	if w.NUid != NOUID {
+		d.NUid = w.NUid
+	}
+	if w.NGid != NOUID {
+		d.NGid = w.NGid
+	}
+	if w.NMuid != NOUID {
+		d.NMuid = w.NMuid
+	}
+	return d
+}
+
+// statSize checks that b holds as much as the size which starts it
+// says it does.
+func statSize(b []byte) error {
+	if len(b) < 2 {
+		return fmt.Errorf("stat too short for its size: have %d bytes", len(b))
+	}
+	if n := int(b[0]) | int(b[1])<<8; n > len(b)-2 {
+		return fmt.Errorf("stat size is %d, have %d bytes", n, len(b)-2)
+	}
+	return nil
+}
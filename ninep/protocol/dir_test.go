@@ -0,0 +1,93 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDirMarshal(t *testing.T) {
+	for _, d := range []Dir{{}, wireDirDir, NullDir, {Name: longDirName}} {
+		var got Dir
+		if err := got.Unmarshal(d.Marshal()); err != nil || !reflect.DeepEqual(got, d) {
+			t.Errorf("round trip of %v: got (%v, %v)", abbrev(d), abbrev(got), err)
+		}
+	}
+	if b := wireDirDir.Marshal(); !bytes.Equal(b, wireDir) {
+		t.Errorf("Marshal: got\n%v\nwant\n%v", b, wireDir)
+	}
+	for _, d := range []DirU{{}, dirU, NullDirU} {
+		var got DirU
+		if err := got.Unmarshal(d.Marshal()); err != nil || !reflect.DeepEqual(got, d) {
+			t.Errorf("round trip of %v: got (%v, %v)", d, got, err)
+		}
+	}
+
+	// A 9P2000.u stat is a 9P2000 one with more on the end.
+	var d Dir
+	if err := d.Unmarshal(wireDirU); err != nil || !reflect.DeepEqual(d, dirU.Dir) {
+		t.Errorf("Dir.Unmarshal of a 9P2000.u stat: want (%v, nil), got (%v, %v)", dirU.Dir, d, err)
+	}
+
+	// The size must not claim more than there is.
+	for i := range wireDir {
+		if err := d.Unmarshal(wireDir[:i]); err == nil {
+			t.Errorf("Unmarshal of %d bytes of %d: want error, got nil", i, len(wireDir))
+		}
+	}
+}
+
+func TestNullDir(t *testing.T) {
+	// Every integer all ones, every string empty.
+	want := append(le16(47), bytes.Repeat([]byte{0xff}, 2+4+13+4+4+4+8)...)
+	want = append(want, 0, 0, 0, 0, 0, 0, 0, 0)
+	if b := NullDir.Marshal(); !bytes.Equal(b, want) {
+		t.Errorf("NullDir.Marshal: got\n%v\nwant\n%v", b, want)
+	}
+	if !NullDir.IsNull() || !NullDirU.IsNull() {
+		t.Errorf("NullDir and NullDirU: want IsNull")
+	}
+	d := NullDir
+	d.Mode = 0644
+	if d.IsNull() || (DirU{Dir: d, NUid: NOUID, NGid: NOUID, NMuid: NOUID}).IsNull() {
+		t.Errorf("%v: want !IsNull", d)
+	}
+	du := NullDirU
+	du.NGid = 100
+	if du.IsNull() {
+		t.Errorf("%v: want !IsNull", du)
+	}
+	if old := wireDirDir; !reflect.DeepEqual(old.Apply(NullDir), old) {
+		t.Errorf("Apply(NullDir): got %v, want %v", old.Apply(NullDir), old)
+	}
+}
+
+func TestWstatRename(t *testing.T) {
+	// The classic rename: everything but the name left alone.
+	w := NullDir
+	w.Name = "new"
+	var got Dir
+	if err := got.Unmarshal(w.Marshal()); err != nil || got.IsNull() || got.Name != "new" {
+		t.Fatalf("Unmarshal of a rename: got (%v, %v)", got, err)
+	}
+	old := wireDirDir
+	want := old
+	want.Name = "new"
+	if d := old.Apply(got); !reflect.DeepEqual(d, want) {
+		t.Errorf("Apply(rename): got %v, want %v", d, want)
+	}
+
+	// A truncation and chmod together, with a gid, in 9P2000.u.
+	wu := NullDirU
+	wu.Length, wu.Mode, wu.NGid = 0, 0600, 10
+	oldU := dirU
+	wantU := oldU
+	wantU.Length, wantU.Mode, wantU.NGid = 0, 0600, 10
+	if d := oldU.Apply(wu); !reflect.DeepEqual(d, wantU) {
+		t.Errorf("DirU.Apply: got %v, want %v", d, wantU)
+	}
+}
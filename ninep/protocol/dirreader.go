@@ -0,0 +1,79 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"fmt"
+	"io"
+)
+
+// A DirReader answers Treads of a directory, whose data is its entries
+// as stat structures. The protocol says each Rread must hold a whole
+// number of them, and each Tread after the first must start where the
+// one before it left off, or else at 0 to start again. DirReader keeps
+// to that, given the directory's entries one at a time.
+//
+// A NineServer keeps a DirReader for each FID open on a directory.
+// Requests on a FID are run one at a time, so it needs no lock.
+type DirReader struct {
+	// Open starts reading the directory, from its first entry, and
+	// returns a function which returns each entry in turn, marshaled,
+	// e.g. by Marshaldir, and then io.EOF. It is called for each read
+	// at offset 0.
+	Open func() (next func() ([]byte, error), err error)
+
+	next    func() ([]byte, error)
+	pending []byte // an entry which didn't fit in the last read
+	offset  Offset // where the next read must start
+	eof     bool
+}
+
+// Read returns the entries for a Tread at offset o of up to c bytes:
+// as many whole entries as fit in c, and none once they have all been
+// read. It is an error if the next entry is bigger than c, or if o is
+// neither 0 nor where the last read left off.
+func (d *DirReader) Read(o Offset, c Count) ([]byte, error) {
+	if o == 0 {
+		next, err := d.Open()
+		if err != nil {
+			return nil, err
+		}
+		d.next, d.pending, d.offset, d.eof = next, nil, 0, false
+	} else if d.next == nil || o != d.offset {
+		return nil, fmt.Errorf("bad offset %d in directory read: want 0 or %d", o, d.offset)
+	}
+
+	var b []byte
+	for !d.eof {
+		e := d.pending
+		if e == nil {
+			var err error
+			if e, err = d.next(); err == io.EOF {
+				d.eof = true
+				break
+			} else if err != nil {
+				if len(b) > 0 {
+					// Send what we have, and the error next time.
+					d.pending = nil
+					d.next = func() ([]byte, error) { return nil, err }
+					break
+				}
+				return nil, err
+			}
+		}
+		if len(b)+len(e) > int(c) {
+			// Keep it for the next read, which may have room.
+			d.pending = e
+			if len(b) == 0 {
+				return nil, fmt.Errorf("directory entry of %d bytes won't fit in a read of %d", len(e), c)
+			}
+			break
+		}
+		b = append(b, e...)
+		d.pending = nil
+	}
+	d.offset += Offset(len(b))
+	return b, nil
+}
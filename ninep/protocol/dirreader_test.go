@@ -0,0 +1,165 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// dirEntries returns n marshaled Dirs, of different lengths.
+func dirEntries(n int) [][]byte {
+	var es [][]byte
+	for i := 0; i < n; i++ {
+		var b bytes.Buffer
+		Marshaldir(&b, Dir{Name: strings.Repeat("x", i%13) + fmt.Sprint(i), User: "harvey", QID: QID{Path: uint64(i)}})
+		es = append(es, b.Bytes())
+	}
+	return es
+}
+
+// entriesReader returns a DirReader of es, which counts its Opens.
+func entriesReader(es [][]byte, opens *int) *DirReader {
+	return &DirReader{Open: func() (func() ([]byte, error), error) {
+		*opens++
+		i := 0
+		return func() ([]byte, error) {
+			if i == len(es) {
+				return nil, io.EOF
+			}
+			i++
+			return es[i-1], nil
+		}, nil
+	}}
+}
+
+// readDir reads all of d, c bytes at a time, checking each read is of
+// whole entries, and returns their names.
+func readDir(t *testing.T, d *DirReader, c Count) []string {
+	t.Helper()
+	var names []string
+	var o Offset
+	for {
+		b, err := d.Read(o, c)
+		if err != nil {
+			t.Fatalf("Read(%d, %d): want nil, got %v", o, c, err)
+		}
+		if len(b) > int(c) {
+			t.Fatalf("Read(%d, %d): got %d bytes", o, c, len(b))
+		}
+		if len(b) == 0 {
+			return names
+		}
+		o += Offset(len(b))
+		for bb := bytes.NewBuffer(b); bb.Len() > 0; {
+			if bb.Len() < 2 || int(bb.Bytes()[0])|int(bb.Bytes()[1])<<8 > bb.Len()-2 {
+				t.Fatalf("Read(%d, %d): %d bytes left, not a whole entry", o, c, bb.Len())
+			}
+			d, err := Unmarshaldir(bb)
+			if err != nil {
+				t.Fatalf("Read(%d, %d): Unmarshaldir: %v", o, c, err)
+			}
+			names = append(names, d.Name)
+		}
+	}
+}
+
+func TestDirReader(t *testing.T) {
+	es := dirEntries(100)
+	var want []string
+	total := 0
+	for i, e := range es {
+		want = append(want, strings.Repeat("x", i%13)+fmt.Sprint(i))
+		total += len(e)
+	}
+	var opens int
+	d := entriesReader(es, &opens)
+	// From a read just big enough for the biggest entry to one for
+	// them all, and over.
+	for _, c := range []Count{76, 100, 200, 1000, Count(total), Count(total) + 1, 8192} {
+		got := readDir(t, d, c)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("reads of %d: got %v, want %v", c, got, want)
+		}
+	}
+	if opens != 7 {
+		t.Errorf("Opens: want one for each time through, 7, got %d", opens)
+	}
+
+	// Part way through, a read at 0 starts again.
+	first, err := d.Read(0, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Read(Offset(len(first)), 300); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := d.Read(0, 300); err != nil || !bytes.Equal(again, first) {
+		t.Errorf("Read at 0 again: want the first %d bytes again, got %d, %v", len(first), len(again), err)
+	}
+
+	// Anywhere else is an error.
+	for _, o := range []Offset{1, Offset(len(first)) - 1, Offset(len(first)) + 1} {
+		if _, err := d.Read(o, 300); err == nil {
+			t.Errorf("Read at %d, with the last read ending at %d: want an error, got nil", o, len(first))
+		}
+	}
+	if _, err := (&DirReader{}).Read(10, 300); err == nil {
+		t.Errorf("Read at 10 before one at 0: want an error, got nil")
+	}
+}
+
+func TestDirReaderBigEntry(t *testing.T) {
+	es := dirEntries(3)
+	var opens int
+	d := entriesReader(es, &opens)
+	if b, err := d.Read(0, Count(len(es[0])-1)); err == nil {
+		t.Errorf("Read too small for an entry: want an error, got %d bytes", len(b))
+	}
+	// The entry isn't lost: a bigger read gets it.
+	b, err := d.Read(0, Count(len(es[0])))
+	if err != nil || !bytes.Equal(b, es[0]) {
+		t.Errorf("Read of just the first entry: want it, got %d bytes, %v", len(b), err)
+	}
+	if _, err := d.Read(Offset(len(b)), Count(len(es[1])-1)); err == nil {
+		t.Errorf("Read too small for the second entry: want an error, got nil")
+	}
+	if b2, err := d.Read(Offset(len(b)), 8192); err != nil || len(b2) != len(es[1])+len(es[2]) {
+		t.Errorf("Read of the rest: want %d bytes, got %d, %v", len(es[1])+len(es[2]), len(b2), err)
+	}
+}
+
+func TestDirReaderError(t *testing.T) {
+	es := dirEntries(3)
+	bad := errors.New("bad entry")
+	i := 0
+	d := &DirReader{Open: func() (func() ([]byte, error), error) {
+		i = 0
+		return func() ([]byte, error) {
+			if i == 2 {
+				return nil, bad
+			}
+			i++
+			return es[i-1], nil
+		}, nil
+	}}
+	// The entries before the error come first, and the error after.
+	b, err := d.Read(0, 8192)
+	if err != nil || len(b) != len(es[0])+len(es[1]) {
+		t.Fatalf("Read: want the 2 entries before the error, got %d bytes, %v", len(b), err)
+	}
+	if _, err := d.Read(Offset(len(b)), 8192); err != bad {
+		t.Errorf("Read after them: want %v, got %v", bad, err)
+	}
+
+	d.Open = func() (func() ([]byte, error), error) { return nil, bad }
+	if _, err := d.Read(0, 8192); err != bad {
+		t.Errorf("Read with Open failing: want %v, got %v", bad, err)
+	}
+}
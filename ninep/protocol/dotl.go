@@ -0,0 +1,164 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// 9P2000.L is the dialect Linux's v9fs prefers. It drops the 9P2000
+// open, create and stat messages in favour of ones that look like the
+// Linux system calls, and reports errors as an errno in Rlerror. It is
+// described in https://github.com/chaos/diod/blob/master/protocol.md.
+// Its messages are generated by gen.go, like the classic ones.
+const VersionL = "9P2000.L"
+
+// Lock types, for Tlock and Tgetlock.
+const (
+	LockTypeRdlck = 0
+	LockTypeWrlck = 1
+	LockTypeUnlck = 2
+)
+
+// Lock flags, for Tlock.
+const (
+	LockFlagsBlock   = 1
+	LockFlagsReclaim = 2
+)
+
+// Lock status, for Rlock.
+const (
+	LockSuccess = 0
+	LockBlocked = 1
+	LockError   = 2
+	LockGrace   = 3
+)
+
+// A NineServerL speaks 9P2000.L. It agrees to do so by returning
+// VersionL from Rversion; the protocol never offers VersionL to a
+// server which isn't a NineServerL. Tattach and Tauth are as in
+// 9P2000.u, and the classic Twalk, Tread, Twrite, Tclunk, Tremove and
+// Tflush are used as they are.
+// Flags and modes are as in Linux: Rlopen and Rlcreate are given the
+// flags to open(2), and modes include the file type, as in stat(2).
+type NineServerL interface {
+	NineServer
+	StatfsNineServer
+	Rlopen(ctx context.Context, fid FID, flags uint32) (QID, MaxSize, error)
+	// Rlcreate creates name in the directory fid, and opens it; fid
+	// then refers to the new file, as for Rcreate.
+	Rlcreate(ctx context.Context, fid FID, name string, flags, mode, gid uint32) (QID, MaxSize, error)
+	Rsymlink(ctx context.Context, dfid FID, name, target string, gid uint32) (QID, error)
+	Rmknod(ctx context.Context, dfid FID, name string, mode, major, minor, gid uint32) (QID, error)
+	// Rrename moves fid to name in the directory dfid.
+	Rrename(ctx context.Context, fid, dfid FID, name string) error
+	Rreadlink(ctx context.Context, fid FID) (string, error)
+	// Rgetattr returns the attributes of fid. mask, of Getattr bits,
+	// says which are wanted; the server may return more or fewer,
+	// and says which in Attr.Valid.
+	Rgetattr(ctx context.Context, fid FID, mask uint64) (Attr, error)
+	Rsetattr(ctx context.Context, fid FID, attr SetAttr) error
+	// Rxattrwalk sets up newfid to read the extended attribute name
+	// of fid, or the list of them if name is empty, and returns its size.
+	Rxattrwalk(ctx context.Context, fid, newfid FID, name string) (uint64, error)
+	// Rxattrcreate turns fid into one to be written with the value of
+	// the extended attribute name, which takes effect on Tclunk.
+	Rxattrcreate(ctx context.Context, fid FID, name string, size uint64, flags uint32) error
+	// Rreaddir returns up to count bytes of directory entries from the
+	// open directory fid, each marshaled by MarshalDirent, starting
+	// with the one after that whose Offset is offset.
+	Rreaddir(ctx context.Context, fid FID, offset Offset, count Count) ([]byte, error)
+	Rfsync(ctx context.Context, fid FID, datasync uint32) error
+	Rlock(ctx context.Context, fid FID, typ uint8, flags uint32, start, length uint64, procID uint32, clientID string) (uint8, error)
+	Rgetlock(ctx context.Context, fid FID, typ uint8, start, length uint64, procID uint32, clientID string) (uint8, uint64, uint64, uint32, string, error)
+	// Rlink makes name in the directory dfid a hard link to fid.
+	Rlink(ctx context.Context, dfid, fid FID, name string) error
+	Rmkdir(ctx context.Context, dfid FID, name string, mode, gid uint32) (QID, error)
+	Rrenameat(ctx context.Context, olddfid FID, oldname string, newdfid FID, newname string) error
+	// Runlinkat removes name from the directory dfid. flags may have
+	// AT_REMOVEDIR (0x200) set, as for unlinkat(2).
+	Runlinkat(ctx context.Context, dfid FID, name string, flags uint32) error
+}
+
+// Dirent is one entry in the data of an Rreaddir.
+type Dirent struct {
+	QID    QID
+	Offset uint64 // the offset to give Treaddir to start after this entry
+	Type   uint8  // the file type, as in the d_type of a Linux dirent
+	Name   string
+}
+
+// MarshalDirent appends d to b. Unlike the other Marshal functions,
+// it doesn't replace what's in b, so that entries can be strung together.
+func MarshalDirent(b *bytes.Buffer, d Dirent) {
+	b.WriteByte(d.QID.Type)
+	puint32(b, d.QID.Version)
+	puint64(b, d.QID.Path)
+	puint64(b, d.Offset)
+	b.WriteByte(d.Type)
+	pstring(b, d.Name)
+}
+
+// UnmarshalDirent takes one directory entry from the front of b.
+func UnmarshalDirent(b *bytes.Buffer) (d Dirent, err error) {
+	if b.Len() < QIDLen+8+1 {
+		return d, fmt.Errorf("pkt too short for Dirent: need %d, have %d", QIDLen+8+1, b.Len())
+	}
+	d.QID.Type, _ = b.ReadByte()
+	d.QID.Version, _ = guint32(b)
+	d.QID.Path, _ = guint64(b)
+	d.Offset, _ = guint64(b)
+	d.Type, _ = b.ReadByte()
+	d.Name, err = gstring(b)
+	return d, err
+}
+
+// dispatchL holds the server functions for the messages 9P2000.L adds.
+var dispatchL = map[MType]func(*Server, context.Context, *bytes.Buffer) error{
+	Tstatfs:      (*Server).SrvRstatfs,
+	Tlopen:       (*Server).SrvRlopen,
+	Tlcreate:     (*Server).SrvRlcreate,
+	Tsymlink:     (*Server).SrvRsymlink,
+	Tmknod:       (*Server).SrvRmknod,
+	Trename:      (*Server).SrvRrename,
+	Treadlink:    (*Server).SrvRreadlink,
+	Tgetattr:     (*Server).SrvRgetattr,
+	Tsetattr:     (*Server).SrvRsetattr,
+	Txattrwalk:   (*Server).SrvRxattrwalk,
+	Txattrcreate: (*Server).SrvRxattrcreate,
+	Treaddir:     (*Server).SrvRreaddir,
+	Tfsync:       (*Server).SrvRfsync,
+	Tlock:        (*Server).SrvRlock,
+	Tgetlock:     (*Server).SrvRgetlock,
+	Tlink:        (*Server).SrvRlink,
+	Tmkdir:       (*Server).SrvRmkdir,
+	Trenameat:    (*Server).SrvRrenameat,
+	Tunlinkat:    (*Server).SrvRunlinkat,
+}
+
+// notSupported is the error for a message the server doesn't handle.
+// It carries EOPNOTSUPP, which Linux takes as a cue to fall back to
+// an older message, e.g. from Tunlinkat to Tremove.
+type notSupported MType
+
+func (n notSupported) Error() string {
+	return fmt.Sprintf("Dispatch: %v not supported", RPCNames[MType(n)])
+}
+
+func puint64(b *bytes.Buffer, v uint64) {
+	puint32(b, uint32(v))
+	puint32(b, uint32(v>>32))
+}
+
+func guint64(b *bytes.Buffer) (uint64, error) {
+	if b.Len() < 8 {
+		return 0, fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+	}
+	lo, _ := guint32(b)
+	hi, _ := guint32(b)
+	return uint64(lo) | uint64(hi)<<32, nil
+}
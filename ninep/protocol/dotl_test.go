@@ -0,0 +1,514 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// The wire forms below were put together by hand, field by field,
+// from the 9P2000.L description.
+var (
+	wireRlerror = []byte{
+		11, 0, 0, 0, uint8(Rlerror), 1, 0,
+		2, 0, 0, 0, // ENOENT
+	}
+	wireTlopen = []byte{
+		15, 0, 0, 0, uint8(Tlopen), 1, 0,
+		3, 0, 0, 0, // fid
+		0x02, 0x80, 0, 0, // O_RDWR|O_LARGEFILE
+	}
+	wireTgetattr = []byte{
+		19, 0, 0, 0, uint8(Tgetattr), 1, 0,
+		3, 0, 0, 0, // fid
+		0xff, 0x07, 0, 0, 0, 0, 0, 0, // GetattrBasic
+	}
+	wireDirent = []byte{
+		QTDIR, 1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, // qid
+		3, 0, 0, 0, 0, 0, 0, 0, // offset
+		4,                   // DT_DIR
+		3, 0, 'u', 's', 'r', // name
+	}
+	dirent = Dirent{QID: QID{Type: QTDIR, Version: 1, Path: 2}, Offset: 3, Type: 4, Name: "usr"}
+)
+
+func TestDotLWire(t *testing.T) {
+	var b bytes.Buffer
+
+	MarshalRlerrorPkt(&b, 1, ENOENT)
+	if !bytes.Equal(b.Bytes(), wireRlerror) {
+		t.Errorf("MarshalRlerrorPkt: want %v, got %v", wireRlerror, b.Bytes())
+	}
+	errno, tag, err := UnmarshalRlerrorPkt(bytes.NewBuffer(wireRlerror[5:]))
+	if errno != ENOENT || tag != 1 || err != nil {
+		t.Errorf("UnmarshalRlerrorPkt: want (2, 1, nil), got (%v, %v, %v)", errno, tag, err)
+	}
+
+	MarshalTlopenPkt(&b, 1, 3, 0x8002)
+	if !bytes.Equal(b.Bytes(), wireTlopen) {
+		t.Errorf("MarshalTlopenPkt: want %v, got %v", wireTlopen, b.Bytes())
+	}
+	fid, flags, tag, err := UnmarshalTlopenPkt(bytes.NewBuffer(wireTlopen[5:]))
+	if fid != 3 || flags != 0x8002 || tag != 1 || err != nil {
+		t.Errorf("UnmarshalTlopenPkt: want (3, 0x8002, 1, nil), got (%v, %#x, %v, %v)", fid, flags, tag, err)
+	}
+
+	MarshalTgetattrPkt(&b, 1, 3, GetattrBasic)
+	if !bytes.Equal(b.Bytes(), wireTgetattr) {
+		t.Errorf("MarshalTgetattrPkt: want %v, got %v", wireTgetattr, b.Bytes())
+	}
+	fid, mask, tag, err := UnmarshalTgetattrPkt(bytes.NewBuffer(wireTgetattr[5:]))
+	if fid != 3 || mask != GetattrBasic || tag != 1 || err != nil {
+		t.Errorf("UnmarshalTgetattrPkt: want (3, %#x, 1, nil), got (%v, %#x, %v, %v)", GetattrBasic, fid, mask, tag, err)
+	}
+
+	b.Reset()
+	MarshalDirent(&b, dirent)
+	if !bytes.Equal(b.Bytes(), wireDirent) {
+		t.Errorf("MarshalDirent: want %v, got %v", wireDirent, b.Bytes())
+	}
+	d, err := UnmarshalDirent(bytes.NewBuffer(wireDirent))
+	if err != nil || d != dirent {
+		t.Errorf("UnmarshalDirent: want (%v, nil), got (%v, %v)", dirent, d, err)
+	}
+	// Every prefix is too short.
+	for i := range wireDirent {
+		if _, err := UnmarshalDirent(bytes.NewBuffer(wireDirent[:i])); err == nil {
+			t.Errorf("UnmarshalDirent of %d bytes: want error, got nil", i)
+		}
+	}
+}
+
+var (
+	lqid  = QID{Type: QTFILE, Version: 1, Path: 2}
+	lattr = Attr{
+		Valid: GetattrBasic, QID: lqid, Mode: syscall.S_IFREG | 0644,
+		UID: 3, GID: 4, NLink: 5, RDev: 6, Size: 7, BlkSize: 8, Blocks: 9,
+		ATimeSec: 10, ATimeNSec: 11, MTimeSec: 12, MTimeNSec: 13,
+		CTimeSec: 14, CTimeNSec: 15, BTimeSec: 16, BTimeNSec: 17,
+		Gen: 18, DataVersion: 19,
+	}
+	lstatfs = Statfs{Type: 0x01021997, BSize: 4096, Blocks: 3, BFree: 2, BAvail: 1, Files: 6, FFree: 5, FSID: 7, NameLen: 255}
+)
+
+// lecho is an echo server which speaks 9P2000.L. It remembers the
+// arguments of the last call, and gives back fixed answers.
+type lecho struct {
+	*echo
+	got string
+}
+
+func (e *lecho) Rversion(ctx context.Context, msize MaxSize, version string) (MaxSize, string, error) {
+	return msize, version, nil
+}
+
+func (e *lecho) record(args ...interface{}) {
+	e.got = fmt.Sprint(args...)
+}
+
+func (e *lecho) Rstatfs(ctx context.Context, fid FID) (Statfs, error) {
+	e.record(fid)
+	return lstatfs, nil
+}
+
+func (e *lecho) Rlopen(ctx context.Context, fid FID, flags uint32) (QID, MaxSize, error) {
+	e.record(fid, " ", flags)
+	return lqid, 8192, nil
+}
+
+func (e *lecho) Rlcreate(ctx context.Context, fid FID, name string, flags, mode, gid uint32) (QID, MaxSize, error) {
+	e.record(fid, " ", name, " ", flags, " ", mode, " ", gid)
+	return lqid, 4096, nil
+}
+
+func (e *lecho) Rsymlink(ctx context.Context, dfid FID, name, target string, gid uint32) (QID, error) {
+	e.record(dfid, " ", name, " ", target, " ", gid)
+	return QID{Type: QTSYMLINK, Path: 3}, nil
+}
+
+func (e *lecho) Rmknod(ctx context.Context, dfid FID, name string, mode, major, minor, gid uint32) (QID, error) {
+	e.record(dfid, " ", name, " ", mode, " ", major, " ", minor, " ", gid)
+	return lqid, nil
+}
+
+func (e *lecho) Rrename(ctx context.Context, fid, dfid FID, name string) error {
+	e.record(fid, " ", dfid, " ", name)
+	return nil
+}
+
+func (e *lecho) Rreadlink(ctx context.Context, fid FID) (string, error) {
+	e.record(fid)
+	return "/target", nil
+}
+
+func (e *lecho) Rgetattr(ctx context.Context, fid FID, mask uint64) (Attr, error) {
+	e.record(fid, " ", mask)
+	return lattr, nil
+}
+
+func (e *lecho) Rsetattr(ctx context.Context, fid FID, attr SetAttr) error {
+	e.record(fid, " ", attr)
+	return nil
+}
+
+func (e *lecho) Rxattrwalk(ctx context.Context, fid, newfid FID, name string) (uint64, error) {
+	e.record(fid, " ", newfid, " ", name)
+	return 42, nil
+}
+
+func (e *lecho) Rxattrcreate(ctx context.Context, fid FID, name string, size uint64, flags uint32) error {
+	e.record(fid, " ", name, " ", size, " ", flags)
+	return nil
+}
+
+func (e *lecho) Rreaddir(ctx context.Context, fid FID, offset Offset, count Count) ([]byte, error) {
+	e.record(fid, " ", offset, " ", count)
+	var b bytes.Buffer
+	MarshalDirent(&b, dirent)
+	MarshalDirent(&b, Dirent{QID: lqid, Offset: 4, Type: 8, Name: "motd"})
+	return b.Bytes(), nil
+}
+
+func (e *lecho) Rfsync(ctx context.Context, fid FID, datasync uint32) error {
+	e.record(fid, " ", datasync)
+	return nil
+}
+
+func (e *lecho) Rlock(ctx context.Context, fid FID, typ uint8, flags uint32, start, length uint64, procID uint32, clientID string) (uint8, error) {
+	e.record(fid, " ", typ, " ", flags, " ", start, " ", length, " ", procID, " ", clientID)
+	return LockBlocked, nil
+}
+
+func (e *lecho) Rgetlock(ctx context.Context, fid FID, typ uint8, start, length uint64, procID uint32, clientID string) (uint8, uint64, uint64, uint32, string, error) {
+	e.record(fid, " ", typ, " ", start, " ", length, " ", procID, " ", clientID)
+	return LockTypeUnlck, start, length, procID, clientID, nil
+}
+
+func (e *lecho) Rlink(ctx context.Context, dfid, fid FID, name string) error {
+	e.record(dfid, " ", fid, " ", name)
+	return nil
+}
+
+func (e *lecho) Rmkdir(ctx context.Context, dfid FID, name string, mode, gid uint32) (QID, error) {
+	e.record(dfid, " ", name, " ", mode, " ", gid)
+	return QID{Type: QTDIR, Path: 4}, nil
+}
+
+func (e *lecho) Rrenameat(ctx context.Context, olddfid FID, oldname string, newdfid FID, newname string) error {
+	e.record(olddfid, " ", oldname, " ", newdfid, " ", newname)
+	return nil
+}
+
+func (e *lecho) Runlinkat(ctx context.Context, dfid FID, name string, flags uint32) error {
+	e.record(dfid, " ", name, " ", flags)
+	if name == "missing" {
+		return syscall.ENOENT
+	}
+	return nil
+}
+
+func TestDotLNegotiation(t *testing.T) {
+	for _, tt := range []struct {
+		ns   NineServer
+		ask  string
+		want string
+	}{
+		{newEcho(), "9P2000.L", "9P2000"},
+		{&uecho{echo: newEcho()}, "9P2000.L", "9P2000"},
+		{&lecho{echo: newEcho()}, "9P2000.L", "9P2000.L"},
+		{&lecho{echo: newEcho()}, "9P2000.u", "9P2000"},
+		{&lecho{echo: newEcho()}, "9P2000", "9P2000"},
+	} {
+		c, v := newVersionConn(t, tt.ns, tt.ask)
+		c.Close()
+		if v != tt.want {
+			t.Errorf("%T asked for %v: want %v, got %v", tt.ns, tt.ask, tt.want, v)
+		}
+	}
+}
+
+// TestDotL sends every 9P2000.L message through a server, checking
+// that the server gets what was sent, and the client what was replied.
+func TestDotL(t *testing.T) {
+	e := &lecho{echo: newEcho()}
+	c, _ := newVersionConn(t, e, VersionL)
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTattachUPkt(&b, 1, 1, NOFID, "glenda", "", 1000)
+	call(t, c, &b, Rattach)
+
+	setattr := SetAttr{Valid: SetattrMode | SetattrSize, Mode: 0600, UID: 1, GID: 2, Size: 3, ATimeSec: 4, ATimeNSec: 5, MTimeSec: 6, MTimeNSec: 7}
+	var dirents bytes.Buffer
+	MarshalDirent(&dirents, dirent)
+	MarshalDirent(&dirents, Dirent{QID: lqid, Offset: 4, Type: 8, Name: "motd"})
+
+	for _, tt := range []struct {
+		name   string
+		send   func(b *bytes.Buffer)
+		want   MType
+		got    string // what the server was given
+		reply  func(b *bytes.Buffer) ([]interface{}, error)
+		result []interface{}
+	}{
+		{
+			name: "statfs",
+			send: func(b *bytes.Buffer) { MarshalTstatfsPkt(b, 2, 1) },
+			want: Rstatfs,
+			got:  "1",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				s, _, err := UnmarshalRstatfsPkt(b)
+				return []interface{}{s}, err
+			},
+			result: []interface{}{lstatfs},
+		},
+		{
+			name: "lopen",
+			send: func(b *bytes.Buffer) { MarshalTlopenPkt(b, 2, 1, 0x8002) },
+			want: Rlopen,
+			got:  "1 32770",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				q, iounit, _, err := UnmarshalRlopenPkt(b)
+				return []interface{}{q, iounit}, err
+			},
+			result: []interface{}{lqid, MaxSize(8192)},
+		},
+		{
+			name: "lcreate",
+			send: func(b *bytes.Buffer) { MarshalTlcreatePkt(b, 2, 1, "new", 0x41, 0644, 100) },
+			want: Rlcreate,
+			got:  "1 new 65 420 100",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				q, iounit, _, err := UnmarshalRlcreatePkt(b)
+				return []interface{}{q, iounit}, err
+			},
+			result: []interface{}{lqid, MaxSize(4096)},
+		},
+		{
+			name: "symlink",
+			send: func(b *bytes.Buffer) { MarshalTsymlinkPkt(b, 2, 1, "l", "/tmp", 100) },
+			want: Rsymlink,
+			got:  "1 l /tmp 100",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				q, _, err := UnmarshalRsymlinkPkt(b)
+				return []interface{}{q}, err
+			},
+			result: []interface{}{QID{Type: QTSYMLINK, Path: 3}},
+		},
+		{
+			name: "mknod",
+			send: func(b *bytes.Buffer) { MarshalTmknodPkt(b, 2, 1, "fifo", syscall.S_IFIFO|0600, 0, 0, 100) },
+			want: Rmknod,
+			got:  "1 fifo 4480 0 0 100",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				q, _, err := UnmarshalRmknodPkt(b)
+				return []interface{}{q}, err
+			},
+			result: []interface{}{lqid},
+		},
+		{
+			name: "rename",
+			send: func(b *bytes.Buffer) { MarshalTrenamePkt(b, 2, 1, 5, "to") },
+			want: Rrename,
+			got:  "1 5 to",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				_, err := UnmarshalRrenamePkt(b)
+				return nil, err
+			},
+		},
+		{
+			name: "readlink",
+			send: func(b *bytes.Buffer) { MarshalTreadlinkPkt(b, 2, 1) },
+			want: Rreadlink,
+			got:  "1",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				s, _, err := UnmarshalRreadlinkPkt(b)
+				return []interface{}{s}, err
+			},
+			result: []interface{}{"/target"},
+		},
+		{
+			name: "getattr",
+			send: func(b *bytes.Buffer) { MarshalTgetattrPkt(b, 2, 1, GetattrAll) },
+			want: Rgetattr,
+			got:  "1 16383",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				a, _, err := UnmarshalRgetattrPkt(b)
+				return []interface{}{a}, err
+			},
+			result: []interface{}{lattr},
+		},
+		{
+			name: "setattr",
+			send: func(b *bytes.Buffer) { MarshalTsetattrPkt(b, 2, 1, setattr) },
+			want: Rsetattr,
+			got:  fmt.Sprint(1, " ", setattr),
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				_, err := UnmarshalRsetattrPkt(b)
+				return nil, err
+			},
+		},
+		{
+			name: "xattrwalk",
+			send: func(b *bytes.Buffer) { MarshalTxattrwalkPkt(b, 2, 1, 6, "user.x") },
+			want: Rxattrwalk,
+			got:  "1 6 user.x",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				n, _, err := UnmarshalRxattrwalkPkt(b)
+				return []interface{}{n}, err
+			},
+			result: []interface{}{uint64(42)},
+		},
+		{
+			name: "xattrcreate",
+			send: func(b *bytes.Buffer) { MarshalTxattrcreatePkt(b, 2, 1, "user.x", 10, 1) },
+			want: Rxattrcreate,
+			got:  "1 user.x 10 1",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				_, err := UnmarshalRxattrcreatePkt(b)
+				return nil, err
+			},
+		},
+		{
+			name: "readdir",
+			send: func(b *bytes.Buffer) { MarshalTreaddirPkt(b, 2, 1, 3, 4096) },
+			want: Rreaddir,
+			got:  "1 3 4096",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				d, _, err := UnmarshalRreaddirPkt(b)
+				return []interface{}{append([]byte{}, d...)}, err
+			},
+			result: []interface{}{dirents.Bytes()},
+		},
+		{
+			name: "fsync",
+			send: func(b *bytes.Buffer) { MarshalTfsyncPkt(b, 2, 1, 1) },
+			want: Rfsync,
+			got:  "1 1",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				_, err := UnmarshalRfsyncPkt(b)
+				return nil, err
+			},
+		},
+		{
+			name: "lock",
+			send: func(b *bytes.Buffer) { MarshalTlockPkt(b, 2, 1, LockTypeWrlck, LockFlagsBlock, 10, 20, 99, "host") },
+			want: Rlock,
+			got:  "1 1 1 10 20 99 host",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				s, _, err := UnmarshalRlockPkt(b)
+				return []interface{}{s}, err
+			},
+			result: []interface{}{uint8(LockBlocked)},
+		},
+		{
+			name: "getlock",
+			send: func(b *bytes.Buffer) { MarshalTgetlockPkt(b, 2, 1, LockTypeRdlck, 10, 20, 99, "host") },
+			want: Rgetlock,
+			got:  "1 0 10 20 99 host",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				typ, start, length, pid, id, _, err := UnmarshalRgetlockPkt(b)
+				return []interface{}{typ, start, length, pid, id}, err
+			},
+			result: []interface{}{uint8(LockTypeUnlck), uint64(10), uint64(20), uint32(99), "host"},
+		},
+		{
+			name: "link",
+			send: func(b *bytes.Buffer) { MarshalTlinkPkt(b, 2, 5, 1, "hard") },
+			want: Rlink,
+			got:  "5 1 hard",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				_, err := UnmarshalRlinkPkt(b)
+				return nil, err
+			},
+		},
+		{
+			name: "mkdir",
+			send: func(b *bytes.Buffer) { MarshalTmkdirPkt(b, 2, 1, "d", 0755, 100) },
+			want: Rmkdir,
+			got:  "1 d 493 100",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				q, _, err := UnmarshalRmkdirPkt(b)
+				return []interface{}{q}, err
+			},
+			result: []interface{}{QID{Type: QTDIR, Path: 4}},
+		},
+		{
+			name: "renameat",
+			send: func(b *bytes.Buffer) { MarshalTrenameatPkt(b, 2, 1, "a", 5, "b") },
+			want: Rrenameat,
+			got:  "1 a 5 b",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				_, err := UnmarshalRrenameatPkt(b)
+				return nil, err
+			},
+		},
+		{
+			name: "unlinkat",
+			send: func(b *bytes.Buffer) { MarshalTunlinkatPkt(b, 2, 1, "d", 0x200) },
+			want: Runlinkat,
+			got:  "1 d 512",
+			reply: func(b *bytes.Buffer) ([]interface{}, error) {
+				_, err := UnmarshalRunlinkatPkt(b)
+				return nil, err
+			},
+		},
+	} {
+		b.Reset()
+		tt.send(&b)
+		rb := call(t, c, &b, tt.want)
+		if e.got != tt.got {
+			t.Errorf("%s: server got %q, want %q", tt.name, e.got, tt.got)
+		}
+		r, err := tt.reply(rb)
+		if err != nil || !reflect.DeepEqual(r, tt.result) {
+			t.Errorf("%s: want (%v, nil), got (%v, %v)", tt.name, tt.result, r, err)
+		}
+	}
+
+	// Errors are Rlerrors, with the errno if there is one, or EIO.
+	MarshalTunlinkatPkt(&b, 3, 1, "missing", 0)
+	errno, tag, err := UnmarshalRlerrorPkt(call(t, c, &b, Rlerror))
+	if errno != ENOENT || tag != 3 || err != nil {
+		t.Errorf("Tunlinkat missing: want (ENOENT, 3, nil), got (%v, %v, %v)", errno, tag, err)
+	}
+	b.Reset()
+	b.Write([]byte{7, 0, 0, 0, uint8(Tlopen), 4, 0})
+	errno, tag, err = UnmarshalRlerrorPkt(call(t, c, &b, Rlerror))
+	if errno != EIO || tag != 4 || err != nil {
+		t.Errorf("short Tlopen: want (EIO, 4, nil), got (%v, %v, %v)", errno, tag, err)
+	}
+	// Messages nobody serves are EOPNOTSUPP, so Linux knows to fall back.
+	b.Reset()
+	b.Write([]byte{11, 0, 0, 0, uint8(Tlerror), 5, 0, 1, 0, 0, 0})
+	errno, tag, err = UnmarshalRlerrorPkt(call(t, c, &b, Rlerror))
+	if errno != EOPNOTSUPP || tag != 5 || err != nil {
+		t.Errorf("Tlerror: want (EOPNOTSUPP, 5, nil), got (%v, %v, %v)", errno, tag, err)
+	}
+}
+
+// 9P2000.L messages are not served unless 9P2000.L was agreed.
+func TestDotLNotNegotiated(t *testing.T) {
+	e := &lecho{echo: newEcho()}
+	c, _ := newVersionConn(t, e, Version)
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTgetattrPkt(&b, 2, 1, GetattrAll)
+	if s, _, _ := UnmarshalRerrorPkt(call(t, c, &b, Rerror)); s != "Dispatch: Tgetattr not supported" {
+		t.Errorf("Tgetattr: want %q, got %q", "Dispatch: Tgetattr not supported", s)
+	}
+	if e.got != "" {
+		t.Errorf("Tgetattr: server was called with %q", e.got)
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 9P2000.u is 9P2000 with some additions for Unix: numeric user IDs,
+// symlinks and devices, and errnos. It is what Linux's v9fs speaks
+// if it isn't asked for 9P2000.L. It is described in
+// http://ericvh.github.io/9p-rfc/rfc9p2000.u.html.
+// Only a few messages change; they're marshaled here, by hand, rather
+// than by gen.go.
+const (
+	Version  = "9P2000"
+	VersionU = "9P2000.u"
+
+	// VersionUnknown is the version in the Rversion to a Tversion for
+	// a version the server doesn't know. The client may try another.
+	VersionUnknown = "unknown"
+
+	// NOUID is the numeric user ID for no user.
+	NOUID = ^uint32(0)
+)
+
+// File modes added by 9P2000.u.
+const (
+	DMSYMLINK   = 0x02000000 // mode bit for symbolic links
+	DMDEVICE    = 0x00800000 // mode bit for devices
+	DMNAMEDPIPE = 0x00200000 // mode bit for named pipes
+	DMSOCKET    = 0x00100000 // mode bit for sockets
+	DMSETUID    = 0x00080000 // mode bit for setuid
+	DMSETGID    = 0x00040000 // mode bit for setgid
+)
+
+// A UNineServer speaks 9P2000.u. It agrees to do so by returning
+// VersionU from Rversion, and from then on the stats it returns from
+// Rstat and from reads of directories, and those it is given in Rwstat,
+// are in the form of DirU. The protocol never offers VersionU to a
+// server which isn't a UNineServer; it offers Version instead.
+type UNineServer interface {
+	NineServer
+	// RattachU is Rattach with the numeric ID of the user.
+	RattachU(ctx context.Context, fid, afid FID, uname, aname string, nuname uint32) (QID, error)
+	// RcreateU is Rcreate with an extension, which is the target of
+	// a symlink, or a device given as "b major minor" or "c major minor".
+	RcreateU(ctx context.Context, fid FID, name string, perm Perm, mode Mode, extension string) (QID, MaxSize, error)
+}
+
+// DirU is a Dir with the 9P2000.u extensions.
+type DirU struct {
+	Dir
+	Extension string // symlink target, or device, as for RcreateU
+	NUid      uint32 // numeric owner
+	NGid      uint32 // numeric group
+	NMuid     uint32 // numeric last modifier
+}
+
+// MarshalDirU marshals d as a 9P2000.u stat. Like Marshaldir, it
+// replaces what's in b.
+func MarshalDirU(b *bytes.Buffer, d DirU) {
+	Marshaldir(b, d.Dir)
+	pstring(b, d.Extension)
+	puint32(b, d.NUid)
+	puint32(b, d.NGid)
+	puint32(b, d.NMuid)
+	l := b.Len() - 2
+	copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8)})
+}
+
+// UnmarshalDirU unmarshals a 9P2000.u stat.
+func UnmarshalDirU(b *bytes.Buffer) (d DirU, err error) {
+	if d.Dir, err = Unmarshaldir(b); err != nil {
+		return d, err
+	}
+	if d.Extension, err = gstring(b); err != nil {
+		return d, err
+	}
+	if d.NUid, err = guint32(b); err != nil {
+		return d, err
+	}
+	if d.NGid, err = guint32(b); err != nil {
+		return d, err
+	}
+	d.NMuid, err = guint32(b)
+	return d, err
+}
+
+// MarshalRerrorUPkt marshals a 9P2000.u Rerror, which has an errno
+// after the message. An errno of 0 leaves clients to make what they
+// can of the message.
+func MarshalRerrorUPkt(b *bytes.Buffer, t Tag, e string, errno uint32) {
+	MarshalRerrorPkt(b, t, e)
+	puint32(b, errno)
+	fixSize(b)
+}
+
+// UnmarshalRerrorUPkt unmarshals a 9P2000.u Rerror, from the tag onward.
+func UnmarshalRerrorUPkt(b *bytes.Buffer) (e string, errno uint32, t Tag, err error) {
+	if t, err = gtag(b); err != nil {
+		return
+	}
+	if e, err = gstring(b); err != nil {
+		return
+	}
+	errno, err = guint32(b)
+	return
+}
+
+// MarshalTattachUPkt marshals a 9P2000.u Tattach, which has the
+// numeric ID of the user after the classic fields.
+func MarshalTattachUPkt(b *bytes.Buffer, t Tag, fid, afid FID, uname, aname string, nuname uint32) {
+	MarshalTattachPkt(b, t, fid, afid, uname, aname)
+	puint32(b, nuname)
+	fixSize(b)
+}
+
+// UnmarshalTattachUPkt unmarshals a 9P2000.u Tattach, from the tag onward.
+func UnmarshalTattachUPkt(b *bytes.Buffer) (fid, afid FID, uname, aname string, nuname uint32, t Tag, err error) {
+	if t, err = gtag(b); err != nil {
+		return
+	}
+	var u uint32
+	if u, err = guint32(b); err != nil {
+		return
+	}
+	fid = FID(u)
+	if u, err = guint32(b); err != nil {
+		return
+	}
+	afid = FID(u)
+	if uname, err = gstring(b); err != nil {
+		return
+	}
+	if aname, err = gstring(b); err != nil {
+		return
+	}
+	nuname, err = guint32(b)
+	return
+}
+
+// MarshalTauthUPkt marshals a 9P2000.u Tauth, which has the numeric
+// ID of the user after the classic fields.
+func MarshalTauthUPkt(b *bytes.Buffer, t Tag, afid FID, uname, aname string, nuname uint32) {
+	MarshalTauthPkt(b, t, afid, uname, aname)
+	puint32(b, nuname)
+	fixSize(b)
+}
+
+// UnmarshalTauthUPkt unmarshals a 9P2000.u Tauth, from the tag onward.
+func UnmarshalTauthUPkt(b *bytes.Buffer) (afid FID, uname, aname string, nuname uint32, t Tag, err error) {
+	if t, err = gtag(b); err != nil {
+		return
+	}
+	var u uint32
+	if u, err = guint32(b); err != nil {
+		return
+	}
+	afid = FID(u)
+	if uname, err = gstring(b); err != nil {
+		return
+	}
+	if aname, err = gstring(b); err != nil {
+		return
+	}
+	nuname, err = guint32(b)
+	return
+}
+
+// MarshalTcreateUPkt marshals a 9P2000.u Tcreate, which has an
+// extension after the classic fields.
+func MarshalTcreateUPkt(b *bytes.Buffer, t Tag, fid FID, name string, perm Perm, mode Mode, extension string) {
+	MarshalTcreatePkt(b, t, fid, name, perm, mode)
+	pstring(b, extension)
+	fixSize(b)
+}
+
+// UnmarshalTcreateUPkt unmarshals a 9P2000.u Tcreate, from the tag onward.
+func UnmarshalTcreateUPkt(b *bytes.Buffer) (fid FID, name string, perm Perm, mode Mode, extension string, t Tag, err error) {
+	if t, err = gtag(b); err != nil {
+		return
+	}
+	var u uint32
+	if u, err = guint32(b); err != nil {
+		return
+	}
+	fid = FID(u)
+	if name, err = gstring(b); err != nil {
+		return
+	}
+	if u, err = guint32(b); err != nil {
+		return
+	}
+	perm = Perm(u)
+	m, err := b.ReadByte()
+	if err != nil {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	mode = Mode(m)
+	extension, err = gstring(b)
+	return
+}
+
+// srvRattachU, srvRauthU and srvRcreateU are the 9P2000.u versions
+// of the generated SrvR functions.
+func (s *Server) srvRattachU(ctx context.Context, b *bytes.Buffer) error {
+	fid, afid, uname, aname, nuname, t, err := UnmarshalTattachUPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tattach], err)
+		return err
+	}
+	// 9P2000.L uses this Tattach too, and a NineServerL needn't be a
+	// UNineServer.
+	var q QID
+	if u, ok := s.NS.(UNineServer); ok {
+		q, err = u.RattachU(ctx, fid, afid, uname, aname, nuname)
+	} else {
+		q, err = s.NS.Rattach(ctx, fid, afid, uname, aname)
+	}
+	if err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRattachPkt(b, t, q)
+	}
+	return nil
+}
+
+func (s *Server) srvRauthU(ctx context.Context, b *bytes.Buffer) error {
+	afid, uname, aname, _, t, err := UnmarshalTauthUPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tauth], err)
+		return err
+	}
+	// Make it look like a classic Tauth, from the tag onward.
+	MarshalTauthPkt(b, t, afid, uname, aname)
+	b.Next(5)
+	return s.SrvRauth(ctx, b)
+}
+
+func (s *Server) srvRcreateU(ctx context.Context, b *bytes.Buffer) error {
+	fid, name, perm, mode, extension, t, err := UnmarshalTcreateUPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tcreate], err)
+		return err
+	}
+	if q, iounit, err := s.NS.(UNineServer).RcreateU(ctx, fid, name, perm, mode, extension); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRcreatePkt(b, t, q, iounit)
+	}
+	return nil
+}
+
+// negotiateVersion rewrites a Tversion, given from the tag onward, so
+// that it only asks the server for a version it knows, and an msize no
+// bigger than MSIZE. Anything that starts with "9P2000." that the server
+// doesn't speak becomes plain 9P2000, which every server does. It
+// returns false, and leaves b alone, if the version isn't 9P2000 at all,
+// e.g. 9P1999 or 9P2000X; that gets VersionUnknown.
+func (s *Server) negotiateVersion(b *bytes.Buffer) bool {
+	msize, v, t, err := UnmarshalTversionPkt(bytes.NewBuffer(b.Bytes()))
+	if err != nil {
+		// SrvRversion will say what's wrong with it.
+		return true
+	}
+	if v != Version && !strings.HasPrefix(v, Version+".") {
+		return false
+	}
+	want := Version
+	switch {
+	case v == Version:
+	case v == VersionU:
+		if _, ok := s.NS.(UNineServer); ok {
+			want = v
+		}
+	case v == VersionL:
+		if _, ok := s.NS.(NineServerL); ok {
+			want = v
+		}
+	}
+	if want == v && msize <= MSIZE {
+		return true
+	}
+	if msize > MSIZE {
+		msize = MSIZE
+	}
+	MarshalTversionPkt(b, t, msize, want)
+	b.Next(5)
+	return true
+}
+
+// marshalRerror puts an Rerror for err in b, with an errno if the
+// connection speaks 9P2000.u, or an Rlerror if it speaks 9P2000.L,
+// which has nothing but the errno; EIO if err doesn't have one. The
+// message is cut to fit msize. This is the one place error replies are
+// made; see ReplyError.
+func (s *Server) marshalRerror(b *bytes.Buffer, t Tag, err error) {
+	// A NineServer which ran out of the time its request was given
+	// hands back its context's error, which says nothing a client can
+	// act on.
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = ErrTimedOut
+	}
+	errno := errnoOf(err)
+	var e *Error
+	if errors.As(err, &e) {
+		errno = e.Errno
+	} else if e = osError(err); e != nil {
+		if errno == 0 {
+			errno = e.Errno
+		}
+		err = e
+	}
+	if _, ok := err.(notSupported); ok {
+		errno = EOPNOTSUPP
+	}
+	ss := s.session()
+	if ss.dotl {
+		if errno == 0 {
+			errno = EIO
+		}
+		MarshalRlerrorPkt(b, t, errno)
+		return
+	}
+	// size[4] Rerror tag[2] ename[s], and errno[4] for 9P2000.u.
+	room := int(ss.size()) - (4 + 1 + 2 + 2)
+	if ss.dotu {
+		MarshalRerrorUPkt(b, t, fitError(err.Error(), room-4), errno)
+		return
+	}
+	MarshalRerrorPkt(b, t, fitError(err.Error(), room))
+}
+
+func pstring(b *bytes.Buffer, s string) {
+	b.Write([]byte{uint8(len(s)), uint8(len(s) >> 8)})
+	b.WriteString(s)
+}
+
+func puint32(b *bytes.Buffer, v uint32) {
+	b.Write([]byte{uint8(v), uint8(v >> 8), uint8(v >> 16), uint8(v >> 24)})
+}
+
+// fixSize sets the size at the start of a message in b.
+func fixSize(b *bytes.Buffer) {
+	l := b.Len()
+	copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+}
+
+func gtag(b *bytes.Buffer) (Tag, error) {
+	if b.Len() < 2 {
+		return 0, fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+	}
+	d := b.Next(2)
+	return Tag(d[0]) | Tag(d[1])<<8, nil
+}
+
+func guint32(b *bytes.Buffer) (uint32, error) {
+	if b.Len() < 4 {
+		return 0, fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+	}
+	d := b.Next(4)
+	return uint32(d[0]) | uint32(d[1])<<8 | uint32(d[2])<<16 | uint32(d[3])<<24, nil
+}
+
+func gstring(b *bytes.Buffer) (string, error) {
+	if b.Len() < 2 {
+		return "", fmt.Errorf("pkt too short for string: need 2, have %d", b.Len())
+	}
+	d := b.Next(2)
+	l := int(d[0]) | int(d[1])<<8
+	if b.Len() < l {
+		return "", fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+	}
+	return string(b.Next(l)), nil
+}
@@ -0,0 +1,313 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// The wire forms below were put together by hand, field by field,
+// from the 9P2000.u spec.
+var (
+	wireRerrorU = []byte{
+		17, 0, 0, 0, uint8(Rerror), 1, 0,
+		4, 0, 'n', 'o', 'p', 'e',
+		2, 0, 0, 0, // ENOENT
+	}
+	wireTattachU = []byte{
+		29, 0, 0, 0, uint8(Tattach), 1, 0,
+		0, 0, 0, 0, // fid
+		0xff, 0xff, 0xff, 0xff, // afid
+		6, 0, 'g', 'l', 'e', 'n', 'd', 'a',
+		0, 0, // aname
+		0xe8, 0x03, 0, 0, // n_uname 1000
+	}
+	wireTauthU = []byte{
+		25, 0, 0, 0, uint8(Tauth), 1, 0,
+		5, 0, 0, 0, // afid
+		6, 0, 'g', 'l', 'e', 'n', 'd', 'a',
+		0, 0, // aname
+		0xe8, 0x03, 0, 0, // n_uname 1000
+	}
+	wireTcreateU = []byte{
+		25, 0, 0, 0, uint8(Tcreate), 2, 0,
+		1, 0, 0, 0, // fid
+		1, 0, 'l',
+		0xff, 0x01, 0, 0x02, // DMSYMLINK|0777
+		0,                        // mode
+		4, 0, '/', 't', 'm', 'p', // extension
+	}
+)
+
+func TestDotUWire(t *testing.T) {
+	var b bytes.Buffer
+
+	MarshalRerrorUPkt(&b, 1, "nope", ENOENT)
+	if !bytes.Equal(b.Bytes(), wireRerrorU) {
+		t.Errorf("MarshalRerrorUPkt: want %v, got %v", wireRerrorU, b.Bytes())
+	}
+	e, errno, tag, err := UnmarshalRerrorUPkt(bytes.NewBuffer(wireRerrorU[5:]))
+	if e != "nope" || errno != ENOENT || tag != 1 || err != nil {
+		t.Errorf("UnmarshalRerrorUPkt: want (nope, 2, 1, nil), got (%q, %v, %v, %v)", e, errno, tag, err)
+	}
+
+	MarshalTattachUPkt(&b, 1, 0, NOFID, "glenda", "", 1000)
+	if !bytes.Equal(b.Bytes(), wireTattachU) {
+		t.Errorf("MarshalTattachUPkt: want %v, got %v", wireTattachU, b.Bytes())
+	}
+	fid, afid, uname, aname, nuname, tag, err := UnmarshalTattachUPkt(bytes.NewBuffer(wireTattachU[5:]))
+	if fid != 0 || afid != NOFID || uname != "glenda" || aname != "" || nuname != 1000 || tag != 1 || err != nil {
+		t.Errorf("UnmarshalTattachUPkt: got (%v, %v, %q, %q, %v, %v, %v)", fid, afid, uname, aname, nuname, tag, err)
+	}
+
+	MarshalTauthUPkt(&b, 1, 5, "glenda", "", 1000)
+	if !bytes.Equal(b.Bytes(), wireTauthU) {
+		t.Errorf("MarshalTauthUPkt: want %v, got %v", wireTauthU, b.Bytes())
+	}
+	afid, uname, aname, nuname, tag, err = UnmarshalTauthUPkt(bytes.NewBuffer(wireTauthU[5:]))
+	if afid != 5 || uname != "glenda" || aname != "" || nuname != 1000 || tag != 1 || err != nil {
+		t.Errorf("UnmarshalTauthUPkt: got (%v, %q, %q, %v, %v, %v)", afid, uname, aname, nuname, tag, err)
+	}
+
+	MarshalTcreateUPkt(&b, 2, 1, "l", DMSYMLINK|0777, 0, "/tmp")
+	if !bytes.Equal(b.Bytes(), wireTcreateU) {
+		t.Errorf("MarshalTcreateUPkt: want %v, got %v", wireTcreateU, b.Bytes())
+	}
+	fid, name, perm, mode, ext, tag, err := UnmarshalTcreateUPkt(bytes.NewBuffer(wireTcreateU[5:]))
+	if fid != 1 || name != "l" || perm != DMSYMLINK|0777 || mode != 0 || ext != "/tmp" || tag != 2 || err != nil {
+		t.Errorf("UnmarshalTcreateUPkt: got (%v, %q, %v, %v, %q, %v, %v)", fid, name, perm, mode, ext, tag, err)
+	}
+
+	MarshalDirU(&b, dirU)
+	if !bytes.Equal(b.Bytes(), wireDirU) {
+		t.Errorf("MarshalDirU: want %v, got %v", wireDirU, b.Bytes())
+	}
+	d, err := UnmarshalDirU(bytes.NewBuffer(wireDirU))
+	if err != nil || !reflect.DeepEqual(d, dirU) {
+		t.Errorf("UnmarshalDirU: want (%v, nil), got (%v, %v)", dirU, d, err)
+	}
+	// Every prefix is too short.
+	for i := range wireDirU {
+		if _, err := UnmarshalDirU(bytes.NewBuffer(wireDirU[:i])); err == nil {
+			t.Errorf("UnmarshalDirU of %d bytes: want error, got nil", i)
+		}
+	}
+}
+
+// uecho is an echo server which speaks 9P2000.u.
+type uecho struct {
+	*echo
+	nuname    uint32
+	extension string
+}
+
+func (e *uecho) Rversion(ctx context.Context, msize MaxSize, version string) (MaxSize, string, error) {
+	return msize, version, nil
+}
+
+func (e *uecho) RattachU(ctx context.Context, fid, afid FID, uname, aname string, nuname uint32) (QID, error) {
+	e.nuname = nuname
+	return QID{}, nil
+}
+
+func (e *uecho) RcreateU(ctx context.Context, fid FID, name string, perm Perm, mode Mode, extension string) (QID, MaxSize, error) {
+	e.extension = extension
+	return QID{Type: QTSYMLINK}, 0, nil
+}
+
+func (e *uecho) Rremove(ctx context.Context, f FID) error {
+	return &os.PathError{Op: "remove", Path: "x", Err: syscall.ENOENT}
+}
+
+// TestErrnoError checks that errors which carry an errno are sent with
+// the string clients know it by, and the errno as it is.
+func TestErrnoError(t *testing.T) {
+	for _, tt := range []struct {
+		err   error
+		want  string
+		errno uint32
+	}{
+		{&os.PathError{Op: "open", Path: "/x/y", Err: syscall.ENOTDIR}, "not a directory", ENOTDIR},
+		{&os.PathError{Op: "open", Path: "/x", Err: syscall.EISDIR}, "file is a directory", EISDIR},
+		{&os.PathError{Op: "chmod", Path: "/x", Err: syscall.EPERM}, "permission denied", EPERM},
+		{&os.PathError{Op: "write", Path: "/x", Err: syscall.ENOSPC}, "no space left on device", ENOSPC},
+		{&os.PathError{Op: "remove", Path: "/x", Err: syscall.ENOTEMPTY}, "remove /x: directory not empty", uint32(syscall.ENOTEMPTY)},
+	} {
+		s := &Server{sess: session{dotu: true}}
+		b := tagged(1)
+		s.ReplyError(b, 1, "%w", tt.err)
+		if e, errno, _, err := UnmarshalRerrorUPkt(rerror(t, b, Rerror)); err != nil || e != tt.want || errno != tt.errno {
+			t.Errorf("%v: want (%q, %v), got (%q, %v, %v)", tt.err, tt.want, tt.errno, e, errno, err)
+		}
+	}
+}
+
+// newVersionConn is newTestConn, but asks for version, and returns
+// the version agreed.
+func newVersionConn(t *testing.T, ns NineServer, version string) (net.Conn, string) {
+	t.Helper()
+	p, p2 := net.Pipe()
+	l, err := NewNetListener(func() NineServer { return ns })
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	if err := l.Accept(p2); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	var b bytes.Buffer
+	MarshalTversionPkt(&b, NOTAG, 8192, version)
+	rb := call(t, p, &b, Rversion)
+	_, v, _, err := UnmarshalRversionPkt(rb)
+	if err != nil {
+		t.Fatalf("UnmarshalRversionPkt: want nil, got %v", err)
+	}
+	return p, v
+}
+
+func TestDotUNegotiation(t *testing.T) {
+	for _, tt := range []struct {
+		ns   NineServer
+		ask  string
+		want string
+	}{
+		{newEcho(), "9P2000", "9P2000"},
+		{newEcho(), "9P2000.u", "9P2000"},
+		{newEcho(), "9P2000.L", "9P2000"},
+		{&uecho{echo: newEcho()}, "9P2000.u", "9P2000.u"},
+		{&uecho{echo: newEcho()}, "9P2000.L", "9P2000"},
+		{&uecho{echo: newEcho()}, "9P2000", "9P2000"},
+	} {
+		c, v := newVersionConn(t, tt.ns, tt.ask)
+		c.Close()
+		if v != tt.want {
+			t.Errorf("%T asked for %v: want %v, got %v", tt.ns, tt.ask, tt.want, v)
+		}
+	}
+}
+
+func TestUnknownVersion(t *testing.T) {
+	for _, tt := range []struct {
+		ns          NineServer
+		ask         string
+		want, again string
+	}{
+		// A dialect we don't know is still 9P2000.
+		{newEcho(), "9P2000.XYZ", Version, ""},
+		{newEcho(), "9P1999", VersionUnknown, Version},
+		{newEcho(), "9P2000X", VersionUnknown, Version},
+		{newEcho(), "", VersionUnknown, Version},
+		// Nor is the server turning it down an Rerror.
+		{&refuser{echo: newEcho()}, Version, VersionUnknown, VersionUnknown},
+	} {
+		c, v := newVersionConn(t, tt.ns, tt.ask)
+		if v != tt.want {
+			t.Errorf("%T asked for %q: want %q, got %q", tt.ns, tt.ask, tt.want, v)
+		}
+		if v != VersionUnknown {
+			c.Close()
+			continue
+		}
+		// Without a session, there is nothing else to do, until the
+		// client asks for a version it can have.
+		var b bytes.Buffer
+		MarshalTattachPkt(&b, 1, 1, NOFID, "", "")
+		call(t, c, &b, Rerror)
+		MarshalTversionPkt(&b, NOTAG, 8192, Version)
+		rb := call(t, c, &b, Rversion)
+		if _, v, _, err := UnmarshalRversionPkt(rb); err != nil || v != tt.again {
+			t.Errorf("%T asked again after %q: want %q, got (%q, %v)", tt.ns, tt.ask, tt.again, v, err)
+		}
+		c.Close()
+	}
+}
+
+// refuser turns down every version.
+type refuser struct {
+	*echo
+}
+
+func (r *refuser) Rversion(ctx context.Context, msize MaxSize, version string) (MaxSize, string, error) {
+	return 0, "", fmt.Errorf("%v not supported", version)
+}
+
+func TestVersionMsize(t *testing.T) {
+	for _, tt := range []struct {
+		ns         NineServer
+		ask, want  MaxSize
+		versioning string
+	}{
+		{newEcho(), 8192, 8192, Version},
+		{newEcho(), MSIZE, MSIZE, Version},
+		{newEcho(), MSIZE + 1, MSIZE, Version},
+		{newEcho(), 1 << 31, MSIZE, Version},
+		{&grower{echo: newEcho()}, 8192, 8192, Version},
+		{newEcho(), 1 << 31, MSIZE, "9P1999"},
+	} {
+		p, p2 := net.Pipe()
+		l, err := NewNetListener(func() NineServer { return tt.ns })
+		if err != nil {
+			t.Fatalf("NewNetListener: want nil, got %v", err)
+		}
+		if err := l.Accept(p2); err != nil {
+			t.Fatalf("Accept: want nil, got %v", err)
+		}
+		var b bytes.Buffer
+		MarshalTversionPkt(&b, NOTAG, tt.ask, tt.versioning)
+		rb := call(t, p, &b, Rversion)
+		if msize, _, _, err := UnmarshalRversionPkt(rb); err != nil || msize != tt.want {
+			t.Errorf("%T asked for msize %d: want %d, got (%d, %v)", tt.ns, tt.ask, tt.want, msize, err)
+		}
+		p.Close()
+	}
+}
+
+// grower answers with a bigger msize than it was asked for.
+type grower struct {
+	*echo
+}
+
+func (g *grower) Rversion(ctx context.Context, msize MaxSize, version string) (MaxSize, string, error) {
+	return msize * 2, version, nil
+}
+
+func TestDotU(t *testing.T) {
+	u := &uecho{echo: newEcho()}
+	c, _ := newVersionConn(t, u, VersionU)
+	defer c.Close()
+
+	call(t, c, bytes.NewBuffer(append([]byte{}, wireTattachU...)), Rattach)
+	if u.nuname != 1000 {
+		t.Errorf("n_uname: want 1000, got %v", u.nuname)
+	}
+	call(t, c, bytes.NewBuffer(append([]byte{}, wireTcreateU...)), Rcreate)
+	if u.extension != "/tmp" {
+		t.Errorf("extension: want /tmp, got %q", u.extension)
+	}
+
+	var b bytes.Buffer
+	MarshalTremovePkt(&b, 3, 1)
+	e, errno, tag, err := UnmarshalRerrorUPkt(call(t, c, &b, Rerror))
+	if errno != ENOENT || tag != 3 || err != nil {
+		t.Errorf("Rerror: want (ENOENT, 3, nil), got (%q, %v, %v, %v)", e, errno, tag, err)
+	}
+
+	// Errors from the protocol itself carry an errno too, even if 0.
+	b.Reset()
+	b.Write([]byte{7, 0, 0, 0, uint8(Tremove), 4, 0})
+	e, errno, tag, err = UnmarshalRerrorUPkt(call(t, c, &b, Rerror))
+	if tag != 4 || err != nil {
+		t.Errorf("Rerror: want (4, nil), got (%q, %v, %v, %v)", e, errno, tag, err)
+	}
+}
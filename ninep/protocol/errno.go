@@ -0,0 +1,22 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package protocol
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errnoOf returns the errno in err, or 0 if there isn't one.
+func errnoOf(err error) uint32 {
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return uint32(e)
+	}
+	return 0
+}
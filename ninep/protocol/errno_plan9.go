@@ -0,0 +1,10 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+// errnoOf returns 0: Plan 9 errors are strings.
+func errnoOf(err error) uint32 {
+	return 0
+}
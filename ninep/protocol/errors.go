@@ -0,0 +1,229 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+func (e *Error) Error() string {
+	return e.Err
+}
+
+// Is reports whether target is the package os error e stands for, e.g.
+// os.ErrNotExist for ErrNotExist, so that errors.Is works with either.
+func (e *Error) Is(target error) bool {
+	for _, o := range osErrors {
+		if e == o.e && target == o.err {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors for common conditions, for servers to return and clients to
+// match. The strings are Plan 9's, which Linux's v9fs also knows. The
+// Client's Call functions return these, rather than a new error with
+// the same string, so errors.Is works.
+var (
+	ErrNotExist   = &Error{"file does not exist", ENOENT}
+	ErrPermission = &Error{"permission denied", EACCES}
+	ErrExist      = &Error{"file already exists", EEXIST}
+	ErrNotDir     = &Error{"not a directory", ENOTDIR}
+	ErrIsDir      = &Error{"file is a directory", EISDIR}
+	ErrNoSpace    = &Error{"no space left on device", ENOSPC}
+	ErrTimedOut   = &Error{"timed out", ETIMEDOUT}
+	ErrReadOnly   = &Error{"read-only file system", EROFS}
+
+	// ErrBadWalkName is the Server's reply to a Twalk with a name
+	// which holds a slash or a NUL.
+	ErrBadWalkName = &Error{"bad character in file name", EINVAL}
+)
+
+// knownErrors are the Err values by their strings, and by the strings
+// other servers send for the same things, all in lower case: those of
+// Plan 9's kernel and lib9p, and of Unix, which 9P2000.u servers send.
+var knownErrors = map[string]*Error{
+	"file not found":              ErrNotExist,
+	"no such file or directory":   ErrNotExist,
+	"operation not permitted":     ErrPermission,
+	"file exists":                 ErrExist,
+	"walk in non-directory":       ErrNotDir,
+	"is a directory":              ErrIsDir,
+	"file system full":            ErrNoSpace,
+	"connection timed out":        ErrTimedOut,
+	"fid unknown or out of range": ErrUnknownFID,
+	"duplicate fid":               ErrFIDInUse,
+}
+
+func init() {
+	for _, e := range []*Error{ErrNotExist, ErrPermission, ErrExist, ErrNotDir, ErrIsDir, ErrNoSpace, ErrTimedOut, ErrReadOnly, ErrBadWalkName, ErrUnknownFID, ErrFIDInUse, ErrFIDOpen} {
+		knownErrors[e.Err] = e
+	}
+}
+
+// ErrorFor returns the error an Rerror's string s stands for: one of
+// the Err values, if it is theirs; an error with s as its text which
+// errors.Is matches with one, if s says the same in other words, e.g.
+// "No such file or directory"; or else a new error with s as its text.
+// It is for clients which read Rerrors themselves.
+func ErrorFor(s string) error {
+	return clientError(s)
+}
+
+// ErrorForErrno returns the error the errno of a 9P2000.u Rerror or a
+// 9P2000.L Rlerror stands for: one of the Err values, if it is theirs,
+// or else a new *Error with errno in it.
+func ErrorForErrno(errno uint32) error {
+	if e, ok := errnoErrors[errno]; ok {
+		return e
+	}
+	// A server's EBADF is about the FID, not a file descriptor of
+	// its own, which it had better not let out.
+	if errno == EBADF {
+		return ErrUnknownFID
+	}
+	return &Error{fmt.Sprintf("errno %d", errno), errno}
+}
+
+// errnoErrors are the Err values for errnos.
+var errnoErrors = map[uint32]*Error{
+	ENOENT:    ErrNotExist,
+	EPERM:     ErrPermission,
+	EACCES:    ErrPermission,
+	EEXIST:    ErrExist,
+	ENOTDIR:   ErrNotDir,
+	EISDIR:    ErrIsDir,
+	ENOSPC:    ErrNoSpace,
+	ETIMEDOUT: ErrTimedOut,
+	EROFS:     ErrReadOnly,
+}
+
+// A remoteError is an Rerror which says one of the Err values' things
+// in its own words, which it keeps.
+type remoteError struct {
+	s string
+	e *Error
+}
+
+func (e *remoteError) Error() string { return e.s }
+func (e *remoteError) Unwrap() error { return e.e }
+
+// clientError returns the error for an Rerror's string s: one of the
+// Err values, if it is theirs, or a remoteError, if it says the same
+// as one of them otherwise.
+func clientError(s string) error {
+	if e, ok := knownErrors[s]; ok && e.Err == s {
+		return e
+	}
+	if e := knownError(s); e != nil {
+		return &remoteError{s, e}
+	}
+	return errors.New(s)
+}
+
+// knownError returns the Err value s says, in any case, and perhaps
+// after saying which file or what was being done: Plan 9 has
+// "'name' file does not exist", and Go and Unix servers have
+// "open /name: no such file or directory".
+func knownError(s string) *Error {
+	s = strings.ToLower(s)
+	if e, ok := knownErrors[s]; ok {
+		return e
+	}
+	if i := strings.LastIndex(s, ": "); i >= 0 {
+		if e, ok := knownErrors[s[i+2:]]; ok {
+			return e
+		}
+	}
+	if strings.HasPrefix(s, "'") {
+		if i := strings.LastIndex(s, "' "); i > 0 {
+			if e, ok := knownErrors[s[i+2:]]; ok {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// ReplyError puts in b an error reply to the request with tag t, in
+// whichever dialect the connection speaks. The message is made from
+// format and args as by fmt.Errorf, so %w can carry an errno, or one of
+// the Err values, for 9P2000.u and 9P2000.L. It is cut short, if need
+// be, so that the reply fits in msize. An error from package os, such
+// as an *os.PathError, is sent as the Err value clients know it by.
+func (s *Server) ReplyError(b *bytes.Buffer, t Tag, format string, args ...interface{}) {
+	s.marshalRerror(b, t, fmt.Errorf(format, args...))
+}
+
+// osErrors are the Err values for errors from package os, whose
+// messages, e.g. "open /a/long/path: no such file or directory", aren't
+// the ones clients look for, and may not even fit in a reply.
+var osErrors = []struct {
+	err error
+	e   *Error
+}{
+	{os.ErrNotExist, ErrNotExist},
+	{os.ErrPermission, ErrPermission},
+	{os.ErrExist, ErrExist},
+}
+
+// osError returns the Err value for err: the one its errno stands for,
+// if it has an errno, or else the one for it in osErrors. The errno
+// comes first because an errno which is none of ours may still be one
+// of package os's errors, as ENOTEMPTY is os.ErrExist.
+func osError(err error) *Error {
+	if errno := errnoOf(err); errno != 0 {
+		return errnoErrors[errno]
+	}
+	for _, o := range osErrors {
+		if errors.Is(err, o.err) {
+			return o.e
+		}
+	}
+	return nil
+}
+
+// errCut marks the end of an error which fitError cut short.
+const errCut = "..."
+
+// fitError cuts e to at most n bytes, and no more than a 9P string can
+// hold, without splitting a character. It ends what it cuts with
+// errCut, if there's room.
+func fitError(e string, n int) string {
+	if n > 1<<16-1 {
+		n = 1<<16 - 1
+	}
+	if n < 0 {
+		n = 0
+	}
+	if len(e) <= n {
+		return e
+	}
+	cut := errCut
+	if n < len(cut) {
+		cut = ""
+	}
+	n -= len(cut)
+	for n > 0 && !utf8.RuneStart(e[n]) {
+		n--
+	}
+	return e[:n] + cut
+}
+
+// tagOf returns the tag of the message in b, which holds it from the
+// tag on, without reading it.
+func tagOf(b *bytes.Buffer) Tag {
+	d := b.Bytes()
+	if len(d) < 2 {
+		return NOTAG
+	}
+	return Tag(d[0]) | Tag(d[1])<<8
+}
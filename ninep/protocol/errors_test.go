@@ -0,0 +1,258 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tagged returns a buffer holding a message from tag t on, as a
+// Dispatcher gets it.
+func tagged(t Tag) *bytes.Buffer {
+	return bytes.NewBuffer([]byte{byte(t), byte(t >> 8), 1, 2, 3, 4})
+}
+
+// rerror checks that b holds a well-formed message of type want and
+// returns the rest of it, from the tag on.
+func rerror(t *testing.T, b *bytes.Buffer, want MType) *bytes.Buffer {
+	t.Helper()
+	d := b.Bytes()
+	if len(d) < 7 || MType(d[4]) != want {
+		t.Fatalf("reply: want %v, got %v", RPCNames[want], d)
+	}
+	if l := int(d[0]) | int(d[1])<<8 | int(d[2])<<16 | int(d[3])<<24; l != len(d) {
+		t.Fatalf("reply: size says %d, but there are %d bytes", l, len(d))
+	}
+	return bytes.NewBuffer(d[5:])
+}
+
+func TestReplyError(t *testing.T) {
+	s := &Server{}
+	b := tagged(7)
+	s.ReplyError(b, tagOf(b), "walk %s: %v", "x", "no good")
+	if e, tag, err := UnmarshalRerrorPkt(rerror(t, b, Rerror)); err != nil || tag != 7 || e != "walk x: no good" {
+		t.Errorf("ReplyError: want (walk x: no good, 7), got (%q, %v, %v)", e, tag, err)
+	}
+
+	// The message is cut to fit msize, but not in the middle of a
+	// character, and marked as cut.
+	s.sess.msize = 20
+	b = tagged(7)
+	s.ReplyError(b, 7, "%s", strings.Repeat("é", 10))
+	if e, _, err := UnmarshalRerrorPkt(rerror(t, b, Rerror)); err != nil || e != "éééé..." || b.Len() != 20 {
+		t.Errorf("ReplyError with msize 20: want (éééé...) in 20 bytes, got (%q, %v) in %d", e, err, b.Len())
+	}
+
+	// 9P2000.u and 9P2000.L get the errno of an Err value.
+	s = &Server{sess: session{dotu: true}}
+	b = tagged(8)
+	s.ReplyError(b, 8, "open: %w", ErrNotExist)
+	if e, errno, tag, err := UnmarshalRerrorUPkt(rerror(t, b, Rerror)); err != nil || tag != 8 || errno != ENOENT || e != "open: file does not exist" {
+		t.Errorf("ReplyError for 9P2000.u: want (open: file does not exist, ENOENT, 8), got (%q, %v, %v, %v)", e, errno, tag, err)
+	}
+	s.sess.msize = 20
+	b = tagged(8)
+	s.ReplyError(b, 8, "%w", ErrPermission)
+	if e, errno, _, err := UnmarshalRerrorUPkt(rerror(t, b, Rerror)); err != nil || errno != EACCES || e != "perm..." || b.Len() != 20 {
+		t.Errorf("ReplyError for 9P2000.u with msize 20: want (perm..., EACCES) in 20 bytes, got (%q, %v, %v) in %d", e, errno, err, b.Len())
+	}
+	s = &Server{sess: session{dotl: true}}
+	b = tagged(9)
+	s.ReplyError(b, 9, "%w", ErrExist)
+	if errno, tag, err := UnmarshalRlerrorPkt(rerror(t, b, Rlerror)); err != nil || tag != 9 || errno != EEXIST {
+		t.Errorf("ReplyError for 9P2000.L: want (EEXIST, 9), got (%v, %v, %v)", errno, tag, err)
+	}
+
+	b = tagged(10)
+	ServerError(b, "bad")
+	if e, tag, err := UnmarshalRerrorPkt(rerror(t, b, Rerror)); err != nil || tag != 10 || e != "bad" {
+		t.Errorf("ServerError: want (bad, 10), got (%q, %v, %v)", e, tag, err)
+	}
+
+	// Before Tversion, and for messages we don't know.
+	s = &Server{}
+	b = tagged(11)
+	if err := Dispatch(nil, s, b, Twalk); err == nil {
+		t.Errorf("Dispatch of Twalk before Tversion: want err, got nil")
+	}
+	if e, tag, err := UnmarshalRerrorPkt(rerror(t, b, Rerror)); err != nil || tag != 11 || !strings.Contains(e, "not allowed before Tversion") {
+		t.Errorf("Dispatch of Twalk before Tversion: want an Rerror for tag 11, got (%q, %v, %v)", e, tag, err)
+	}
+	s.sess.versioned = true
+	b = tagged(12)
+	Dispatch(nil, s, b, Tlopen)
+	if e, tag, err := UnmarshalRerrorPkt(rerror(t, b, Rerror)); err != nil || tag != 12 || !strings.Contains(e, "not supported") {
+		t.Errorf("Dispatch of Tlopen to a 9P2000 server: want an Rerror for tag 12, got (%q, %v, %v)", e, tag, err)
+	}
+}
+
+func TestLongError(t *testing.T) {
+	long := strings.Repeat("x", 100<<10)
+	for _, s := range []*Server{
+		{sess: session{msize: 8192}},
+		{sess: session{msize: 8192, dotu: true}},
+		// Even with room for it, a 9P string can't hold it all.
+		{sess: session{msize: 1 << 20}},
+	} {
+		b := tagged(1)
+		s.ReplyError(b, 1, "%s", long)
+		var e string
+		var err error
+		if s.sess.dotu {
+			e, _, _, err = UnmarshalRerrorUPkt(rerror(t, b, Rerror))
+		} else {
+			e, _, err = UnmarshalRerrorPkt(rerror(t, b, Rerror))
+		}
+		if err != nil || !strings.HasPrefix(long, strings.TrimSuffix(e, errCut)) || !strings.HasSuffix(e, errCut) {
+			t.Errorf("msize %d, dotu %v: want the start of the error, cut, got (%.20q..., %v)", s.sess.msize, s.sess.dotu, e, err)
+		}
+		if b.Len() > int(s.sess.msize) || len(e) > 1<<16-1 {
+			t.Errorf("msize %d, dotu %v: reply is %d bytes, error %d", s.sess.msize, s.sess.dotu, b.Len(), len(e))
+		}
+	}
+}
+
+func TestOSError(t *testing.T) {
+	_, notExist := os.Open(filepath.Join(strings.Repeat("/long", 20), "missing"))
+	for _, tt := range []struct {
+		err   error
+		want  *Error
+		errno uint32
+	}{
+		{notExist, ErrNotExist, ENOENT},
+		{fmt.Errorf("walk: %w", notExist), ErrNotExist, ENOENT},
+		{&os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission}, ErrPermission, EACCES},
+		{&os.LinkError{Op: "rename", Old: "/x", New: "/y", Err: os.ErrExist}, ErrExist, EEXIST},
+	} {
+		s := &Server{sess: session{dotu: true}}
+		b := tagged(1)
+		s.ReplyError(b, 1, "%w", tt.err)
+		if e, errno, _, err := UnmarshalRerrorUPkt(rerror(t, b, Rerror)); err != nil || e != tt.want.Err || errno != tt.errno {
+			t.Errorf("%v: want (%q, %v), got (%q, %v, %v)", tt.err, tt.want.Err, tt.errno, e, errno, err)
+		}
+	}
+	// Other errors keep what they say.
+	s := &Server{}
+	b := tagged(1)
+	s.ReplyError(b, 1, "%w", errors.New("disk on fire"))
+	if e, _, err := UnmarshalRerrorPkt(rerror(t, b, Rerror)); err != nil || e != "disk on fire" {
+		t.Errorf("other error: want disk on fire, got (%q, %v)", e, err)
+	}
+}
+
+func TestClientError(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want *Error // nil for none
+	}{
+		// The Err values' own strings, as our servers send them.
+		{"file does not exist", ErrNotExist},
+		{"permission denied", ErrPermission},
+		{"file already exists", ErrExist},
+		{"not a directory", ErrNotDir},
+		{"file is a directory", ErrIsDir},
+		{"no space left on device", ErrNoSpace},
+		{"timed out", ErrTimedOut},
+		{"read-only file system", ErrReadOnly},
+		{"unknown fid", ErrUnknownFID},
+		{"fid in use", ErrFIDInUse},
+		{"fid is open", ErrFIDOpen},
+
+		// Other servers' strings.
+		{"file not found", ErrNotExist},
+		{"No such file or directory", ErrNotExist},
+		{"'x' file does not exist", ErrNotExist},
+		{"open /x: no such file or directory", ErrNotExist},
+		{"Permission denied", ErrPermission},
+		{"operation not permitted", ErrPermission},
+		{"File exists", ErrExist},
+		{"walk in non-directory", ErrNotDir},
+		{"Is a directory", ErrIsDir},
+		{"file system full", ErrNoSpace},
+		{"Connection timed out", ErrTimedOut},
+		{"fid unknown or out of range", ErrUnknownFID},
+		{"duplicate fid", ErrFIDInUse},
+
+		{"something else", nil},
+		{"directory not empty", nil},
+		{"not a directory: x", nil},
+		{"'x' something else", nil},
+	} {
+		err := clientError(tt.s)
+		if err == nil || err.Error() != tt.s {
+			t.Errorf("clientError(%q): want an error which says so, got %v", tt.s, err)
+			continue
+		}
+		var e *Error
+		switch {
+		case tt.want == nil && errors.As(err, &e):
+			t.Errorf("clientError(%q): want no Err value, got %v", tt.s, e)
+		case tt.want != nil && !errors.Is(err, tt.want):
+			t.Errorf("clientError(%q): want %v, got %v", tt.s, tt.want, err)
+		// Our own come back as themselves.
+		case tt.want != nil && tt.s == tt.want.Err && err != tt.want:
+			t.Errorf("clientError(%q): want %v itself, got %#v", tt.s, tt.want, err)
+		}
+	}
+}
+
+func TestErrorForErrno(t *testing.T) {
+	for _, tt := range []struct {
+		errno uint32
+		want  *Error
+	}{
+		{ENOENT, ErrNotExist},
+		{EPERM, ErrPermission},
+		{EACCES, ErrPermission},
+		{EEXIST, ErrExist},
+		{ENOTDIR, ErrNotDir},
+		{EISDIR, ErrIsDir},
+		{ENOSPC, ErrNoSpace},
+		{ETIMEDOUT, ErrTimedOut},
+		{EROFS, ErrReadOnly},
+		{EBADF, ErrUnknownFID},
+	} {
+		if err := ErrorForErrno(tt.errno); err != tt.want {
+			t.Errorf("ErrorForErrno(%d): want %v, got %v", tt.errno, tt.want, err)
+		}
+	}
+	var e *Error
+	if err := ErrorForErrno(EIO); !errors.As(err, &e) || e.Errno != EIO {
+		t.Errorf("ErrorForErrno(EIO): want an *Error with errno EIO, got %#v", err)
+	}
+
+	// And back: each Err value's errno stands for it, bar EBADF's
+	// and EINVAL's, which stand for more than one.
+	for _, e := range []*Error{ErrNotExist, ErrPermission, ErrExist, ErrNotDir, ErrIsDir, ErrNoSpace, ErrTimedOut, ErrReadOnly, ErrUnknownFID} {
+		if err := ErrorForErrno(e.Errno); err != e {
+			t.Errorf("ErrorForErrno(%v's errno %d): want it, got %v", e, e.Errno, err)
+		}
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	for _, tt := range []struct {
+		err, target error
+		want        bool
+	}{
+		{ErrNotExist, os.ErrNotExist, true},
+		{ErrPermission, os.ErrPermission, true},
+		{ErrExist, os.ErrExist, true},
+		{clientError("No such file or directory"), os.ErrNotExist, true},
+		{fmt.Errorf("walk: %w", ErrNotExist), os.ErrNotExist, true},
+		{ErrNotDir, os.ErrNotExist, false},
+		{ErrNotExist, os.ErrExist, false},
+	} {
+		if got := errors.Is(tt.err, tt.target); got != tt.want {
+			t.Errorf("errors.Is(%v, %v): want %v, got %v", tt.err, tt.target, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import "sync"
+
+// Errors a FIDMap returns for FIDs used against the rules.
+var (
+	ErrUnknownFID = &Error{"unknown fid", EBADF}
+	ErrFIDInUse   = &Error{"fid in use", EBADF}
+	ErrFIDOpen    = &Error{"fid is open", EBADF}
+)
+
+// An OpenFID is a FIDMap entry which knows whether it has been opened,
+// by Topen or Tcreate, so that Walk can refuse to walk from it.
+type OpenFID interface {
+	IsOpen() bool
+}
+
+// A FIDMap holds what a NineServer keeps for each of its client's
+// FIDs, and keeps to the rules for using them: a FID must be known to
+// be used, a new one must not be in use already, and one that has
+// been opened can't be walked from. Its methods may be called at once
+// from any number of goroutines. The zero FIDMap is empty and ready to
+// use.
+type FIDMap struct {
+	mu sync.Mutex
+	m  map[FID]interface{}
+}
+
+// Add sets fid to v, e.g. for Tattach or Tauth. It is ErrFIDInUse if
+// fid is set already.
+func (fm *FIDMap) Add(fid FID, v interface{}) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if _, ok := fm.m[fid]; ok {
+		return ErrFIDInUse
+	}
+	if fm.m == nil {
+		fm.m = make(map[FID]interface{})
+	}
+	fm.m[fid] = v
+	return nil
+}
+
+// Lookup returns what fid is set to, or ErrUnknownFID.
+func (fm *FIDMap) Lookup(fid FID) (interface{}, error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	v, ok := fm.m[fid]
+	if !ok {
+		return nil, ErrUnknownFID
+	}
+	return v, nil
+}
+
+// Replace sets fid, which must be set already, to v, e.g. once Topen
+// has opened it.
+func (fm *FIDMap) Replace(fid FID, v interface{}) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if _, ok := fm.m[fid]; !ok {
+		return ErrUnknownFID
+	}
+	fm.m[fid] = v
+	return nil
+}
+
+// Walk does a Twalk from fid to newfid. fid must be set, and not open
+// if it is an OpenFID, and newfid must not be in use unless it is fid.
+// walk is given what fid is set to, and returns what newfid is to be
+// set to, which for a walk of no names is a copy. It may return nil
+// for a walk which got only part of the way, when newfid is left
+// alone. It is called without the FIDMap locked, so it may take its
+// time; newfid is checked again once it is done.
+func (fm *FIDMap) Walk(fid, newfid FID, walk func(v interface{}) (interface{}, error)) error {
+	fm.mu.Lock()
+	v, ok := fm.m[fid]
+	_, inUse := fm.m[newfid]
+	fm.mu.Unlock()
+	switch {
+	case !ok:
+		return ErrUnknownFID
+	case isOpen(v):
+		return ErrFIDOpen
+	case inUse && newfid != fid:
+		return ErrFIDInUse
+	}
+
+	nv, err := walk(v)
+	if err != nil || nv == nil {
+		return err
+	}
+
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	_, ok = fm.m[newfid]
+	switch {
+	case newfid == fid && !ok:
+		// It was clunked while we walked.
+		return ErrUnknownFID
+	case newfid != fid && ok:
+		return ErrFIDInUse
+	}
+	fm.m[newfid] = nv
+	return nil
+}
+
+// Clunk forgets fid, for Tclunk or Tremove, and returns what it was
+// set to, for the caller to close.
+func (fm *FIDMap) Clunk(fid FID) (interface{}, error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	v, ok := fm.m[fid]
+	if !ok {
+		return nil, ErrUnknownFID
+	}
+	delete(fm.m, fid)
+	return v, nil
+}
+
+// ClunkAll forgets every FID, e.g. when the connection is done with,
+// and returns what they were set to.
+func (fm *FIDMap) ClunkAll() map[FID]interface{} {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	m := fm.m
+	fm.m = nil
+	return m
+}
+
+// Len returns the number of FIDs set.
+func (fm *FIDMap) Len() int {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	return len(fm.m)
+}
+
+func isOpen(v interface{}) bool {
+	o, ok := v.(OpenFID)
+	return ok && o.IsOpen()
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// fidEntry is a FIDMap entry, which may be open.
+type fidEntry struct {
+	name string
+	open bool
+}
+
+func (e *fidEntry) IsOpen() bool { return e.open }
+
+// walkTo returns a walk function which walks to name.
+func walkTo(name string) func(interface{}) (interface{}, error) {
+	return func(v interface{}) (interface{}, error) {
+		return &fidEntry{name: v.(*fidEntry).name + "/" + name}, nil
+	}
+}
+
+// clone is the walk function for a walk of no names.
+func clone(v interface{}) (interface{}, error) {
+	e := *v.(*fidEntry)
+	return &e, nil
+}
+
+// name returns the name fid is set to, or the error looking it up.
+func name(fm *FIDMap, fid FID) string {
+	v, err := fm.Lookup(fid)
+	if err != nil {
+		return err.Error()
+	}
+	return v.(*fidEntry).name
+}
+
+func TestFIDMap(t *testing.T) {
+	var fm FIDMap
+	if _, err := fm.Lookup(0); err != ErrUnknownFID {
+		t.Errorf("Lookup in an empty FIDMap: want ErrUnknownFID, got %v", err)
+	}
+	if err := fm.Add(0, &fidEntry{name: "root"}); err != nil {
+		t.Fatalf("Add: want nil, got %v", err)
+	}
+	if err := fm.Add(0, &fidEntry{name: "again"}); err != ErrFIDInUse {
+		t.Errorf("Add of a FID in use: want ErrFIDInUse, got %v", err)
+	}
+	if n := name(&fm, 0); n != "root" {
+		t.Errorf("Lookup after Add: want root, got %q", n)
+	}
+
+	for _, tt := range []struct {
+		what        string
+		fid, newfid FID
+		walk        func(interface{}) (interface{}, error)
+		err         error
+		want        string // what newfid is after
+	}{
+		{"clone", 0, 1, clone, nil, "root"},
+		{"walk", 0, 2, walkTo("a"), nil, "root/a"},
+		{"walk from unknown FID", 9, 3, walkTo("a"), ErrUnknownFID, "unknown fid"},
+		{"walk to FID in use", 0, 1, walkTo("b"), ErrFIDInUse, "root"},
+		{"clone to FID in use", 0, 2, clone, ErrFIDInUse, "root/a"},
+		{"walk in place", 2, 2, walkTo("b"), nil, "root/a/b"},
+		{"clone in place", 2, 2, clone, nil, "root/a/b"},
+		{"partial walk", 0, 3, func(interface{}) (interface{}, error) { return nil, nil }, nil, "unknown fid"},
+		{"failed walk", 0, 3, func(interface{}) (interface{}, error) { return nil, ErrNotExist }, ErrNotExist, "unknown fid"},
+	} {
+		if err := fm.Walk(tt.fid, tt.newfid, tt.walk); err != tt.err {
+			t.Errorf("%s: Walk(%d, %d): want %v, got %v", tt.what, tt.fid, tt.newfid, tt.err, err)
+		}
+		if n := name(&fm, tt.newfid); n != tt.want {
+			t.Errorf("%s: newfid %d: want %q, got %q", tt.what, tt.newfid, tt.want, n)
+		}
+	}
+	if n := name(&fm, 0); n != "root" {
+		t.Errorf("fid 0 after walks: want root, got %q", n)
+	}
+
+	// An open FID can't be walked from, even to clone it.
+	if err := fm.Replace(1, &fidEntry{name: "root", open: true}); err != nil {
+		t.Fatalf("Replace: want nil, got %v", err)
+	}
+	called := false
+	for _, newfid := range []FID{1, 4} {
+		err := fm.Walk(1, newfid, func(v interface{}) (interface{}, error) {
+			called = true
+			return clone(v)
+		})
+		if err != ErrFIDOpen {
+			t.Errorf("Walk(1, %d) from an open FID: want ErrFIDOpen, got %v", newfid, err)
+		}
+	}
+	if called {
+		t.Errorf("Walk from an open FID: walk function called")
+	}
+	if err := fm.Replace(9, &fidEntry{}); err != ErrUnknownFID {
+		t.Errorf("Replace of an unknown FID: want ErrUnknownFID, got %v", err)
+	}
+
+	if v, err := fm.Clunk(2); err != nil || v.(*fidEntry).name != "root/a/b" {
+		t.Errorf("Clunk: want root/a/b, got (%v, %v)", v, err)
+	}
+	if _, err := fm.Clunk(2); err != ErrUnknownFID {
+		t.Errorf("Clunk again: want ErrUnknownFID, got %v", err)
+	}
+	// A clunked FID may be used again at once.
+	if err := fm.Walk(0, 2, walkTo("c")); err != nil {
+		t.Errorf("Walk to a clunked FID: want nil, got %v", err)
+	}
+
+	if n := fm.Len(); n != 3 {
+		t.Errorf("Len: want 3, got %d", n)
+	}
+	all := fm.ClunkAll()
+	if len(all) != 3 || all[0].(*fidEntry).name != "root" || all[2].(*fidEntry).name != "root/c" {
+		t.Errorf("ClunkAll: want fids 0, 1 and 2, got %v", all)
+	}
+	if n := fm.Len(); n != 0 {
+		t.Errorf("Len after ClunkAll: want 0, got %d", n)
+	}
+	if err := fm.Add(0, &fidEntry{name: "root"}); err != nil {
+		t.Errorf("Add after ClunkAll: want nil, got %v", err)
+	}
+}
+
+// TestFIDMapWalkRace changes the FIDs while a walk is in progress: the
+// newfid may be taken, and the fid clunked.
+func TestFIDMapWalkRace(t *testing.T) {
+	var fm FIDMap
+	fm.Add(0, &fidEntry{name: "root"})
+	err := fm.Walk(0, 1, func(v interface{}) (interface{}, error) {
+		fm.Add(1, &fidEntry{name: "other"})
+		return walkTo("a")(v)
+	})
+	if err != ErrFIDInUse || name(&fm, 1) != "other" {
+		t.Errorf("Walk to a FID taken during the walk: want ErrFIDInUse and it left alone, got %v and %q", err, name(&fm, 1))
+	}
+	err = fm.Walk(1, 1, func(v interface{}) (interface{}, error) {
+		fm.Clunk(1)
+		return walkTo("a")(v)
+	})
+	if err != ErrUnknownFID || fm.Len() != 1 {
+		t.Errorf("Walk in place of a FID clunked during the walk: want ErrUnknownFID and it gone, got %v and %d FIDs", err, fm.Len())
+	}
+}
+
+func TestFIDMapConcurrent(t *testing.T) {
+	var fm FIDMap
+	fm.Add(0, &fidEntry{name: "root"})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				fid := FID(1 + g*1000 + i)
+				if err := fm.Walk(0, fid, walkTo(fmt.Sprint(fid))); err != nil {
+					t.Errorf("Walk(0, %d): want nil, got %v", fid, err)
+				}
+				if _, err := fm.Lookup(fid); err != nil {
+					t.Errorf("Lookup(%d): want nil, got %v", fid, err)
+				}
+				if i%2 == 0 {
+					if _, err := fm.Clunk(fid); err != nil {
+						t.Errorf("Clunk(%d): want nil, got %v", fid, err)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := fm.Len(); n != 1+8*50 {
+		t.Errorf("Len: want %d, got %d", 1+8*50, n)
+	}
+}
+
+func TestFIDMapErrors(t *testing.T) {
+	// The client gets back the same errors, so errors.Is works.
+	for _, e := range []*Error{ErrUnknownFID, ErrFIDInUse, ErrFIDOpen} {
+		if err := clientError(e.Err); !errors.Is(err, e) {
+			t.Errorf("clientError(%q): want %v, got %v", e.Err, e, err)
+		}
+	}
+}
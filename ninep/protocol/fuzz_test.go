@@ -0,0 +1,213 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unmarshalers are all the Unmarshal functions, which FuzzUnmarshal
+// picks from by its first argument.
+var unmarshalers = []interface{}{
+	UnmarshalDirU,
+	UnmarshalDirent,
+	Unmarshaldir,
+	UnmarshalRattachPkt,
+	UnmarshalRauthPkt,
+	UnmarshalRclunkPkt,
+	UnmarshalRcreatePkt,
+	UnmarshalRerrorPkt,
+	UnmarshalRerrorUPkt,
+	UnmarshalRflushPkt,
+	UnmarshalRfsyncPkt,
+	UnmarshalRgetattrPkt,
+	UnmarshalRgetlockPkt,
+	UnmarshalRlcreatePkt,
+	UnmarshalRlerrorPkt,
+	UnmarshalRlinkPkt,
+	UnmarshalRlockPkt,
+	UnmarshalRlopenPkt,
+	UnmarshalRmkdirPkt,
+	UnmarshalRmknodPkt,
+	UnmarshalRopenPkt,
+	UnmarshalRreadPkt,
+	UnmarshalRreaddirPkt,
+	UnmarshalRreadlinkPkt,
+	UnmarshalRremovePkt,
+	UnmarshalRrenamePkt,
+	UnmarshalRrenameatPkt,
+	UnmarshalRsetattrPkt,
+	UnmarshalRstatPkt,
+	UnmarshalRstatfsPkt,
+	UnmarshalRsymlinkPkt,
+	UnmarshalRunlinkatPkt,
+	UnmarshalRversionPkt,
+	UnmarshalRwalkPkt,
+	UnmarshalRwritePkt,
+	UnmarshalRwstatPkt,
+	UnmarshalRxattrcreatePkt,
+	UnmarshalRxattrwalkPkt,
+	UnmarshalTattachPkt,
+	UnmarshalTattachUPkt,
+	UnmarshalTauthPkt,
+	UnmarshalTauthUPkt,
+	UnmarshalTclunkPkt,
+	UnmarshalTcreatePkt,
+	UnmarshalTcreateUPkt,
+	UnmarshalTflushPkt,
+	UnmarshalTfsyncPkt,
+	UnmarshalTgetattrPkt,
+	UnmarshalTgetlockPkt,
+	UnmarshalTlcreatePkt,
+	UnmarshalTlinkPkt,
+	UnmarshalTlockPkt,
+	UnmarshalTlopenPkt,
+	UnmarshalTmkdirPkt,
+	UnmarshalTmknodPkt,
+	UnmarshalTopenPkt,
+	UnmarshalTreadPkt,
+	UnmarshalTreaddirPkt,
+	UnmarshalTreadlinkPkt,
+	UnmarshalTremovePkt,
+	UnmarshalTrenamePkt,
+	UnmarshalTrenameatPkt,
+	UnmarshalTsetattrPkt,
+	UnmarshalTstatPkt,
+	UnmarshalTstatfsPkt,
+	UnmarshalTsymlinkPkt,
+	UnmarshalTunlinkatPkt,
+	UnmarshalTversionPkt,
+	UnmarshalTwalkPkt,
+	UnmarshalTwritePkt,
+	UnmarshalTwstatPkt,
+	UnmarshalTxattrcreatePkt,
+	UnmarshalTxattrwalkPkt,
+}
+
+func funcName(f interface{}) string {
+	n := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+	return n[strings.LastIndex(n, ".")+1:]
+}
+
+// unmarshalerFor returns the index in unmarshalers of the function for
+// messages of type t.
+func unmarshalerFor(t MType) int {
+	for i, u := range unmarshalers {
+		if funcName(u) == "Unmarshal"+RPCNames[t]+"Pkt" {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkSize fails if anything in v, which was unmarshaled from n
+// bytes, is bigger than those bytes could hold.
+func checkSize(t *testing.T, what string, v reflect.Value, n int) {
+	t.Helper()
+	switch v.Kind() {
+	case reflect.String, reflect.Slice:
+		if v.Len() > n {
+			t.Fatalf("%s: %d long, from %d bytes", what, v.Len(), n)
+		}
+		if v.Kind() == reflect.Slice {
+			for i := 0; i < v.Len(); i++ {
+				checkSize(t, what, v.Index(i), n)
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			checkSize(t, what, v.Field(i), n)
+		}
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, tt := range wireTests {
+		if i := unmarshalerFor(MType(tt.wire[4])); i >= 0 {
+			f.Add(uint8(i), tt.wire[5:])
+		}
+	}
+	f.Add(uint8(0), wireDirU)
+	f.Add(uint8(2), wireDir)
+	f.Fuzz(func(t *testing.T, which uint8, data []byte) {
+		u := unmarshalers[int(which)%len(unmarshalers)]
+		out := reflect.ValueOf(u).Call([]reflect.Value{reflect.ValueOf(bytes.NewBuffer(data))})
+		for _, v := range out {
+			checkSize(t, funcName(u), v, len(data))
+		}
+	})
+}
+
+// fuzzServer is an echo server which keeps nothing from one request
+// to the next.
+type fuzzServer struct {
+	*echo
+}
+
+func (s *fuzzServer) Rclunk(ctx context.Context, f FID) error  { return nil }
+func (s *fuzzServer) Rremove(ctx context.Context, f FID) error { return nil }
+
+func FuzzServe(f *testing.F) {
+	var b bytes.Buffer
+	MarshalTversionPkt(&b, NOTAG, 8192, Version)
+	version := b.Bytes()
+	all := version
+	for _, tt := range wireTests {
+		if MType(tt.wire[4])&1 == 0 {
+			f.Add(append(version[:len(version):len(version)], tt.wire...))
+			all = append(all[:len(all):len(all)], tt.wire...)
+		}
+	}
+	f.Add(all)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		l, err := NewNetListener(func() NineServer { return &fuzzServer{echo: newEcho()} })
+		if err != nil {
+			t.Fatalf("NewNetListener: want nil, got %v", err)
+		}
+		p, p2 := net.Pipe()
+		defer p.Close()
+		if err := l.Accept(p2); err != nil {
+			t.Fatalf("Accept: want nil, got %v", err)
+		}
+		read := make(chan struct{})
+		go func() {
+			io.Copy(ioutil.Discard, p)
+			close(read)
+		}()
+		wrote := make(chan struct{})
+		go func() {
+			p.Write(data)
+			close(wrote)
+		}()
+
+		// The server must take all it's given, unless it hangs up.
+		select {
+		case <-wrote:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the server stopped reading, but didn't hang up")
+		}
+		// Then, it must finish what it was asked, and hang up.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := l.Shutdown(ctx); err != nil {
+			t.Fatalf("Shutdown: want nil, got %v", err)
+		}
+		select {
+		case <-read:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the connection is still open after Shutdown")
+		}
+	})
+}
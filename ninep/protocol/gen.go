@@ -41,6 +41,7 @@ const (
 package protocol
 import (
 "bytes"
+"context"
 "fmt"
 _ "log"
 )
@@ -67,6 +68,8 @@ type emitter struct {
 type call struct {
 	T *emitter
 	R *emitter
+	// NS is the NineServer the server function calls.
+	NS string
 }
 
 type pack struct {
@@ -75,17 +78,17 @@ type pack struct {
 	tn string
 	r  interface{}
 	rn string
+	// l is set for 9P2000.L messages, which are served by a
+	// NineServerL, and which the Client doesn't speak.
+	l bool
 }
 
 const (
-	serverError = `func ServerError (b *bytes.Buffer, s string) {
-	var u [8]byte
-	// This can't really happen. 
-	if _, err := b.Read(u[:2]); err != nil {
-		return
-	}
-	t := Tag(uint16(u[0])|uint16(u[1])<<8)
-	MarshalRerrorPkt (b, t, s)
+	serverError = `// ServerError replaces the T-message in b, from its tag on, with a
+// 9P2000 Rerror carrying s. Dispatchers should use Server.ReplyError,
+// which speaks the connection's dialect and knows its msize.
+func ServerError (b *bytes.Buffer, s string) {
+	(&Server{}).ReplyError(b, tagOf(b), "%s", s)
 }
 `
 )
@@ -96,6 +99,7 @@ var (
 	packages = []*pack{
 		{n: "error", t: protocol.RerrorPkt{}, tn: "Rerror", r: protocol.RerrorPkt{}, rn: "Rerror"},
 		{n: "version", t: protocol.TversionPkt{}, tn: "Tversion", r: protocol.RversionPkt{}, rn: "Rversion"},
+		{n: "auth", t: protocol.TauthPkt{}, tn: "Tauth", r: protocol.RauthPkt{}, rn: "Rauth"},
 		{n: "attach", t: protocol.TattachPkt{}, tn: "Tattach", r: protocol.RattachPkt{}, rn: "Rattach"},
 		{n: "flush", t: protocol.TflushPkt{}, tn: "Tflush", r: protocol.RflushPkt{}, rn: "Rflush"},
 		{n: "walk", t: protocol.TwalkPkt{}, tn: "Twalk", r: protocol.RwalkPkt{}, rn: "Rwalk"},
@@ -107,6 +111,26 @@ var (
 		{n: "remove", t: protocol.TremovePkt{}, tn: "Tremove", r: protocol.RremovePkt{}, rn: "Rremove"},
 		{n: "read", t: protocol.TreadPkt{}, tn: "Tread", r: protocol.RreadPkt{}, rn: "Rread"},
 		{n: "write", t: protocol.TwritePkt{}, tn: "Twrite", r: protocol.RwritePkt{}, rn: "Rwrite"},
+		{n: "lerror", t: protocol.RlerrorPkt{}, tn: "Rlerror", r: protocol.RlerrorPkt{}, rn: "Rlerror", l: true},
+		{n: "statfs", t: protocol.TstatfsPkt{}, tn: "Tstatfs", r: protocol.RstatfsPkt{}, rn: "Rstatfs", l: true},
+		{n: "lopen", t: protocol.TlopenPkt{}, tn: "Tlopen", r: protocol.RlopenPkt{}, rn: "Rlopen", l: true},
+		{n: "lcreate", t: protocol.TlcreatePkt{}, tn: "Tlcreate", r: protocol.RlcreatePkt{}, rn: "Rlcreate", l: true},
+		{n: "symlink", t: protocol.TsymlinkPkt{}, tn: "Tsymlink", r: protocol.RsymlinkPkt{}, rn: "Rsymlink", l: true},
+		{n: "mknod", t: protocol.TmknodPkt{}, tn: "Tmknod", r: protocol.RmknodPkt{}, rn: "Rmknod", l: true},
+		{n: "rename", t: protocol.TrenamePkt{}, tn: "Trename", r: protocol.RrenamePkt{}, rn: "Rrename", l: true},
+		{n: "readlink", t: protocol.TreadlinkPkt{}, tn: "Treadlink", r: protocol.RreadlinkPkt{}, rn: "Rreadlink", l: true},
+		{n: "getattr", t: protocol.TgetattrPkt{}, tn: "Tgetattr", r: protocol.RgetattrPkt{}, rn: "Rgetattr", l: true},
+		{n: "setattr", t: protocol.TsetattrPkt{}, tn: "Tsetattr", r: protocol.RsetattrPkt{}, rn: "Rsetattr", l: true},
+		{n: "xattrwalk", t: protocol.TxattrwalkPkt{}, tn: "Txattrwalk", r: protocol.RxattrwalkPkt{}, rn: "Rxattrwalk", l: true},
+		{n: "xattrcreate", t: protocol.TxattrcreatePkt{}, tn: "Txattrcreate", r: protocol.RxattrcreatePkt{}, rn: "Rxattrcreate", l: true},
+		{n: "readdir", t: protocol.TreaddirPkt{}, tn: "Treaddir", r: protocol.RreaddirPkt{}, rn: "Rreaddir", l: true},
+		{n: "fsync", t: protocol.TfsyncPkt{}, tn: "Tfsync", r: protocol.RfsyncPkt{}, rn: "Rfsync", l: true},
+		{n: "lock", t: protocol.TlockPkt{}, tn: "Tlock", r: protocol.RlockPkt{}, rn: "Rlock", l: true},
+		{n: "getlock", t: protocol.TgetlockPkt{}, tn: "Tgetlock", r: protocol.RgetlockPkt{}, rn: "Rgetlock", l: true},
+		{n: "link", t: protocol.TlinkPkt{}, tn: "Tlink", r: protocol.RlinkPkt{}, rn: "Rlink", l: true},
+		{n: "mkdir", t: protocol.TmkdirPkt{}, tn: "Tmkdir", r: protocol.RmkdirPkt{}, rn: "Rmkdir", l: true},
+		{n: "renameat", t: protocol.TrenameatPkt{}, tn: "Trenameat", r: protocol.RrenameatPkt{}, rn: "Rrenameat", l: true},
+		{n: "unlinkat", t: protocol.TunlinkatPkt{}, tn: "Tunlinkat", r: protocol.RunlinkatPkt{}, rn: "Runlinkat", l: true},
 	}
 	msfunc = template.Must(template.New("ms").Parse(`func Marshal{{.MFunc}} (b *bytes.Buffer, {{.MParms}}) {
 var l uint64
@@ -144,10 +168,11 @@ return
 	ufunc = template.Must(template.New("mr").Parse(`func Unmarshal{{.UFunc}}Pkt (b *bytes.Buffer) ({{.URet}} t Tag, err error) {
 var u [8]uint8
 var l uint64
-if _, err = b.Read(u[:2]); err != nil {
+if b.Len() < 2 {
 err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 return
 }
+b.Read(u[:2])
 l = uint64(u[0]) | uint64(u[1])<<8
 t = Tag(l)
 {{.UCode}}
@@ -157,12 +182,14 @@ err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
 return
 }
 `))
-	sfunc = template.Must(template.New("s").Parse(`func (s *Server) Srv{{.R.UFunc}}(b*bytes.Buffer) (err error) {
+	sfunc = template.Must(template.New("s").Parse(`func (s *Server) Srv{{.R.UFunc}}(ctx context.Context, b*bytes.Buffer) (err error) {
 	{{.T.MList}}{{.T.MLsep}} t, err := Unmarshal{{.T.MFunc}}Pkt(b)
-	//if err != nil {
-	//}
-	if {{.R.MList}}{{.R.MLsep}} err := s.NS.{{.R.MFunc}}({{.T.MList}}); err != nil {
-	MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[{{.T.MFunc}}], err)
+		return err
+	}
+	if {{.R.MList}}{{.R.MLsep}} err := {{.NS}}.{{.R.MFunc}}(ctx, {{.T.MList}}); err != nil {
+	s.marshalRerror(b, t, err)
 } else {
 	Marshal{{.R.MFunc}}Pkt(b, t, {{.R.MList}})
 }
@@ -184,7 +211,7 @@ if MType(bb[4]) == Rerror {
 	if err != nil {
 		return {{.R.UList}} err
 	}
-	return {{.R.UList}} fmt.Errorf("%v", s)
+	return {{.R.UList}} clientError(s)
 } else {
 	{{.R.MList}}{{.R.MLsep}} _, err = Unmarshal{{.R.UFunc}}Pkt(bytes.NewBuffer(bb[5:]))
 }
@@ -197,7 +224,10 @@ func nodebug(string, ...interface{}) {
 }
 
 func newCall(p *pack) *call {
-	c := &call{}
+	c := &call{NS: "s.NS"}
+	if p.l {
+		c.NS = "s.NS.(NineServerL)"
+	}
 	// We set inBWrite to true because the prologue marshal code sets up some default writes to b
 	c.T = &emitter{"T" + p.n, p.tn, &bytes.Buffer{}, &bytes.Buffer{}, "", &bytes.Buffer{}, p.tn, &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}, true}
 	c.R = &emitter{"R" + p.n, p.rn, &bytes.Buffer{}, &bytes.Buffer{}, "", &bytes.Buffer{}, p.rn, &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}, true}
@@ -218,7 +248,9 @@ func emitEncodeInt(v interface{}, n string, l int, e *emitter) {
 func emitDecodeInt(v interface{}, n string, l int, e *emitter) {
 	t := reflect.ValueOf(v).Type().Name()
 	debug("emit reflect.ValueOf(v) %s %v, %v", t, n, l)
-	e.UCode.WriteString(fmt.Sprintf("\tif _, err = b.Read(u[:%v]); err != nil {\n\t\terr = fmt.Errorf(\"pkt too short for uint%v: need %v, have %%d\", b.Len())\n\treturn\n\t}\n", l, l*8, l))
+	// bytes.Buffer's Read only fails when the buffer is empty; a
+	// field cut short must be caught before it's read.
+	e.UCode.WriteString(fmt.Sprintf("\tif b.Len() < %v {\n\t\terr = fmt.Errorf(\"pkt too short for uint%v: need %v, have %%d\", b.Len())\n\treturn\n\t}\n\tb.Read(u[:%v])\n", l, l*8, l, l))
 	e.UCode.WriteString(fmt.Sprintf("\t%v = %s(u[0])\n", n, t))
 	for i := 1; i < l; i++ {
 		e.UCode.WriteString(fmt.Sprintf("\t%v |= %s(u[%d])<<%v\n", n, t, i, i*8))
@@ -245,6 +277,14 @@ func emitDecodeString(n string, e *emitter) {
 	e.UCode.WriteString("\t_ = b.Next(int(l))\n")
 }
 
+// emitDecodeBytes decodes l bytes, whose count has already been read.
+// The data is not copied: it refers to b.
+func emitDecodeBytes(n string, e *emitter) {
+	e.UCode.WriteString(fmt.Sprintf("\tif b.Len() < int(l) {\n\t\terr = fmt.Errorf(\"pkt too short for []byte: need %%d, have %%d\", l, b.Len())\n\treturn\n\t}\n"))
+	e.UCode.WriteString(fmt.Sprintf("\t%v = b.Bytes()[:l]\n", n))
+	e.UCode.WriteString("\t_ = b.Next(int(l))\n")
+}
+
 func genEncodeStruct(v interface{}, n string, e *emitter) error {
 	debug("genEncodeStruct(%T, %v, %v)", v, n, e)
 	t := reflect.ValueOf(v)
@@ -318,6 +358,19 @@ func genEncodeSlice(v interface{}, n string, e *emitter) error {
 	return nil
 }
 
+// emitCheckWalk refuses a walk of more than MaxWElem elements, as the
+// protocol does, or of more than the rest of the packet could hold,
+// each being at least size bytes. The only slices of strings and QIDs
+// are in Twalk and Rwalk.
+func emitCheckWalk(size int, e *emitter) {
+	e.UCode.WriteString("\tif l > MaxWElem {\n")
+	e.UCode.WriteString("\t\terr = fmt.Errorf(\"%d walk elements; the most is %d\", l, MaxWElem)\n")
+	e.UCode.WriteString("\t\treturn\n\t}\n")
+	e.UCode.WriteString(fmt.Sprintf("\tif b.Len() < int(l)*%d {\n", size))
+	e.UCode.WriteString(fmt.Sprintf("\t\terr = fmt.Errorf(\"pkt too short for %%d walk elements: need %%d, have %%d\", l, l*%d, b.Len())\n", size))
+	e.UCode.WriteString("\t\treturn\n\t}\n")
+}
+
 func genDecodeSlice(v interface{}, n string, e *emitter) error {
 	// Sadly, []byte is not encoded like []everything else.
 	t := fmt.Sprintf("%T", v)
@@ -325,6 +378,7 @@ func genDecodeSlice(v interface{}, n string, e *emitter) error {
 	case "[]string":
 		var u uint64
 		emitDecodeInt(u, "l", 2, e)
+		emitCheckWalk(2, e)
 		e.UCode.WriteString(fmt.Sprintf("\t%v = make([]string, l)\n", n))
 		e.UCode.WriteString(fmt.Sprintf("for i := range %v {\n", n))
 		var s string
@@ -333,6 +387,7 @@ func genDecodeSlice(v interface{}, n string, e *emitter) error {
 	case "[]protocol.QID":
 		var u uint64
 		emitDecodeInt(u, "l", 2, e)
+		emitCheckWalk(13, e)
 		e.UCode.WriteString(fmt.Sprintf("\t%v = make([]QID, l)\n", n))
 		e.UCode.WriteString(fmt.Sprintf("for i := range %v {\n", n))
 		genDecodeData(protocol.QID{}, n+"[i]", e)
@@ -340,13 +395,11 @@ func genDecodeSlice(v interface{}, n string, e *emitter) error {
 	case "[]byte", "[]uint8":
 		var u uint64
 		emitDecodeInt(u, "l", 4, e)
-		e.UCode.WriteString(fmt.Sprintf("\t%v = b.Bytes()[:l]\n", n))
-		e.UCode.WriteString("\t_ = b.Next(int(l))\n")
+		emitDecodeBytes(n, e)
 	case "[]protocol.DataCnt16":
 		var u uint64
 		emitDecodeInt(u, "l", 2, e)
-		e.UCode.WriteString(fmt.Sprintf("\t%v = b.Bytes()[:l]\n", n))
-		e.UCode.WriteString("\t_ = b.Next(int(l))\n")
+		emitDecodeBytes(n, e)
 	default:
 		log.Printf("genDecodeSlice: Can't handle slice of %v", t)
 	}
@@ -505,14 +558,19 @@ func genMsgRPC(b io.Writer, p *pack) (*call, error) {
 	mfunc.Execute(b, c.R)
 	ufunc.Execute(b, c.R)
 
-	if p.n == "error" {
+	if p.n == "error" || p.n == "lerror" {
 		return c, nil
 	}
 
 	mfunc.Execute(b, c.T)
 	ufunc.Execute(b, c.T)
-	sfunc.Execute(b, c)
-	cfunc.Execute(b, c)
+	// Rauth is optional, so its server function is written by hand.
+	if p.n != "auth" {
+		sfunc.Execute(b, c)
+	}
+	if !p.l {
+		cfunc.Execute(b, c)
+	}
 	return nil, nil
 
 }
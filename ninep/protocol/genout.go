@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	_ "log"
 )
@@ -25,16 +26,18 @@ func MarshalRerrorPkt(b *bytes.Buffer, t Tag, Error string) {
 func UnmarshalRerrorPkt(b *bytes.Buffer) (Error string, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	if b.Len() < int(l) {
@@ -72,24 +75,27 @@ func MarshalRversionPkt(b *bytes.Buffer, t Tag, RMsize MaxSize, RVersion string)
 func UnmarshalRversionPkt(b *bytes.Buffer) (RMsize MaxSize, RVersion string, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	RMsize = MaxSize(u[0])
 	RMsize |= MaxSize(u[1]) << 8
 	RMsize |= MaxSize(u[2]) << 16
 	RMsize |= MaxSize(u[3]) << 24
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	if b.Len() < int(l) {
@@ -127,24 +133,27 @@ func MarshalTversionPkt(b *bytes.Buffer, t Tag, TMsize MaxSize, TVersion string)
 func UnmarshalTversionPkt(b *bytes.Buffer) (TMsize MaxSize, TVersion string, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	TMsize = MaxSize(u[0])
 	TMsize |= MaxSize(u[1]) << 8
 	TMsize |= MaxSize(u[2]) << 16
 	TMsize |= MaxSize(u[3]) << 24
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	if b.Len() < int(l) {
@@ -159,12 +168,14 @@ func UnmarshalTversionPkt(b *bytes.Buffer) (TMsize MaxSize, TVersion string, t T
 	}
 	return
 }
-func (s *Server) SrvRversion(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRversion(ctx context.Context, b *bytes.Buffer) (err error) {
 	TMsize, TVersion, t, err := UnmarshalTversionPkt(b)
-	//if err != nil {
-	//}
-	if RMsize, RVersion, err := s.NS.Rversion(TMsize, TVersion); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tversion], err)
+		return err
+	}
+	if RMsize, RVersion, err := s.NS.Rversion(ctx, TMsize, TVersion); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRversionPkt(b, t, RMsize, RVersion)
 	}
@@ -189,12 +200,181 @@ func (c *Client) CallTversion(TMsize MaxSize, TVersion string) (RMsize MaxSize,
 		if err != nil {
 			return RMsize, RVersion, err
 		}
-		return RMsize, RVersion, fmt.Errorf("%v", s)
+		return RMsize, RVersion, clientError(s)
 	} else {
 		RMsize, RVersion, _, err = UnmarshalRversionPkt(bytes.NewBuffer(bb[5:]))
 	}
 	return RMsize, RVersion, err
 }
+func MarshalRauthPkt(b *bytes.Buffer, t Tag, AQID QID) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rauth),
+		byte(t), byte(t >> 8),
+		uint8(AQID.Type >> 0),
+		uint8(AQID.Version >> 0),
+		uint8(AQID.Version >> 8),
+		uint8(AQID.Version >> 16),
+		uint8(AQID.Version >> 24),
+		uint8(AQID.Path >> 0),
+		uint8(AQID.Path >> 8),
+		uint8(AQID.Path >> 16),
+		uint8(AQID.Path >> 24),
+		uint8(AQID.Path >> 32),
+		uint8(AQID.Path >> 40),
+		uint8(AQID.Path >> 48),
+		uint8(AQID.Path >> 56),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRauthPkt(b *bytes.Buffer) (AQID QID, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	AQID.Type = uint8(u[0])
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	AQID.Version = uint32(u[0])
+	AQID.Version |= uint32(u[1]) << 8
+	AQID.Version |= uint32(u[2]) << 16
+	AQID.Version |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	AQID.Path = uint64(u[0])
+	AQID.Path |= uint64(u[1]) << 8
+	AQID.Path |= uint64(u[2]) << 16
+	AQID.Path |= uint64(u[3]) << 24
+	AQID.Path |= uint64(u[4]) << 32
+	AQID.Path |= uint64(u[5]) << 40
+	AQID.Path |= uint64(u[6]) << 48
+	AQID.Path |= uint64(u[7]) << 56
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTauthPkt(b *bytes.Buffer, t Tag, AFID FID, Uname string, Aname string) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tauth),
+		byte(t), byte(t >> 8),
+		uint8(AFID >> 0),
+		uint8(AFID >> 8),
+		uint8(AFID >> 16),
+		uint8(AFID >> 24),
+		uint8(len(Uname)), uint8(len(Uname) >> 8),
+	})
+	b.Write([]byte(Uname))
+	b.Write([]byte{uint8(len(Aname)), uint8(len(Aname) >> 8)})
+	b.Write([]byte(Aname))
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTauthPkt(b *bytes.Buffer) (AFID FID, Uname string, Aname string, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	AFID = FID(u[0])
+	AFID |= FID(u[1]) << 8
+	AFID |= FID(u[2]) << 16
+	AFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	Uname = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	Aname = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+
+func (c *Client) CallTauth(AFID FID, Uname string, Aname string) (AQID QID, err error) {
+	var b = bytes.Buffer{}
+	if c.Trace != nil {
+		c.Trace("%v", Tauth)
+	}
+	t := Tag(0)
+	r := make(chan []byte)
+	if c.Trace != nil {
+		c.Trace(":tag %v, FID %v", t, c.FID)
+	}
+	MarshalTauthPkt(&b, t, AFID, Uname, Aname)
+	c.FromClient <- &RPCCall{b: b.Bytes(), Reply: r}
+	bb := <-r
+	if MType(bb[4]) == Rerror {
+		s, _, err := UnmarshalRerrorPkt(bytes.NewBuffer(bb[5:]))
+		if err != nil {
+			return AQID, err
+		}
+		return AQID, clientError(s)
+	} else {
+		AQID, _, err = UnmarshalRauthPkt(bytes.NewBuffer(bb[5:]))
+	}
+	return AQID, err
+}
 func MarshalRattachPkt(b *bytes.Buffer, t Tag, QID QID) {
 	var l uint64
 	b.Reset()
@@ -225,29 +405,33 @@ func MarshalRattachPkt(b *bytes.Buffer, t Tag, QID QID) {
 func UnmarshalRattachPkt(b *bytes.Buffer) (QID QID, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:1]); err != nil {
+	if b.Len() < 1 {
 		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
 		return
 	}
+	b.Read(u[:1])
 	QID.Type = uint8(u[0])
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	QID.Version = uint32(u[0])
 	QID.Version |= uint32(u[1]) << 8
 	QID.Version |= uint32(u[2]) << 16
 	QID.Version |= uint32(u[3]) << 24
-	if _, err = b.Read(u[:8]); err != nil {
+	if b.Len() < 8 {
 		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
 		return
 	}
+	b.Read(u[:8])
 	QID.Path = uint64(u[0])
 	QID.Path |= uint64(u[1]) << 8
 	QID.Path |= uint64(u[2]) << 16
@@ -291,32 +475,36 @@ func MarshalTattachPkt(b *bytes.Buffer, t Tag, SFID FID, AFID FID, Uname string,
 func UnmarshalTattachPkt(b *bytes.Buffer) (SFID FID, AFID FID, Uname string, Aname string, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	SFID = FID(u[0])
 	SFID |= FID(u[1]) << 8
 	SFID |= FID(u[2]) << 16
 	SFID |= FID(u[3]) << 24
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	AFID = FID(u[0])
 	AFID |= FID(u[1]) << 8
 	AFID |= FID(u[2]) << 16
 	AFID |= FID(u[3]) << 24
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	if b.Len() < int(l) {
@@ -325,10 +513,11 @@ func UnmarshalTattachPkt(b *bytes.Buffer) (SFID FID, AFID FID, Uname string, Ana
 	}
 	Uname = string(b.Bytes()[:l])
 	_ = b.Next(int(l))
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	if b.Len() < int(l) {
@@ -343,12 +532,14 @@ func UnmarshalTattachPkt(b *bytes.Buffer) (SFID FID, AFID FID, Uname string, Ana
 	}
 	return
 }
-func (s *Server) SrvRattach(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRattach(ctx context.Context, b *bytes.Buffer) (err error) {
 	SFID, AFID, Uname, Aname, t, err := UnmarshalTattachPkt(b)
-	//if err != nil {
-	//}
-	if QID, err := s.NS.Rattach(SFID, AFID, Uname, Aname); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tattach], err)
+		return err
+	}
+	if QID, err := s.NS.Rattach(ctx, SFID, AFID, Uname, Aname); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRattachPkt(b, t, QID)
 	}
@@ -373,7 +564,7 @@ func (c *Client) CallTattach(SFID FID, AFID FID, Uname string, Aname string) (QI
 		if err != nil {
 			return QID, err
 		}
-		return QID, fmt.Errorf("%v", s)
+		return QID, clientError(s)
 	} else {
 		QID, _, err = UnmarshalRattachPkt(bytes.NewBuffer(bb[5:]))
 	}
@@ -396,10 +587,11 @@ func MarshalRflushPkt(b *bytes.Buffer, t Tag) {
 func UnmarshalRflushPkt(b *bytes.Buffer) (t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
 
@@ -427,16 +619,18 @@ func MarshalTflushPkt(b *bytes.Buffer, t Tag, OTag Tag) {
 func UnmarshalTflushPkt(b *bytes.Buffer) (OTag Tag, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	OTag = Tag(u[0])
 	OTag |= Tag(u[1]) << 8
 
@@ -445,12 +639,14 @@ func UnmarshalTflushPkt(b *bytes.Buffer) (OTag Tag, t Tag, err error) {
 	}
 	return
 }
-func (s *Server) SrvRflush(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRflush(ctx context.Context, b *bytes.Buffer) (err error) {
 	OTag, t, err := UnmarshalTflushPkt(b)
-	//if err != nil {
-	//}
-	if err := s.NS.Rflush(OTag); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tflush], err)
+		return err
+	}
+	if err := s.NS.Rflush(ctx, OTag); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRflushPkt(b, t)
 	}
@@ -475,7 +671,7 @@ func (c *Client) CallTflush(OTag Tag) (err error) {
 		if err != nil {
 			return err
 		}
-		return fmt.Errorf("%v", s)
+		return clientError(s)
 	} else {
 		_, err = UnmarshalRflushPkt(bytes.NewBuffer(bb[5:]))
 	}
@@ -516,37 +712,50 @@ func MarshalRwalkPkt(b *bytes.Buffer, t Tag, QIDs []QID) {
 func UnmarshalRwalkPkt(b *bytes.Buffer) (QIDs []QID, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
+	if l > MaxWElem {
+		err = fmt.Errorf("%d walk elements; the most is %d", l, MaxWElem)
+		return
+	}
+	if b.Len() < int(l)*13 {
+		err = fmt.Errorf("pkt too short for %d walk elements: need %d, have %d", l, l*13, b.Len())
+		return
+	}
 	QIDs = make([]QID, l)
 	for i := range QIDs {
-		if _, err = b.Read(u[:1]); err != nil {
+		if b.Len() < 1 {
 			err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
 			return
 		}
+		b.Read(u[:1])
 		QIDs[i].Type = uint8(u[0])
-		if _, err = b.Read(u[:4]); err != nil {
+		if b.Len() < 4 {
 			err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 			return
 		}
+		b.Read(u[:4])
 		QIDs[i].Version = uint32(u[0])
 		QIDs[i].Version |= uint32(u[1]) << 8
 		QIDs[i].Version |= uint32(u[2]) << 16
 		QIDs[i].Version |= uint32(u[3]) << 24
-		if _, err = b.Read(u[:8]); err != nil {
+		if b.Len() < 8 {
 			err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
 			return
 		}
+		b.Read(u[:8])
 		QIDs[i].Path = uint64(u[0])
 		QIDs[i].Path |= uint64(u[1]) << 8
 		QIDs[i].Path |= uint64(u[2]) << 16
@@ -593,40 +802,53 @@ func MarshalTwalkPkt(b *bytes.Buffer, t Tag, SFID FID, NewFID FID, Paths []strin
 func UnmarshalTwalkPkt(b *bytes.Buffer) (SFID FID, NewFID FID, Paths []string, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	SFID = FID(u[0])
 	SFID |= FID(u[1]) << 8
 	SFID |= FID(u[2]) << 16
 	SFID |= FID(u[3]) << 24
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	NewFID = FID(u[0])
 	NewFID |= FID(u[1]) << 8
 	NewFID |= FID(u[2]) << 16
 	NewFID |= FID(u[3]) << 24
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
+	if l > MaxWElem {
+		err = fmt.Errorf("%d walk elements; the most is %d", l, MaxWElem)
+		return
+	}
+	if b.Len() < int(l)*2 {
+		err = fmt.Errorf("pkt too short for %d walk elements: need %d, have %d", l, l*2, b.Len())
+		return
+	}
 	Paths = make([]string, l)
 	for i := range Paths {
-		if _, err = b.Read(u[:2]); err != nil {
+		if b.Len() < 2 {
 			err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 			return
 		}
+		b.Read(u[:2])
 		l = uint64(u[0])
 		l |= uint64(u[1]) << 8
 		if b.Len() < int(l) {
@@ -642,12 +864,14 @@ func UnmarshalTwalkPkt(b *bytes.Buffer) (SFID FID, NewFID FID, Paths []string, t
 	}
 	return
 }
-func (s *Server) SrvRwalk(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRwalk(ctx context.Context, b *bytes.Buffer) (err error) {
 	SFID, NewFID, Paths, t, err := UnmarshalTwalkPkt(b)
-	//if err != nil {
-	//}
-	if QIDs, err := s.NS.Rwalk(SFID, NewFID, Paths); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Twalk], err)
+		return err
+	}
+	if QIDs, err := s.NS.Rwalk(ctx, SFID, NewFID, Paths); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRwalkPkt(b, t, QIDs)
 	}
@@ -672,7 +896,7 @@ func (c *Client) CallTwalk(SFID FID, NewFID FID, Paths []string) (QIDs []QID, er
 		if err != nil {
 			return QIDs, err
 		}
-		return QIDs, fmt.Errorf("%v", s)
+		return QIDs, clientError(s)
 	} else {
 		QIDs, _, err = UnmarshalRwalkPkt(bytes.NewBuffer(bb[5:]))
 	}
@@ -712,29 +936,33 @@ func MarshalRopenPkt(b *bytes.Buffer, t Tag, OQID QID, IOUnit MaxSize) {
 func UnmarshalRopenPkt(b *bytes.Buffer) (OQID QID, IOUnit MaxSize, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:1]); err != nil {
+	if b.Len() < 1 {
 		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
 		return
 	}
+	b.Read(u[:1])
 	OQID.Type = uint8(u[0])
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	OQID.Version = uint32(u[0])
 	OQID.Version |= uint32(u[1]) << 8
 	OQID.Version |= uint32(u[2]) << 16
 	OQID.Version |= uint32(u[3]) << 24
-	if _, err = b.Read(u[:8]); err != nil {
+	if b.Len() < 8 {
 		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
 		return
 	}
+	b.Read(u[:8])
 	OQID.Path = uint64(u[0])
 	OQID.Path |= uint64(u[1]) << 8
 	OQID.Path |= uint64(u[2]) << 16
@@ -743,10 +971,11 @@ func UnmarshalRopenPkt(b *bytes.Buffer) (OQID QID, IOUnit MaxSize, t Tag, err er
 	OQID.Path |= uint64(u[5]) << 40
 	OQID.Path |= uint64(u[6]) << 48
 	OQID.Path |= uint64(u[7]) << 56
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	IOUnit = MaxSize(u[0])
 	IOUnit |= MaxSize(u[1]) << 8
 	IOUnit |= MaxSize(u[2]) << 16
@@ -779,24 +1008,27 @@ func MarshalTopenPkt(b *bytes.Buffer, t Tag, OFID FID, Omode Mode) {
 func UnmarshalTopenPkt(b *bytes.Buffer) (OFID FID, Omode Mode, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	OFID = FID(u[0])
 	OFID |= FID(u[1]) << 8
 	OFID |= FID(u[2]) << 16
 	OFID |= FID(u[3]) << 24
-	if _, err = b.Read(u[:1]); err != nil {
+	if b.Len() < 1 {
 		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
 		return
 	}
+	b.Read(u[:1])
 	Omode = Mode(u[0])
 
 	if b.Len() > 0 {
@@ -804,12 +1036,14 @@ func UnmarshalTopenPkt(b *bytes.Buffer) (OFID FID, Omode Mode, t Tag, err error)
 	}
 	return
 }
-func (s *Server) SrvRopen(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRopen(ctx context.Context, b *bytes.Buffer) (err error) {
 	OFID, Omode, t, err := UnmarshalTopenPkt(b)
-	//if err != nil {
-	//}
-	if OQID, IOUnit, err := s.NS.Ropen(OFID, Omode); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Topen], err)
+		return err
+	}
+	if OQID, IOUnit, err := s.NS.Ropen(ctx, OFID, Omode); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRopenPkt(b, t, OQID, IOUnit)
 	}
@@ -834,7 +1068,7 @@ func (c *Client) CallTopen(OFID FID, Omode Mode) (OQID QID, IOUnit MaxSize, err
 		if err != nil {
 			return OQID, IOUnit, err
 		}
-		return OQID, IOUnit, fmt.Errorf("%v", s)
+		return OQID, IOUnit, clientError(s)
 	} else {
 		OQID, IOUnit, _, err = UnmarshalRopenPkt(bytes.NewBuffer(bb[5:]))
 	}
@@ -874,29 +1108,33 @@ func MarshalRcreatePkt(b *bytes.Buffer, t Tag, OQID QID, IOUnit MaxSize) {
 func UnmarshalRcreatePkt(b *bytes.Buffer) (OQID QID, IOUnit MaxSize, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:1]); err != nil {
+	if b.Len() < 1 {
 		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
 		return
 	}
+	b.Read(u[:1])
 	OQID.Type = uint8(u[0])
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	OQID.Version = uint32(u[0])
 	OQID.Version |= uint32(u[1]) << 8
 	OQID.Version |= uint32(u[2]) << 16
 	OQID.Version |= uint32(u[3]) << 24
-	if _, err = b.Read(u[:8]); err != nil {
+	if b.Len() < 8 {
 		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
 		return
 	}
+	b.Read(u[:8])
 	OQID.Path = uint64(u[0])
 	OQID.Path |= uint64(u[1]) << 8
 	OQID.Path |= uint64(u[2]) << 16
@@ -905,10 +1143,11 @@ func UnmarshalRcreatePkt(b *bytes.Buffer) (OQID QID, IOUnit MaxSize, t Tag, err
 	OQID.Path |= uint64(u[5]) << 40
 	OQID.Path |= uint64(u[6]) << 48
 	OQID.Path |= uint64(u[7]) << 56
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	IOUnit = MaxSize(u[0])
 	IOUnit |= MaxSize(u[1]) << 8
 	IOUnit |= MaxSize(u[2]) << 16
@@ -948,24 +1187,27 @@ func MarshalTcreatePkt(b *bytes.Buffer, t Tag, OFID FID, Name string, CreatePerm
 func UnmarshalTcreatePkt(b *bytes.Buffer) (OFID FID, Name string, CreatePerm Perm, Omode Mode, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	OFID = FID(u[0])
 	OFID |= FID(u[1]) << 8
 	OFID |= FID(u[2]) << 16
 	OFID |= FID(u[3]) << 24
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	if b.Len() < int(l) {
@@ -974,18 +1216,20 @@ func UnmarshalTcreatePkt(b *bytes.Buffer) (OFID FID, Name string, CreatePerm Per
 	}
 	Name = string(b.Bytes()[:l])
 	_ = b.Next(int(l))
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	CreatePerm = Perm(u[0])
 	CreatePerm |= Perm(u[1]) << 8
 	CreatePerm |= Perm(u[2]) << 16
 	CreatePerm |= Perm(u[3]) << 24
-	if _, err = b.Read(u[:1]); err != nil {
+	if b.Len() < 1 {
 		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
 		return
 	}
+	b.Read(u[:1])
 	Omode = Mode(u[0])
 
 	if b.Len() > 0 {
@@ -993,12 +1237,14 @@ func UnmarshalTcreatePkt(b *bytes.Buffer) (OFID FID, Name string, CreatePerm Per
 	}
 	return
 }
-func (s *Server) SrvRcreate(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRcreate(ctx context.Context, b *bytes.Buffer) (err error) {
 	OFID, Name, CreatePerm, Omode, t, err := UnmarshalTcreatePkt(b)
-	//if err != nil {
-	//}
-	if OQID, IOUnit, err := s.NS.Rcreate(OFID, Name, CreatePerm, Omode); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tcreate], err)
+		return err
+	}
+	if OQID, IOUnit, err := s.NS.Rcreate(ctx, OFID, Name, CreatePerm, Omode); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRcreatePkt(b, t, OQID, IOUnit)
 	}
@@ -1023,7 +1269,7 @@ func (c *Client) CallTcreate(OFID FID, Name string, CreatePerm Perm, Omode Mode)
 		if err != nil {
 			return OQID, IOUnit, err
 		}
-		return OQID, IOUnit, fmt.Errorf("%v", s)
+		return OQID, IOUnit, clientError(s)
 	} else {
 		OQID, IOUnit, _, err = UnmarshalRcreatePkt(bytes.NewBuffer(bb[5:]))
 	}
@@ -1049,18 +1295,24 @@ func MarshalRstatPkt(b *bytes.Buffer, t Tag, B []byte) {
 func UnmarshalRstatPkt(b *bytes.Buffer) (B []byte, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for []byte: need %d, have %d", l, b.Len())
+		return
+	}
 	B = b.Bytes()[:l]
 	_ = b.Next(int(l))
 
@@ -1090,16 +1342,18 @@ func MarshalTstatPkt(b *bytes.Buffer, t Tag, OFID FID) {
 func UnmarshalTstatPkt(b *bytes.Buffer) (OFID FID, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	OFID = FID(u[0])
 	OFID |= FID(u[1]) << 8
 	OFID |= FID(u[2]) << 16
@@ -1110,12 +1364,14 @@ func UnmarshalTstatPkt(b *bytes.Buffer) (OFID FID, t Tag, err error) {
 	}
 	return
 }
-func (s *Server) SrvRstat(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRstat(ctx context.Context, b *bytes.Buffer) (err error) {
 	OFID, t, err := UnmarshalTstatPkt(b)
-	//if err != nil {
-	//}
-	if B, err := s.NS.Rstat(OFID); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tstat], err)
+		return err
+	}
+	if B, err := s.NS.Rstat(ctx, OFID); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRstatPkt(b, t, B)
 	}
@@ -1140,7 +1396,7 @@ func (c *Client) CallTstat(OFID FID) (B []byte, err error) {
 		if err != nil {
 			return B, err
 		}
-		return B, fmt.Errorf("%v", s)
+		return B, clientError(s)
 	} else {
 		B, _, err = UnmarshalRstatPkt(bytes.NewBuffer(bb[5:]))
 	}
@@ -1163,10 +1419,11 @@ func MarshalRwstatPkt(b *bytes.Buffer, t Tag) {
 func UnmarshalRwstatPkt(b *bytes.Buffer) (t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
 
@@ -1199,26 +1456,33 @@ func MarshalTwstatPkt(b *bytes.Buffer, t Tag, OFID FID, B []byte) {
 func UnmarshalTwstatPkt(b *bytes.Buffer) (OFID FID, B []byte, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	OFID = FID(u[0])
 	OFID |= FID(u[1]) << 8
 	OFID |= FID(u[2]) << 16
 	OFID |= FID(u[3]) << 24
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for []byte: need %d, have %d", l, b.Len())
+		return
+	}
 	B = b.Bytes()[:l]
 	_ = b.Next(int(l))
 
@@ -1227,12 +1491,14 @@ func UnmarshalTwstatPkt(b *bytes.Buffer) (OFID FID, B []byte, t Tag, err error)
 	}
 	return
 }
-func (s *Server) SrvRwstat(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRwstat(ctx context.Context, b *bytes.Buffer) (err error) {
 	OFID, B, t, err := UnmarshalTwstatPkt(b)
-	//if err != nil {
-	//}
-	if err := s.NS.Rwstat(OFID, B); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Twstat], err)
+		return err
+	}
+	if err := s.NS.Rwstat(ctx, OFID, B); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRwstatPkt(b, t)
 	}
@@ -1257,7 +1523,7 @@ func (c *Client) CallTwstat(OFID FID, B []byte) (err error) {
 		if err != nil {
 			return err
 		}
-		return fmt.Errorf("%v", s)
+		return clientError(s)
 	} else {
 		_, err = UnmarshalRwstatPkt(bytes.NewBuffer(bb[5:]))
 	}
@@ -1280,10 +1546,11 @@ func MarshalRclunkPkt(b *bytes.Buffer, t Tag) {
 func UnmarshalRclunkPkt(b *bytes.Buffer) (t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
 
@@ -1313,16 +1580,18 @@ func MarshalTclunkPkt(b *bytes.Buffer, t Tag, OFID FID) {
 func UnmarshalTclunkPkt(b *bytes.Buffer) (OFID FID, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	OFID = FID(u[0])
 	OFID |= FID(u[1]) << 8
 	OFID |= FID(u[2]) << 16
@@ -1333,12 +1602,14 @@ func UnmarshalTclunkPkt(b *bytes.Buffer) (OFID FID, t Tag, err error) {
 	}
 	return
 }
-func (s *Server) SrvRclunk(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRclunk(ctx context.Context, b *bytes.Buffer) (err error) {
 	OFID, t, err := UnmarshalTclunkPkt(b)
-	//if err != nil {
-	//}
-	if err := s.NS.Rclunk(OFID); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tclunk], err)
+		return err
+	}
+	if err := s.NS.Rclunk(ctx, OFID); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRclunkPkt(b, t)
 	}
@@ -1363,7 +1634,7 @@ func (c *Client) CallTclunk(OFID FID) (err error) {
 		if err != nil {
 			return err
 		}
-		return fmt.Errorf("%v", s)
+		return clientError(s)
 	} else {
 		_, err = UnmarshalRclunkPkt(bytes.NewBuffer(bb[5:]))
 	}
@@ -1386,10 +1657,11 @@ func MarshalRremovePkt(b *bytes.Buffer, t Tag) {
 func UnmarshalRremovePkt(b *bytes.Buffer) (t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
 
@@ -1419,16 +1691,18 @@ func MarshalTremovePkt(b *bytes.Buffer, t Tag, OFID FID) {
 func UnmarshalTremovePkt(b *bytes.Buffer) (OFID FID, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	OFID = FID(u[0])
 	OFID |= FID(u[1]) << 8
 	OFID |= FID(u[2]) << 16
@@ -1439,12 +1713,14 @@ func UnmarshalTremovePkt(b *bytes.Buffer) (OFID FID, t Tag, err error) {
 	}
 	return
 }
-func (s *Server) SrvRremove(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRremove(ctx context.Context, b *bytes.Buffer) (err error) {
 	OFID, t, err := UnmarshalTremovePkt(b)
-	//if err != nil {
-	//}
-	if err := s.NS.Rremove(OFID); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tremove], err)
+		return err
+	}
+	if err := s.NS.Rremove(ctx, OFID); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRremovePkt(b, t)
 	}
@@ -1469,7 +1745,7 @@ func (c *Client) CallTremove(OFID FID) (err error) {
 		if err != nil {
 			return err
 		}
-		return fmt.Errorf("%v", s)
+		return clientError(s)
 	} else {
 		_, err = UnmarshalRremovePkt(bytes.NewBuffer(bb[5:]))
 	}
@@ -1497,20 +1773,26 @@ func MarshalRreadPkt(b *bytes.Buffer, t Tag, Data []uint8) {
 func UnmarshalRreadPkt(b *bytes.Buffer) (Data []uint8, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	l |= uint64(u[2]) << 16
 	l |= uint64(u[3]) << 24
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for []byte: need %d, have %d", l, b.Len())
+		return
+	}
 	Data = b.Bytes()[:l]
 	_ = b.Next(int(l))
 
@@ -1552,24 +1834,27 @@ func MarshalTreadPkt(b *bytes.Buffer, t Tag, OFID FID, Off Offset, Len Count) {
 func UnmarshalTreadPkt(b *bytes.Buffer) (OFID FID, Off Offset, Len Count, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	OFID = FID(u[0])
 	OFID |= FID(u[1]) << 8
 	OFID |= FID(u[2]) << 16
 	OFID |= FID(u[3]) << 24
-	if _, err = b.Read(u[:8]); err != nil {
+	if b.Len() < 8 {
 		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
 		return
 	}
+	b.Read(u[:8])
 	Off = Offset(u[0])
 	Off |= Offset(u[1]) << 8
 	Off |= Offset(u[2]) << 16
@@ -1578,10 +1863,11 @@ func UnmarshalTreadPkt(b *bytes.Buffer) (OFID FID, Off Offset, Len Count, t Tag,
 	Off |= Offset(u[5]) << 40
 	Off |= Offset(u[6]) << 48
 	Off |= Offset(u[7]) << 56
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	Len = Count(u[0])
 	Len |= Count(u[1]) << 8
 	Len |= Count(u[2]) << 16
@@ -1592,12 +1878,14 @@ func UnmarshalTreadPkt(b *bytes.Buffer) (OFID FID, Off Offset, Len Count, t Tag,
 	}
 	return
 }
-func (s *Server) SrvRread(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRread(ctx context.Context, b *bytes.Buffer) (err error) {
 	OFID, Off, Len, t, err := UnmarshalTreadPkt(b)
-	//if err != nil {
-	//}
-	if Data, err := s.NS.Rread(OFID, Off, Len); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tread], err)
+		return err
+	}
+	if Data, err := s.NS.Rread(ctx, OFID, Off, Len); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRreadPkt(b, t, Data)
 	}
@@ -1622,7 +1910,7 @@ func (c *Client) CallTread(OFID FID, Off Offset, Len Count) (Data []uint8, err e
 		if err != nil {
 			return Data, err
 		}
-		return Data, fmt.Errorf("%v", s)
+		return Data, clientError(s)
 	} else {
 		Data, _, err = UnmarshalRreadPkt(bytes.NewBuffer(bb[5:]))
 	}
@@ -1649,16 +1937,18 @@ func MarshalRwritePkt(b *bytes.Buffer, t Tag, RLen Count) {
 func UnmarshalRwritePkt(b *bytes.Buffer) (RLen Count, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	RLen = Count(u[0])
 	RLen |= Count(u[1]) << 8
 	RLen |= Count(u[2]) << 16
@@ -1703,24 +1993,27 @@ func MarshalTwritePkt(b *bytes.Buffer, t Tag, OFID FID, Off Offset, Data []uint8
 func UnmarshalTwritePkt(b *bytes.Buffer) (OFID FID, Off Offset, Data []uint8, t Tag, err error) {
 	var u [8]uint8
 	var l uint64
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0]) | uint64(u[1])<<8
 	t = Tag(l)
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	OFID = FID(u[0])
 	OFID |= FID(u[1]) << 8
 	OFID |= FID(u[2]) << 16
 	OFID |= FID(u[3]) << 24
-	if _, err = b.Read(u[:8]); err != nil {
+	if b.Len() < 8 {
 		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
 		return
 	}
+	b.Read(u[:8])
 	Off = Offset(u[0])
 	Off |= Offset(u[1]) << 8
 	Off |= Offset(u[2]) << 16
@@ -1729,14 +2022,19 @@ func UnmarshalTwritePkt(b *bytes.Buffer) (OFID FID, Off Offset, Data []uint8, t
 	Off |= Offset(u[5]) << 40
 	Off |= Offset(u[6]) << 48
 	Off |= Offset(u[7]) << 56
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	l |= uint64(u[2]) << 16
 	l |= uint64(u[3]) << 24
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for []byte: need %d, have %d", l, b.Len())
+		return
+	}
 	Data = b.Bytes()[:l]
 	_ = b.Next(int(l))
 
@@ -1745,12 +2043,14 @@ func UnmarshalTwritePkt(b *bytes.Buffer) (OFID FID, Off Offset, Data []uint8, t
 	}
 	return
 }
-func (s *Server) SrvRwrite(b *bytes.Buffer) (err error) {
+func (s *Server) SrvRwrite(ctx context.Context, b *bytes.Buffer) (err error) {
 	OFID, Off, Data, t, err := UnmarshalTwritePkt(b)
-	//if err != nil {
-	//}
-	if RLen, err := s.NS.Rwrite(OFID, Off, Data); err != nil {
-		MarshalRerrorPkt(b, t, fmt.Sprintf("%v", err))
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Twrite], err)
+		return err
+	}
+	if RLen, err := s.NS.Rwrite(ctx, OFID, Off, Data); err != nil {
+		s.marshalRerror(b, t, err)
 	} else {
 		MarshalRwritePkt(b, t, RLen)
 	}
@@ -1775,20 +2075,3468 @@ func (c *Client) CallTwrite(OFID FID, Off Offset, Data []uint8) (RLen Count, err
 		if err != nil {
 			return RLen, err
 		}
-		return RLen, fmt.Errorf("%v", s)
+		return RLen, clientError(s)
 	} else {
 		RLen, _, err = UnmarshalRwritePkt(bytes.NewBuffer(bb[5:]))
 	}
 	return RLen, err
 }
-func ServerError(b *bytes.Buffer, s string) {
-	var u [8]byte
-	// This can't really happen.
-	if _, err := b.Read(u[:2]); err != nil {
+func MarshalRlerrorPkt(b *bytes.Buffer, t Tag, Ecode uint32) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rlerror),
+		byte(t), byte(t >> 8),
+		uint8(Ecode >> 0),
+		uint8(Ecode >> 8),
+		uint8(Ecode >> 16),
+		uint8(Ecode >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRlerrorPkt(b *bytes.Buffer) (Ecode uint32, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	Ecode = uint32(u[0])
+	Ecode |= uint32(u[1]) << 8
+	Ecode |= uint32(u[2]) << 16
+	Ecode |= uint32(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalRstatfsPkt(b *bytes.Buffer, t Tag, S Statfs) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rstatfs),
+		byte(t), byte(t >> 8),
+		uint8(S.Type >> 0),
+		uint8(S.Type >> 8),
+		uint8(S.Type >> 16),
+		uint8(S.Type >> 24),
+		uint8(S.BSize >> 0),
+		uint8(S.BSize >> 8),
+		uint8(S.BSize >> 16),
+		uint8(S.BSize >> 24),
+		uint8(S.Blocks >> 0),
+		uint8(S.Blocks >> 8),
+		uint8(S.Blocks >> 16),
+		uint8(S.Blocks >> 24),
+		uint8(S.Blocks >> 32),
+		uint8(S.Blocks >> 40),
+		uint8(S.Blocks >> 48),
+		uint8(S.Blocks >> 56),
+		uint8(S.BFree >> 0),
+		uint8(S.BFree >> 8),
+		uint8(S.BFree >> 16),
+		uint8(S.BFree >> 24),
+		uint8(S.BFree >> 32),
+		uint8(S.BFree >> 40),
+		uint8(S.BFree >> 48),
+		uint8(S.BFree >> 56),
+		uint8(S.BAvail >> 0),
+		uint8(S.BAvail >> 8),
+		uint8(S.BAvail >> 16),
+		uint8(S.BAvail >> 24),
+		uint8(S.BAvail >> 32),
+		uint8(S.BAvail >> 40),
+		uint8(S.BAvail >> 48),
+		uint8(S.BAvail >> 56),
+		uint8(S.Files >> 0),
+		uint8(S.Files >> 8),
+		uint8(S.Files >> 16),
+		uint8(S.Files >> 24),
+		uint8(S.Files >> 32),
+		uint8(S.Files >> 40),
+		uint8(S.Files >> 48),
+		uint8(S.Files >> 56),
+		uint8(S.FFree >> 0),
+		uint8(S.FFree >> 8),
+		uint8(S.FFree >> 16),
+		uint8(S.FFree >> 24),
+		uint8(S.FFree >> 32),
+		uint8(S.FFree >> 40),
+		uint8(S.FFree >> 48),
+		uint8(S.FFree >> 56),
+		uint8(S.FSID >> 0),
+		uint8(S.FSID >> 8),
+		uint8(S.FSID >> 16),
+		uint8(S.FSID >> 24),
+		uint8(S.FSID >> 32),
+		uint8(S.FSID >> 40),
+		uint8(S.FSID >> 48),
+		uint8(S.FSID >> 56),
+		uint8(S.NameLen >> 0),
+		uint8(S.NameLen >> 8),
+		uint8(S.NameLen >> 16),
+		uint8(S.NameLen >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRstatfsPkt(b *bytes.Buffer) (S Statfs, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	S.Type = uint32(u[0])
+	S.Type |= uint32(u[1]) << 8
+	S.Type |= uint32(u[2]) << 16
+	S.Type |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	S.BSize = uint32(u[0])
+	S.BSize |= uint32(u[1]) << 8
+	S.BSize |= uint32(u[2]) << 16
+	S.BSize |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	S.Blocks = uint64(u[0])
+	S.Blocks |= uint64(u[1]) << 8
+	S.Blocks |= uint64(u[2]) << 16
+	S.Blocks |= uint64(u[3]) << 24
+	S.Blocks |= uint64(u[4]) << 32
+	S.Blocks |= uint64(u[5]) << 40
+	S.Blocks |= uint64(u[6]) << 48
+	S.Blocks |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	S.BFree = uint64(u[0])
+	S.BFree |= uint64(u[1]) << 8
+	S.BFree |= uint64(u[2]) << 16
+	S.BFree |= uint64(u[3]) << 24
+	S.BFree |= uint64(u[4]) << 32
+	S.BFree |= uint64(u[5]) << 40
+	S.BFree |= uint64(u[6]) << 48
+	S.BFree |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	S.BAvail = uint64(u[0])
+	S.BAvail |= uint64(u[1]) << 8
+	S.BAvail |= uint64(u[2]) << 16
+	S.BAvail |= uint64(u[3]) << 24
+	S.BAvail |= uint64(u[4]) << 32
+	S.BAvail |= uint64(u[5]) << 40
+	S.BAvail |= uint64(u[6]) << 48
+	S.BAvail |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	S.Files = uint64(u[0])
+	S.Files |= uint64(u[1]) << 8
+	S.Files |= uint64(u[2]) << 16
+	S.Files |= uint64(u[3]) << 24
+	S.Files |= uint64(u[4]) << 32
+	S.Files |= uint64(u[5]) << 40
+	S.Files |= uint64(u[6]) << 48
+	S.Files |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	S.FFree = uint64(u[0])
+	S.FFree |= uint64(u[1]) << 8
+	S.FFree |= uint64(u[2]) << 16
+	S.FFree |= uint64(u[3]) << 24
+	S.FFree |= uint64(u[4]) << 32
+	S.FFree |= uint64(u[5]) << 40
+	S.FFree |= uint64(u[6]) << 48
+	S.FFree |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	S.FSID = uint64(u[0])
+	S.FSID |= uint64(u[1]) << 8
+	S.FSID |= uint64(u[2]) << 16
+	S.FSID |= uint64(u[3]) << 24
+	S.FSID |= uint64(u[4]) << 32
+	S.FSID |= uint64(u[5]) << 40
+	S.FSID |= uint64(u[6]) << 48
+	S.FSID |= uint64(u[7]) << 56
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	S.NameLen = uint32(u[0])
+	S.NameLen |= uint32(u[1]) << 8
+	S.NameLen |= uint32(u[2]) << 16
+	S.NameLen |= uint32(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTstatfsPkt(b *bytes.Buffer, t Tag, SFID FID) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tstatfs),
+		byte(t), byte(t >> 8),
+		uint8(SFID >> 0),
+		uint8(SFID >> 8),
+		uint8(SFID >> 16),
+		uint8(SFID >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTstatfsPkt(b *bytes.Buffer) (SFID FID, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
-	t := Tag(uint16(u[0]) | uint16(u[1])<<8)
-	MarshalRerrorPkt(b, t, s)
+	b.Read(u[:4])
+	SFID = FID(u[0])
+	SFID |= FID(u[1]) << 8
+	SFID |= FID(u[2]) << 16
+	SFID |= FID(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRstatfs(ctx context.Context, b *bytes.Buffer) (err error) {
+	SFID, t, err := UnmarshalTstatfsPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tstatfs], err)
+		return err
+	}
+	if S, err := s.NS.(NineServerL).Rstatfs(ctx, SFID); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRstatfsPkt(b, t, S)
+	}
+	return nil
+}
+func MarshalRlopenPkt(b *bytes.Buffer, t Tag, OQID QID, OIOUnit MaxSize) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rlopen),
+		byte(t), byte(t >> 8),
+		uint8(OQID.Type >> 0),
+		uint8(OQID.Version >> 0),
+		uint8(OQID.Version >> 8),
+		uint8(OQID.Version >> 16),
+		uint8(OQID.Version >> 24),
+		uint8(OQID.Path >> 0),
+		uint8(OQID.Path >> 8),
+		uint8(OQID.Path >> 16),
+		uint8(OQID.Path >> 24),
+		uint8(OQID.Path >> 32),
+		uint8(OQID.Path >> 40),
+		uint8(OQID.Path >> 48),
+		uint8(OQID.Path >> 56),
+		uint8(OIOUnit >> 0),
+		uint8(OIOUnit >> 8),
+		uint8(OIOUnit >> 16),
+		uint8(OIOUnit >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRlopenPkt(b *bytes.Buffer) (OQID QID, OIOUnit MaxSize, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	OQID.Type = uint8(u[0])
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	OQID.Version = uint32(u[0])
+	OQID.Version |= uint32(u[1]) << 8
+	OQID.Version |= uint32(u[2]) << 16
+	OQID.Version |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	OQID.Path = uint64(u[0])
+	OQID.Path |= uint64(u[1]) << 8
+	OQID.Path |= uint64(u[2]) << 16
+	OQID.Path |= uint64(u[3]) << 24
+	OQID.Path |= uint64(u[4]) << 32
+	OQID.Path |= uint64(u[5]) << 40
+	OQID.Path |= uint64(u[6]) << 48
+	OQID.Path |= uint64(u[7]) << 56
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	OIOUnit = MaxSize(u[0])
+	OIOUnit |= MaxSize(u[1]) << 8
+	OIOUnit |= MaxSize(u[2]) << 16
+	OIOUnit |= MaxSize(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTlopenPkt(b *bytes.Buffer, t Tag, OFID FID, OFlags uint32) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tlopen),
+		byte(t), byte(t >> 8),
+		uint8(OFID >> 0),
+		uint8(OFID >> 8),
+		uint8(OFID >> 16),
+		uint8(OFID >> 24),
+		uint8(OFlags >> 0),
+		uint8(OFlags >> 8),
+		uint8(OFlags >> 16),
+		uint8(OFlags >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTlopenPkt(b *bytes.Buffer) (OFID FID, OFlags uint32, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	OFID = FID(u[0])
+	OFID |= FID(u[1]) << 8
+	OFID |= FID(u[2]) << 16
+	OFID |= FID(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	OFlags = uint32(u[0])
+	OFlags |= uint32(u[1]) << 8
+	OFlags |= uint32(u[2]) << 16
+	OFlags |= uint32(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRlopen(ctx context.Context, b *bytes.Buffer) (err error) {
+	OFID, OFlags, t, err := UnmarshalTlopenPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tlopen], err)
+		return err
+	}
+	if OQID, OIOUnit, err := s.NS.(NineServerL).Rlopen(ctx, OFID, OFlags); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRlopenPkt(b, t, OQID, OIOUnit)
+	}
+	return nil
+}
+func MarshalRlcreatePkt(b *bytes.Buffer, t Tag, CQID QID, CIOUnit MaxSize) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rlcreate),
+		byte(t), byte(t >> 8),
+		uint8(CQID.Type >> 0),
+		uint8(CQID.Version >> 0),
+		uint8(CQID.Version >> 8),
+		uint8(CQID.Version >> 16),
+		uint8(CQID.Version >> 24),
+		uint8(CQID.Path >> 0),
+		uint8(CQID.Path >> 8),
+		uint8(CQID.Path >> 16),
+		uint8(CQID.Path >> 24),
+		uint8(CQID.Path >> 32),
+		uint8(CQID.Path >> 40),
+		uint8(CQID.Path >> 48),
+		uint8(CQID.Path >> 56),
+		uint8(CIOUnit >> 0),
+		uint8(CIOUnit >> 8),
+		uint8(CIOUnit >> 16),
+		uint8(CIOUnit >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRlcreatePkt(b *bytes.Buffer) (CQID QID, CIOUnit MaxSize, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	CQID.Type = uint8(u[0])
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	CQID.Version = uint32(u[0])
+	CQID.Version |= uint32(u[1]) << 8
+	CQID.Version |= uint32(u[2]) << 16
+	CQID.Version |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	CQID.Path = uint64(u[0])
+	CQID.Path |= uint64(u[1]) << 8
+	CQID.Path |= uint64(u[2]) << 16
+	CQID.Path |= uint64(u[3]) << 24
+	CQID.Path |= uint64(u[4]) << 32
+	CQID.Path |= uint64(u[5]) << 40
+	CQID.Path |= uint64(u[6]) << 48
+	CQID.Path |= uint64(u[7]) << 56
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	CIOUnit = MaxSize(u[0])
+	CIOUnit |= MaxSize(u[1]) << 8
+	CIOUnit |= MaxSize(u[2]) << 16
+	CIOUnit |= MaxSize(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTlcreatePkt(b *bytes.Buffer, t Tag, CFID FID, CName string, CFlags uint32, CMode uint32, CGID uint32) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tlcreate),
+		byte(t), byte(t >> 8),
+		uint8(CFID >> 0),
+		uint8(CFID >> 8),
+		uint8(CFID >> 16),
+		uint8(CFID >> 24),
+		uint8(len(CName)), uint8(len(CName) >> 8),
+	})
+	b.Write([]byte(CName))
+	b.Write([]byte{uint8(CFlags >> 0),
+		uint8(CFlags >> 8),
+		uint8(CFlags >> 16),
+		uint8(CFlags >> 24),
+		uint8(CMode >> 0),
+		uint8(CMode >> 8),
+		uint8(CMode >> 16),
+		uint8(CMode >> 24),
+		uint8(CGID >> 0),
+		uint8(CGID >> 8),
+		uint8(CGID >> 16),
+		uint8(CGID >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTlcreatePkt(b *bytes.Buffer) (CFID FID, CName string, CFlags uint32, CMode uint32, CGID uint32, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	CFID = FID(u[0])
+	CFID |= FID(u[1]) << 8
+	CFID |= FID(u[2]) << 16
+	CFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	CName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	CFlags = uint32(u[0])
+	CFlags |= uint32(u[1]) << 8
+	CFlags |= uint32(u[2]) << 16
+	CFlags |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	CMode = uint32(u[0])
+	CMode |= uint32(u[1]) << 8
+	CMode |= uint32(u[2]) << 16
+	CMode |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	CGID = uint32(u[0])
+	CGID |= uint32(u[1]) << 8
+	CGID |= uint32(u[2]) << 16
+	CGID |= uint32(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRlcreate(ctx context.Context, b *bytes.Buffer) (err error) {
+	CFID, CName, CFlags, CMode, CGID, t, err := UnmarshalTlcreatePkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tlcreate], err)
+		return err
+	}
+	if CQID, CIOUnit, err := s.NS.(NineServerL).Rlcreate(ctx, CFID, CName, CFlags, CMode, CGID); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRlcreatePkt(b, t, CQID, CIOUnit)
+	}
+	return nil
+}
+func MarshalRsymlinkPkt(b *bytes.Buffer, t Tag, SQID QID) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rsymlink),
+		byte(t), byte(t >> 8),
+		uint8(SQID.Type >> 0),
+		uint8(SQID.Version >> 0),
+		uint8(SQID.Version >> 8),
+		uint8(SQID.Version >> 16),
+		uint8(SQID.Version >> 24),
+		uint8(SQID.Path >> 0),
+		uint8(SQID.Path >> 8),
+		uint8(SQID.Path >> 16),
+		uint8(SQID.Path >> 24),
+		uint8(SQID.Path >> 32),
+		uint8(SQID.Path >> 40),
+		uint8(SQID.Path >> 48),
+		uint8(SQID.Path >> 56),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRsymlinkPkt(b *bytes.Buffer) (SQID QID, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	SQID.Type = uint8(u[0])
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	SQID.Version = uint32(u[0])
+	SQID.Version |= uint32(u[1]) << 8
+	SQID.Version |= uint32(u[2]) << 16
+	SQID.Version |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	SQID.Path = uint64(u[0])
+	SQID.Path |= uint64(u[1]) << 8
+	SQID.Path |= uint64(u[2]) << 16
+	SQID.Path |= uint64(u[3]) << 24
+	SQID.Path |= uint64(u[4]) << 32
+	SQID.Path |= uint64(u[5]) << 40
+	SQID.Path |= uint64(u[6]) << 48
+	SQID.Path |= uint64(u[7]) << 56
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTsymlinkPkt(b *bytes.Buffer, t Tag, SDFID FID, SName string, Target string, SGID uint32) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tsymlink),
+		byte(t), byte(t >> 8),
+		uint8(SDFID >> 0),
+		uint8(SDFID >> 8),
+		uint8(SDFID >> 16),
+		uint8(SDFID >> 24),
+		uint8(len(SName)), uint8(len(SName) >> 8),
+	})
+	b.Write([]byte(SName))
+	b.Write([]byte{uint8(len(Target)), uint8(len(Target) >> 8)})
+	b.Write([]byte(Target))
+	b.Write([]byte{uint8(SGID >> 0),
+		uint8(SGID >> 8),
+		uint8(SGID >> 16),
+		uint8(SGID >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTsymlinkPkt(b *bytes.Buffer) (SDFID FID, SName string, Target string, SGID uint32, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	SDFID = FID(u[0])
+	SDFID |= FID(u[1]) << 8
+	SDFID |= FID(u[2]) << 16
+	SDFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	SName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	Target = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	SGID = uint32(u[0])
+	SGID |= uint32(u[1]) << 8
+	SGID |= uint32(u[2]) << 16
+	SGID |= uint32(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRsymlink(ctx context.Context, b *bytes.Buffer) (err error) {
+	SDFID, SName, Target, SGID, t, err := UnmarshalTsymlinkPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tsymlink], err)
+		return err
+	}
+	if SQID, err := s.NS.(NineServerL).Rsymlink(ctx, SDFID, SName, Target, SGID); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRsymlinkPkt(b, t, SQID)
+	}
+	return nil
+}
+func MarshalRmknodPkt(b *bytes.Buffer, t Tag, NQID QID) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rmknod),
+		byte(t), byte(t >> 8),
+		uint8(NQID.Type >> 0),
+		uint8(NQID.Version >> 0),
+		uint8(NQID.Version >> 8),
+		uint8(NQID.Version >> 16),
+		uint8(NQID.Version >> 24),
+		uint8(NQID.Path >> 0),
+		uint8(NQID.Path >> 8),
+		uint8(NQID.Path >> 16),
+		uint8(NQID.Path >> 24),
+		uint8(NQID.Path >> 32),
+		uint8(NQID.Path >> 40),
+		uint8(NQID.Path >> 48),
+		uint8(NQID.Path >> 56),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRmknodPkt(b *bytes.Buffer) (NQID QID, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	NQID.Type = uint8(u[0])
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	NQID.Version = uint32(u[0])
+	NQID.Version |= uint32(u[1]) << 8
+	NQID.Version |= uint32(u[2]) << 16
+	NQID.Version |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	NQID.Path = uint64(u[0])
+	NQID.Path |= uint64(u[1]) << 8
+	NQID.Path |= uint64(u[2]) << 16
+	NQID.Path |= uint64(u[3]) << 24
+	NQID.Path |= uint64(u[4]) << 32
+	NQID.Path |= uint64(u[5]) << 40
+	NQID.Path |= uint64(u[6]) << 48
+	NQID.Path |= uint64(u[7]) << 56
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTmknodPkt(b *bytes.Buffer, t Tag, NDFID FID, NName string, NMode uint32, Major uint32, Minor uint32, NGID uint32) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tmknod),
+		byte(t), byte(t >> 8),
+		uint8(NDFID >> 0),
+		uint8(NDFID >> 8),
+		uint8(NDFID >> 16),
+		uint8(NDFID >> 24),
+		uint8(len(NName)), uint8(len(NName) >> 8),
+	})
+	b.Write([]byte(NName))
+	b.Write([]byte{uint8(NMode >> 0),
+		uint8(NMode >> 8),
+		uint8(NMode >> 16),
+		uint8(NMode >> 24),
+		uint8(Major >> 0),
+		uint8(Major >> 8),
+		uint8(Major >> 16),
+		uint8(Major >> 24),
+		uint8(Minor >> 0),
+		uint8(Minor >> 8),
+		uint8(Minor >> 16),
+		uint8(Minor >> 24),
+		uint8(NGID >> 0),
+		uint8(NGID >> 8),
+		uint8(NGID >> 16),
+		uint8(NGID >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTmknodPkt(b *bytes.Buffer) (NDFID FID, NName string, NMode uint32, Major uint32, Minor uint32, NGID uint32, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	NDFID = FID(u[0])
+	NDFID |= FID(u[1]) << 8
+	NDFID |= FID(u[2]) << 16
+	NDFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	NName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	NMode = uint32(u[0])
+	NMode |= uint32(u[1]) << 8
+	NMode |= uint32(u[2]) << 16
+	NMode |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	Major = uint32(u[0])
+	Major |= uint32(u[1]) << 8
+	Major |= uint32(u[2]) << 16
+	Major |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	Minor = uint32(u[0])
+	Minor |= uint32(u[1]) << 8
+	Minor |= uint32(u[2]) << 16
+	Minor |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	NGID = uint32(u[0])
+	NGID |= uint32(u[1]) << 8
+	NGID |= uint32(u[2]) << 16
+	NGID |= uint32(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRmknod(ctx context.Context, b *bytes.Buffer) (err error) {
+	NDFID, NName, NMode, Major, Minor, NGID, t, err := UnmarshalTmknodPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tmknod], err)
+		return err
+	}
+	if NQID, err := s.NS.(NineServerL).Rmknod(ctx, NDFID, NName, NMode, Major, Minor, NGID); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRmknodPkt(b, t, NQID)
+	}
+	return nil
+}
+func MarshalRrenamePkt(b *bytes.Buffer, t Tag) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rrename),
+		byte(t), byte(t >> 8),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRrenamePkt(b *bytes.Buffer) (t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTrenamePkt(b *bytes.Buffer, t Tag, RFID FID, RDFID FID, RName string) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Trename),
+		byte(t), byte(t >> 8),
+		uint8(RFID >> 0),
+		uint8(RFID >> 8),
+		uint8(RFID >> 16),
+		uint8(RFID >> 24),
+		uint8(RDFID >> 0),
+		uint8(RDFID >> 8),
+		uint8(RDFID >> 16),
+		uint8(RDFID >> 24),
+		uint8(len(RName)), uint8(len(RName) >> 8),
+	})
+	b.Write([]byte(RName))
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTrenamePkt(b *bytes.Buffer) (RFID FID, RDFID FID, RName string, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	RFID = FID(u[0])
+	RFID |= FID(u[1]) << 8
+	RFID |= FID(u[2]) << 16
+	RFID |= FID(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	RDFID = FID(u[0])
+	RDFID |= FID(u[1]) << 8
+	RDFID |= FID(u[2]) << 16
+	RDFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	RName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRrename(ctx context.Context, b *bytes.Buffer) (err error) {
+	RFID, RDFID, RName, t, err := UnmarshalTrenamePkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Trename], err)
+		return err
+	}
+	if err := s.NS.(NineServerL).Rrename(ctx, RFID, RDFID, RName); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRrenamePkt(b, t)
+	}
+	return nil
+}
+func MarshalRreadlinkPkt(b *bytes.Buffer, t Tag, LTarget string) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rreadlink),
+		byte(t), byte(t >> 8),
+		uint8(len(LTarget)), uint8(len(LTarget) >> 8),
+	})
+	b.Write([]byte(LTarget))
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRreadlinkPkt(b *bytes.Buffer) (LTarget string, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	LTarget = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTreadlinkPkt(b *bytes.Buffer, t Tag, LFID FID) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Treadlink),
+		byte(t), byte(t >> 8),
+		uint8(LFID >> 0),
+		uint8(LFID >> 8),
+		uint8(LFID >> 16),
+		uint8(LFID >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTreadlinkPkt(b *bytes.Buffer) (LFID FID, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	LFID = FID(u[0])
+	LFID |= FID(u[1]) << 8
+	LFID |= FID(u[2]) << 16
+	LFID |= FID(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRreadlink(ctx context.Context, b *bytes.Buffer) (err error) {
+	LFID, t, err := UnmarshalTreadlinkPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Treadlink], err)
+		return err
+	}
+	if LTarget, err := s.NS.(NineServerL).Rreadlink(ctx, LFID); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRreadlinkPkt(b, t, LTarget)
+	}
+	return nil
+}
+func MarshalRgetattrPkt(b *bytes.Buffer, t Tag, A Attr) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rgetattr),
+		byte(t), byte(t >> 8),
+		uint8(A.Valid >> 0),
+		uint8(A.Valid >> 8),
+		uint8(A.Valid >> 16),
+		uint8(A.Valid >> 24),
+		uint8(A.Valid >> 32),
+		uint8(A.Valid >> 40),
+		uint8(A.Valid >> 48),
+		uint8(A.Valid >> 56),
+		uint8(A.QID.Type >> 0),
+		uint8(A.QID.Version >> 0),
+		uint8(A.QID.Version >> 8),
+		uint8(A.QID.Version >> 16),
+		uint8(A.QID.Version >> 24),
+		uint8(A.QID.Path >> 0),
+		uint8(A.QID.Path >> 8),
+		uint8(A.QID.Path >> 16),
+		uint8(A.QID.Path >> 24),
+		uint8(A.QID.Path >> 32),
+		uint8(A.QID.Path >> 40),
+		uint8(A.QID.Path >> 48),
+		uint8(A.QID.Path >> 56),
+		uint8(A.Mode >> 0),
+		uint8(A.Mode >> 8),
+		uint8(A.Mode >> 16),
+		uint8(A.Mode >> 24),
+		uint8(A.UID >> 0),
+		uint8(A.UID >> 8),
+		uint8(A.UID >> 16),
+		uint8(A.UID >> 24),
+		uint8(A.GID >> 0),
+		uint8(A.GID >> 8),
+		uint8(A.GID >> 16),
+		uint8(A.GID >> 24),
+		uint8(A.NLink >> 0),
+		uint8(A.NLink >> 8),
+		uint8(A.NLink >> 16),
+		uint8(A.NLink >> 24),
+		uint8(A.NLink >> 32),
+		uint8(A.NLink >> 40),
+		uint8(A.NLink >> 48),
+		uint8(A.NLink >> 56),
+		uint8(A.RDev >> 0),
+		uint8(A.RDev >> 8),
+		uint8(A.RDev >> 16),
+		uint8(A.RDev >> 24),
+		uint8(A.RDev >> 32),
+		uint8(A.RDev >> 40),
+		uint8(A.RDev >> 48),
+		uint8(A.RDev >> 56),
+		uint8(A.Size >> 0),
+		uint8(A.Size >> 8),
+		uint8(A.Size >> 16),
+		uint8(A.Size >> 24),
+		uint8(A.Size >> 32),
+		uint8(A.Size >> 40),
+		uint8(A.Size >> 48),
+		uint8(A.Size >> 56),
+		uint8(A.BlkSize >> 0),
+		uint8(A.BlkSize >> 8),
+		uint8(A.BlkSize >> 16),
+		uint8(A.BlkSize >> 24),
+		uint8(A.BlkSize >> 32),
+		uint8(A.BlkSize >> 40),
+		uint8(A.BlkSize >> 48),
+		uint8(A.BlkSize >> 56),
+		uint8(A.Blocks >> 0),
+		uint8(A.Blocks >> 8),
+		uint8(A.Blocks >> 16),
+		uint8(A.Blocks >> 24),
+		uint8(A.Blocks >> 32),
+		uint8(A.Blocks >> 40),
+		uint8(A.Blocks >> 48),
+		uint8(A.Blocks >> 56),
+		uint8(A.ATimeSec >> 0),
+		uint8(A.ATimeSec >> 8),
+		uint8(A.ATimeSec >> 16),
+		uint8(A.ATimeSec >> 24),
+		uint8(A.ATimeSec >> 32),
+		uint8(A.ATimeSec >> 40),
+		uint8(A.ATimeSec >> 48),
+		uint8(A.ATimeSec >> 56),
+		uint8(A.ATimeNSec >> 0),
+		uint8(A.ATimeNSec >> 8),
+		uint8(A.ATimeNSec >> 16),
+		uint8(A.ATimeNSec >> 24),
+		uint8(A.ATimeNSec >> 32),
+		uint8(A.ATimeNSec >> 40),
+		uint8(A.ATimeNSec >> 48),
+		uint8(A.ATimeNSec >> 56),
+		uint8(A.MTimeSec >> 0),
+		uint8(A.MTimeSec >> 8),
+		uint8(A.MTimeSec >> 16),
+		uint8(A.MTimeSec >> 24),
+		uint8(A.MTimeSec >> 32),
+		uint8(A.MTimeSec >> 40),
+		uint8(A.MTimeSec >> 48),
+		uint8(A.MTimeSec >> 56),
+		uint8(A.MTimeNSec >> 0),
+		uint8(A.MTimeNSec >> 8),
+		uint8(A.MTimeNSec >> 16),
+		uint8(A.MTimeNSec >> 24),
+		uint8(A.MTimeNSec >> 32),
+		uint8(A.MTimeNSec >> 40),
+		uint8(A.MTimeNSec >> 48),
+		uint8(A.MTimeNSec >> 56),
+		uint8(A.CTimeSec >> 0),
+		uint8(A.CTimeSec >> 8),
+		uint8(A.CTimeSec >> 16),
+		uint8(A.CTimeSec >> 24),
+		uint8(A.CTimeSec >> 32),
+		uint8(A.CTimeSec >> 40),
+		uint8(A.CTimeSec >> 48),
+		uint8(A.CTimeSec >> 56),
+		uint8(A.CTimeNSec >> 0),
+		uint8(A.CTimeNSec >> 8),
+		uint8(A.CTimeNSec >> 16),
+		uint8(A.CTimeNSec >> 24),
+		uint8(A.CTimeNSec >> 32),
+		uint8(A.CTimeNSec >> 40),
+		uint8(A.CTimeNSec >> 48),
+		uint8(A.CTimeNSec >> 56),
+		uint8(A.BTimeSec >> 0),
+		uint8(A.BTimeSec >> 8),
+		uint8(A.BTimeSec >> 16),
+		uint8(A.BTimeSec >> 24),
+		uint8(A.BTimeSec >> 32),
+		uint8(A.BTimeSec >> 40),
+		uint8(A.BTimeSec >> 48),
+		uint8(A.BTimeSec >> 56),
+		uint8(A.BTimeNSec >> 0),
+		uint8(A.BTimeNSec >> 8),
+		uint8(A.BTimeNSec >> 16),
+		uint8(A.BTimeNSec >> 24),
+		uint8(A.BTimeNSec >> 32),
+		uint8(A.BTimeNSec >> 40),
+		uint8(A.BTimeNSec >> 48),
+		uint8(A.BTimeNSec >> 56),
+		uint8(A.Gen >> 0),
+		uint8(A.Gen >> 8),
+		uint8(A.Gen >> 16),
+		uint8(A.Gen >> 24),
+		uint8(A.Gen >> 32),
+		uint8(A.Gen >> 40),
+		uint8(A.Gen >> 48),
+		uint8(A.Gen >> 56),
+		uint8(A.DataVersion >> 0),
+		uint8(A.DataVersion >> 8),
+		uint8(A.DataVersion >> 16),
+		uint8(A.DataVersion >> 24),
+		uint8(A.DataVersion >> 32),
+		uint8(A.DataVersion >> 40),
+		uint8(A.DataVersion >> 48),
+		uint8(A.DataVersion >> 56),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRgetattrPkt(b *bytes.Buffer) (A Attr, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.Valid = uint64(u[0])
+	A.Valid |= uint64(u[1]) << 8
+	A.Valid |= uint64(u[2]) << 16
+	A.Valid |= uint64(u[3]) << 24
+	A.Valid |= uint64(u[4]) << 32
+	A.Valid |= uint64(u[5]) << 40
+	A.Valid |= uint64(u[6]) << 48
+	A.Valid |= uint64(u[7]) << 56
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	A.QID.Type = uint8(u[0])
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	A.QID.Version = uint32(u[0])
+	A.QID.Version |= uint32(u[1]) << 8
+	A.QID.Version |= uint32(u[2]) << 16
+	A.QID.Version |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.QID.Path = uint64(u[0])
+	A.QID.Path |= uint64(u[1]) << 8
+	A.QID.Path |= uint64(u[2]) << 16
+	A.QID.Path |= uint64(u[3]) << 24
+	A.QID.Path |= uint64(u[4]) << 32
+	A.QID.Path |= uint64(u[5]) << 40
+	A.QID.Path |= uint64(u[6]) << 48
+	A.QID.Path |= uint64(u[7]) << 56
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	A.Mode = uint32(u[0])
+	A.Mode |= uint32(u[1]) << 8
+	A.Mode |= uint32(u[2]) << 16
+	A.Mode |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	A.UID = uint32(u[0])
+	A.UID |= uint32(u[1]) << 8
+	A.UID |= uint32(u[2]) << 16
+	A.UID |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	A.GID = uint32(u[0])
+	A.GID |= uint32(u[1]) << 8
+	A.GID |= uint32(u[2]) << 16
+	A.GID |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.NLink = uint64(u[0])
+	A.NLink |= uint64(u[1]) << 8
+	A.NLink |= uint64(u[2]) << 16
+	A.NLink |= uint64(u[3]) << 24
+	A.NLink |= uint64(u[4]) << 32
+	A.NLink |= uint64(u[5]) << 40
+	A.NLink |= uint64(u[6]) << 48
+	A.NLink |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.RDev = uint64(u[0])
+	A.RDev |= uint64(u[1]) << 8
+	A.RDev |= uint64(u[2]) << 16
+	A.RDev |= uint64(u[3]) << 24
+	A.RDev |= uint64(u[4]) << 32
+	A.RDev |= uint64(u[5]) << 40
+	A.RDev |= uint64(u[6]) << 48
+	A.RDev |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.Size = uint64(u[0])
+	A.Size |= uint64(u[1]) << 8
+	A.Size |= uint64(u[2]) << 16
+	A.Size |= uint64(u[3]) << 24
+	A.Size |= uint64(u[4]) << 32
+	A.Size |= uint64(u[5]) << 40
+	A.Size |= uint64(u[6]) << 48
+	A.Size |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.BlkSize = uint64(u[0])
+	A.BlkSize |= uint64(u[1]) << 8
+	A.BlkSize |= uint64(u[2]) << 16
+	A.BlkSize |= uint64(u[3]) << 24
+	A.BlkSize |= uint64(u[4]) << 32
+	A.BlkSize |= uint64(u[5]) << 40
+	A.BlkSize |= uint64(u[6]) << 48
+	A.BlkSize |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.Blocks = uint64(u[0])
+	A.Blocks |= uint64(u[1]) << 8
+	A.Blocks |= uint64(u[2]) << 16
+	A.Blocks |= uint64(u[3]) << 24
+	A.Blocks |= uint64(u[4]) << 32
+	A.Blocks |= uint64(u[5]) << 40
+	A.Blocks |= uint64(u[6]) << 48
+	A.Blocks |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.ATimeSec = uint64(u[0])
+	A.ATimeSec |= uint64(u[1]) << 8
+	A.ATimeSec |= uint64(u[2]) << 16
+	A.ATimeSec |= uint64(u[3]) << 24
+	A.ATimeSec |= uint64(u[4]) << 32
+	A.ATimeSec |= uint64(u[5]) << 40
+	A.ATimeSec |= uint64(u[6]) << 48
+	A.ATimeSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.ATimeNSec = uint64(u[0])
+	A.ATimeNSec |= uint64(u[1]) << 8
+	A.ATimeNSec |= uint64(u[2]) << 16
+	A.ATimeNSec |= uint64(u[3]) << 24
+	A.ATimeNSec |= uint64(u[4]) << 32
+	A.ATimeNSec |= uint64(u[5]) << 40
+	A.ATimeNSec |= uint64(u[6]) << 48
+	A.ATimeNSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.MTimeSec = uint64(u[0])
+	A.MTimeSec |= uint64(u[1]) << 8
+	A.MTimeSec |= uint64(u[2]) << 16
+	A.MTimeSec |= uint64(u[3]) << 24
+	A.MTimeSec |= uint64(u[4]) << 32
+	A.MTimeSec |= uint64(u[5]) << 40
+	A.MTimeSec |= uint64(u[6]) << 48
+	A.MTimeSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.MTimeNSec = uint64(u[0])
+	A.MTimeNSec |= uint64(u[1]) << 8
+	A.MTimeNSec |= uint64(u[2]) << 16
+	A.MTimeNSec |= uint64(u[3]) << 24
+	A.MTimeNSec |= uint64(u[4]) << 32
+	A.MTimeNSec |= uint64(u[5]) << 40
+	A.MTimeNSec |= uint64(u[6]) << 48
+	A.MTimeNSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.CTimeSec = uint64(u[0])
+	A.CTimeSec |= uint64(u[1]) << 8
+	A.CTimeSec |= uint64(u[2]) << 16
+	A.CTimeSec |= uint64(u[3]) << 24
+	A.CTimeSec |= uint64(u[4]) << 32
+	A.CTimeSec |= uint64(u[5]) << 40
+	A.CTimeSec |= uint64(u[6]) << 48
+	A.CTimeSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.CTimeNSec = uint64(u[0])
+	A.CTimeNSec |= uint64(u[1]) << 8
+	A.CTimeNSec |= uint64(u[2]) << 16
+	A.CTimeNSec |= uint64(u[3]) << 24
+	A.CTimeNSec |= uint64(u[4]) << 32
+	A.CTimeNSec |= uint64(u[5]) << 40
+	A.CTimeNSec |= uint64(u[6]) << 48
+	A.CTimeNSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.BTimeSec = uint64(u[0])
+	A.BTimeSec |= uint64(u[1]) << 8
+	A.BTimeSec |= uint64(u[2]) << 16
+	A.BTimeSec |= uint64(u[3]) << 24
+	A.BTimeSec |= uint64(u[4]) << 32
+	A.BTimeSec |= uint64(u[5]) << 40
+	A.BTimeSec |= uint64(u[6]) << 48
+	A.BTimeSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.BTimeNSec = uint64(u[0])
+	A.BTimeNSec |= uint64(u[1]) << 8
+	A.BTimeNSec |= uint64(u[2]) << 16
+	A.BTimeNSec |= uint64(u[3]) << 24
+	A.BTimeNSec |= uint64(u[4]) << 32
+	A.BTimeNSec |= uint64(u[5]) << 40
+	A.BTimeNSec |= uint64(u[6]) << 48
+	A.BTimeNSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.Gen = uint64(u[0])
+	A.Gen |= uint64(u[1]) << 8
+	A.Gen |= uint64(u[2]) << 16
+	A.Gen |= uint64(u[3]) << 24
+	A.Gen |= uint64(u[4]) << 32
+	A.Gen |= uint64(u[5]) << 40
+	A.Gen |= uint64(u[6]) << 48
+	A.Gen |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	A.DataVersion = uint64(u[0])
+	A.DataVersion |= uint64(u[1]) << 8
+	A.DataVersion |= uint64(u[2]) << 16
+	A.DataVersion |= uint64(u[3]) << 24
+	A.DataVersion |= uint64(u[4]) << 32
+	A.DataVersion |= uint64(u[5]) << 40
+	A.DataVersion |= uint64(u[6]) << 48
+	A.DataVersion |= uint64(u[7]) << 56
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTgetattrPkt(b *bytes.Buffer, t Tag, GFID FID, Mask uint64) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tgetattr),
+		byte(t), byte(t >> 8),
+		uint8(GFID >> 0),
+		uint8(GFID >> 8),
+		uint8(GFID >> 16),
+		uint8(GFID >> 24),
+		uint8(Mask >> 0),
+		uint8(Mask >> 8),
+		uint8(Mask >> 16),
+		uint8(Mask >> 24),
+		uint8(Mask >> 32),
+		uint8(Mask >> 40),
+		uint8(Mask >> 48),
+		uint8(Mask >> 56),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTgetattrPkt(b *bytes.Buffer) (GFID FID, Mask uint64, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	GFID = FID(u[0])
+	GFID |= FID(u[1]) << 8
+	GFID |= FID(u[2]) << 16
+	GFID |= FID(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	Mask = uint64(u[0])
+	Mask |= uint64(u[1]) << 8
+	Mask |= uint64(u[2]) << 16
+	Mask |= uint64(u[3]) << 24
+	Mask |= uint64(u[4]) << 32
+	Mask |= uint64(u[5]) << 40
+	Mask |= uint64(u[6]) << 48
+	Mask |= uint64(u[7]) << 56
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRgetattr(ctx context.Context, b *bytes.Buffer) (err error) {
+	GFID, Mask, t, err := UnmarshalTgetattrPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tgetattr], err)
+		return err
+	}
+	if A, err := s.NS.(NineServerL).Rgetattr(ctx, GFID, Mask); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRgetattrPkt(b, t, A)
+	}
+	return nil
+}
+func MarshalRsetattrPkt(b *bytes.Buffer, t Tag) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rsetattr),
+		byte(t), byte(t >> 8),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRsetattrPkt(b *bytes.Buffer) (t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTsetattrPkt(b *bytes.Buffer, t Tag, SFID FID, SA SetAttr) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tsetattr),
+		byte(t), byte(t >> 8),
+		uint8(SFID >> 0),
+		uint8(SFID >> 8),
+		uint8(SFID >> 16),
+		uint8(SFID >> 24),
+		uint8(SA.Valid >> 0),
+		uint8(SA.Valid >> 8),
+		uint8(SA.Valid >> 16),
+		uint8(SA.Valid >> 24),
+		uint8(SA.Mode >> 0),
+		uint8(SA.Mode >> 8),
+		uint8(SA.Mode >> 16),
+		uint8(SA.Mode >> 24),
+		uint8(SA.UID >> 0),
+		uint8(SA.UID >> 8),
+		uint8(SA.UID >> 16),
+		uint8(SA.UID >> 24),
+		uint8(SA.GID >> 0),
+		uint8(SA.GID >> 8),
+		uint8(SA.GID >> 16),
+		uint8(SA.GID >> 24),
+		uint8(SA.Size >> 0),
+		uint8(SA.Size >> 8),
+		uint8(SA.Size >> 16),
+		uint8(SA.Size >> 24),
+		uint8(SA.Size >> 32),
+		uint8(SA.Size >> 40),
+		uint8(SA.Size >> 48),
+		uint8(SA.Size >> 56),
+		uint8(SA.ATimeSec >> 0),
+		uint8(SA.ATimeSec >> 8),
+		uint8(SA.ATimeSec >> 16),
+		uint8(SA.ATimeSec >> 24),
+		uint8(SA.ATimeSec >> 32),
+		uint8(SA.ATimeSec >> 40),
+		uint8(SA.ATimeSec >> 48),
+		uint8(SA.ATimeSec >> 56),
+		uint8(SA.ATimeNSec >> 0),
+		uint8(SA.ATimeNSec >> 8),
+		uint8(SA.ATimeNSec >> 16),
+		uint8(SA.ATimeNSec >> 24),
+		uint8(SA.ATimeNSec >> 32),
+		uint8(SA.ATimeNSec >> 40),
+		uint8(SA.ATimeNSec >> 48),
+		uint8(SA.ATimeNSec >> 56),
+		uint8(SA.MTimeSec >> 0),
+		uint8(SA.MTimeSec >> 8),
+		uint8(SA.MTimeSec >> 16),
+		uint8(SA.MTimeSec >> 24),
+		uint8(SA.MTimeSec >> 32),
+		uint8(SA.MTimeSec >> 40),
+		uint8(SA.MTimeSec >> 48),
+		uint8(SA.MTimeSec >> 56),
+		uint8(SA.MTimeNSec >> 0),
+		uint8(SA.MTimeNSec >> 8),
+		uint8(SA.MTimeNSec >> 16),
+		uint8(SA.MTimeNSec >> 24),
+		uint8(SA.MTimeNSec >> 32),
+		uint8(SA.MTimeNSec >> 40),
+		uint8(SA.MTimeNSec >> 48),
+		uint8(SA.MTimeNSec >> 56),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTsetattrPkt(b *bytes.Buffer) (SFID FID, SA SetAttr, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	SFID = FID(u[0])
+	SFID |= FID(u[1]) << 8
+	SFID |= FID(u[2]) << 16
+	SFID |= FID(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	SA.Valid = uint32(u[0])
+	SA.Valid |= uint32(u[1]) << 8
+	SA.Valid |= uint32(u[2]) << 16
+	SA.Valid |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	SA.Mode = uint32(u[0])
+	SA.Mode |= uint32(u[1]) << 8
+	SA.Mode |= uint32(u[2]) << 16
+	SA.Mode |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	SA.UID = uint32(u[0])
+	SA.UID |= uint32(u[1]) << 8
+	SA.UID |= uint32(u[2]) << 16
+	SA.UID |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	SA.GID = uint32(u[0])
+	SA.GID |= uint32(u[1]) << 8
+	SA.GID |= uint32(u[2]) << 16
+	SA.GID |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	SA.Size = uint64(u[0])
+	SA.Size |= uint64(u[1]) << 8
+	SA.Size |= uint64(u[2]) << 16
+	SA.Size |= uint64(u[3]) << 24
+	SA.Size |= uint64(u[4]) << 32
+	SA.Size |= uint64(u[5]) << 40
+	SA.Size |= uint64(u[6]) << 48
+	SA.Size |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	SA.ATimeSec = uint64(u[0])
+	SA.ATimeSec |= uint64(u[1]) << 8
+	SA.ATimeSec |= uint64(u[2]) << 16
+	SA.ATimeSec |= uint64(u[3]) << 24
+	SA.ATimeSec |= uint64(u[4]) << 32
+	SA.ATimeSec |= uint64(u[5]) << 40
+	SA.ATimeSec |= uint64(u[6]) << 48
+	SA.ATimeSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	SA.ATimeNSec = uint64(u[0])
+	SA.ATimeNSec |= uint64(u[1]) << 8
+	SA.ATimeNSec |= uint64(u[2]) << 16
+	SA.ATimeNSec |= uint64(u[3]) << 24
+	SA.ATimeNSec |= uint64(u[4]) << 32
+	SA.ATimeNSec |= uint64(u[5]) << 40
+	SA.ATimeNSec |= uint64(u[6]) << 48
+	SA.ATimeNSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	SA.MTimeSec = uint64(u[0])
+	SA.MTimeSec |= uint64(u[1]) << 8
+	SA.MTimeSec |= uint64(u[2]) << 16
+	SA.MTimeSec |= uint64(u[3]) << 24
+	SA.MTimeSec |= uint64(u[4]) << 32
+	SA.MTimeSec |= uint64(u[5]) << 40
+	SA.MTimeSec |= uint64(u[6]) << 48
+	SA.MTimeSec |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	SA.MTimeNSec = uint64(u[0])
+	SA.MTimeNSec |= uint64(u[1]) << 8
+	SA.MTimeNSec |= uint64(u[2]) << 16
+	SA.MTimeNSec |= uint64(u[3]) << 24
+	SA.MTimeNSec |= uint64(u[4]) << 32
+	SA.MTimeNSec |= uint64(u[5]) << 40
+	SA.MTimeNSec |= uint64(u[6]) << 48
+	SA.MTimeNSec |= uint64(u[7]) << 56
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRsetattr(ctx context.Context, b *bytes.Buffer) (err error) {
+	SFID, SA, t, err := UnmarshalTsetattrPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tsetattr], err)
+		return err
+	}
+	if err := s.NS.(NineServerL).Rsetattr(ctx, SFID, SA); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRsetattrPkt(b, t)
+	}
+	return nil
+}
+func MarshalRxattrwalkPkt(b *bytes.Buffer, t Tag, XSize uint64) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rxattrwalk),
+		byte(t), byte(t >> 8),
+		uint8(XSize >> 0),
+		uint8(XSize >> 8),
+		uint8(XSize >> 16),
+		uint8(XSize >> 24),
+		uint8(XSize >> 32),
+		uint8(XSize >> 40),
+		uint8(XSize >> 48),
+		uint8(XSize >> 56),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRxattrwalkPkt(b *bytes.Buffer) (XSize uint64, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	XSize = uint64(u[0])
+	XSize |= uint64(u[1]) << 8
+	XSize |= uint64(u[2]) << 16
+	XSize |= uint64(u[3]) << 24
+	XSize |= uint64(u[4]) << 32
+	XSize |= uint64(u[5]) << 40
+	XSize |= uint64(u[6]) << 48
+	XSize |= uint64(u[7]) << 56
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTxattrwalkPkt(b *bytes.Buffer, t Tag, XFID FID, XNewFID FID, XName string) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Txattrwalk),
+		byte(t), byte(t >> 8),
+		uint8(XFID >> 0),
+		uint8(XFID >> 8),
+		uint8(XFID >> 16),
+		uint8(XFID >> 24),
+		uint8(XNewFID >> 0),
+		uint8(XNewFID >> 8),
+		uint8(XNewFID >> 16),
+		uint8(XNewFID >> 24),
+		uint8(len(XName)), uint8(len(XName) >> 8),
+	})
+	b.Write([]byte(XName))
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTxattrwalkPkt(b *bytes.Buffer) (XFID FID, XNewFID FID, XName string, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	XFID = FID(u[0])
+	XFID |= FID(u[1]) << 8
+	XFID |= FID(u[2]) << 16
+	XFID |= FID(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	XNewFID = FID(u[0])
+	XNewFID |= FID(u[1]) << 8
+	XNewFID |= FID(u[2]) << 16
+	XNewFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	XName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRxattrwalk(ctx context.Context, b *bytes.Buffer) (err error) {
+	XFID, XNewFID, XName, t, err := UnmarshalTxattrwalkPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Txattrwalk], err)
+		return err
+	}
+	if XSize, err := s.NS.(NineServerL).Rxattrwalk(ctx, XFID, XNewFID, XName); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRxattrwalkPkt(b, t, XSize)
+	}
+	return nil
+}
+func MarshalRxattrcreatePkt(b *bytes.Buffer, t Tag) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rxattrcreate),
+		byte(t), byte(t >> 8),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRxattrcreatePkt(b *bytes.Buffer) (t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTxattrcreatePkt(b *bytes.Buffer, t Tag, XFID FID, XName string, XSize uint64, XFlags uint32) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Txattrcreate),
+		byte(t), byte(t >> 8),
+		uint8(XFID >> 0),
+		uint8(XFID >> 8),
+		uint8(XFID >> 16),
+		uint8(XFID >> 24),
+		uint8(len(XName)), uint8(len(XName) >> 8),
+	})
+	b.Write([]byte(XName))
+	b.Write([]byte{uint8(XSize >> 0),
+		uint8(XSize >> 8),
+		uint8(XSize >> 16),
+		uint8(XSize >> 24),
+		uint8(XSize >> 32),
+		uint8(XSize >> 40),
+		uint8(XSize >> 48),
+		uint8(XSize >> 56),
+		uint8(XFlags >> 0),
+		uint8(XFlags >> 8),
+		uint8(XFlags >> 16),
+		uint8(XFlags >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTxattrcreatePkt(b *bytes.Buffer) (XFID FID, XName string, XSize uint64, XFlags uint32, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	XFID = FID(u[0])
+	XFID |= FID(u[1]) << 8
+	XFID |= FID(u[2]) << 16
+	XFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	XName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	XSize = uint64(u[0])
+	XSize |= uint64(u[1]) << 8
+	XSize |= uint64(u[2]) << 16
+	XSize |= uint64(u[3]) << 24
+	XSize |= uint64(u[4]) << 32
+	XSize |= uint64(u[5]) << 40
+	XSize |= uint64(u[6]) << 48
+	XSize |= uint64(u[7]) << 56
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	XFlags = uint32(u[0])
+	XFlags |= uint32(u[1]) << 8
+	XFlags |= uint32(u[2]) << 16
+	XFlags |= uint32(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRxattrcreate(ctx context.Context, b *bytes.Buffer) (err error) {
+	XFID, XName, XSize, XFlags, t, err := UnmarshalTxattrcreatePkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Txattrcreate], err)
+		return err
+	}
+	if err := s.NS.(NineServerL).Rxattrcreate(ctx, XFID, XName, XSize, XFlags); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRxattrcreatePkt(b, t)
+	}
+	return nil
+}
+func MarshalRreaddirPkt(b *bytes.Buffer, t Tag, Entries []uint8) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rreaddir),
+		byte(t), byte(t >> 8),
+		uint8(len(Entries) >> 0),
+		uint8(len(Entries) >> 8),
+		uint8(len(Entries) >> 16),
+		uint8(len(Entries) >> 24),
+	})
+	b.Write(Entries)
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRreaddirPkt(b *bytes.Buffer) (Entries []uint8, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	l |= uint64(u[2]) << 16
+	l |= uint64(u[3]) << 24
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for []byte: need %d, have %d", l, b.Len())
+		return
+	}
+	Entries = b.Bytes()[:l]
+	_ = b.Next(int(l))
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTreaddirPkt(b *bytes.Buffer, t Tag, DFID FID, DOffset Offset, DCount Count) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Treaddir),
+		byte(t), byte(t >> 8),
+		uint8(DFID >> 0),
+		uint8(DFID >> 8),
+		uint8(DFID >> 16),
+		uint8(DFID >> 24),
+		uint8(DOffset >> 0),
+		uint8(DOffset >> 8),
+		uint8(DOffset >> 16),
+		uint8(DOffset >> 24),
+		uint8(DOffset >> 32),
+		uint8(DOffset >> 40),
+		uint8(DOffset >> 48),
+		uint8(DOffset >> 56),
+		uint8(DCount >> 0),
+		uint8(DCount >> 8),
+		uint8(DCount >> 16),
+		uint8(DCount >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTreaddirPkt(b *bytes.Buffer) (DFID FID, DOffset Offset, DCount Count, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	DFID = FID(u[0])
+	DFID |= FID(u[1]) << 8
+	DFID |= FID(u[2]) << 16
+	DFID |= FID(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	DOffset = Offset(u[0])
+	DOffset |= Offset(u[1]) << 8
+	DOffset |= Offset(u[2]) << 16
+	DOffset |= Offset(u[3]) << 24
+	DOffset |= Offset(u[4]) << 32
+	DOffset |= Offset(u[5]) << 40
+	DOffset |= Offset(u[6]) << 48
+	DOffset |= Offset(u[7]) << 56
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	DCount = Count(u[0])
+	DCount |= Count(u[1]) << 8
+	DCount |= Count(u[2]) << 16
+	DCount |= Count(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRreaddir(ctx context.Context, b *bytes.Buffer) (err error) {
+	DFID, DOffset, DCount, t, err := UnmarshalTreaddirPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Treaddir], err)
+		return err
+	}
+	if Entries, err := s.NS.(NineServerL).Rreaddir(ctx, DFID, DOffset, DCount); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRreaddirPkt(b, t, Entries)
+	}
+	return nil
+}
+func MarshalRfsyncPkt(b *bytes.Buffer, t Tag) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rfsync),
+		byte(t), byte(t >> 8),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRfsyncPkt(b *bytes.Buffer) (t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTfsyncPkt(b *bytes.Buffer, t Tag, FFID FID, Datasync uint32) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tfsync),
+		byte(t), byte(t >> 8),
+		uint8(FFID >> 0),
+		uint8(FFID >> 8),
+		uint8(FFID >> 16),
+		uint8(FFID >> 24),
+		uint8(Datasync >> 0),
+		uint8(Datasync >> 8),
+		uint8(Datasync >> 16),
+		uint8(Datasync >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTfsyncPkt(b *bytes.Buffer) (FFID FID, Datasync uint32, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	FFID = FID(u[0])
+	FFID |= FID(u[1]) << 8
+	FFID |= FID(u[2]) << 16
+	FFID |= FID(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	Datasync = uint32(u[0])
+	Datasync |= uint32(u[1]) << 8
+	Datasync |= uint32(u[2]) << 16
+	Datasync |= uint32(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRfsync(ctx context.Context, b *bytes.Buffer) (err error) {
+	FFID, Datasync, t, err := UnmarshalTfsyncPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tfsync], err)
+		return err
+	}
+	if err := s.NS.(NineServerL).Rfsync(ctx, FFID, Datasync); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRfsyncPkt(b, t)
+	}
+	return nil
+}
+func MarshalRlockPkt(b *bytes.Buffer, t Tag, Status uint8) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rlock),
+		byte(t), byte(t >> 8),
+		uint8(Status >> 0),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRlockPkt(b *bytes.Buffer) (Status uint8, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	Status = uint8(u[0])
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTlockPkt(b *bytes.Buffer, t Tag, LFID FID, LType uint8, LFlags uint32, LStart uint64, LLength uint64, LProcID uint32, LClientID string) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tlock),
+		byte(t), byte(t >> 8),
+		uint8(LFID >> 0),
+		uint8(LFID >> 8),
+		uint8(LFID >> 16),
+		uint8(LFID >> 24),
+		uint8(LType >> 0),
+		uint8(LFlags >> 0),
+		uint8(LFlags >> 8),
+		uint8(LFlags >> 16),
+		uint8(LFlags >> 24),
+		uint8(LStart >> 0),
+		uint8(LStart >> 8),
+		uint8(LStart >> 16),
+		uint8(LStart >> 24),
+		uint8(LStart >> 32),
+		uint8(LStart >> 40),
+		uint8(LStart >> 48),
+		uint8(LStart >> 56),
+		uint8(LLength >> 0),
+		uint8(LLength >> 8),
+		uint8(LLength >> 16),
+		uint8(LLength >> 24),
+		uint8(LLength >> 32),
+		uint8(LLength >> 40),
+		uint8(LLength >> 48),
+		uint8(LLength >> 56),
+		uint8(LProcID >> 0),
+		uint8(LProcID >> 8),
+		uint8(LProcID >> 16),
+		uint8(LProcID >> 24),
+		uint8(len(LClientID)), uint8(len(LClientID) >> 8),
+	})
+	b.Write([]byte(LClientID))
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTlockPkt(b *bytes.Buffer) (LFID FID, LType uint8, LFlags uint32, LStart uint64, LLength uint64, LProcID uint32, LClientID string, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	LFID = FID(u[0])
+	LFID |= FID(u[1]) << 8
+	LFID |= FID(u[2]) << 16
+	LFID |= FID(u[3]) << 24
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	LType = uint8(u[0])
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	LFlags = uint32(u[0])
+	LFlags |= uint32(u[1]) << 8
+	LFlags |= uint32(u[2]) << 16
+	LFlags |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	LStart = uint64(u[0])
+	LStart |= uint64(u[1]) << 8
+	LStart |= uint64(u[2]) << 16
+	LStart |= uint64(u[3]) << 24
+	LStart |= uint64(u[4]) << 32
+	LStart |= uint64(u[5]) << 40
+	LStart |= uint64(u[6]) << 48
+	LStart |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	LLength = uint64(u[0])
+	LLength |= uint64(u[1]) << 8
+	LLength |= uint64(u[2]) << 16
+	LLength |= uint64(u[3]) << 24
+	LLength |= uint64(u[4]) << 32
+	LLength |= uint64(u[5]) << 40
+	LLength |= uint64(u[6]) << 48
+	LLength |= uint64(u[7]) << 56
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	LProcID = uint32(u[0])
+	LProcID |= uint32(u[1]) << 8
+	LProcID |= uint32(u[2]) << 16
+	LProcID |= uint32(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	LClientID = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRlock(ctx context.Context, b *bytes.Buffer) (err error) {
+	LFID, LType, LFlags, LStart, LLength, LProcID, LClientID, t, err := UnmarshalTlockPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tlock], err)
+		return err
+	}
+	if Status, err := s.NS.(NineServerL).Rlock(ctx, LFID, LType, LFlags, LStart, LLength, LProcID, LClientID); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRlockPkt(b, t, Status)
+	}
+	return nil
+}
+func MarshalRgetlockPkt(b *bytes.Buffer, t Tag, RType uint8, RStart uint64, RLength uint64, RProcID uint32, RClientID string) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rgetlock),
+		byte(t), byte(t >> 8),
+		uint8(RType >> 0),
+		uint8(RStart >> 0),
+		uint8(RStart >> 8),
+		uint8(RStart >> 16),
+		uint8(RStart >> 24),
+		uint8(RStart >> 32),
+		uint8(RStart >> 40),
+		uint8(RStart >> 48),
+		uint8(RStart >> 56),
+		uint8(RLength >> 0),
+		uint8(RLength >> 8),
+		uint8(RLength >> 16),
+		uint8(RLength >> 24),
+		uint8(RLength >> 32),
+		uint8(RLength >> 40),
+		uint8(RLength >> 48),
+		uint8(RLength >> 56),
+		uint8(RProcID >> 0),
+		uint8(RProcID >> 8),
+		uint8(RProcID >> 16),
+		uint8(RProcID >> 24),
+		uint8(len(RClientID)), uint8(len(RClientID) >> 8),
+	})
+	b.Write([]byte(RClientID))
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRgetlockPkt(b *bytes.Buffer) (RType uint8, RStart uint64, RLength uint64, RProcID uint32, RClientID string, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	RType = uint8(u[0])
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	RStart = uint64(u[0])
+	RStart |= uint64(u[1]) << 8
+	RStart |= uint64(u[2]) << 16
+	RStart |= uint64(u[3]) << 24
+	RStart |= uint64(u[4]) << 32
+	RStart |= uint64(u[5]) << 40
+	RStart |= uint64(u[6]) << 48
+	RStart |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	RLength = uint64(u[0])
+	RLength |= uint64(u[1]) << 8
+	RLength |= uint64(u[2]) << 16
+	RLength |= uint64(u[3]) << 24
+	RLength |= uint64(u[4]) << 32
+	RLength |= uint64(u[5]) << 40
+	RLength |= uint64(u[6]) << 48
+	RLength |= uint64(u[7]) << 56
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	RProcID = uint32(u[0])
+	RProcID |= uint32(u[1]) << 8
+	RProcID |= uint32(u[2]) << 16
+	RProcID |= uint32(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	RClientID = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTgetlockPkt(b *bytes.Buffer, t Tag, GFID FID, GType uint8, GStart uint64, GLength uint64, GProcID uint32, GClientID string) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tgetlock),
+		byte(t), byte(t >> 8),
+		uint8(GFID >> 0),
+		uint8(GFID >> 8),
+		uint8(GFID >> 16),
+		uint8(GFID >> 24),
+		uint8(GType >> 0),
+		uint8(GStart >> 0),
+		uint8(GStart >> 8),
+		uint8(GStart >> 16),
+		uint8(GStart >> 24),
+		uint8(GStart >> 32),
+		uint8(GStart >> 40),
+		uint8(GStart >> 48),
+		uint8(GStart >> 56),
+		uint8(GLength >> 0),
+		uint8(GLength >> 8),
+		uint8(GLength >> 16),
+		uint8(GLength >> 24),
+		uint8(GLength >> 32),
+		uint8(GLength >> 40),
+		uint8(GLength >> 48),
+		uint8(GLength >> 56),
+		uint8(GProcID >> 0),
+		uint8(GProcID >> 8),
+		uint8(GProcID >> 16),
+		uint8(GProcID >> 24),
+		uint8(len(GClientID)), uint8(len(GClientID) >> 8),
+	})
+	b.Write([]byte(GClientID))
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTgetlockPkt(b *bytes.Buffer) (GFID FID, GType uint8, GStart uint64, GLength uint64, GProcID uint32, GClientID string, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	GFID = FID(u[0])
+	GFID |= FID(u[1]) << 8
+	GFID |= FID(u[2]) << 16
+	GFID |= FID(u[3]) << 24
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	GType = uint8(u[0])
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	GStart = uint64(u[0])
+	GStart |= uint64(u[1]) << 8
+	GStart |= uint64(u[2]) << 16
+	GStart |= uint64(u[3]) << 24
+	GStart |= uint64(u[4]) << 32
+	GStart |= uint64(u[5]) << 40
+	GStart |= uint64(u[6]) << 48
+	GStart |= uint64(u[7]) << 56
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	GLength = uint64(u[0])
+	GLength |= uint64(u[1]) << 8
+	GLength |= uint64(u[2]) << 16
+	GLength |= uint64(u[3]) << 24
+	GLength |= uint64(u[4]) << 32
+	GLength |= uint64(u[5]) << 40
+	GLength |= uint64(u[6]) << 48
+	GLength |= uint64(u[7]) << 56
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	GProcID = uint32(u[0])
+	GProcID |= uint32(u[1]) << 8
+	GProcID |= uint32(u[2]) << 16
+	GProcID |= uint32(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	GClientID = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRgetlock(ctx context.Context, b *bytes.Buffer) (err error) {
+	GFID, GType, GStart, GLength, GProcID, GClientID, t, err := UnmarshalTgetlockPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tgetlock], err)
+		return err
+	}
+	if RType, RStart, RLength, RProcID, RClientID, err := s.NS.(NineServerL).Rgetlock(ctx, GFID, GType, GStart, GLength, GProcID, GClientID); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRgetlockPkt(b, t, RType, RStart, RLength, RProcID, RClientID)
+	}
+	return nil
+}
+func MarshalRlinkPkt(b *bytes.Buffer, t Tag) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rlink),
+		byte(t), byte(t >> 8),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRlinkPkt(b *bytes.Buffer) (t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTlinkPkt(b *bytes.Buffer, t Tag, LDFID FID, LFID FID, LName string) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tlink),
+		byte(t), byte(t >> 8),
+		uint8(LDFID >> 0),
+		uint8(LDFID >> 8),
+		uint8(LDFID >> 16),
+		uint8(LDFID >> 24),
+		uint8(LFID >> 0),
+		uint8(LFID >> 8),
+		uint8(LFID >> 16),
+		uint8(LFID >> 24),
+		uint8(len(LName)), uint8(len(LName) >> 8),
+	})
+	b.Write([]byte(LName))
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTlinkPkt(b *bytes.Buffer) (LDFID FID, LFID FID, LName string, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	LDFID = FID(u[0])
+	LDFID |= FID(u[1]) << 8
+	LDFID |= FID(u[2]) << 16
+	LDFID |= FID(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	LFID = FID(u[0])
+	LFID |= FID(u[1]) << 8
+	LFID |= FID(u[2]) << 16
+	LFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	LName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRlink(ctx context.Context, b *bytes.Buffer) (err error) {
+	LDFID, LFID, LName, t, err := UnmarshalTlinkPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tlink], err)
+		return err
+	}
+	if err := s.NS.(NineServerL).Rlink(ctx, LDFID, LFID, LName); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRlinkPkt(b, t)
+	}
+	return nil
+}
+func MarshalRmkdirPkt(b *bytes.Buffer, t Tag, MQID QID) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rmkdir),
+		byte(t), byte(t >> 8),
+		uint8(MQID.Type >> 0),
+		uint8(MQID.Version >> 0),
+		uint8(MQID.Version >> 8),
+		uint8(MQID.Version >> 16),
+		uint8(MQID.Version >> 24),
+		uint8(MQID.Path >> 0),
+		uint8(MQID.Path >> 8),
+		uint8(MQID.Path >> 16),
+		uint8(MQID.Path >> 24),
+		uint8(MQID.Path >> 32),
+		uint8(MQID.Path >> 40),
+		uint8(MQID.Path >> 48),
+		uint8(MQID.Path >> 56),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRmkdirPkt(b *bytes.Buffer) (MQID QID, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 1 {
+		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
+		return
+	}
+	b.Read(u[:1])
+	MQID.Type = uint8(u[0])
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	MQID.Version = uint32(u[0])
+	MQID.Version |= uint32(u[1]) << 8
+	MQID.Version |= uint32(u[2]) << 16
+	MQID.Version |= uint32(u[3]) << 24
+	if b.Len() < 8 {
+		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
+		return
+	}
+	b.Read(u[:8])
+	MQID.Path = uint64(u[0])
+	MQID.Path |= uint64(u[1]) << 8
+	MQID.Path |= uint64(u[2]) << 16
+	MQID.Path |= uint64(u[3]) << 24
+	MQID.Path |= uint64(u[4]) << 32
+	MQID.Path |= uint64(u[5]) << 40
+	MQID.Path |= uint64(u[6]) << 48
+	MQID.Path |= uint64(u[7]) << 56
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTmkdirPkt(b *bytes.Buffer, t Tag, MDFID FID, MName string, MMode uint32, MGID uint32) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tmkdir),
+		byte(t), byte(t >> 8),
+		uint8(MDFID >> 0),
+		uint8(MDFID >> 8),
+		uint8(MDFID >> 16),
+		uint8(MDFID >> 24),
+		uint8(len(MName)), uint8(len(MName) >> 8),
+	})
+	b.Write([]byte(MName))
+	b.Write([]byte{uint8(MMode >> 0),
+		uint8(MMode >> 8),
+		uint8(MMode >> 16),
+		uint8(MMode >> 24),
+		uint8(MGID >> 0),
+		uint8(MGID >> 8),
+		uint8(MGID >> 16),
+		uint8(MGID >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTmkdirPkt(b *bytes.Buffer) (MDFID FID, MName string, MMode uint32, MGID uint32, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	MDFID = FID(u[0])
+	MDFID |= FID(u[1]) << 8
+	MDFID |= FID(u[2]) << 16
+	MDFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	MName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	MMode = uint32(u[0])
+	MMode |= uint32(u[1]) << 8
+	MMode |= uint32(u[2]) << 16
+	MMode |= uint32(u[3]) << 24
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	MGID = uint32(u[0])
+	MGID |= uint32(u[1]) << 8
+	MGID |= uint32(u[2]) << 16
+	MGID |= uint32(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRmkdir(ctx context.Context, b *bytes.Buffer) (err error) {
+	MDFID, MName, MMode, MGID, t, err := UnmarshalTmkdirPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tmkdir], err)
+		return err
+	}
+	if MQID, err := s.NS.(NineServerL).Rmkdir(ctx, MDFID, MName, MMode, MGID); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRmkdirPkt(b, t, MQID)
+	}
+	return nil
+}
+func MarshalRrenameatPkt(b *bytes.Buffer, t Tag) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Rrenameat),
+		byte(t), byte(t >> 8),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRrenameatPkt(b *bytes.Buffer) (t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTrenameatPkt(b *bytes.Buffer, t Tag, OldDFID FID, OldName string, NewDFID FID, NewName string) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Trenameat),
+		byte(t), byte(t >> 8),
+		uint8(OldDFID >> 0),
+		uint8(OldDFID >> 8),
+		uint8(OldDFID >> 16),
+		uint8(OldDFID >> 24),
+		uint8(len(OldName)), uint8(len(OldName) >> 8),
+	})
+	b.Write([]byte(OldName))
+	b.Write([]byte{uint8(NewDFID >> 0),
+		uint8(NewDFID >> 8),
+		uint8(NewDFID >> 16),
+		uint8(NewDFID >> 24),
+		uint8(len(NewName)), uint8(len(NewName) >> 8),
+	})
+	b.Write([]byte(NewName))
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTrenameatPkt(b *bytes.Buffer) (OldDFID FID, OldName string, NewDFID FID, NewName string, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	OldDFID = FID(u[0])
+	OldDFID |= FID(u[1]) << 8
+	OldDFID |= FID(u[2]) << 16
+	OldDFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	OldName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	NewDFID = FID(u[0])
+	NewDFID |= FID(u[1]) << 8
+	NewDFID |= FID(u[2]) << 16
+	NewDFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	NewName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRrenameat(ctx context.Context, b *bytes.Buffer) (err error) {
+	OldDFID, OldName, NewDFID, NewName, t, err := UnmarshalTrenameatPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Trenameat], err)
+		return err
+	}
+	if err := s.NS.(NineServerL).Rrenameat(ctx, OldDFID, OldName, NewDFID, NewName); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRrenameatPkt(b, t)
+	}
+	return nil
+}
+func MarshalRunlinkatPkt(b *bytes.Buffer, t Tag) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Runlinkat),
+		byte(t), byte(t >> 8),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalRunlinkatPkt(b *bytes.Buffer) (t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func MarshalTunlinkatPkt(b *bytes.Buffer, t Tag, UDFID FID, UName string, UFlags uint32) {
+	var l uint64
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0,
+		uint8(Tunlinkat),
+		byte(t), byte(t >> 8),
+		uint8(UDFID >> 0),
+		uint8(UDFID >> 8),
+		uint8(UDFID >> 16),
+		uint8(UDFID >> 24),
+		uint8(len(UName)), uint8(len(UName) >> 8),
+	})
+	b.Write([]byte(UName))
+	b.Write([]byte{uint8(UFlags >> 0),
+		uint8(UFlags >> 8),
+		uint8(UFlags >> 16),
+		uint8(UFlags >> 24),
+	})
+
+	{
+		l = uint64(b.Len())
+		copy(b.Bytes(), []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	}
+	return
+}
+func UnmarshalTunlinkatPkt(b *bytes.Buffer) (UDFID FID, UName string, UFlags uint32, t Tag, err error) {
+	var u [8]uint8
+	var l uint64
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for Tag; need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0]) | uint64(u[1])<<8
+	t = Tag(l)
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	UDFID = FID(u[0])
+	UDFID |= FID(u[1]) << 8
+	UDFID |= FID(u[2]) << 16
+	UDFID |= FID(u[3]) << 24
+	if b.Len() < 2 {
+		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
+		return
+	}
+	b.Read(u[:2])
+	l = uint64(u[0])
+	l |= uint64(u[1]) << 8
+	if b.Len() < int(l) {
+		err = fmt.Errorf("pkt too short for string: need %d, have %d", l, b.Len())
+		return
+	}
+	UName = string(b.Bytes()[:l])
+	_ = b.Next(int(l))
+	if b.Len() < 4 {
+		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
+		return
+	}
+	b.Read(u[:4])
+	UFlags = uint32(u[0])
+	UFlags |= uint32(u[1]) << 8
+	UFlags |= uint32(u[2]) << 16
+	UFlags |= uint32(u[3]) << 24
+
+	if b.Len() > 0 {
+		err = fmt.Errorf("Packet too long: %d bytes left over after decode", b.Len())
+	}
+	return
+}
+func (s *Server) SrvRunlinkat(ctx context.Context, b *bytes.Buffer) (err error) {
+	UDFID, UName, UFlags, t, err := UnmarshalTunlinkatPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tunlinkat], err)
+		return err
+	}
+	if err := s.NS.(NineServerL).Runlinkat(ctx, UDFID, UName, UFlags); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		MarshalRunlinkatPkt(b, t)
+	}
+	return nil
+}
+
+// ServerError replaces the T-message in b, from its tag on, with a
+// 9P2000 Rerror carrying s. Dispatchers should use Server.ReplyError,
+// which speaks the connection's dialect and knows its msize.
+func ServerError(b *bytes.Buffer, s string) {
+	(&Server{}).ReplyError(b, tagOf(b), "%s", s)
 }
 func Marshaldir(b *bytes.Buffer, D Dir) {
 	var l uint64
@@ -1851,37 +5599,42 @@ func Unmarshaldir(b *bytes.Buffer) (D Dir, err error) {
 	var u [8]uint8
 	var l uint64
 	_ = b.Next(2) // eat the length too
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	D.Type = uint16(u[0])
 	D.Type |= uint16(u[1]) << 8
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	D.Dev = uint32(u[0])
 	D.Dev |= uint32(u[1]) << 8
 	D.Dev |= uint32(u[2]) << 16
 	D.Dev |= uint32(u[3]) << 24
-	if _, err = b.Read(u[:1]); err != nil {
+	if b.Len() < 1 {
 		err = fmt.Errorf("pkt too short for uint8: need 1, have %d", b.Len())
 		return
 	}
+	b.Read(u[:1])
 	D.QID.Type = uint8(u[0])
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	D.QID.Version = uint32(u[0])
 	D.QID.Version |= uint32(u[1]) << 8
 	D.QID.Version |= uint32(u[2]) << 16
 	D.QID.Version |= uint32(u[3]) << 24
-	if _, err = b.Read(u[:8]); err != nil {
+	if b.Len() < 8 {
 		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
 		return
 	}
+	b.Read(u[:8])
 	D.QID.Path = uint64(u[0])
 	D.QID.Path |= uint64(u[1]) << 8
 	D.QID.Path |= uint64(u[2]) << 16
@@ -1890,34 +5643,38 @@ func Unmarshaldir(b *bytes.Buffer) (D Dir, err error) {
 	D.QID.Path |= uint64(u[5]) << 40
 	D.QID.Path |= uint64(u[6]) << 48
 	D.QID.Path |= uint64(u[7]) << 56
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	D.Mode = uint32(u[0])
 	D.Mode |= uint32(u[1]) << 8
 	D.Mode |= uint32(u[2]) << 16
 	D.Mode |= uint32(u[3]) << 24
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	D.Atime = uint32(u[0])
 	D.Atime |= uint32(u[1]) << 8
 	D.Atime |= uint32(u[2]) << 16
 	D.Atime |= uint32(u[3]) << 24
-	if _, err = b.Read(u[:4]); err != nil {
+	if b.Len() < 4 {
 		err = fmt.Errorf("pkt too short for uint32: need 4, have %d", b.Len())
 		return
 	}
+	b.Read(u[:4])
 	D.Mtime = uint32(u[0])
 	D.Mtime |= uint32(u[1]) << 8
 	D.Mtime |= uint32(u[2]) << 16
 	D.Mtime |= uint32(u[3]) << 24
-	if _, err = b.Read(u[:8]); err != nil {
+	if b.Len() < 8 {
 		err = fmt.Errorf("pkt too short for uint64: need 8, have %d", b.Len())
 		return
 	}
+	b.Read(u[:8])
 	D.Length = uint64(u[0])
 	D.Length |= uint64(u[1]) << 8
 	D.Length |= uint64(u[2]) << 16
@@ -1926,10 +5683,11 @@ func Unmarshaldir(b *bytes.Buffer) (D Dir, err error) {
 	D.Length |= uint64(u[5]) << 40
 	D.Length |= uint64(u[6]) << 48
 	D.Length |= uint64(u[7]) << 56
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	if b.Len() < int(l) {
@@ -1938,10 +5696,11 @@ func Unmarshaldir(b *bytes.Buffer) (D Dir, err error) {
 	}
 	D.Name = string(b.Bytes()[:l])
 	_ = b.Next(int(l))
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	if b.Len() < int(l) {
@@ -1950,10 +5709,11 @@ func Unmarshaldir(b *bytes.Buffer) (D Dir, err error) {
 	}
 	D.User = string(b.Bytes()[:l])
 	_ = b.Next(int(l))
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	if b.Len() < int(l) {
@@ -1962,10 +5722,11 @@ func Unmarshaldir(b *bytes.Buffer) (D Dir, err error) {
 	}
 	D.Group = string(b.Bytes()[:l])
 	_ = b.Next(int(l))
-	if _, err = b.Read(u[:2]); err != nil {
+	if b.Len() < 2 {
 		err = fmt.Errorf("pkt too short for uint16: need 2, have %d", b.Len())
 		return
 	}
+	b.Read(u[:2])
 	l = uint64(u[0])
 	l |= uint64(u[1]) << 8
 	if b.Len() < int(l) {
@@ -0,0 +1,221 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the port a dial string without one, e.g. tcp!host,
+// means: that of 9fs.
+const DefaultPort = "564"
+
+// dialNetworks maps the networks a dial string may name to Go's.
+var dialNetworks = map[string]string{
+	"net":        "tcp",
+	"tcp":        "tcp",
+	"tcp4":       "tcp4",
+	"tcp6":       "tcp6",
+	"unix":       "unix",
+	"unixpacket": "unixpacket",
+	"vsock":      "vsock",
+}
+
+// dialServices are the Plan 9 service names a dial string may have in
+// place of a port, which Go's resolver may not know.
+var dialServices = map[string]string{
+	"9fs":  "564",
+	"9pfs": "564",
+	"styx": "6666",
+}
+
+// ParseDialString parses a dial string, as Plan 9, Harvey and
+// plan9port write them, into a network and an address, as ListenNet
+// and DialNet take them:
+//
+//	tcp!host!port	tcp, host:port; tcp4, tcp6 and net, for tcp, too
+//	tcp!host	tcp, host:564
+//	tcp!*!port	tcp, :port, to listen on all addresses
+//	tcp!host:port	tcp, host:port, in Go's form
+//	unix!/path	unix, /path, which may hold a !
+//	vsock!cid!port	vsock, cid:port; the cid may be empty
+//	/path		unix, /path
+//	host:port	tcp, host:port
+//
+// The port may be a service name: 9fs, styx, or one the system knows.
+func ParseDialString(s string) (network, address string, err error) {
+	bad := func(why string) (string, string, error) {
+		return "", "", fmt.Errorf("dial string %q: %s", s, why)
+	}
+	if s == "" {
+		return bad("empty")
+	}
+	i := strings.Index(s, "!")
+	if i < 0 {
+		if strings.HasPrefix(s, "/") {
+			return "unix", s, nil
+		}
+		return "tcp", s, nil
+	}
+	network, ok := dialNetworks[s[:i]]
+	if !ok {
+		return bad(fmt.Sprintf("unknown network %q", s[:i]))
+	}
+	rest := s[i+1:]
+	if network == "unix" || network == "unixpacket" {
+		if rest == "" {
+			return bad("no path")
+		}
+		return network, rest, nil
+	}
+	f := strings.Split(rest, "!")
+	switch {
+	case len(f) > 2:
+		return bad("too many !s")
+	case len(f) == 1 && network == "vsock":
+		// Only cid:port will do.
+		return network, rest, nil
+	case len(f) == 1:
+		if _, _, err := net.SplitHostPort(rest); err == nil {
+			return network, rest, nil
+		}
+		f = append(f, DefaultPort)
+	}
+	host, port := f[0], f[1]
+	if port == "" {
+		return bad("no port")
+	}
+	if network == "vsock" {
+		return network, host + ":" + port, nil
+	}
+	if host == "" {
+		return bad("no host")
+	}
+	if host == "*" {
+		host = ""
+	}
+	if p, ok := dialServices[port]; ok {
+		port = p
+	}
+	return network, net.JoinHostPort(host, port), nil
+}
+
+// Listen listens on the dial string addr: tcp!host!port, or a TCP
+// address, host:port; unix!/path/to/sock; or vsock!cid!port, for a VM
+// socket. See ParseDialString and ListenNet.
+func Listen(addr string) (net.Listener, error) {
+	network, address, err := ParseDialString(addr)
+	if err != nil {
+		return nil, err
+	}
+	return ListenNet(network, address)
+}
+
+// ListenNet is net.Listen, but knows two more things. The network may
+// be "vsock", on Linux, whose address is cid:port; the cid may be
+// empty, to listen on any. And for "unix", a socket file left behind by
+// a server which is no longer running is removed first. Closing a unix
+// socket's Listener, as Shutdown and Close do, removes its file.
+func ListenNet(network, address string) (net.Listener, error) {
+	switch network {
+	case "vsock":
+		cid, port, err := parseVsockAddr(address)
+		if err != nil {
+			return nil, err
+		}
+		return listenVsock(cid, port)
+	case "unix", "unixpacket":
+		ln, err := net.Listen(network, address)
+		if err == nil || !staleSocket(network, address, err) {
+			return ln, err
+		}
+		if err := os.Remove(address); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// DialAddr connects to the dial string addr, as Listen takes them. It
+// is for Dial: func() (net.Conn, error) { return DialAddr(addr) }.
+func DialAddr(addr string) (net.Conn, error) {
+	network, address, err := ParseDialString(addr)
+	if err != nil {
+		return nil, err
+	}
+	return DialNet(network, address)
+}
+
+// DialNet is net.Dial, but knows "vsock" too, as ListenNet does.
+func DialNet(network, address string) (net.Conn, error) {
+	if network != "vsock" {
+		return net.Dial(network, address)
+	}
+	cid, port, err := parseVsockAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	return dialVsock(cid, port)
+}
+
+// vsockAnyCID is VMADDR_CID_ANY, the cid to listen on for any.
+const vsockAnyCID = ^uint32(0)
+
+// parseVsockAddr parses a vsock address, cid:port. An empty cid is
+// vsockAnyCID.
+func parseVsockAddr(address string) (cid, port uint32, err error) {
+	i := strings.LastIndex(address, ":")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("vsock address %q: want cid:port", address)
+	}
+	cid = vsockAnyCID
+	if c := address[:i]; c != "" {
+		n, err := strconv.ParseUint(c, 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("vsock address %q: bad cid: %v", address, err)
+		}
+		cid = uint32(n)
+	}
+	n, err := strconv.ParseUint(address[i+1:], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("vsock address %q: bad port: %v", address, err)
+	}
+	return cid, uint32(n), nil
+}
+
+// vsockAddr is the net.Addr of a VM socket.
+type vsockAddr struct {
+	cid, port uint32
+}
+
+func (a vsockAddr) Network() string { return "vsock" }
+
+func (a vsockAddr) String() string { return fmt.Sprintf("%d:%d", a.cid, a.port) }
+
+// ListenAndServe listens on the dial string addr, as Listen takes them,
+// or l.Addr if it is empty, or else DefaultAddr, and serves connections
+// there.
+func (l *NetListener) ListenAndServe(addr string) error {
+	ln, err := Listen(l.listenAddr(addr))
+	if err != nil {
+		return err
+	}
+	return l.Serve(ln)
+}
+
+// listenAddr returns addr, or l.Addr if it is empty, or else
+// DefaultAddr.
+func (l *NetListener) listenAddr(addr string) string {
+	for _, a := range []string{addr, l.Addr} {
+		if a != "" {
+			return a
+		}
+	}
+	return DefaultAddr
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseDialString(t *testing.T) {
+	for _, tt := range []struct {
+		s, network, address string
+	}{
+		{":5640", "tcp", ":5640"},
+		{"localhost:5640", "tcp", "localhost:5640"},
+		{"tcp!localhost!5640", "tcp", "localhost:5640"},
+		{"net!localhost!5640", "tcp", "localhost:5640"},
+		{"tcp!localhost", "tcp", "localhost:564"},
+		{"tcp!localhost!9fs", "tcp", "localhost:564"},
+		{"tcp!localhost!styx", "tcp", "localhost:6666"},
+		{"tcp!localhost!http", "tcp", "localhost:http"},
+		{"tcp!*!5640", "tcp", ":5640"},
+		{"tcp!::1!5640", "tcp", "[::1]:5640"},
+		{"tcp6!::1", "tcp6", "[::1]:564"},
+		{"tcp!localhost:5640", "tcp", "localhost:5640"},
+		{"tcp4!:5640", "tcp4", ":5640"},
+		{"unix!/run/ufs.sock", "unix", "/run/ufs.sock"},
+		{"unix!/tmp/a!b", "unix", "/tmp/a!b"},
+		{"unix!/tmp/ns.glenda.:0/factotum", "unix", "/tmp/ns.glenda.:0/factotum"},
+		{"/srv/boot", "unix", "/srv/boot"},
+		{"vsock!3!5640", "vsock", "3:5640"},
+		{"vsock!!5640", "vsock", ":5640"},
+		{"vsock!3:5640", "vsock", "3:5640"},
+	} {
+		n, a, err := ParseDialString(tt.s)
+		if n != tt.network || a != tt.address || err != nil {
+			t.Errorf("ParseDialString(%q): want (%q, %q, nil), got (%q, %q, %v)", tt.s, tt.network, tt.address, n, a, err)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"udp!localhost!5640",
+		"!localhost!5640",
+		"tcp!localhost!5640!x",
+		"tcp!!5640",
+		"tcp!localhost!",
+		"unix!",
+		"vsock!3!",
+	} {
+		if n, a, err := ParseDialString(s); err == nil {
+			t.Errorf("ParseDialString(%q): want an error, got (%q, %q, nil)", s, n, a)
+		}
+	}
+}
+
+func TestParseVsockAddr(t *testing.T) {
+	for _, tt := range []struct {
+		a         string
+		cid, port uint32
+		ok        bool
+	}{
+		{"3:5640", 3, 5640, true},
+		{":5640", vsockAnyCID, 5640, true},
+		{"3", 0, 0, false},
+		{"x:5640", 0, 0, false},
+		{"3:5640x", 0, 0, false},
+	} {
+		cid, port, err := parseVsockAddr(tt.a)
+		if (err == nil) != tt.ok || cid != tt.cid || port != tt.port {
+			t.Errorf("parseVsockAddr(%q): want (%d, %d, ok %v), got (%d, %d, %v)", tt.a, tt.cid, tt.port, tt.ok, cid, port, err)
+		}
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	if runtime.GOOS == "plan9" || runtime.GOOS == "windows" {
+		t.Skipf("no unix sockets on %v", runtime.GOOS)
+	}
+	dir, err := ioutil.TempDir("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "s")
+
+	// A server which died leaves its socket behind.
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Plan 9's UnixListener, which is never used, has no such method.
+	ln.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err := os.Lstat(sock); err != nil {
+		t.Fatalf("socket file: want it left behind, got %v", err)
+	}
+
+	ln, err = Listen("unix!" + sock)
+	if err != nil {
+		t.Fatalf("Listen over a stale socket: want nil, got %v", err)
+	}
+	// But one still being served is left alone.
+	if _, err := Listen("unix!" + sock); err == nil {
+		t.Errorf("Listen on a socket in use: want an error, got nil")
+	}
+	ln.Close()
+	if _, err := os.Lstat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket file after Close: want it gone, got %v", err)
+	}
+
+	// Nor is a file which isn't a socket removed.
+	if err := ioutil.WriteFile(sock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("unix!" + sock); err == nil {
+		t.Errorf("Listen on a plain file: want an error, got nil")
+	}
+}
+
+func TestVsock(t *testing.T) {
+	// Without a loopback transport, a dial would only time out.
+	if _, err := os.Stat("/sys/module/vsock_loopback"); err != nil {
+		t.Skipf("no vsock loopback here: %v", err)
+	}
+	port := 20000 + os.Getpid()%10000
+	ln, err := Listen(fmt.Sprintf("vsock!!%d", port))
+	if err != nil {
+		t.Skipf("no vsock here: %v", err)
+	}
+	defer ln.Close()
+	// 1 is VMADDR_CID_LOCAL, for loopback.
+	c, err := DialNet("vsock", fmt.Sprintf("1:%d", port))
+	if err != nil {
+		t.Skipf("no vsock loopback here: %v", err)
+	}
+	defer c.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	defer sc.Close()
+	if _, err := c.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write: want nil, got %v", err)
+	}
+	b := make([]byte, 2)
+	if _, err := sc.Read(b); err != nil || string(b) != "hi" {
+		t.Errorf("Read: want (hi, nil), got (%q, %v)", b, err)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets is the number of buckets in a latency histogram.
+// Bucket 0 counts requests answered in under a microsecond, and bucket
+// i, for i > 0, those which took at least 2^(i-1) and under 2^i
+// microseconds. The last bucket takes everything longer.
+const LatencyBuckets = 32
+
+// Metrics counts the requests a NetListener, or one of its connections,
+// has served. It is kept with atomic adds alone, so it costs little on
+// the path of every request. The NetListener keeps one for itself and
+// one for each connection, Stats keeps one for the requests it sees,
+// and Snapshot reads them. A Metrics is always
+// allocated on its own, never embedded, so that its counters are
+// aligned for 64-bit atomics on 32-bit platforms.
+type Metrics struct {
+	// requests is indexed by T-message type, halved: the R-messages
+	// are odd.
+	requests [128]requestCounters
+
+	bytesIn  uint64
+	bytesOut uint64
+	rejected uint64
+	accepted uint64
+	conns    int64
+
+	// parent, if set, gets everything counted here too.
+	parent *Metrics
+}
+
+type requestCounters struct {
+	count   uint64
+	errors  uint64
+	nanos   uint64
+	latency [LatencyBuckets]uint64
+}
+
+// RequestMetrics is what has been counted for one type of request.
+type RequestMetrics struct {
+	// Count is the number of requests answered, or flushed.
+	Count uint64
+	// Errors is how many of those were answered with an Rerror or
+	// Rlerror, including those which timed out.
+	Errors uint64
+	// Total is the time they took, from being read to having their
+	// reply queued.
+	Total time.Duration
+	// Latency is a histogram of the time each took: see LatencyBuckets.
+	Latency [LatencyBuckets]uint64
+}
+
+// Mean returns the mean time taken by a request.
+func (m RequestMetrics) Mean() time.Duration {
+	if m.Count == 0 {
+		return 0
+	}
+	return m.Total / time.Duration(m.Count)
+}
+
+// Quantile returns a bound on the time in which the fraction q of the
+// requests were answered: the top of the latency bucket in which it
+// falls. It is 0 if there are no requests.
+func (m RequestMetrics) Quantile(q float64) time.Duration {
+	var n uint64
+	for _, c := range m.Latency {
+		n += c
+	}
+	if n == 0 {
+		return 0
+	}
+	want := uint64(q * float64(n))
+	if want == 0 {
+		want = 1
+	}
+	var seen uint64
+	for i, c := range m.Latency {
+		seen += c
+		if seen >= want {
+			return time.Microsecond << uint(i)
+		}
+	}
+	return time.Microsecond << (LatencyBuckets - 1)
+}
+
+// MetricsSnapshot is a copy of a Metrics, at one moment.
+type MetricsSnapshot struct {
+	// Requests holds the counters for each type of T-message which has
+	// been seen.
+	Requests map[MType]RequestMetrics
+	// BytesIn and BytesOut count the bytes of messages read and
+	// written.
+	BytesIn, BytesOut uint64
+	// Rejected counts requests answered with an Rerror without being
+	// run: because they were malformed, used a tag in use, were over
+	// a limit, or came while the server was shutting down.
+	Rejected uint64
+	// Conns is the number of connections being served, and Accepted
+	// the number ever served. They are 0 for a connection's Metrics.
+	Conns    int64
+	Accepted uint64
+}
+
+// Errors returns the number of requests answered with an error,
+// whether or not they were run.
+func (s MetricsSnapshot) Errors() uint64 {
+	n := s.Rejected
+	for _, r := range s.Requests {
+		n += r.Errors
+	}
+	return n
+}
+
+// Snapshot returns a copy of m. Counters which are updated together may
+// be caught between one and the other, but each is right.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	s := MetricsSnapshot{
+		Requests: make(map[MType]RequestMetrics),
+		BytesIn:  atomic.LoadUint64(&m.bytesIn),
+		BytesOut: atomic.LoadUint64(&m.bytesOut),
+		Rejected: atomic.LoadUint64(&m.rejected),
+		Conns:    atomic.LoadInt64(&m.conns),
+		Accepted: atomic.LoadUint64(&m.accepted),
+	}
+	for i := range m.requests {
+		rc := &m.requests[i]
+		n := atomic.LoadUint64(&rc.count)
+		if n == 0 {
+			continue
+		}
+		r := RequestMetrics{
+			Count:  n,
+			Errors: atomic.LoadUint64(&rc.errors),
+			Total:  time.Duration(atomic.LoadUint64(&rc.nanos)),
+		}
+		for j := range rc.latency {
+			r.Latency[j] = atomic.LoadUint64(&rc.latency[j])
+		}
+		s.Requests[MType(i*2)] = r
+	}
+	return s
+}
+
+// request counts a request of type t which took d, and whether it
+// ended in an error.
+func (m *Metrics) request(t MType, d time.Duration, failed bool) {
+	b := bits.Len64(uint64(d / time.Microsecond))
+	if b >= LatencyBuckets {
+		b = LatencyBuckets - 1
+	}
+	for ; m != nil; m = m.parent {
+		rc := &m.requests[t/2]
+		atomic.AddUint64(&rc.count, 1)
+		if failed {
+			atomic.AddUint64(&rc.errors, 1)
+		}
+		atomic.AddUint64(&rc.nanos, uint64(d))
+		atomic.AddUint64(&rc.latency[b], 1)
+	}
+}
+
+func (m *Metrics) read(n int64) {
+	for ; m != nil; m = m.parent {
+		atomic.AddUint64(&m.bytesIn, uint64(n))
+	}
+}
+
+func (m *Metrics) wrote(n int64) {
+	for ; m != nil; m = m.parent {
+		atomic.AddUint64(&m.bytesOut, uint64(n))
+	}
+}
+
+func (m *Metrics) reject() {
+	for ; m != nil; m = m.parent {
+		atomic.AddUint64(&m.rejected, 1)
+	}
+}
+
+// conn counts a connection coming, with n = 1, or going, with n = -1.
+func (m *Metrics) conn(n int64) {
+	if n > 0 {
+		atomic.AddUint64(&m.accepted, 1)
+	}
+	atomic.AddInt64(&m.conns, n)
+}
+
+// ConnMetrics is a snapshot of the Metrics of one connection.
+type ConnMetrics struct {
+	RemoteAddr string
+	Start      time.Time
+	MetricsSnapshot
+}
+
+// Metrics returns the Metrics of all l's connections together.
+func (l *NetListener) Metrics() *Metrics {
+	return l.metrics
+}
+
+// ConnMetrics returns a snapshot of the Metrics of each connection l is
+// serving.
+func (l *NetListener) ConnMetrics() []ConnMetrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var cm []ConnMetrics
+	for c := range l.conns {
+		cm = append(cm, ConnMetrics{RemoteAddr: c.remoteAddr, Start: c.start, MetricsSnapshot: c.metrics.Snapshot()})
+	}
+	return cm
+}
+
+// isError reports whether the reply in b is an Rerror or Rlerror.
+func isError(b []byte) bool {
+	return len(b) > 4 && (MType(b[4]) == Rerror || MType(b[4]) == Rlerror)
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"expvar"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	l, c := newListenerConn(t, newEcho())
+
+	// Tversion, which newListenerConn did, is 19 bytes each way.
+	in, out := uint64(19), uint64(19)
+	do := func(b *bytes.Buffer) {
+		t.Helper()
+		in += uint64(b.Len())
+		send(t, c, b)
+		_, rb := readReply(t, c)
+		out += uint64(rb.Len() + 5)
+	}
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, 2, 0, 5)
+	do(&b)
+	MarshalTreadPkt(&b, 1, 2, 2, 5)
+	do(&b)
+	MarshalTstatPkt(&b, 2, 5)
+	do(&b)
+	// NOTAG is only for Tversion, so this isn't run.
+	MarshalTclunkPkt(&b, NOTAG, 2)
+	do(&b)
+
+	want := map[MType][2]uint64{
+		Tversion: {1, 0},
+		Tread:    {2, 0},
+		Tstat:    {1, 1},
+	}
+	check := func(name string, s MetricsSnapshot) {
+		t.Helper()
+		if len(s.Requests) != len(want) {
+			t.Errorf("%s: want %d types of request, got %v", name, len(want), s.Requests)
+		}
+		for typ, w := range want {
+			r := s.Requests[typ]
+			if r.Count != w[0] || r.Errors != w[1] {
+				t.Errorf("%s: %v: want %d, %d errors, got %d, %d errors", name, RPCNames[typ], w[0], w[1], r.Count, r.Errors)
+			}
+			if q := r.Quantile(1); q <= 0 || q > r.Total*2+time.Microsecond {
+				t.Errorf("%s: %v: latency bound %v for a total of %v", name, RPCNames[typ], q, r.Total)
+			}
+		}
+		if s.Rejected != 1 || s.Errors() != 2 {
+			t.Errorf("%s: want 1 rejected, 2 errors in all, got %d, %d", name, s.Rejected, s.Errors())
+		}
+	}
+
+	cm := l.ConnMetrics()
+	if len(cm) != 1 {
+		t.Fatalf("ConnMetrics: want 1 connection, got %d", len(cm))
+	}
+	check("conn", cm[0].MetricsSnapshot)
+	if s := l.Metrics().Snapshot(); s.Conns != 1 || s.Accepted != 1 {
+		t.Errorf("listener: want 1 connection, 1 accepted, got %d, %d", s.Conns, s.Accepted)
+	}
+
+	// Replies are counted once written, which may be just after we
+	// read them, so wait for the connection to be done with.
+	c.Close()
+	var s MetricsSnapshot
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if s = l.Metrics().Snapshot(); s.Conns == 0 {
+			break
+		}
+	}
+	if s.Conns != 0 || s.Accepted != 1 {
+		t.Fatalf("listener: want 0 connections, 1 accepted, got %d, %d", s.Conns, s.Accepted)
+	}
+	check("listener", s)
+	if s.BytesIn != in || s.BytesOut != out {
+		t.Errorf("listener: want %d bytes in, %d out, got %d, %d", in, out, s.BytesIn, s.BytesOut)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	var r RequestMetrics
+	if q := r.Quantile(0.5); q != 0 {
+		t.Errorf("Quantile of nothing: want 0, got %v", q)
+	}
+	r.Latency[0] = 90
+	r.Latency[10] = 10
+	for q, want := range map[float64]time.Duration{
+		0:    time.Microsecond,
+		0.5:  time.Microsecond,
+		0.9:  time.Microsecond,
+		0.95: 1024 * time.Microsecond,
+		1:    1024 * time.Microsecond,
+	} {
+		if got := r.Quantile(q); got != want {
+			t.Errorf("Quantile(%v): want %v, got %v", q, want, got)
+		}
+	}
+}
+
+// This publishes a NetListener's Metrics with expvar, so that they are
+// served as JSON at /debug/vars, along with those of each connection.
+func ExampleMetrics() {
+	l, err := NewNetListener(func() NineServer { return newEcho() })
+	if err != nil {
+		panic(err)
+	}
+	expvar.Publish("ninep", expvar.Func(func() interface{} {
+		s := l.Metrics().Snapshot()
+		byName := make(map[string]RequestMetrics)
+		for t, r := range s.Requests {
+			byName[RPCNames[t]] = r
+		}
+		return map[string]interface{}{
+			"requests": byName,
+			"bytesIn":  s.BytesIn,
+			"bytesOut": s.BytesOut,
+			"errors":   s.Errors(),
+			"conns":    s.Conns,
+			"perConn":  l.ConnMetrics(),
+		}
+	}))
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		panic(err)
+	}
+	go l.Serve(ln)
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a Dispatcher in another, which may look at, change
+// or stand in for what the first does, e.g. to log requests.
+type Middleware func(Dispatcher) Dispatcher
+
+// WithMiddleware returns a NetListenerOpt which wraps the Dispatcher of
+// each of the NetListener's connections in m. The first Middleware
+// given, to the first WithMiddleware, is the outermost.
+func WithMiddleware(m ...Middleware) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.middleware = append(l.middleware, m...)
+		return nil
+	}
+}
+
+// chain wraps d in m, the first outermost.
+func chain(d Dispatcher, m []Middleware) Dispatcher {
+	for i := len(m) - 1; i >= 0; i-- {
+		d = m[i](d)
+	}
+	return d
+}
+
+// Recover returns Middleware which turns a panic, e.g. in a NineServer
+// method, into an Rerror for the request, rather than letting it take
+// down the process. The panic and its stack are logged with logf, or
+// with the log package if logf is nil.
+func Recover(logf func(string, ...interface{})) Middleware {
+	if logf == nil {
+		logf = log.Printf
+	}
+	return func(next Dispatcher) Dispatcher {
+		return func(ctx context.Context, s *Server, b *bytes.Buffer, t MType) (err error) {
+			// The Dispatcher may have read any of b by the time it
+			// panics, so get the tag first.
+			tag := tagOf(b)
+			defer func() {
+				if p := recover(); p != nil {
+					logf("%v: panic: %v\n%s", RPCNames[t], p, debug.Stack())
+					err = fmt.Errorf("%v: server panic: %v", RPCNames[t], p)
+					s.marshalRerror(b, tag, err)
+				}
+			}()
+			return next(ctx, s, b, t)
+		}
+	}
+}
+
+// Stats is Middleware which keeps a Metrics of the requests that go
+// through it, by type: how many, how many failed, and how long they
+// took in the Dispatcher. Only those counters are kept; a NetListener's
+// own Metrics has the bytes and connections too. Its zero value is
+// ready to use, and one Stats may be shared by any number of
+// connections.
+type Stats struct {
+	// Logf, if set, is called with a line for each request.
+	Logf func(string, ...interface{})
+
+	once sync.Once
+	m    *Metrics
+}
+
+// metrics returns s's Metrics, which is allocated on its own, as
+// Metrics must be.
+func (s *Stats) metrics() *Metrics {
+	s.once.Do(func() {
+		s.m = new(Metrics)
+	})
+	return s.m
+}
+
+// Middleware wraps next to keep s.
+func (s *Stats) Middleware(next Dispatcher) Dispatcher {
+	m := s.metrics()
+	return func(ctx context.Context, srv *Server, b *bytes.Buffer, t MType) error {
+		start := time.Now()
+		err := next(ctx, srv, b, t)
+		took := time.Since(start)
+		failed := isError(b.Bytes())
+		m.request(t, took, failed)
+		if s.Logf != nil {
+			s.Logf("%v took %v, error %v", RPCNames[t], took, failed)
+		}
+		return err
+	}
+}
+
+// Snapshot returns what s has counted so far.
+func (s *Stats) Snapshot() MetricsSnapshot {
+	return s.metrics().Snapshot()
+}
+
+// String returns a line for each type of request.
+func (s *Stats) String() string {
+	m := s.Snapshot().Requests
+	var types []int
+	for t := range m {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	var b strings.Builder
+	for _, t := range types {
+		rm := m[MType(t)]
+		fmt.Fprintf(&b, "%v: %d requests, %d errors, mean %v, 99%% under %v\n",
+			RPCNames[MType(t)], rm.Count, rm.Errors, rm.Mean(), rm.Quantile(0.99))
+	}
+	return b.String()
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Each message a conn reads goes in a buffer from bufPool, and its
+// reply is marshaled into the same buffer, which goes back to the pool
+// once the reply is written. Other replies, e.g. Rerrors for requests
+// which are refused, get buffers from the pool too. So once a server is
+// warmed up, reading and answering a message allocates no buffers.
+var bufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// maxPooledBuffer is the biggest buffer kept in the pool: enough for
+// the msize Linux asks for. Bigger ones are left to the garbage
+// collector, so one client with a huge msize doesn't leave the pool
+// full of them.
+const maxPooledBuffer = 1<<20 + IOHDRSZ
+
+// getBuf returns an empty buffer with room for n bytes.
+func getBuf(n int) *bytes.Buffer {
+	b := bufPool.Get().(*bytes.Buffer)
+	b.Reset()
+	b.Grow(n)
+	return b
+}
+
+// putBuf returns b to the pool. Nothing may use b, or any slice of
+// its contents, afterwards.
+func putBuf(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBuffer {
+		return
+	}
+	bufPool.Put(b)
+}
@@ -4,7 +4,10 @@
 
 package protocol
 
-import "bytes"
+import (
+	"bytes"
+	"context"
+)
 
 // 9P2000 message types
 const (
@@ -39,6 +42,52 @@ const (
 	Tlast
 )
 
+// 9P2000.L message types. They are numbered below the 9P2000 ones,
+// which 9P2000.L keeps, other than Terror, Topen, Tcreate, Tstat and
+// Twstat.
+const (
+	Tlerror      MType = 6
+	Rlerror      MType = 7
+	Tstatfs      MType = 8
+	Rstatfs      MType = 9
+	Tlopen       MType = 12
+	Rlopen       MType = 13
+	Tlcreate     MType = 14
+	Rlcreate     MType = 15
+	Tsymlink     MType = 16
+	Rsymlink     MType = 17
+	Tmknod       MType = 18
+	Rmknod       MType = 19
+	Trename      MType = 20
+	Rrename      MType = 21
+	Treadlink    MType = 22
+	Rreadlink    MType = 23
+	Tgetattr     MType = 24
+	Rgetattr     MType = 25
+	Tsetattr     MType = 26
+	Rsetattr     MType = 27
+	Txattrwalk   MType = 30
+	Rxattrwalk   MType = 31
+	Txattrcreate MType = 32
+	Rxattrcreate MType = 33
+	Treaddir     MType = 40
+	Rreaddir     MType = 41
+	Tfsync       MType = 50
+	Rfsync       MType = 51
+	Tlock        MType = 52
+	Rlock        MType = 53
+	Tgetlock     MType = 54
+	Rgetlock     MType = 55
+	Tlink        MType = 70
+	Rlink        MType = 71
+	Tmkdir       MType = 72
+	Rmkdir       MType = 73
+	Trenameat    MType = 74
+	Rrenameat    MType = 75
+	Tunlinkat    MType = 76
+	Runlinkat    MType = 77
+)
+
 const (
 	MSIZE   = 2*1048576 + IOHDRSZ // default message size (1048576+IOHdrSz)
 	IOHDRSZ = 24                  // the non-data size of the Twrite messages
@@ -100,10 +149,20 @@ const (
 	EPERM   = 1
 	ENOENT  = 2
 	EIO     = 5
+	EBADF   = 9
+	EAGAIN  = 11
 	EACCES  = 13
 	EEXIST  = 17
 	ENOTDIR = 20
+	EISDIR  = 21
 	EINVAL  = 22
+	ENOSPC  = 28
+	EROFS   = 30
+
+	ENOTEMPTY = 39  // as on Linux
+	ETIMEDOUT = 110 // as on Linux
+
+	EOPNOTSUPP = 95 // as on Linux; sent for messages a server doesn't implement
 )
 
 // Types contained in 9p messages.
@@ -125,9 +184,11 @@ type (
 	DataCnt16 byte // []byte with a 16-bit count.
 )
 
-// Error represents a 9P2000 error
+// Error represents a 9P2000 error: the string an Rerror carries, and
+// the errno a 9P2000.u Rerror or a 9P2000.L Rlerror carries.
 type Error struct {
-	Err string
+	Err   string
+	Errno uint32
 }
 
 // File identifier
@@ -152,7 +213,94 @@ type Dir struct {
 	ModUser string // name of the last user that modified the file
 }
 
-type Dispatcher func(s *Server, b *bytes.Buffer, t MType) error
+// Statfs describes a file system, in the form of a 9P2000.L Rstatfs.
+type Statfs struct {
+	Type    uint32 // type of file system
+	BSize   uint32 // optimal transfer block size
+	Blocks  uint64 // total data blocks in file system
+	BFree   uint64 // free blocks in file system
+	BAvail  uint64 // free blocks available to unprivileged users
+	Files   uint64 // total file nodes in file system
+	FFree   uint64 // free file nodes in file system
+	FSID    uint64 // file system id
+	NameLen uint32 // maximum length of filenames
+}
+
+// Bits in the mask of Tgetattr, and the valid field of Attr, which say
+// which attributes are wanted, or were returned.
+const (
+	GetattrMode        = 0x00000001
+	GetattrNLink       = 0x00000002
+	GetattrUID         = 0x00000004
+	GetattrGID         = 0x00000008
+	GetattrRDev        = 0x00000010
+	GetattrATime       = 0x00000020
+	GetattrMTime       = 0x00000040
+	GetattrCTime       = 0x00000080
+	GetattrIno         = 0x00000100
+	GetattrSize        = 0x00000200
+	GetattrBlocks      = 0x00000400
+	GetattrBTime       = 0x00000800
+	GetattrGen         = 0x00001000
+	GetattrDataVersion = 0x00002000
+	GetattrBasic       = 0x000007ff // everything stat(2) returns
+	GetattrAll         = 0x00003fff
+)
+
+// Attr holds the attributes of a file, in the form of a 9P2000.L Rgetattr.
+// Mode is a Unix mode, including the file type, not a 9P one.
+type Attr struct {
+	Valid       uint64 // Getattr bits for the fields that are filled in
+	QID         QID
+	Mode        uint32
+	UID         uint32
+	GID         uint32
+	NLink       uint64
+	RDev        uint64
+	Size        uint64
+	BlkSize     uint64
+	Blocks      uint64
+	ATimeSec    uint64
+	ATimeNSec   uint64
+	MTimeSec    uint64
+	MTimeNSec   uint64
+	CTimeSec    uint64
+	CTimeNSec   uint64
+	BTimeSec    uint64 // reserved for future use
+	BTimeNSec   uint64
+	Gen         uint64
+	DataVersion uint64
+}
+
+// Bits in the valid field of SetAttr, which say which attributes to set.
+const (
+	SetattrMode     = 0x00000001
+	SetattrUID      = 0x00000002
+	SetattrGID      = 0x00000004
+	SetattrSize     = 0x00000008
+	SetattrATime    = 0x00000010 // set the atime, to now unless SetattrATimeSet
+	SetattrMTime    = 0x00000020 // set the mtime, to now unless SetattrMTimeSet
+	SetattrCTime    = 0x00000040
+	SetattrATimeSet = 0x00000080 // the atime is in ATimeSec and ATimeNSec
+	SetattrMTimeSet = 0x00000100 // the mtime is in MTimeSec and MTimeNSec
+)
+
+// SetAttr holds the attributes to change in a 9P2000.L Tsetattr.
+type SetAttr struct {
+	Valid     uint32
+	Mode      uint32
+	UID       uint32
+	GID       uint32
+	Size      uint64
+	ATimeSec  uint64
+	ATimeNSec uint64
+	MTimeSec  uint64
+	MTimeNSec uint64
+}
+
+// A Dispatcher handles one request. ctx is cancelled if the request
+// is flushed or the connection goes away.
+type Dispatcher func(ctx context.Context, s *Server, b *bytes.Buffer, t MType) error
 
 // N.B. In all packets, the wire order is assumed to be the order in which you
 // put struct members.
@@ -172,6 +320,16 @@ type RversionPkt struct {
 	RVersion string
 }
 
+type TauthPkt struct {
+	AFID  FID
+	Uname string
+	Aname string
+}
+
+type RauthPkt struct {
+	AQID QID
+}
+
 type TattachPkt struct {
 	SFID  FID
 	AFID  FID
@@ -280,13 +438,228 @@ type DirPkt struct {
 	D Dir
 }
 
+// 9P2000.L messages.
+
+type RlerrorPkt struct {
+	Ecode uint32
+}
+
+type TstatfsPkt struct {
+	SFID FID
+}
+
+type RstatfsPkt struct {
+	S Statfs
+}
+
+type TlopenPkt struct {
+	OFID   FID
+	OFlags uint32
+}
+
+type RlopenPkt struct {
+	OQID    QID
+	OIOUnit MaxSize
+}
+
+type TlcreatePkt struct {
+	CFID   FID
+	CName  string
+	CFlags uint32
+	CMode  uint32
+	CGID   uint32
+}
+
+type RlcreatePkt struct {
+	CQID    QID
+	CIOUnit MaxSize
+}
+
+type TsymlinkPkt struct {
+	SDFID  FID
+	SName  string
+	Target string
+	SGID   uint32
+}
+
+type RsymlinkPkt struct {
+	SQID QID
+}
+
+type TmknodPkt struct {
+	NDFID FID
+	NName string
+	NMode uint32
+	Major uint32
+	Minor uint32
+	NGID  uint32
+}
+
+type RmknodPkt struct {
+	NQID QID
+}
+
+type TrenamePkt struct {
+	RFID  FID
+	RDFID FID
+	RName string
+}
+
+type RrenamePkt struct {
+}
+
+type TreadlinkPkt struct {
+	LFID FID
+}
+
+type RreadlinkPkt struct {
+	LTarget string
+}
+
+type TgetattrPkt struct {
+	GFID FID
+	Mask uint64
+}
+
+type RgetattrPkt struct {
+	A Attr
+}
+
+type TsetattrPkt struct {
+	SFID FID
+	SA   SetAttr
+}
+
+type RsetattrPkt struct {
+}
+
+type TxattrwalkPkt struct {
+	XFID    FID
+	XNewFID FID
+	XName   string
+}
+
+type RxattrwalkPkt struct {
+	XSize uint64
+}
+
+type TxattrcreatePkt struct {
+	XFID   FID
+	XName  string
+	XSize  uint64
+	XFlags uint32
+}
+
+type RxattrcreatePkt struct {
+}
+
+type TreaddirPkt struct {
+	DFID    FID
+	DOffset Offset
+	DCount  Count
+}
+
+type RreaddirPkt struct {
+	Entries []byte
+}
+
+type TfsyncPkt struct {
+	FFID     FID
+	Datasync uint32
+}
+
+type RfsyncPkt struct {
+}
+
+type TlockPkt struct {
+	LFID      FID
+	LType     uint8
+	LFlags    uint32
+	LStart    uint64
+	LLength   uint64
+	LProcID   uint32
+	LClientID string
+}
+
+type RlockPkt struct {
+	Status uint8
+}
+
+type TgetlockPkt struct {
+	GFID      FID
+	GType     uint8
+	GStart    uint64
+	GLength   uint64
+	GProcID   uint32
+	GClientID string
+}
+
+type RgetlockPkt struct {
+	RType     uint8
+	RStart    uint64
+	RLength   uint64
+	RProcID   uint32
+	RClientID string
+}
+
+type TlinkPkt struct {
+	LDFID FID
+	LFID  FID
+	LName string
+}
+
+type RlinkPkt struct {
+}
+
+type TmkdirPkt struct {
+	MDFID FID
+	MName string
+	MMode uint32
+	MGID  uint32
+}
+
+type RmkdirPkt struct {
+	MQID QID
+}
+
+type TrenameatPkt struct {
+	OldDFID FID
+	OldName string
+	NewDFID FID
+	NewName string
+}
+
+type RrenameatPkt struct {
+}
+
+type TunlinkatPkt struct {
+	UDFID  FID
+	UName  string
+	UFlags uint32
+}
+
+type RunlinkatPkt struct {
+}
+
 type RPCCall struct {
 	b     []byte
 	Reply chan []byte
+
+	// sent, if set, is told the tag the call was sent with.
+	sent chan Tag
 }
 
 type RPCReply struct {
 	b []byte
+
+	// buf, if set, is the pooled buffer holding b, to go back to the
+	// pool once b has been written.
+	buf *bytes.Buffer
+
+	// body, for a streamed Rread, is the data to write after b.
+	// written is closed once it has been.
+	body    replyBody
+	written chan struct{}
 }
 
 /* rpc servers */
@@ -294,19 +667,65 @@ type ClientOpt func(*Client) error
 type NetListenerOpt func(*NetListener) error
 type Tracer func(string, ...interface{})
 
+// NineServer is implemented by 9p file servers. The context passed to
+// each method is cancelled when the request is flushed or the connection
+// is closed; methods which may block for a long time should watch it.
+// The []byte passed to Rwrite and Rwstat is part of the buffer the
+// message was read into, which is reused once the reply is written, so
+// it must not be kept after the method returns.
 type NineServer interface {
-	Rversion(MaxSize, string) (MaxSize, string, error)
-	Rattach(FID, FID, string, string) (QID, error)
-	Rwalk(FID, FID, []string) ([]QID, error)
-	Ropen(FID, Mode) (QID, MaxSize, error)
-	Rcreate(FID, string, Perm, Mode) (QID, MaxSize, error)
-	Rstat(FID) ([]byte, error)
-	Rwstat(FID, []byte) error
-	Rclunk(FID) error
-	Rremove(FID) error
-	Rread(FID, Offset, Count) ([]byte, error)
-	Rwrite(FID, Offset, []byte) (Count, error)
-	Rflush(Otag Tag) error
+	Rversion(context.Context, MaxSize, string) (MaxSize, string, error)
+	Rattach(context.Context, FID, FID, string, string) (QID, error)
+	Rwalk(context.Context, FID, FID, []string) ([]QID, error)
+	Ropen(context.Context, FID, Mode) (QID, MaxSize, error)
+	Rcreate(context.Context, FID, string, Perm, Mode) (QID, MaxSize, error)
+	Rstat(context.Context, FID) ([]byte, error)
+	Rwstat(context.Context, FID, []byte) error
+	Rclunk(context.Context, FID) error
+	Rremove(context.Context, FID) error
+	Rread(context.Context, FID, Offset, Count) ([]byte, error)
+	Rwrite(context.Context, FID, Offset, []byte) (Count, error)
+	Rflush(ctx context.Context, Otag Tag) error
+}
+
+// A ReadIntoNineServer reads straight into the buffer its Rread reply
+// is marshaled in, saving the copy of the []byte Rread returns. If a
+// server has RreadInto, it is called for Tread rather than Rread. It
+// reads up to len(b) bytes from fid at o, and returns how many it read.
+// Like the []byte given to Rwrite, b must not be kept.
+type ReadIntoNineServer interface {
+	RreadInto(ctx context.Context, fid FID, o Offset, b []byte) (int, error)
+}
+
+// An AuthNineServer requires clients to authenticate before they
+// attach. Rauth sets up afid for an authentication exchange between
+// uname and the server, for access to aname, and returns its QID, which
+// must have QTAUTH set. The client then reads and writes afid, through
+// the server's usual Rread and Rwrite, for as long as the protocol
+// takes, and presents afid in its Tattach; it is Rattach's job to check
+// that the exchange was completed; a Tattach naming any afid other
+// than NOFID or one set up by Tauth never gets that far.
+// Tauth to servers which don't implement it gets an error, and the
+// afid in their Tattach is passed along unchecked, as it always was.
+type AuthNineServer interface {
+	Rauth(ctx context.Context, afid FID, uname, aname string) (QID, error)
+}
+
+// A StatfsNineServer can describe the file system holding a FID,
+// for clients which want to know sizes and free space, e.g. for df.
+// It is optional: it serves the 9P2000.L Tstatfs message.
+type StatfsNineServer interface {
+	Rstatfs(context.Context, FID) (Statfs, error)
+}
+
+// A ClosingNineServer is told when its connection is done with, so
+// that it can let go of what the connection's FIDs hold, e.g. open
+// files. ConnClosed is called once, after the last request on the
+// connection has finished, however the connection ended: the client
+// hung up or vanished, it was idle too long, or the listener was shut
+// down. Nothing else is called after it.
+type ClosingNineServer interface {
+	ConnClosed()
 }
 
 var (
@@ -339,5 +758,46 @@ var (
 		Rstat:    "Rstat",
 		Twstat:   "Twstat",
 		Rwstat:   "Rwstat",
+
+		Tlerror:      "Tlerror",
+		Rlerror:      "Rlerror",
+		Tstatfs:      "Tstatfs",
+		Rstatfs:      "Rstatfs",
+		Tlopen:       "Tlopen",
+		Rlopen:       "Rlopen",
+		Tlcreate:     "Tlcreate",
+		Rlcreate:     "Rlcreate",
+		Tsymlink:     "Tsymlink",
+		Rsymlink:     "Rsymlink",
+		Tmknod:       "Tmknod",
+		Rmknod:       "Rmknod",
+		Trename:      "Trename",
+		Rrename:      "Rrename",
+		Treadlink:    "Treadlink",
+		Rreadlink:    "Rreadlink",
+		Tgetattr:     "Tgetattr",
+		Rgetattr:     "Rgetattr",
+		Tsetattr:     "Tsetattr",
+		Rsetattr:     "Rsetattr",
+		Txattrwalk:   "Txattrwalk",
+		Rxattrwalk:   "Rxattrwalk",
+		Txattrcreate: "Txattrcreate",
+		Rxattrcreate: "Rxattrcreate",
+		Treaddir:     "Treaddir",
+		Rreaddir:     "Rreaddir",
+		Tfsync:       "Tfsync",
+		Rfsync:       "Rfsync",
+		Tlock:        "Tlock",
+		Rlock:        "Rlock",
+		Tgetlock:     "Tgetlock",
+		Rgetlock:     "Rgetlock",
+		Tlink:        "Tlink",
+		Rlink:        "Rlink",
+		Tmkdir:       "Tmkdir",
+		Rmkdir:       "Rmkdir",
+		Trenameat:    "Trenameat",
+		Rrenameat:    "Rrenameat",
+		Tunlinkat:    "Tunlinkat",
+		Runlinkat:    "Runlinkat",
 	}
 )
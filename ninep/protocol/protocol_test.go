@@ -6,11 +6,15 @@ package protocol
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -215,18 +219,18 @@ type echo struct {
 	qids map[FID]QID
 }
 
-func (e *echo) Rversion(msize MaxSize, version string) (MaxSize, string, error) {
+func (e *echo) Rversion(ctx context.Context, msize MaxSize, version string) (MaxSize, string, error) {
 	if version != "9P2000" {
 		return 0, "", fmt.Errorf("%v not supported; only 9P2000", version)
 	}
 	return msize, version, nil
 }
 
-func (e *echo) Rattach(FID, FID, string, string) (QID, error) {
+func (e *echo) Rattach(ctx context.Context, fid FID, afid FID, uname string, aname string) (QID, error) {
 	return QID{}, nil
 }
 
-func (e *echo) Rflush(o Tag) error {
+func (e *echo) Rflush(ctx context.Context, o Tag) error {
 	switch o {
 	case 3:
 		// Make it fancier, later.
@@ -235,9 +239,9 @@ func (e *echo) Rflush(o Tag) error {
 	return fmt.Errorf("Rflush: bad Tag %v", o)
 }
 
-func (e *echo) Rwalk(fid FID, newfid FID, paths []string) ([]QID, error) {
+func (e *echo) Rwalk(ctx context.Context, fid FID, newfid FID, paths []string) ([]QID, error) {
 	//fmt.Printf("walk(%d, %d, %d, %v\n", fid, newfid, len(paths), paths)
-	if len(paths) > 1 {
+	if len(paths) != 1 {
 		return nil, nil
 	}
 	switch paths[0] {
@@ -247,15 +251,15 @@ func (e *echo) Rwalk(fid FID, newfid FID, paths []string) ([]QID, error) {
 	return nil, nil
 }
 
-func (e *echo) Ropen(fid FID, mode Mode) (QID, MaxSize, error) {
+func (e *echo) Ropen(ctx context.Context, fid FID, mode Mode) (QID, MaxSize, error) {
 	//fmt.Printf("open(%v, %v\n", fid, mode)
 	return QID{}, 4000, nil
 }
-func (e *echo) Rcreate(fid FID, name string, perm Perm, mode Mode) (QID, MaxSize, error) {
+func (e *echo) Rcreate(ctx context.Context, fid FID, name string, perm Perm, mode Mode) (QID, MaxSize, error) {
 	//fmt.Printf("open(%v, %v\n", fid, mode)
 	return QID{}, 5000, nil
 }
-func (e *echo) Rclunk(f FID) error {
+func (e *echo) Rclunk(ctx context.Context, f FID) error {
 	switch int(f) {
 	case 2:
 		// Make it fancier, later.
@@ -267,7 +271,7 @@ func (e *echo) Rclunk(f FID) error {
 	//fmt.Printf("clunk(%v)\n", f)
 	return fmt.Errorf("Clunk: bad FID %v", f)
 }
-func (e *echo) Rstat(f FID) ([]byte, error) {
+func (e *echo) Rstat(ctx context.Context, f FID) ([]byte, error) {
 	switch int(f) {
 	case 2:
 		// Make it fancier, later.
@@ -276,7 +280,7 @@ func (e *echo) Rstat(f FID) ([]byte, error) {
 	//fmt.Printf("stat(%v)\n", f)
 	return []byte{}, fmt.Errorf("Stat: bad FID %v", f)
 }
-func (e *echo) Rwstat(f FID, s []byte) error {
+func (e *echo) Rwstat(ctx context.Context, f FID, s []byte) error {
 	switch int(f) {
 	case 2:
 		// Make it fancier, later.
@@ -285,7 +289,7 @@ func (e *echo) Rwstat(f FID, s []byte) error {
 	//fmt.Printf("stat(%v)\n", f)y
 	return fmt.Errorf("Wstat: bad FID %v", f)
 }
-func (e *echo) Rremove(f FID) error {
+func (e *echo) Rremove(ctx context.Context, f FID) error {
 	switch int(f) {
 	case 2:
 		// Make it fancier, later.
@@ -295,7 +299,7 @@ func (e *echo) Rremove(f FID) error {
 	//fmt.Printf("remove(%v)\n", f)
 	return fmt.Errorf("Remove: bad FID %v", f)
 }
-func (e *echo) Rread(f FID, o Offset, c Count) ([]byte, error) {
+func (e *echo) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
 	switch int(f) {
 	case 2:
 		// Make it fancier, later.
@@ -304,7 +308,7 @@ func (e *echo) Rread(f FID, o Offset, c Count) ([]byte, error) {
 	return nil, fmt.Errorf("Read: bad FID %v", f)
 }
 
-func (e *echo) Rwrite(f FID, o Offset, b []byte) (Count, error) {
+func (e *echo) Rwrite(ctx context.Context, f FID, o Offset, b []byte) (Count, error) {
 	switch int(f) {
 	case 2:
 		// Make it fancier, later.
@@ -401,10 +405,9 @@ func TestTMessages(t *testing.T) {
 	t.Logf("CallTattach: wanted an error and got %v", err)
 
 	m, v, err := c.CallTversion(8000, "9p3000")
-	if err == nil {
-		t.Fatalf("CallTversion: want err, got nil")
+	if err != nil || v != VersionUnknown {
+		t.Fatalf("CallTversion: want (%v, nil), got (%v, %v)", VersionUnknown, v, err)
 	}
-	t.Logf("CallTversion: wanted an error and got %v", err)
 
 	m, v, err = c.CallTversion(8000, "9P2000")
 	if err != nil {
@@ -497,6 +500,21 @@ func TestTMessages(t *testing.T) {
 }
 
 func BenchmarkNull(b *testing.B) {
+	benchmarkNull(b)
+}
+
+func BenchmarkNullTracingDisabled(b *testing.B) {
+	benchmarkNull(b, WithTracingDisabled())
+}
+
+// A Logger which only wants LevelInfo costs a request no more than no
+// Logger at all: BenchmarkNullQuietLogger should allocate no more than
+// BenchmarkNullTracingDisabled.
+func BenchmarkNullQuietLogger(b *testing.B) {
+	benchmarkNull(b, WithLogger(LevelTracer{Trace: func(string, ...interface{}) {}, Level: LevelInfo}))
+}
+
+func benchmarkNull(b *testing.B, opts ...NetListenerOpt) {
 	p, p2 := net.Pipe()
 
 	c, err := NewClient(func(c *Client) error {
@@ -515,7 +533,7 @@ func BenchmarkNull(b *testing.B) {
 	s, err := NewNetListener(
 		func() NineServer {
 			return newEcho()
-		})
+		}, opts...)
 
 	if err != nil {
 		b.Fatalf("NewServer: want nil, got %v", err)
@@ -525,7 +543,13 @@ func BenchmarkNull(b *testing.B) {
 		b.Fatalf("Accept: want nil, got %v", err)
 	}
 
+	if _, _, err := c.CallTversion(8000, "9P2000"); err != nil {
+		b.Fatalf("CallTversion: want nil, got %v", err)
+	}
+
 	b.Logf("%d iterations", b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		if _, err := c.CallTread(FID(2), 0, 5); err != nil {
 			b.Fatalf("CallTread: want nil, got %v", err)
@@ -533,3 +557,470 @@ func BenchmarkNull(b *testing.B) {
 	}
 
 }
+
+// bench is an echo server which reads like a file server: reads on
+// bigFID are of a file's contents.
+type bench struct {
+	*echo
+	file []byte
+}
+
+func (s *bench) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
+	if f != bigFID {
+		return s.echo.Rread(ctx, f, o, c)
+	}
+	b := make([]byte, c)
+	return b[:copy(b, s.file)], nil
+}
+
+func (s *bench) RreadInto(ctx context.Context, f FID, o Offset, b []byte) (int, error) {
+	if f != bigFID {
+		d, err := s.echo.Rread(ctx, f, o, Count(len(b)))
+		return copy(b, d), err
+	}
+	return copy(b, s.file), nil
+}
+
+// benchMsize has room for 8k of data in a Tread or Twrite.
+const benchMsize = 8192 + IOHDRSZ
+
+// benchRPC runs the request in req b.N times on a conn to a bench
+// server, and checks each reply is of type want. n is the number of
+// bytes of data each carries.
+func benchRPC(b *testing.B, req *bytes.Buffer, want MType, n int64) {
+	s := &bench{echo: newEcho(), file: make([]byte, 8192)}
+	l, err := NewNetListener(func() NineServer { return s }, WithTracingDisabled())
+	if err != nil {
+		b.Fatalf("NewNetListener: %v", err)
+	}
+	c, p := net.Pipe()
+	defer c.Close()
+	if err := l.Accept(p); err != nil {
+		b.Fatalf("Accept: %v", err)
+	}
+	r := make([]byte, benchMsize)
+	var v bytes.Buffer
+	MarshalTversionPkt(&v, NOTAG, benchMsize, "9P2000")
+	if _, err := c.Write(v.Bytes()); err != nil {
+		b.Fatalf("Write Tversion: %v", err)
+	}
+	if _, err := io.ReadAtLeast(c, r, 7); err != nil {
+		b.Fatalf("Read Rversion: %v", err)
+	}
+
+	m := req.Bytes()
+	b.SetBytes(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(m); err != nil {
+			b.Fatalf("Write: %v", err)
+		}
+		if _, err := io.ReadFull(c, r[:7]); err != nil {
+			b.Fatalf("reading reply header: %v", err)
+		}
+		sz := int(r[0]) | int(r[1])<<8 | int(r[2])<<16 | int(r[3])<<24
+		if _, err := io.ReadFull(c, r[7:sz]); err != nil {
+			b.Fatalf("reading reply body: %v", err)
+		}
+		if MType(r[4]) != want {
+			b.Fatalf("reply: want %v, got %v", RPCNames[want], RPCNames[MType(r[4])])
+		}
+	}
+}
+
+func BenchmarkTwalk(b *testing.B) {
+	var req bytes.Buffer
+	MarshalTwalkPkt(&req, 1, 1, 2, []string{"null"})
+	benchRPC(b, &req, Rwalk, 0)
+}
+
+func BenchmarkTread8k(b *testing.B) {
+	var req bytes.Buffer
+	MarshalTreadPkt(&req, 1, bigFID, 0, 8192)
+	benchRPC(b, &req, Rread, 8192)
+}
+
+func BenchmarkTwrite8k(b *testing.B) {
+	var req bytes.Buffer
+	MarshalTwritePkt(&req, 1, 2, 0, make([]byte, 8192))
+	benchRPC(b, &req, Rwrite, 8192)
+}
+
+func TestDial(t *testing.T) {
+	s, err := NewNetListener(func() NineServer { return newEcho() })
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	down := fmt.Errorf("server is down")
+	var dials, failures int
+	dial := func() (net.Conn, error) {
+		if dials++; dials%3 != 0 {
+			return nil, down
+		}
+		p, p2 := net.Pipe()
+		if err := s.Accept(p2); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	b := Backoff{
+		Max: 20 * time.Millisecond,
+		Notify: func(attempt int, err error) {
+			if err != down {
+				t.Errorf("Notify: want %v, got %v", down, err)
+			}
+			failures++
+		},
+	}
+	setMsize := func(c *Client) error {
+		c.Msize = 8192
+		return nil
+	}
+
+	c, err := Dial(dial, b, setMsize)
+	if err != nil {
+		t.Fatalf("Dial: want nil, got %v", err)
+	}
+	if dials != 3 || failures != 2 {
+		t.Errorf("Dial: want 3 dials and 2 failures, got %d and %d", dials, failures)
+	}
+	if _, _, err := c.CallTversion(8000, "9P2000"); err != nil {
+		t.Fatalf("CallTversion: want nil, got %v", err)
+	}
+
+	c2, err := c.Redial()
+	if err != nil {
+		t.Fatalf("Redial: want nil, got %v", err)
+	}
+	if c2.Msize != 8192 {
+		t.Errorf("Redial: want Msize 8192, got %v", c2.Msize)
+	}
+	if _, _, err := c2.CallTversion(8000, "9P2000"); err != nil {
+		t.Fatalf("CallTversion after Redial: want nil, got %v", err)
+	}
+
+	// Give up after two attempts, with the last error.
+	dials = 0
+	dial = func() (net.Conn, error) {
+		dials++
+		return nil, fmt.Errorf("attempt %d", dials)
+	}
+	if _, err := Dial(dial, Backoff{Attempts: 2}); err == nil || err.Error() != "attempt 2" || dials != 2 {
+		t.Errorf("Dial to a dead server: want (attempt 2) after 2 dials, got (%v) after %d", err, dials)
+	}
+
+	if _, err := (&Client{}).Redial(); err == nil {
+		t.Errorf("Redial of a client not made by Dial: want err, got nil")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Max: 20 * time.Millisecond}
+	for _, tt := range []struct {
+		n        int
+		min, max time.Duration
+	}{
+		{1, 2500 * time.Microsecond, 5 * time.Millisecond},
+		{2, 5 * time.Millisecond, 10 * time.Millisecond},
+		{3, 10 * time.Millisecond, 20 * time.Millisecond},
+		{4, 10 * time.Millisecond, 20 * time.Millisecond},
+		{100, 10 * time.Millisecond, 20 * time.Millisecond},
+	} {
+		for i := 0; i < 10; i++ {
+			if d := b.Delay(tt.n); d < tt.min || d > tt.max {
+				t.Errorf("Delay(%d): want between %v and %v, got %v", tt.n, tt.min, tt.max, d)
+			}
+		}
+	}
+}
+
+// rooted is an echo server which records attaches and walks, and
+// walks anywhere.
+type rooted struct {
+	*echo
+
+	mu      sync.Mutex
+	attachs []string
+	walks   []string
+}
+
+func (r *rooted) Rattach(ctx context.Context, fid FID, afid FID, uname string, aname string) (QID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attachs = append(r.attachs, fmt.Sprintf("%d %s %s", fid, uname, aname))
+	return QID{Type: QTDIR}, nil
+}
+
+func (r *rooted) Rwalk(ctx context.Context, fid FID, newfid FID, paths []string) ([]QID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.walks = append(r.walks, fmt.Sprintf("%d %v", fid, paths))
+	return make([]QID, len(paths)), nil
+}
+
+func (r *rooted) get() ([]string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, w := r.attachs, r.walks
+	r.attachs, r.walks = nil, nil
+	return a, w
+}
+
+func TestAttach(t *testing.T) {
+	r := &rooted{echo: newEcho()}
+	s, err := NewNetListener(func() NineServer { return r })
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	dial := func() (net.Conn, error) {
+		p, p2 := net.Pipe()
+		if err := s.Accept(p2); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	c, err := Dial(dial, Backoff{})
+	if err != nil {
+		t.Fatalf("Dial: want nil, got %v", err)
+	}
+	if root := c.Root(); root != NOFID {
+		t.Errorf("Root before Attach: want NOFID, got %v", root)
+	}
+	if _, _, err := c.Walk("a"); err == nil {
+		t.Errorf("Walk before Attach: want err, got nil")
+	}
+	if q, err := c.Attach(8192, "9P2000", "glenda", "main"); err != nil || q.Type != QTDIR {
+		t.Fatalf("Attach: want (a directory, nil), got (%v, %v)", q, err)
+	}
+	root := c.Root()
+
+	// Every walk starts from the one root, absolute or not.
+	seen := map[FID]bool{root: true}
+	for _, path := range []string{"/a/b", "a/b", ""} {
+		fid, q, err := c.Walk(path)
+		if err != nil || seen[fid] {
+			t.Errorf("Walk(%q): want a new FID, got (%v, %v, %v)", path, fid, q, err)
+		}
+		seen[fid] = true
+	}
+	attachs, walks := r.get()
+	want := []string{fmt.Sprintf("%d [a b]", root), fmt.Sprintf("%d [a b]", root), fmt.Sprintf("%d []", root)}
+	if len(attachs) != 1 || fmt.Sprint(walks) != fmt.Sprint(want) {
+		t.Errorf("Walks: want one attach and walks %q, got %q and %q", want, attachs, walks)
+	}
+
+	// A new connection gets a root of its own, attached as before.
+	c2, err := c.Redial()
+	if err != nil {
+		t.Fatalf("Redial: want nil, got %v", err)
+	}
+	root2 := c2.Root()
+	if root2 == NOFID {
+		t.Fatalf("Root after Redial: want a FID, got NOFID")
+	}
+	if _, _, err := c2.Walk("/c"); err != nil {
+		t.Errorf("Walk after Redial: want nil, got %v", err)
+	}
+	attachs, walks = r.get()
+	if a := fmt.Sprintf("%d glenda main", root2); len(attachs) != 1 || attachs[0] != a || fmt.Sprint(walks) != fmt.Sprintf("[%d [c]]", root2) {
+		t.Errorf("Redial: want attach %q and a walk from it, got %q and %q", a, attachs, walks)
+	}
+}
+
+func TestTryRead(t *testing.T) {
+	p, p2 := net.Pipe()
+	defer p.Close()
+	c, err := NewClient(func(c *Client) error {
+		c.FromNet, c.ToNet = p, p
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewClient: want nil, got %v", err)
+	}
+	s := newSlow()
+	l, err := NewNetListener(func() NineServer { return s })
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	if err := l.Accept(p2); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	if _, _, err := c.CallTversion(8192, Version); err != nil {
+		t.Fatalf("CallTversion: want nil, got %v", err)
+	}
+
+	tags := len(c.Tags)
+	if b, err := c.TryRead(context.Background(), 2, 0, 10); err != nil || string(b) != "HI" {
+		t.Errorf("TryRead: want (HI, nil), got (%q, %v)", b, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.TryRead(ctx, slowFID, 0, 5); err != ErrWouldBlock {
+		t.Errorf("TryRead of a slow file: want %v, got %v", ErrWouldBlock, err)
+	}
+	// The read went to the server, and was flushed there before
+	// TryRead returned, with its tag back for the next one.
+	<-s.started
+	if fmt.Sprint(s.ops) != "[cancelled]" {
+		t.Errorf("TryRead of a slow file: want the read flushed, got %v", s.ops)
+	}
+	if len(c.Tags) != tags {
+		t.Errorf("TryRead of a slow file: want %d tags free, got %d", tags, len(c.Tags))
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-s.started
+		cancel()
+	}()
+	if _, err := c.TryRead(ctx, slowFID, 0, 5); err != context.Canceled {
+		t.Errorf("TryRead cancelled: want %v, got %v", context.Canceled, err)
+	}
+	if b, err := c.TryRead(context.Background(), 2, 0, 10); err != nil || string(b) != "HI" {
+		t.Errorf("TryRead after a flush: want (HI, nil), got (%q, %v)", b, err)
+	}
+	if _, err := c.TryRead(context.Background(), 5, 0, 10); err == nil || err == ErrWouldBlock {
+		t.Errorf("TryRead of a bad fid: want the server's error, got %v", err)
+	}
+	if len(c.Tags) != tags {
+		t.Errorf("TryRead: want %d tags free, got %d", tags, len(c.Tags))
+	}
+}
+
+// sized is a slow server which notes the size of each read asked for,
+// and each write.
+type sized struct {
+	*slow
+	mu     sync.Mutex
+	reads  []int
+	writes []int
+}
+
+func (s *sized) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
+	s.mu.Lock()
+	s.reads = append(s.reads, int(c))
+	s.mu.Unlock()
+	return s.slow.Rread(ctx, f, o, c)
+}
+
+func (s *sized) Rwrite(ctx context.Context, f FID, o Offset, b []byte) (Count, error) {
+	s.mu.Lock()
+	s.writes = append(s.writes, len(b))
+	s.mu.Unlock()
+	return s.slow.Rwrite(ctx, f, o, b)
+}
+
+func TestClientMsize(t *testing.T) {
+	p, p2 := net.Pipe()
+	c, err := NewClient(func(c *Client) error {
+		c.FromNet, c.ToNet = p, p
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewClient: want nil, got %v", err)
+	}
+	s := &sized{slow: newSlow()}
+	l, err := NewNetListener(func() NineServer { return s })
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	if err := l.Accept(p2); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	if _, _, err := c.CallTversion(8192, Version); err != nil || c.Msize != 8192 {
+		t.Fatalf("CallTversion: want msize 8192, got %d, %v", c.Msize, err)
+	}
+
+	// Reads and writes bigger than msize take several messages.
+	if n, err := c.Write(2, 0, make([]byte, 20000)); err != nil || n != 20000 {
+		t.Errorf("Write: want (20000, nil), got (%d, %v)", n, err)
+	}
+	if b, err := c.Read(bigFID, 0, 20000); err != nil || len(b) != 20000 {
+		t.Errorf("Read: want (20000 bytes, nil), got (%d bytes, %v)", len(b), err)
+	}
+	if want := []int{8168, 8168, 3664}; !reflect.DeepEqual(s.writes, want) || !reflect.DeepEqual(s.reads, want) {
+		t.Errorf("at msize 8192: want writes and reads of %v, got %v and %v", want, s.writes, s.reads)
+	}
+
+	// After a Tversion which lowers msize, even a single Tread or
+	// Twrite is cut down to fit, rather than the server giving up on
+	// the connection.
+	if _, _, err := c.CallTversion(4096, Version); err != nil || c.Msize != 4096 {
+		t.Fatalf("CallTversion: want msize 4096, got %d, %v", c.Msize, err)
+	}
+	if n, err := c.CallTwrite(2, 0, make([]byte, 8000)); err != nil || n != 4072 {
+		t.Errorf("CallTwrite at msize 4096: want (4072, nil), got (%d, %v)", n, err)
+	}
+	if b, err := c.CallTread(bigFID, 0, 8000); err != nil || len(b) != 4072 {
+		t.Errorf("CallTread at msize 4096: want (4072 bytes, nil), got (%d bytes, %v)", len(b), err)
+	}
+	if b, err := c.Read(bigFID, 0, 5000); err != nil || len(b) != 5000 {
+		t.Errorf("Read at msize 4096: want (5000 bytes, nil), got (%d bytes, %v)", len(b), err)
+	}
+}
+
+func TestClientMsizeMidWrite(t *testing.T) {
+	p, srv := net.Pipe()
+	defer srv.Close()
+	c, err := NewClient(func(c *Client) error {
+		c.FromNet, c.ToNet = p, p
+		c.Msize = 8192
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewClient: want nil, got %v", err)
+	}
+	type result struct {
+		n   Count
+		err error
+	}
+	wrote := make(chan result, 1)
+	go func() {
+		n, err := c.Write(2, 0, make([]byte, 20000))
+		wrote <- result{n, err}
+	}()
+
+	// The server takes the first Twrite, and, before answering it,
+	// settles on a smaller msize.
+	typ, b := readReply(t, srv)
+	_, _, d, tag1, err := UnmarshalTwritePkt(b)
+	if typ != Twrite || err != nil || len(d) != 8192-IOHDRSZ {
+		t.Fatalf("first message: want a Twrite of %d bytes, got %v of %d, %v", 8192-IOHDRSZ, RPCNames[typ], len(d), err)
+	}
+	versioned := make(chan error, 1)
+	go func() {
+		_, _, err := c.CallTversion(4096, Version)
+		versioned <- err
+	}()
+	typ, b = readReply(t, srv)
+	if _, _, tag, err := UnmarshalTversionPkt(b); typ != Tversion || err != nil {
+		t.Fatalf("second message: want a Tversion, got %v, %v", RPCNames[typ], err)
+	} else {
+		var r bytes.Buffer
+		MarshalRversionPkt(&r, tag, 4096, Version)
+		send(t, srv, &r)
+	}
+	if err := <-versioned; err != nil {
+		t.Fatalf("CallTversion: %v", err)
+	}
+	var r bytes.Buffer
+	MarshalRwritePkt(&r, tag1, Count(len(d)))
+	send(t, srv, &r)
+
+	// The rest of the write comes in pieces which fit.
+	tot := len(d)
+	for tot < 20000 {
+		typ, b := readReply(t, srv)
+		_, _, d, tag, err := UnmarshalTwritePkt(b)
+		if typ != Twrite || err != nil || len(d) > 4096-IOHDRSZ {
+			t.Fatalf("after Tversion: want a Twrite of at most %d bytes, got %v of %d, %v", 4096-IOHDRSZ, RPCNames[typ], len(d), err)
+		}
+		tot += len(d)
+		r.Reset()
+		MarshalRwritePkt(&r, tag, Count(len(d)))
+		send(t, srv, &r)
+	}
+	if res := <-wrote; res.n != 20000 || res.err != nil {
+		t.Errorf("Write: want (20000, nil), got (%d, %v)", res.n, res.err)
+	}
+}
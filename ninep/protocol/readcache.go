@@ -0,0 +1,152 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// A ReadCache reads an open FID through a Client, keeping what it read
+// so that the same read, at the same offset for the same count, needn't
+// go to the server again. It is for files which are read over and over
+// and seldom change, e.g. configuration, where the round trips are what
+// cost.
+//
+// What it keeps may be stale. Every Recheck, before a read, it stats
+// the FID, and if the QID's version has changed it throws everything
+// away; so a read sees what the file held at most Recheck ago, as far
+// as the server's versions tell. Writes through the ReadCache throw
+// everything away at once. The stat is a Tstat, so the Client must
+// speak 9P2000 or 9P2000.u.
+type ReadCache struct {
+	c   *Client
+	fid FID
+
+	// Entries is the most reads kept: the least recently used goes
+	// to make room for another.
+	Entries int
+	// Recheck is how often the version is checked. 0 means before
+	// every read, which saves only the data, not the round trip.
+	Recheck time.Duration
+
+	// now is time.Now, but tests may stop the clock.
+	now func() time.Time
+
+	mu      sync.Mutex
+	version uint32
+	checked time.Time
+	// gen counts the times the cache has been emptied, so that a read
+	// which raced with that doesn't put back what was thrown away.
+	gen     uint64
+	lru     *list.List
+	entries map[readKey]*list.Element
+}
+
+type readKey struct {
+	o Offset
+	n Count
+}
+
+type readEntry struct {
+	k readKey
+	b []byte
+}
+
+// NewReadCache returns a ReadCache for fid, which c has open, keeping
+// up to entries reads, and checking the version every recheck.
+func NewReadCache(c *Client, fid FID, entries int, recheck time.Duration) *ReadCache {
+	return &ReadCache{
+		c:       c,
+		fid:     fid,
+		Entries: entries,
+		Recheck: recheck,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[readKey]*list.Element),
+	}
+}
+
+// Read reads n bytes at o, from the cache if it can.
+func (rc *ReadCache) Read(o Offset, n Count) ([]byte, error) {
+	k := readKey{o, n}
+	rc.mu.Lock()
+	if err := rc.checkLocked(); err != nil {
+		rc.mu.Unlock()
+		return rc.c.CallTread(rc.fid, o, n)
+	}
+	if e, ok := rc.entries[k]; ok {
+		rc.lru.MoveToFront(e)
+		b := append([]byte(nil), e.Value.(*readEntry).b...)
+		rc.mu.Unlock()
+		return b, nil
+	}
+	gen := rc.gen
+	rc.mu.Unlock()
+
+	b, err := rc.c.CallTread(rc.fid, o, n)
+	if err != nil {
+		return b, err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, ok := rc.entries[k]; !ok && gen == rc.gen && rc.Entries > 0 {
+		rc.entries[k] = rc.lru.PushFront(&readEntry{k: k, b: append([]byte(nil), b...)})
+		for rc.lru.Len() > rc.Entries {
+			e := rc.lru.Back()
+			delete(rc.entries, e.Value.(*readEntry).k)
+			rc.lru.Remove(e)
+		}
+	}
+	return b, nil
+}
+
+// Write writes b at o, and empties the cache.
+func (rc *ReadCache) Write(o Offset, b []byte) (Count, error) {
+	n, err := rc.c.CallTwrite(rc.fid, o, b)
+	rc.Invalidate()
+	return n, err
+}
+
+// Invalidate empties the cache, e.g. after the file has been changed
+// some other way.
+func (rc *ReadCache) Invalidate() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.emptyLocked()
+	rc.checked = time.Time{}
+}
+
+func (rc *ReadCache) emptyLocked() {
+	rc.gen++
+	rc.lru.Init()
+	rc.entries = make(map[readKey]*list.Element)
+}
+
+// checkLocked stats the FID, if it is time to, and empties the cache if
+// the version has changed. If the stat fails, the cache is emptied, and
+// the error returned, so that the read goes to the server.
+func (rc *ReadCache) checkLocked() error {
+	now := rc.now()
+	if !rc.checked.IsZero() && now.Sub(rc.checked) < rc.Recheck {
+		return nil
+	}
+	b, err := rc.c.CallTstat(rc.fid)
+	if err == nil {
+		var d Dir
+		if d, err = Unmarshaldir(bytes.NewBuffer(b)); err == nil {
+			if rc.checked.IsZero() || d.QID.Version != rc.version {
+				rc.emptyLocked()
+			}
+			rc.version, rc.checked = d.QID.Version, now
+			return nil
+		}
+	}
+	rc.emptyLocked()
+	rc.checked = time.Time{}
+	return err
+}
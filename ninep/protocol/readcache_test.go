@@ -0,0 +1,121 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// versioned is an echo server whose file 2 has a version, which the
+// test bumps, and which counts the reads and stats it serves.
+type versioned struct {
+	*echo
+
+	mu      sync.Mutex
+	version uint32
+	reads   int
+	stats   int
+}
+
+func (v *versioned) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.reads++
+	return []byte(fmt.Sprintf("v%d@%d", v.version, o)), nil
+}
+
+func (v *versioned) Rstat(ctx context.Context, f FID) ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.stats++
+	var b bytes.Buffer
+	Marshaldir(&b, Dir{QID: QID{Path: 2, Version: v.version}, Name: "f"})
+	return b.Bytes(), nil
+}
+
+func (v *versioned) Rwrite(ctx context.Context, f FID, o Offset, b []byte) (Count, error) {
+	v.bump()
+	return Count(len(b)), nil
+}
+
+func (v *versioned) bump() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.version++
+}
+
+func (v *versioned) counts() (reads, stats int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.reads, v.stats
+}
+
+func TestReadCache(t *testing.T) {
+	p, p2 := net.Pipe()
+	c, err := NewClient(func(c *Client) error {
+		c.FromNet, c.ToNet = p, p
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewClient: want nil, got %v", err)
+	}
+	v := &versioned{echo: newEcho()}
+	l, err := NewNetListener(func() NineServer { return v })
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	if err := l.Accept(p2); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	defer p.Close()
+	if _, _, err := c.CallTversion(8192, Version); err != nil {
+		t.Fatalf("CallTversion: want nil, got %v", err)
+	}
+
+	rc := NewReadCache(c, 2, 2, time.Minute)
+	now := time.Unix(1e9, 0)
+	rc.now = func() time.Time { return now }
+	read := func(o Offset, want string, reads, stats int) {
+		t.Helper()
+		b, err := rc.Read(o, 10)
+		if err != nil || string(b) != want {
+			t.Errorf("Read at %d: want (%q, nil), got (%q, %v)", o, want, b, err)
+		}
+		if r, s := v.counts(); r != reads || s != stats {
+			t.Errorf("Read at %d: want %d reads and %d stats on the server, got %d and %d", o, reads, stats, r, s)
+		}
+	}
+
+	read(0, "v0@0", 1, 1)
+	read(0, "v0@0", 1, 1)
+	read(5, "v0@5", 2, 1)
+	// Two entries, so reading a third drops 0, the least recently used.
+	read(6, "v0@6", 3, 1)
+	read(5, "v0@5", 3, 1)
+	read(0, "v0@0", 4, 1)
+
+	// A change on the server isn't seen until it's time to recheck.
+	v.bump()
+	read(0, "v0@0", 4, 1)
+	now = now.Add(time.Minute)
+	read(0, "v1@0", 5, 2)
+	read(0, "v1@0", 5, 2)
+
+	// Nor is a recheck which finds no change a reason to read again.
+	now = now.Add(time.Minute)
+	read(0, "v1@0", 5, 3)
+
+	// Writing through the cache empties it at once.
+	if _, err := rc.Write(0, []byte("x")); err != nil {
+		t.Fatalf("Write: want nil, got %v", err)
+	}
+	read(0, "v2@0", 6, 4)
+}
@@ -0,0 +1,464 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Recording says where WithRecording keeps the records of
+// connections, and how much of them.
+type Recording struct {
+	// Dir is the directory the record files are written in.
+	Dir string
+
+	// MaxBytes, if not 0, bounds the size of a record file. A
+	// connection which has filled one goes on in another, with the
+	// next part number.
+	MaxBytes int64
+
+	// MaxFiles, if not 0, bounds the number of record files kept in
+	// Dir. The oldest are removed to make room for new ones, even if
+	// they are still being written.
+	MaxFiles int
+
+	// mu guards the pruning of Dir.
+	mu sync.Mutex
+}
+
+// recordMagic starts every record file.
+const recordMagic = "9P record 1\n"
+
+// recordSuffix ends the name of every record file.
+const recordSuffix = ".9prec"
+
+// WithRecording returns a NetListenerOpt which records everything read
+// from and written to each connection, byte for byte, as it was read
+// or written, with the time, in files in rec.Dir. A connection's first
+// file is called
+//
+//	<start time>-<remote address>-000000.9prec
+//
+// and its later parts, if rec.MaxBytes is set, -000001, -000002 and so
+// on, so that the names sort in the order they were written. Over
+// TLS, what is recorded is the 9p, not the TLS. ReadRecord reads the
+// files, and Replay plays them back.
+//
+// A connection which can't be recorded is served anyway, and logged.
+// Without WithRecording, connections pay nothing for it.
+func WithRecording(rec *Recording) NetListenerOpt {
+	return func(l *NetListener) error {
+		if err := os.MkdirAll(rec.Dir, 0755); err != nil {
+			return err
+		}
+		l.recording = rec
+		return nil
+	}
+}
+
+// A RecordEntry is what one read from, or write to, a connection
+// carried.
+type RecordEntry struct {
+	Time time.Time
+	// Out is set for what the server wrote, and clear for what it
+	// read.
+	Out  bool
+	Data []byte
+}
+
+// connRecorder writes the record of one connection.
+type connRecorder struct {
+	rec  *Recording
+	base string
+
+	// mu guards below. Reads and writes happen on goroutines of
+	// their own.
+	mu   sync.Mutex
+	f    *os.File
+	part int
+	n    int64
+	err  error
+}
+
+// newRecorder starts the record of the connection from remoteAddr.
+func (rec *Recording) newRecorder(remoteAddr string) (*connRecorder, error) {
+	name := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '.' {
+			return r
+		}
+		return '_'
+	}, remoteAddr)
+	r := &connRecorder{
+		rec:  rec,
+		base: filepath.Join(rec.Dir, time.Now().UTC().Format("20060102T150405.000000")+"-"+name),
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open starts the record's current part.
+func (r *connRecorder) open() error {
+	f, err := os.OpenFile(fmt.Sprintf("%s-%06d%s", r.base, r.part, recordSuffix), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(recordMagic); err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.n = f, int64(len(recordMagic))
+	r.rec.prune()
+	return nil
+}
+
+// record writes an entry for b. The first error stops the recording,
+// and is returned; the connection is none of its business.
+func (r *connRecorder) record(out bool, b []byte) error {
+	var h [13]byte
+	h[0] = '<'
+	if out {
+		h[0] = '>'
+	}
+	binary.LittleEndian.PutUint64(h[1:], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint32(h[9:], uint32(len(b)))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil
+	}
+	if max := r.rec.MaxBytes; max > 0 && r.n > int64(len(recordMagic)) && r.n+int64(len(h)+len(b)) > max {
+		r.f.Close()
+		r.part++
+		if r.err = r.open(); r.err != nil {
+			return r.err
+		}
+	}
+	// One write per entry, so that a file cut short by a crash ends
+	// at an entry, or close to one.
+	m, err := r.f.Write(append(h[:], b...))
+	r.n += int64(m)
+	if err != nil {
+		r.f.Close()
+		r.err = err
+	}
+	return err
+}
+
+func (r *connRecorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.f.Close()
+		r.err = os.ErrClosed
+	}
+}
+
+// prune removes the oldest record files in Dir, so that there are no
+// more than MaxFiles. The names start with the time, so the oldest
+// sort first.
+func (rec *Recording) prune() {
+	if rec.MaxFiles <= 0 {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	fis, err := ioutil.ReadDir(rec.Dir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), recordSuffix) {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > rec.MaxFiles {
+		os.Remove(filepath.Join(rec.Dir, names[0]))
+		names = names[1:]
+	}
+}
+
+// record has what passes through c recorded, as rec says.
+func (c *conn) record(rec *Recording) {
+	r, err := rec.newRecorder(c.remoteAddr)
+	if err != nil {
+		c.logf("not recording: %v", err)
+		return
+	}
+	rc := &recordConn{
+		ReadWriteCloser: struct {
+			io.Reader
+			io.Writer
+			io.Closer
+		}{c.Reader, c.Writer, c.Closer},
+		r:    r,
+		logf: c.logf,
+	}
+	c.Reader, c.Writer, c.Closer = rc, rc, rc
+}
+
+// recordConn is a connection's Reader, Writer and Closer, recording
+// what passes through them.
+type recordConn struct {
+	io.ReadWriteCloser
+	r    *connRecorder
+	logf func(string, ...interface{})
+}
+
+func (rc *recordConn) Read(b []byte) (int, error) {
+	n, err := rc.ReadWriteCloser.Read(b)
+	if n > 0 {
+		rc.check(rc.r.record(false, b[:n]))
+	}
+	return n, err
+}
+
+func (rc *recordConn) Write(b []byte) (int, error) {
+	n, err := rc.ReadWriteCloser.Write(b)
+	if n > 0 {
+		rc.check(rc.r.record(true, b[:n]))
+	}
+	return n, err
+}
+
+func (rc *recordConn) Close() error {
+	rc.r.close()
+	return rc.ReadWriteCloser.Close()
+}
+
+func (rc *recordConn) check(err error) {
+	if err != nil {
+		rc.logf("recording stopped: %v", err)
+	}
+}
+
+// ReadRecord reads a record file written for WithRecording. A file
+// cut short, e.g. by a crash, gives the entries which are whole, and
+// io.ErrUnexpectedEOF. A record in more than one part is read a part at
+// a time, and the entries put together.
+func ReadRecord(r io.Reader) ([]RecordEntry, error) {
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != recordMagic {
+		return nil, errors.New("not a 9p record")
+	}
+	var es []RecordEntry
+	for {
+		var h [13]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return es, err
+		}
+		if h[0] != '<' && h[0] != '>' {
+			return es, fmt.Errorf("record entry %d: bad direction %q", len(es), h[0])
+		}
+		e := RecordEntry{
+			Time: time.Unix(0, int64(binary.LittleEndian.Uint64(h[1:]))),
+			Out:  h[0] == '>',
+			Data: make([]byte, binary.LittleEndian.Uint32(h[9:])),
+		}
+		if _, err := io.ReadFull(r, e.Data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return es, err
+		}
+		es = append(es, e)
+	}
+}
+
+// Replay serves what the recorded client sent, in es, from ns, as a
+// connection would, and compares what it gets back with what was
+// recorded. It is paced by the record: nothing is sent until as much
+// has been replied as had been when the client sent it, so a request
+// which waited for another's reply still does, up to replayWait. The
+// replies with each tag must be the same, and in the same order;
+// requests in flight at once may be answered in either order. The
+// error, if any, says where they first differ.
+//
+// A record of a session which went wrong makes a regression test of
+// it: Replay it against the fixed NineServer, or against one which
+// serves the same files, if the replies depend on them.
+func Replay(es []RecordEntry, ns NineServer) error {
+	var want bytes.Buffer
+	for _, e := range es {
+		if e.Out {
+			want.Write(e.Data)
+		}
+	}
+	rc := &replayConn{es: es}
+	c := &conn{
+		server:     &Server{NS: ns, D: Dispatch},
+		Reader:     rc,
+		Writer:     rc,
+		Closer:     ioutil.NopCloser(nil),
+		replies:    make(chan RPCReply, NumTags),
+		remoteAddr: "replay",
+		metrics:    new(Metrics),
+	}
+	c.room = sync.NewCond(&c.mu)
+	// serve returns once it has read everything, and every reply has
+	// been written.
+	c.serve()
+	return CompareReplies(want.Bytes(), rc.got.Bytes())
+}
+
+// CompareReplies compares the replies in got with those in want, as
+// Replay does: the replies with each tag must be the same, and in the
+// same order, but replies with different tags may come in any order.
+// The error, if any, says where they first differ.
+func CompareReplies(want, got []byte) error {
+	wantTags, err := repliesByTag(want)
+	if err != nil {
+		return fmt.Errorf("recorded replies: %v", err)
+	}
+	gotTags, err := repliesByTag(got)
+	if err != nil {
+		return fmt.Errorf("replayed replies: %v", err)
+	}
+	for _, tag := range sortedTags(wantTags, gotTags) {
+		w, g := wantTags[tag], gotTags[tag]
+		for i := 0; i < len(w) || i < len(g); i++ {
+			switch {
+			case i >= len(g):
+				return fmt.Errorf("tag %d reply %d: want\n%sgot none", tag, i, dumpMessage("", w[i]))
+			case i >= len(w):
+				return fmt.Errorf("tag %d reply %d: want none, got\n%s", tag, i, dumpMessage("", g[i]))
+			case !bytes.Equal(w[i], g[i]):
+				return fmt.Errorf("tag %d reply %d: want\n%sgot\n%s", tag, i, dumpMessage("", w[i]), dumpMessage("", g[i]))
+			}
+		}
+	}
+	return nil
+}
+
+// replayWait is how long Replay waits for the replies a request
+// followed in the record.
+const replayWait = 5 * time.Second
+
+// replayConn reads the client's side of a record, and keeps what is
+// written to it. Each of the client's entries is read only once as many
+// replies have been written as were before it in the record.
+type replayConn struct {
+	es []RecordEntry
+
+	// next is the next entry, in is what is left of the client's
+	// entry being read, and out is what the server wrote before it.
+	// late is set once a wait has run out, after which we don't.
+	next int
+	in   []byte
+	out  []byte
+	late bool
+
+	// mu guards got, which is written by the conn's writer.
+	mu  sync.Mutex
+	got bytes.Buffer
+}
+
+func (rc *replayConn) Read(b []byte) (int, error) {
+	for len(rc.in) == 0 {
+		if rc.next == len(rc.es) {
+			rc.wait()
+			return 0, io.EOF
+		}
+		e := rc.es[rc.next]
+		rc.next++
+		if e.Out {
+			rc.out = append(rc.out, e.Data...)
+			continue
+		}
+		rc.wait()
+		rc.in = e.Data
+	}
+	n := copy(b, rc.in)
+	rc.in = rc.in[n:]
+	return n, nil
+}
+
+// wait waits until as many replies have been written as there are in
+// rc.out.
+func (rc *replayConn) wait() {
+	want := countMessages(rc.out)
+	for start := time.Now(); !rc.late; time.Sleep(time.Millisecond) {
+		rc.mu.Lock()
+		n := countMessages(rc.got.Bytes())
+		rc.mu.Unlock()
+		if n >= want {
+			return
+		}
+		rc.late = time.Since(start) > replayWait
+	}
+}
+
+func (rc *replayConn) Write(b []byte) (int, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.got.Write(b)
+}
+
+// countMessages returns the number of whole messages b starts with.
+func countMessages(b []byte) int {
+	n := 0
+	for len(b) >= 4 {
+		sz := int(binary.LittleEndian.Uint32(b))
+		if sz < 7 || sz > len(b) {
+			break
+		}
+		b = b[sz:]
+		n++
+	}
+	return n
+}
+
+// repliesByTag splits b into messages, and returns them by tag, in
+// the order they came.
+func repliesByTag(b []byte) (map[Tag][][]byte, error) {
+	m := make(map[Tag][][]byte)
+	for len(b) > 0 {
+		if len(b) < 7 {
+			return m, fmt.Errorf("%d bytes left over", len(b))
+		}
+		sz := int(binary.LittleEndian.Uint32(b))
+		if sz < 7 || sz > len(b) {
+			return m, fmt.Errorf("message size %d, have %d bytes", sz, len(b))
+		}
+		tag := Tag(binary.LittleEndian.Uint16(b[5:]))
+		m[tag] = append(m[tag], b[:sz])
+		b = b[sz:]
+	}
+	return m, nil
+}
+
+// sortedTags returns the tags in either of ms, in order.
+func sortedTags(ms ...map[Tag][][]byte) []Tag {
+	seen := make(map[Tag]bool)
+	var tags []Tag
+	for _, m := range ms {
+		for t := range m {
+			if !seen[t] {
+				seen[t] = true
+				tags = append(tags, t)
+			}
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
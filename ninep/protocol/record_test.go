@@ -0,0 +1,181 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recorded is an echo server whose clunks always work, whatever other
+// tests have removed.
+type recorded struct {
+	*echo
+}
+
+func (r recorded) Rclunk(ctx context.Context, f FID) error {
+	return nil
+}
+
+// recordSession serves ns with rec recording, runs a short session
+// with it, and returns the names of the record files, in order.
+func recordSession(t *testing.T, ns NineServer, rec *Recording) []string {
+	t.Helper()
+	l, c := newListenerConn(t, ns, WithRecording(rec))
+	var b bytes.Buffer
+	MarshalTattachPkt(&b, 1, 2, NOFID, "glenda", "")
+	send(t, c, &b)
+	if typ, _ := readReply(t, c); typ != Rattach {
+		t.Fatalf("Tattach: want Rattach, got %v", RPCNames[typ])
+	}
+	b.Reset()
+	MarshalTreadPkt(&b, 2, 2, 0, 100)
+	send(t, c, &b)
+	if typ, _ := readReply(t, c); typ != Rread {
+		t.Fatalf("Tread: want Rread, got %v", RPCNames[typ])
+	}
+	b.Reset()
+	MarshalTclunkPkt(&b, 3, 2)
+	send(t, c, &b)
+	if typ, _ := readReply(t, c); typ != Rclunk {
+		t.Fatalf("Tclunk: want Rclunk, got %v", RPCNames[typ])
+	}
+	c.Close()
+	for start := time.Now(); len(l.Conns()) > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("connection not done with after the client went away")
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(rec.Dir, "*"+recordSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func readRecordFiles(t *testing.T, names []string) []RecordEntry {
+	t.Helper()
+	var es []RecordEntry
+	for _, n := range names {
+		f, err := os.Open(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := ReadRecord(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("ReadRecord(%s): %v", n, err)
+		}
+		es = append(es, e...)
+	}
+	return es
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := recordSession(t, recorded{newEcho()}, &Recording{Dir: dir})
+	if len(names) != 1 || !strings.HasSuffix(names[0], "-pipe-000000"+recordSuffix) {
+		t.Fatalf("record files: got %q, want one for the pipe", names)
+	}
+	es := readRecordFiles(t, names)
+	var in, out bytes.Buffer
+	for i, e := range es {
+		if e.Time.IsZero() || i > 0 && e.Time.Before(es[i-1].Time) {
+			t.Errorf("entry %d: time %v out of order", i, e.Time)
+		}
+		if e.Out {
+			out.Write(e.Data)
+		} else {
+			in.Write(e.Data)
+		}
+	}
+	// What was read starts with the Tversion, and what was written
+	// with the Rversion.
+	if in.Len() < 7 || MType(in.Bytes()[4]) != Tversion {
+		t.Errorf("recorded input: want a Tversion first, got %v", in.Bytes())
+	}
+	if out.Len() < 7 || MType(out.Bytes()[4]) != Rversion {
+		t.Errorf("recorded output: want an Rversion first, got %v", out.Bytes())
+	}
+
+	if err := Replay(es, recorded{newEcho()}); err != nil {
+		t.Errorf("Replay against the same server: %v", err)
+	}
+	// A server which reads something else differs in tag 2's reply.
+	if err := Replay(es, patterned{newEcho()}); err == nil || !strings.HasPrefix(err.Error(), "tag 2 reply 0") {
+		t.Errorf("Replay against another server: want a difference in tag 2, got %v", err)
+	}
+}
+
+func TestRecordRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Small files hold an entry each, and a whole session can still
+	// be put back together from them.
+	names := recordSession(t, recorded{newEcho()}, &Recording{Dir: dir, MaxBytes: 64})
+	if len(names) < 4 {
+		t.Fatalf("record files: got %q, want several parts", names)
+	}
+	for _, n := range names {
+		fi, err := os.Stat(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if es := readRecordFiles(t, []string{n}); fi.Size() > 64 && len(es) != 1 {
+			t.Errorf("%s: %d bytes in %d entries, want at most 64 bytes, or one entry", n, fi.Size(), len(es))
+		}
+	}
+	if err := Replay(readRecordFiles(t, names), recorded{newEcho()}); err != nil {
+		t.Errorf("Replay of the parts: %v", err)
+	}
+
+	// With MaxFiles, only the newest are kept.
+	os.RemoveAll(dir)
+	names = recordSession(t, recorded{newEcho()}, &Recording{Dir: dir, MaxBytes: 64, MaxFiles: 2})
+	if len(names) != 2 {
+		t.Fatalf("record files with MaxFiles 2: got %q", names)
+	}
+}
+
+func TestReadRecordShort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	names := recordSession(t, recorded{newEcho()}, &Recording{Dir: dir})
+	b, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := ReadRecord(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut short in the last entry, as by a crash.
+	es, err := ReadRecord(bytes.NewReader(b[:len(b)-1]))
+	if err != io.ErrUnexpectedEOF || len(es) != len(all)-1 {
+		t.Errorf("ReadRecord of a cut record: got (%d entries, %v), want (%d, %v)", len(es), err, len(all)-1, io.ErrUnexpectedEOF)
+	}
+	if _, err := ReadRecord(strings.NewReader("not a record at all")); err == nil {
+		t.Error("ReadRecord of something else: want an error, got nil")
+	}
+}
@@ -8,10 +8,18 @@ package protocol
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,24 +34,182 @@ type NetListener struct {
 	// TCP address to listen on, default is DefaultAddr
 	Addr string
 
-	// Trace function for logging
+	// Trace function for logging. It gets traces up to LevelDebug.
 	Trace Tracer
 
+	// Logger, if set, gets traces in place of Trace, at the levels
+	// it wants. If it is a ConnLogger, each connection has its own.
+	Logger Logger
+
+	// tracingDisabled skips per-request tracing entirely,
+	// rather than calling Trace only to have it do nothing.
+	tracingDisabled bool
+
+	// timeouts are given to each connection.
+	timeouts timeouts
+
+	// limits are set by WithMaxConns, WithMaxRequests,
+	// WithMaxInflightBytes and WithMaxBufferedBytes.
+	limits limits
+
+	// middleware wraps Dispatch for each connection.
+	middleware []Middleware
+
+	// metrics counts what all the connections have done.
+	metrics *Metrics
+
+	// tlsConfig, if set, is for serving over TLS. See WithTLS.
+	tlsConfig *tls.Config
+
+	// keepAlive is the TCP keep-alive period set by WithKeepAlive.
+	keepAlive time.Duration
+
+	// recording, if set, is where connections are recorded. See
+	// WithRecording.
+	recording *Recording
+
+	// capturer, if set, captures the messages of every connection.
+	// See WithCapture.
+	capturer *capturer
+
+	// onConnect and onDisconnect, if set, are told of each connection
+	// as it starts and ends.
+	onConnect    func(remoteAddr string)
+	onDisconnect func(remoteAddr string, err error)
+
 	// mu guards below
 	mu sync.Mutex
 
 	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+
+	// inShutdown is set once Shutdown is called, so connections
+	// which arrive after that are drained too.
+	inShutdown bool
+
+	// inflight is the number of bytes in the requests in progress on
+	// all connections, counted if limits.bytes is set.
+	inflight int64
+}
+
+// limits bound how much the NetListener takes on. Zero means no limit.
+type limits struct {
+	conns    int
+	requests int
+	bytes    int64
+	buffered int64
+}
+
+// shutdownPollInterval is how often Shutdown looks for connections
+// which have finished their requests.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// timeouts are the limits set by WithIdleTimeout, WithHeaderTimeout,
+// WithRequestTimeout and WithOpTimeouts. Zero means no limit.
+type timeouts struct {
+	idle    time.Duration
+	header  time.Duration
+	request time.Duration
+
+	// ops holds the timeouts for types of request which don't have
+	// the request timeout.
+	ops map[MType]time.Duration
+}
+
+// forRequest returns the timeout for a request of type t.
+func (to timeouts) forRequest(t MType) time.Duration {
+	if t == Tversion || t == Tflush {
+		return 0
+	}
+	if d, ok := to.ops[t]; ok {
+		return d
+	}
+	return to.request
 }
 
 // Server is a 9p server.
-// For now it's extremely serial. But we will use a chan for replies to ensure that
-// we can go to a more concurrent one later.
+// Requests on a connection are dispatched concurrently, with
+// replies funneled through a chan to a single writer. See conn.serve.
+// Those naming the same FID, though, are run one at a time, in the
+// order they arrived, so that e.g. overlapping Twrites on a FID are
+// done in the order they were sent, and a NineServer needs no lock of
+// its own for each FID. Requests on different FIDs run in parallel.
 type Server struct {
 	NS NineServer
 	D  Dispatcher
 
-	// Versioned is set to true on the first call to Tversion
-	Versioned bool
+	// mu guards the session and the FIDs below. Requests on a
+	// connection run concurrently, but Tversion runs on its own.
+	mu sync.Mutex
+
+	// sess is what the last Tversion settled on.
+	sess session
+
+	// afids holds the FIDs set up by Tauth, which are the only ones
+	// Tattach accepts as an afid.
+	afids map[FID]bool
+
+	// fids holds every FID the client has set up, by Tattach, Tauth,
+	// Twalk or Txattrwalk, and not yet clunked or removed, so that a
+	// new Tversion can clunk them. It is true for those opened, by
+	// Topen, Tcreate, Tlopen or Tlcreate, which can't be walked.
+	fids map[FID]bool
+}
+
+// session is the state Tversion negotiates for a connection. Another
+// Tversion starts a new session.
+type session struct {
+	// versioned is set once the client has sent a Tversion.
+	versioned bool
+
+	// msize is the message size negotiated by Tversion, or 0 if
+	// there hasn't been one yet.
+	msize MaxSize
+
+	// dotu is set if Tversion settled on 9P2000.u, and dotl if it
+	// settled on 9P2000.L.
+	dotu bool
+	dotl bool
+}
+
+// size returns the session's msize, or MSIZE before there is one.
+func (ss session) size() MaxSize {
+	if ss.msize == 0 {
+		return MSIZE
+	}
+	return ss.msize
+}
+
+// version returns the version Tversion settled on, or "" if there
+// hasn't been one.
+func (ss session) version() string {
+	switch {
+	case !ss.versioned:
+		return ""
+	case ss.dotl:
+		return VersionL
+	case ss.dotu:
+		return VersionU
+	}
+	return Version
+}
+
+// session returns the current session.
+func (s *Server) session() session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sess
+}
+
+// Versioned reports whether the client has sent a Tversion.
+func (s *Server) Versioned() bool {
+	return s.session().versioned
+}
+
+// Msize returns the largest message, in bytes, allowed in either
+// direction: the size negotiated by Tversion, or MSIZE before then.
+func (s *Server) Msize() MaxSize {
+	return s.session().size()
 }
 
 // conn has a listener in it, and I don't recall why.
@@ -60,13 +226,122 @@ type conn struct {
 	// remoteAddr is rwc.RemoteAddr().String(). See note in net/http/server.go.
 	remoteAddr string
 
+	// rd sets read deadlines, to enforce timeouts. It is nil if the
+	// connection doesn't have them, as for ServeFromRWC.
+	rd interface {
+		SetReadDeadline(time.Time) error
+	}
+	timeouts timeouts
+
+	// start is when we started serving the connection.
+	start time.Time
+
 	// replies
 	replies chan RPCReply
 
+	// log gets the conn's traces. It is nil if there are none.
+	log Logger
+
+	// metrics counts what the conn has done. Its parent is the
+	// listener's.
+	metrics *Metrics
+
+	// tls is the connection, if it is over TLS. serve does the
+	// handshake.
+	tls *tls.Conn
+
+	// ctx is the parent of every request's context. It is cancelled
+	// when we stop reading from the connection. Its own parent is
+	// parent, if set, and otherwise the background.
+	ctx    context.Context
+	cancel context.CancelFunc
+	parent context.Context
+
+	// wg counts requests which have been read but not yet replied to.
+	wg sync.WaitGroup
+
+	// mu guards below
+	mu sync.Mutex
+
 	// dead is set to true when we finish reading packets.
 	dead bool
 
-	logger func(string, ...interface{})
+	// draining is set when the listener is shutting down. New requests
+	// are refused, and the conn is closed once it is idle.
+	draining bool
+
+	// err is why the conn ended, if not because the client hung up,
+	// or we did, between messages.
+	err error
+
+	// unwritten counts replies queued but not yet written.
+	unwritten int
+
+	// buffered is the bytes of the requests in progress and of the
+	// replies not yet written. room is signalled when it goes down,
+	// or the conn fails, for serve to wait on once it is over
+	// limits.buffered.
+	buffered int64
+	room     *sync.Cond
+
+	// lastActive is when a message was last read or written.
+	lastActive time.Time
+
+	// fids holds, for each FID with requests in progress, the requests
+	// still waiting to run. Requests on a FID run in the order they
+	// arrived, one at a time.
+	fids map[FID][]func()
+
+	// tags maps each in-flight tag to its request.
+	tags map[Tag]*request
+}
+
+// request is a request which has been read but not yet replied to.
+type request struct {
+	tag Tag
+	t   MType
+	b   *bytes.Buffer
+
+	// arrived is when the request was read, for Metrics.
+	arrived time.Time
+
+	// ctx is cancelled when the request is flushed, or has run out
+	// of time.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// timer expires the request once it has taken longer than its
+	// timeout.
+	timer *time.Timer
+
+	// reserved is what the request counts against limits.bytes, and
+	// size what it counts in conn.buffered.
+	reserved int64
+	size     int64
+
+	// body is the streamed part of the reply, if there is one.
+	body replyBody
+
+	// done is closed once the reply has been queued for writing,
+	// or dropped because the request was flushed.
+	done chan struct{}
+
+	// started is set once the request begins to run, flushed when a
+	// Tflush arrives before the reply has been queued, and replied once
+	// it has. expired is set if an Rerror was sent because it took too
+	// long. All four are guarded by conn.mu.
+	started bool
+	flushed bool
+	replied bool
+	expired bool
+}
+
+// answered reports whether the client has been, or is about to be,
+// told that r is done with, so that its tag may be used again: it has
+// been replied to, or answered with an Rerror because it took too long,
+// or flushed. c.mu must be held.
+func (r *request) answered() bool {
+	return r.replied || r.expired || r.flushed
 }
 
 // this is getting icky, but the plan is to deprecate this whole thing in favor of p9.
@@ -77,6 +352,7 @@ var Debug = func(string, ...interface{}) {}
 func NewNetListener(nsCreator NsCreator, opts ...NetListenerOpt) (*NetListener, error) {
 	l := &NetListener{
 		nsCreator: nsCreator,
+		metrics:   new(Metrics),
 	}
 
 	for _, o := range opts {
@@ -88,9 +364,218 @@ func NewNetListener(nsCreator NsCreator, opts ...NetListenerOpt) (*NetListener,
 	return l, nil
 }
 
+// WithTracingDisabled returns a NetListenerOpt which turns off tracing
+// on the NetListener's connections. No trace calls are made, and no
+// arguments built for them, so a latency-sensitive server pays nothing.
+func WithTracingDisabled() NetListenerOpt {
+	return func(l *NetListener) error {
+		l.tracingDisabled = true
+		return nil
+	}
+}
+
+// WithTraceWriter returns a NetListenerOpt which sends the
+// NetListener's traces to w, e.g. a file, rather than wherever Trace
+// sends them. Each trace is a line, stamped with the date and the time
+// to the microsecond. Writes to w are made one at a time.
+func WithTraceWriter(w io.Writer) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.Trace = log.New(w, "", log.LstdFlags|log.Lmicroseconds).Printf
+		return nil
+	}
+}
+
+// WithLogger returns a NetListenerOpt which sends the NetListener's
+// traces to lg, in place of Trace. LevelTracer makes a Logger of a
+// Tracer, e.g. log.Printf, with a Level.
+func WithLogger(lg Logger) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.Logger = lg
+		return nil
+	}
+}
+
+// WithIdleTimeout returns a NetListenerOpt which closes connections
+// that have had nothing to do for d: no messages in either direction,
+// and no requests in progress. A client waiting on a Tread that blocks,
+// e.g. on a console, is not idle, however long it waits.
+func WithIdleTimeout(d time.Duration) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.timeouts.idle = d
+		return nil
+	}
+}
+
+// WithKeepAlive returns a NetListenerOpt which has TCP connections
+// probed every d while they are quiet, so that one whose client has
+// gone without a word, e.g. been switched off, is found dead and
+// closed, rather than holding its FIDs until TCP gives up on it, which
+// can take hours. A negative d turns the probes off, and 0 leaves
+// connections as their listener made them: those from net.Listen are
+// probed every 15 seconds.
+func WithKeepAlive(d time.Duration) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.keepAlive = d
+		return nil
+	}
+}
+
+// WithHeaderTimeout returns a NetListenerOpt which gives a client d
+// to send its Tversion after connecting, and d to send the rest of
+// any message once it has sent the first byte. Clients which connect
+// and say nothing, or stop part way through a message, are cut off.
+func WithHeaderTimeout(d time.Duration) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.timeouts.header = d
+		return nil
+	}
+}
+
+// WithRequestTimeout returns a NetListenerOpt which gives each request
+// d to be answered. The request's context has that deadline, so that
+// the NineServer can bound its own work. One which takes longer has its
+// context cancelled, and is answered with an Rerror, ErrTimedOut; the
+// server's reply, if it ever comes up with one, is dropped. A NineServer
+// may return the context's error, which is sent as ErrTimedOut too.
+// Tversion and Tflush have no limit, and WithOpTimeouts sets others.
+func WithRequestTimeout(d time.Duration) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.timeouts.request = d
+		return nil
+	}
+}
+
+// WithOpTimeouts returns a NetListenerOpt which gives requests of the
+// types in ops their own timeouts, in place of that of
+// WithRequestTimeout, e.g. a short one for Tstat and Twalk and a long
+// one for Tread and Twrite. They work just as it does. A zero timeout
+// means no limit for that type. Tversion and Tflush can't have one.
+func WithOpTimeouts(ops map[MType]time.Duration) NetListenerOpt {
+	return func(l *NetListener) error {
+		if l.timeouts.ops == nil {
+			l.timeouts.ops = make(map[MType]time.Duration)
+		}
+		for t, d := range ops {
+			if t%2 != 0 || t == Tversion || t == Tflush || RPCNames[t] == "" {
+				return fmt.Errorf("WithOpTimeouts: type %d (%v) can't have a timeout", t, RPCNames[t])
+			}
+			if d < 0 {
+				return fmt.Errorf("WithOpTimeouts: negative timeout %v for %v", d, RPCNames[t])
+			}
+			l.timeouts.ops[t] = d
+		}
+		return nil
+	}
+}
+
+// WithMaxConns returns a NetListenerOpt which limits the NetListener to
+// serving n connections at once. Any more are closed as soon as they
+// are accepted.
+func WithMaxConns(n int) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.limits.conns = n
+		return nil
+	}
+}
+
+// WithMaxRequests returns a NetListenerOpt which limits each connection
+// to n requests in progress at once. Requests beyond that are answered
+// with an Rerror, without being run. Tversion and Tflush are exempt.
+func WithMaxRequests(n int) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.limits.requests = n
+		return nil
+	}
+}
+
+// WithMaxInflightBytes returns a NetListenerOpt which limits the
+// requests in progress, across all connections, to n bytes of
+// messages. A request which would take it over is answered with an
+// Rerror, and its message is discarded as it is read rather than
+// being kept.
+func WithMaxInflightBytes(n int64) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.limits.bytes = n
+		return nil
+	}
+}
+
+// WithMaxBufferedBytes returns a NetListenerOpt which limits each
+// connection to about n bytes of requests in progress and replies not
+// yet written. Once it is over, the connection reads no more until
+// requests finish and their replies are written, so that a client
+// which sends faster than the NineServer can keep up waits for it,
+// rather than the server holding everything it sends. Unlike
+// WithMaxInflightBytes, nothing is refused. A message is read whole
+// once it is begun, so the limit may be passed by up to msize.
+func WithMaxBufferedBytes(n int64) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.limits.buffered = n
+		return nil
+	}
+}
+
+// WithOnConnect returns a NetListenerOpt which calls f with the remote
+// address of each connection it accepts, before it serves it. f is
+// called on the goroutine which called Accept, so it must be quick.
+func WithOnConnect(f func(remoteAddr string)) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.onConnect = f
+		return nil
+	}
+}
+
+// WithOnDisconnect returns a NetListenerOpt which calls f once each
+// connection which was accepted is done with: its NineServer has been
+// told, and Conns no longer lists it. err is nil if the client hung
+// up between messages, or Shutdown closed the connection once it was
+// idle; otherwise it says what went wrong, e.g. a read or write failed,
+// the idle timeout passed, a message made no sense, or Close or
+// CloseConn closed it.
+func WithOnDisconnect(f func(remoteAddr string, err error)) NetListenerOpt {
+	return func(l *NetListener) error {
+		l.onDisconnect = f
+		return nil
+	}
+}
+
+// keepAliver is a net.Conn which can send TCP keep-alives, such as a
+// *net.TCPConn.
+type keepAliver interface {
+	SetKeepAlive(bool) error
+	SetKeepAlivePeriod(time.Duration) error
+}
+
+// setKeepAlive sets up keep-alives on rwc, as WithKeepAlive asked.
+func (l *NetListener) setKeepAlive(rwc net.Conn) error {
+	ka, ok := rwc.(keepAliver)
+	if !ok || l.keepAlive == 0 {
+		return nil
+	}
+	if l.keepAlive < 0 {
+		return ka.SetKeepAlive(false)
+	}
+	if err := ka.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return ka.SetKeepAlivePeriod(l.keepAlive)
+}
+
 func (l *NetListener) newConn(rwc net.Conn) (*conn, error) {
+	if err := l.setKeepAlive(rwc); err != nil {
+		l.logf("keep-alive for %v: %v", rwc.RemoteAddr(), err)
+	}
+	if _, ok := rwc.(*tls.Conn); !ok && l.tlsConfig != nil {
+		rwc = tls.Server(rwc, l.tlsConfig)
+	}
+	return l.newConnRWC(rwc, rwc.RemoteAddr().String()), nil
+}
+
+// newConnRWC is newConn for a connection which may not be a net.Conn,
+// from remoteAddr. It has timeouts only if it has read deadlines.
+func (l *NetListener) newConnRWC(rwc io.ReadWriteCloser, remoteAddr string) *conn {
 	ns := l.nsCreator()
-	server := &Server{NS: ns, D: Dispatch}
+	server := &Server{NS: ns, D: chain(Dispatch, l.middleware)}
 
 	c := &conn{
 		server:     server,
@@ -99,28 +584,97 @@ func (l *NetListener) newConn(rwc net.Conn) (*conn, error) {
 		Writer:     rwc,
 		Closer:     rwc,
 		replies:    make(chan RPCReply, NumTags),
-		remoteAddr: rwc.RemoteAddr().String(),
-		logger:     l.logf,
+		remoteAddr: remoteAddr,
+		timeouts:   l.timeouts,
+		metrics:    &Metrics{parent: l.metrics},
+	}
+	c.room = sync.NewCond(&c.mu)
+	if rd, ok := rwc.(interface{ SetReadDeadline(time.Time) error }); ok {
+		c.rd = rd
+	} else {
+		c.timeouts = timeouts{}
+	}
+	c.tls, _ = rwc.(*tls.Conn)
+	switch {
+	case l.tracingDisabled:
+	case l.Logger != nil:
+		c.log = l.Logger
+		if cl, ok := l.Logger.(ConnLogger); ok {
+			c.log = cl.ForConn(c.remoteAddr)
+		}
+	case l.Trace != nil:
+		c.log = l.Trace
+	}
+	if l.recording != nil {
+		c.record(l.recording)
+	}
+	if l.capturer != nil {
+		c.capture(l.capturer)
 	}
 
-	return c, nil
+	return c
 }
 
-// ServeFromRWC runs a server from an io.ReadWriteCloser
-// This can be used on Plan 9 for files in #s (i.e. /srv)
-func ServeFromRWC(rwc io.ReadWriteCloser, fs NineServer, n string) {
+// ServeConn serves ns on rwc, e.g. a pipe, a Plan 9 /srv file or an
+// SSH channel, as a NetListener made with opts would serve a
+// connection it accepted. It returns once the client hangs up, or
+// something goes wrong, or ctx is done, when rwc is closed and the
+// requests in progress are cancelled. The error is nil if the client
+// hung up between messages, ctx.Err() if ctx is done, and otherwise
+// what went wrong, as WithOnDisconnect has it.
+//
+// If rwc is a net.Conn, everything opts can set applies to it. If it
+// isn't, WithTLS and WithKeepAlive can't, and the timeouts apply only
+// if it has a SetReadDeadline method, as an *os.File may.
+func ServeConn(ctx context.Context, rwc io.ReadWriteCloser, ns NineServer, opts ...NetListenerOpt) error {
+	return serveRWC(ctx, rwc, ns, "", opts...)
+}
 
-	c := &conn{
-		server:     &Server{NS: fs, D: Dispatch},
-		Reader:     rwc,
-		Writer:     rwc,
-		Closer:     rwc,
-		replies:    make(chan RPCReply, NumTags),
-		remoteAddr: n,
-		logger:     Debug,
+// serveRWC is ServeConn, calling the client remoteAddr if rwc isn't a
+// net.Conn, which knows its own.
+func serveRWC(ctx context.Context, rwc io.ReadWriteCloser, ns NineServer, remoteAddr string, opts ...NetListenerOpt) error {
+	l, err := NewNetListener(func() NineServer { return ns }, opts...)
+	if err != nil {
+		return err
+	}
+	var c *conn
+	if nc, ok := rwc.(net.Conn); ok {
+		c, _ = l.newConn(nc)
+	} else if l.tlsConfig != nil {
+		return fmt.Errorf("ServeConn: TLS needs a net.Conn, not a %T", rwc)
+	} else {
+		if remoteAddr == "" {
+			remoteAddr = fmt.Sprintf("%T", rwc)
+		}
+		c = l.newConnRWC(rwc, remoteAddr)
 	}
+	c.parent = ctx
 
-	c.serve()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.connected(c)
+		c.serve()
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.fail(ctx.Err())
+		c.Close()
+		<-done
+	}
+	return c.reason()
+}
+
+// ServeFromRWC runs a server from an io.ReadWriteCloser, until the
+// client hangs up. This can be used on Plan 9 for files in #s (i.e.
+// /srv). ServeConn does the same, but can be stopped, says how it
+// ended, and takes NetListenerOpts.
+func ServeFromRWC(rwc io.ReadWriteCloser, fs NineServer, n string) {
+	serveRWC(context.Background(), rwc, fs, n, func(l *NetListener) error {
+		l.Trace = Debug
+		return nil
+	})
 }
 
 // trackNetListener from http.Server
@@ -196,126 +750,1326 @@ func (l *NetListener) Accept(conn net.Conn) error {
 		return err
 	}
 
+	l.connected(c)
 	go c.serve()
 	return nil
 }
 
-// Shutdown closes all active listeners. It does not close all active
-// connections but probably should.
-func (l *NetListener) Shutdown() error {
+// ServeConn serves a single connection, returning when it is closed.
+// It is Accept for callers who run their own accept loop and would
+// rather choose the goroutine themselves.
+func (l *NetListener) ServeConn(conn net.Conn) error {
+	c, err := l.newConn(conn)
+	if err != nil {
+		return err
+	}
+
+	l.connected(c)
+	c.serve()
+	return nil
+}
+
+// connected tells onConnect of c.
+func (l *NetListener) connected(c *conn) {
+	if l.onConnect != nil {
+		l.onConnect(c.remoteAddr)
+	}
+}
+
+// trackConn adds c to, or removes it from, the connections Shutdown
+// and Close close. It reports false, and doesn't add c, if there are
+// already as many connections as WithMaxConns allows.
+func (l *NetListener) trackConn(c *conn, add bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns == nil {
+		l.conns = make(map[*conn]struct{})
+	}
+
+	if add {
+		if l.limits.conns > 0 && len(l.conns) >= l.limits.conns {
+			return false
+		}
+		l.conns[c] = struct{}{}
+		l.metrics.conn(1)
+		if l.inShutdown {
+			c.drain()
+		}
+	} else {
+		delete(l.conns, c)
+		l.metrics.conn(-1)
+	}
+	return true
+}
+
+// reserve counts n more bytes of requests in progress, unless that
+// would be more than limits.bytes.
+func (l *NetListener) reserve(n int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight+n > l.limits.bytes {
+		return false
+	}
+	l.inflight += n
+	return true
+}
+
+func (l *NetListener) release(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight -= n
+}
+
+// closeIdleConnsLocked closes the connections with nothing in
+// progress, and reports whether that was all of them.
+func (l *NetListener) closeIdleConnsLocked() bool {
+	for c := range l.conns {
+		if c.idle() {
+			c.Close()
+			delete(l.conns, c)
+		}
+	}
+	return len(l.conns) == 0
+}
+
+// Shutdown shuts the NetListener down gracefully. It closes the
+// listeners, so that no more connections are accepted, and refuses
+// any new requests on the connections it has, with an Rerror. Each
+// connection is closed once the requests it was already running have
+// been answered. If ctx is done before they all have been, the rest
+// of the connections are closed anyway, abandoning their requests,
+// and Shutdown returns ctx.Err().
+func (l *NetListener) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	l.inShutdown = true
+	err := l.closeNetListenersLocked()
+	for c := range l.conns {
+		c.drain()
+	}
+	l.mu.Unlock()
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for {
+		l.mu.Lock()
+		done := l.closeIdleConnsLocked()
+		l.mu.Unlock()
+		if done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			l.Close()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Close closes the listeners and all the connections at once,
+// abandoning any requests in progress. Shutdown is more polite.
+func (l *NetListener) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	return l.closeNetListenersLocked()
+	l.inShutdown = true
+	err := l.closeNetListenersLocked()
+	for c := range l.conns {
+		c.fail(errors.New("NetListener closed"))
+		c.Close()
+		delete(l.conns, c)
+	}
+	return err
+}
+
+// ConnInfo describes one of a NetListener's connections, at one
+// moment.
+type ConnInfo struct {
+	RemoteAddr string
+	// Start is when the connection was accepted, Uptime how long ago
+	// that was, and LastActive when a message was last read or written.
+	Start      time.Time
+	Uptime     time.Duration
+	LastActive time.Time
+	// Version and Msize are what the last Tversion settled on. Until
+	// there has been one, Version is empty and Msize is MSIZE.
+	Version string
+	Msize   MaxSize
+	// Outstanding is the number of requests read but not yet done with.
+	// Buffered is the bytes of those requests and of the replies not
+	// yet written, which WithMaxBufferedBytes limits.
+	Outstanding int
+	Buffered    int64
+	// BytesIn and BytesOut count the bytes of messages read and
+	// written.
+	BytesIn, BytesOut uint64
+}
+
+func (i ConnInfo) String() string {
+	v := i.Version
+	if v == "" {
+		v = "no version"
+	}
+	return fmt.Sprintf("%s: %s, msize %d, up %v, last active %v ago, %d tags in use, %d bytes in, %d out",
+		i.RemoteAddr, v, i.Msize, i.Uptime.Round(time.Millisecond), time.Since(i.LastActive).Round(time.Millisecond), i.Outstanding, i.BytesIn, i.BytesOut)
+}
+
+// Conns returns a snapshot of each connection l is serving, oldest
+// first. It is safe to call while they are being served.
+func (l *NetListener) Conns() []ConnInfo {
+	l.mu.Lock()
+	cs := make([]*conn, 0, len(l.conns))
+	for c := range l.conns {
+		cs = append(cs, c)
+	}
+	l.mu.Unlock()
+
+	// Ask each conn only once we've let go of l.mu, so that one that's
+	// busy doesn't hold up the listener.
+	ci := make([]ConnInfo, len(cs))
+	for i, c := range cs {
+		ci[i] = c.info()
+	}
+	sort.Slice(ci, func(i, j int) bool {
+		if !ci[i].Start.Equal(ci[j].Start) {
+			return ci[i].Start.Before(ci[j].Start)
+		}
+		return ci[i].RemoteAddr < ci[j].RemoteAddr
+	})
+	return ci
+}
+
+// CloseConn closes the connections from remoteAddr, as Conns gives it,
+// e.g. to be rid of a client that's wedged, abandoning their requests.
+// Clients of a unix socket may all have the same address, and then
+// they are all closed. It is an error if there are none.
+func (l *NetListener) CloseConn(remoteAddr string) error {
+	l.mu.Lock()
+	var cs []*conn
+	for c := range l.conns {
+		if c.remoteAddr == remoteAddr {
+			cs = append(cs, c)
+		}
+	}
+	l.mu.Unlock()
+	if len(cs) == 0 {
+		return fmt.Errorf("no connection from %q", remoteAddr)
+	}
+	for _, c := range cs {
+		c.logf("closing connection: CloseConn")
+		c.fail(errors.New("closed by CloseConn"))
+		c.Close()
+	}
+	return nil
 }
 
+// String describes l's connections, one to a line after the first.
 func (l *NetListener) String() string {
-	// TODO
-	return ""
+	ci := l.Conns()
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d connections", len(ci))
+	for _, i := range ci {
+		fmt.Fprintf(&b, "\n%v", i)
+	}
+	return b.String()
 }
 
 func (l *NetListener) logf(format string, args ...interface{}) {
-	if l.Trace != nil {
+	switch {
+	case l.Logger != nil:
+		if l.Logger.Enabled(LevelInfo) {
+			l.Logger.Logf(LevelInfo, format, args...)
+		}
+	case l.Trace != nil:
 		l.Trace(format, args...)
 	}
 }
 
 func (c *conn) String() string {
-	return fmt.Sprintf("Dead %v %d replies pending", c.dead, len(c.replies))
+	c.mu.Lock()
+	dead := c.dead
+	c.mu.Unlock()
+	return fmt.Sprintf("%v, %d replies pending, dead %v", c.info(), len(c.replies), dead)
 }
 
-func (c *conn) logf(format string, args ...interface{}) {
+// info describes c, for Conns.
+func (c *conn) info() ConnInfo {
+	ss := c.server.session()
+	i := ConnInfo{
+		RemoteAddr: c.remoteAddr,
+		Version:    ss.version(),
+		Msize:      ss.size(),
+		BytesIn:    atomic.LoadUint64(&c.metrics.bytesIn),
+		BytesOut:   atomic.LoadUint64(&c.metrics.bytesOut),
+	}
+	c.mu.Lock()
+	i.Start, i.LastActive, i.Outstanding = c.start, c.lastActive, len(c.tags)
+	i.Buffered = c.buffered
+	c.mu.Unlock()
+	i.Uptime = time.Since(i.Start)
+	return i
+}
+
+// tracing reports whether the conn logs at level l. Calls to tracef on
+// the per-request path check it first so that, when it is false, we
+// don't even allocate their arguments.
+func (c *conn) tracing(l Level) bool {
+	return c.log != nil && c.log.Enabled(l)
+}
+
+// tracef logs at level l.
+func (c *conn) tracef(l Level, format string, args ...interface{}) {
 	// prepend some info about the conn
-	if c.logger != nil {
-		c.logger("[%v] "+format, append([]interface{}{c.remoteAddr}, args...)...)
+	if c.tracing(l) {
+		c.log.Logf(l, "[%v] "+format, append([]interface{}{c.remoteAddr}, args...)...)
 	}
 }
 
+// logf logs at LevelInfo.
+func (c *conn) logf(format string, args ...interface{}) {
+	c.tracef(LevelInfo, format, args...)
+}
+
+// serve reads packets from the connection and dispatches each one
+// in its own goroutine, so a slow request does not hold up the others.
+// Two orderings are preserved. Requests naming the same FID are run
+// one at a time in the order they arrived; and a Tflush is not answered
+// until the request it names has been answered or abandoned. Tversion
+// is run only once everything before it has finished. Replies are
+// written by a single goroutine, writeReplies.
 func (c *conn) serve() {
-	defer c.Close()
+	c.fids = make(map[FID][]func())
+	c.tags = make(map[Tag]*request)
+	if c.parent == nil {
+		c.parent = context.Background()
+	}
+	c.ctx, c.cancel = context.WithCancel(c.parent)
+	c.start = time.Now()
+	c.lastActive = c.start
+	if c.listener != nil {
+		if f := c.listener.onDisconnect; f != nil {
+			// This runs last of all.
+			defer func() { f(c.remoteAddr, c.reason()) }()
+		}
+		if !c.listener.trackConn(c, true) {
+			c.fail(fmt.Errorf("already serving the most allowed, %d", c.listener.limits.conns))
+			c.logf("closing connection: already serving the most allowed, %d", c.listener.limits.conns)
+			c.Close()
+			return
+		}
+		defer c.listener.trackConn(c, false)
+	}
+	// This runs once everything else is done with, but before the
+	// listener forgets c: once Conns no longer lists c, the NineServer
+	// has been told.
+	defer c.closed()
+	if c.tls != nil {
+		if err := c.handshake(); err != nil {
+			c.fail(fmt.Errorf("TLS handshake: %w", err))
+			c.logf("closing connection: TLS handshake: %v", err)
+			c.cancel()
+			c.Close()
+			return
+		}
+	}
 
-	c.logf("Starting readNetPackets")
+	done := make(chan struct{})
+	go func() {
+		c.writeReplies()
+		close(done)
+	}()
+	defer func() {
+		c.cancel()
+		c.wg.Wait()
+		close(c.replies)
+		<-done
+		c.Close()
+	}()
 
-	for !c.dead {
-		l := make([]byte, 7)
-		if _, err := io.ReadFull(c, l); err != nil {
+	c.tracef(LevelDebug, "Starting readNetPackets")
+
+	l := make([]byte, 7)
+	for {
+		if !c.waitForRoom() {
+			c.logf("readNetPackets: %v", c.reason())
+			c.markDead()
+			return
+		}
+		if err := c.readHeader(l); err != nil {
 			c.logf("readNetPackets: short read: %v", err)
-			c.dead = true
+			c.hungUp(err)
+			c.markDead()
 			return
 		}
 		sz := int64(l[0]) + int64(l[1])<<8 + int64(l[2])<<16 + int64(l[3])<<24
 		t := MType(l[4])
-		b := bytes.NewBuffer(l[5:])
-		r := io.LimitReader(c.Reader, sz-7)
-		if _, err := io.Copy(b, r); err != nil {
+		tag := Tag(l[5]) | Tag(l[6])<<8
+		// The server only changes msize during Tversion, which runs
+		// on its own, so it can't change under us here.
+		if msize := int64(c.server.Msize()); sz < 7 || sz > msize {
+			// Either the size is nonsense, or it's more than we're
+			// willing to read. Either way we have no way to find the
+			// next message. Say why, and give up on the connection.
+			c.reject(tag, "bad message size %d for %v: must be between 7 and msize %d", sz, RPCNames[t], msize)
+			return
+		}
+		reserved, err := c.admit(t, tag, sz)
+		if err != nil {
+			if _, err := io.CopyN(ioutil.Discard, c.Reader, sz-7); err != nil {
+				c.logf("readNetPackets: short read: %v", err)
+				c.fail(midMessage(err))
+				c.markDead()
+				return
+			}
+			c.metrics.read(sz)
+			c.metrics.reject()
+			c.logf("readNetPackets: %v", err)
+			c.sendError(tag, err)
+			continue
+		}
+		// The buffer holds the message from the tag on. CopyN reads
+		// with the buffer's ReadFrom, which wants MinRead bytes to
+		// spare even once there's no more to read.
+		b := getBuf(int(sz) - 5 + bytes.MinRead)
+		b.Write(l[5:])
+		if _, err := io.CopyN(b, c.Reader, sz-7); err != nil {
 			c.logf("readNetPackets: short read: %v", err)
-			c.dead = true
+			c.fail(midMessage(err))
+			putBuf(b)
+			c.release(reserved)
+			c.markDead()
 			return
 		}
-		c.logf("readNetPackets: got %v, len %d, sending to IO", RPCNames[MType(l[4])], b.Len())
-		//panic(fmt.Sprintf("packet is %v", b.Bytes()[:]))
-		//panic(fmt.Sprintf("s is %v", s))
-		if err := c.server.D(c.server, b, t); err != nil {
-			c.logf("%v: %v", RPCNames[MType(l[4])], err)
+		c.touch()
+		c.metrics.read(sz)
+		c.buffer(sz)
+		if c.tracing(LevelDebug) {
+			c.tracef(LevelDebug, "readNetPackets: got %v, len %d, sending to IO", RPCNames[MType(l[4])], b.Len())
+		}
+		if c.tracing(LevelWire) {
+			c.tracef(LevelWire, "%s", dumpMessage("<-", append(l[:5:5], b.Bytes()...)))
+		}
+
+		if t == Tversion {
+			// Tversion aborts everything outstanding, so let it all
+			// finish first, and don't read anything more until we're done.
+			c.wg.Wait()
+		}
+		req := c.startTag(tag, t, b)
+		if req == nil {
+			c.release(reserved)
+			c.buffer(-sz)
+			putBuf(b)
+			c.metrics.reject()
+			c.sendError(tag, fmt.Errorf("%v: server is shutting down", RPCNames[t]))
+			continue
+		}
+		req.reserved, req.size = reserved, sz
+		c.wg.Add(1)
+		switch t {
+		case Tversion:
+			c.dispatch(req)
+		case Tflush:
+			go c.flush(req)
+		default:
+			fid, ok := fidOf(b.Bytes())
+			if !ok {
+				go c.dispatch(req)
+				break
+			}
+			c.queue(fid, func() { c.dispatch(req) })
+		}
+	}
+}
+
+// admit decides whether to take on a request of type t, with tag tag,
+// whose message is sz bytes long: the tag must be one it may use, and
+// there must be room for it. If so it returns what it reserved against
+// limits.bytes, to be given back with release. If not, the error says
+// why.
+func (c *conn) admit(t MType, tag Tag, sz int64) (int64, error) {
+	if err := c.checkTag(t, tag); err != nil {
+		return 0, err
+	}
+	l := c.listener
+	if l == nil || t == Tversion || t == Tflush {
+		return 0, nil
+	}
+	if max := l.limits.requests; max > 0 {
+		c.mu.Lock()
+		n := len(c.tags)
+		c.mu.Unlock()
+		if n >= max {
+			return 0, fmt.Errorf("%v: too many requests: %d in progress on this connection", RPCNames[t], n)
+		}
+	}
+	if l.limits.bytes > 0 {
+		if !l.reserve(sz) {
+			return 0, fmt.Errorf("%v: too many requests: no room for %d more bytes", RPCNames[t], sz)
+		}
+		return sz, nil
+	}
+	return 0, nil
+}
+
+// checkTag returns an error if a request of type t may not use tag.
+// NOTAG is only for Tversion, and a tag may not be used again until
+// the request using it has been answered. Tversion waits for every
+// request before it to finish, so it can use any tag.
+func (c *conn) checkTag(t MType, tag Tag) error {
+	if t == Tversion {
+		return nil
+	}
+	if tag == NOTAG {
+		return fmt.Errorf("%v: NOTAG is only for Tversion", RPCNames[t])
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.tags[tag]; ok && !r.answered() {
+		return fmt.Errorf("%v: tag %d is in use by a %v", RPCNames[t], tag, RPCNames[r.t])
+	}
+	return nil
+}
+
+// buffer counts n more bytes in c.buffered, or, if n is negative,
+// -n fewer.
+func (c *conn) buffer(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bufferLocked(n)
+}
+
+func (c *conn) bufferLocked(n int64) {
+	c.buffered += n
+	if n < 0 {
+		c.room.Broadcast()
+	}
+}
+
+// waitForRoom waits until c.buffered is within limits.buffered, and
+// reports whether it is: if c fails first, it isn't.
+func (c *conn) waitForRoom() bool {
+	if c.listener == nil || c.listener.limits.buffered <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.buffered >= c.listener.limits.buffered && c.err == nil {
+		c.room.Wait()
+	}
+	return c.err == nil
+}
+
+// release gives back what admit reserved.
+func (c *conn) release(n int64) {
+	if n > 0 {
+		c.listener.release(n)
+	}
+}
+
+// readHeader reads the header of the next message into l. While no
+// message has begun, the deadline is that of waitDeadline; once one
+// has, the rest of it, body included, must arrive within the header
+// timeout.
+func (c *conn) readHeader(l []byte) error {
+	for n := 0; n < len(l); {
+		if n == 0 {
+			c.setReadDeadline(c.waitDeadline())
+		}
+		m, err := c.Read(l[n:])
+		if n == 0 && m > 0 {
+			var d time.Time
+			if c.timeouts.header > 0 {
+				d = time.Now().Add(c.timeouts.header)
+			}
+			c.setReadDeadline(d)
+		}
+		n += m
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
 		}
-		c.logf("readNetPackets: Write %v back", b)
-		amt, err := c.Write(b.Bytes())
 		if err != nil {
-			c.logf("readNetPackets: write error: %v", err)
-			c.dead = true
+			// A deadline passing while we're still busy, or after a
+			// reply has pushed it back, isn't the client's fault.
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 && time.Now().Before(c.waitDeadline()) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// waitDeadline returns how long we'll wait for the next message: until
+// the header timeout after connecting, if Tversion hasn't been done,
+// and otherwise until the idle timeout after the conn was last active,
+// or from now if it is busy.
+func (c *conn) waitDeadline() time.Time {
+	if !c.server.Versioned() && c.timeouts.header > 0 {
+		return c.start.Add(c.timeouts.header)
+	}
+	if c.timeouts.idle == 0 {
+		return time.Time{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.idleLocked() {
+		return time.Now().Add(c.timeouts.idle)
+	}
+	return c.lastActive.Add(c.timeouts.idle)
+}
+
+func (c *conn) setReadDeadline(t time.Time) {
+	if c.rd != nil {
+		c.rd.SetReadDeadline(t)
+	}
+}
+
+// touch notes that a message has been read or written.
+func (c *conn) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastActive = time.Now()
+}
+
+// dispatch runs one request and queues its reply. A request flushed
+// before it got to run is not run at all, and the reply to a flushed
+// request is dropped.
+func (c *conn) dispatch(r *request) {
+	defer c.wg.Done()
+	defer c.endTag(r)
+
+	c.mu.Lock()
+	r.started = true
+	ran := !r.flushed && r.ctx.Err() == nil
+	c.mu.Unlock()
+	if ran {
+		if err := c.server.D(r.ctx, c.server, r.b, r.t); err != nil {
+			c.tracef(LevelDebug, "%v: %v", RPCNames[r.t], err)
+		}
+	}
+
+	c.mu.Lock()
+	r.replied = ran && !r.flushed && !r.expired
+	failed := r.expired || r.replied && isError(r.b.Bytes())
+	c.mu.Unlock()
+	c.metrics.request(r.t, time.Since(r.arrived), failed)
+	switch {
+	case !r.replied:
+		r.body.close()
+		putBuf(r.b)
+	case c.checkReply(r) && r.body.r != nil:
+		// Whatever the body is read from must stay put until it has
+		// been written, so the next request on the FID, which might
+		// be a Tclunk, has to wait.
+		written := make(chan struct{})
+		c.sendReply(RPCReply{b: r.b.Bytes(), buf: r.b, body: r.body, written: written})
+		<-written
+	default:
+		c.send(r.b)
+	}
+}
+
+// checkReply replaces a reply too big for msize, which would be a
+// server bug, with an Rerror. The client would otherwise give up on
+// the connection, with no clue as to why. It reports whether the reply
+// was good.
+func (c *conn) checkReply(r *request) bool {
+	msize := c.server.Msize()
+	if n := int64(r.b.Len()) + r.body.n; n > int64(msize) {
+		err := fmt.Errorf("%v: reply of %d bytes is more than msize %d", RPCNames[r.t], n, msize)
+		c.logf("%v", err)
+		c.server.marshalRerror(r.b, r.tag, err)
+		r.body.close()
+		return false
+	}
+	return true
+}
+
+// flush answers a Tflush. If the request it names is still in flight,
+// its context is cancelled and its reply, if not already queued, is
+// dropped. The spec requires that Rflush not be sent until the flushed
+// request is finished with, so if it has started running we wait for it;
+// if it is still queued behind others on its FID it will never run.
+func (c *conn) flush(r *request) {
+	d := r.b.Bytes()
+	if len(d) >= 4 {
+		otag := Tag(d[2]) | Tag(d[3])<<8
+		c.mu.Lock()
+		o, ok := c.tags[otag]
+		ok = ok && o != r
+		var wait bool
+		if ok {
+			o.flushed = o.flushed || !o.replied
+			wait = o.started
+		}
+		c.mu.Unlock()
+		if ok {
+			o.cancel()
+		}
+		if wait {
+			<-o.done
+		}
+	}
+	c.dispatch(r)
+}
+
+// queue runs f after any requests already queued on fid.
+func (c *conn) queue(fid FID, f func()) {
+	c.mu.Lock()
+	q, busy := c.fids[fid]
+	c.fids[fid] = append(q, f)
+	c.mu.Unlock()
+	if !busy {
+		go c.runFID(fid)
+	}
+}
+
+// runFID runs the requests queued on fid until there are none left.
+func (c *conn) runFID(fid FID) {
+	for {
+		c.mu.Lock()
+		q := c.fids[fid]
+		if len(q) == 0 {
+			delete(c.fids, fid)
+			c.mu.Unlock()
 			return
 		}
-		c.logf("Returned %v amt %v", b, amt)
+		f := q[0]
+		c.fids[fid] = q[1:]
+		c.mu.Unlock()
+		f()
+	}
+}
+
+// startTag records a newly read request as in flight. If the conn is
+// draining it returns nil, and the request should be refused; only
+// Tflush, which can only hurry things along, is let through.
+func (c *conn) startTag(tag Tag, t MType, b *bytes.Buffer) *request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining && t != Tflush {
+		return nil
+	}
+	r := &request{tag: tag, t: t, b: b, arrived: time.Now(), done: make(chan struct{})}
+	if d := c.timeouts.forRequest(t); d > 0 {
+		// The deadline is for the NineServer, which can see it,
+		// and the timer for us, in case it doesn't look.
+		r.ctx, r.cancel = context.WithTimeout(c.ctx, d)
+		r.timer = time.AfterFunc(d, func() { c.expire(r) })
+	} else {
+		r.ctx, r.cancel = context.WithCancel(c.ctx)
+	}
+	if t == Tread {
+		r.ctx = context.WithValue(r.ctx, replyBodyKey{}, &r.body)
+	}
+	c.tags[tag] = r
+	return r
+}
+
+// expire answers r with an Rerror, and cancels it, because it has
+// taken longer than its timeout.
+func (c *conn) expire(r *request) {
+	c.mu.Lock()
+	if r.replied || r.flushed || c.tags[r.tag] != r {
+		c.mu.Unlock()
+		return
+	}
+	r.expired = true
+	// Until the Rerror is queued, serve mustn't close c.replies.
+	c.wg.Add(1)
+	defer c.wg.Done()
+	c.mu.Unlock()
+
+	r.cancel()
+	c.sendError(r.tag, fmt.Errorf("%v: %w after %v", RPCNames[r.t], ErrTimedOut, c.timeouts.forRequest(r.t)))
+}
+
+// endTag marks r as no longer in flight.
+func (c *conn) endTag(r *request) {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.cancel()
+	c.release(r.reserved)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bufferLocked(-r.size)
+	if c.tags[r.tag] == r {
+		delete(c.tags, r.tag)
+	}
+	close(r.done)
+}
+
+// reject answers tag with an Rerror, and marks the conn as dead. It is
+// for framing errors, after which we can't read any more messages.
+func (c *conn) reject(tag Tag, format string, args ...interface{}) {
+	m := fmt.Sprintf(format, args...)
+	c.logf("readNetPackets: %v", m)
+	c.metrics.reject()
+	c.fail(errors.New(m))
+	c.sendError(tag, errors.New(m))
+	c.markDead()
+}
+
+// send queues the reply in b, which is from getBuf, for writeReplies.
+// b goes back to the pool once it is written.
+func (c *conn) send(b *bytes.Buffer) {
+	c.sendReply(RPCReply{b: b.Bytes(), buf: b})
+}
+
+func (c *conn) sendReply(r RPCReply) {
+	c.mu.Lock()
+	c.unwritten++
+	c.bufferLocked(int64(len(r.b)))
+	c.mu.Unlock()
+	c.replies <- r
+}
+
+// sendError queues an Rerror for tag.
+func (c *conn) sendError(tag Tag, err error) {
+	b := getBuf(0)
+	c.server.marshalRerror(b, tag, err)
+	c.send(b)
+}
+
+// drain makes c refuse new requests.
+func (c *conn) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+}
+
+// closed tells the NineServer, if it wants to know, that c is done with.
+func (c *conn) closed() {
+	if cn, ok := c.server.NS.(ClosingNineServer); ok {
+		cn.ConnClosed()
 	}
 }
 
+// idle reports whether c has no requests in progress, and no replies
+// waiting to be written.
+func (c *conn) idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.idleLocked()
+}
+
+func (c *conn) idleLocked() bool {
+	return len(c.tags) == 0 && c.unwritten == 0
+}
+
+// fail notes err as why c ended, unless it has a reason already.
+func (c *conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		c.room.Broadcast()
+	}
+}
+
+// hungUp notes why reading the next message failed: if it is because
+// the client hung up, or because we closed c, as Shutdown does once it
+// is idle, it isn't a failure.
+func (c *conn) hungUp(err error) {
+	c.mu.Lock()
+	draining := c.draining
+	c.mu.Unlock()
+	if err != io.EOF && !draining {
+		c.fail(err)
+	}
+}
+
+// reason returns why c ended: nil, or what fail was told first.
+func (c *conn) reason() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// midMessage returns err, from reading the rest of a message, as an
+// error: a client which hangs up part way through a message hasn't
+// hung up cleanly.
+func midMessage(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (c *conn) markDead() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dead = true
+}
+
+// writeReplies writes replies to the connection until c.replies is
+// closed. Once a write fails the connection is closed, so that serve
+// stops reading, and the remaining replies are discarded.
+func (c *conn) writeReplies() {
+	var failed bool
+	for r := range c.replies {
+		if !failed {
+			failed = !c.writeReply(r.b)
+		}
+		if r.written != nil {
+			if !failed {
+				failed = !c.writeBody(r.body)
+			}
+			r.body.close()
+			close(r.written)
+		}
+		putBuf(r.buf)
+		c.mu.Lock()
+		c.unwritten--
+		c.bufferLocked(-int64(len(r.b)))
+		c.lastActive = time.Now()
+		c.mu.Unlock()
+	}
+}
+
+// writeReply writes one reply, and reports whether it could. If it
+// couldn't, the connection is dead, and no more replies are written.
+func (c *conn) writeReply(b []byte) bool {
+	if c.tracing(LevelDebug) {
+		c.tracef(LevelDebug, "readNetPackets: Write %v back", b)
+	}
+	if c.tracing(LevelWire) {
+		c.tracef(LevelWire, "%s", dumpMessage("->", b))
+	}
+	amt, err := writeAll(c, b)
+	c.metrics.wrote(int64(amt))
+	if err != nil {
+		c.logf("readNetPackets: write error after %d of %d bytes: %v", amt, len(b), err)
+		c.fail(err)
+		c.markDead()
+		c.Close()
+		return false
+	}
+	if c.tracing(LevelDebug) {
+		c.tracef(LevelDebug, "Returned %v amt %v", b, amt)
+	}
+	return true
+}
+
+// writeBody writes the streamed part of a reply. The reply's size has
+// been sent already, so if the body comes up short there is no way to
+// finish the reply honestly, and the connection is closed instead.
+func (c *conn) writeBody(body replyBody) bool {
+	src := &readErr{r: body.r}
+	amt, err := io.CopyN(c.Writer, src, body.n)
+	c.metrics.wrote(amt)
+	if err != nil {
+		if err == src.err {
+			err = fmt.Errorf("reply body short by %d bytes: %w", body.n-amt, err)
+			c.logf("writeBody: %v; closing the connection", err)
+		} else {
+			c.logf("writeBody: write error after %d of %d bytes of reply body: %v", amt, body.n, err)
+		}
+		c.fail(err)
+		c.markDead()
+		c.Close()
+		return false
+	}
+	return true
+}
+
+// writeAll writes all of b to w. A short write leaves the peer part way
+// through a message, with no way to find the start of the next, so the
+// only choices are to finish it or give up on the connection. Not every
+// Writer returns an error when it writes less than it was given, so we
+// keep going until it's all written or it stops making progress.
+func writeAll(w io.Writer, b []byte) (int, error) {
+	var tot int
+	for tot < len(b) {
+		n, err := w.Write(b[tot:])
+		tot += n
+		if err != nil {
+			return tot, err
+		}
+		if n == 0 {
+			return tot, io.ErrShortWrite
+		}
+	}
+	return tot, nil
+}
+
+// fidOf returns the FID named by a T-message, given the message
+// from the tag onward. Every T-message we dispatch, other than
+// Tversion and Tflush, starts with a FID.
+func fidOf(b []byte) (FID, bool) {
+	if len(b) < 6 {
+		return 0, false
+	}
+	return FID(b[2]) | FID(b[3])<<8 | FID(b[4])<<16 | FID(b[5])<<24, true
+}
+
 // Dispatch dispatches request to different functions.
 // It's also the the first place we try to establish server semantics.
 // We could do this with interface assertions and such a la rsc/fuse
 // but most people I talked do disliked that. So we don't. If you want
 // to make things optional, just define the ones you want to implement in this case.
-func Dispatch(s *Server, b *bytes.Buffer, t MType) error {
-	switch t {
-	case Tversion:
-		s.Versioned = true
-	default:
-		if !s.Versioned {
-			m := fmt.Sprintf("Dispatch: %v not allowed before Tversion", RPCNames[t])
-			// Yuck. Provide helper.
-			d := b.Bytes()
-			MarshalRerrorPkt(b, Tag(d[0])|Tag(d[1])<<8, m)
-			return fmt.Errorf("Dispatch: %v not allowed before Tversion", RPCNames[t])
+func Dispatch(ctx context.Context, s *Server, b *bytes.Buffer, t MType) error {
+	if t == Tversion {
+		return s.version(ctx, b)
+	}
+	ss := s.session()
+	if !ss.versioned {
+		s.ReplyError(b, tagOf(b), "Dispatch: %v not allowed before Tversion", RPCNames[t])
+		return fmt.Errorf("Dispatch: %v not allowed before Tversion", RPCNames[t])
+	}
+	fid, nwname, ok := newFIDOf(t, b.Bytes())
+	ofid, opens := openFIDOf(t, b.Bytes())
+	err := s.dispatch(ctx, ss, b, t)
+	if ok {
+		s.addFID(t, fid, nwname, b.Bytes())
+	}
+	if opens {
+		s.openFID(t, ofid, b.Bytes())
+	}
+	return err
+}
+
+// version answers a Tversion, which starts a new session. The FIDs of
+// the old one are clunked, as if by Tclunk, and the msize and dialect
+// are whatever the new one settles on.
+func (s *Server) version(ctx context.Context, b *bytes.Buffer) error {
+	s.mu.Lock()
+	fids := s.fids
+	s.sess, s.fids, s.afids = session{versioned: true}, nil, nil
+	s.mu.Unlock()
+	for fid := range fids {
+		if err := s.NS.Rclunk(ctx, fid); err != nil {
+			Debug("Tversion: clunk of %v: %v", fid, err)
 		}
 	}
 
+	asked, av, t, _ := UnmarshalTversionPkt(bytes.NewBuffer(b.Bytes()))
+	if !s.negotiateVersion(b) {
+		s.unknownVersion(b, t, asked)
+		return nil
+	}
+	if err := s.SrvRversion(ctx, b); err != nil {
+		return err
+	}
+	d := b.Bytes()
+	if len(d) < 5 || MType(d[4]) != Rversion {
+		// The server turned the version down: the client must
+		// ask for another, not give up.
+		Debug("Tversion: %v turned down", av)
+		s.unknownVersion(b, t, asked)
+		return nil
+	}
+	msize, v, _, err := UnmarshalRversionPkt(bytes.NewBuffer(d[5:]))
+	if err != nil {
+		return nil
+	}
+	// The Rversion can't offer more than was asked for, nor more than
+	// we can take.
+	max := MaxSize(MSIZE)
+	if asked < max {
+		max = asked
+	}
+	if msize > max {
+		msize = max
+		MarshalRversionPkt(b, t, msize, v)
+	}
+	s.mu.Lock()
+	s.sess = session{versioned: true, msize: msize, dotu: v == VersionU, dotl: v == VersionL}
+	s.mu.Unlock()
+	return nil
+}
+
+// unknownVersion replies to a Tversion for a version which isn't to be
+// had with an Rversion for VersionUnknown, as the protocol says to,
+// rather than an Rerror. There is no session until the client asks for
+// one the server knows.
+func (s *Server) unknownVersion(b *bytes.Buffer, t Tag, msize MaxSize) {
+	if msize > MSIZE {
+		msize = MSIZE
+	}
+	s.mu.Lock()
+	s.sess = session{}
+	s.mu.Unlock()
+	MarshalRversionPkt(b, t, msize, VersionUnknown)
+}
+
+// dispatch runs a request, other than Tversion, in the session ss.
+func (s *Server) dispatch(ctx context.Context, ss session, b *bytes.Buffer, t MType) error {
+	if f, ok := dispatchL[t]; ok && ss.dotl {
+		if t == Treaddir {
+			// Treaddir's count is where Tread's is.
+			clampRead(b, ss.size())
+		}
+		return f(s, ctx, b)
+	}
+
 	switch t {
-	case Tversion:
-		return s.SrvRversion(b)
+	case Tauth:
+		if ss.dotu || ss.dotl {
+			return s.srvRauthU(ctx, b)
+		}
+		return s.SrvRauth(ctx, b)
 	case Tattach:
-		return s.SrvRattach(b)
+		// Servers that don't do authentication have never cared
+		// what's in the afid, and nor have clients talking to them.
+		_, auth := s.NS.(AuthNineServer)
+		if afid, ok := afidOf(b.Bytes()); auth && ok && afid != NOFID && !s.isAFID(afid) {
+			s.ReplyError(b, tagOf(b), "Tattach: %v is not an authentication fid", afid)
+			return nil
+		}
+		if ss.dotu || ss.dotl {
+			return s.srvRattachU(ctx, b)
+		}
+		return s.SrvRattach(ctx, b)
 	case Tflush:
-		return s.SrvRflush(b)
+		return s.SrvRflush(ctx, b)
 	case Twalk:
-		return s.SrvRwalk(b)
+		if err := s.checkWalk(b.Bytes()); err != nil {
+			s.marshalRerror(b, tagOf(b), err)
+			return nil
+		}
+		return s.SrvRwalk(ctx, b)
 	case Topen:
-		return s.SrvRopen(b)
+		return s.SrvRopen(ctx, b)
 	case Tcreate:
-		return s.SrvRcreate(b)
+		if ss.dotu {
+			return s.srvRcreateU(ctx, b)
+		}
+		return s.SrvRcreate(ctx, b)
 	case Tclunk:
-		return s.SrvRclunk(b)
+		s.dropFID(b.Bytes())
+		return s.SrvRclunk(ctx, b)
 	case Tstat:
-		return s.SrvRstat(b)
+		return s.SrvRstat(ctx, b)
 	case Twstat:
-		return s.SrvRwstat(b)
+		return s.SrvRwstat(ctx, b)
 	case Tremove:
-		return s.SrvRremove(b)
+		s.dropFID(b.Bytes())
+		return s.SrvRremove(ctx, b)
 	case Tread:
-		return s.SrvRread(b)
+		clampRead(b, ss.size())
+		if body, ok := ctx.Value(replyBodyKey{}).(*replyBody); ok {
+			if _, ok := s.NS.(StreamNineServer); ok {
+				if done, err := s.srvRstream(ctx, b, body); done {
+					return err
+				}
+			}
+		}
+		if _, ok := s.NS.(ReadIntoNineServer); ok {
+			return s.srvRreadInto(ctx, b)
+		}
+		return s.SrvRread(ctx, b)
 	case Twrite:
-		return s.SrvRwrite(b)
+		return s.SrvRwrite(ctx, b)
 	}
 
 	// This has been tested by removing Attach from the switch.
-	ServerError(b, fmt.Sprintf("Dispatch: %v not supported", RPCNames[t]))
+	s.marshalRerror(b, tagOf(b), notSupported(t))
+	return nil
+}
+
+// srvRreadInto is SrvRread for a ReadIntoNineServer. The data is read
+// into b after the Rread header, rather than being copied there.
+func (s *Server) srvRreadInto(ctx context.Context, b *bytes.Buffer) error {
+	OFID, Off, Len, t, err := UnmarshalTreadPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tread], err)
+		return err
+	}
+	MarshalRreadPkt(b, t, nil)
+	b.Grow(int(Len) + bytes.MinRead)
+	// ReadFrom reads into the room we just made. The one Read does
+	// the whole read, and the next says that's all.
+	var done bool
+	_, err = b.ReadFrom(readerFunc(func(p []byte) (int, error) {
+		if done {
+			return 0, io.EOF
+		}
+		done = true
+		if len(p) > int(Len) {
+			p = p[:Len]
+		}
+		return s.NS.(ReadIntoNineServer).RreadInto(ctx, OFID, Off, p)
+	}))
+	if err != nil {
+		s.marshalRerror(b, t, err)
+		return nil
+	}
+	d := b.Bytes()
+	l, n := len(d), len(d)-11
+	copy(d, []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	copy(d[7:], []byte{uint8(n), uint8(n >> 8), uint8(n >> 16), uint8(n >> 24)})
+	return nil
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// SrvRauth is written by hand, unlike the other SrvR functions,
+// because not every NineServer is an AuthNineServer.
+func (s *Server) SrvRauth(ctx context.Context, b *bytes.Buffer) (err error) {
+	AFID, Uname, Aname, t, err := UnmarshalTauthPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tauth], err)
+		return err
+	}
+	a, ok := s.NS.(AuthNineServer)
+	if !ok {
+		s.ReplyError(b, t, "authentication not required")
+		return nil
+	}
+	if AQID, err := a.Rauth(ctx, AFID, Uname, Aname); err != nil {
+		s.marshalRerror(b, t, err)
+	} else {
+		s.mu.Lock()
+		if s.afids == nil {
+			s.afids = make(map[FID]bool)
+		}
+		s.afids[AFID] = true
+		s.mu.Unlock()
+		MarshalRauthPkt(b, t, AQID)
+	}
+	return nil
+}
+
+func (s *Server) isAFID(f FID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.afids[f]
+}
+
+// dropFID forgets the FID in a Tclunk or Tremove, given from the tag
+// onward. Either way the FID is gone afterwards.
+func (s *Server) dropFID(b []byte) {
+	if f, ok := fidOf(b); ok {
+		s.mu.Lock()
+		delete(s.afids, f)
+		delete(s.fids, f)
+		s.mu.Unlock()
+	}
+}
+
+// newFIDOf returns the FID that a Tattach, Tauth, Twalk or Txattrwalk,
+// given from the tag onward, sets up if it succeeds, and for Twalk the
+// number of names, all of which must be walked for it to succeed.
+func newFIDOf(t MType, b []byte) (f FID, nwname int, ok bool) {
+	switch t {
+	case Tattach, Tauth:
+		f, ok = fidOf(b)
+		return f, 0, ok
+	case Twalk, Txattrwalk:
+		if len(b) < 10 {
+			return 0, 0, false
+		}
+		if t == Twalk && len(b) >= 12 {
+			nwname = int(b[10]) | int(b[11])<<8
+		}
+		return FID(b[6]) | FID(b[7])<<8 | FID(b[8])<<16 | FID(b[9])<<24, nwname, true
+	}
+	return 0, 0, false
+}
+
+// addFID notes f, from newFIDOf, as set up if the reply to the request
+// of type t says so.
+func (s *Server) addFID(t MType, f FID, nwname int, reply []byte) {
+	if len(reply) < 7 || MType(reply[4]) != t+1 {
+		return
+	}
+	if t == Twalk && (len(reply) < 9 || int(reply[7])|int(reply[8])<<8 != nwname) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fids == nil {
+		s.fids = make(map[FID]bool)
+	}
+	s.fids[f] = false
+}
+
+// openFIDOf returns the FID that a Topen, Tcreate, Tlopen or Tlcreate,
+// given from the tag onward, opens if it succeeds.
+func openFIDOf(t MType, b []byte) (FID, bool) {
+	switch t {
+	case Topen, Tcreate, Tlopen, Tlcreate:
+		return fidOf(b)
+	}
+	return 0, false
+}
+
+// openFID notes f, from openFIDOf, as opened if the reply to the
+// request of type t says so.
+func (s *Server) openFID(t MType, f FID, reply []byte) {
+	if len(reply) < 7 || MType(reply[4]) != t+1 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.fids[f]; ok {
+		s.fids[f] = true
+	}
+}
+
+// checkWalk checks a Twalk, given from the tag onward, against the rules
+// the NineServer is spared: the FID must not have been opened, and no
+// name may hold a slash or a NUL, as none could name a file in one
+// directory. The number of names is checked when it is unmarshaled.
+// A Twalk too short for what it says it holds is left to that too.
+func (s *Server) checkWalk(b []byte) error {
+	f, ok := fidOf(b)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	open := s.fids[f]
+	s.mu.Unlock()
+	if open {
+		return ErrFIDOpen
+	}
+	if len(b) < 12 {
+		return nil
+	}
+	n := int(b[10]) | int(b[11])<<8
+	if n > MaxWElem {
+		return nil
+	}
+	b = b[12:]
+	for i := 0; i < n && len(b) >= 2; i++ {
+		l := int(b[0]) | int(b[1])<<8
+		if len(b) < 2+l {
+			break
+		}
+		if bytes.ContainsAny(b[2:2+l], "/\x00") {
+			return ErrBadWalkName
+		}
+		b = b[2+l:]
+	}
 	return nil
 }
+
+// afidOf returns the afid in a Tattach, given from the tag onward.
+func afidOf(b []byte) (FID, bool) {
+	if len(b) < 10 {
+		return 0, false
+	}
+	return FID(b[6]) | FID(b[7])<<8 | FID(b[8])<<16 | FID(b[9])<<24, true
+}
+
+// clampRead reduces the count in a Tread, given from the tag onward,
+// so that the Rread will fit in msize.
+func clampRead(b *bytes.Buffer, msize MaxSize) {
+	d := b.Bytes()
+	if len(d) < 18 || msize <= IOHDRSZ {
+		return
+	}
+	max := uint32(msize - IOHDRSZ)
+	c := uint32(d[14]) | uint32(d[15])<<8 | uint32(d[16])<<16 | uint32(d[17])<<24
+	if c > max {
+		d[14], d[15], d[16], d[17] = uint8(max), uint8(max>>8), uint8(max>>16), uint8(max>>24)
+	}
+}
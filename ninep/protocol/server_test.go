@@ -0,0 +1,2176 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// slowFID is the FID on which reads block until released.
+	slowFID = 10
+	// bigFID is the FID on which reads return as much as was asked for.
+	bigFID = 3
+)
+
+// slow is an echo server whose reads on slowFID block until release
+// is closed or the request is cancelled. It records the order in which
+// requests on slowFID ran.
+type slow struct {
+	*echo
+	started chan struct{}
+	release chan struct{}
+
+	mu  sync.Mutex
+	ops []string
+}
+
+func newSlow() *slow {
+	return &slow{
+		echo:    newEcho(),
+		started: make(chan struct{}, NumTags),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *slow) record(op string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, op)
+}
+
+func (s *slow) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
+	if f == bigFID {
+		return make([]byte, c), nil
+	}
+	if f != slowFID {
+		return s.echo.Rread(ctx, f, o, c)
+	}
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		s.record("cancelled")
+		return nil, ctx.Err()
+	}
+	s.record("read")
+	return []byte("SLOW"), nil
+}
+
+func (s *slow) Rclunk(ctx context.Context, f FID) error {
+	if f != slowFID {
+		return s.echo.Rclunk(ctx, f)
+	}
+	s.record("clunk")
+	return nil
+}
+
+func (s *slow) Rflush(ctx context.Context, o Tag) error {
+	return nil
+}
+
+// newTestConn returns the client end of a connection served by ns.
+// Tversion has been done.
+func newTestConn(t *testing.T, ns NineServer) net.Conn {
+	_, c := newListenerConn(t, ns)
+	return c
+}
+
+// newListenerConn is newTestConn, but returns the NetListener too,
+// which is made with opts.
+func newListenerConn(t *testing.T, ns NineServer, opts ...NetListenerOpt) (*NetListener, net.Conn) {
+	p, p2 := net.Pipe()
+	l, err := NewNetListener(func() NineServer { return ns }, opts...)
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	if err := l.Accept(p2); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	var b bytes.Buffer
+	MarshalTversionPkt(&b, NOTAG, 8192, "9P2000")
+	if _, err := p.Write(b.Bytes()); err != nil {
+		t.Fatalf("Write Tversion: want nil, got %v", err)
+	}
+	if typ, _ := readReply(t, p); typ != Rversion {
+		t.Fatalf("Tversion: want Rversion, got %v", RPCNames[typ])
+	}
+	return l, p
+}
+
+// readReply reads one message from c, returning its type and the rest
+// of the message from the tag on.
+func readReply(t *testing.T, c net.Conn) (MType, *bytes.Buffer) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	l := make([]byte, 7)
+	if _, err := io.ReadFull(c, l); err != nil {
+		t.Fatalf("reading reply header: %v", err)
+	}
+	sz := int64(l[0]) + int64(l[1])<<8 + int64(l[2])<<16 + int64(l[3])<<24
+	b := bytes.NewBuffer(l[5:])
+	if _, err := io.CopyN(b, c, sz-7); err != nil {
+		t.Fatalf("reading reply body: %v", err)
+	}
+	return MType(l[4]), b
+}
+
+// noReply fails if c has anything to read within a short time.
+func noReply(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	defer c.SetReadDeadline(time.Time{})
+	var l [1]byte
+	if n, err := c.Read(l[:]); err == nil {
+		t.Fatalf("read %d bytes, want nothing", n)
+	}
+}
+
+func send(t *testing.T, c net.Conn, b *bytes.Buffer) {
+	t.Helper()
+	if _, err := c.Write(b.Bytes()); err != nil {
+		t.Fatalf("Write: want nil, got %v", err)
+	}
+}
+
+func TestSlowReadDoesNotBlock(t *testing.T) {
+	s := newSlow()
+	c := newTestConn(t, s)
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-s.started
+
+	MarshalTreadPkt(&b, 2, 2, 0, 5)
+	send(t, c, &b)
+	typ, rb := readReply(t, c)
+	if typ != Rread {
+		t.Fatalf("fast Tread: want Rread, got %v", RPCNames[typ])
+	}
+	d, tag, err := UnmarshalRreadPkt(rb)
+	if err != nil || tag != 2 || string(d) != "HI" {
+		t.Fatalf("fast Tread: want (\"HI\", 2, nil), got (%q, %v, %v)", d, tag, err)
+	}
+
+	close(s.release)
+	typ, rb = readReply(t, c)
+	if typ != Rread {
+		t.Fatalf("slow Tread: want Rread, got %v", RPCNames[typ])
+	}
+	d, tag, err = UnmarshalRreadPkt(rb)
+	if err != nil || tag != 1 || string(d) != "SLOW" {
+		t.Fatalf("slow Tread: want (\"SLOW\", 1, nil), got (%q, %v, %v)", d, tag, err)
+	}
+}
+
+func TestTagInUse(t *testing.T) {
+	s := newSlow()
+	l, c := newListenerConn(t, s)
+	defer c.Close()
+	inUse := func() string {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for sc := range l.conns {
+			return sc.String()
+		}
+		return ""
+	}
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-s.started
+	if got := inUse(); !strings.Contains(got, " 1 tags in use") {
+		t.Errorf("conn String: want 1 tag in use, got %q", got)
+	}
+
+	// A tag in use can't be used again, even on another FID, and
+	// nothing but Tversion can use NOTAG.
+	MarshalTreadPkt(&b, 1, 2, 0, 5)
+	send(t, c, &b)
+	if e := expectRerror(t, c, 1); !strings.Contains(e, "tag 1 is in use") {
+		t.Errorf("Tread with a tag in use: want an Rerror saying so, got %q", e)
+	}
+	MarshalTclunkPkt(&b, NOTAG, 2)
+	send(t, c, &b)
+	if e := expectRerror(t, c, NOTAG); !strings.Contains(e, "NOTAG") {
+		t.Errorf("Tclunk with NOTAG: want an Rerror saying so, got %q", e)
+	}
+
+	close(s.release)
+	typ, rb := readReply(t, c)
+	if typ != Rread {
+		t.Fatalf("slow Tread: want Rread, got %v", RPCNames[typ])
+	}
+	d, tag, err := UnmarshalRreadPkt(rb)
+	if err != nil || tag != 1 || string(d) != "SLOW" {
+		t.Fatalf("slow Tread: want (\"SLOW\", 1, nil), got (%q, %v, %v)", d, tag, err)
+	}
+
+	// Once it's answered, the tag can be used again, at once.
+	for i := 0; i < 100; i++ {
+		MarshalTreadPkt(&b, 1, 2, 0, 5)
+		if _, tag, err := UnmarshalRreadPkt(call(t, c, &b, Rread)); err != nil || tag != 1 {
+			t.Fatalf("Tread with tag 1 again: want (1, nil), got (%v, %v)", tag, err)
+		}
+	}
+}
+
+func TestFIDOrdering(t *testing.T) {
+	s := newSlow()
+	c := newTestConn(t, s)
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-s.started
+	MarshalTclunkPkt(&b, 2, slowFID)
+	send(t, c, &b)
+
+	// The clunk must wait for the read on the same FID.
+	noReply(t, c)
+	close(s.release)
+
+	for _, want := range []MType{Rread, Rclunk} {
+		if typ, _ := readReply(t, c); typ != want {
+			t.Fatalf("reply: want %v, got %v", RPCNames[want], RPCNames[typ])
+		}
+	}
+	if fmt.Sprint(s.ops) != "[read clunk]" {
+		t.Errorf("ops: want [read clunk], got %v", s.ops)
+	}
+}
+
+func TestFlushBeforeReply(t *testing.T) {
+	s := newSlow()
+	c := newTestConn(t, s)
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-s.started
+	MarshalTflushPkt(&b, 3, 1)
+	send(t, c, &b)
+
+	// The read is cancelled and its reply dropped: all we get is Rflush.
+	typ, rb := readReply(t, c)
+	if typ != Rflush {
+		t.Fatalf("reply: want Rflush, got %v", RPCNames[typ])
+	}
+	if tag, err := UnmarshalRflushPkt(rb); err != nil || tag != 3 {
+		t.Fatalf("Rflush: want (3, nil), got (%v, %v)", tag, err)
+	}
+	noReply(t, c)
+	if fmt.Sprint(s.ops) != "[cancelled]" {
+		t.Errorf("ops: want [cancelled], got %v", s.ops)
+	}
+}
+
+func TestFlushAfterReply(t *testing.T) {
+	s := newSlow()
+	c := newTestConn(t, s)
+	defer c.Close()
+	close(s.release)
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	if typ, _ := readReply(t, c); typ != Rread {
+		t.Fatalf("reply: want Rread, got %v", RPCNames[typ])
+	}
+	// Tag 1 is no longer in flight, so there is nothing to flush.
+	MarshalTflushPkt(&b, 3, 1)
+	send(t, c, &b)
+	if typ, _ := readReply(t, c); typ != Rflush {
+		t.Fatalf("reply: want Rflush, got %v", RPCNames[typ])
+	}
+	if fmt.Sprint(s.ops) != "[read]" {
+		t.Errorf("ops: want [read], got %v", s.ops)
+	}
+}
+
+// TestFlushQueued flushes a request which is waiting behind another
+// on the same FID. It never runs, and Rflush need not wait for it.
+func TestFlushQueued(t *testing.T) {
+	s := newSlow()
+	c := newTestConn(t, s)
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-s.started
+	MarshalTclunkPkt(&b, 2, slowFID)
+	send(t, c, &b)
+	MarshalTflushPkt(&b, 3, 2)
+	send(t, c, &b)
+	if typ, _ := readReply(t, c); typ != Rflush {
+		t.Fatalf("reply: want Rflush, got %v", RPCNames[typ])
+	}
+
+	close(s.release)
+	if typ, _ := readReply(t, c); typ != Rread {
+		t.Fatalf("reply: want Rread, got %v", RPCNames[typ])
+	}
+	noReply(t, c)
+	if fmt.Sprint(s.ops) != "[read]" {
+		t.Errorf("ops: want [read], got %v", s.ops)
+	}
+}
+
+// TestFlushRace sends a Tflush hard on the heels of a fast request,
+// many times over. Whichever wins, the client must see either the
+// reply followed by Rflush, or Rflush alone.
+func TestFlushRace(t *testing.T) {
+	c := newTestConn(t, newSlow())
+	defer c.Close()
+
+	var b bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		MarshalTreadPkt(&b, 1, 2, 0, 5)
+		send(t, c, &b)
+		MarshalTflushPkt(&b, 3, 1)
+		send(t, c, &b)
+
+		typ, _ := readReply(t, c)
+		if typ == Rread {
+			typ, _ = readReply(t, c)
+		}
+		if typ != Rflush {
+			t.Fatalf("iteration %d: want Rflush, got %v", i, RPCNames[typ])
+		}
+	}
+}
+
+// TestInterleaved runs many slow and fast requests at once, and
+// checks that every one of them gets the right reply.
+func TestInterleaved(t *testing.T) {
+	p, p2 := net.Pipe()
+	c, err := NewClient(func(c *Client) error {
+		c.FromNet, c.ToNet = p, p
+		c.Msize = 8192
+		c.Trace = func(string, ...interface{}) {}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	s := newSlow()
+	l, err := NewNetListener(func() NineServer { return s })
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	if err := l.Accept(p2); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	if _, _, err := c.CallTversion(8192, "9P2000"); err != nil {
+		t.Fatalf("CallTversion: want nil, got %v", err)
+	}
+
+	const n = 64
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			d, err := c.CallTread(slowFID, 0, 5)
+			if err == nil && string(d) != "SLOW" {
+				err = fmt.Errorf("slow CallTread: want \"SLOW\", got %q", d)
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			d, err := c.CallTread(2, 0, 5)
+			if err == nil && string(d) != "HI" {
+				err = fmt.Errorf("fast CallTread: want \"HI\", got %q", d)
+			}
+			errs <- err
+		}()
+	}
+
+	// The first slow read holds up the others on its FID, but none
+	// of the fast ones.
+	<-s.started
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(s.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMessageTooBig(t *testing.T) {
+	c := newTestConn(t, newSlow())
+	defer c.Close()
+
+	// A 4GB Tread. All we send is the header.
+	send(t, c, bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, uint8(Tread), 1, 0}))
+	typ, b := readReply(t, c)
+	if typ != Rerror {
+		t.Fatalf("reply: want Rerror, got %v", RPCNames[typ])
+	}
+	e, tag, err := UnmarshalRerrorPkt(b)
+	if err != nil || tag != 1 {
+		t.Fatalf("Rerror: want tag 1, got (%q, %v, %v)", e, tag, err)
+	}
+	t.Logf("Rerror is %q", e)
+
+	// There's no finding the next message after that, so the
+	// server hangs up.
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read after Rerror: want (0, EOF), got (%d, %v)", n, err)
+	}
+}
+
+func TestReadClampedToMsize(t *testing.T) {
+	c := newTestConn(t, newSlow())
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, bigFID, 0, 100000)
+	send(t, c, &b)
+	typ, rb := readReply(t, c)
+	if typ != Rread {
+		t.Fatalf("reply: want Rread, got %v", RPCNames[typ])
+	}
+	if rb.Len()+5 > 8192 {
+		t.Errorf("Rread is %d bytes, want at most msize 8192", rb.Len()+5)
+	}
+	d, _, err := UnmarshalRreadPkt(rb)
+	if err != nil {
+		t.Fatalf("UnmarshalRreadPkt: want nil, got %v", err)
+	}
+	if len(d) != 8192-IOHDRSZ {
+		t.Errorf("Rread data: want %d bytes, got %d", 8192-IOHDRSZ, len(d))
+	}
+}
+
+func TestClampRead(t *testing.T) {
+	const msize = 8192 + IOHDRSZ
+	for _, tt := range []struct {
+		msize MaxSize
+		count Count
+		want  Count
+	}{
+		{msize, 8191, 8191},
+		{msize, 8192, 8192},
+		{msize, 8193, 8192},
+		{msize, 1 << 20, 8192},
+		{msize, 1<<31 - 1, 8192},
+		// Too small an msize to say anything about.
+		{IOHDRSZ, 100, 100},
+	} {
+		var b bytes.Buffer
+		MarshalTreadPkt(&b, 1, 2, 3, tt.count)
+		b.Next(5)
+		clampRead(&b, tt.msize)
+		fid, o, c, tag, err := UnmarshalTreadPkt(&b)
+		if err != nil || tag != 1 || fid != 2 || o != 3 || c != tt.want {
+			t.Errorf("count %d in msize %d: want count %d, got (%d, %d, %d, %d, %v)", tt.count, tt.msize, tt.want, fid, o, c, tag, err)
+		}
+	}
+}
+
+// expectRerror reads a reply and fails unless it is an Rerror for tag.
+func expectRerror(t *testing.T, c net.Conn, tag Tag) string {
+	t.Helper()
+	typ, b := readReply(t, c)
+	if typ != Rerror {
+		t.Fatalf("reply: want Rerror, got %v", RPCNames[typ])
+	}
+	e, rtag, err := UnmarshalRerrorPkt(b)
+	if err != nil || rtag != tag {
+		t.Fatalf("Rerror: want tag %d, got (%q, %v, %v)", tag, e, rtag, err)
+	}
+	return e
+}
+
+// expectEOF fails unless the server has hung up.
+func expectEOF(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read: want (0, EOF), got (%d, %v)", n, err)
+	}
+}
+
+func TestMessageTooSmall(t *testing.T) {
+	for _, sz := range []uint8{0, 3, 6} {
+		t.Run(fmt.Sprint(sz), func(t *testing.T) {
+			c := newTestConn(t, newSlow())
+			defer c.Close()
+
+			send(t, c, bytes.NewBuffer([]byte{sz, 0, 0, 0, uint8(Tclunk), 1, 0}))
+			t.Logf("Rerror is %q", expectRerror(t, c, 1))
+			expectEOF(t, c)
+		})
+	}
+}
+
+func TestShortMessage(t *testing.T) {
+	c := newTestConn(t, newSlow())
+	defer c.Close()
+
+	// A Tread with nothing after the tag.
+	send(t, c, bytes.NewBuffer([]byte{7, 0, 0, 0, uint8(Tread), 1, 0}))
+	t.Logf("Rerror is %q", expectRerror(t, c, 1))
+
+	// A Twrite which claims more data than it carries.
+	var b bytes.Buffer
+	MarshalTwritePkt(&b, 2, bigFID, 0, []byte("hi"))
+	d := b.Bytes()
+	d[19], d[20] = 0xff, 0xff
+	send(t, c, &b)
+	t.Logf("Rerror is %q", expectRerror(t, c, 2))
+
+	// A Twalk whose element count is far more than it carries.
+	b.Reset()
+	MarshalTwalkPkt(&b, 3, bigFID, bigFID+1, []string{"a"})
+	d = b.Bytes()
+	d[15], d[16] = 0xff, 0xff
+	send(t, c, &b)
+	t.Logf("Rerror is %q", expectRerror(t, c, 3))
+
+	// The framing was fine, so the connection is still usable.
+	b.Reset()
+	MarshalTreadPkt(&b, 4, bigFID, 0, 10)
+	send(t, c, &b)
+	if typ, _ := readReply(t, c); typ != Rread {
+		t.Fatalf("reply: want Rread, got %v", RPCNames[typ])
+	}
+}
+
+func TestTruncatedMessage(t *testing.T) {
+	s := newSlow()
+	c := newTestConn(t, s)
+
+	// A Tclunk which stops halfway through the FID.
+	send(t, c, bytes.NewBuffer([]byte{11, 0, 0, 0, uint8(Tclunk), 1, 0, slowFID, 0}))
+	c.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ops) != 0 {
+		t.Errorf("ops: want none, got %v", s.ops)
+	}
+}
+
+func TestDribbledMessage(t *testing.T) {
+	c := newTestConn(t, newSlow())
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, bigFID, 0, 10)
+	for _, x := range b.Bytes() {
+		send(t, c, bytes.NewBuffer([]byte{x}))
+	}
+	if typ, _ := readReply(t, c); typ != Rread {
+		t.Fatalf("reply: want Rread, got %v", RPCNames[typ])
+	}
+}
+
+// TestGarbage sends well-framed messages with random contents. Nothing
+// is checked but that the server doesn't fall over.
+func TestGarbage(t *testing.T) {
+	c := newTestConn(t, newEcho())
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(ioutil.Discard, c)
+	}()
+
+	// Tversion would reset everything, and Tremove can change
+	// the echo server's state for other tests.
+	types := []MType{Tattach, Tflush, Twalk, Topen, Tcreate, Tread, Twrite, Tclunk, Tstat, Twstat, Tauth, Rread, 0, 255}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		body := make([]byte, r.Intn(64))
+		r.Read(body)
+		sz := 7 + len(body)
+		m := []byte{uint8(sz), 0, 0, 0, uint8(types[r.Intn(len(types))]), uint8(i), uint8(i >> 8)}
+		send(t, c, bytes.NewBuffer(append(m, body...)))
+	}
+
+	// Tversion is not run until everything before it has finished.
+	var b bytes.Buffer
+	MarshalTversionPkt(&b, NOTAG, 8192, "9P2000")
+	send(t, c, &b)
+	c.Close()
+	<-done
+}
+
+// greedy is an echo server whose walks and reads return more than
+// will fit in any reply.
+type greedy struct {
+	*echo
+}
+
+func (g *greedy) Rwalk(ctx context.Context, fid FID, newfid FID, paths []string) ([]QID, error) {
+	return make([]QID, 1000), nil
+}
+
+func (g *greedy) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
+	return make([]byte, int(c)+IOHDRSZ), nil
+}
+
+func TestOversizedReply(t *testing.T) {
+	c := newTestConn(t, &greedy{echo: newEcho()})
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTwalkPkt(&b, 1, 0, 1, []string{"a"})
+	if e, _, _ := UnmarshalRerrorPkt(call(t, c, &b, Rerror)); !strings.HasPrefix(e, "Twalk: reply of 13009 bytes is more than msize 8192") {
+		t.Errorf("Twalk: want an Rerror about the reply size, got %q", e)
+	}
+	// Tread is clamped to fit msize, but the server reads more.
+	MarshalTreadPkt(&b, 2, 0, 0, 1<<20)
+	if e, _, _ := UnmarshalRerrorPkt(call(t, c, &b, Rerror)); !strings.HasPrefix(e, "Tread: reply of 8203 bytes is more than msize 8192") {
+		t.Errorf("Tread: want an Rerror about the reply size, got %q", e)
+	}
+	// The connection is still fine.
+	MarshalTstatPkt(&b, 3, 2)
+	call(t, c, &b, Rstat)
+}
+
+// dribbler writes at most three bytes at a time, without complaint.
+type dribbler struct {
+	io.Writer
+}
+
+func (d dribbler) Write(b []byte) (int, error) {
+	if len(b) > 3 {
+		b = b[:3]
+	}
+	return d.Writer.Write(b)
+}
+
+func TestShortWrites(t *testing.T) {
+	c, p := net.Pipe()
+	defer c.Close()
+	rwc := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{p, dribbler{p}, p}
+	go ServeFromRWC(rwc, newSlow(), "dribbler")
+
+	var b bytes.Buffer
+	MarshalTversionPkt(&b, NOTAG, 8192, "9P2000")
+	send(t, c, &b)
+	if typ, _ := readReply(t, c); typ != Rversion {
+		t.Fatalf("Tversion: want Rversion, got %v", RPCNames[typ])
+	}
+	for i := 0; i < 10; i++ {
+		b.Reset()
+		MarshalTreadPkt(&b, Tag(i), bigFID, 0, Count(i*100))
+		send(t, c, &b)
+		typ, rb := readReply(t, c)
+		if typ != Rread {
+			t.Fatalf("reply %d: want Rread, got %v", i, RPCNames[typ])
+		}
+		d, tag, err := UnmarshalRreadPkt(rb)
+		if err != nil || tag != Tag(i) || len(d) != i*100 {
+			t.Fatalf("Rread %d: want (%d bytes, tag %d, nil), got (%d bytes, tag %d, %v)", i, i*100, i, len(d), tag, err)
+		}
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	l, err := NewNetListener(func() NineServer { return newSlow() })
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	c, p := net.Pipe()
+	served := make(chan error)
+	go func() {
+		served <- l.ServeConn(p)
+	}()
+
+	var b bytes.Buffer
+	MarshalTversionPkt(&b, NOTAG, 8192, "9P2000")
+	send(t, c, &b)
+	if typ, _ := readReply(t, c); typ != Rversion {
+		t.Fatalf("Tversion: want Rversion, got %v", RPCNames[typ])
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("ServeConn returned %v with the connection still open", err)
+	default:
+	}
+
+	c.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("ServeConn: want nil, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ServeConn did not return after the connection was closed")
+	}
+}
+
+// serveConn runs ServeConn on the server end of a pipe in the
+// background, returning the client end, with Tversion done, and where
+// ServeConn's error goes.
+func serveConn(t *testing.T, ctx context.Context, ns NineServer, opts ...NetListenerOpt) (net.Conn, chan error) {
+	t.Helper()
+	c, p := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeConn(ctx, p, ns, opts...)
+	}()
+	var b bytes.Buffer
+	MarshalTversionPkt(&b, NOTAG, 8192, "9P2000")
+	call(t, c, &b, Rversion)
+	return c, served
+}
+
+func waitServed(t *testing.T, served chan error) error {
+	t.Helper()
+	select {
+	case err := <-served:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return")
+	}
+	return nil
+}
+
+func TestServeConnFunc(t *testing.T) {
+	// A client which hangs up is no error.
+	c, served := serveConn(t, context.Background(), newEcho())
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, 2, 0, 100)
+	call(t, c, &b, Rread)
+	c.Close()
+	if err := waitServed(t, served); err != nil {
+		t.Errorf("after the client hung up: want nil, got %v", err)
+	}
+
+	// Cancelling the context stops the server, cancels what is in
+	// progress, and hangs up.
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newSlow()
+	c, served = serveConn(t, ctx, s)
+	defer c.Close()
+	b.Reset()
+	MarshalTreadPkt(&b, 1, slowFID, 0, 100)
+	send(t, c, &b)
+	<-s.started
+	cancel()
+	if err := waitServed(t, served); err != context.Canceled {
+		t.Errorf("after cancel: want %v, got %v", context.Canceled, err)
+	}
+	s.mu.Lock()
+	if len(s.ops) != 1 || s.ops[0] != "cancelled" {
+		t.Errorf("after cancel: slow read got %q, want cancelled", s.ops)
+	}
+	s.mu.Unlock()
+	expectEOF(t, c)
+
+	// The options are those of a NetListener's.
+	disconnected := make(chan error, 1)
+	c, served = serveConn(t, context.Background(), newEcho(),
+		WithIdleTimeout(50*time.Millisecond),
+		WithOnDisconnect(func(addr string, err error) { disconnected <- err }))
+	defer c.Close()
+	err := waitServed(t, served)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("after the idle timeout: want a timeout, got %v", err)
+	}
+	if e := <-disconnected; e != err {
+		t.Errorf("WithOnDisconnect: got %v, want %v", e, err)
+	}
+}
+
+func TestTraceWriter(t *testing.T) {
+	var w bytes.Buffer
+	l, err := NewNetListener(func() NineServer { return newEcho() }, WithTraceWriter(&w))
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	c, p := net.Pipe()
+	served := make(chan error)
+	go func() {
+		served <- l.ServeConn(p)
+	}()
+	var b bytes.Buffer
+	MarshalTversionPkt(&b, NOTAG, 8192, "9P2000")
+	call(t, c, &b, Rversion)
+	c.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("ServeConn: want nil, got %v", err)
+	}
+
+	// ServeConn has returned, so nothing is writing to w.
+	lines := strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n")
+	stamped := regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d\.\d{6} \[`)
+	var sawTversion bool
+	for _, line := range lines {
+		if !stamped.MatchString(line) {
+			t.Errorf("trace %q: want a timestamp and the remote address", line)
+		}
+		sawTversion = sawTversion || strings.Contains(line, "got Tversion")
+	}
+	if !sawTversion {
+		t.Errorf("traces %q: want one for Tversion", lines)
+	}
+}
+
+// recorder is a ConnLogger which keeps what it is told, up to level.
+type recorder struct {
+	level Level
+
+	mu    sync.Mutex
+	conns []string
+	logs  map[Level][]string
+}
+
+func (r *recorder) Enabled(l Level) bool {
+	return l <= r.level
+}
+
+func (r *recorder) Logf(l Level, format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logs[l] = append(r.logs[l], fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) ForConn(remoteAddr string) Logger {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns = append(r.conns, remoteAddr)
+	return r
+}
+
+func TestLogger(t *testing.T) {
+	r := &recorder{level: LevelWire, logs: make(map[Level][]string)}
+	_, c := newListenerConn(t, newEcho(), WithLogger(r))
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, 2, 0, 5)
+	call(t, c, &b, Rread)
+	c.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.conns) != 1 || r.conns[0] != "pipe" {
+		t.Errorf("ForConn: want one call, for pipe, got %v", r.conns)
+	}
+	wire := strings.Join(r.logs[LevelWire], "")
+	for _, want := range []string{
+		"[pipe] <- Tversion size 19 tag 65535\n00000000  13 00 00 00 64 ff ff 00  20 00 00 06 00 39 50 32  |....d... ....9P2|",
+		"[pipe] -> Rversion size 19 tag 65535\n",
+		"[pipe] <- Tread size 23 tag 1 fid 2\n",
+		"[pipe] -> Rread size 13 tag 1\n00000000  0d 00 00 00 75 01 00 02  00 00 00 48 49           |....u......HI|",
+	} {
+		if !strings.Contains(wire, want) {
+			t.Errorf("LevelWire logs: want %q in\n%s", want, wire)
+		}
+	}
+	if len(r.logs[LevelDebug]) == 0 {
+		t.Errorf("LevelDebug logs: want some, got none")
+	}
+
+	// A Tracer with a level gets no more than that.
+	var logged []string
+	lt := LevelTracer{Trace: func(f string, args ...interface{}) { logged = append(logged, fmt.Sprintf(f, args...)) }, Level: LevelInfo}
+	if lt.Enabled(LevelDebug) || !lt.Enabled(LevelInfo) {
+		t.Errorf("LevelTracer at LevelInfo: want only LevelInfo enabled")
+	}
+	lt.Logf(LevelWire, "wire")
+	lt.Logf(LevelInfo, "info")
+	if len(logged) != 1 || logged[0] != "info" {
+		t.Errorf("LevelTracer at LevelInfo: want [info] logged, got %q", logged)
+	}
+}
+
+// startShutdown starts l.Shutdown, with a slow read in progress on c,
+// and waits until c refuses new requests.
+func startShutdown(t *testing.T, ctx context.Context, l *NetListener, s *slow, c net.Conn) chan error {
+	t.Helper()
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-s.started
+
+	done := make(chan error)
+	go func() {
+		done <- l.Shutdown(ctx)
+	}()
+	// The conn is told to drain asynchronously, so it may answer a
+	// few more requests before it starts refusing them.
+	for {
+		MarshalTstatPkt(&b, 2, 2)
+		send(t, c, &b)
+		typ, rb := readReply(t, c)
+		if typ == Rstat {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		e, _, err := UnmarshalRerrorPkt(rb)
+		if typ != Rerror || err != nil || !strings.Contains(e, "shutting down") {
+			t.Fatalf("Tstat during Shutdown: want Rstat or Rerror saying the server is shutting down, got (%v, %q, %v)", RPCNames[typ], e, err)
+		}
+		return done
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := newSlow()
+	l, c := newListenerConn(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := startShutdown(t, ctx, l, s, c)
+
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a read outstanding", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(s.release)
+	typ, rb := readReply(t, c)
+	if typ != Rread {
+		t.Fatalf("reply: want Rread, got %v", RPCNames[typ])
+	}
+	if data, tag, err := UnmarshalRreadPkt(rb); err != nil || tag != 1 || string(data) != "SLOW" {
+		t.Errorf("Rread: want (SLOW, 1, nil), got (%q, %v, %v)", data, tag, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: want nil, got %v", err)
+	}
+	expectEOF(t, c)
+}
+
+func TestShutdownExpired(t *testing.T) {
+	s := newSlow()
+	l, c := newListenerConn(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := startShutdown(t, ctx, l, s, c)
+
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: want %v, got %v", context.DeadlineExceeded, err)
+	}
+	expectEOF(t, c)
+	// Closing the conn cancels the read.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		ops := fmt.Sprint(s.ops)
+		s.mu.Unlock()
+		if ops == "[cancelled]" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ops: want [cancelled], got %v", ops)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := newSlow()
+	l, c := newListenerConn(t, s)
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-s.started
+	if err := l.Close(); err != nil {
+		t.Errorf("Close: want nil, got %v", err)
+	}
+	expectEOF(t, c)
+}
+
+func TestConns(t *testing.T) {
+	s := newSlow()
+	l, c := newListenerConn(t, s)
+	defer c.Close()
+
+	// Look while the connection is being served, for the race
+	// detector.
+	stop := make(chan struct{})
+	looked := make(chan struct{})
+	go func() {
+		defer close(looked)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			l.Conns()
+			_ = l.String()
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-looked
+	}()
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	n := uint64(b.Len())
+	send(t, c, &b)
+	<-s.started
+	ci := l.Conns()
+	if len(ci) != 1 {
+		t.Fatalf("Conns: want 1, got %v", ci)
+	}
+	// Tversion is 19 bytes each way.
+	i := ci[0]
+	if i.RemoteAddr != "pipe" || i.Version != Version || i.Msize != 8192 || i.Outstanding != 1 || i.BytesIn != 19+n || i.BytesOut != 19 {
+		t.Errorf("Conns: want pipe, %s, msize 8192, 1 outstanding, %d bytes in, 19 out, got %+v", Version, 19+n, i)
+	}
+	if i.Uptime <= 0 || i.LastActive.Before(i.Start) {
+		t.Errorf("Conns: want it up since Start, active since, got %+v", i)
+	}
+	if str := l.String(); !strings.HasPrefix(str, "1 connections\npipe: 9P2000, msize 8192") {
+		t.Errorf("String: got %q", str)
+	}
+
+	close(s.release)
+	if typ, _ := readReply(t, c); typ != Rread {
+		t.Fatalf("slow Tread: want Rread, got %v", RPCNames[typ])
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if ci = l.Conns(); ci[0].Outstanding == 0 {
+			break
+		}
+	}
+	if ci[0].Outstanding != 0 {
+		t.Errorf("Conns after Rread: want 0 outstanding, got %+v", ci[0])
+	}
+
+	if err := l.CloseConn("nowhere"); err == nil {
+		t.Errorf("CloseConn of no connection: want an error, got nil")
+	}
+	if err := l.CloseConn("pipe"); err != nil {
+		t.Fatalf("CloseConn: want nil, got %v", err)
+	}
+	expectEOF(t, c)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if ci = l.Conns(); len(ci) == 0 {
+			break
+		}
+	}
+	if len(ci) != 0 {
+		t.Errorf("Conns after CloseConn: want none, got %v", ci)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := newSlow()
+	_, c := newListenerConn(t, s, WithIdleTimeout(50*time.Millisecond))
+
+	// A read that blocks for longer than the timeout doesn't make the
+	// conn idle.
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-s.started
+	time.Sleep(150 * time.Millisecond)
+	close(s.release)
+	if typ, _ := readReply(t, c); typ != Rread {
+		t.Fatalf("reply: want Rread, got %v", RPCNames[typ])
+	}
+	// Nor does the time spent waiting for it count against the next
+	// request.
+	MarshalTstatPkt(&b, 2, 2)
+	call(t, c, &b, Rstat)
+
+	// Saying nothing does.
+	start := time.Now()
+	expectEOF(t, c)
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("conn closed after %v, want about 50ms", d)
+	}
+}
+
+// closing is a slow server which says when ConnClosed is called, and
+// what had happened by then.
+type closing struct {
+	*slow
+	closed chan []string
+}
+
+func (s closing) ConnClosed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed <- append([]string(nil), s.ops...)
+}
+
+func TestConnClosed(t *testing.T) {
+	// A client which vanishes mid-request: the request is cancelled,
+	// and the server is told once it has finished.
+	s := closing{newSlow(), make(chan []string, 2)}
+	_, c := newListenerConn(t, s)
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-s.started
+	c.Close()
+	select {
+	case ops := <-s.closed:
+		if fmt.Sprint(ops) != "[cancelled]" {
+			t.Errorf("ops before ConnClosed: want [cancelled], got %v", ops)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnClosed not called after the client went away")
+	}
+
+	// One which says nothing for too long.
+	s = closing{newSlow(), make(chan []string, 2)}
+	_, c = newListenerConn(t, s, WithIdleTimeout(50*time.Millisecond))
+	expectEOF(t, c)
+	select {
+	case <-s.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnClosed not called after the idle timeout")
+	}
+	select {
+	case <-s.closed:
+		t.Error("ConnClosed called twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnHooks(t *testing.T) {
+	type event struct {
+		connect bool
+		addr    string
+		err     error
+	}
+	events := make(chan event, 10)
+	opts := []NetListenerOpt{
+		WithOnConnect(func(addr string) { events <- event{true, addr, nil} }),
+		WithOnDisconnect(func(addr string, err error) { events <- event{false, addr, err} }),
+	}
+	next := func() event {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no connection event")
+		}
+		return event{}
+	}
+
+	// A client which hangs up between messages is no error.
+	l, c := newListenerConn(t, newEcho(), opts...)
+	if e := next(); !e.connect || e.addr != "pipe" {
+		t.Errorf("first event: want connect from pipe, got %+v", e)
+	}
+	c.Close()
+	if e := next(); e.connect || e.addr != "pipe" || e.err != nil {
+		t.Errorf("after the client hung up: want disconnect with nil, got %+v", e)
+	}
+	if n := len(l.Conns()); n != 0 {
+		t.Errorf("at disconnect: %d connections listed, want 0", n)
+	}
+
+	// One which sends nonsense, or hangs up part way through a
+	// message, is.
+	for _, tt := range []struct {
+		b    []byte
+		want string
+	}{
+		{[]byte{1, 0, 0, 0, byte(Tread), 1, 0}, "bad message size 1"},
+		{[]byte{100, 0, 0, 0, byte(Tread), 1, 0, 2}, io.ErrUnexpectedEOF.Error()},
+		{[]byte{100, 0}, io.ErrUnexpectedEOF.Error()},
+	} {
+		_, c = newListenerConn(t, newEcho(), opts...)
+		next()
+		c.Write(tt.b)
+		c.Close()
+		if e := next(); e.connect || e.err == nil || !strings.Contains(e.err.Error(), tt.want) {
+			t.Errorf("after %v: want disconnect with %q, got %+v", tt.b, tt.want, e)
+		}
+	}
+
+	// So is one closed by CloseConn.
+	l, c = newListenerConn(t, newEcho(), opts...)
+	defer c.Close()
+	next()
+	l.CloseConn("pipe")
+	if e := next(); e.connect || e.err == nil || !strings.Contains(e.err.Error(), "CloseConn") {
+		t.Errorf("after CloseConn: want disconnect with an error, got %+v", e)
+	}
+}
+
+// kaConn is a net.Conn which records how its keep-alives are set.
+type kaConn struct {
+	net.Conn
+	set    bool
+	on     bool
+	period time.Duration
+}
+
+func (c *kaConn) SetKeepAlive(on bool) error {
+	c.set, c.on = true, on
+	return nil
+}
+
+func (c *kaConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
+
+func TestKeepAlive(t *testing.T) {
+	for _, tt := range []struct {
+		d      time.Duration
+		set    bool
+		on     bool
+		period time.Duration
+	}{
+		{0, false, false, 0},
+		{time.Minute, true, true, time.Minute},
+		{-1, true, false, 0},
+	} {
+		l, err := NewNetListener(func() NineServer { return newEcho() }, WithKeepAlive(tt.d))
+		if err != nil {
+			t.Fatalf("NewNetListener: want nil, got %v", err)
+		}
+		c, p := net.Pipe()
+		kc := &kaConn{Conn: p}
+		if err := l.Accept(kc); err != nil {
+			t.Fatalf("Accept: want nil, got %v", err)
+		}
+		c.Close()
+		if kc.set != tt.set || kc.on != tt.on || kc.period != tt.period {
+			t.Errorf("WithKeepAlive(%v): want set %v, on %v, period %v, got %v, %v, %v", tt.d, tt.set, tt.on, tt.period, kc.set, kc.on, kc.period)
+		}
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	opt := WithHeaderTimeout(50 * time.Millisecond)
+
+	// A client which never sends Tversion is cut off.
+	l, err := NewNetListener(func() NineServer { return newEcho() }, opt)
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	c, p := net.Pipe()
+	if err := l.Accept(p); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	expectEOF(t, c)
+
+	// After Tversion, there is no limit on waiting for a message...
+	_, c = newListenerConn(t, newEcho(), opt)
+	time.Sleep(100 * time.Millisecond)
+	var b bytes.Buffer
+	MarshalTstatPkt(&b, 1, 2)
+	call(t, c, &b, Rstat)
+
+	// ...but there is on finishing one.
+	if _, err := c.Write(b.Bytes()[:9]); err != nil {
+		t.Fatalf("Write: want nil, got %v", err)
+	}
+	expectEOF(t, c)
+}
+
+// stubborn is a slow server whose reads on slowFID pay no attention to
+// their context.
+type stubborn struct {
+	*slow
+}
+
+func (s stubborn) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
+	if f != slowFID {
+		return s.slow.Rread(ctx, f, o, c)
+	}
+	s.started <- struct{}{}
+	<-s.release
+	return []byte("LATE"), nil
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := newSlow()
+	_, c := newListenerConn(t, s, WithRequestTimeout(50*time.Millisecond))
+	var b bytes.Buffer
+	MarshalTstatPkt(&b, 1, 2)
+	call(t, c, &b, Rstat)
+
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	if e := expectRerror(t, c, 1); !strings.Contains(e, "timed out") {
+		t.Errorf("Rerror: want timed out, got %q", e)
+	}
+	// The clunk waits for the read to finish.
+	MarshalTclunkPkt(&b, 1, slowFID)
+	call(t, c, &b, Rclunk)
+	if fmt.Sprint(s.ops) != "[cancelled clunk]" {
+		t.Errorf("ops: want [cancelled clunk], got %v", s.ops)
+	}
+
+	// A server which carries on regardless has its reply dropped, and
+	// doesn't hold up anything else.
+	st := stubborn{newSlow()}
+	_, c = newListenerConn(t, st, WithRequestTimeout(50*time.Millisecond))
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-st.started
+	if e := expectRerror(t, c, 1); !strings.Contains(e, "timed out") {
+		t.Errorf("Rerror: want timed out, got %q", e)
+	}
+	MarshalTstatPkt(&b, 2, 2)
+	call(t, c, &b, Rstat)
+	close(st.release)
+	noReply(t, c)
+}
+
+func TestOpTimeouts(t *testing.T) {
+	st := stubborn{newSlow()}
+	l, c := newListenerConn(t, st, WithRequestTimeout(time.Hour), WithOpTimeouts(map[MType]time.Duration{
+		Tread: 50 * time.Millisecond,
+		Tstat: 0,
+	}))
+	defer c.Close()
+	if d := l.timeouts.forRequest(Twalk); d != time.Hour {
+		t.Errorf("Twalk timeout: want the request timeout, an hour, got %v", d)
+	}
+	if d := l.timeouts.forRequest(Tstat); d != 0 {
+		t.Errorf("Tstat timeout: want none, got %v", d)
+	}
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-st.started
+	if e := expectRerror(t, c, 1); !strings.Contains(e, "timed out after 50ms") {
+		t.Errorf("Rerror: want timed out after 50ms, got %q", e)
+	}
+	close(st.release)
+	noReply(t, c)
+
+	for _, bad := range []map[MType]time.Duration{
+		{Tversion: time.Second},
+		{Tflush: time.Second},
+		{Rread: time.Second},
+		{Tstat: -time.Second},
+	} {
+		if _, err := NewNetListener(func() NineServer { return newEcho() }, WithOpTimeouts(bad)); err == nil {
+			t.Errorf("WithOpTimeouts(%v): want an error, got nil", bad)
+		}
+	}
+}
+
+// deadliner is a slow server whose reads on slowFID wait for their
+// context's deadline, and whose reads on bigFID fail at once, as if
+// a deadline of their own had passed.
+type deadliner struct {
+	*slow
+	hadDeadline chan bool
+}
+
+func (d deadliner) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
+	switch f {
+	case slowFID:
+		_, ok := ctx.Deadline()
+		d.hadDeadline <- ok
+		<-ctx.Done()
+		return nil, fmt.Errorf("read: %w", ctx.Err())
+	case bigFID:
+		return nil, fmt.Errorf("read: %w", context.DeadlineExceeded)
+	}
+	return d.slow.Rread(ctx, f, o, c)
+}
+
+func TestRequestDeadline(t *testing.T) {
+	d := deadliner{slow: newSlow(), hadDeadline: make(chan bool, 1)}
+	_, c := newListenerConn(t, d, WithRequestTimeout(50*time.Millisecond))
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	if !<-d.hadDeadline {
+		t.Errorf("Rread: want a deadline on the context, got none")
+	}
+	if e := expectRerror(t, c, 1); !strings.Contains(e, "timed out") {
+		t.Errorf("Rerror: want timed out, got %q", e)
+	}
+
+	// Whatever the server wraps its context's error in, the client is
+	// just told the request timed out.
+	MarshalTreadPkt(&b, 2, bigFID, 0, 5)
+	send(t, c, &b)
+	if e := expectRerror(t, c, 2); e != ErrTimedOut.Err {
+		t.Errorf("Rerror: want %q, got %q", ErrTimedOut.Err, e)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	const max = 4
+	l, err := NewNetListener(func() NineServer { return newEcho() }, WithMaxConns(max))
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen on loopback: %v", err)
+	}
+	go l.Serve(ln)
+	defer l.Close()
+
+	// version reports whether c is served.
+	version := func(c net.Conn) bool {
+		var b bytes.Buffer
+		MarshalTversionPkt(&b, NOTAG, 8192, "9P2000")
+		if _, err := c.Write(b.Bytes()); err != nil {
+			return false
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		h := make([]byte, 7)
+		_, err := io.ReadFull(c, h)
+		return err == nil && MType(h[4]) == Rversion
+	}
+
+	// Hammer it, and only max get in.
+	const n = 50
+	conns := make([]net.Conn, n)
+	served := make([]bool, n)
+	var wg sync.WaitGroup
+	for i := range conns {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: want nil, got %v", err)
+		}
+		defer c.Close()
+		conns[i] = c
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			served[i] = version(conns[i])
+		}(i)
+	}
+	wg.Wait()
+	var got int
+	for _, ok := range served {
+		if ok {
+			got++
+		}
+	}
+	if got != max {
+		t.Fatalf("served %d of %d connections, want %d", got, n, max)
+	}
+
+	// Once one goes, there's room for another.
+	for i, ok := range served {
+		if ok {
+			conns[i].Close()
+			break
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: want nil, got %v", err)
+		}
+		defer c.Close()
+		if version(c) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no connection served after one closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxRequests(t *testing.T) {
+	s := newSlow()
+	_, c := newListenerConn(t, s, WithMaxRequests(2))
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c, &b)
+	<-s.started
+	MarshalTreadPkt(&b, 2, slowFID, 0, 5)
+	send(t, c, &b)
+
+	MarshalTstatPkt(&b, 3, 2)
+	send(t, c, &b)
+	if e := expectRerror(t, c, 3); !strings.Contains(e, "too many requests") {
+		t.Errorf("Rerror: want too many requests, got %q", e)
+	}
+	// Tflush still works.
+	MarshalTflushPkt(&b, 4, 2)
+	call(t, c, &b, Rflush)
+
+	close(s.release)
+	if typ, _ := readReply(t, c); typ != Rread {
+		t.Fatalf("reply: want Rread, got %v", RPCNames[typ])
+	}
+	MarshalTstatPkt(&b, 3, 2)
+	call(t, c, &b, Rstat)
+}
+
+func TestMaxInflightBytes(t *testing.T) {
+	s := newSlow()
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	sz := int64(b.Len())
+	l, c1 := newListenerConn(t, s, WithMaxInflightBytes(2*sz))
+	// The budget is shared by all the connections.
+	c2, p := net.Pipe()
+	if err := l.Accept(p); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	MarshalTversionPkt(&b, NOTAG, 8192, "9P2000")
+	call(t, c2, &b, Rversion)
+
+	MarshalTreadPkt(&b, 1, slowFID, 0, 5)
+	send(t, c1, &b)
+	send(t, c2, &b)
+	<-s.started
+	<-s.started
+
+	// Big or small, there's no room for anything else.
+	MarshalTwritePkt(&b, 2, 2, 0, make([]byte, 4000))
+	send(t, c1, &b)
+	if e := expectRerror(t, c1, 2); !strings.Contains(e, "too many requests") {
+		t.Errorf("Rerror: want too many requests, got %q", e)
+	}
+	MarshalTstatPkt(&b, 2, 2)
+	send(t, c2, &b)
+	if e := expectRerror(t, c2, 2); !strings.Contains(e, "too many requests") {
+		t.Errorf("Rerror: want too many requests, got %q", e)
+	}
+
+	// Until the reads are done.
+	close(s.release)
+	for _, c := range []net.Conn{c1, c2} {
+		if typ, _ := readReply(t, c); typ != Rread {
+			t.Fatalf("reply: want Rread, got %v", RPCNames[typ])
+		}
+	}
+	MarshalTstatPkt(&b, 2, 2)
+	call(t, c1, &b, Rstat)
+}
+
+// stalled is an echo server whose writes block until release is
+// closed, as a slow disk would.
+type stalled struct {
+	*echo
+	release chan struct{}
+}
+
+func (s *stalled) Rwrite(ctx context.Context, f FID, o Offset, b []byte) (Count, error) {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	return s.echo.Rwrite(ctx, f, o, b)
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	const n = 64
+	var b bytes.Buffer
+	MarshalTwritePkt(&b, 0, 2, 0, make([]byte, 8192-IOHDRSZ))
+	sz := int64(b.Len())
+	budget := 4 * sz
+	s := &stalled{echo: newEcho(), release: make(chan struct{})}
+	l, c := newListenerConn(t, s, WithMaxBufferedBytes(budget))
+	defer c.Close()
+
+	// The client sends as fast as it can, and reads every reply.
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		var b bytes.Buffer
+		for i := 0; i < n; i++ {
+			MarshalTwritePkt(&b, Tag(i), 2, Offset(i), make([]byte, 8192-IOHDRSZ))
+			if _, err := c.Write(b.Bytes()); err != nil {
+				return
+			}
+		}
+	}()
+	replies := make(chan MType, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			typ, _ := readReply(t, c)
+			replies <- typ
+		}
+	}()
+
+	// The server stops reading once it is over budget, so the client
+	// can't send everything, and what is held stays bounded.
+	var ci ConnInfo
+	for start := time.Now(); time.Since(start) < 200*time.Millisecond; time.Sleep(10 * time.Millisecond) {
+		ci = l.Conns()[0]
+		if ci.Buffered > budget+sz {
+			t.Fatalf("%d bytes buffered, want at most %d", ci.Buffered, budget+sz)
+		}
+	}
+	select {
+	case <-sent:
+		t.Fatal("the client sent everything while the server was stalled")
+	default:
+	}
+	if ci.Outstanding == 0 || ci.Outstanding > int(budget/sz)+1 {
+		t.Errorf("%d requests outstanding, want 1 to %d", ci.Outstanding, budget/sz+1)
+	}
+
+	// Once the writes go through, the rest is read.
+	close(s.release)
+	for i := 0; i < n; i++ {
+		select {
+		case typ := <-replies:
+			if typ != Rwrite {
+				t.Fatalf("reply %d: want Rwrite, got %v", i, RPCNames[typ])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d replies, want %d", i, n)
+		}
+	}
+	<-sent
+	// The last reply is counted out just after it is written.
+	for start := time.Now(); l.Conns()[0].Buffered != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("after every reply: %d bytes buffered, want 0", l.Conns()[0].Buffered)
+		}
+	}
+}
+
+// patterned is an echo server whose reads on a fid return tag bytes
+// of the fid's value, where tag is the offset, so that every reply is
+// different.
+type patterned struct {
+	*echo
+}
+
+func (p patterned) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
+	return bytes.Repeat([]byte{byte(f)}, int(o)), nil
+}
+
+// patternedInto is patterned, reading with RreadInto.
+type patternedInto struct {
+	patterned
+}
+
+func (p patternedInto) RreadInto(ctx context.Context, f FID, o Offset, b []byte) (int, error) {
+	n := int(o)
+	for i := range b[:n] {
+		b[i] = byte(f)
+	}
+	return n, nil
+}
+
+// streamer is patterned, streaming its reads. The reader for fid 1001
+// comes up short, by 2 of 4 bytes, fid 1003 isn't streamed, fid 1004 claims more than it
+// was asked for, and reads of fid 1005 record when they happen.
+type streamer struct {
+	patterned
+
+	mu  sync.Mutex
+	ops []string
+}
+
+func (s *streamer) Rstream(ctx context.Context, f FID, o Offset, c Count) (io.Reader, Count, error) {
+	switch f {
+	case 1001:
+		return strings.NewReader("ab"), 4, nil
+	case 1003:
+		return nil, 0, nil
+	case 1004:
+		return strings.NewReader(""), c + 1, nil
+	case 1005:
+		return ioutil.NopCloser(readerFunc(func(p []byte) (int, error) {
+			s.op("read")
+			return copy(p, "data"), io.EOF
+		})), 4, nil
+	}
+	return bytes.NewReader(bytes.Repeat([]byte{byte(f)}, int(o))), Count(o), nil
+}
+
+func (s *streamer) Rclunk(ctx context.Context, f FID) error {
+	s.op("clunk")
+	return nil
+}
+
+func (s *streamer) op(o string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, o)
+}
+
+func TestStream(t *testing.T) {
+	ns := &streamer{patterned: patterned{newEcho()}}
+	c := newTestConn(t, ns)
+	defer c.Close()
+	var b bytes.Buffer
+	for _, tc := range []struct {
+		fid  FID
+		o    Offset
+		want string
+	}{
+		{fid: 7, o: 3, want: "\x07\x07\x07"},
+		{fid: 7, o: 0, want: ""}, // the end of the file
+		{fid: 1003, o: 2, want: "\xeb\xeb"},
+	} {
+		MarshalTreadPkt(&b, 1, tc.fid, tc.o, 100)
+		d, _, err := UnmarshalRreadPkt(call(t, c, &b, Rread))
+		if err != nil || string(d) != tc.want {
+			t.Errorf("Tread of fid %d at %d: want %q, got (%q, %v)", tc.fid, tc.o, tc.want, d, err)
+		}
+	}
+
+	MarshalTreadPkt(&b, 1, 1004, 0, 100)
+	send(t, c, &b)
+	if e := expectRerror(t, c, 1); !strings.Contains(e, "Rstream gave 101 bytes for a read of 100") {
+		t.Errorf("Tread of fid 1004: want an error about the 101 bytes, got %q", e)
+	}
+
+	// The Tclunk waits for the streamed read before it.
+	MarshalTreadPkt(&b, 1, 1005, 0, 100)
+	send(t, c, &b)
+	MarshalTclunkPkt(&b, 2, 1005)
+	send(t, c, &b)
+	for i := 0; i < 2; i++ {
+		readReply(t, c)
+	}
+	if got := strings.Join(ns.ops, " "); got != "read clunk" {
+		t.Errorf("ops: want read clunk, got %v", got)
+	}
+
+	// A body which comes up short isn't made up to size: what there
+	// is is sent, after the header, and the connection closed.
+	MarshalTreadPkt(&b, 1, 1001, 0, 100)
+	send(t, c, &b)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	d, err := ioutil.ReadAll(c)
+	if err != nil || len(d) != 13 || string(d[11:]) != "ab" {
+		t.Errorf("Tread of fid 1001: want 11 bytes of header and ab, then EOF, got (%q, %v)", d, err)
+	}
+}
+
+// TestPooledBuffers checks that no reply is spoilt by a buffer going
+// back to the pool too soon, with lots of them in flight at once, and
+// writes to fill the buffers with something else.
+func TestPooledBuffers(t *testing.T) {
+	for _, ns := range []NineServer{
+		patterned{newEcho()},
+		patternedInto{patterned{newEcho()}},
+		&streamer{patterned: patterned{newEcho()}},
+	} {
+		c := newTestConn(t, ns)
+		const n = 200
+		go func() {
+			var b bytes.Buffer
+			for i := 1; i <= n; i++ {
+				MarshalTreadPkt(&b, Tag(i), FID(i), Offset(i), Count(i))
+				c.Write(b.Bytes())
+				MarshalTwritePkt(&b, Tag(n+i), 2, 0, bytes.Repeat([]byte{0xff}, i))
+				c.Write(b.Bytes())
+			}
+		}()
+		for i := 0; i < 2*n; i++ {
+			typ, rb := readReply(t, c)
+			if typ == Rwrite {
+				continue
+			}
+			d, tag, err := UnmarshalRreadPkt(rb)
+			if err != nil || typ != Rread {
+				t.Fatalf("reply: want Rread, got (%v, %v)", RPCNames[typ], err)
+			}
+			if want := bytes.Repeat([]byte{byte(tag)}, int(tag)); !bytes.Equal(d, want) {
+				t.Fatalf("Rread for tag %d: want %v, got %v", tag, want, d)
+			}
+		}
+		c.Close()
+	}
+}
+
+// authed is an echo server which wants to hear the password on an
+// afid before it lets anyone attach.
+type authed struct {
+	*echo
+
+	mu    sync.Mutex
+	afids map[FID]bool // whether the password has been written
+}
+
+const password = "open sesame"
+
+func (a *authed) Rauth(ctx context.Context, afid FID, uname, aname string) (QID, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.afids[afid] = false
+	return QID{Type: QTAUTH, Path: uint64(afid)}, nil
+}
+
+func (a *authed) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
+	a.mu.Lock()
+	_, ok := a.afids[f]
+	a.mu.Unlock()
+	if !ok {
+		return a.echo.Rread(ctx, f, o, c)
+	}
+	return []byte("password?"), nil
+}
+
+func (a *authed) Rwrite(ctx context.Context, f FID, o Offset, b []byte) (Count, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.afids[f]; !ok {
+		return a.echo.Rwrite(ctx, f, o, b)
+	}
+	if string(b) != password {
+		return -1, fmt.Errorf("wrong password")
+	}
+	a.afids[f] = true
+	return Count(len(b)), nil
+}
+
+func (a *authed) Rclunk(ctx context.Context, f FID) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.afids[f]; !ok {
+		return a.echo.Rclunk(ctx, f)
+	}
+	delete(a.afids, f)
+	return nil
+}
+
+func (a *authed) Rattach(ctx context.Context, f, afid FID, uname, aname string) (QID, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if afid == NOFID {
+		return QID{}, fmt.Errorf("authentication required")
+	}
+	if !a.afids[afid] {
+		return QID{}, fmt.Errorf("authentication not finished")
+	}
+	return a.echo.Rattach(ctx, f, afid, uname, aname)
+}
+
+// call sends a message and checks the type of the reply.
+func call(t *testing.T, c net.Conn, b *bytes.Buffer, want MType) *bytes.Buffer {
+	t.Helper()
+	send(t, c, b)
+	typ, rb := readReply(t, c)
+	if typ != want {
+		msg := ""
+		if typ == Rerror {
+			msg, _, _ = UnmarshalRerrorPkt(rb)
+		}
+		t.Fatalf("reply: want %v, got %v %s", RPCNames[want], RPCNames[typ], msg)
+	}
+	return rb
+}
+
+func TestAuthNotRequired(t *testing.T) {
+	c := newTestConn(t, newSlow())
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTauthPkt(&b, 1, 100, "glenda", "")
+	rb := call(t, c, &b, Rerror)
+	if e, _, _ := UnmarshalRerrorPkt(rb); e != "authentication not required" {
+		t.Errorf("Tauth: want %q, got %q", "authentication not required", e)
+	}
+
+	// Whatever is in the afid is ignored.
+	MarshalTattachPkt(&b, 2, 1, NOFID, "glenda", "")
+	call(t, c, &b, Rattach)
+	MarshalTattachPkt(&b, 3, 1, 100, "glenda", "")
+	call(t, c, &b, Rattach)
+}
+
+func TestAuth(t *testing.T) {
+	c := newTestConn(t, &authed{echo: newEcho(), afids: make(map[FID]bool)})
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTattachPkt(&b, 1, 1, NOFID, "glenda", "")
+	call(t, c, &b, Rerror)
+
+	MarshalTauthPkt(&b, 2, 100, "glenda", "")
+	q, _, err := UnmarshalRauthPkt(call(t, c, &b, Rauth))
+	if err != nil || q.Type&QTAUTH == 0 {
+		t.Fatalf("Rauth: want a QTAUTH QID, got (%v, %v)", q, err)
+	}
+
+	// The protocol knows nothing of FID 101, and the server has
+	// not heard the password on 100.
+	MarshalTattachPkt(&b, 3, 1, 101, "glenda", "")
+	call(t, c, &b, Rerror)
+	MarshalTattachPkt(&b, 4, 1, 100, "glenda", "")
+	call(t, c, &b, Rerror)
+
+	MarshalTreadPkt(&b, 5, 100, 0, 100)
+	d, _, err := UnmarshalRreadPkt(call(t, c, &b, Rread))
+	if err != nil || string(d) != "password?" {
+		t.Fatalf("Rread: want %q, got (%q, %v)", "password?", d, err)
+	}
+	MarshalTwritePkt(&b, 6, 100, 0, []byte("wrong"))
+	call(t, c, &b, Rerror)
+	MarshalTwritePkt(&b, 7, 100, 0, []byte(password))
+	call(t, c, &b, Rwrite)
+
+	MarshalTattachPkt(&b, 8, 1, 100, "glenda", "")
+	call(t, c, &b, Rattach)
+
+	// Once it's clunked, the afid is no good.
+	MarshalTclunkPkt(&b, 9, 100)
+	call(t, c, &b, Rclunk)
+	MarshalTattachPkt(&b, 10, 1, 100, "glenda", "")
+	call(t, c, &b, Rerror)
+}
+
+// panicky is an echo server whose reads panic.
+type panicky struct {
+	*echo
+}
+
+func (p panicky) Rread(ctx context.Context, f FID, o Offset, c Count) ([]byte, error) {
+	panic("oops")
+}
+
+func TestRecover(t *testing.T) {
+	var logged []string
+	var stats Stats
+	_, c := newListenerConn(t, panicky{newEcho()}, WithMiddleware(
+		stats.Middleware,
+		Recover(func(f string, args ...interface{}) {
+			logged = append(logged, fmt.Sprintf(f, args...))
+		}),
+	))
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTreadPkt(&b, 1, 2, 0, 10)
+	send(t, c, &b)
+	if e := expectRerror(t, c, 1); !strings.Contains(e, "server panic: oops") {
+		t.Errorf("Tread: want an Rerror about the panic, got %q", e)
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], "oops") || !strings.Contains(logged[0], "panicky") {
+		t.Errorf("Recover: want the panic and its stack logged, got %q", logged)
+	}
+
+	// The connection is still good.
+	MarshalTwritePkt(&b, 2, 2, 0, []byte("hi"))
+	if n, _, err := UnmarshalRwritePkt(call(t, c, &b, Rwrite)); err != nil || n != 2 {
+		t.Errorf("Twrite after the panic: want (2, nil), got (%v, %v)", n, err)
+	}
+
+	got := stats.Snapshot().Requests
+	for typ, want := range map[MType]RequestMetrics{Tversion: {Count: 1}, Tread: {Count: 1, Errors: 1}, Twrite: {Count: 1}} {
+		if g := got[typ]; g.Count != want.Count || g.Errors != want.Errors {
+			t.Errorf("Stats for %v: want %d requests and %d errors, got %+v", RPCNames[typ], want.Count, want.Errors, g)
+		}
+	}
+	if s := stats.String(); !strings.Contains(s, "Tread: 1 requests, 1 errors") {
+		t.Errorf("Stats.String: want a line for Tread, got %q", s)
+	}
+}
+
+// clunker is an echo server whose walks succeed as far as the first
+// name "nope", and which records the FIDs it is asked to clunk, and
+// how many walks it is asked to do.
+type clunker struct {
+	*echo
+
+	mu      sync.Mutex
+	clunked []FID
+	walks   int
+}
+
+func (c *clunker) Rwalk(ctx context.Context, fid FID, newfid FID, paths []string) ([]QID, error) {
+	c.mu.Lock()
+	c.walks++
+	c.mu.Unlock()
+	var q []QID
+	for _, p := range paths {
+		if p == "nope" {
+			break
+		}
+		q = append(q, QID{Path: uint64(len(q))})
+	}
+	return q, nil
+}
+
+func (c *clunker) Rclunk(ctx context.Context, f FID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clunked = append(c.clunked, f)
+	return nil
+}
+
+func (c *clunker) take() []FID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.clunked
+	c.clunked = nil
+	sort.Slice(f, func(i, j int) bool { return f[i] < f[j] })
+	return f
+}
+
+func TestReversion(t *testing.T) {
+	ns := &clunker{echo: newEcho()}
+	c := newTestConn(t, ns)
+	defer c.Close()
+
+	var b bytes.Buffer
+	MarshalTattachPkt(&b, 1, 1, NOFID, "glenda", "")
+	call(t, c, &b, Rattach)
+	MarshalTwalkPkt(&b, 2, 1, 2, []string{"a", "b"})
+	call(t, c, &b, Rwalk)
+	// A short walk doesn't set up newfid.
+	MarshalTwalkPkt(&b, 3, 1, 3, []string{"a", "nope"})
+	call(t, c, &b, Rwalk)
+	MarshalTwalkPkt(&b, 4, 1, 4, nil)
+	call(t, c, &b, Rwalk)
+	MarshalTclunkPkt(&b, 5, 4)
+	call(t, c, &b, Rclunk)
+	if got := ns.take(); len(got) != 1 || got[0] != 4 {
+		t.Fatalf("Tclunk of 4: want [4] clunked, got %v", got)
+	}
+
+	// A new Tversion clunks whatever is left of the old session, and
+	// only that.
+	MarshalTversionPkt(&b, NOTAG, 4096, "9P2000")
+	call(t, c, &b, Rversion)
+	if got := ns.take(); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("Tversion: want [1 2] clunked, got %v", got)
+	}
+	MarshalTversionPkt(&b, NOTAG, 4096, "9P2000")
+	call(t, c, &b, Rversion)
+	if got := ns.take(); len(got) != 0 {
+		t.Errorf("Tversion with no FIDs: want none clunked, got %v", got)
+	}
+
+}
+
+func TestWalkRules(t *testing.T) {
+	ns := &clunker{echo: newEcho()}
+	c := newTestConn(t, ns)
+	defer c.Close()
+	walks := func() int {
+		ns.mu.Lock()
+		defer ns.mu.Unlock()
+		return ns.walks
+	}
+
+	var b bytes.Buffer
+	MarshalTattachPkt(&b, 1, 1, NOFID, "glenda", "")
+	call(t, c, &b, Rattach)
+
+	// A walk which fails part way gets the QIDs of the names it got
+	// through, and no error.
+	MarshalTwalkPkt(&b, 2, 1, 2, []string{"a", "nope", "b"})
+	if q, _, err := UnmarshalRwalkPkt(call(t, c, &b, Rwalk)); err != nil || len(q) != 1 {
+		t.Errorf("short Twalk: want 1 QID, got (%v, %v)", q, err)
+	}
+
+	// MaxWElem names may be walked, and no more.
+	names := make([]string, MaxWElem+1)
+	for i := range names {
+		names[i] = ".."
+	}
+	MarshalTwalkPkt(&b, 2, 1, 2, names[:MaxWElem])
+	if q, _, err := UnmarshalRwalkPkt(call(t, c, &b, Rwalk)); err != nil || len(q) != MaxWElem {
+		t.Errorf("Twalk of %d names: want %d QIDs, got (%v, %v)", MaxWElem, MaxWElem, q, err)
+	}
+	n := walks()
+	for _, tt := range []struct {
+		names []string
+		want  string
+	}{
+		{names, fmt.Sprintf("%d walk elements; the most is %d", MaxWElem+1, MaxWElem)},
+		{[]string{"a", "b/c"}, ErrBadWalkName.Err},
+		{[]string{"a\x00"}, ErrBadWalkName.Err},
+		{[]string{"/"}, ErrBadWalkName.Err},
+	} {
+		MarshalTwalkPkt(&b, 3, 1, 3, tt.names)
+		if e, _, _ := UnmarshalRerrorPkt(call(t, c, &b, Rerror)); !strings.Contains(e, tt.want) {
+			t.Errorf("Twalk of %q: want Rerror %q, got %q", tt.names, tt.want, e)
+		}
+	}
+	if w := walks(); w != n {
+		t.Errorf("bad Twalks: want none passed on, got %d", w-n)
+	}
+
+	// An open FID can't be walked, until it is clunked.
+	MarshalTwalkPkt(&b, 4, 1, 4, nil)
+	call(t, c, &b, Rwalk)
+	MarshalTopenPkt(&b, 5, 4, OREAD)
+	call(t, c, &b, Ropen)
+	MarshalTwalkPkt(&b, 6, 4, 5, nil)
+	if e, _, _ := UnmarshalRerrorPkt(call(t, c, &b, Rerror)); e != ErrFIDOpen.Err {
+		t.Errorf("Twalk of an open FID: want Rerror %q, got %q", ErrFIDOpen.Err, e)
+	}
+	MarshalTwalkPkt(&b, 6, 1, 5, nil)
+	call(t, c, &b, Rwalk)
+	MarshalTclunkPkt(&b, 7, 4)
+	call(t, c, &b, Rclunk)
+	MarshalTwalkPkt(&b, 8, 1, 4, []string{"a"})
+	call(t, c, &b, Rwalk)
+	MarshalTwalkPkt(&b, 9, 4, 6, []string{"b"})
+	call(t, c, &b, Rwalk)
+}
+
+// TestSessionRace runs a Tversion while others look at the session,
+// for the race detector.
+func TestSessionRace(t *testing.T) {
+	s := &Server{NS: &clunker{echo: newEcho()}, D: Dispatch}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Msize()
+				s.Versioned()
+				s.marshalRerror(new(bytes.Buffer), 1, errors.New("no"))
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		var b bytes.Buffer
+		MarshalTversionPkt(&b, NOTAG, MaxSize(4096+i), "9P2000")
+		b.Next(5)
+		if err := Dispatch(context.Background(), s, &b, Tversion); err != nil {
+			t.Errorf("Dispatch of Tversion: want nil, got %v", err)
+		}
+	}
+	wg.Wait()
+	if m := s.Msize(); m != 4096+9 {
+		t.Errorf("Msize: want %d, got %d", 4096+9, m)
+	}
+}
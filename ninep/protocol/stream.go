@@ -0,0 +1,93 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// A StreamNineServer can have the data of an Rread copied to the
+// connection straight from a reader, rather than through the buffer
+// the reply is marshaled in, which for big reads saves the copy and
+// the buffer. Rstream returns a reader for the n bytes, no more than c,
+// of fid at o; n is 0 at the end of the file. It may return a nil
+// reader, and then the Tread is answered by RreadInto or Rread, as
+// usual. The reader is read once the reply's header has been written,
+// after Rstream returns but before any other request on fid runs. It
+// must give all n bytes: the reply's size has been sent, so if it comes
+// up short the connection is closed, rather than the reply made up to
+// size. If it is an io.Closer, it is closed once it has been read.
+type StreamNineServer interface {
+	Rstream(ctx context.Context, fid FID, o Offset, c Count) (r io.Reader, n Count, err error)
+}
+
+// replyBody is the streamed part of a reply: n bytes read from r.
+type replyBody struct {
+	r io.Reader
+	n int64
+}
+
+func (b *replyBody) close() {
+	if c, ok := b.r.(io.Closer); ok {
+		c.Close()
+	}
+	b.r, b.n = nil, 0
+}
+
+// replyBodyKey is the context key for the *replyBody of a Tread, for
+// srvRstream to fill in. It is only there when the conn can stream.
+type replyBodyKey struct{}
+
+// srvRstream is SrvRread for a StreamNineServer. It reports whether it
+// answered the Tread; if the server had no reader for it, b is left
+// as it was.
+func (s *Server) srvRstream(ctx context.Context, b *bytes.Buffer, body *replyBody) (bool, error) {
+	saved := append(make([]byte, 0, 32), b.Bytes()...)
+	OFID, Off, Len, t, err := UnmarshalTreadPkt(b)
+	if err != nil {
+		s.ReplyError(b, t, "%v: %v", RPCNames[Tread], err)
+		return true, err
+	}
+	r, n, err := s.NS.(StreamNineServer).Rstream(ctx, OFID, Off, Len)
+	if err == nil && r != nil && (n < 0 || n > Len) {
+		err = fmt.Errorf("%v: Rstream gave %d bytes for a read of %d", RPCNames[Tread], n, Len)
+	}
+	if err != nil {
+		if r != nil {
+			(&replyBody{r: r}).close()
+		}
+		s.marshalRerror(b, t, err)
+		return true, nil
+	}
+	if r == nil {
+		b.Reset()
+		b.Write(saved)
+		return false, nil
+	}
+	MarshalRreadPkt(b, t, nil)
+	d := b.Bytes()
+	l := len(d) + int(n)
+	copy(d, []byte{uint8(l), uint8(l >> 8), uint8(l >> 16), uint8(l >> 24)})
+	copy(d[7:], []byte{uint8(n), uint8(n >> 8), uint8(n >> 16), uint8(n >> 24)})
+	body.r, body.n = r, int64(n)
+	return true, nil
+}
+
+// readErr remembers the error from reading r.
+type readErr struct {
+	r   io.Reader
+	err error
+}
+
+func (e *readErr) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil {
+		e.err = err
+	}
+	return n, err
+}
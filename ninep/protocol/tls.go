@@ -0,0 +1,125 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// WithTLS returns a NetListenerOpt which serves every connection over
+// TLS, as configured by config, which must have a certificate. If it
+// asks for client certificates, as with tls.RequireAndVerifyClientCert,
+// the one a client gives is in the context of each of its requests:
+// see PeerCertificate and CheckPeerUser.
+func WithTLS(config *tls.Config) NetListenerOpt {
+	return func(l *NetListener) error {
+		if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+			return errors.New("WithTLS: no certificate")
+		}
+		l.tlsConfig = config
+		return nil
+	}
+}
+
+// LoadTLSConfig returns a tls.Config with the certificate and key in
+// certFile and keyFile, which are PEM encoded. If clientCAFile is set,
+// clients must give a certificate signed by one of the CAs in it: this
+// is mutual TLS.
+func LoadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates", clientCAFile)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// ListenAndServeTLS is ListenAndServe, but serves connections over TLS,
+// with the certificate and key in certFile and keyFile. Anything else
+// about TLS, e.g. the CAs for client certificates, is as given to
+// WithTLS.
+func (l *NetListener) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if l.tlsConfig != nil {
+		config = l.tlsConfig.Clone()
+	}
+	config.Certificates = append(config.Certificates, cert)
+	ln, err := Listen(l.listenAddr(addr))
+	if err != nil {
+		return err
+	}
+	return l.Serve(tls.NewListener(ln, config))
+}
+
+type tlsStateKey struct{}
+
+// TLSConnectionState returns the state of the TLS connection over which
+// the request whose context is ctx came, if it came over TLS.
+func TLSConnectionState(ctx context.Context) (*tls.ConnectionState, bool) {
+	cs, ok := ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+	return cs, ok
+}
+
+// PeerCertificate returns the certificate the client gave, if it gave
+// one and it was verified, for the request whose context is ctx.
+func PeerCertificate(ctx context.Context) (*x509.Certificate, bool) {
+	cs, ok := TLSConnectionState(ctx)
+	if !ok || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return cs.VerifiedChains[0][0], true
+}
+
+// CheckPeerUser is for Rattach and Rauth. If the client gave a verified
+// certificate, uname must be the common name of its subject, and it
+// returns ErrPermission if not. If there is no certificate, anyone may
+// be anyone, as without TLS.
+func CheckPeerUser(ctx context.Context, uname string) error {
+	cert, ok := PeerCertificate(ctx)
+	if !ok || cert.Subject.CommonName == uname {
+		return nil
+	}
+	return fmt.Errorf("user %q is not %q, whose certificate was given: %w", uname, cert.Subject.CommonName, ErrPermission)
+}
+
+// handshake does the TLS handshake on c, within the header timeout if
+// there is one, and puts the connection's state in c.ctx.
+func (c *conn) handshake() error {
+	if d := c.timeouts.header; d > 0 {
+		c.tls.SetDeadline(time.Now().Add(d))
+		defer c.tls.SetDeadline(time.Time{})
+	}
+	if err := c.tls.Handshake(); err != nil {
+		return err
+	}
+	cs := c.tls.ConnectionState()
+	c.ctx = context.WithValue(c.ctx, tlsStateKey{}, &cs)
+	return nil
+}
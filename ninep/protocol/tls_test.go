@@ -0,0 +1,261 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate, and its key, for tests.
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert makes a certificate for cn, good for localhost, signed by
+// ca, or by itself, as a CA, if ca is nil.
+func newTestCert(t *testing.T, cn string, ca *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, der: der, key: key}
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// write writes c and its key to files in dir, as PEM, and returns
+// their names.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	k, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// peerEcho is an echo server whose Rattach checks the user against the
+// client's certificate.
+type peerEcho struct {
+	*echo
+	peer chan string
+}
+
+func (p *peerEcho) Rattach(ctx context.Context, fid FID, afid FID, uname string, aname string) (QID, error) {
+	cn := ""
+	if cert, ok := PeerCertificate(ctx); ok {
+		cn = cert.Subject.CommonName
+	}
+	p.peer <- cn
+	if err := CheckPeerUser(ctx, uname); err != nil {
+		return QID{}, err
+	}
+	return p.echo.Rattach(ctx, fid, afid, uname, aname)
+}
+
+// serveTLS serves ns with config on a local port, and returns the
+// port's address.
+func serveTLS(t *testing.T, ns NineServer, config *tls.Config) string {
+	t.Helper()
+	l, err := NewNetListener(func() NineServer { return ns }, WithTLS(config), WithHeaderTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.Serve(ln)
+	t.Cleanup(func() { l.Close() })
+	return ln.Addr().String()
+}
+
+// attachTLS connects to addr with config, and does a Tversion and a
+// Tattach as uname, returning the type of the Tattach's reply.
+func attachTLS(t *testing.T, addr string, config *tls.Config, uname string) (MType, error) {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	var b bytes.Buffer
+	MarshalTversionPkt(&b, NOTAG, 8192, Version)
+	if _, err := c.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	if typ, _ := readReply(t, c); typ != Rversion {
+		t.Fatalf("Tversion: want Rversion, got %v", RPCNames[typ])
+	}
+	MarshalTattachPkt(&b, 1, 1, NOFID, uname, "")
+	if _, err := c.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	typ, _ := readReply(t, c)
+	return typ, nil
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "localhost", ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	ns := &peerEcho{echo: newEcho(), peer: make(chan string, 1)}
+	addr := serveTLS(t, ns, &tls.Config{Certificates: []tls.Certificate{server.tls()}})
+	typ, err := attachTLS(t, addr, &tls.Config{RootCAs: roots, ServerName: "localhost"}, "glenda")
+	if err != nil || typ != Rattach {
+		t.Fatalf("Tattach: want Rattach, got %v, %v", RPCNames[typ], err)
+	}
+	if cn := <-ns.peer; cn != "" {
+		t.Errorf("PeerCertificate without client certificates: want none, got %q", cn)
+	}
+
+	// A client which doesn't trust the server gets nowhere.
+	if _, err := attachTLS(t, addr, &tls.Config{ServerName: "localhost"}, "glenda"); err == nil {
+		t.Errorf("Dial without the CA: want an error, got nil")
+	}
+
+	if _, err := NewNetListener(func() NineServer { return ns }, WithTLS(&tls.Config{})); err == nil {
+		t.Errorf("WithTLS without a certificate: want an error, got nil")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "localhost", ca)
+	glenda := newTestCert(t, "glenda", ca)
+	stranger := newTestCert(t, "glenda", newTestCert(t, "other ca", nil))
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := server.write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+	config, err := LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("LoadTLSConfig: want nil, got %v", err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("LoadTLSConfig with client CAs: want client certificates required, got %v", config.ClientAuth)
+	}
+
+	ns := &peerEcho{echo: newEcho(), peer: make(chan string, 1)}
+	addr := serveTLS(t, ns, config)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(c *testCert) *tls.Config {
+		config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if c != nil {
+			config.Certificates = []tls.Certificate{c.tls()}
+		}
+		return config
+	}
+
+	typ, err := attachTLS(t, addr, client(glenda), "glenda")
+	if err != nil || typ != Rattach {
+		t.Fatalf("Tattach as glenda: want Rattach, got %v, %v", RPCNames[typ], err)
+	}
+	if cn := <-ns.peer; cn != "glenda" {
+		t.Errorf("PeerCertificate: want glenda, got %q", cn)
+	}
+
+	typ, err = attachTLS(t, addr, client(glenda), "bootes")
+	if err != nil || typ != Rerror {
+		t.Errorf("Tattach as bootes with glenda's certificate: want Rerror, got %v, %v", RPCNames[typ], err)
+	}
+	<-ns.peer
+
+	// Without a good certificate, the handshake fails, though the
+	// client may only find out when it reads.
+	for name, c := range map[string]*testCert{"none": nil, "unknown CA": stranger} {
+		conn, err := tls.Dial("tcp", addr, client(c))
+		if err != nil {
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		var b bytes.Buffer
+		MarshalTversionPkt(&b, NOTAG, 8192, Version)
+		conn.Write(b.Bytes())
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("client certificate %s: want an error, got a reply", name)
+		}
+		conn.Close()
+	}
+	select {
+	case cn := <-ns.peer:
+		t.Errorf("Rattach was called for %q without a good certificate", cn)
+	default:
+	}
+}
+
+func TestCheckPeerUser(t *testing.T) {
+	if err := CheckPeerUser(context.Background(), "anyone"); err != nil {
+		t.Errorf("CheckPeerUser without TLS: want nil, got %v", err)
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "glenda"}}
+	ctx := context.WithValue(context.Background(), tlsStateKey{}, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}})
+	if err := CheckPeerUser(ctx, "glenda"); err != nil {
+		t.Errorf("CheckPeerUser(glenda) for glenda: want nil, got %v", err)
+	}
+	if err := CheckPeerUser(ctx, "bootes"); !errors.Is(err, ErrPermission) {
+		t.Errorf("CheckPeerUser(bootes) for glenda: want ErrPermission, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// A Level is how much a Logger is told.
+type Level int
+
+const (
+	// LevelInfo is for connections coming and going, and errors.
+	LevelInfo Level = iota
+	// LevelDebug adds a trace of each request.
+	LevelDebug
+	// LevelWire adds each message, its header decoded, dumped in hex.
+	LevelWire
+)
+
+// A Logger gets a NetListener's traces.
+type Logger interface {
+	// Enabled reports whether the Logger wants messages at level l,
+	// so that they needn't be made if not.
+	Enabled(l Level) bool
+	Logf(l Level, format string, args ...interface{})
+}
+
+// A ConnLogger is a Logger which makes another for each connection,
+// e.g. to put the connection's context in every message.
+type ConnLogger interface {
+	Logger
+	ForConn(remoteAddr string) Logger
+}
+
+// Enabled makes a Tracer a Logger. It wants messages up to LevelDebug,
+// which is all that a Trace function got before there were levels.
+func (t Tracer) Enabled(l Level) bool {
+	return t != nil && l <= LevelDebug
+}
+
+// Logf logs to t, whatever the level.
+func (t Tracer) Logf(l Level, format string, args ...interface{}) {
+	t(format, args...)
+}
+
+// LevelTracer is a Logger which sends messages up to Level to Trace.
+type LevelTracer struct {
+	Trace Tracer
+	Level Level
+}
+
+func (lt LevelTracer) Enabled(l Level) bool {
+	return lt.Trace != nil && l <= lt.Level
+}
+
+func (lt LevelTracer) Logf(l Level, format string, args ...interface{}) {
+	if lt.Enabled(l) {
+		lt.Trace(format, args...)
+	}
+}
+
+// dumpMessage describes m, or as much of it as is in hand, for
+// LevelWire: the header fields, and the FID of a T-message that has
+// one, and then m in hex. dir is "<-" for messages read, "->" for those
+// written.
+func dumpMessage(dir string, m []byte) string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "%s", dir)
+	if len(m) >= 7 {
+		t := MType(m[4])
+		sz := int(m[0]) | int(m[1])<<8 | int(m[2])<<16 | int(m[3])<<24
+		fmt.Fprintf(&s, " %v size %d tag %d", RPCNames[t], sz, Tag(m[5])|Tag(m[6])<<8)
+		if fid, ok := fidOf(m[5:]); ok && t%2 == 0 && t != Tversion && t != Tflush {
+			fmt.Fprintf(&s, " fid %d", fid)
+		}
+		if sz > len(m) {
+			fmt.Fprintf(&s, " (%d bytes of body follow)", sz-len(m))
+		}
+	}
+	fmt.Fprintf(&s, "\n%s", hex.Dump(m))
+	return s.String()
+}
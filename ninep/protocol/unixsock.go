@@ -0,0 +1,33 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package protocol
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// staleSocket reports whether err, from listening on the unix socket
+// address, was because a socket file is there with nobody listening on
+// it.
+func staleSocket(network, address string, err error) bool {
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		return false
+	}
+	if fi, err := os.Lstat(address); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	c, err := net.Dial(network, address)
+	if err == nil {
+		c.Close()
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
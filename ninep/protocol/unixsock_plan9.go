@@ -0,0 +1,10 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+// staleSocket reports false: there are no unix sockets to leave behind.
+func staleSocket(network, address string, err error) bool {
+	return false
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockListener is a net.Listener for VM sockets, which package net
+// doesn't know. Its socket is non-blocking, and in an os.File, so that
+// Accept waits in the runtime's poller, and Close wakes it.
+type vsockListener struct {
+	f    *os.File
+	addr vsockAddr
+}
+
+func listenVsock(cid, port uint32) (net.Listener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	l := &vsockListener{f: os.NewFile(uintptr(fd), "vsock"), addr: vsockAddr{cid, port}}
+	// For VMADDR_PORT_ANY, ask which port we got.
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			l.addr = vsockAddr{vm.CID, vm.Port}
+		}
+	}
+	return l, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	rc, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var nfd int
+	var sa unix.Sockaddr
+	var aerr error
+	err = rc.Read(func(fd uintptr) bool {
+		nfd, sa, aerr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return aerr != unix.EAGAIN
+	})
+	if err == nil {
+		err = aerr
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: l.addr, Err: err}
+	}
+	c := &vsockConn{File: os.NewFile(uintptr(nfd), "vsock"), local: l.addr}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		c.remote = vsockAddr{vm.CID, vm.Port}
+	}
+	return c, nil
+}
+
+func (l *vsockListener) Close() error {
+	return l.f.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// vsockConn is a net.Conn for a VM socket. Its os.File does the
+// reading, writing and deadlines.
+type vsockConn struct {
+	*os.File
+	local, remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+
+// dialVsock connects to port on cid. The connect blocks, and only then
+// is the socket made non-blocking, for the poller.
+func dialVsock(cid, port uint32) (net.Conn, error) {
+	raddr := vsockAddr{cid, port}
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: raddr, Err: os.NewSyscallError("socket", err)}
+	}
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: raddr, Err: os.NewSyscallError("connect", err)}
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: raddr, Err: os.NewSyscallError("setnonblock", err)}
+	}
+	c := &vsockConn{File: os.NewFile(uintptr(fd), "vsock"), remote: raddr}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			c.local = vsockAddr{vm.CID, vm.Port}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,22 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func listenVsock(cid, port uint32) (net.Listener, error) {
+	return nil, fmt.Errorf("vsock is not supported on %v", runtime.GOOS)
+}
+
+func dialVsock(cid, port uint32) (net.Conn, error) {
+	return nil, fmt.Errorf("vsock is not supported on %v", runtime.GOOS)
+}
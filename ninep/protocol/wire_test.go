@@ -0,0 +1,539 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// These are the 9P2000 messages as they are on the wire, put together
+// by hand from intro(5) and the pages after it, not by anything in
+// this package. The little-endian helpers below are for the messages
+// too long to write out byte by byte.
+
+func le16(v uint16) []byte { return []byte{byte(v), byte(v >> 8)} }
+
+func le32(v uint32) []byte { return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)} }
+
+func le64(v uint64) []byte { return append(le32(uint32(v)), le32(uint32(v>>32))...) }
+
+// wstr is a string as 9P sends them: a two byte length, then the bytes.
+func wstr(s string) []byte { return append(le16(uint16(len(s))), s...) }
+
+// wqid is a QID: type[1] version[4] path[8].
+func wqid(q QID) []byte {
+	return append(append([]byte{q.Type}, le32(q.Version)...), le64(q.Path)...)
+}
+
+// wmsg is a message: size[4] type[1] tag[2], then the body.
+func wmsg(t MType, tag Tag, body ...[]byte) []byte {
+	b := append([]byte{byte(t)}, le16(uint16(tag))...)
+	for _, p := range body {
+		b = append(b, p...)
+	}
+	return append(le32(uint32(4+len(b))), b...)
+}
+
+var (
+	wireQID = QID{Type: QTDIR, Version: 0x01020304, Path: 0x0102030405060708}
+
+	// A dir with nothing in its strings.
+	wireEmptyDir = []byte{
+		47, 0, // size, not counting itself
+		0, 0, // type
+		0, 0, 0, 0, // dev
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // qid
+		0, 0, 0, 0, // mode
+		0, 0, 0, 0, // atime
+		0, 0, 0, 0, // mtime
+		0, 0, 0, 0, 0, 0, 0, 0, // length
+		0, 0, // name
+		0, 0, // uid
+		0, 0, // gid
+		0, 0, // muid
+	}
+	wireDir = []byte{
+		56, 0,
+		1, 0, // type
+		2, 0, 0, 0, // dev
+		QTDIR, 4, 3, 2, 1, 8, 7, 6, 5, 4, 3, 2, 1, // qid
+		0xed, 0x01, 0, 0x80, // DMDIR|0755
+		0x10, 0, 0, 0, // atime
+		0x20, 0, 0, 0, // mtime
+		0, 0x10, 0, 0, 0, 0, 0, 0, // length 4096
+		3, 0, 'u', 's', 'r',
+		3, 0, 'g', 'l', 'e',
+		3, 0, 's', 'y', 's',
+		0, 0, // muid
+	}
+	wireDirDir = Dir{
+		Type:   1,
+		Dev:    2,
+		QID:    wireQID,
+		Mode:   DMDIR | 0755,
+		Atime:  0x10,
+		Mtime:  0x20,
+		Length: 4096,
+		Name:   "usr",
+		User:   "gle",
+		Group:  "sys",
+	}
+	// A 9P2000.u stat, of a symlink: as Dir.Unmarshal, which keeps
+	// the first fields, and UnmarshalDirU, which takes it all, see it.
+	wireDirU = []byte{
+		65, 0,
+		0, 0, // type
+		0, 0, 0, 0, // dev
+		QTSYMLINK, 1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, // qid
+		0xff, 0x01, 0, 0x02, // DMSYMLINK|0777
+		3, 0, 0, 0, // atime
+		4, 0, 0, 0, // mtime
+		5, 0, 0, 0, 0, 0, 0, 0, // length
+		1, 0, 'l',
+		1, 0, 'u',
+		1, 0, 'g',
+		0, 0, // muid
+		1, 0, 't', // extension
+		0xe8, 0x03, 0, 0, // n_uid 1000
+		100, 0, 0, 0, // n_gid 100
+		0xff, 0xff, 0xff, 0xff, // n_muid
+	}
+	dirU = DirU{
+		Dir: Dir{
+			QID:    QID{Type: QTSYMLINK, Version: 1, Path: 2},
+			Mode:   DMSYMLINK | 0777,
+			Atime:  3,
+			Mtime:  4,
+			Length: 5,
+			Name:   "l",
+			User:   "u",
+			Group:  "g",
+		},
+		Extension: "t",
+		NUid:      1000,
+		NGid:      100,
+		NMuid:     NOUID,
+	}
+
+	// The longest name a string can hold, and the longest a dir
+	// can, whose size is in two bytes too.
+	longName    = strings.Repeat("n", 1<<16-1)
+	longDirName = longName[:1<<16-1-47]
+	// The most elements one Twalk may walk.
+	walk16 = strings.Split("a/b/c/d/e/f/g/h/i/j/k/l/m/n/o/p", "/")
+)
+
+func wireWalk16() []byte {
+	var b []byte
+	for _, p := range walk16 {
+		b = append(b, wstr(p)...)
+	}
+	return wmsg(Twalk, 1, le32(1), le32(2), le16(16), b)
+}
+
+func wireRwalk16() []byte {
+	var b []byte
+	for i := range walk16 {
+		b = append(b, wqid(QID{Path: uint64(i)})...)
+	}
+	return wmsg(Rwalk, 1, le16(16), b)
+}
+
+func qids16() []QID {
+	q := make([]QID, 16)
+	for i := range q {
+		q[i].Path = uint64(i)
+	}
+	return q
+}
+
+// unmarshaled gathers what an Unmarshal function returns, so that the
+// cases below can all be compared the same way.
+func unmarshaled(v ...interface{}) []interface{} { return v }
+
+// wireTests are the golden messages, with what marshals them, what
+// unmarshals them, and what the latter returns. They seed the fuzz
+// tests too.
+var wireTests = []struct {
+	n    string
+	wire []byte
+	m    func(*bytes.Buffer)
+	u    func(*bytes.Buffer) []interface{}
+	want []interface{}
+}{
+	{
+		n: "Tversion",
+		wire: []byte{
+			19, 0, 0, 0, uint8(Tversion), 0xff, 0xff,
+			0, 0x20, 0, 0, // msize 8192
+			6, 0, '9', 'P', '2', '0', '0', '0',
+		},
+		m:    func(b *bytes.Buffer) { MarshalTversionPkt(b, NOTAG, 8192, Version) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTversionPkt(b)) },
+		want: unmarshaled(MaxSize(8192), Version, NOTAG, nil),
+	},
+	{
+		n: "Rversion unknown",
+		wire: []byte{
+			20, 0, 0, 0, uint8(Rversion), 0xff, 0xff,
+			0, 0x20, 0, 0,
+			7, 0, 'u', 'n', 'k', 'n', 'o', 'w', 'n',
+		},
+		m:    func(b *bytes.Buffer) { MarshalRversionPkt(b, NOTAG, 8192, VersionUnknown) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRversionPkt(b)) },
+		want: unmarshaled(MaxSize(8192), VersionUnknown, NOTAG, nil),
+	},
+	{
+		n: "Tauth",
+		wire: []byte{
+			21, 0, 0, 0, uint8(Tauth), 1, 0,
+			5, 0, 0, 0, // afid
+			6, 0, 'g', 'l', 'e', 'n', 'd', 'a',
+			0, 0, // aname
+		},
+		m:    func(b *bytes.Buffer) { MarshalTauthPkt(b, 1, 5, "glenda", "") },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTauthPkt(b)) },
+		want: unmarshaled(FID(5), "glenda", "", Tag(1), nil),
+	},
+	{
+		n: "Rauth",
+		wire: []byte{
+			20, 0, 0, 0, uint8(Rauth), 1, 0,
+			QTAUTH, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0,
+		},
+		m:    func(b *bytes.Buffer) { MarshalRauthPkt(b, 1, QID{Type: QTAUTH, Path: 1}) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRauthPkt(b)) },
+		want: unmarshaled(QID{Type: QTAUTH, Path: 1}, Tag(1), nil),
+	},
+	{
+		n: "Rerror",
+		wire: []byte{
+			13, 0, 0, 0, uint8(Rerror), 1, 0,
+			4, 0, 'n', 'o', 'p', 'e',
+		},
+		m:    func(b *bytes.Buffer) { MarshalRerrorPkt(b, 1, "nope") },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRerrorPkt(b)) },
+		want: unmarshaled("nope", Tag(1), nil),
+	},
+	{
+		n:    "Tflush",
+		wire: []byte{9, 0, 0, 0, uint8(Tflush), 2, 0, 1, 0},
+		m:    func(b *bytes.Buffer) { MarshalTflushPkt(b, 2, 1) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTflushPkt(b)) },
+		want: unmarshaled(Tag(1), Tag(2), nil),
+	},
+	{
+		n:    "Rflush",
+		wire: []byte{7, 0, 0, 0, uint8(Rflush), 2, 0},
+		m:    func(b *bytes.Buffer) { MarshalRflushPkt(b, 2) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRflushPkt(b)) },
+		want: unmarshaled(Tag(2), nil),
+	},
+	{
+		n: "Tattach",
+		wire: []byte{
+			26, 0, 0, 0, uint8(Tattach), 1, 0,
+			0, 0, 0, 0, // fid
+			0xff, 0xff, 0xff, 0xff, // afid
+			6, 0, 'g', 'l', 'e', 'n', 'd', 'a',
+			1, 0, '/',
+		},
+		m:    func(b *bytes.Buffer) { MarshalTattachPkt(b, 1, 0, NOFID, "glenda", "/") },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTattachPkt(b)) },
+		want: unmarshaled(FID(0), NOFID, "glenda", "/", Tag(1), nil),
+	},
+	{
+		n: "Rattach",
+		wire: []byte{
+			20, 0, 0, 0, uint8(Rattach), 1, 0,
+			QTDIR, 4, 3, 2, 1, 8, 7, 6, 5, 4, 3, 2, 1,
+		},
+		m:    func(b *bytes.Buffer) { MarshalRattachPkt(b, 1, wireQID) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRattachPkt(b)) },
+		want: unmarshaled(wireQID, Tag(1), nil),
+	},
+	{
+		// A walk of nothing clones the fid.
+		n: "Twalk of no names",
+		wire: []byte{
+			17, 0, 0, 0, uint8(Twalk), 1, 0,
+			1, 0, 0, 0, // fid
+			2, 0, 0, 0, // newfid
+			0, 0, // nwname
+		},
+		m:    func(b *bytes.Buffer) { MarshalTwalkPkt(b, 1, 1, 2, nil) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTwalkPkt(b)) },
+		want: unmarshaled(FID(1), FID(2), []string{}, Tag(1), nil),
+	},
+	{
+		n: "Twalk",
+		wire: []byte{
+			26, 0, 0, 0, uint8(Twalk), 1, 0,
+			1, 0, 0, 0,
+			2, 0, 0, 0,
+			2, 0,
+			3, 0, 'u', 's', 'r',
+			2, 0, '.', '.',
+		},
+		m:    func(b *bytes.Buffer) { MarshalTwalkPkt(b, 1, 1, 2, []string{"usr", ".."}) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTwalkPkt(b)) },
+		want: unmarshaled(FID(1), FID(2), []string{"usr", ".."}, Tag(1), nil),
+	},
+	{
+		n:    "Twalk of MaxWElem names",
+		wire: wireWalk16(),
+		m:    func(b *bytes.Buffer) { MarshalTwalkPkt(b, 1, 1, 2, walk16) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTwalkPkt(b)) },
+		want: unmarshaled(FID(1), FID(2), walk16, Tag(1), nil),
+	},
+	{
+		n:    "Twalk of the longest name",
+		wire: wmsg(Twalk, 1, le32(1), le32(2), le16(1), wstr(longName)),
+		m:    func(b *bytes.Buffer) { MarshalTwalkPkt(b, 1, 1, 2, []string{longName}) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTwalkPkt(b)) },
+		want: unmarshaled(FID(1), FID(2), []string{longName}, Tag(1), nil),
+	},
+	{
+		n:    "Rwalk of nothing",
+		wire: []byte{9, 0, 0, 0, uint8(Rwalk), 1, 0, 0, 0},
+		m:    func(b *bytes.Buffer) { MarshalRwalkPkt(b, 1, nil) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRwalkPkt(b)) },
+		want: unmarshaled([]QID{}, Tag(1), nil),
+	},
+	{
+		n:    "Rwalk of MaxWElem QIDs",
+		wire: wireRwalk16(),
+		m:    func(b *bytes.Buffer) { MarshalRwalkPkt(b, 1, qids16()) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRwalkPkt(b)) },
+		want: unmarshaled(qids16(), Tag(1), nil),
+	},
+	{
+		n:    "Topen",
+		wire: []byte{12, 0, 0, 0, uint8(Topen), 1, 0, 3, 0, 0, 0, ORDWR | OTRUNC},
+		m:    func(b *bytes.Buffer) { MarshalTopenPkt(b, 1, 3, ORDWR|OTRUNC) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTopenPkt(b)) },
+		want: unmarshaled(FID(3), Mode(ORDWR|OTRUNC), Tag(1), nil),
+	},
+	{
+		n: "Ropen",
+		wire: []byte{
+			24, 0, 0, 0, uint8(Ropen), 1, 0,
+			QTDIR, 4, 3, 2, 1, 8, 7, 6, 5, 4, 3, 2, 1,
+			0, 0x20, 0, 0, // iounit
+		},
+		m:    func(b *bytes.Buffer) { MarshalRopenPkt(b, 1, wireQID, 8192) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRopenPkt(b)) },
+		want: unmarshaled(wireQID, MaxSize(8192), Tag(1), nil),
+	},
+	{
+		n: "Tcreate",
+		wire: []byte{
+			21, 0, 0, 0, uint8(Tcreate), 1, 0,
+			3, 0, 0, 0,
+			3, 0, 't', 'm', 'p',
+			0xff, 0x01, 0, 0x80, // DMDIR|0777
+			OREAD,
+		},
+		m:    func(b *bytes.Buffer) { MarshalTcreatePkt(b, 1, 3, "tmp", DMDIR|0777, OREAD) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTcreatePkt(b)) },
+		want: unmarshaled(FID(3), "tmp", Perm(DMDIR|0777), Mode(OREAD), Tag(1), nil),
+	},
+	{
+		n:    "Tcreate of the longest name",
+		wire: wmsg(Tcreate, 1, le32(3), wstr(longName), le32(0644), []byte{OWRITE}),
+		m:    func(b *bytes.Buffer) { MarshalTcreatePkt(b, 1, 3, longName, 0644, OWRITE) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTcreatePkt(b)) },
+		want: unmarshaled(FID(3), longName, Perm(0644), Mode(OWRITE), Tag(1), nil),
+	},
+	{
+		n: "Rcreate",
+		wire: []byte{
+			24, 0, 0, 0, uint8(Rcreate), 1, 0,
+			QTDIR, 4, 3, 2, 1, 8, 7, 6, 5, 4, 3, 2, 1,
+			0, 0, 0, 0,
+		},
+		m:    func(b *bytes.Buffer) { MarshalRcreatePkt(b, 1, wireQID, 0) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRcreatePkt(b)) },
+		want: unmarshaled(wireQID, MaxSize(0), Tag(1), nil),
+	},
+	{
+		n: "Tread",
+		wire: []byte{
+			23, 0, 0, 0, uint8(Tread), 1, 0,
+			3, 0, 0, 0,
+			8, 7, 6, 5, 4, 3, 2, 1, // offset
+			0, 0x20, 0, 0, // count
+		},
+		m:    func(b *bytes.Buffer) { MarshalTreadPkt(b, 1, 3, 0x0102030405060708, 8192) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTreadPkt(b)) },
+		want: unmarshaled(FID(3), Offset(0x0102030405060708), Count(8192), Tag(1), nil),
+	},
+	{
+		n:    "Rread of nothing",
+		wire: []byte{11, 0, 0, 0, uint8(Rread), 1, 0, 0, 0, 0, 0},
+		m:    func(b *bytes.Buffer) { MarshalRreadPkt(b, 1, nil) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRreadPkt(b)) },
+		want: unmarshaled([]uint8{}, Tag(1), nil),
+	},
+	{
+		n:    "Rread",
+		wire: []byte{14, 0, 0, 0, uint8(Rread), 1, 0, 3, 0, 0, 0, 'h', 'i', '\n'},
+		m:    func(b *bytes.Buffer) { MarshalRreadPkt(b, 1, []byte("hi\n")) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRreadPkt(b)) },
+		want: unmarshaled([]uint8("hi\n"), Tag(1), nil),
+	},
+	{
+		n: "Twrite",
+		wire: []byte{
+			26, 0, 0, 0, uint8(Twrite), 1, 0,
+			3, 0, 0, 0,
+			0, 0x10, 0, 0, 0, 0, 0, 0, // offset 4096
+			3, 0, 0, 0, 'h', 'i', '\n',
+		},
+		m:    func(b *bytes.Buffer) { MarshalTwritePkt(b, 1, 3, 4096, []byte("hi\n")) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTwritePkt(b)) },
+		want: unmarshaled(FID(3), Offset(4096), []uint8("hi\n"), Tag(1), nil),
+	},
+	{
+		n:    "Rwrite",
+		wire: []byte{11, 0, 0, 0, uint8(Rwrite), 1, 0, 3, 0, 0, 0},
+		m:    func(b *bytes.Buffer) { MarshalRwritePkt(b, 1, 3) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRwritePkt(b)) },
+		want: unmarshaled(Count(3), Tag(1), nil),
+	},
+	{
+		n:    "Tclunk",
+		wire: []byte{11, 0, 0, 0, uint8(Tclunk), 1, 0, 3, 0, 0, 0},
+		m:    func(b *bytes.Buffer) { MarshalTclunkPkt(b, 1, 3) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTclunkPkt(b)) },
+		want: unmarshaled(FID(3), Tag(1), nil),
+	},
+	{
+		n:    "Rclunk",
+		wire: []byte{7, 0, 0, 0, uint8(Rclunk), 1, 0},
+		m:    func(b *bytes.Buffer) { MarshalRclunkPkt(b, 1) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRclunkPkt(b)) },
+		want: unmarshaled(Tag(1), nil),
+	},
+	{
+		n:    "Tremove",
+		wire: []byte{11, 0, 0, 0, uint8(Tremove), 1, 0, 3, 0, 0, 0},
+		m:    func(b *bytes.Buffer) { MarshalTremovePkt(b, 1, 3) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTremovePkt(b)) },
+		want: unmarshaled(FID(3), Tag(1), nil),
+	},
+	{
+		n:    "Rremove",
+		wire: []byte{7, 0, 0, 0, uint8(Rremove), 1, 0},
+		m:    func(b *bytes.Buffer) { MarshalRremovePkt(b, 1) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRremovePkt(b)) },
+		want: unmarshaled(Tag(1), nil),
+	},
+	{
+		n:    "Tstat",
+		wire: []byte{11, 0, 0, 0, uint8(Tstat), 1, 0, 3, 0, 0, 0},
+		m:    func(b *bytes.Buffer) { MarshalTstatPkt(b, 1, 3) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTstatPkt(b)) },
+		want: unmarshaled(FID(3), Tag(1), nil),
+	},
+	{
+		// The stat is counted twice: by Rstat's n[2], then
+		// by its own size[2].
+		n:    "Rstat",
+		wire: append([]byte{67, 0, 0, 0, uint8(Rstat), 1, 0, 58, 0}, wireDir...),
+		m:    func(b *bytes.Buffer) { MarshalRstatPkt(b, 1, wireDir) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRstatPkt(b)) },
+		want: unmarshaled(wireDir, Tag(1), nil),
+	},
+	{
+		n:    "Twstat of an empty dir",
+		wire: append([]byte{62, 0, 0, 0, uint8(Twstat), 1, 0, 3, 0, 0, 0, 49, 0}, wireEmptyDir...),
+		m:    func(b *bytes.Buffer) { MarshalTwstatPkt(b, 1, 3, wireEmptyDir) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalTwstatPkt(b)) },
+		want: unmarshaled(FID(3), wireEmptyDir, Tag(1), nil),
+	},
+	{
+		n:    "Rwstat",
+		wire: []byte{7, 0, 0, 0, uint8(Rwstat), 1, 0},
+		m:    func(b *bytes.Buffer) { MarshalRwstatPkt(b, 1) },
+		u:    func(b *bytes.Buffer) []interface{} { return unmarshaled(UnmarshalRwstatPkt(b)) },
+		want: unmarshaled(Tag(1), nil),
+	},
+}
+
+func TestWire(t *testing.T) {
+	for _, tt := range wireTests {
+		var b bytes.Buffer
+		tt.m(&b)
+		if !bytes.Equal(b.Bytes(), tt.wire) {
+			t.Errorf("%s: marshaled\n%v\nwant\n%v", tt.n, abbrev(b.Bytes()), abbrev(tt.wire))
+		}
+		if typ := MType(tt.wire[4]); typ < Tversion || typ >= Tlast || RPCNames[typ] == "" {
+			t.Errorf("%s: bad type %d in the wire form", tt.n, typ)
+		}
+		got := tt.u(bytes.NewBuffer(append([]byte{}, tt.wire[5:]...)))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: unmarshaled %v, want %v", tt.n, abbrev(got), abbrev(tt.want))
+		}
+
+		// A byte short, or a byte over, is an error.
+		short := tt.u(bytes.NewBuffer(append([]byte{}, tt.wire[5:len(tt.wire)-1]...)))
+		if err := short[len(short)-1]; err == nil {
+			t.Errorf("%s: unmarshaled a byte short: want an error, got nil", tt.n)
+		}
+		long := tt.u(bytes.NewBuffer(append(append([]byte{}, tt.wire[5:]...), 0)))
+		if err := long[len(long)-1]; err == nil {
+			t.Errorf("%s: unmarshaled a byte over: want an error, got nil", tt.n)
+		}
+	}
+
+	// Nor may a walk be longer than MaxWElem.
+	twalk := append(wireWalk16(), wstr("q")...)
+	twalk[17] = 17
+	if _, _, _, _, err := UnmarshalTwalkPkt(bytes.NewBuffer(twalk[5:])); err == nil {
+		t.Errorf("Twalk of %d names: want an error, got nil", MaxWElem+1)
+	}
+	rwalk := append(wireRwalk16(), wqid(QID{})...)
+	rwalk[7] = 17
+	if _, _, err := UnmarshalRwalkPkt(bytes.NewBuffer(rwalk[5:])); err == nil {
+		t.Errorf("Rwalk of %d QIDs: want an error, got nil", MaxWElem+1)
+	}
+}
+
+// abbrev keeps the longest names from filling the screen.
+func abbrev(v interface{}) string {
+	s := fmt.Sprint(v)
+	if len(s) > 200 {
+		s = s[:200] + "..."
+	}
+	return s
+}
+
+func TestWireDir(t *testing.T) {
+	for _, tt := range []struct {
+		n    string
+		wire []byte
+		d    Dir
+	}{
+		{"dir", wireDir, wireDirDir},
+		{"empty dir", wireEmptyDir, Dir{}},
+		{"longest name", append(append(le16(1<<16-1), wireEmptyDir[2:41]...),
+			append(wstr(longDirName), 0, 0, 0, 0, 0, 0)...), Dir{Name: longDirName}},
+	} {
+		var b bytes.Buffer
+		Marshaldir(&b, tt.d)
+		if !bytes.Equal(b.Bytes(), tt.wire) {
+			t.Errorf("%s: marshaled\n%v\nwant\n%v", tt.n, abbrev(b.Bytes()), abbrev(tt.wire))
+		}
+		d, err := Unmarshaldir(bytes.NewBuffer(append([]byte{}, tt.wire...)))
+		if err != nil || !reflect.DeepEqual(d, tt.d) {
+			t.Errorf("%s: unmarshaled (%v, %v), want (%v, nil)", tt.n, abbrev(d), err, abbrev(tt.d))
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// A Quota limits the total length of the files in an export. One Quota
+// is shared by the QuotaFileServers for every connection to it.
+type Quota struct {
+	max int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// NewQuota returns a Quota of max bytes, of which used are taken
+// already, e.g. as found by ufs.DiskUsage.
+func NewQuota(max, used int64) *Quota {
+	return &Quota{max: max, used: used}
+}
+
+// Used returns the number of bytes in use.
+func (q *Quota) Used() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used
+}
+
+// take takes n more bytes, and reports whether there was room for
+// them. Giving bytes back, with n < 0, always works.
+func (q *Quota) take(n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n > 0 && q.used+n > q.max {
+		return false
+	}
+	q.used += n
+	return true
+}
+
+// full reports whether there is no room for anything more.
+func (q *Quota) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used >= q.max
+}
+
+// QuotaFileServer serves what its NineServer does, but keeps the
+// lengths of its files within Quota. Writes and Twstats that would
+// lengthen files beyond it, and Tcreates once it is full, fail with
+// protocol.ErrNoSpace. Removing a file gives back its length, as do
+// opening it OTRUNC, and clunking it when it was opened ORCLOSE.
+// Lengths are as Rstat reports them, so a sparse file counts in full.
+// Two FIDs extending the same file at once may both be charged for
+// the same bytes: the quota errs on the side of refusing. A write to a
+// file whose length can't be had fails, as it can't be charged for.
+//
+// Reads go to the NineServer's Rstream or RreadInto, if it has them,
+// and Tstatfs to its Rstatfs. It is never a NineServerL, though: the
+// 9P2000.L messages which make and lengthen files would get round the
+// quota, so connections speak 9P2000.u at most.
+type QuotaFileServer struct {
+	protocol.NineServer
+	Quota *Quota
+
+	// mu guards rclose, the FIDs opened ORCLOSE, whose files go when
+	// they are clunked.
+	mu     sync.Mutex
+	rclose map[protocol.FID]bool
+}
+
+// QuotaNineServer returns s, limited by q.
+func QuotaNineServer(s protocol.NineServer, q *Quota) *QuotaFileServer {
+	return &QuotaFileServer{NineServer: s, Quota: q}
+}
+
+func (qfs *QuotaFileServer) Rversion(ctx context.Context, msize protocol.MaxSize, version string) (protocol.MaxSize, string, error) {
+	// As for DebugFileServer, we look like a UNineServer whether or
+	// not we wrap one.
+	if _, ok := qfs.NineServer.(protocol.UNineServer); !ok && version == protocol.VersionU {
+		version = protocol.Version
+	}
+	return qfs.NineServer.Rversion(ctx, msize, version)
+}
+
+func (qfs *QuotaFileServer) RattachU(ctx context.Context, fid protocol.FID, afid protocol.FID, uname string, aname string, nuname uint32) (protocol.QID, error) {
+	return qfs.NineServer.(protocol.UNineServer).RattachU(ctx, fid, afid, uname, aname, nuname)
+}
+
+func (qfs *QuotaFileServer) Ropen(ctx context.Context, fid protocol.FID, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	var l int64
+	var lerr error
+	if mode&protocol.OTRUNC != 0 {
+		l, lerr = qfs.length(ctx, fid)
+	}
+	q, iounit, err := qfs.NineServer.Ropen(ctx, fid, mode)
+	if err != nil {
+		return q, iounit, err
+	}
+	if mode&protocol.OTRUNC != 0 && lerr == nil {
+		qfs.Quota.take(-l)
+	}
+	qfs.opened(fid, mode)
+	return q, iounit, nil
+}
+
+func (qfs *QuotaFileServer) Rcreate(ctx context.Context, fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	if qfs.Quota.full() {
+		return protocol.QID{}, 0, protocol.ErrNoSpace
+	}
+	q, iounit, err := qfs.NineServer.Rcreate(ctx, fid, name, perm, mode)
+	if err == nil {
+		qfs.opened(fid, mode)
+	}
+	return q, iounit, err
+}
+
+func (qfs *QuotaFileServer) RcreateU(ctx context.Context, fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode, extension string) (protocol.QID, protocol.MaxSize, error) {
+	if qfs.Quota.full() {
+		return protocol.QID{}, 0, protocol.ErrNoSpace
+	}
+	q, iounit, err := qfs.NineServer.(protocol.UNineServer).RcreateU(ctx, fid, name, perm, mode, extension)
+	if err == nil {
+		qfs.opened(fid, mode)
+	}
+	return q, iounit, err
+}
+
+// opened notes that fid was opened with mode, to give back its length
+// when it is clunked, if mode has ORCLOSE.
+func (qfs *QuotaFileServer) opened(fid protocol.FID, mode protocol.Mode) {
+	if mode&protocol.ORCLOSE == 0 {
+		return
+	}
+	qfs.mu.Lock()
+	defer qfs.mu.Unlock()
+	if qfs.rclose == nil {
+		qfs.rclose = make(map[protocol.FID]bool)
+	}
+	qfs.rclose[fid] = true
+}
+
+// closed reports whether fid was opened ORCLOSE, and forgets it.
+func (qfs *QuotaFileServer) closed(fid protocol.FID) bool {
+	qfs.mu.Lock()
+	defer qfs.mu.Unlock()
+	rclose := qfs.rclose[fid]
+	delete(qfs.rclose, fid)
+	return rclose
+}
+
+// length returns the length of the file fid, which is 0 for a
+// directory.
+func (qfs *QuotaFileServer) length(ctx context.Context, fid protocol.FID) (int64, error) {
+	b, err := qfs.NineServer.Rstat(ctx, fid)
+	if err != nil {
+		return 0, err
+	}
+	// A 9P2000.u stat starts with a 9P2000 one.
+	var d protocol.Dir
+	if err := d.Unmarshal(b); err != nil || d.Mode&protocol.DMDIR != 0 {
+		return 0, err
+	}
+	return int64(d.Length), nil
+}
+
+func (qfs *QuotaFileServer) Rwrite(ctx context.Context, fid protocol.FID, o protocol.Offset, b []byte) (protocol.Count, error) {
+	l, err := qfs.length(ctx, fid)
+	if err != nil {
+		return -1, err
+	}
+	grow := int64(o) + int64(len(b)) - l
+	if grow < 0 {
+		grow = 0
+	}
+	if !qfs.Quota.take(grow) {
+		return -1, protocol.ErrNoSpace
+	}
+	n, err := qfs.NineServer.Rwrite(ctx, fid, o, b)
+	// Give back what a short or failed write didn't use.
+	grew := int64(o) + int64(n) - l
+	if n < 0 || grew < 0 {
+		grew = 0
+	}
+	qfs.Quota.take(grew - grow)
+	return n, err
+}
+
+func (qfs *QuotaFileServer) Rwstat(ctx context.Context, fid protocol.FID, b []byte) error {
+	var d protocol.Dir
+	if err := d.Unmarshal(b); err != nil || d.Length == protocol.NullDir.Length {
+		return qfs.NineServer.Rwstat(ctx, fid, b)
+	}
+	l, err := qfs.length(ctx, fid)
+	if err != nil {
+		return err
+	}
+	grow := int64(d.Length) - l
+	if grow > 0 && !qfs.Quota.take(grow) {
+		return protocol.ErrNoSpace
+	}
+	if err := qfs.NineServer.Rwstat(ctx, fid, b); err != nil {
+		if grow > 0 {
+			qfs.Quota.take(-grow)
+		}
+		return err
+	}
+	if grow < 0 {
+		qfs.Quota.take(grow)
+	}
+	return nil
+}
+
+func (qfs *QuotaFileServer) Rclunk(ctx context.Context, fid protocol.FID) error {
+	if !qfs.closed(fid) {
+		return qfs.NineServer.Rclunk(ctx, fid)
+	}
+	l, lerr := qfs.length(ctx, fid)
+	err := qfs.NineServer.Rclunk(ctx, fid)
+	if err == nil && lerr == nil {
+		qfs.Quota.take(-l)
+	}
+	return err
+}
+
+func (qfs *QuotaFileServer) Rremove(ctx context.Context, fid protocol.FID) error {
+	qfs.closed(fid)
+	// Tremove clunks fid, whether or not it works, so look first.
+	l, lerr := qfs.length(ctx, fid)
+	err := qfs.NineServer.Rremove(ctx, fid)
+	if err == nil && lerr == nil {
+		qfs.Quota.take(-l)
+	}
+	return err
+}
+
+// Rstream streams the read if the NineServer can, and otherwise leaves
+// it to RreadInto.
+func (qfs *QuotaFileServer) Rstream(ctx context.Context, fid protocol.FID, o protocol.Offset, c protocol.Count) (io.Reader, protocol.Count, error) {
+	if s, ok := qfs.NineServer.(protocol.StreamNineServer); ok {
+		return s.Rstream(ctx, fid, o, c)
+	}
+	return nil, 0, nil
+}
+
+// RreadInto reads into b if the NineServer can, and otherwise copies
+// what its Rread returns.
+func (qfs *QuotaFileServer) RreadInto(ctx context.Context, fid protocol.FID, o protocol.Offset, b []byte) (int, error) {
+	if r, ok := qfs.NineServer.(protocol.ReadIntoNineServer); ok {
+		return r.RreadInto(ctx, fid, o, b)
+	}
+	d, err := qfs.NineServer.Rread(ctx, fid, o, protocol.Count(len(b)))
+	return copy(b, d), err
+}
+
+func (qfs *QuotaFileServer) Rstatfs(ctx context.Context, fid protocol.FID) (protocol.Statfs, error) {
+	s, ok := qfs.NineServer.(protocol.StatfsNineServer)
+	if !ok {
+		return protocol.Statfs{}, fmt.Errorf("statfs not supported")
+	}
+	return s.Rstatfs(ctx, fid)
+}
+
+// ConnClosed passes the news on, if the NineServer wants it, and gives
+// back the lengths of the files opened ORCLOSE, which it clunks.
+func (qfs *QuotaFileServer) ConnClosed() {
+	cn, ok := qfs.NineServer.(protocol.ClosingNineServer)
+	if !ok {
+		return
+	}
+	qfs.mu.Lock()
+	fids := qfs.rclose
+	qfs.rclose = nil
+	qfs.mu.Unlock()
+	var l int64
+	for fid := range fids {
+		if n, err := qfs.length(context.Background(), fid); err == nil {
+			l += n
+		}
+	}
+	cn.ConnClosed()
+	qfs.Quota.take(-l)
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package replay plays back captures made with protocol.WithCapture:
+// a captured client's requests are sent again, as the client sent
+// them, and the replies compared with those captured. Serve plays them
+// to a NineServer in this process; Client, to a server at the far end
+// of a connection. Either way, what a client did can be done again
+// without the client.
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// Wait is how long a replay waits for the replies which, in the
+// capture, came before a request. Once one wait has run out, a replay
+// sends the rest without waiting.
+var Wait = 5 * time.Second
+
+// Sessions splits a capture into what each connection read and wrote,
+// in the order the connections started.
+func Sessions(es []protocol.CaptureEntry) [][]protocol.RecordEntry {
+	byConn := make(map[uint32][]protocol.RecordEntry)
+	var conns []uint32
+	for _, e := range es {
+		if _, ok := byConn[e.Conn]; !ok {
+			conns = append(conns, e.Conn)
+		}
+		byConn[e.Conn] = append(byConn[e.Conn], e.RecordEntry)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i] < conns[j] })
+	var ss [][]protocol.RecordEntry
+	for _, c := range conns {
+		ss = append(ss, byConn[c])
+	}
+	return ss
+}
+
+// Serve plays session, one of Sessions, to ns, served as
+// protocol.ServeFromRWC serves a connection, and compares the replies
+// with the session's, as protocol.CompareReplies does.
+func Serve(session []protocol.RecordEntry, ns protocol.NineServer) error {
+	p, p2 := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		protocol.ServeFromRWC(p2, ns, "replay")
+	}()
+	err := Client(session, p)
+	<-served
+	return err
+}
+
+// Client plays session, one of Sessions, to the server at the far end
+// of rwc, and compares the replies with the session's, as
+// protocol.CompareReplies does. It is paced by the session: no request
+// is sent until as many replies have come as had come when the client
+// sent it, up to Wait. rwc is closed once the replies are in.
+func Client(session []protocol.RecordEntry, rwc io.ReadWriteCloser) error {
+	r := &replies{}
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		r.read(rwc)
+	}()
+	want, err := send(session, rwc, r)
+	rwc.Close()
+	<-read
+	if err != nil {
+		return err
+	}
+	return protocol.CompareReplies(want, r.bytes())
+}
+
+// send sends the session's requests on w, paced by r, and returns the
+// replies the session has.
+func send(session []protocol.RecordEntry, w io.Writer, r *replies) ([]byte, error) {
+	var want bytes.Buffer
+	var n int
+	for _, e := range session {
+		if e.Out {
+			want.Write(e.Data)
+			n++
+			continue
+		}
+		r.wait(n)
+		if _, err := w.Write(e.Data); err != nil {
+			return nil, fmt.Errorf("sending request: %v", err)
+		}
+	}
+	r.wait(n)
+	return want.Bytes(), nil
+}
+
+// replies keeps the replies a replay gets.
+type replies struct {
+	// late is set once a wait has run out, after which we don't.
+	late bool
+
+	// mu guards below, which read writes.
+	mu  sync.Mutex
+	got bytes.Buffer
+	n   int
+}
+
+// read reads replies from r until it fails.
+func (rs *replies) read(r io.Reader) {
+	for {
+		var l [4]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return
+		}
+		sz := binary.LittleEndian.Uint32(l[:])
+		if sz < 7 || sz > protocol.MSIZE {
+			return
+		}
+		m := make([]byte, sz)
+		copy(m, l[:])
+		if _, err := io.ReadFull(r, m[4:]); err != nil {
+			return
+		}
+		rs.mu.Lock()
+		rs.got.Write(m)
+		rs.n++
+		rs.mu.Unlock()
+	}
+}
+
+// wait waits until n replies have come.
+func (rs *replies) wait(n int) {
+	for start := time.Now(); !rs.late; time.Sleep(time.Millisecond) {
+		rs.mu.Lock()
+		got := rs.n
+		rs.mu.Unlock()
+		if got >= n {
+			return
+		}
+		rs.late = time.Since(start) > Wait
+	}
+}
+
+func (rs *replies) bytes() []byte {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.got.Bytes()
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package replay
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"harvey-os.org/ninep/client"
+	"harvey-os.org/ninep/ninetest"
+	"harvey-os.org/ninep/protocol"
+	"harvey-os.org/ninep/tmpfs"
+)
+
+// tarFS returns a tmpfs serving a tree with the file a/f, holding s.
+func tarFS(t *testing.T, s string) protocol.NineServer {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	if err := tw.WriteHeader(&tar.Header{Name: "a/f", Mode: 0644, Size: int64(len(s)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := tmpfs.ReadImageTar(&b)
+	if err != nil {
+		t.Fatalf("ReadImageTar: want nil, got %v", err)
+	}
+	return tmpfs.NewFileServer(a, 8192)
+}
+
+// accept returns a connection to ns.
+func accept(t *testing.T, ns protocol.NineServer) net.Conn {
+	t.Helper()
+	p, err := ninetest.PipeServer(ns)
+	if err != nil {
+		t.Fatalf("PipeServer: want nil, got %v", err)
+	}
+	return p
+}
+
+// capture captures a client reading a/f from a tarFS holding s.
+func capture(t *testing.T, s string) []protocol.CaptureEntry {
+	t.Helper()
+	var b bytes.Buffer
+	ns := tarFS(t, s)
+	l, err := protocol.NewNetListener(func() protocol.NineServer { return ns }, protocol.WithCapture(&b))
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	p, err := ninetest.Pipe(l)
+	if err != nil {
+		t.Fatalf("Pipe: want nil, got %v", err)
+	}
+	c, err := client.NewConn(context.Background(), p, 8192)
+	if err != nil {
+		t.Fatalf("NewConn: want nil, got %v", err)
+	}
+	root, err := c.Attach(context.Background(), "glenda", "")
+	if err != nil {
+		t.Fatalf("Attach: want nil, got %v", err)
+	}
+	f, err := root.Walk("a/f")
+	if err != nil {
+		t.Fatalf("Walk: want nil, got %v", err)
+	}
+	if err := f.Open(protocol.OREAD); err != nil {
+		t.Fatalf("Open: want nil, got %v", err)
+	}
+	got := make([]byte, len(s))
+	if n, err := f.ReadAt(got, 0); n != len(s) || err != nil {
+		t.Fatalf("ReadAt: want (%d, nil), got (%d, %v)", len(s), n, err)
+	}
+	f.Clunk()
+	root.Clunk()
+	c.Close()
+	for start := time.Now(); len(l.Conns()) > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("connection not done with after the client went away")
+		}
+	}
+	es, err := protocol.ReadCapture(&b)
+	if err != nil {
+		t.Fatalf("ReadCapture: want nil, got %v", err)
+	}
+	return es
+}
+
+func TestReplay(t *testing.T) {
+	const s = "what the client read"
+	ss := Sessions(capture(t, s))
+	if len(ss) != 1 {
+		t.Fatalf("Sessions: want one, got %d", len(ss))
+	}
+
+	if err := Serve(ss[0], tarFS(t, s)); err != nil {
+		t.Errorf("Serve to the same tree: want nil, got %v", err)
+	}
+	p := accept(t, tarFS(t, s))
+	if err := Client(ss[0], p); err != nil {
+		t.Errorf("Client to the same tree: want nil, got %v", err)
+	}
+
+	// A file which has changed reads differently.
+	if err := Serve(ss[0], tarFS(t, strings.ToUpper(s))); err == nil || !strings.Contains(err.Error(), "reply") {
+		t.Errorf("Serve to a changed tree: want a difference, got %v", err)
+	}
+	p = accept(t, tarFS(t, strings.ToUpper(s)))
+	if err := Client(ss[0], p); err == nil {
+		t.Errorf("Client to a changed tree: want a difference, got nil")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	e := func(conn uint32, out bool) protocol.CaptureEntry {
+		return protocol.CaptureEntry{Conn: conn, RecordEntry: protocol.RecordEntry{Out: out}}
+	}
+	ss := Sessions([]protocol.CaptureEntry{e(2, false), e(1, false), e(2, true), e(1, true), e(3, false)})
+	if len(ss) != 3 || len(ss[0]) != 2 || len(ss[1]) != 2 || len(ss[2]) != 1 {
+		t.Fatalf("Sessions: want sessions of 2, 2 and 1 entries, got %v", ss)
+	}
+	if ss[1][0].Out || !ss[1][1].Out {
+		t.Errorf("Sessions: want connection 2's entries in order, got %v", ss[1])
+	}
+}
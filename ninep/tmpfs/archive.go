@@ -51,6 +51,9 @@ type File struct {
 	// them as files.
 	isSymlink bool
 	target    string
+	// r, if set, is where the data is, rather than in data: see
+	// IndexImageTar.
+	r *io.SectionReader
 }
 
 func newFile(name string, id uint64, dataSize uint64, isFile bool, accessTime uint32, modTime uint32) *File {
@@ -81,7 +84,7 @@ func (f *File) P9Dir(uname string) *protocol.Dir {
 	d.Mode = 0444
 	d.Atime = f.accessTime
 	d.Mtime = f.modTime
-	d.Length = uint64(len(f.data))
+	d.Length = uint64(f.Size())
 	d.Name = f.Name()
 	d.User = uname
 	d.Group = uname
@@ -90,9 +93,37 @@ func (f *File) P9Dir(uname string) *protocol.Dir {
 
 // Data returns the data for the given file
 func (f *File) Data() []byte {
+	if f.r != nil {
+		b := make([]byte, f.r.Size())
+		n, _ := f.r.ReadAt(b, 0)
+		return b[:n]
+	}
 	return f.data
 }
 
+// Size returns the size of the file's data.
+func (f *File) Size() int64 {
+	if f.r != nil {
+		return f.r.Size()
+	}
+	return int64(len(f.data))
+}
+
+// ReadAt reads the file's data at off into b, as for io.ReaderAt.
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	if f.r != nil {
+		return f.r.ReadAt(b, off)
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
 // Directory describes a directory from a tar
 type Directory struct {
 	name           string
@@ -291,6 +322,66 @@ func ReadImageTar(r io.Reader) (*Archive, error) {
 	return fs, nil
 }
 
+// IndexImageTar reads the headers of the tar file in r, which is size
+// bytes long, to produce an archive whose files are read from r when
+// they are read, rather than being read into memory. r must stay open
+// for as long as the archive is in use. The tar file can't be
+// compressed, or hold sparse files, since their data has to be found
+// at some offset in r.
+func IndexImageTar(r io.ReaderAt, size int64) (*Archive, error) {
+	openTime := time.Now()
+	fs := &Archive{newDirectory("/", nil, openTime, 0), []*Directory{}, []*File{}, openTime}
+	// tar seeks over the data, rather than reading it, since sr is
+	// an io.Seeker.
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	for id := 0; ; id++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isSparse(hdr) {
+			return nil, fmt.Errorf("%q: sparse files can't be indexed", hdr.Name)
+		}
+		// Next has read the header, and no further.
+		off, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		Debug("%q: %d bytes at %d", hdr.Name, hdr.Size, off)
+
+		file := newFile(
+			path.Base(hdr.Name),
+			uint64(id),
+			0,
+			!hdr.FileInfo().IsDir(),
+			uint32(hdr.AccessTime.Unix()),
+			uint32(hdr.ModTime.Unix()))
+		file.r = io.NewSectionReader(r, off, hdr.Size)
+		if err = fs.addFile(hdr.Name, file); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// isSparse reports whether hdr is for a sparse file, in any of the ways
+// GNU tar has of saying so.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
 // ReadImageCpio reads a cpio archive to produce a file hierarchy
 func ReadImageCpio(r io.ReaderAt) (*Archive, error) {
 	cpioReader := cpio.Newc.Reader(r)
@@ -3,10 +3,14 @@ package tmpfs
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 // Create and add some files to the archive.
@@ -122,6 +126,55 @@ func TestReadArchiveTar(t *testing.T) {
 	}
 }
 
+func TestIndexArchiveTar(t *testing.T) {
+	b := createTestImageTar().Bytes()
+	want, err := ReadImageTar(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	arch, err := IndexImageTar(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arch.files) != len(want.files) || len(arch.dirs) != len(want.dirs) {
+		t.Fatalf("IndexImageTar: want %d files and %d dirs, got %d and %d", len(want.files), len(want.dirs), len(arch.files), len(arch.dirs))
+	}
+	for i, f := range arch.files {
+		if f.r == nil {
+			t.Errorf("%q: want data in the tar file, got it in memory", f.name)
+		}
+		if d, w := string(f.Data()), string(want.files[i].Data()); f.name != want.files[i].name || d != w || f.Size() != int64(len(w)) {
+			t.Errorf("%q: want %q, got %q, size %d", f.name, w, d, f.Size())
+		}
+	}
+
+	readme, err := arch.Root().ChildByName("readme.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 8)
+	if n, err := readme.(*File).ReadAt(p, 5); err != nil || string(p[:n]) != "archive " {
+		t.Errorf("ReadAt 5: want (archive , nil), got (%q, %v)", p[:n], err)
+	}
+	if n, err := readme.(*File).ReadAt(p, 36); err != io.EOF || string(p[:n]) != "s." {
+		t.Errorf("ReadAt 36: want (s., EOF), got (%q, %v)", p[:n], err)
+	}
+}
+
+func TestArchiveFS(t *testing.T) {
+	b := createTestImageTar().Bytes()
+	arch, err := IndexImageTar(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(arch, "emptyFile", "readme.txt", "foo/gopher.txt", "bar/todo.txt", "foo/todo2.txt", "abc/123/sean.txt"); err != nil {
+		t.Error(err)
+	}
+	if _, err := arch.Open("foo/nothing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open of foo/nothing: want %v, got %v", fs.ErrNotExist, err)
+	}
+}
+
 func TestReadArchiveCpio(t *testing.T) {
 	Debug = t.Logf
 	f, err := os.Open("test.cpio")
@@ -0,0 +1,140 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tmpfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// Open opens name in a, which makes an Archive an fs.FS, e.g. to serve
+// over HTTP with http.FS. Its files are io.Seekers and io.ReaderAts,
+// and its directories fs.ReadDirFiles.
+func (a *Archive) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	e := Entry(a.root)
+	if name != "." {
+		for _, n := range strings.Split(name, "/") {
+			d, ok := e.(*Directory)
+			if !ok {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			c, err := d.ChildByName(n)
+			if err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			e = c
+		}
+	}
+	return &fsFile{e: e, root: e == Entry(a.root)}, nil
+}
+
+// fsFile is a file or directory opened in an Archive's fs.FS.
+type fsFile struct {
+	e Entry
+	// root is set for the archive's root, which is "." to fs.FS.
+	root bool
+	// off is where the next Read of a file starts, and next is the
+	// next entry for ReadDir of a directory.
+	off  int64
+	next int
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info(), nil
+}
+
+func (f *fsFile) info() *entryInfo {
+	i := &entryInfo{d: f.e.P9Dir("")}
+	if f.root {
+		i.d.Name = "."
+	}
+	return i
+}
+
+func (f *fsFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *fsFile) ReadAt(b []byte, off int64) (int, error) {
+	file, ok := f.e.(*File)
+	if !ok {
+		return 0, &fs.PathError{Op: "read", Path: f.info().Name(), Err: errors.New("is a directory")}
+	}
+	return file.ReadAt(b, off)
+}
+
+func (f *fsFile) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		off += f.off
+	case io.SeekEnd:
+		if file, ok := f.e.(*File); ok {
+			off += file.Size()
+		}
+	default:
+		return 0, fs.ErrInvalid
+	}
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	f.off = off
+	return off, nil
+}
+
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d, ok := f.e.(*Directory)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: f.info().Name(), Err: errors.New("not a directory")}
+	}
+	var des []fs.DirEntry
+	for f.next < d.NumChildren() && (n <= 0 || len(des) < n) {
+		des = append(des, &entryInfo{d: d.Child(f.next).P9Dir("")})
+		f.next++
+	}
+	if n > 0 && len(des) == 0 {
+		return nil, io.EOF
+	}
+	return des, nil
+}
+
+func (f *fsFile) Close() error {
+	return nil
+}
+
+// entryInfo is the fs.FileInfo, and fs.DirEntry, for the protocol.Dir
+// of an entry.
+type entryInfo struct {
+	d *protocol.Dir
+}
+
+func (i *entryInfo) Name() string               { return i.d.Name }
+func (i *entryInfo) Size() int64                { return int64(i.d.Length) }
+func (i *entryInfo) ModTime() time.Time         { return time.Unix(int64(i.d.Mtime), 0) }
+func (i *entryInfo) IsDir() bool                { return i.d.Mode&protocol.DMDIR != 0 }
+func (i *entryInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i *entryInfo) Info() (fs.FileInfo, error) { return i, nil }
+func (i *entryInfo) Sys() interface{}           { return i.d }
+
+func (i *entryInfo) Mode() fs.FileMode {
+	m := fs.FileMode(i.d.Mode & 0777)
+	if i.IsDir() {
+		m |= fs.ModeDir
+	}
+	return m
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tmpfs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+func TestFileServer(t *testing.T) {
+	b := createTestImageTar().Bytes()
+	for _, indexed := range []bool{false, true} {
+		arch, err := ReadImageTar(bytes.NewReader(b))
+		if indexed {
+			arch, err = IndexImageTar(bytes.NewReader(b), int64(len(b)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := NewFileServer(arch, 8192)
+		bg := context.Background()
+		if _, err := fs.Rattach(bg, 0, protocol.NOFID, "glenda", ""); err != nil {
+			t.Fatalf("Rattach: want nil, got %v", err)
+		}
+		if _, err := fs.Rwalk(bg, 0, 1, []string{"foo", "gopher.txt"}); err != nil {
+			t.Fatalf("Rwalk: want nil, got %v", err)
+		}
+		if _, iounit, err := fs.Ropen(bg, 1, protocol.OREAD); err != nil || iounit != 8192 {
+			t.Fatalf("Ropen: want (8192, nil), got (%v, %v)", iounit, err)
+		}
+		for _, tc := range []struct {
+			o    protocol.Offset
+			c    protocol.Count
+			want string
+		}{
+			{0, 6, "Gopher"},
+			{21, 100, "Geoffrey\nGonzo"},
+			{34, 100, "o"},
+			{35, 100, ""},
+			{100, 100, ""},
+		} {
+			if d, err := fs.Rread(bg, 1, tc.o, tc.c); err != nil || string(d) != tc.want {
+				t.Errorf("Rread(%d, %d), indexed %v: want (%q, nil), got (%q, %v)", tc.o, tc.c, indexed, tc.want, d, err)
+			}
+		}
+		if _, _, err := fs.Ropen(bg, 1, protocol.OWRITE); err == nil {
+			t.Errorf("Ropen for writing: want err, got nil")
+		}
+	}
+}
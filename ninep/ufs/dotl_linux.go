@@ -0,0 +1,445 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// 9P2000.L is served on Linux only, where its flags, modes and errnos
+// are those of the host, and can be handed straight to the OS.
+// As for 9P2000.u, we serve files as ourselves, so the gids given for
+// new files are ignored.
+
+const (
+	// openFlags are the open(2) flags we honour in Tlopen and
+	// Tlcreate. The client takes care of O_APPEND itself, and
+	// WriteAt won't work on a file opened with it.
+	openFlags = syscall.O_ACCMODE | syscall.O_TRUNC | syscall.O_SYNC | syscall.O_DSYNC
+
+	atRemoveDir = 0x200 // the unlinkat(2) flag, for Tunlinkat
+
+	// Special values of the nanoseconds given to utimensat(2).
+	utimeNow  = 1<<30 - 1
+	utimeOmit = 1<<30 - 2
+)
+
+// join returns the full name of name in the directory d. The name
+// must be a single path element.
+func join(d *file, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", syscall.EINVAL
+	}
+	return path.Join(d.fullName, name), nil
+}
+
+// lstatQID returns the QID of the file n.
+func (e *FileServer) lstatQID(n string) (protocol.QID, error) {
+	st, err := os.Lstat(n)
+	if err != nil {
+		return protocol.QID{}, err
+	}
+	return e.qid(n, st), nil
+}
+
+// direntType returns the d_type of a Linux dirent for fi.
+func direntType(fi os.FileInfo) uint8 {
+	switch m := fi.Mode(); {
+	case m.IsDir():
+		return syscall.DT_DIR
+	case m&os.ModeSymlink != 0:
+		return syscall.DT_LNK
+	case m&os.ModeNamedPipe != 0:
+		return syscall.DT_FIFO
+	case m&os.ModeSocket != 0:
+		return syscall.DT_SOCK
+	case m&os.ModeCharDevice != 0:
+		return syscall.DT_CHR
+	case m&os.ModeDevice != 0:
+		return syscall.DT_BLK
+	case m.IsRegular():
+		return syscall.DT_REG
+	}
+	return syscall.DT_UNKNOWN
+}
+
+func (e *FileServer) Rlopen(ctx context.Context, fid protocol.FID, flags uint32) (protocol.QID, protocol.MaxSize, error) {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	if f.file != nil {
+		return protocol.QID{}, 0, fmt.Errorf("FID already open")
+	}
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		if err := e.writable(f.fullName); err != nil {
+			return protocol.QID{}, 0, err
+		}
+	}
+	if f.file, err = os.OpenFile(f.fullName, int(flags)&openFlags, 0); err != nil {
+		return protocol.QID{}, 0, err
+	}
+	return f.QID, e.iounit(), nil
+}
+
+func (e *FileServer) Rlcreate(ctx context.Context, fid protocol.FID, name string, flags, mode, gid uint32) (protocol.QID, protocol.MaxSize, error) {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	if f.file != nil {
+		return protocol.QID{}, 0, fmt.Errorf("FID already open")
+	}
+	n, err := join(f, name)
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	if err := e.writable(n); err != nil {
+		return protocol.QID{}, 0, err
+	}
+	of, err := os.OpenFile(n, int(flags)&(openFlags|syscall.O_EXCL)|os.O_CREATE, os.FileMode(mode&0777))
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	q, err := e.lstatQID(n)
+	if err != nil {
+		of.Close()
+		return protocol.QID{}, 0, err
+	}
+	f.fullName = n
+	f.QID = q
+	f.file = of
+	return q, e.iounit(), nil
+}
+
+func (e *FileServer) Rsymlink(ctx context.Context, dfid protocol.FID, name, target string, gid uint32) (protocol.QID, error) {
+	d, err := e.getFile(dfid)
+	if err != nil {
+		return protocol.QID{}, err
+	}
+	n, err := join(d, name)
+	if err != nil {
+		return protocol.QID{}, err
+	}
+	if err := e.writable(n); err != nil {
+		return protocol.QID{}, err
+	}
+	if err := os.Symlink(target, n); err != nil {
+		return protocol.QID{}, err
+	}
+	return e.lstatQID(n)
+}
+
+// Rmknod makes pipes and sockets. As for 9P2000.u, we don't make devices.
+func (e *FileServer) Rmknod(ctx context.Context, dfid protocol.FID, name string, mode, major, minor, gid uint32) (protocol.QID, error) {
+	d, err := e.getFile(dfid)
+	if err != nil {
+		return protocol.QID{}, err
+	}
+	n, err := join(d, name)
+	if err != nil {
+		return protocol.QID{}, err
+	}
+	if err := e.writable(n); err != nil {
+		return protocol.QID{}, err
+	}
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFREG:
+	default:
+		return protocol.QID{}, syscall.EPERM
+	}
+	if err := syscall.Mknod(n, mode, 0); err != nil {
+		return protocol.QID{}, &os.PathError{Op: "mknod", Path: n, Err: err}
+	}
+	return e.lstatQID(n)
+}
+
+func (e *FileServer) Rrename(ctx context.Context, fid, dfid protocol.FID, name string) error {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return err
+	}
+	d, err := e.getFile(dfid)
+	if err != nil {
+		return err
+	}
+	n, err := join(d, name)
+	if err != nil {
+		return err
+	}
+	if err := e.writable(f.fullName, n); err != nil {
+		return err
+	}
+	if err := os.Rename(f.fullName, n); err != nil {
+		return err
+	}
+	f.fullName = n
+	return nil
+}
+
+func (e *FileServer) Rreadlink(ctx context.Context, fid protocol.FID) (string, error) {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(f.fullName)
+}
+
+// Rgetattr always returns the attributes stat(2) does, whatever is asked for.
+func (e *FileServer) Rgetattr(ctx context.Context, fid protocol.FID, mask uint64) (protocol.Attr, error) {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return protocol.Attr{}, err
+	}
+	fi, err := os.Lstat(f.fullName)
+	if err != nil {
+		return protocol.Attr{}, err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	return protocol.Attr{
+		Valid:     protocol.GetattrBasic,
+		QID:       e.qid(f.fullName, fi),
+		Mode:      st.Mode,
+		UID:       st.Uid,
+		GID:       st.Gid,
+		NLink:     uint64(st.Nlink),
+		RDev:      uint64(st.Rdev),
+		Size:      uint64(st.Size),
+		BlkSize:   uint64(st.Blksize),
+		Blocks:    uint64(st.Blocks),
+		ATimeSec:  uint64(st.Atim.Sec),
+		ATimeNSec: uint64(st.Atim.Nsec),
+		MTimeSec:  uint64(st.Mtim.Sec),
+		MTimeNSec: uint64(st.Mtim.Nsec),
+		CTimeSec:  uint64(st.Ctim.Sec),
+		CTimeNSec: uint64(st.Ctim.Nsec),
+	}, nil
+}
+
+// Rsetattr sets the attributes in attr.Valid. The ctime can't be set;
+// it changes along with anything else.
+func (e *FileServer) Rsetattr(ctx context.Context, fid protocol.FID, attr protocol.SetAttr) error {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return err
+	}
+	n := f.fullName
+	if err := e.writable(n); err != nil {
+		return err
+	}
+	if attr.Valid&(protocol.SetattrUID|protocol.SetattrGID) != 0 {
+		uid, gid := -1, -1
+		if attr.Valid&protocol.SetattrUID != 0 {
+			uid = int(attr.UID)
+		}
+		if attr.Valid&protocol.SetattrGID != 0 {
+			gid = int(attr.GID)
+		}
+		if err := os.Lchown(n, uid, gid); err != nil {
+			return err
+		}
+	}
+	// After the chown, which can clear the setuid and setgid bits.
+	if attr.Valid&protocol.SetattrMode != 0 {
+		if err := syscall.Chmod(n, attr.Mode&07777); err != nil {
+			return &os.PathError{Op: "chmod", Path: n, Err: err}
+		}
+	}
+	if attr.Valid&protocol.SetattrSize != 0 {
+		if err := os.Truncate(n, int64(attr.Size)); err != nil {
+			return err
+		}
+	}
+	if attr.Valid&(protocol.SetattrATime|protocol.SetattrMTime) != 0 {
+		ts := []syscall.Timespec{{Nsec: utimeOmit}, {Nsec: utimeOmit}}
+		for i, t := range []struct {
+			set, given uint32
+			sec, nsec  uint64
+		}{
+			{protocol.SetattrATime, protocol.SetattrATimeSet, attr.ATimeSec, attr.ATimeNSec},
+			{protocol.SetattrMTime, protocol.SetattrMTimeSet, attr.MTimeSec, attr.MTimeNSec},
+		} {
+			switch {
+			case attr.Valid&t.set == 0:
+			case attr.Valid&t.given != 0:
+				ts[i] = syscall.NsecToTimespec(int64(t.sec)*1e9 + int64(t.nsec))
+			default:
+				ts[i].Nsec = utimeNow
+			}
+		}
+		if err := syscall.UtimesNano(n, ts); err != nil {
+			return &os.PathError{Op: "utimensat", Path: n, Err: err}
+		}
+	}
+	return nil
+}
+
+// Rxattrwalk is not supported: we don't do extended attributes.
+func (e *FileServer) Rxattrwalk(ctx context.Context, fid, newfid protocol.FID, name string) (uint64, error) {
+	return 0, syscall.EOPNOTSUPP
+}
+
+// Rxattrcreate is not supported: we don't do extended attributes.
+func (e *FileServer) Rxattrcreate(ctx context.Context, fid protocol.FID, name string, size uint64, flags uint32) error {
+	return syscall.EOPNOTSUPP
+}
+
+// Rreaddir reads the directory, like Rread, into the rock when the
+// offset is 0. The offset of each entry is its index in the rock, plus 1.
+func (e *FileServer) Rreaddir(ctx context.Context, fid protocol.FID, offset protocol.Offset, count protocol.Count) ([]byte, error) {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.file == nil {
+		return nil, fmt.Errorf("FID not open")
+	}
+	if offset == 0 || f.rock == nil {
+		if err := resetDir(f); err != nil {
+			return nil, err
+		}
+		if f.rock, err = f.file.Readdir(-1); err != nil {
+			return nil, err
+		}
+	}
+	var b, next bytes.Buffer
+	for i := int(offset); i < len(f.rock); i++ {
+		fi := f.rock[i]
+		next.Reset()
+		protocol.MarshalDirent(&next, protocol.Dirent{
+			QID:    e.qid(path.Join(f.fullName, fi.Name()), fi),
+			Offset: uint64(i + 1),
+			Type:   direntType(fi),
+			Name:   fi.Name(),
+		})
+		if b.Len()+next.Len() > int(count) {
+			break
+		}
+		b.Write(next.Bytes())
+	}
+	return b.Bytes(), nil
+}
+
+func (e *FileServer) Rfsync(ctx context.Context, fid protocol.FID, datasync uint32) error {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return err
+	}
+	if f.file == nil {
+		return fmt.Errorf("FID not open")
+	}
+	if datasync != 0 {
+		return syscall.Fdatasync(int(f.file.Fd()))
+	}
+	return f.file.Sync()
+}
+
+// Rlock grants every lock, without taking it, as QEMU does. The client
+// sees its own locks; other clients of the same files don't.
+func (e *FileServer) Rlock(ctx context.Context, fid protocol.FID, typ uint8, flags uint32, start, length uint64, procID uint32, clientID string) (uint8, error) {
+	if _, err := e.getFile(fid); err != nil {
+		return protocol.LockError, err
+	}
+	return protocol.LockSuccess, nil
+}
+
+// Rgetlock says there is no lock in the way, since Rlock takes none.
+func (e *FileServer) Rgetlock(ctx context.Context, fid protocol.FID, typ uint8, start, length uint64, procID uint32, clientID string) (uint8, uint64, uint64, uint32, string, error) {
+	if _, err := e.getFile(fid); err != nil {
+		return 0, 0, 0, 0, "", err
+	}
+	return protocol.LockTypeUnlck, start, length, procID, clientID, nil
+}
+
+func (e *FileServer) Rlink(ctx context.Context, dfid, fid protocol.FID, name string) error {
+	d, err := e.getFile(dfid)
+	if err != nil {
+		return err
+	}
+	f, err := e.getFile(fid)
+	if err != nil {
+		return err
+	}
+	n, err := join(d, name)
+	if err != nil {
+		return err
+	}
+	if err := e.writable(n); err != nil {
+		return err
+	}
+	return os.Link(f.fullName, n)
+}
+
+func (e *FileServer) Rmkdir(ctx context.Context, dfid protocol.FID, name string, mode, gid uint32) (protocol.QID, error) {
+	d, err := e.getFile(dfid)
+	if err != nil {
+		return protocol.QID{}, err
+	}
+	n, err := join(d, name)
+	if err != nil {
+		return protocol.QID{}, err
+	}
+	if err := e.writable(n); err != nil {
+		return protocol.QID{}, err
+	}
+	if err := syscall.Mkdir(n, mode&07777); err != nil {
+		return protocol.QID{}, &os.PathError{Op: "mkdir", Path: n, Err: err}
+	}
+	return e.lstatQID(n)
+}
+
+func (e *FileServer) Rrenameat(ctx context.Context, olddfid protocol.FID, oldname string, newdfid protocol.FID, newname string) error {
+	od, err := e.getFile(olddfid)
+	if err != nil {
+		return err
+	}
+	nd, err := e.getFile(newdfid)
+	if err != nil {
+		return err
+	}
+	o, err := join(od, oldname)
+	if err != nil {
+		return err
+	}
+	n, err := join(nd, newname)
+	if err != nil {
+		return err
+	}
+	if err := e.writable(o, n); err != nil {
+		return err
+	}
+	return os.Rename(o, n)
+}
+
+func (e *FileServer) Runlinkat(ctx context.Context, dfid protocol.FID, name string, flags uint32) error {
+	d, err := e.getFile(dfid)
+	if err != nil {
+		return err
+	}
+	n, err := join(d, name)
+	if err != nil {
+		return err
+	}
+	if err := e.writable(n); err != nil {
+		return err
+	}
+	if flags&atRemoveDir != 0 {
+		err = syscall.Rmdir(n)
+	} else {
+		err = syscall.Unlink(n)
+	}
+	if err != nil {
+		return &os.PathError{Op: "unlinkat", Path: n, Err: err}
+	}
+	return nil
+}
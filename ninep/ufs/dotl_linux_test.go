@@ -0,0 +1,188 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"testing"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+func TestDotL(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "dotl.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fs := &FileServer{rootPath: tmpdir, IOunit: 8192}
+	var _ protocol.NineServerL = fs
+	bg := context.Background()
+	if _, v, err := fs.Rversion(bg, 8192, protocol.VersionL); err != nil || v != protocol.VersionL {
+		t.Fatalf("Rversion: want (%v, nil), got (%v, %v)", protocol.VersionL, v, err)
+	}
+	if _, err := fs.RattachU(bg, 0, protocol.NOFID, "", "", protocol.NOUID); err != nil {
+		t.Fatalf("RattachU: want nil, got %v", err)
+	}
+
+	// Walking to something that isn't there gives ENOENT, which Linux
+	// needs before it will create it.
+	if _, err := fs.Rwalk(bg, 0, 1, []string{"f"}); !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("Rwalk to nothing: want ENOENT, got %v", err)
+	}
+
+	// Create, write, and look at a file.
+	if _, err := fs.Rwalk(bg, 0, 1, nil); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if _, _, err := fs.Rlcreate(bg, 1, "../f", syscall.O_RDWR, 0644, 0); err == nil {
+		t.Errorf("Rlcreate of ../f: want error, got nil")
+	}
+	q, iounit, err := fs.Rlcreate(bg, 1, "f", syscall.O_RDWR|syscall.O_CREAT|syscall.O_APPEND, 0640, 0)
+	if err != nil || q.Type != protocol.QTFILE || iounit != 8192-protocol.IOHDRSZ {
+		t.Fatalf("Rlcreate: want (file QID, %d, nil), got (%v, %v, %v)", 8192-protocol.IOHDRSZ, q, iounit, err)
+	}
+	if n, err := fs.Rwrite(bg, 1, 0, []byte("hello")); err != nil || n != 5 {
+		t.Fatalf("Rwrite: want (5, nil), got (%v, %v)", n, err)
+	}
+	if err := fs.Rfsync(bg, 1, 1); err != nil {
+		t.Errorf("Rfsync: want nil, got %v", err)
+	}
+	a, err := fs.Rgetattr(bg, 1, protocol.GetattrBasic)
+	if err != nil {
+		t.Fatalf("Rgetattr: want nil, got %v", err)
+	}
+	if a.Mode != syscall.S_IFREG|0640 || a.Size != 5 || a.NLink != 1 || a.QID.Path != q.Path || a.Valid != protocol.GetattrBasic {
+		t.Errorf("Rgetattr: want a 5-byte 0640 file, got %+v", a)
+	}
+
+	err = fs.Rsetattr(bg, 1, protocol.SetAttr{
+		Valid:    protocol.SetattrMode | protocol.SetattrSize | protocol.SetattrMTime | protocol.SetattrMTimeSet,
+		Mode:     0600,
+		Size:     2,
+		MTimeSec: 1000000000,
+	})
+	if err != nil {
+		t.Fatalf("Rsetattr: want nil, got %v", err)
+	}
+	a, err = fs.Rgetattr(bg, 1, protocol.GetattrBasic)
+	if err != nil || a.Mode&0777 != 0600 || a.Size != 2 || a.MTimeSec != 1000000000 || a.MTimeNSec != 0 {
+		t.Errorf("Rgetattr after Rsetattr: want mode 0600, size 2, mtime 1000000000, got (%+v, %v)", a, err)
+	}
+	if err := fs.Rclunk(bg, 1); err != nil {
+		t.Fatalf("Rclunk: want nil, got %v", err)
+	}
+
+	// Directories, links and renames.
+	if q, err := fs.Rmkdir(bg, 0, "d", 0755, 0); err != nil || q.Type != protocol.QTDIR {
+		t.Fatalf("Rmkdir: want (dir QID, nil), got (%v, %v)", q, err)
+	}
+	if _, err := fs.Rmkdir(bg, 0, "d", 0755, 0); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("Rmkdir again: want EEXIST, got %v", err)
+	}
+	if q, err := fs.Rsymlink(bg, 0, "l", "f", 0); err != nil || q.Type != protocol.QTSYMLINK {
+		t.Fatalf("Rsymlink: want (symlink QID, nil), got (%v, %v)", q, err)
+	}
+	if _, err := fs.Rwalk(bg, 0, 2, []string{"l"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if l, err := fs.Rreadlink(bg, 2); err != nil || l != "f" {
+		t.Errorf("Rreadlink: want (f, nil), got (%q, %v)", l, err)
+	}
+	if _, err := fs.Rwalk(bg, 0, 3, []string{"f"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if err := fs.Rlink(bg, 0, 3, "hard"); err != nil {
+		t.Errorf("Rlink: want nil, got %v", err)
+	}
+	if _, err := fs.Rwalk(bg, 0, 4, []string{"d"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if err := fs.Rrename(bg, 3, 4, "g"); err != nil {
+		t.Fatalf("Rrename: want nil, got %v", err)
+	}
+	if l, err := fs.Rreadlink(bg, 2); err != nil || l != "f" {
+		t.Errorf("Rreadlink: want (f, nil), got (%q, %v)", l, err)
+	}
+	if a, err := fs.Rgetattr(bg, 3, protocol.GetattrBasic); err != nil || a.Size != 2 || a.NLink != 2 {
+		t.Errorf("Rgetattr of renamed file: want size 2 and 2 links, got (%+v, %v)", a, err)
+	}
+	if err := fs.Rrenameat(bg, 0, "hard", 4, "h"); err != nil {
+		t.Errorf("Rrenameat: want nil, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(tmpdir, "d", "h")); err != nil {
+		t.Errorf("Rrenameat: d/h is not there: %v", err)
+	}
+	if q, err := fs.Rmknod(bg, 0, "fifo", syscall.S_IFIFO|0600, 0, 0, 0); err != nil || q.Type != protocol.QTFILE {
+		t.Errorf("Rmknod of a fifo: want (file QID, nil), got (%v, %v)", q, err)
+	}
+	if _, err := fs.Rmknod(bg, 0, "null", syscall.S_IFCHR|0600, 1, 3, 0); err == nil {
+		t.Errorf("Rmknod of a device: want error, got nil")
+	}
+
+	// Read the directory, a few entries at a time.
+	if _, err := fs.Rwalk(bg, 0, 5, nil); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if _, _, err := fs.Rlopen(bg, 5, syscall.O_RDONLY|syscall.O_DIRECTORY); err != nil {
+		t.Fatalf("Rlopen: want nil, got %v", err)
+	}
+	var names []string
+	var off protocol.Offset
+	for {
+		b, err := fs.Rreaddir(bg, 5, off, 40)
+		if err != nil {
+			t.Fatalf("Rreaddir: want nil, got %v", err)
+		}
+		if len(b) == 0 {
+			break
+		}
+		for bb := bytes.NewBuffer(b); bb.Len() > 0; {
+			d, err := protocol.UnmarshalDirent(bb)
+			if err != nil {
+				t.Fatalf("UnmarshalDirent: want nil, got %v", err)
+			}
+			if d.Name == "d" && (d.Type != syscall.DT_DIR || d.QID.Type != protocol.QTDIR) {
+				t.Errorf("Dirent for d: want a directory, got %+v", d)
+			}
+			names = append(names, d.Name)
+			off = protocol.Offset(d.Offset)
+		}
+	}
+	sort.Strings(names)
+	if got, want := names, []string{"d", "fifo", "l"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("Rreaddir: want %v, got %v", want, got)
+	}
+
+	if err := fs.Runlinkat(bg, 0, "d", 0); err == nil {
+		t.Errorf("Runlinkat of a directory without AT_REMOVEDIR: want error, got nil")
+	}
+	for _, n := range []string{"d/g", "d/h"} {
+		if err := os.Remove(path.Join(tmpdir, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Runlinkat(bg, 0, "d", atRemoveDir); err != nil {
+		t.Errorf("Runlinkat of d: want nil, got %v", err)
+	}
+	if err := fs.Runlinkat(bg, 0, "l", 0); err != nil {
+		t.Errorf("Runlinkat of l: want nil, got %v", err)
+	}
+	if err := fs.Runlinkat(bg, 0, "l", 0); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Runlinkat of l again: want ENOENT, got %v", err)
+	}
+
+	if _, err := fs.Rxattrwalk(bg, 0, 6, "user.x"); !errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Errorf("Rxattrwalk: want EOPNOTSUPP, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// RattachU is Rattach. We serve files as ourselves, whoever the user is.
+func (e *FileServer) RattachU(ctx context.Context, fid protocol.FID, afid protocol.FID, uname string, aname string, nuname uint32) (protocol.QID, error) {
+	return e.Rattach(ctx, fid, afid, uname, aname)
+}
+
+// RcreateU is Rcreate, but can also make symlinks. We don't make
+// devices, pipes or sockets.
+func (e *FileServer) RcreateU(ctx context.Context, fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode, extension string) (protocol.QID, protocol.MaxSize, error) {
+	switch {
+	case perm&protocol.DMSYMLINK != 0:
+	case perm&(protocol.DMDEVICE|protocol.DMNAMEDPIPE|protocol.DMSOCKET) != 0:
+		return protocol.QID{}, 0, fmt.Errorf("can't create special files")
+	default:
+		return e.Rcreate(ctx, fid, name, perm, mode)
+	}
+
+	f, err := e.getFile(fid)
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	if f.file != nil {
+		return protocol.QID{}, 0, fmt.Errorf("FID already open")
+	}
+	n := path.Join(f.fullName, name)
+	if err := e.writable(n); err != nil {
+		return protocol.QID{}, 0, err
+	}
+	if err := os.Symlink(extension, n); err != nil {
+		return protocol.QID{}, 0, err
+	}
+	_, q, err := e.stat(n)
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	f.fullName = n
+	f.QID = q
+	return q, 0, nil
+}
+
+// marshalStat returns the stat for fi, whose full name is n, in
+// whichever form was negotiated.
+func (e *FileServer) marshalStat(n string, fi os.FileInfo) ([]byte, error) {
+	d, err := dirTo9p2000Dir(fi, e.qid(n, fi))
+	if err != nil {
+		return nil, err
+	}
+	if !e.dotu {
+		return d.Marshal(), nil
+	}
+	du := protocol.DirU{Dir: *d, NMuid: protocol.NOUID}
+	du.NUid, du.NGid = fileInfoToIDs(fi)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		du.Mode |= protocol.DMSYMLINK
+		if du.Extension, err = os.Readlink(n); err != nil {
+			return nil, err
+		}
+	}
+	if fi.Mode()&os.ModeSetuid != 0 {
+		du.Mode |= protocol.DMSETUID
+	}
+	if fi.Mode()&os.ModeSetgid != 0 {
+		du.Mode |= protocol.DMSETGID
+	}
+	return du.Marshal(), nil
+}
+
+// chown changes the numeric owner and group of n, as given in a
+// 9P2000.u Twstat. It reports whether there was anything to change.
+func chown(n string, d protocol.DirU) (bool, error) {
+	if d.NUid == protocol.NOUID && d.NGid == protocol.NOUID {
+		return false, nil
+	}
+	uid, gid := -1, -1
+	if d.NUid != protocol.NOUID {
+		uid = int(d.NUid)
+	}
+	if d.NGid != protocol.NOUID {
+		gid = int(d.NGid)
+	}
+	return true, os.Lchown(n, uid, gid)
+}
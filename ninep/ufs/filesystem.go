@@ -5,7 +5,7 @@
 package ufs
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -23,65 +23,155 @@ type file struct {
 	protocol.QID
 	fullName string
 	file     *os.File
-	// Stash all the directory entries here, use them up one by one,
-	// and reread them each time offset is 0.
-	// 9P2000 requires that a directory read only contain integral
-	// stat entries.
+	// dir frames Treads of a directory into whole stat entries.
+	dir *protocol.DirReader
+	// For Treaddir, stash all the directory entries here, and reread
+	// them each time offset is 0.
 	// rock is Ken's term. You can find it in Harvey in various places.
 	// This approach is not robust when you get to 1 million entries
 	// in a directory, but in our experience, only nuclear scientiests
 	// do stuff like that.
 	rock []os.FileInfo
+	// rclose is set if the file was opened, or made, ORCLOSE, to be
+	// removed when it is clunked.
+	rclose bool
+}
+
+// IsOpen makes a file a protocol.OpenFID, so that an open FID can't be
+// walked.
+func (f *file) IsOpen() bool {
+	return f.file != nil
 }
 
 type FileServer struct {
-	root      *file
 	rootPath  string
 	Versioned bool
-	IOunit    protocol.MaxSize
+	// IOunit, if not 0, caps the iounit Ropen and Rcreate give, which
+	// is otherwise as much as fits in a Tread or Twrite. See iounit.
+	IOunit protocol.MaxSize
+
+	// msize is what the last Tversion settled on, or 0 before one.
+	msize protocol.MaxSize
+
+	// dotu is set if we agreed to speak 9P2000.u.
+	dotu bool
+
+	// oneFS keeps walks on the file system holding rootPath, whose
+	// device is rootDev. See WithOneFilesystem.
+	oneFS   bool
+	rootDev uint64
+
+	// quota, if set, limits the files served. See WithQuota.
+	quota *ninep.Quota
+
+	// qidFunc, if set, makes QIDs in place of fileInfoToQID. See
+	// WithQIDFunc.
+	qidFunc QIDFunc
 
-	// mu guards below
-	mu    sync.Mutex
-	files map[protocol.FID]*file
+	// pathRules, if set, make some subtrees read-only. See
+	// WithPathRules.
+	pathRules []PathRule
+
+	// mu guards rootDev.
+	mu sync.Mutex
+
+	// fids holds a *file for each FID.
+	fids protocol.FIDMap
 }
 
-func stat(s string) (*protocol.Dir, protocol.QID, error) {
+func (e *FileServer) stat(s string) (*protocol.Dir, protocol.QID, error) {
 	var q protocol.QID
 	st, err := os.Lstat(s)
 	if err != nil {
 		return nil, q, fmt.Errorf("does not exist")
 	}
-	d, err := dirTo9p2000Dir(st)
+	q = e.qid(s, st)
+	d, err := dirTo9p2000Dir(st, q)
 	if err != nil {
 		return nil, q, nil
 	}
-	q = fileInfoToQID(st)
 	return d, q, nil
 }
 
-func (e *FileServer) Rversion(msize protocol.MaxSize, version string) (protocol.MaxSize, string, error) {
-	if version != "9P2000" {
-		return 0, "", fmt.Errorf("%v not supported; only 9P2000", version)
+// qid returns the QID of fi, the file whose full name is name: made by
+// qidFunc, if there is one, from its name within the tree served.
+func (e *FileServer) qid(name string, fi os.FileInfo) protocol.QID {
+	if e.qidFunc == nil {
+		return fileInfoToQID(fi)
+	}
+	return e.qidFunc(e.relName(name), fi)
+}
+
+// isDir reports whether name, whose QID is q, can be walked into.
+// Symlinks are followed, since the OS will follow them for us
+// when we join the next element onto the path.
+func isDir(name string, q protocol.QID) bool {
+	if q.Type&protocol.QTDIR != 0 {
+		return true
+	}
+	if q.Type&protocol.QTSYMLINK == 0 {
+		return false
+	}
+	st, err := os.Stat(name)
+	return err == nil && st.IsDir()
+}
+
+func (e *FileServer) Rversion(ctx context.Context, msize protocol.MaxSize, version string) (protocol.MaxSize, string, error) {
+	switch version {
+	case protocol.Version, protocol.VersionU:
+	case protocol.VersionL:
+		// Only on Linux.
+		if _, ok := interface{}(e).(protocol.NineServerL); ok {
+			break
+		}
+		fallthrough
+	default:
+		return 0, "", fmt.Errorf("%v not supported; only %v and %v", version, protocol.Version, protocol.VersionU)
 	}
 	e.Versioned = true
+	e.dotu = version == protocol.VersionU
+	// The Server settles on no more than MSIZE, whatever we say.
+	if msize > protocol.MSIZE {
+		msize = protocol.MSIZE
+	}
+	e.msize = msize
 	return msize, version, nil
 }
 
-func (e *FileServer) getFile(fid protocol.FID) (*file, error) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	f, ok := e.files[fid]
-	if !ok {
-		return nil, fmt.Errorf("does not exist")
+// iounit returns the iounit for a file just opened: the most data a
+// Tread or Twrite can move at once, within msize, or IOunit, if it's
+// set and less. It is 0, which tells the client to work it out, if
+// msize leaves no room for data.
+func (e *FileServer) iounit() protocol.MaxSize {
+	msize := e.msize
+	if msize == 0 {
+		msize = protocol.MSIZE
+	}
+	if msize <= protocol.IOHDRSZ {
+		return 0
 	}
+	n := msize - protocol.IOHDRSZ
+	if e.IOunit != 0 && e.IOunit < n {
+		n = e.IOunit
+	}
+	return n
+}
 
-	return f, nil
+func (e *FileServer) getFile(fid protocol.FID) (*file, error) {
+	f, err := e.fids.Lookup(fid)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*file), nil
 }
 
-func (e *FileServer) Rattach(fid protocol.FID, afid protocol.FID, uname string, aname string) (protocol.QID, error) {
+func (e *FileServer) Rattach(ctx context.Context, fid protocol.FID, afid protocol.FID, uname string, aname string) (protocol.QID, error) {
 	if afid != protocol.NOFID {
 		return protocol.QID{}, fmt.Errorf("We don't do auth attach")
 	}
+	if err := protocol.CheckPeerUser(ctx, uname); err != nil {
+		return protocol.QID{}, err
+	}
 	// There should be no .. or other such junk in the Aname. Clean it up anyway.
 	aname = path.Join("/", aname)
 	aname = path.Join(e.rootPath, aname)
@@ -89,42 +179,86 @@ func (e *FileServer) Rattach(fid protocol.FID, afid protocol.FID, uname string,
 	if err != nil {
 		return protocol.QID{}, err
 	}
+	if e.oneFS {
+		rst, err := os.Stat(e.rootPath)
+		if err != nil {
+			return protocol.QID{}, err
+		}
+		e.mu.Lock()
+		e.rootDev, _ = fileInfoToDev(rst)
+		e.mu.Unlock()
+		if !e.sameFS(st) {
+			return protocol.QID{}, fmt.Errorf("%v is not on the same file system as %v", aname, e.rootPath)
+		}
+	}
 	r := &file{fullName: aname}
-	r.QID = fileInfoToQID(st)
-	e.files[fid] = r
-	e.root = r
+	r.QID = e.qid(aname, st)
+	if err := e.fids.Add(fid, r); err != nil {
+		return protocol.QID{}, err
+	}
 	return r.QID, nil
 }
 
-func (e *FileServer) Rflush(o protocol.Tag) error {
+func (e *FileServer) Rflush(ctx context.Context, o protocol.Tag) error {
 	return nil
 }
 
-func (e *FileServer) Rwalk(fid protocol.FID, newfid protocol.FID, paths []string) ([]protocol.QID, error) {
-	e.mu.Lock()
-	f, ok := e.files[fid]
-	e.mu.Unlock()
-	if !ok {
-		return nil, fmt.Errorf("does not exist")
-	}
-	if len(paths) == 0 {
-		e.mu.Lock()
-		defer e.mu.Unlock()
-		_, ok := e.files[newfid]
-		if ok {
-			return nil, fmt.Errorf("FID in use: clone walk, fid %d newfid %d", fid, newfid)
+func (e *FileServer) Rwalk(ctx context.Context, fid protocol.FID, newfid protocol.FID, paths []string) ([]protocol.QID, error) {
+	var qids []protocol.QID
+	err := e.fids.Walk(fid, newfid, func(v interface{}) (interface{}, error) {
+		f := v.(*file)
+		if len(paths) == 0 {
+			qids = []protocol.QID{}
+			return &file{fullName: f.fullName, QID: f.QID}, nil
+		}
+		// A walk which got only part of the way has no file, and
+		// leaves newfid be.
+		nf, q, err := e.walk(ctx, f, paths)
+		qids = q
+		if nf == nil {
+			return nil, err
 		}
-		nf := *f
-		e.files[newfid] = &nf
-		return []protocol.QID{}, nil
+		return nf, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return qids, nil
+}
+
+// walk walks from f along paths. It returns the file reached, and the
+// QIDs of those walked, or just the QIDs if it got only part of the way.
+func (e *FileServer) walk(ctx context.Context, f *file, paths []string) (*file, []protocol.QID, error) {
+	// You can't walk into a file. The starting fid must be a directory,
+	// and so must every element we pass through on the way.
+	if !isDir(f.fullName, f.QID) {
+		return nil, nil, fmt.Errorf("not a directory")
 	}
 	p := f.fullName
 	q := make([]protocol.QID, len(paths))
 
 	var i int
 	for i = range paths {
+		// Each element is a trip to the file system, which may be slow
+		// (think NFS), so give up as soon as the request is flushed.
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if i > 0 && !isDir(p, q[i-1]) {
+			// Same rules as a failed element below: return the QIDs
+			// walked so far, which includes the file we can't descend.
+			return nil, q[:i], nil
+		}
 		p = path.Join(p, paths[i])
 		st, err := os.Lstat(p)
+		if err == nil && !e.sameFS(st) {
+			// Treat a mount point as a wall: an error if it's the
+			// first element, otherwise the end of the walk.
+			if i == 0 {
+				return nil, nil, fmt.Errorf("%v is on another file system", paths[i])
+			}
+			return nil, q[:i], nil
+		}
 		if err != nil {
 			// From the RFC: If the first element cannot be walked for any
 			// reason, Rerror is returned. Otherwise, the walk will return an
@@ -140,43 +274,41 @@ func (e *FileServer) Rwalk(fid protocol.FID, newfid protocol.FID, paths []string
 			// to sum up: if any walks have succeeded, you return the QIDS for
 			// one more than the last successful walk
 			if i == 0 {
-				return nil, fmt.Errorf("file does not exist")
+				// Keep the errno, which 9P2000.L clients need to
+				// see, but not our path.
+				if pe, ok := err.(*os.PathError); ok {
+					err = pe.Err
+				}
+				return nil, nil, fmt.Errorf("file does not exist: %w", err)
 			}
 			// we only get here if i is > 0 and less than nwname,
 			// so the i should be safe.
-			return q[:i], nil
-		}
-		q[i] = fileInfoToQID(st)
-	}
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	// this is quite unlikely, which is why we don't bother checking for it first.
-	if fid != newfid {
-		if _, ok := e.files[newfid]; ok {
-			return nil, fmt.Errorf("FID in use: walk to %v, fid %v, newfid %v", paths, fid, newfid)
+			return nil, q[:i], nil
 		}
+		q[i] = e.qid(p, st)
 	}
-	e.files[newfid] = &file{fullName: p, QID: q[i]}
-	return q, nil
+	return &file{fullName: p, QID: q[i]}, q, nil
 }
 
-func (e *FileServer) Ropen(fid protocol.FID, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
-	e.mu.Lock()
-	f, ok := e.files[fid]
-	e.mu.Unlock()
-	if !ok {
-		return protocol.QID{}, 0, fmt.Errorf("does not exist")
+func (e *FileServer) Ropen(ctx context.Context, fid protocol.FID, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return protocol.QID{}, 0, err
+	}
+	if m := mode & 3; m == protocol.OWRITE || m == protocol.ORDWR || mode&(protocol.OTRUNC|protocol.ORCLOSE) != 0 {
+		if err := e.writable(f.fullName); err != nil {
+			return protocol.QID{}, 0, err
+		}
 	}
-
-	var err error
 	f.file, err = os.OpenFile(f.fullName, modeToUnixFlags(mode), 0)
 	if err != nil {
 		return protocol.QID{}, 0, err
 	}
+	f.rclose = mode&protocol.ORCLOSE != 0
 
-	return f.QID, e.IOunit, nil
+	return f.QID, e.iounit(), nil
 }
-func (e *FileServer) Rcreate(fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+func (e *FileServer) Rcreate(ctx context.Context, fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
 	f, err := e.getFile(fid)
 	if err != nil {
 		return protocol.QID{}, 0, err
@@ -185,39 +317,50 @@ func (e *FileServer) Rcreate(fid protocol.FID, name string, perm protocol.Perm,
 		return protocol.QID{}, 0, fmt.Errorf("FID already open")
 	}
 	n := path.Join(f.fullName, name)
+	if err := e.writable(n); err != nil {
+		return protocol.QID{}, 0, err
+	}
+	p := os.FileMode(perm) & 0777
+	var of *os.File
 	if perm&protocol.Perm(protocol.DMDIR) != 0 {
-		p := os.FileMode(int(perm) & 0777)
-		err := os.Mkdir(n, p)
-		_, q, err := stat(n)
-		if err != nil {
+		if err := os.Mkdir(n, p); err != nil {
 			return protocol.QID{}, 0, err
 		}
-		f.fullName = n
-		f.QID = q
-		return q, 8000, err
+		// Directories can only be opened for reading.
+		of, err = os.Open(n)
+	} else {
+		// Tcreate of a name that's already there must fail. With
+		// O_EXCL, the file is made and opened in one go, so of any
+		// number of clients creating the same name, one wins, and
+		// nobody can get at the file before it is open.
+		of, err = os.OpenFile(n, modeToUnixFlags(mode)|os.O_CREATE|os.O_EXCL, p)
 	}
-
-	m := modeToUnixFlags(mode) | os.O_CREATE | os.O_TRUNC
-	p := os.FileMode(perm) & 0777
-	of, err := os.OpenFile(n, m, p)
 	if err != nil {
 		return protocol.QID{}, 0, err
 	}
-	_, q, err := stat(n)
+	st, err := of.Stat()
 	if err != nil {
+		of.Close()
 		return protocol.QID{}, 0, err
 	}
+	q := e.qid(n, st)
 	f.fullName = n
 	f.QID = q
 	f.file = of
-	return q, 8000, err
+	f.rclose = mode&protocol.ORCLOSE != 0
+	return q, e.iounit(), nil
 }
-func (e *FileServer) Rclunk(fid protocol.FID) error {
-	_, err := e.clunk(fid)
-	return err
+
+// Rclunk clunks fid, and removes its file if it was opened ORCLOSE.
+func (e *FileServer) Rclunk(ctx context.Context, fid protocol.FID) error {
+	f, err := e.clunk(fid)
+	if err != nil || !f.rclose {
+		return err
+	}
+	return os.Remove(f.fullName)
 }
 
-func (e *FileServer) Rstat(fid protocol.FID) ([]byte, error) {
+func (e *FileServer) Rstat(ctx context.Context, fid protocol.FID) ([]byte, error) {
 	f, err := e.getFile(fid)
 	if err != nil {
 		return []byte{}, err
@@ -226,26 +369,41 @@ func (e *FileServer) Rstat(fid protocol.FID) ([]byte, error) {
 	if err != nil {
 		return []byte{}, fmt.Errorf("ENOENT")
 	}
-	d, err := dirTo9p2000Dir(st)
+	b, err := e.marshalStat(f.fullName, st)
 	if err != nil {
-		return []byte{}, nil
+		return []byte{}, err
 	}
-	var b bytes.Buffer
-	protocol.Marshaldir(&b, *d)
-	return b.Bytes(), nil
+	return b, nil
 }
-func (e *FileServer) Rwstat(fid protocol.FID, b []byte) error {
-	var changed bool
+func (e *FileServer) Rwstat(ctx context.Context, fid protocol.FID, b []byte) error {
 	f, err := e.getFile(fid)
 	if err != nil {
 		return err
 	}
-	dir, err := protocol.Unmarshaldir(bytes.NewBuffer(b))
+	dir := protocol.NullDirU
+	if e.dotu {
+		err = dir.Unmarshal(b)
+	} else {
+		err = dir.Dir.Unmarshal(b)
+	}
 	if err != nil {
 		return err
 	}
-	if dir.Mode != 0xFFFFFFFF {
-		changed = true
+	// A Twstat that changes nothing asks for the file to be
+	// committed to stable storage.
+	if dir.IsNull() {
+		if f.file == nil {
+			return nil
+		}
+		return fsync(f.file)
+	}
+	if err := e.writable(f.fullName); err != nil {
+		return err
+	}
+	if _, err := chown(f.fullName, dir); err != nil {
+		return err
+	}
+	if dir.Mode != protocol.NullDir.Mode {
 		mode := dir.Mode & 0777
 		if err := os.Chmod(f.fullName, os.FileMode(mode)); err != nil {
 			return err
@@ -255,13 +413,11 @@ func (e *FileServer) Rwstat(fid protocol.FID, b []byte) error {
 	// Try to find local uid, gid by name.
 	if dir.User != "" || dir.Group != "" {
 		return fmt.Errorf("Permission denied")
-		changed = true
 	}
 
 	/*
 		if uid != ninep.NOUID || gid != ninep.NOUID {
-			changed = true
-			e := os.Chown(fid.path, int(uid), int(gid))
+				e := os.Chown(fid.path, int(uid), int(gid))
 			if e != nil {
 				req.RespondError(toError(e))
 				return
@@ -270,7 +426,6 @@ func (e *FileServer) Rwstat(fid protocol.FID, b []byte) error {
 	*/
 
 	if dir.Name != "" {
-		changed = true
 		// If we path.Join dir.Name to / before adding it to
 		// the fid path, that ensures nobody gets to walk out of the
 		// root of this server.
@@ -287,6 +442,9 @@ func (e *FileServer) Rwstat(fid protocol.FID, b []byte) error {
 		// If to exists, and to is a directory, we can't do the
 		// rename, since os.Rename will move from into to.
 
+		if err := e.writable(newname); err != nil {
+			return err
+		}
 		st, err := os.Stat(newname)
 		if err == nil && st.IsDir() {
 			return fmt.Errorf("is a directory")
@@ -297,8 +455,7 @@ func (e *FileServer) Rwstat(fid protocol.FID, b []byte) error {
 		f.fullName = newname
 	}
 
-	if dir.Length != 0xFFFFFFFFFFFFFFFF {
-		changed = true
+	if dir.Length != protocol.NullDir.Length {
 		if err := os.Truncate(f.fullName, int64(dir.Length)); err != nil {
 			return err
 		}
@@ -306,10 +463,9 @@ func (e *FileServer) Rwstat(fid protocol.FID, b []byte) error {
 
 	// If either mtime or atime need to be changed, then
 	// we must change both.
-	if dir.Mtime != ^uint32(0) || dir.Atime != ^uint32(0) {
-		changed = true
+	if dir.Mtime != protocol.NullDir.Mtime || dir.Atime != protocol.NullDir.Atime {
 		mt, at := time.Unix(int64(dir.Mtime), 0), time.Unix(int64(dir.Atime), 0)
-		if cmt, cat := (dir.Mtime == ^uint32(0)), (dir.Atime == ^uint32(0)); cmt || cat {
+		if cmt, cat := (dir.Mtime == protocol.NullDir.Mtime), (dir.Atime == protocol.NullDir.Atime); cmt || cat {
 			st, err := os.Stat(f.fullName)
 			if err != nil {
 				return err
@@ -326,20 +482,24 @@ func (e *FileServer) Rwstat(fid protocol.FID, b []byte) error {
 		}
 	}
 
-	if !changed && f.file != nil {
-		f.file.Sync()
-	}
 	return nil
 }
 
+// fsync is (*os.File).Sync; tests replace it to see that it's called.
+var fsync = (*os.File).Sync
+
 func (e *FileServer) clunk(fid protocol.FID) (*file, error) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	f, ok := e.files[fid]
-	if !ok {
-		return nil, fmt.Errorf("does not exist")
+	v, err := e.fids.Clunk(fid)
+	if err != nil {
+		return nil, err
 	}
-	delete(e.files, fid)
+	f := v.(*file)
+	f.close()
+	return f, nil
+}
+
+// close closes f's file, if it is open.
+func (f *file) close() {
 	// What do we do if we can't close it?
 	// All I can think of is to log it.
 	if f.file != nil {
@@ -347,20 +507,36 @@ func (e *FileServer) clunk(fid protocol.FID) (*file, error) {
 			log.Printf("Close of %v failed: %v", f.fullName, err)
 		}
 	}
-	return f, nil
+}
+
+// ConnClosed clunks every FID, closing the files they have open, and
+// removing those opened ORCLOSE, once the connection is done with.
+func (e *FileServer) ConnClosed() {
+	for _, v := range e.fids.ClunkAll() {
+		f := v.(*file)
+		f.close()
+		if f.rclose {
+			if err := os.Remove(f.fullName); err != nil {
+				log.Printf("Remove of %v failed: %v", f.fullName, err)
+			}
+		}
+	}
 }
 
 // Rremove removes the file. The question of whether the file continues to be accessible
 // is system dependent.
-func (e *FileServer) Rremove(fid protocol.FID) error {
+func (e *FileServer) Rremove(ctx context.Context, fid protocol.FID) error {
 	f, err := e.clunk(fid)
 	if err != nil {
 		return err
 	}
+	if err := e.writable(f.fullName); err != nil {
+		return err
+	}
 	return os.Remove(f.fullName)
 }
 
-func (e *FileServer) Rread(fid protocol.FID, o protocol.Offset, c protocol.Count) ([]byte, error) {
+func (e *FileServer) Rread(ctx context.Context, fid protocol.FID, o protocol.Offset, c protocol.Count) ([]byte, error) {
 	f, err := e.getFile(fid)
 	if err != nil {
 		return nil, err
@@ -368,61 +544,154 @@ func (e *FileServer) Rread(fid protocol.FID, o protocol.Offset, c protocol.Count
 	if f.file == nil {
 		return nil, fmt.Errorf("FID not open")
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if f.QID.Type&protocol.QTDIR != 0 {
-		if o == 0 {
-			err := resetDir(f)
-			if err != nil {
-				return nil, err
-			}
-			f.rock, err = f.file.Readdir(-1)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		// We make the assumption that they can always fit at least one
-		// directory entry into a read. If that assumption does not hold
-		// so many things are broken that we can't fix them here.
-		var b = &bytes.Buffer{}
-		for len(f.rock) > 0 {
-			var nextb = &bytes.Buffer{}
-			d9p, err := dirTo9p2000Dir(f.rock[0])
-			if err != nil {
-				return nil, err
-			}
-			protocol.Marshaldir(nextb, *d9p)
-			// Seen on linux clients: sometimes the math is wrong and
-			// they end up asking for the last element with not enough data.
-			// Linux bug or bug with this server? Not sure yet.
-			if nextb.Len()+b.Len() > int(c) {
-				// If b.Len() is > 0, break, since it will fit.
-				// if the entry could not fit, there are not a lot of good answers.
-				// We'll have to drop it?
-				if b.Len() > 0 {
-					break
-				}
-				log.Printf("Warning: Server bug? %v, need %d bytes;count is %d: skipping", d9p, b.Len(), c)
-			} else {
-				if _, err := b.Write(nextb.Bytes()); err != nil {
-					log.Printf("Warning: Could not write %q to stat buffer", f.rock[0])
-				}
-			}
-			f.rock = f.rock[1:]
+		if f.dir == nil {
+			f.dir = &protocol.DirReader{Open: func() (func() ([]byte, error), error) { return e.dirEntries(f) }}
 		}
-		return b.Bytes(), nil
+		return f.dir.Read(o, c)
 	}
 
 	// N.B. even if they ask for 0 bytes on some file systems it is important to pass
 	// through a zero byte read (not Unix, of course).
 	b := make([]byte, c)
-	n, err := f.file.ReadAt(b, int64(o))
+	n, err := readAt(ctx, f.file, b, int64(o))
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
 	return b[:n], nil
 }
 
-func (e *FileServer) Rwrite(fid protocol.FID, o protocol.Offset, b []byte) (protocol.Count, error) {
+// dirEntriesAtOnce is how many directory entries dirEntries reads
+// from the directory at once.
+const dirEntriesAtOnce = 128
+
+// dirEntries starts reading the directory f over, and returns a
+// function which returns its entries one at a time, as stat
+// structures, for a DirReader.
+func (e *FileServer) dirEntries(f *file) (func() ([]byte, error), error) {
+	if err := resetDir(f); err != nil {
+		return nil, err
+	}
+	var fis []os.FileInfo
+	return func() ([]byte, error) {
+		for len(fis) == 0 {
+			var err error
+			fis, err = f.file.Readdir(dirEntriesAtOnce)
+			if len(fis) == 0 {
+				if err == nil {
+					err = io.EOF
+				}
+				return nil, err
+			}
+		}
+		fi := fis[0]
+		fis = fis[1:]
+		return e.marshalStat(path.Join(f.fullName, fi.Name()), fi)
+	}, nil
+}
+
+// ioChunk is the most readAt and writeAt do at once, between checks
+// that the request is still wanted.
+const ioChunk = 256 << 10
+
+// readAt is f.ReadAt, a chunk at a time, so that a big read stops once
+// ctx is done, e.g. because its request has timed out.
+func readAt(ctx context.Context, f *os.File, b []byte, o int64) (int, error) {
+	var n int
+	for first := true; first || n < len(b); first = false {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		m, err := f.ReadAt(b[n:n+chunk(len(b)-n)], o+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writeAt is f.WriteAt, a chunk at a time, as readAt is f.ReadAt. Its
+// count is what was written, even with an error: see pwrite.
+func writeAt(ctx context.Context, f *os.File, b []byte, o int64) (int, error) {
+	var n int
+	for first := true; first || n < len(b); first = false {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		m, err := pwrite(f, b[n:n+chunk(len(b)-n)], o+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func chunk(n int) int {
+	if n > ioChunk {
+		return ioChunk
+	}
+	return n
+}
+
+// RreadInto is Rread, reading straight into b.
+func (e *FileServer) RreadInto(ctx context.Context, fid protocol.FID, o protocol.Offset, b []byte) (int, error) {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return 0, err
+	}
+	if f.file == nil || f.QID.Type&protocol.QTDIR != 0 {
+		// Rread has the errors, and knows how to read directories.
+		d, err := e.Rread(ctx, fid, o, protocol.Count(len(b)))
+		return copy(b, d), err
+	}
+	n, err := readAt(ctx, f.file, b, int64(o))
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// streamMin is the smallest read Rstream streams. Smaller ones aren't
+// worth the extra write to the connection.
+const streamMin = 64 << 10
+
+// Rstream streams big reads of plain files straight from the file. If
+// the file is cut short under it, the connection is closed: see
+// protocol.StreamNineServer.
+func (e *FileServer) Rstream(ctx context.Context, fid protocol.FID, o protocol.Offset, c protocol.Count) (io.Reader, protocol.Count, error) {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return nil, 0, err
+	}
+	if f.file == nil || f.QID.Type&protocol.QTDIR != 0 || c < streamMin {
+		return nil, 0, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	st, err := f.file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, 0, nil
+	}
+	n := st.Size() - int64(o)
+	if n < 0 {
+		n = 0
+	}
+	if n > int64(c) {
+		n = int64(c)
+	}
+	return io.NewSectionReader(f.file, int64(o), n), protocol.Count(n), nil
+}
+
+func (e *FileServer) Rwrite(ctx context.Context, fid protocol.FID, o protocol.Offset, b []byte) (protocol.Count, error) {
 	f, err := e.getFile(fid)
 	if err != nil {
 		return -1, err
@@ -430,26 +699,126 @@ func (e *FileServer) Rwrite(fid protocol.FID, o protocol.Offset, b []byte) (prot
 	if f.file == nil {
 		return -1, fmt.Errorf("FID not open")
 	}
+	// It may have been renamed into a read-only subtree since it
+	// was opened.
+	if err := e.writable(f.fullName); err != nil {
+		return -1, err
+	}
 
 	// N.B. even if they ask for 0 bytes on some file systems it is important to pass
 	// through a zero byte write (not Unix, of course). Also, let the underlying file system
 	// manage the error if the open mode was wrong. No need to duplicate the logic.
 
-	n, err := f.file.WriteAt(b, int64(o))
+	n, err := writeAt(ctx, f.file, b, int64(o))
+	if n > 0 && err != nil {
+		// Some of it was written, e.g. before the disk filled up.
+		// Say how much, as write(2) does: the client writes the rest,
+		// and gets the error then.
+		err = nil
+	}
 	return protocol.Count(n), err
 }
 
+// sameFS reports whether st, found by a walk, may be walked to: with
+// WithOneFilesystem, only if it is on the same device as the root.
+func (e *FileServer) sameFS(st os.FileInfo) bool {
+	if !e.oneFS {
+		return true
+	}
+	dev, ok := fileInfoToDev(st)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !ok || dev == e.rootDev
+}
+
+// Opt is an option for the FileServers a UFS makes, as NetListenerOpt
+// is for its NetListener.
+type Opt func(*FileServer)
+
+// WithOneFilesystem returns an Opt which keeps walks from crossing
+// into other file systems mounted beneath the root, as find -xdev
+// does: a walk stops short of a mount point, or fails if that is its
+// first element. Where files have no device, it does nothing.
+func WithOneFilesystem() Opt {
+	return func(f *FileServer) {
+		f.oneFS = true
+	}
+}
+
+// WithQuota returns an Opt which keeps the total length of the files
+// served within q, which is shared by every connection, as for
+// ninep.QuotaFileServer. Connections then speak 9P2000.u at most.
+// DiskUsage tells how much of q the files already use.
+func WithQuota(q *ninep.Quota) Opt {
+	return func(f *FileServer) {
+		f.quota = q
+	}
+}
+
+// A QIDFunc makes the QID of a file, given its name within the tree
+// served, rooted at "/", and what Lstat says of it. It lets a tree with
+// no inodes, or one with a layout of its own, say what its files are.
+//
+// A QIDFunc must keep to what 9P asks of a QID. Its Path must differ
+// for any two files which exist at the same time, and stay the same
+// for a file for as long as it exists, whichever name it is reached by;
+// a file which is renamed may get a new Path, which clients take to be
+// a new file. Its Version should change whenever the file's contents
+// do, so that clients know to throw away what they have cached. Its
+// Type must have QTDIR set for a directory and QTSYMLINK for a
+// symbolic link, which walks rely on.
+type QIDFunc func(path string, fi os.FileInfo) protocol.QID
+
+// WithQIDFunc returns an Opt which makes QIDs with f. Without it, a
+// QID's Path is the file's inode number, where there is one, and its
+// Version is taken from the time it was last modified.
+func WithQIDFunc(f QIDFunc) Opt {
+	return func(fs *FileServer) {
+		fs.qidFunc = f
+	}
+}
+
+// DefaultQID returns the QID a file gets without a QIDFunc, from what
+// Lstat says of it, for a QIDFunc which only changes part of it.
+func DefaultQID(fi os.FileInfo) protocol.QID {
+	return fileInfoToQID(fi)
+}
+
+// DiskUsage returns the total length of the files under root, as
+// ninep.QuotaFileServer counts them: directories count for nothing.
+func DiskUsage(root string) (int64, error) {
+	var n int64
+	err := filepath.Walk(root, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			n += fi.Size()
+		}
+		return nil
+	})
+	return n, err
+}
+
 func NewUFS(root string, debug int, opts ...protocol.NetListenerOpt) (*protocol.NetListener, error) {
+	return NewUFSWithOpts(root, debug, nil, opts...)
+}
+
+// NewUFSWithOpts is NewUFS, with options for the FileServers too.
+func NewUFSWithOpts(root string, debug int, fsOpts []Opt, opts ...protocol.NetListenerOpt) (*protocol.NetListener, error) {
 	nsCreator := func() protocol.NineServer {
 		f := &FileServer{}
-		f.files = make(map[protocol.FID]*file)
 		f.rootPath = root // for now.
-		f.IOunit = 8192
 
-		// any opts for the ufs layer can be added here too ...
+		for _, o := range fsOpts {
+			o(f)
+		}
 		var d protocol.NineServer = f
+		if f.quota != nil {
+			d = ninep.QuotaNineServer(f, f.quota)
+		}
 		if debug != 0 {
-			d = &ninep.DebugFileServer{FileServer: f}
+			d = &ninep.DebugFileServer{FileServer: d}
 		}
 		return d
 	}
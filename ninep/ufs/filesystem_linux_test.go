@@ -0,0 +1,123 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+func TestOneFilesystem(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "onefs.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	mnt := path.Join(tmpdir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := syscall.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("can't mount a tmpfs: %v", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+	if err := os.Mkdir(path.Join(mnt, "d"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// a/m gets to the mount the long way round.
+	if err := os.Mkdir(path.Join(tmpdir, "a"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Symlink("../mnt", path.Join(tmpdir, "a", "m")); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	bg := context.Background()
+	for _, one := range []bool{false, true} {
+		fs := &FileServer{rootPath: tmpdir}
+		if one {
+			WithOneFilesystem()(fs)
+		}
+		if _, err := fs.Rattach(bg, 0, protocol.NOFID, "", ""); err != nil {
+			t.Fatalf("Rattach: want nil, got %v", err)
+		}
+
+		q, err := fs.Rwalk(bg, 0, 1, []string{"mnt", "d"})
+		if one && err == nil {
+			t.Errorf("Rwalk into the mount with WithOneFilesystem: want err, got %v", q)
+		}
+		if !one && (err != nil || len(q) != 2) {
+			t.Errorf("Rwalk into the mount: want 2 QIDs, got (%v, %v)", q, err)
+		}
+
+		// Stopping at the mount point part way is a short walk.
+		q, err = fs.Rwalk(bg, 0, 2, []string{"a", "m", "d"})
+		if want := map[bool]int{false: 3, true: 2}[one]; err != nil || len(q) != want {
+			t.Errorf("Rwalk(a, m, d), one file system %v: want %d QIDs, got (%v, %v)", one, want, q, err)
+		}
+
+		// Attaching beyond the mount point is refused too.
+		_, err = fs.Rattach(bg, 3, protocol.NOFID, "", "mnt/d")
+		if one != (err != nil) {
+			t.Errorf("Rattach(mnt/d), one file system %v: got %v", one, err)
+		}
+	}
+}
+
+func TestShortWrite(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "full.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	// A file system with room for 16 pages, and no more.
+	const size = 64 << 10
+	if err := syscall.Mount("tmpfs", tmpdir, "tmpfs", 0, "size=64k"); err != nil {
+		t.Skipf("can't mount a tmpfs: %v", err)
+	}
+	defer syscall.Unmount(tmpdir, 0)
+	if err := ioutil.WriteFile(path.Join(tmpdir, "f"), nil, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	fs := &FileServer{rootPath: tmpdir}
+	bg := context.Background()
+	if _, err := fs.Rattach(bg, 0, protocol.NOFID, "", ""); err != nil {
+		t.Fatalf("Rattach: want nil, got %v", err)
+	}
+	if _, err := fs.Rwalk(bg, 0, 1, []string{"f"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if _, _, err := fs.Ropen(bg, 1, protocol.OWRITE); err != nil {
+		t.Fatalf("Ropen: want nil, got %v", err)
+	}
+
+	// More than there is room for: what fits is written, and counted.
+	b := make([]byte, 2*size)
+	n, err := fs.Rwrite(bg, 1, 0, b)
+	if err != nil || n <= 0 || int(n) >= len(b) {
+		t.Fatalf("Rwrite of %d bytes to a full file system: want a short count and nil, got (%d, %v)", len(b), n, err)
+	}
+	fi, err := os.Stat(path.Join(tmpdir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(n) {
+		t.Errorf("Rwrite: said %d bytes, wrote %d", n, fi.Size())
+	}
+
+	// The rest gets the error.
+	if _, err := fs.Rwrite(bg, 1, protocol.Offset(n), b[n:]); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Rwrite of the rest: want %v, got %v", syscall.ENOSPC, err)
+	}
+}
@@ -2,14 +2,21 @@ package ufs
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"harvey-os.org/ninep"
 	"harvey-os.org/ninep/protocol"
 )
 
@@ -315,3 +322,1472 @@ func TestMount(t *testing.T) {
 		t.Fatalf("After remove(%v); stat returns nil, not err", yyy)
 	}
 }
+
+// newClient returns a client that has completed Tversion with a ufs
+// server exporting root.
+func newClient(t *testing.T, root string) *protocol.Client {
+	p, p2 := net.Pipe()
+
+	c, err := protocol.NewClient(func(c *protocol.Client) error {
+		c.FromNet, c.ToNet = p, p
+		c.Msize = 8192
+		c.Trace = t.Logf
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	n, err := NewUFS(root, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Accept(p2); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	if _, _, err := c.CallTversion(8000, "9P2000"); err != nil {
+		t.Fatalf("CallTversion: want nil, got %v", err)
+	}
+	return c
+}
+
+// TestCreateRace has lots of fids create the same names at once.
+// Exactly one create of each should win, and leave its fid open.
+func TestCreateRace(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "create.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fs := &FileServer{rootPath: tmpdir, IOunit: 8192}
+	bg := context.Background()
+	if _, err := fs.Rattach(bg, 0, protocol.NOFID, "", ""); err != nil {
+		t.Fatalf("Rattach: want nil, got %v", err)
+	}
+	for _, perm := range []protocol.Perm{0644, protocol.DMDIR | 0755} {
+		const n = 20
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var won []protocol.FID
+		for i := 1; i <= n; i++ {
+			fid := protocol.FID(i)
+			if _, err := fs.Rwalk(bg, 0, fid, nil); err != nil {
+				t.Fatalf("Rwalk: want nil, got %v", err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mode := protocol.Mode(protocol.ORDWR)
+				if perm&protocol.DMDIR != 0 {
+					mode = protocol.OREAD
+				}
+				q, iounit, err := fs.Rcreate(bg, fid, fmt.Sprintf("x%o", perm), perm, mode)
+				if err != nil {
+					return
+				}
+				if iounit != 8192 {
+					t.Errorf("Rcreate: want iounit 8192, got %v", iounit)
+				}
+				if perm&protocol.DMDIR != 0 && q.Type != protocol.QTDIR {
+					t.Errorf("Rcreate of a directory: want QTDIR, got %v", q)
+				}
+				mu.Lock()
+				won = append(won, fid)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		if len(won) != 1 {
+			t.Fatalf("Rcreate with perm %v: want 1 winner, got %v", perm, won)
+		}
+
+		// The winner's fid is open, and the losers' aren't.
+		if _, err := fs.Rread(bg, won[0], 0, 100); err != nil {
+			t.Errorf("Rread of the new file: want nil, got %v", err)
+		}
+		for i := 1; i <= n; i++ {
+			if fid := protocol.FID(i); fid != won[0] {
+				if _, err := fs.Rread(bg, fid, 0, 100); err == nil {
+					t.Errorf("Rread of fid %d, which lost: want err, got nil", fid)
+				}
+			}
+			if err := fs.Rclunk(bg, protocol.FID(i)); err != nil {
+				t.Fatalf("Rclunk: want nil, got %v", err)
+			}
+		}
+	}
+}
+
+func TestWalkThroughFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "walk.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ioutil.WriteFile(path.Join(tmpdir, "regularfile"), []byte("hi"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	c := newClient(t, tmpdir)
+	if _, err := c.CallTattach(0, protocol.NOFID, "/", ""); err != nil {
+		t.Fatalf("CallTattach: want nil, got %v", err)
+	}
+
+	w, err := c.CallTwalk(0, 1, []string{"regularfile", "child"})
+	if err != nil {
+		t.Fatalf("CallTwalk(0,1,[\"regularfile\", \"child\"]): want nil, got %v", err)
+	}
+	if len(w) != 1 {
+		t.Fatalf("CallTwalk(0,1,[\"regularfile\", \"child\"]): want 1 QID, got %v", w)
+	}
+	if w[0].Type&protocol.QTDIR != 0 {
+		t.Errorf("CallTwalk(0,1,[\"regularfile\", \"child\"]): QID %v is a directory, want a file", w[0])
+	}
+	// A partial walk must not affect newfid.
+	if _, err := c.CallTstat(1); err == nil {
+		t.Errorf("CallTstat(1) after partial walk: want err, got nil")
+	}
+
+	// Walking from a fid that is itself a file is an error.
+	if _, err := c.CallTwalk(0, 2, []string{"regularfile"}); err != nil {
+		t.Fatalf("CallTwalk(0,2,[\"regularfile\"]): want nil, got %v", err)
+	}
+	if w, err := c.CallTwalk(2, 3, []string{"child"}); err == nil {
+		t.Errorf("CallTwalk(2,3,[\"child\"]): want err, got %v", w)
+	}
+}
+
+func TestFIDRules(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "fids.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ioutil.WriteFile(path.Join(tmpdir, "f"), []byte("hi"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	c := newClient(t, tmpdir)
+	if _, err := c.CallTattach(0, protocol.NOFID, "/", ""); err != nil {
+		t.Fatalf("CallTattach: want nil, got %v", err)
+	}
+	if _, err := c.CallTattach(0, protocol.NOFID, "/", ""); !errors.Is(err, protocol.ErrFIDInUse) {
+		t.Errorf("CallTattach to a FID in use: want ErrFIDInUse, got %v", err)
+	}
+	if _, err := c.CallTwalk(0, 1, []string{"f"}); err != nil {
+		t.Fatalf("CallTwalk: want nil, got %v", err)
+	}
+	if _, err := c.CallTwalk(0, 1, nil); !errors.Is(err, protocol.ErrFIDInUse) {
+		t.Errorf("CallTwalk to a FID in use: want ErrFIDInUse, got %v", err)
+	}
+	if _, err := c.CallTwalk(5, 6, nil); !errors.Is(err, protocol.ErrUnknownFID) {
+		t.Errorf("CallTwalk from an unknown FID: want ErrUnknownFID, got %v", err)
+	}
+	if _, _, err := c.CallTopen(1, protocol.OREAD); err != nil {
+		t.Fatalf("CallTopen: want nil, got %v", err)
+	}
+	if _, err := c.CallTwalk(1, 2, nil); !errors.Is(err, protocol.ErrFIDOpen) {
+		t.Errorf("CallTwalk from an open FID: want ErrFIDOpen, got %v", err)
+	}
+	if err := c.CallTclunk(1); err != nil {
+		t.Fatalf("CallTclunk: want nil, got %v", err)
+	}
+	if err := c.CallTclunk(1); !errors.Is(err, protocol.ErrUnknownFID) {
+		t.Errorf("CallTclunk again: want ErrUnknownFID, got %v", err)
+	}
+	// Once clunked, the FID may be used again.
+	if _, err := c.CallTwalk(0, 1, nil); err != nil {
+		t.Errorf("CallTwalk to a clunked FID: want nil, got %v", err)
+	}
+}
+
+func TestDirRead(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "dirread.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	want := make(map[string]bool)
+	for i := 0; i < 300; i++ {
+		n := fmt.Sprintf("%s%d", strings.Repeat("f", i%40), i)
+		if err := ioutil.WriteFile(path.Join(tmpdir, n), nil, 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		want[n] = true
+	}
+
+	c := newClient(t, tmpdir)
+	if _, err := c.CallTattach(0, protocol.NOFID, "/", ""); err != nil {
+		t.Fatalf("CallTattach: want nil, got %v", err)
+	}
+	if _, err := c.CallTwalk(0, 1, nil); err != nil {
+		t.Fatalf("CallTwalk: want nil, got %v", err)
+	}
+	if _, _, err := c.CallTopen(1, protocol.OREAD); err != nil {
+		t.Fatalf("CallTopen: want nil, got %v", err)
+	}
+	// The directory takes many reads, of a few entries each, and each
+	// read is of whole entries. It reads the same from 0 again.
+	for pass := 0; pass < 2; pass++ {
+		got := make(map[string]bool)
+		var o protocol.Offset
+		var reads int
+		for {
+			d, err := c.CallTread(1, o, 300)
+			if err != nil {
+				t.Fatalf("pass %d: CallTread at %d: want nil, got %v", pass, o, err)
+			}
+			if len(d) == 0 {
+				break
+			}
+			reads++
+			o += protocol.Offset(len(d))
+			for b := bytes.NewBuffer(d); b.Len() > 0; {
+				dir, err := protocol.Unmarshaldir(b)
+				if err != nil {
+					t.Fatalf("pass %d: read at %d: not whole entries: %v", pass, o, err)
+				}
+				if got[dir.Name] {
+					t.Errorf("pass %d: %q read twice", pass, dir.Name)
+				}
+				got[dir.Name] = true
+			}
+		}
+		if len(got) != len(want) || reads < 30 {
+			t.Errorf("pass %d: got %d entries in %d reads, want %d in many", pass, len(got), reads, len(want))
+		}
+		for n := range want {
+			if !got[n] {
+				t.Errorf("pass %d: %q not read", pass, n)
+			}
+		}
+		if pass == 0 {
+			if _, err := c.CallTread(1, o-1, 300); err == nil {
+				t.Errorf("CallTread at a bad offset: want err, got nil")
+			}
+		}
+	}
+}
+
+func TestWalkTo(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "walkto.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	// Deeper than one Twalk can go.
+	var names []string
+	for i := 0; i < protocol.MaxWElem+4; i++ {
+		names = append(names, fmt.Sprintf("d%d", i))
+	}
+	deep := path.Join(names...)
+	if err := os.MkdirAll(path.Join(tmpdir, deep), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	c := newClient(t, tmpdir)
+	if _, err := c.CallTattach(0, protocol.NOFID, "/", ""); err != nil {
+		t.Fatalf("CallTattach: want nil, got %v", err)
+	}
+
+	start := protocol.FID(c.FID)
+	fid, q, err := c.WalkTo(0, "/"+deep+"/")
+	if err != nil || len(q) != len(names) {
+		t.Fatalf("WalkTo(0, %q): want %d QIDs, got (%v, %v)", deep, len(names), q, err)
+	}
+	if q[len(q)-1].Type&protocol.QTDIR == 0 {
+		t.Errorf("WalkTo(0, %q): last QID %v is not a directory", deep, q[len(q)-1])
+	}
+	if _, err := c.CallTstat(fid); err != nil {
+		t.Errorf("CallTstat(%d) after WalkTo: want nil, got %v", fid, err)
+	}
+	// The fid the first Twalk made has been clunked.
+	if _, err := c.CallTstat(start + 1); err == nil {
+		t.Errorf("CallTstat(%d) of the intermediate fid: want err, got nil", start+1)
+	}
+
+	// A walk that fails in its second Twalk returns the QIDs it got,
+	// and leaves no fids behind.
+	start = protocol.FID(c.FID)
+	fid, q, err = c.WalkTo(0, deep+"/missing/x")
+	if err == nil || fid != protocol.NOFID || len(q) != len(names) {
+		t.Errorf("WalkTo(0, %q/missing/x): want (NOFID, %d QIDs, err), got (%v, %v, %v)", deep, len(names), fid, q, err)
+	}
+	for f := start + 1; f <= protocol.FID(c.FID); f++ {
+		if _, err := c.CallTstat(f); err == nil {
+			t.Errorf("CallTstat(%d) after failed WalkTo: want err, got nil", f)
+		}
+	}
+
+	// An empty path clones.
+	if fid, q, err := c.WalkTo(0, ""); err != nil || len(q) != 0 || fid == 0 {
+		t.Errorf("WalkTo(0, \"\"): want (new fid, no QIDs, nil), got (%v, %v, %v)", fid, q, err)
+	} else if _, err := c.CallTstat(fid); err != nil {
+		t.Errorf("CallTstat(%d) after clone: want nil, got %v", fid, err)
+	}
+}
+
+func TestCancelledIO(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "cancel.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ioutil.WriteFile(path.Join(tmpdir, "f"), []byte("hi"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	fs := &FileServer{rootPath: tmpdir}
+	bg := context.Background()
+	if _, err := fs.Rattach(bg, 0, protocol.NOFID, "", ""); err != nil {
+		t.Fatalf("Rattach: want nil, got %v", err)
+	}
+	if _, err := fs.Rwalk(bg, 0, 1, []string{"f"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if _, _, err := fs.Ropen(bg, 1, protocol.ORDWR); err != nil {
+		t.Fatalf("Ropen: want nil, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(bg)
+	cancel()
+	if b, err := fs.Rread(ctx, 1, 0, 2); err != context.Canceled {
+		t.Errorf("Rread with cancelled context: want %v, got (%q, %v)", context.Canceled, b, err)
+	}
+	if n, err := fs.Rwrite(ctx, 1, 0, []byte("ho")); err != context.Canceled {
+		t.Errorf("Rwrite with cancelled context: want %v, got (%v, %v)", context.Canceled, n, err)
+	}
+	if q, err := fs.Rwalk(ctx, 0, 2, []string{"f"}); err != context.Canceled {
+		t.Errorf("Rwalk with cancelled context: want %v, got (%v, %v)", context.Canceled, q, err)
+	}
+	if b, err := fs.Rread(bg, 1, 0, 2); err != nil || string(b) != "hi" {
+		t.Errorf("Rread: want (\"hi\", nil), got (%q, %v)", b, err)
+	}
+}
+
+// expiring is a context which is done after its Err has been asked n
+// times.
+type expiring struct {
+	context.Context
+	n int
+}
+
+func (e *expiring) Err() error {
+	if e.n == 0 {
+		return context.DeadlineExceeded
+	}
+	e.n--
+	return nil
+}
+
+func TestExpiredTransfer(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "expire.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	f, err := os.Create(path.Join(tmpdir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// A transfer which runs out of time part way stops after the chunk
+	// it is doing.
+	b := make([]byte, 3*ioChunk)
+	if n, err := writeAt(&expiring{context.Background(), 2}, f, b, 0); n != 2*ioChunk || err != context.DeadlineExceeded {
+		t.Errorf("writeAt: want (%d, %v), got (%d, %v)", 2*ioChunk, context.DeadlineExceeded, n, err)
+	}
+	if n, err := readAt(&expiring{context.Background(), 1}, f, b, 0); n != ioChunk || err != context.DeadlineExceeded {
+		t.Errorf("readAt: want (%d, %v), got (%d, %v)", ioChunk, context.DeadlineExceeded, n, err)
+	}
+	if n, err := readAt(context.Background(), f, b, 0); n != 2*ioChunk || err != io.EOF {
+		t.Errorf("readAt: want (%d, EOF), got (%d, %v)", 2*ioChunk, n, err)
+	}
+	// Even an empty one is passed on.
+	if n, err := writeAt(context.Background(), f, nil, 0); n != 0 || err != nil {
+		t.Errorf("writeAt of nothing: want (0, nil), got (%d, %v)", n, err)
+	}
+}
+
+func TestStatfs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("statfs not supported on %s", runtime.GOOS)
+	}
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "statfs.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	var ns protocol.NineServer = &FileServer{rootPath: tmpdir}
+	s, ok := ns.(protocol.StatfsNineServer)
+	if !ok {
+		t.Fatalf("ufs does not implement protocol.StatfsNineServer")
+	}
+	if _, err := ns.Rattach(context.Background(), 0, protocol.NOFID, "", ""); err != nil {
+		t.Fatalf("Rattach: want nil, got %v", err)
+	}
+	st, err := s.Rstatfs(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("Rstatfs: want nil, got %v", err)
+	}
+	t.Logf("statfs is %+v", st)
+	if st.BSize == 0 || st.Blocks == 0 {
+		t.Errorf("Rstatfs: want non-zero block size and count, got %+v", st)
+	}
+	if st.BFree > st.Blocks || st.BAvail > st.BFree || st.FFree > st.Files {
+		t.Errorf("Rstatfs: free counts exceed totals: %+v", st)
+	}
+	if _, err := s.Rstatfs(context.Background(), 22); err == nil {
+		t.Errorf("Rstatfs(22): want err, got nil")
+	}
+}
+
+func TestDotU(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skipf("no symlinks or numeric IDs on %s", runtime.GOOS)
+	}
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "dotu.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := os.Symlink("target", path.Join(tmpdir, "old")); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	fs := &FileServer{rootPath: tmpdir}
+	bg := context.Background()
+	if _, v, err := fs.Rversion(bg, 8192, protocol.VersionU); err != nil || v != protocol.VersionU {
+		t.Fatalf("Rversion: want (%v, nil), got (%v, %v)", protocol.VersionU, v, err)
+	}
+	if _, err := fs.RattachU(bg, 0, protocol.NOFID, "", "", protocol.NOUID); err != nil {
+		t.Fatalf("RattachU: want nil, got %v", err)
+	}
+
+	// Stat of an existing symlink.
+	if _, err := fs.Rwalk(bg, 0, 1, []string{"old"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	b, err := fs.Rstat(bg, 1)
+	if err != nil {
+		t.Fatalf("Rstat: want nil, got %v", err)
+	}
+	d, err := protocol.UnmarshalDirU(bytes.NewBuffer(b))
+	if err != nil {
+		t.Fatalf("UnmarshalDirU: want nil, got %v", err)
+	}
+	if d.Extension != "target" || d.Mode&protocol.DMSYMLINK == 0 || d.QID.Type&protocol.QTSYMLINK == 0 {
+		t.Errorf("stat of symlink: want extension %q and symlink mode and QID, got %+v", "target", d)
+	}
+	if d.NUid != uint32(os.Getuid()) || d.NGid != uint32(os.Getgid()) {
+		t.Errorf("stat: want uid %d gid %d, got %d %d", os.Getuid(), os.Getgid(), d.NUid, d.NGid)
+	}
+
+	// Making a new one.
+	if _, err := fs.Rwalk(bg, 0, 2, nil); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	q, _, err := fs.RcreateU(bg, 2, "new", protocol.DMSYMLINK|0777, protocol.OREAD, "old")
+	if err != nil {
+		t.Fatalf("RcreateU: want nil, got %v", err)
+	}
+	if q.Type&protocol.QTSYMLINK == 0 {
+		t.Errorf("RcreateU: want a symlink QID, got %v", q)
+	}
+	if l, err := os.Readlink(path.Join(tmpdir, "new")); err != nil || l != "old" {
+		t.Errorf("Readlink: want (old, nil), got (%q, %v)", l, err)
+	}
+	if _, _, err := fs.RcreateU(bg, 0, "dev", protocol.DMDEVICE|0666, protocol.OREAD, "c 1 3"); err == nil {
+		t.Errorf("RcreateU of a device: want error, got nil")
+	}
+
+	// Directory reads have the extensions too.
+	if _, err := fs.Rwalk(bg, 0, 3, nil); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if _, _, err := fs.Ropen(bg, 3, protocol.OREAD); err != nil {
+		t.Fatalf("Ropen: want nil, got %v", err)
+	}
+	b, err = fs.Rread(bg, 3, 0, 8192)
+	if err != nil {
+		t.Fatalf("Rread: want nil, got %v", err)
+	}
+	links := map[string]string{}
+	for rb := bytes.NewBuffer(b); rb.Len() > 0; {
+		d, err := protocol.UnmarshalDirU(rb)
+		if err != nil {
+			t.Fatalf("UnmarshalDirU: want nil, got %v", err)
+		}
+		links[d.Name] = d.Extension
+	}
+	if links["old"] != "target" || links["new"] != "old" {
+		t.Errorf("directory read: want old -> target and new -> old, got %v", links)
+	}
+
+	// Changing ownership to what it already is always works.
+	var wb bytes.Buffer
+	protocol.MarshalDirU(&wb, protocol.DirU{
+		Dir: protocol.Dir{
+			Type:   ^uint16(0),
+			Dev:    ^uint32(0),
+			QID:    protocol.QID{Type: ^uint8(0), Version: ^uint32(0), Path: ^uint64(0)},
+			Mode:   ^uint32(0),
+			Atime:  ^uint32(0),
+			Mtime:  ^uint32(0),
+			Length: ^uint64(0),
+		},
+		NUid:  uint32(os.Getuid()),
+		NGid:  uint32(os.Getgid()),
+		NMuid: protocol.NOUID,
+	})
+	if err := fs.Rwstat(bg, 1, wb.Bytes()); err != nil {
+		t.Errorf("Rwstat: want nil, got %v", err)
+	}
+}
+
+func TestWstatSync(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "wstatsync.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	var synced []string
+	defer func(f func(*os.File) error) { fsync = f }(fsync)
+	fsync = func(f *os.File) error {
+		synced = append(synced, f.Name())
+		return f.Sync()
+	}
+
+	bg := context.Background()
+	for _, dotu := range []bool{false, true} {
+		fs := &FileServer{rootPath: tmpdir, dotu: dotu}
+		if _, err := fs.Rattach(bg, 0, protocol.NOFID, "", ""); err != nil {
+			t.Fatalf("Rattach: want nil, got %v", err)
+		}
+		if _, err := fs.Rwalk(bg, 0, 1, nil); err != nil {
+			t.Fatalf("Rwalk: want nil, got %v", err)
+		}
+		name := fmt.Sprintf("f%v", dotu)
+		if _, _, err := fs.Rcreate(bg, 1, name, 0644, protocol.OWRITE); err != nil {
+			t.Fatalf("Rcreate: want nil, got %v", err)
+		}
+		if _, err := fs.Rwrite(bg, 1, 0, []byte("hello")); err != nil {
+			t.Fatalf("Rwrite: want nil, got %v", err)
+		}
+
+		var b bytes.Buffer
+		d := protocol.Dir{
+			Type:   ^uint16(0),
+			Dev:    ^uint32(0),
+			QID:    protocol.QID{Type: ^uint8(0), Version: ^uint32(0), Path: ^uint64(0)},
+			Mode:   ^uint32(0),
+			Atime:  ^uint32(0),
+			Mtime:  ^uint32(0),
+			Length: ^uint64(0),
+		}
+		if dotu {
+			protocol.MarshalDirU(&b, protocol.DirU{Dir: d, NUid: protocol.NOUID, NGid: protocol.NOUID, NMuid: protocol.NOUID})
+		} else {
+			protocol.Marshaldir(&b, d)
+		}
+		synced = nil
+		if err := fs.Rwstat(bg, 1, b.Bytes()); err != nil {
+			t.Errorf("Rwstat to sync, dotu %v: want nil, got %v", dotu, err)
+		}
+		if want := path.Join(tmpdir, name); len(synced) != 1 || synced[0] != want {
+			t.Errorf("Rwstat to sync, dotu %v: want %v synced, got %v", dotu, want, synced)
+		}
+
+		// Changing something isn't a sync.
+		d.Mode = 0600
+		if dotu {
+			protocol.MarshalDirU(&b, protocol.DirU{Dir: d, NUid: protocol.NOUID, NGid: protocol.NOUID, NMuid: protocol.NOUID})
+		} else {
+			protocol.Marshaldir(&b, d)
+		}
+		synced = nil
+		if err := fs.Rwstat(bg, 1, b.Bytes()); err != nil || len(synced) != 0 {
+			t.Errorf("Rwstat of mode, dotu %v: want nil and no sync, got (%v, %v)", dotu, synced, err)
+		}
+
+		// Nor is there anything to sync if the file isn't open.
+		if _, err := fs.Rwalk(bg, 0, 2, []string{name}); err != nil {
+			t.Fatalf("Rwalk: want nil, got %v", err)
+		}
+		d.Mode = ^uint32(0)
+		if dotu {
+			protocol.MarshalDirU(&b, protocol.DirU{Dir: d, NUid: protocol.NOUID, NGid: protocol.NOUID, NMuid: protocol.NOUID})
+		} else {
+			protocol.Marshaldir(&b, d)
+		}
+		synced = nil
+		if err := fs.Rwstat(bg, 2, b.Bytes()); err != nil || len(synced) != 0 {
+			t.Errorf("Rwstat to sync an unopened file, dotu %v: want nil and no sync, got (%v, %v)", dotu, synced, err)
+		}
+	}
+}
+
+func TestWstatRename(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "wstatrename.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	bg := context.Background()
+	for _, dotu := range []bool{false, true} {
+		from, to := fmt.Sprintf("from%v", dotu), fmt.Sprintf("to%v", dotu)
+		if err := ioutil.WriteFile(path.Join(tmpdir, from), []byte("hello"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Unix(1e9, 0)
+		if err := os.Chtimes(path.Join(tmpdir, from), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		fs := &FileServer{rootPath: tmpdir, dotu: dotu}
+		if _, err := fs.Rattach(bg, 0, protocol.NOFID, "", ""); err != nil {
+			t.Fatalf("Rattach: want nil, got %v", err)
+		}
+		if _, err := fs.Rwalk(bg, 0, 1, []string{from}); err != nil {
+			t.Fatalf("Rwalk: want nil, got %v", err)
+		}
+		var b []byte
+		if dotu {
+			d := protocol.NullDirU
+			d.Name = to
+			b = d.Marshal()
+		} else {
+			d := protocol.NullDir
+			d.Name = to
+			b = d.Marshal()
+		}
+		if err := fs.Rwstat(bg, 1, b); err != nil {
+			t.Fatalf("Rwstat to rename, dotu %v: want nil, got %v", dotu, err)
+		}
+		if _, err := os.Stat(path.Join(tmpdir, from)); !os.IsNotExist(err) {
+			t.Errorf("dotu %v: %s is still there: %v", dotu, from, err)
+		}
+		// Nothing but the name has changed.
+		st, err := os.Stat(path.Join(tmpdir, to))
+		if err != nil {
+			t.Fatalf("dotu %v: %v", dotu, err)
+		}
+		if st.Size() != 5 || st.Mode().Perm() != 0640 || !st.ModTime().Equal(mtime) {
+			t.Errorf("dotu %v: want 5 bytes, mode 0640 and mtime %v, got %d, %v and %v", dotu, mtime, st.Size(), st.Mode().Perm(), st.ModTime())
+		}
+		// And the FID follows the file.
+		sb, err := fs.Rstat(bg, 1)
+		if err != nil {
+			t.Fatalf("Rstat: want nil, got %v", err)
+		}
+		var d protocol.Dir
+		if err := d.Unmarshal(sb); err != nil || d.Name != to || d.Length != 5 {
+			t.Errorf("Rstat after rename, dotu %v: want %s of 5 bytes, got (%v, %v)", dotu, to, d, err)
+		}
+	}
+}
+
+func TestPathRules(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "pathrules.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	for _, d := range []string{"images", "scratch", "imagesx"} {
+		if err := os.Mkdir(path.Join(tmpdir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(tmpdir, "images", "old"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bg := context.Background()
+	for _, rules := range [][]PathRule{
+		{{"/images", true}},
+		{{"/", true}, {"scratch", false}, {"/imagesx", false}},
+	} {
+		fs := &FileServer{rootPath: tmpdir}
+		WithPathRules(rules...)(fs)
+		if _, err := fs.Rattach(bg, 0, protocol.NOFID, "", ""); err != nil {
+			t.Fatalf("Rattach: want nil, got %v", err)
+		}
+		fid := protocol.FID(1)
+		walk := func(names ...string) protocol.FID {
+			fid++
+			if _, err := fs.Rwalk(bg, 0, fid, names); err != nil {
+				t.Fatalf("%v: Rwalk to %v: want nil, got %v", rules, names, err)
+			}
+			return fid
+		}
+
+		for _, tt := range []struct {
+			dir string
+			err error
+		}{
+			{"images", protocol.ErrReadOnly},
+			{"scratch", nil},
+			// A name which starts like a read-only one isn't beneath it.
+			{"imagesx", nil},
+		} {
+			if _, _, err := fs.Rcreate(bg, walk(tt.dir), "x", 0644, protocol.OWRITE); err != tt.err {
+				t.Errorf("%v: Rcreate of /%s/x: want %v, got %v", rules, tt.dir, tt.err, err)
+			}
+			_, err := os.Stat(path.Join(tmpdir, tt.dir, "x"))
+			if made := err == nil; made != (tt.err == nil) {
+				t.Errorf("%v: /%s/x made: %v, want %v", rules, tt.dir, made, tt.err == nil)
+			}
+		}
+
+		// What's read-only can still be read, but not opened for
+		// writing, changed or removed.
+		if _, _, err := fs.Ropen(bg, walk("images", "old"), protocol.OREAD); err != nil {
+			t.Errorf("%v: Ropen of /images/old for reading: want nil, got %v", rules, err)
+		}
+		for _, mode := range []protocol.Mode{protocol.OWRITE, protocol.ORDWR, protocol.OREAD | protocol.OTRUNC} {
+			if _, _, err := fs.Ropen(bg, walk("images", "old"), mode); err != protocol.ErrReadOnly {
+				t.Errorf("%v: Ropen of /images/old, mode %#x: want ErrReadOnly, got %v", rules, mode, err)
+			}
+		}
+		w := protocol.NullDir
+		w.Mode = 0600
+		if err := fs.Rwstat(bg, walk("images", "old"), w.Marshal()); err != protocol.ErrReadOnly {
+			t.Errorf("%v: Rwstat of /images/old: want ErrReadOnly, got %v", rules, err)
+		}
+		if err := fs.Rremove(bg, walk("images", "old")); err != protocol.ErrReadOnly {
+			t.Errorf("%v: Rremove of /images/old: want ErrReadOnly, got %v", rules, err)
+		}
+		// Nor can anything be renamed into it.
+		w = protocol.NullDir
+		w.Name = "/images/y"
+		if err := fs.Rwstat(bg, walk("scratch", "x"), w.Marshal()); err != protocol.ErrReadOnly {
+			t.Errorf("%v: Rwstat renaming /scratch/x to /images/y: want ErrReadOnly, got %v", rules, err)
+		}
+		if b, err := ioutil.ReadFile(path.Join(tmpdir, "images", "old")); err != nil || string(b) != "hello" {
+			t.Errorf("%v: /images/old: want hello, got (%q, %v)", rules, b, err)
+		}
+		if err := fs.Rremove(bg, walk("scratch", "x")); err != nil {
+			t.Errorf("%v: Rremove of /scratch/x: want nil, got %v", rules, err)
+		}
+		os.Remove(path.Join(tmpdir, "imagesx", "x"))
+	}
+}
+
+func TestConnClosed(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "connclosed.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ioutil.WriteFile(path.Join(tmpdir, "f"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileServer{rootPath: tmpdir}
+	l, err := protocol.NewNetListener(func() protocol.NineServer { return fs })
+	if err != nil {
+		t.Fatalf("NewNetListener: want nil, got %v", err)
+	}
+	c, p := net.Pipe()
+	if err := l.Accept(p); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	cl, err := protocol.NewClient(func(cl *protocol.Client) error {
+		cl.FromNet, cl.ToNet = c, c
+		cl.Msize = 8192
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewClient: want nil, got %v", err)
+	}
+	if _, _, err := cl.CallTversion(8192, protocol.Version); err != nil {
+		t.Fatalf("CallTversion: want nil, got %v", err)
+	}
+	if _, err := cl.CallTattach(0, protocol.NOFID, "", ""); err != nil {
+		t.Fatalf("CallTattach: want nil, got %v", err)
+	}
+	if _, err := cl.CallTwalk(0, 1, []string{"f"}); err != nil {
+		t.Fatalf("CallTwalk: want nil, got %v", err)
+	}
+	if _, _, err := cl.CallTopen(1, protocol.OREAD); err != nil {
+		t.Fatalf("CallTopen: want nil, got %v", err)
+	}
+	v, err := fs.fids.Lookup(1)
+	if err != nil {
+		t.Fatalf("Lookup(1): want nil, got %v", err)
+	}
+	f := v.(*file).file
+
+	// The client goes away without a word. By the time the listener
+	// has forgotten the connection, the FIDs have been clunked and the
+	// file closed.
+	c.Close()
+	for start := time.Now(); len(l.Conns()) != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("connection still there 5s after the client went")
+		}
+	}
+	if n := fs.fids.Len(); n != 0 {
+		t.Errorf("FIDs after the connection closed: want 0, got %d", n)
+	}
+	if err := f.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Close of the opened file: want it closed already, got %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "quota.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := os.Mkdir(path.Join(tmpdir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpdir, "d", "old"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	used, err := DiskUsage(tmpdir)
+	if err != nil || used != 100 {
+		t.Fatalf("DiskUsage: want (100, nil), got (%v, %v)", used, err)
+	}
+	q := ninep.NewQuota(1000, used)
+	fs := ninep.QuotaNineServer(&FileServer{rootPath: tmpdir}, q)
+	bg := context.Background()
+	if _, err := fs.Rattach(bg, 0, protocol.NOFID, "", ""); err != nil {
+		t.Fatalf("Rattach: want nil, got %v", err)
+	}
+	if _, err := fs.Rwalk(bg, 0, 1, nil); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if _, _, err := fs.Rcreate(bg, 1, "f", 0644, protocol.ORDWR); err != nil {
+		t.Fatalf("Rcreate: want nil, got %v", err)
+	}
+	truncate := func(fid protocol.FID, l uint64) error {
+		var b bytes.Buffer
+		protocol.Marshaldir(&b, protocol.Dir{
+			Type:   ^uint16(0),
+			Dev:    ^uint32(0),
+			QID:    protocol.QID{Type: ^uint8(0), Version: ^uint32(0), Path: ^uint64(0)},
+			Mode:   ^uint32(0),
+			Atime:  ^uint32(0),
+			Mtime:  ^uint32(0),
+			Length: l,
+		})
+		return fs.Rwstat(bg, fid, b.Bytes())
+	}
+
+	for _, tt := range []struct {
+		o, n int
+		used int64
+		err  error
+	}{
+		{0, 800, 900, nil},
+		{800, 200, 900, protocol.ErrNoSpace},
+		// Overwriting takes no more room.
+		{0, 500, 900, nil},
+		{700, 200, 1000, nil},
+	} {
+		n, err := fs.Rwrite(bg, 1, protocol.Offset(tt.o), make([]byte, tt.n))
+		if !errors.Is(err, tt.err) || (err == nil && int(n) != tt.n) || q.Used() != tt.used {
+			t.Errorf("Rwrite of %d at %d: want (%d, %v) and %d used, got (%d, %v) and %d used", tt.n, tt.o, tt.n, tt.err, tt.used, n, err, q.Used())
+		}
+	}
+
+	// A write which can't be charged for fails.
+	if _, err := fs.Rwrite(bg, 9, 0, make([]byte, 10)); err == nil || q.Used() != 1000 {
+		t.Errorf("Rwrite to an unknown fid: want an error and 1000 used, got %v and %d used", err, q.Used())
+	}
+	// Reads and statfs still go through to the FileServer.
+	if n, err := fs.RreadInto(bg, 1, 0, make([]byte, 10)); err != nil || n != 10 {
+		t.Errorf("RreadInto: want (10, nil), got (%d, %v)", n, err)
+	}
+	if _, err := fs.Rstatfs(bg, 1); err != nil && runtime.GOOS == "linux" {
+		t.Errorf("Rstatfs: want nil, got %v", err)
+	}
+
+	// Once full, nothing more can be made.
+	if _, err := fs.Rwalk(bg, 0, 2, []string{"d"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if _, _, err := fs.Rcreate(bg, 2, "g", 0644, protocol.ORDWR); !errors.Is(err, protocol.ErrNoSpace) {
+		t.Errorf("Rcreate when full: want ErrNoSpace, got %v", err)
+	}
+
+	// Truncating and removing give room back.
+	if err := truncate(1, 2000); !errors.Is(err, protocol.ErrNoSpace) || q.Used() != 1000 {
+		t.Errorf("Rwstat to lengthen f to 2000: want ErrNoSpace and 1000 used, got %v and %d used", err, q.Used())
+	}
+	if err := truncate(1, 300); err != nil || q.Used() != 400 {
+		t.Errorf("Rwstat to truncate f to 300: want nil and 400 used, got %v and %d used", err, q.Used())
+	}
+	if _, err := fs.Rwalk(bg, 0, 3, []string{"d", "old"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if err := fs.Rremove(bg, 3); err != nil || q.Used() != 300 {
+		t.Errorf("Rremove of old: want nil and 300 used, got %v and %d used", err, q.Used())
+	}
+	if used, err := DiskUsage(tmpdir); err != nil || used != q.Used() {
+		t.Errorf("DiskUsage: want (%d, nil), got (%v, %v)", q.Used(), used, err)
+	}
+
+	// So do opening OTRUNC, and clunking a file opened ORCLOSE.
+	if _, err := fs.Rwalk(bg, 0, 4, []string{"f"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if _, _, err := fs.Ropen(bg, 4, protocol.OWRITE|protocol.OTRUNC); err != nil || q.Used() != 0 {
+		t.Errorf("Ropen of f OTRUNC: want nil and 0 used, got %v and %d used", err, q.Used())
+	}
+	if _, err := fs.Rwalk(bg, 0, 5, []string{"d"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if _, _, err := fs.Rcreate(bg, 5, "tmp", 0644, protocol.ORDWR|protocol.ORCLOSE); err != nil {
+		t.Fatalf("Rcreate ORCLOSE: want nil, got %v", err)
+	}
+	if _, err := fs.Rwrite(bg, 5, 0, make([]byte, 200)); err != nil || q.Used() != 200 {
+		t.Errorf("Rwrite to d/tmp: want nil and 200 used, got %v and %d used", err, q.Used())
+	}
+	if err := fs.Rclunk(bg, 5); err != nil || q.Used() != 0 {
+		t.Errorf("Rclunk of d/tmp, opened ORCLOSE: want nil and 0 used, got %v and %d used", err, q.Used())
+	}
+	if _, err := os.Stat(path.Join(tmpdir, "d", "tmp")); !os.IsNotExist(err) {
+		t.Errorf("d/tmp, clunked: want it removed, got %v", err)
+	}
+	if used, err := DiskUsage(tmpdir); err != nil || used != q.Used() {
+		t.Errorf("DiskUsage: want (%d, nil), got (%v, %v)", q.Used(), used, err)
+	}
+}
+
+func TestQIDFunc(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "qid.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := os.Mkdir(path.Join(tmpdir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpdir, "a", "b"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Number the files in the order they are first seen.
+	paths := map[string]uint64{}
+	qf := func(p string, fi os.FileInfo) protocol.QID {
+		if _, ok := paths[p]; !ok {
+			paths[p] = uint64(len(paths) + 1)
+		}
+		return protocol.QID{Path: paths[p], Version: 7, Type: dirToQIDType(fi)}
+	}
+	fs := &FileServer{rootPath: tmpdir}
+	WithQIDFunc(qf)(fs)
+	bg := context.Background()
+	if q, err := fs.Rattach(bg, 0, protocol.NOFID, "", ""); err != nil || q != (protocol.QID{Path: 1, Version: 7, Type: protocol.QTDIR}) {
+		t.Fatalf("Rattach: want QID 1 and nil, got %v and %v", q, err)
+	}
+	qs, err := fs.Rwalk(bg, 0, 1, []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if len(qs) != 2 || qs[0].Path != 2 || qs[0].Type != protocol.QTDIR || qs[1].Path != 3 || qs[1].Type != 0 {
+		t.Errorf("Rwalk: want QIDs 2, a directory, and 3, got %v", qs)
+	}
+	b, err := fs.Rstat(bg, 1)
+	if err != nil {
+		t.Fatalf("Rstat: want nil, got %v", err)
+	}
+	if d, err := protocol.Unmarshaldir(bytes.NewBuffer(b)); err != nil || d.QID.Path != 3 || d.QID.Version != 7 {
+		t.Errorf("Rstat: want QID 3 version 7, got %v, %v", d.QID, err)
+	}
+	if _, err := fs.Rwalk(bg, 0, 2, []string{"a"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if q, _, err := fs.Rcreate(bg, 2, "c", 0644, protocol.ORDWR); err != nil || q.Path != 4 {
+		t.Errorf("Rcreate: want QID 4 and nil, got %v and %v", q, err)
+	}
+	for p, want := range map[string]uint64{"/": 1, "/a": 2, "/a/b": 3, "/a/c": 4} {
+		if paths[p] != want {
+			t.Errorf("QID of %q: want %d, got %d (all: %v)", p, want, paths[p], paths)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "plan9" || runtime.GOOS == "windows" {
+		t.Skipf("no unix sockets on %v", runtime.GOOS)
+	}
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "unix.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ioutil.WriteFile(path.Join(tmpdir, "f"), []byte("over a unix socket"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sock := path.Join(tmpdir, "ufs.sock")
+
+	l, err := NewUFS(tmpdir, 0)
+	if err != nil {
+		t.Fatalf("NewUFS: want nil, got %v", err)
+	}
+	ln, err := protocol.Listen("unix!" + sock)
+	if err != nil {
+		t.Fatalf("Listen: want nil, got %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- l.Serve(ln) }()
+
+	conn, err := protocol.DialAddr("unix!" + sock)
+	if err != nil {
+		t.Fatalf("DialAddr: want nil, got %v", err)
+	}
+	c, err := protocol.NewClient(func(c *protocol.Client) error {
+		c.FromNet, c.ToNet = conn, conn
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewClient: want nil, got %v", err)
+	}
+	if _, _, err := c.CallTversion(8192, protocol.Version); err != nil {
+		t.Fatalf("CallTversion: want nil, got %v", err)
+	}
+	if _, err := c.CallTattach(0, protocol.NOFID, "", ""); err != nil {
+		t.Fatalf("CallTattach: want nil, got %v", err)
+	}
+	fid, _, err := c.WalkTo(0, "f")
+	if err != nil {
+		t.Fatalf("WalkTo(f): want nil, got %v", err)
+	}
+	if _, _, err := c.CallTopen(fid, protocol.OREAD); err != nil {
+		t.Fatalf("CallTopen: want nil, got %v", err)
+	}
+	if b, err := c.CallTread(fid, 0, 100); err != nil || string(b) != "over a unix socket" {
+		t.Errorf("CallTread: want (%q, nil), got (%q, %v)", "over a unix socket", b, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: want nil, got %v", err)
+	}
+	<-served
+	if _, err := os.Lstat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket file after Shutdown: want it gone, got %v", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "stream.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpdir, "f"), data, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	fs := &FileServer{rootPath: tmpdir}
+	var _ protocol.StreamNineServer = fs
+	bg := context.Background()
+	if _, err := fs.Rattach(bg, 0, protocol.NOFID, "", ""); err != nil {
+		t.Fatalf("Rattach: want nil, got %v", err)
+	}
+	if _, err := fs.Rwalk(bg, 0, 1, []string{"f"}); err != nil {
+		t.Fatalf("Rwalk: want nil, got %v", err)
+	}
+	if r, _, err := fs.Rstream(bg, 1, 0, streamMin); r != nil || err != nil {
+		t.Errorf("Rstream of an unopened file: want (nil, nil), got (%v, %v)", r, err)
+	}
+	if _, _, err := fs.Ropen(bg, 1, protocol.OREAD); err != nil {
+		t.Fatalf("Ropen: want nil, got %v", err)
+	}
+	if r, _, err := fs.Rstream(bg, 1, 0, streamMin-1); r != nil || err != nil {
+		t.Errorf("Rstream of a small read: want (nil, nil), got (%v, %v)", r, err)
+	}
+	for _, o := range []int{0, 90000, 100000, 200000} {
+		r, n, err := fs.Rstream(bg, 1, protocol.Offset(o), streamMin)
+		if err != nil || r == nil {
+			t.Fatalf("Rstream at %d: want a reader, got (%v, %v)", o, r, err)
+		}
+		want := data[:0]
+		if o < len(data) {
+			want = data[o:]
+		}
+		if len(want) > streamMin {
+			want = want[:streamMin]
+		}
+		got, err := ioutil.ReadAll(r)
+		if int(n) != len(want) || err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Rstream at %d: want %d bytes, got %d, and read %d (%v)", o, len(want), n, len(got), err)
+		}
+	}
+
+	// And through a connection, in reads big enough to stream.
+	const msize = 1<<17 + protocol.IOHDRSZ
+	p, p2 := net.Pipe()
+	c, err := protocol.NewClient(func(c *protocol.Client) error {
+		c.FromNet, c.ToNet = p, p
+		c.Msize = msize
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	l, err := NewUFS(tmpdir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Accept(p2); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+	if _, _, err := c.CallTversion(msize, "9P2000"); err != nil {
+		t.Fatalf("CallTversion: want nil, got %v", err)
+	}
+	if _, err := c.CallTattach(0, protocol.NOFID, "", ""); err != nil {
+		t.Fatalf("CallTattach: want nil, got %v", err)
+	}
+	if _, err := c.CallTwalk(0, 1, []string{"f"}); err != nil {
+		t.Fatalf("CallTwalk: want nil, got %v", err)
+	}
+	if _, _, err := c.CallTopen(1, protocol.OREAD); err != nil {
+		t.Fatalf("CallTopen: want nil, got %v", err)
+	}
+	var got []byte
+	for {
+		d, err := c.CallTread(1, protocol.Offset(len(got)), 1<<16)
+		if err != nil {
+			t.Fatalf("CallTread at %d: want nil, got %v", len(got), err)
+		}
+		if len(d) == 0 {
+			break
+		}
+		got = append(got, d...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("CallTread: got %d bytes, not the %d in the file", len(got), len(data))
+	}
+}
+
+// TestReadOverMsize reads with a count far bigger than msize, which
+// the server clamps, each way a FileServer can read.
+func TestReadOverMsize(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "clamp.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	data := make([]byte, 300000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpdir, "f"), data, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	const msize = 1<<16 + protocol.IOHDRSZ
+	for _, how := range []string{"stream", "into", "read"} {
+		l, err := protocol.NewNetListener(func() protocol.NineServer {
+			fs := &FileServer{rootPath: tmpdir}
+			switch how {
+			case "into":
+				return intoOnly{fs, fs}
+			case "read":
+				return readOnly{fs}
+			}
+			return fs
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, p2 := net.Pipe()
+		if err := l.Accept(p2); err != nil {
+			t.Fatalf("%s: Accept: want nil, got %v", how, err)
+		}
+		c, err := protocol.NewClient(func(c *protocol.Client) error {
+			c.FromNet, c.ToNet = p, p
+			c.Msize = msize
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.CallTversion(msize, "9P2000"); err != nil {
+			t.Fatalf("%s: CallTversion: want nil, got %v", how, err)
+		}
+		if _, err := c.CallTattach(0, protocol.NOFID, "", ""); err != nil {
+			t.Fatalf("%s: CallTattach: want nil, got %v", how, err)
+		}
+		if _, err := c.CallTwalk(0, 1, []string{"f"}); err != nil {
+			t.Fatalf("%s: CallTwalk: want nil, got %v", how, err)
+		}
+		if _, _, err := c.CallTopen(1, protocol.OREAD); err != nil {
+			t.Fatalf("%s: CallTopen: want nil, got %v", how, err)
+		}
+		var got []byte
+		for {
+			d, err := c.CallTread(1, protocol.Offset(len(got)), 1<<20)
+			if err != nil {
+				t.Fatalf("%s: CallTread at %d: want nil, got %v", how, len(got), err)
+			}
+			if len(d) == 0 {
+				break
+			}
+			// All but the last read fill the Rread.
+			if left := len(data) - len(got); len(d) != 1<<16 && len(d) != left {
+				t.Fatalf("%s: CallTread at %d: got %d bytes, want %d", how, len(got), len(d), 1<<16)
+			}
+			got = append(got, d...)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: CallTread: got %d bytes, not the %d in the file", how, len(got), len(data))
+		}
+		l.Shutdown(context.Background())
+		p.Close()
+	}
+}
+
+// readOnly hides a FileServer's Rstream and RreadInto.
+type readOnly struct {
+	protocol.NineServer
+}
+
+// intoOnly hides a FileServer's Rstream.
+type intoOnly struct {
+	protocol.NineServer
+	protocol.ReadIntoNineServer
+}
+
+// BenchmarkSequentialRead reads a 1GB file, 1MB at a time, streamed
+// and not.
+func BenchmarkSequentialRead(b *testing.B) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "seqread.dir")
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	const size = 1 << 30
+	f, err := os.Create(path.Join(tmpdir, "f"))
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+
+	const msize = 1<<20 + protocol.IOHDRSZ
+	for _, stream := range []bool{true, false} {
+		b.Run(map[bool]string{true: "stream", false: "into"}[stream], func(b *testing.B) {
+			l, err := protocol.NewNetListener(func() protocol.NineServer {
+				fs := &FileServer{rootPath: tmpdir}
+				if stream {
+					return fs
+				}
+				return intoOnly{fs, fs}
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			p, p2 := net.Pipe()
+			if err := l.Accept(p2); err != nil {
+				b.Fatalf("Accept: want nil, got %v", err)
+			}
+			c, err := protocol.NewClient(func(c *protocol.Client) error {
+				c.FromNet, c.ToNet = p, p
+				c.Msize = msize
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := c.CallTversion(msize, "9P2000"); err != nil {
+				b.Fatalf("CallTversion: want nil, got %v", err)
+			}
+			if _, err := c.CallTattach(0, protocol.NOFID, "", ""); err != nil {
+				b.Fatalf("CallTattach: want nil, got %v", err)
+			}
+			if _, err := c.CallTwalk(0, 1, []string{"f"}); err != nil {
+				b.Fatalf("CallTwalk: want nil, got %v", err)
+			}
+			if _, _, err := c.CallTopen(1, protocol.OREAD); err != nil {
+				b.Fatalf("CallTopen: want nil, got %v", err)
+			}
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for o := 0; o < size; o += 1 << 20 {
+					if _, err := c.CallTread(1, protocol.Offset(o), 1<<20); err != nil {
+						b.Fatalf("CallTread: want nil, got %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestIOunit(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "iounit.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ioutil.WriteFile(path.Join(tmpdir, "f"), []byte("iounit"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, tt := range []struct {
+		msize, cap, want protocol.MaxSize
+	}{
+		{4096, 0, 4096 - protocol.IOHDRSZ},
+		{1 << 20, 0, 1<<20 - protocol.IOHDRSZ},
+		{1 << 20, 8192, 8192},
+		{4096, 8192, 4096 - protocol.IOHDRSZ},
+		{protocol.MSIZE + 1000, 0, protocol.MSIZE - protocol.IOHDRSZ},
+	} {
+		l, err := protocol.NewNetListener(func() protocol.NineServer {
+			return &FileServer{rootPath: tmpdir, IOunit: tt.cap}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, p2 := net.Pipe()
+		if err := l.Accept(p2); err != nil {
+			t.Fatalf("Accept: want nil, got %v", err)
+		}
+		c, err := protocol.NewClient(func(c *protocol.Client) error {
+			c.FromNet, c.ToNet = p, p
+			c.Msize = uint32(tt.msize)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.CallTversion(tt.msize, "9P2000"); err != nil {
+			t.Fatalf("CallTversion(%d): want nil, got %v", tt.msize, err)
+		}
+		if _, err := c.CallTattach(0, protocol.NOFID, "", ""); err != nil {
+			t.Fatalf("CallTattach: want nil, got %v", err)
+		}
+		if _, err := c.CallTwalk(0, 1, []string{"f"}); err != nil {
+			t.Fatalf("CallTwalk: want nil, got %v", err)
+		}
+		if _, iounit, err := c.CallTopen(1, protocol.OREAD); err != nil || iounit != tt.want {
+			t.Errorf("msize %d, IOunit %d: CallTopen: want (%d, nil), got (%d, %v)", tt.msize, tt.cap, tt.want, iounit, err)
+		}
+		if _, err := c.CallTwalk(0, 2, nil); err != nil {
+			t.Fatalf("CallTwalk: want nil, got %v", err)
+		}
+		name := fmt.Sprintf("g%d-%d", tt.msize, tt.cap)
+		if _, iounit, err := c.CallTcreate(2, name, 0644, protocol.ORDWR); err != nil || iounit != tt.want {
+			t.Errorf("msize %d, IOunit %d: CallTcreate: want (%d, nil), got (%d, %v)", tt.msize, tt.cap, tt.want, iounit, err)
+		}
+		p.Close()
+	}
+}
+
+// TestOverlappingWrites sends overlapping Twrites on two FIDs without
+// waiting for the replies, so that the server has them all at once.
+// Those on one FID must be done in the order they were sent, so each
+// file ends up as though they were done one at a time.
+func TestOverlappingWrites(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "overlap.dir")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	l, err := NewUFS(tmpdir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, p2 := net.Pipe()
+	defer p.Close()
+	if err := l.Accept(p2); err != nil {
+		t.Fatalf("Accept: want nil, got %v", err)
+	}
+
+	rpc := func(b *bytes.Buffer, want protocol.MType) {
+		t.Helper()
+		if _, err := p.Write(b.Bytes()); err != nil {
+			t.Fatalf("Write: want nil, got %v", err)
+		}
+		if typ := readType(t, p); typ != want {
+			t.Fatalf("reply: want %v, got %v", protocol.RPCNames[want], protocol.RPCNames[typ])
+		}
+	}
+	var b bytes.Buffer
+	protocol.MarshalTversionPkt(&b, protocol.NOTAG, 1<<16, "9P2000")
+	rpc(&b, protocol.Rversion)
+	protocol.MarshalTattachPkt(&b, 1, 0, protocol.NOFID, "", "")
+	rpc(&b, protocol.Rattach)
+	for _, fid := range []protocol.FID{1, 2} {
+		protocol.MarshalTwalkPkt(&b, 1, 0, fid, nil)
+		rpc(&b, protocol.Rwalk)
+		protocol.MarshalTcreatePkt(&b, 1, fid, fmt.Sprint(fid), 0644, protocol.OWRITE)
+		rpc(&b, protocol.Rcreate)
+	}
+
+	const n, size, step = 1000, 16384, 1000
+	want := map[protocol.FID][]byte{1: nil, 2: nil}
+	var all bytes.Buffer
+	for i := 0; i < n; i++ {
+		for fid := range want {
+			// FID 2's writes go backwards.
+			off := i * step
+			if fid == 2 {
+				off = (n - 1 - i) * step
+			}
+			d := bytes.Repeat([]byte{byte(i)}, size)
+			if end := off + size; len(want[fid]) < end {
+				want[fid] = append(want[fid], make([]byte, end-len(want[fid]))...)
+			}
+			copy(want[fid][off:], d)
+			protocol.MarshalTwritePkt(&b, protocol.Tag(2*i+int(fid)), fid, protocol.Offset(off), d)
+			all.Write(b.Bytes())
+		}
+	}
+	read := make(chan error)
+	go func() {
+		for i := 0; i < 2*n; i++ {
+			if typ := readType(t, p); typ != protocol.Rwrite {
+				read <- fmt.Errorf("reply %d: want Rwrite, got %v", i, protocol.RPCNames[typ])
+				return
+			}
+		}
+		read <- nil
+	}()
+	if _, err := p.Write(all.Bytes()); err != nil {
+		t.Fatalf("Write: want nil, got %v", err)
+	}
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+	for fid, w := range want {
+		got, err := ioutil.ReadFile(path.Join(tmpdir, fmt.Sprint(fid)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, w) {
+			t.Errorf("file %d: not as the writes, done in order, would leave it", fid)
+		}
+	}
+}
+
+// readType reads a message from r, and returns its type.
+func readType(t *testing.T, r io.Reader) protocol.MType {
+	var h [7]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		t.Errorf("reading reply: %v", err)
+		return 0
+	}
+	sz := int64(h[0]) | int64(h[1])<<8 | int64(h[2])<<16 | int64(h[3])<<24
+	if _, err := io.CopyN(ioutil.Discard, r, sz-7); err != nil {
+		t.Errorf("reading reply: %v", err)
+	}
+	return protocol.MType(h[4])
+}
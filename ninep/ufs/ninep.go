@@ -65,9 +65,9 @@ func dirTo9p2000Mode(d os.FileInfo) uint32 {
 	return ret
 }
 
-func dirTo9p2000Dir(fi os.FileInfo) (*protocol.Dir, error) {
+func dirTo9p2000Dir(fi os.FileInfo, q protocol.QID) (*protocol.Dir, error) {
 	d := &protocol.Dir{}
-	d.QID = fileInfoToQID(fi)
+	d.QID = q
 	d.Mode = dirTo9p2000Mode(fi)
 	// TODO: use info on systems that have it.
 	d.Atime = uint32(fi.ModTime().Unix()) // uint32(atime(sysMode).Unix())
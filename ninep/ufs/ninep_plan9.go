@@ -27,3 +27,17 @@ func fileInfoToQID(d os.FileInfo) protocol.QID {
 		Type:    dirToQIDType(d),
 	}
 }
+
+// fileInfoToIDs returns NOUID: there are no numeric user IDs here.
+func fileInfoToIDs(d os.FileInfo) (uid, gid uint32) {
+	return protocol.NOUID, protocol.NOUID
+}
+
+// fileInfoToDev returns the device holding a file: its type and
+// instance, as in #s/0 or #c/1.
+func fileInfoToDev(d os.FileInfo) (uint64, bool) {
+	if stat, ok := d.Sys().(*syscall.Dir); ok {
+		return uint64(stat.Type)<<32 | uint64(stat.Dev), true
+	}
+	return 0, false
+}
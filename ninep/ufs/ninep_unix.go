@@ -32,3 +32,19 @@ func fileInfoToQID(d os.FileInfo) protocol.QID {
 
 	return qid
 }
+
+// fileInfoToIDs returns the numeric owner and group of a file.
+func fileInfoToIDs(d os.FileInfo) (uid, gid uint32) {
+	if stat, ok := d.Sys().(*syscall.Stat_t); ok {
+		return stat.Uid, stat.Gid
+	}
+	return protocol.NOUID, protocol.NOUID
+}
+
+// fileInfoToDev returns the device holding a file.
+func fileInfoToDev(d os.FileInfo) (uint64, bool) {
+	if stat, ok := d.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), true
+	}
+	return 0, false
+}
@@ -23,3 +23,13 @@ func fileInfoToQID(d os.FileInfo) protocol.QID {
 
 	return qid
 }
+
+// fileInfoToIDs returns NOUID: there are no numeric user IDs here.
+func fileInfoToIDs(d os.FileInfo) (uid, gid uint32) {
+	return protocol.NOUID, protocol.NOUID
+}
+
+// fileInfoToDev returns false: we don't know which device holds a file.
+func fileInfoToDev(d os.FileInfo) (uint64, bool) {
+	return 0, false
+}
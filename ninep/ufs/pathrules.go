@@ -0,0 +1,80 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// A PathRule says whether the files at and beneath Path, a name within
+// the tree served, rooted at "/", may be changed.
+type PathRule struct {
+	Path     string
+	ReadOnly bool
+}
+
+// WithPathRules returns an Opt which serves some subtrees read-only and
+// others writable. Of the rules whose Path holds a file, the one with
+// the longest Path says which it is; a file no rule holds is writable.
+// So
+//
+//	WithPathRules(PathRule{"/", true}, PathRule{"/scratch", false})
+//
+// serves everything read-only but /scratch. Opening a read-only file
+// for writing, creating, removing, writing or changing one, or
+// renaming one to or from a read-only name, fails with
+// protocol.ErrReadOnly.
+func WithPathRules(rules ...PathRule) Opt {
+	return func(f *FileServer) {
+		for _, r := range rules {
+			r.Path = path.Join("/", r.Path)
+			f.pathRules = append(f.pathRules, r)
+		}
+	}
+}
+
+// relName returns the name within the tree served, rooted at "/", of
+// the file whose full name is name.
+func (e *FileServer) relName(name string) string {
+	rel, err := filepath.Rel(e.rootPath, name)
+	if err != nil {
+		rel = name
+	}
+	return path.Join("/", filepath.ToSlash(rel))
+}
+
+// readOnly reports whether the file whose full name is name is held by
+// a read-only PathRule.
+func (e *FileServer) readOnly(name string) bool {
+	if len(e.pathRules) == 0 {
+		return false
+	}
+	n := e.relName(name)
+	ro, best := false, -1
+	for _, r := range e.pathRules {
+		if len(r.Path) <= best {
+			continue
+		}
+		if r.Path == "/" || n == r.Path || strings.HasPrefix(n, r.Path+"/") {
+			ro, best = r.ReadOnly, len(r.Path)
+		}
+	}
+	return ro
+}
+
+// writable returns protocol.ErrReadOnly if any of names, full names of
+// files, is read-only.
+func (e *FileServer) writable(names ...string) error {
+	for _, n := range names {
+		if e.readOnly(n) {
+			return protocol.ErrReadOnly
+		}
+	}
+	return nil
+}
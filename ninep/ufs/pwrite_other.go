@@ -0,0 +1,16 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package ufs
+
+import "os"
+
+// pwrite is f.WriteAt. Here a write which comes up short before an
+// error counts for nothing.
+func pwrite(f *os.File, b []byte, off int64) (int, error) {
+	return f.WriteAt(b, off)
+}
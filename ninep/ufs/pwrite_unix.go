@@ -0,0 +1,51 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package ufs
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// pwrite is f.WriteAt, but for the count it returns with an error,
+// which is what was written: f.WriteAt gives 0 with the error once a
+// write has come up short and the next one failed, as on a full disk.
+func pwrite(f *os.File, b []byte, off int64) (int, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return f.WriteAt(b, off)
+	}
+	var n int
+	var werr error
+	err = rc.Write(func(fd uintptr) bool {
+		for n < len(b) {
+			m, err := syscall.Pwrite(int(fd), b[n:], off+int64(n))
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				werr = err
+				break
+			}
+			if m == 0 {
+				werr = io.ErrUnexpectedEOF
+				break
+			}
+			n += m
+		}
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+	if werr != nil {
+		return n, &os.PathError{Op: "write", Path: f.Name(), Err: werr}
+	}
+	return n, nil
+}
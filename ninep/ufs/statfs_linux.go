@@ -0,0 +1,35 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"context"
+	"syscall"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// Rstatfs describes the file system holding fid.
+func (e *FileServer) Rstatfs(ctx context.Context, fid protocol.FID) (protocol.Statfs, error) {
+	f, err := e.getFile(fid)
+	if err != nil {
+		return protocol.Statfs{}, err
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(f.fullName, &st); err != nil {
+		return protocol.Statfs{}, err
+	}
+	return protocol.Statfs{
+		Type:    uint32(st.Type),
+		BSize:   uint32(st.Bsize),
+		Blocks:  st.Blocks,
+		BFree:   st.Bfree,
+		BAvail:  st.Bavail,
+		Files:   st.Files,
+		FFree:   st.Ffree,
+		FSID:    uint64(uint32(st.Fsid.X__val[0])) | uint64(uint32(st.Fsid.X__val[1]))<<32,
+		NameLen: uint32(st.Namelen),
+	}, nil
+}
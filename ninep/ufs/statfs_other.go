@@ -0,0 +1,22 @@
+// Copyright 2021 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package ufs
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"harvey-os.org/ninep/protocol"
+)
+
+// Rstatfs describes the file system holding fid. It is only
+// implemented on Linux.
+func (e *FileServer) Rstatfs(ctx context.Context, fid protocol.FID) (protocol.Statfs, error) {
+	return protocol.Statfs{}, fmt.Errorf("statfs not supported on %s", runtime.GOOS)
+}